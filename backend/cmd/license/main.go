@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/mlaitechio/vagais/pkg/license"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Println("Usage: go run ./cmd/license [keygen|verify]")
+		os.Exit(1)
+	}
+
+	switch os.Args[1] {
+	case "keygen":
+		keygen()
+	case "verify":
+		verify(os.Args[2:])
+	default:
+		fmt.Printf("Unknown command: %s\n", os.Args[1])
+		fmt.Println("Available commands: keygen, verify")
+		os.Exit(1)
+	}
+}
+
+// keygen prints a new signing key pair
+func keygen() {
+	publicKey, privateKey, err := license.GenerateKey()
+	if err != nil {
+		log.Fatalf("Failed to generate key: %v", err)
+	}
+	fmt.Printf("LICENSE_SIGNING_KEY=%s\n", license.EncodeKey(privateKey.Seed()))
+	fmt.Printf("Public key: %s\n", license.EncodeKey(publicKey))
+}
+
+// verify checks a license key offline, the way an air-gapped install would
+func verify(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	publicKeyFlag := flags.String("public-key", "", "base64 Ed25519 public key of the issuer")
+	keyFile := flags.String("license", "", "file containing the license key")
+	revocationsFile := flags.String("revocations", "", "file containing a signed revocation list")
+	agentID := flags.String("agent", "", "agent the license must cover")
+	hardwareID := flags.String("hardware-id", "", "hardware ID of this machine")
+	flags.Parse(args)
+
+	if *publicKeyFlag == "" || *keyFile == "" {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	publicKey, err := license.ParsePublicKey(*publicKeyFlag)
+	if err != nil {
+		log.Fatalf("Invalid public key: %v", err)
+	}
+	key, err := os.ReadFile(*keyFile)
+	if err != nil {
+		log.Fatalf("Failed to read license: %v", err)
+	}
+
+	verifier := license.NewVerifier(publicKey)
+	if *revocationsFile != "" {
+		list, err := os.ReadFile(*revocationsFile)
+		if err != nil {
+			log.Fatalf("Failed to read revocation list: %v", err)
+		}
+		if err := verifier.SetRevocations(strings.TrimSpace(string(list))); err != nil {
+			log.Fatalf("Invalid revocation list: %v", err)
+		}
+	}
+
+	result, err := verifier.Verify(string(key), license.Check{AgentID: *agentID, HardwareID: *hardwareID})
+	if err != nil {
+		fmt.Printf("❌ License invalid: %v\n", err)
+		os.Exit(1)
+	}
+
+	claims, _ := json.MarshalIndent(result, "", "  ")
+	if result.InGrace {
+		fmt.Printf("⚠️  License expired and is in its grace period until %s\n", result.GraceEndsAt.Format("2006-01-02"))
+	} else {
+		fmt.Println("✅ License valid")
+	}
+	fmt.Println(string(claims))
+}
@@ -77,9 +77,38 @@ func runMigrations(db *gorm.DB) error {
 		&models.Agent{},
 		&models.Review{},
 		&models.Execution{},
+		&models.ExecutionJob{},
+		&models.ExecutionStep{},
+		&models.CreditTransaction{},
+		&models.Purchase{},
+		&models.Entitlement{},
+		&models.PaymentCustomer{},
+		&models.PaymentMethod{},
+		&models.PaymentTransaction{},
+		&models.PaymentEvent{},
+		&models.Invoice{},
+		&models.InvoiceLine{},
+		&models.CreatorEarning{},
+		&models.CreatorPayout{},
+		&models.License{},
+		&models.APIKey{},
+		&models.RefreshToken{},
+		&models.RevokedAccessToken{},
+		&models.Session{},
+		&models.MFARecoveryCode{},
+		&models.MFAChallenge{},
+		&models.SSOConnection{},
+		&models.SSOIdentity{},
+		&models.SSOAuthRequest{},
+		&models.SCIMToken{},
+		&models.SCIMGroup{},
+		&models.SCIMGroupMember{},
+		&models.EmailLog{},
 		&models.Webhook{},
 		&models.Notification{},
 		&models.LLMProvider{},
+		&models.Conversation{},
+		&models.Message{},
 	); err != nil {
 		fmt.Printf("[ERROR] Migration failed: %v\n", err)
 		return fmt.Errorf("failed to run migrations: %v", err)
@@ -116,8 +145,37 @@ func resetDatabase(db *gorm.DB) error {
 	fmt.Println("Resetting database...")
 	fmt.Println("Dropping all tables...")
 	if err := db.Migrator().DropTable(
+		&models.Message{},
+		&models.Conversation{},
 		&models.Notification{},
 		&models.Webhook{},
+		&models.EmailLog{},
+		&models.SCIMGroupMember{},
+		&models.SCIMGroup{},
+		&models.SCIMToken{},
+		&models.SSOAuthRequest{},
+		&models.SSOIdentity{},
+		&models.SSOConnection{},
+		&models.MFAChallenge{},
+		&models.MFARecoveryCode{},
+		&models.Session{},
+		&models.RevokedAccessToken{},
+		&models.RefreshToken{},
+		&models.APIKey{},
+		&models.License{},
+		&models.CreatorPayout{},
+		&models.CreatorEarning{},
+		&models.InvoiceLine{},
+		&models.Invoice{},
+		&models.PaymentEvent{},
+		&models.PaymentTransaction{},
+		&models.PaymentMethod{},
+		&models.PaymentCustomer{},
+		&models.Entitlement{},
+		&models.Purchase{},
+		&models.CreditTransaction{},
+		&models.ExecutionStep{},
+		&models.ExecutionJob{},
 		&models.Execution{},
 		&models.Review{},
 		&models.Agent{},
@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
 )
 
 // Config holds all configuration for the application
@@ -15,6 +16,19 @@ type Config struct {
 	JWT          JWTConfig
 	Security     SecurityConfig
 	Email        EmailConfig
+	LLM          LLMConfig
+	Queue        QueueConfig
+	Tools        ToolsConfig
+	Scripts      ScriptsConfig
+	Credits      CreditsConfig
+	Purchases    PurchasesConfig
+	Payments     PaymentsConfig
+	Plans        PlansConfig
+	Billing      BillingConfig
+	Earnings     EarningsConfig
+	License      LicenseConfig
+	MFA          MFAConfig
+	SSO          SSOConfig
 }
 
 // DatabaseConfig holds database configuration
@@ -37,8 +51,10 @@ type RedisConfig struct {
 
 // JWTConfig holds JWT configuration
 type JWTConfig struct {
-	SecretKey       string
-	ExpirationHours int
+	SecretKey          string
+	ExpirationHours    int
+	AccessTokenMinutes int
+	RefreshTokenDays   int
 }
 
 // SecurityConfig holds security configuration
@@ -47,6 +63,9 @@ type SecurityConfig struct {
 	BlockedDomains []string
 	RateLimit      int
 	MaxFileSize    int64
+	// TrustedProxies lists the proxies whose X-Forwarded-For header is
+	// believed when working out a client's address
+	TrustedProxies []string
 }
 
 // EmailConfig holds email configuration
@@ -56,6 +75,143 @@ type EmailConfig struct {
 	SMTPUsername string
 	SMTPPassword string
 	FromEmail    string
+
+	// Transport is "smtp" or "outbox"; outbox writes messages to OutboxDir
+	// instead of sending them. It defaults to smtp when SMTPHost is set.
+	Transport          string
+	OutboxDir          string
+	MaxAttempts        int
+	RetryBaseDelayMs   int
+	SMTPTimeoutSeconds int
+
+	// AppURL is where links in emails point to
+	AppURL                    string
+	VerificationTokenHours    int
+	VerificationResendSeconds int
+}
+
+// LLMConfig holds configuration for calls to LLM providers
+type LLMConfig struct {
+	RequestTimeoutSeconds int
+	DefaultMaxTokens      int
+	OpenAIAPIKey          string
+	AnthropicAPIKey       string
+}
+
+// QueueConfig holds configuration for the execution job queue
+type QueueConfig struct {
+	Backend          string
+	Workers          int
+	PerAgentLimit    int
+	PerOrgLimit      int
+	MaxAttempts      int
+	RetryBaseDelayMs int
+	PollIntervalMs   int
+	LeaseSeconds     int
+
+	// ExecutionTimeoutSeconds applies to agents that do not set their own timeout
+	ExecutionTimeoutSeconds int
+}
+
+// ToolsConfig holds configuration for the tools agents may call
+type ToolsConfig struct {
+	MaxToolCalls       int
+	HTTPAllowedDomains []string
+	HTTPTimeoutSeconds int
+	HTTPMaxBodyBytes   int64
+}
+
+// ScriptsConfig holds configuration for agents that run as a subprocess
+type ScriptsConfig struct {
+	Dir            string
+	Interpreters   []string
+	MaxMemoryMB    int
+	MaxCPUSeconds  int
+	MaxOutputBytes int64
+
+	// MaxProcesses is counted per user, so scripts running at once share it
+	MaxProcesses int
+
+	// UID and GID scripts run as; they must not be root or the server's own user
+	UID int
+	GID int
+}
+
+// CreditsConfig holds configuration for credit metering
+type CreditsConfig struct {
+	SignupBonus   int64
+	PerUSD        int64
+	MinimumCharge int64
+}
+
+// PurchasesConfig holds configuration for marketplace purchases
+type PurchasesConfig struct {
+	RefundWindowDays int
+}
+
+// PaymentsConfig holds configuration for the payment provider
+type PaymentsConfig struct {
+	Provider              string
+	Currency              string
+	WebhookSecret         string
+	StripeSecretKey       string
+	StripePublishableKey  string
+	StripeWebhookSecret   string
+	StripeAPIBase         string
+	RequestTimeoutSeconds int
+}
+
+// PlansConfig holds configuration for subscription plans
+type PlansConfig struct {
+	// File is a JSON array of plans that replaces the built-in ones
+	File    string
+	Default string
+}
+
+// BillingConfig holds configuration for invoices and the monthly billing job
+type BillingConfig struct {
+	InvoicePrefix      string
+	TaxName            string
+	TaxRate            float64
+	DueDays            int
+	CompanyName        string
+	CompanyAddress     string
+	JobIntervalMinutes int
+}
+
+// EarningsConfig holds configuration for creator revenue sharing and payouts
+type EarningsConfig struct {
+	// CreatorShare is the fraction of each sale paid to the agent's creator
+	CreatorShare  float64
+	HoldDays      int
+	MinimumPayout float64
+}
+
+// LicenseConfig holds configuration for signing on-premises license keys
+type LicenseConfig struct {
+	// SigningKey is the base64 Ed25519 private key (seed or full key)
+	SigningKey string
+	Issuer     string
+	GraceDays  int
+}
+
+// MFAConfig holds configuration for multi-factor authentication
+type MFAConfig struct {
+	Issuer string
+	// EncryptionKey encrypts TOTP secrets at rest
+	EncryptionKey    string
+	ChallengeMinutes int
+	MaxAttempts      int
+}
+
+// SSOConfig holds configuration for OpenID Connect single sign-on
+type SSOConfig struct {
+	// RedirectURL is where identity providers send users back to; it
+	// defaults to /sso/callback on the frontend
+	RedirectURL          string
+	StateMinutes         int
+	HTTPTimeoutSeconds   int
+	MetadataCacheMinutes int
 }
 
 // Load loads configuration from environment variables
@@ -79,21 +235,119 @@ func Load() *Config {
 			DB:       getEnvAsInt("REDIS_DB", 0),
 		},
 		JWT: JWTConfig{
-			SecretKey:       getEnv("JWT_SECRET_KEY", "your-secret-key-change-in-production"),
-			ExpirationHours: getEnvAsInt("JWT_EXPIRATION_HOURS", 24),
+			SecretKey:          getEnv("JWT_SECRET_KEY", "your-secret-key-change-in-production"),
+			ExpirationHours:    getEnvAsInt("JWT_EXPIRATION_HOURS", 24),
+			AccessTokenMinutes: getEnvAsInt("JWT_ACCESS_TOKEN_MINUTES", 15),
+			RefreshTokenDays:   getEnvAsInt("JWT_REFRESH_TOKEN_DAYS", 7),
 		},
 		Security: SecurityConfig{
 			AllowedDomains: getEnvAsSlice("ALLOWED_DOMAINS", []string{"*"}),
 			BlockedDomains: getEnvAsSlice("BLOCKED_DOMAINS", []string{}),
 			RateLimit:      getEnvAsInt("RATE_LIMIT", 100),
 			MaxFileSize:    getEnvAsInt64("MAX_FILE_SIZE", 10485760), // 10MB
+			TrustedProxies: getEnvAsSlice("TRUSTED_PROXIES", []string{}),
 		},
 		Email: EmailConfig{
-			SMTPHost:     getEnv("SMTP_HOST", ""),
-			SMTPPort:     getEnvAsInt("SMTP_PORT", 587),
-			SMTPUsername: getEnv("SMTP_USERNAME", ""),
-			SMTPPassword: getEnv("SMTP_PASSWORD", ""),
-			FromEmail:    getEnv("FROM_EMAIL", "noreply@agais.ai"),
+			SMTPHost:                  getEnv("SMTP_HOST", ""),
+			SMTPPort:                  getEnvAsInt("SMTP_PORT", 587),
+			SMTPUsername:              getEnv("SMTP_USERNAME", ""),
+			SMTPPassword:              getEnv("SMTP_PASSWORD", ""),
+			FromEmail:                 getEnv("FROM_EMAIL", "noreply@agais.ai"),
+			Transport:                 getEnv("EMAIL_TRANSPORT", ""),
+			OutboxDir:                 getEnv("EMAIL_OUTBOX_DIR", "./outbox"),
+			MaxAttempts:               getEnvAsInt("EMAIL_MAX_ATTEMPTS", 3),
+			RetryBaseDelayMs:          getEnvAsInt("EMAIL_RETRY_BASE_DELAY_MS", 1000),
+			SMTPTimeoutSeconds:        getEnvAsInt("SMTP_TIMEOUT_SECONDS", 30),
+			AppURL:                    getEnv("APP_URL", "http://localhost:3000"),
+			VerificationTokenHours:    getEnvAsInt("EMAIL_VERIFICATION_TOKEN_HOURS", 24),
+			VerificationResendSeconds: getEnvAsInt("EMAIL_VERIFICATION_RESEND_SECONDS", 60),
+		},
+		LLM: LLMConfig{
+			RequestTimeoutSeconds: getEnvAsInt("LLM_REQUEST_TIMEOUT_SECONDS", 120),
+			DefaultMaxTokens:      getEnvAsInt("LLM_DEFAULT_MAX_TOKENS", 1024),
+			OpenAIAPIKey:          getEnv("OPENAI_API_KEY", ""),
+			AnthropicAPIKey:       getEnv("ANTHROPIC_API_KEY", ""),
+		},
+		Queue: QueueConfig{
+			Backend:          getEnv("QUEUE_BACKEND", "database"),
+			Workers:          getEnvAsInt("QUEUE_WORKERS", 4),
+			PerAgentLimit:    getEnvAsInt("QUEUE_PER_AGENT_LIMIT", 5),
+			PerOrgLimit:      getEnvAsInt("QUEUE_PER_ORG_LIMIT", 10),
+			MaxAttempts:      getEnvAsInt("QUEUE_MAX_ATTEMPTS", 3),
+			RetryBaseDelayMs: getEnvAsInt("QUEUE_RETRY_BASE_DELAY_MS", 2000),
+			PollIntervalMs:   getEnvAsInt("QUEUE_POLL_INTERVAL_MS", 1000),
+			LeaseSeconds:     getEnvAsInt("QUEUE_LEASE_SECONDS", 60),
+
+			ExecutionTimeoutSeconds: getEnvAsInt("EXECUTION_TIMEOUT_SECONDS", 600),
+		},
+		Tools: ToolsConfig{
+			MaxToolCalls:       getEnvAsInt("TOOLS_MAX_CALLS", 10),
+			HTTPAllowedDomains: getEnvAsSlice("TOOLS_HTTP_ALLOWED_DOMAINS", []string{}),
+			HTTPTimeoutSeconds: getEnvAsInt("TOOLS_HTTP_TIMEOUT_SECONDS", 15),
+			HTTPMaxBodyBytes:   getEnvAsInt64("TOOLS_HTTP_MAX_BODY_BYTES", 65536),
+		},
+		Scripts: ScriptsConfig{
+			Dir:            getEnv("AGENT_SCRIPTS_DIR", "./agents"),
+			Interpreters:   getEnvAsSlice("AGENT_SCRIPT_INTERPRETERS", []string{"python3", "node", "sh"}),
+			MaxMemoryMB:    getEnvAsInt("AGENT_SCRIPT_MAX_MEMORY_MB", 512),
+			MaxCPUSeconds:  getEnvAsInt("AGENT_SCRIPT_MAX_CPU_SECONDS", 60),
+			MaxOutputBytes: getEnvAsInt64("AGENT_SCRIPT_MAX_OUTPUT_BYTES", 1048576), // 1MB
+			MaxProcesses:   getEnvAsInt("AGENT_SCRIPT_MAX_PROCESSES", 32),
+			UID:            getEnvAsInt("AGENT_SCRIPT_UID", 65534), // nobody
+			GID:            getEnvAsInt("AGENT_SCRIPT_GID", 65534),
+		},
+		Credits: CreditsConfig{
+			SignupBonus:   getEnvAsInt64("CREDITS_SIGNUP_BONUS", 100),
+			PerUSD:        getEnvAsInt64("CREDITS_PER_USD", 100),
+			MinimumCharge: getEnvAsInt64("CREDITS_MINIMUM_CHARGE", 1),
+		},
+		Purchases: PurchasesConfig{
+			RefundWindowDays: getEnvAsInt("PURCHASE_REFUND_WINDOW_DAYS", 14),
+		},
+		Payments: PaymentsConfig{
+			Provider:              getEnv("PAYMENT_PROVIDER", ""),
+			Currency:              getEnv("PAYMENT_CURRENCY", "USD"),
+			WebhookSecret:         getEnv("PAYMENT_WEBHOOK_SECRET", ""),
+			StripeSecretKey:       getEnv("STRIPE_SECRET_KEY", ""),
+			StripePublishableKey:  getEnv("STRIPE_PUBLISHABLE_KEY", ""),
+			StripeWebhookSecret:   getEnv("STRIPE_WEBHOOK_SECRET", ""),
+			StripeAPIBase:         getEnv("STRIPE_API_BASE", "https://api.stripe.com"),
+			RequestTimeoutSeconds: getEnvAsInt("PAYMENT_REQUEST_TIMEOUT_SECONDS", 30),
+		},
+		Plans: PlansConfig{
+			File:    getEnv("PLANS_FILE", ""),
+			Default: getEnv("DEFAULT_PLAN", "free"),
+		},
+		Billing: BillingConfig{
+			InvoicePrefix:      getEnv("BILLING_INVOICE_PREFIX", "INV"),
+			TaxName:            getEnv("BILLING_TAX_NAME", "Tax"),
+			TaxRate:            getEnvAsFloat("BILLING_TAX_RATE", 0),
+			DueDays:            getEnvAsInt("BILLING_INVOICE_DUE_DAYS", 30),
+			CompanyName:        getEnv("BILLING_COMPANY_NAME", "vagais"),
+			CompanyAddress:     getEnv("BILLING_COMPANY_ADDRESS", ""),
+			JobIntervalMinutes: getEnvAsInt("BILLING_JOB_INTERVAL_MINUTES", 60),
+		},
+		Earnings: EarningsConfig{
+			CreatorShare:  getEnvAsFloat("CREATOR_REVENUE_SHARE", 0.7),
+			HoldDays:      getEnvAsInt("CREATOR_EARNINGS_HOLD_DAYS", 14),
+			MinimumPayout: getEnvAsFloat("CREATOR_MINIMUM_PAYOUT", 10),
+		},
+		License: LicenseConfig{
+			SigningKey: getEnv("LICENSE_SIGNING_KEY", ""),
+			Issuer:     getEnv("LICENSE_ISSUER", "vagais"),
+			GraceDays:  getEnvAsInt("LICENSE_GRACE_DAYS", 7),
+		},
+		MFA: MFAConfig{
+			Issuer:           getEnv("MFA_ISSUER", "vagais"),
+			EncryptionKey:    getEnv("MFA_ENCRYPTION_KEY", ""),
+			ChallengeMinutes: getEnvAsInt("MFA_CHALLENGE_MINUTES", 5),
+			MaxAttempts:      getEnvAsInt("MFA_MAX_ATTEMPTS", 5),
+		},
+		SSO: SSOConfig{
+			RedirectURL:          getEnv("SSO_REDIRECT_URL", getEnv("APP_URL", "http://localhost:3000")+"/sso/callback"),
+			StateMinutes:         getEnvAsInt("SSO_STATE_MINUTES", 10),
+			HTTPTimeoutSeconds:   getEnvAsInt("SSO_HTTP_TIMEOUT_SECONDS", 10),
+			MetadataCacheMinutes: getEnvAsInt("SSO_METADATA_CACHE_MINUTES", 60),
 		},
 	}
 }
@@ -124,6 +378,15 @@ func getEnvAsInt64(key string, defaultValue int64) int64 {
 	return defaultValue
 }
 
+func getEnvAsFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
+			return floatValue
+		}
+	}
+	return defaultValue
+}
+
 func getEnvAsBool(key string, defaultValue bool) bool {
 	if value := os.Getenv(key); value != "" {
 		if boolValue, err := strconv.ParseBool(value); err == nil {
@@ -136,8 +399,13 @@ func getEnvAsBool(key string, defaultValue bool) bool {
 func getEnvAsSlice(key string, defaultValue []string) []string {
 	if value := os.Getenv(key); value != "" {
 		// Simple comma-separated values
-		// In production, you might want more sophisticated parsing
-		return []string{value}
+		var values []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				values = append(values, item)
+			}
+		}
+		return values
 	}
 	return defaultValue
 }
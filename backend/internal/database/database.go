@@ -100,8 +100,37 @@ func migrateModels(db *gorm.DB) error {
 		&models.Agent{},
 		&models.Review{},
 		&models.Execution{},
+		&models.ExecutionJob{},
+		&models.ExecutionStep{},
+		&models.CreditTransaction{},
+		&models.Purchase{},
+		&models.Entitlement{},
+		&models.PaymentCustomer{},
+		&models.PaymentMethod{},
+		&models.PaymentTransaction{},
+		&models.PaymentEvent{},
+		&models.Invoice{},
+		&models.InvoiceLine{},
+		&models.CreatorEarning{},
+		&models.CreatorPayout{},
+		&models.License{},
+		&models.APIKey{},
+		&models.RefreshToken{},
+		&models.RevokedAccessToken{},
+		&models.Session{},
+		&models.MFARecoveryCode{},
+		&models.MFAChallenge{},
+		&models.SSOConnection{},
+		&models.SSOIdentity{},
+		&models.SSOAuthRequest{},
+		&models.SCIMToken{},
+		&models.SCIMGroup{},
+		&models.SCIMGroupMember{},
+		&models.EmailLog{},
 		&models.LLMProvider{},
 		&models.PasswordResetToken{},
+		&models.Conversation{},
+		&models.Message{},
 	)
 }
 
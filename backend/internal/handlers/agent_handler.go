@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 
@@ -14,14 +15,16 @@ import (
 // AgentHandler handles agent-related requests
 type AgentHandler struct {
 	*BaseHandler
-	agentService *services.AgentService
+	agentService   *services.AgentService
+	runtimeService *services.RuntimeService
 }
 
 // NewAgentHandler creates a new agent handler
 func NewAgentHandler(db *gorm.DB, cfg *config.Config) *AgentHandler {
 	return &AgentHandler{
-		BaseHandler:  NewBaseHandler(db, cfg),
-		agentService: services.AgentServiceInstance,
+		BaseHandler:    NewBaseHandler(db, cfg),
+		agentService:   services.AgentServiceInstance,
+		runtimeService: services.RuntimeServiceInstance,
 	}
 }
 
@@ -48,6 +51,15 @@ func (h *AgentHandler) CreateAgent(c *gin.Context) {
 	}
 
 	agent, err := h.agentService.CreateAgent(&req, userID, orgID)
+	var quotaErr *services.QuotaError
+	if errors.As(err, &quotaErr) {
+		h.sendQuotaError(c, http.StatusPaymentRequired, quotaErr)
+		return
+	}
+	if errors.Is(err, services.ErrEmailNotVerified) {
+		h.sendError(c, http.StatusForbidden, err.Error())
+		return
+	}
 	if err != nil {
 		h.sendError(c, http.StatusInternalServerError, err.Error())
 		return
@@ -79,6 +91,15 @@ func (h *AgentHandler) UpdateAgent(c *gin.Context) {
 	}
 
 	agent, err := h.agentService.UpdateAgent(agentID, &req)
+	var quotaErr *services.QuotaError
+	if errors.As(err, &quotaErr) {
+		h.sendQuotaError(c, http.StatusPaymentRequired, quotaErr)
+		return
+	}
+	if errors.Is(err, services.ErrEmailNotVerified) {
+		h.sendError(c, http.StatusForbidden, err.Error())
+		return
+	}
 	if err != nil {
 		h.sendError(c, http.StatusInternalServerError, err.Error())
 		return
@@ -189,7 +210,29 @@ func (h *AgentHandler) ExecuteAgent(c *gin.Context) {
 		return
 	}
 
-	execution, err := h.agentService.ExecuteAgent(agentID, userID, req.Input)
+	var orgID *string
+	user, exists := h.getCurrentUser(c)
+	if exists && user.OrganizationID != nil {
+		orgID = user.OrganizationID
+	}
+
+	execution, err := h.runtimeService.ExecuteAgent(&services.ExecuteAgentRequest{
+		AgentID: agentID,
+		Input:   req.Input,
+	}, userID, orgID)
+	var quotaErr *services.QuotaError
+	if errors.As(err, &quotaErr) {
+		h.sendQuotaError(c, http.StatusPaymentRequired, quotaErr)
+		return
+	}
+	if errors.Is(err, services.ErrInsufficientCredits) || errors.Is(err, services.ErrNotEntitled) {
+		h.sendError(c, http.StatusPaymentRequired, err.Error())
+		return
+	}
+	if errors.Is(err, services.ErrEmailNotVerified) {
+		h.sendError(c, http.StatusForbidden, err.Error())
+		return
+	}
 	if err != nil {
 		h.sendError(c, http.StatusInternalServerError, err.Error())
 		return
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/services"
+)
+
+// APIKeyHandler handles API key management requests
+type APIKeyHandler struct {
+	*BaseHandler
+	apiKeyService *services.APIKeyService
+}
+
+// NewAPIKeyHandler creates a new API key handler
+func NewAPIKeyHandler(db *gorm.DB, cfg *config.Config) *APIKeyHandler {
+	return &APIKeyHandler{
+		BaseHandler:   NewBaseHandler(db, cfg),
+		apiKeyService: services.APIKeyServiceInstance,
+	}
+}
+
+// ListAPIKeys lists the current user's keys and, for admins, their organization's
+func (h *APIKeyHandler) ListAPIKeys(c *gin.Context) {
+	user, exists := h.getCurrentUser(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	keys, err := h.apiKeyService.ListAPIKeys(user, c.Query("include_revoked") == "true")
+	if err != nil {
+		h.sendError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, gin.H{
+		"api_keys": keys,
+		"total":    len(keys),
+	})
+}
+
+// CreateAPIKey creates an API key; the key is only shown in this response
+func (h *APIKeyHandler) CreateAPIKey(c *gin.Context) {
+	var req services.CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.sendError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	user, exists := h.getCurrentUser(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	apiKey, err := h.apiKeyService.CreateAPIKey(user, &req)
+	if err != nil {
+		h.sendError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.sendCreated(c, apiKey)
+}
+
+// RevokeAPIKey revokes an API key
+func (h *APIKeyHandler) RevokeAPIKey(c *gin.Context) {
+	user, exists := h.getCurrentUser(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	apiKey, err := h.apiKeyService.RevokeAPIKey(c.Param("id"), user)
+	if err != nil {
+		h.sendError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, apiKey)
+}
+
+// ListScopes lists the scopes API keys can be granted
+func (h *APIKeyHandler) ListScopes(c *gin.Context) {
+	h.sendSuccess(c, services.APIKeyScopes)
+}
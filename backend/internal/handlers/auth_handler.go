@@ -1,7 +1,9 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
@@ -32,7 +34,7 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		return
 	}
 
-	response, err := h.authService.Login(&req)
+	response, err := h.authService.Login(&req, clientInfo(c))
 	if err != nil {
 		h.sendError(c, http.StatusUnauthorized, err.Error())
 		return
@@ -49,7 +51,7 @@ func (h *AuthHandler) Register(c *gin.Context) {
 		return
 	}
 
-	response, err := h.authService.Register(&req)
+	response, err := h.authService.Register(&req, clientInfo(c))
 	if err != nil {
 		h.sendError(c, http.StatusBadRequest, err.Error())
 		return
@@ -69,7 +71,7 @@ func (h *AuthHandler) RefreshToken(c *gin.Context) {
 		return
 	}
 
-	response, err := h.authService.RefreshToken(req.RefreshToken)
+	response, err := h.authService.RefreshToken(req.RefreshToken, clientInfo(c))
 	if err != nil {
 		h.sendError(c, http.StatusUnauthorized, err.Error())
 		return
@@ -78,15 +80,15 @@ func (h *AuthHandler) RefreshToken(c *gin.Context) {
 	h.sendSuccess(c, response)
 }
 
-// Logout handles user logout
+// Logout signs out the session the access token belongs to
 func (h *AuthHandler) Logout(c *gin.Context) {
-	userID, exists := h.getCurrentUserID(c)
+	value, exists := c.Get("token_claims")
 	if !exists {
 		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
 		return
 	}
 
-	if err := h.authService.Logout(userID); err != nil {
+	if err := h.authService.Logout(value.(*services.JWTClaims)); err != nil {
 		h.sendError(c, http.StatusInternalServerError, "Failed to logout")
 		return
 	}
@@ -94,6 +96,63 @@ func (h *AuthHandler) Logout(c *gin.Context) {
 	h.sendSuccess(c, gin.H{"message": "Logged out successfully"})
 }
 
+// LogoutAll signs out every session of the current user
+func (h *AuthHandler) LogoutAll(c *gin.Context) {
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	if err := h.authService.LogoutAll(userID); err != nil {
+		h.sendError(c, http.StatusInternalServerError, "Failed to logout")
+		return
+	}
+
+	h.sendSuccess(c, gin.H{"message": "Logged out of all sessions"})
+}
+
+// ListSessions lists the current user's active sessions
+func (h *AuthHandler) ListSessions(c *gin.Context) {
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	var currentSessionID string
+	if value, ok := c.Get("token_claims"); ok {
+		currentSessionID = value.(*services.JWTClaims).SessionID
+	}
+
+	sessions, err := h.authService.ListSessions(userID, currentSessionID)
+	if err != nil {
+		h.sendError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, gin.H{
+		"sessions": sessions,
+		"total":    len(sessions),
+	})
+}
+
+// RevokeSession signs out one of the current user's sessions
+func (h *AuthHandler) RevokeSession(c *gin.Context) {
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	if err := h.authService.RevokeSession(userID, c.Param("id")); err != nil {
+		h.sendError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, gin.H{"message": "Session revoked successfully"})
+}
+
 // ValidateToken validates a JWT token
 func (h *AuthHandler) ValidateToken(c *gin.Context) {
 	token := c.GetHeader("Authorization")
@@ -139,6 +198,178 @@ func (h *AuthHandler) ForgotPassword(c *gin.Context) {
 	h.sendSuccess(c, gin.H{"message": "Password reset email sent"})
 }
 
+// VerifyEmail verifies the email address a verification token was sent to
+func (h *AuthHandler) VerifyEmail(c *gin.Context) {
+	var req struct {
+		Token string `json:"token" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.sendError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	user, err := h.authService.VerifyEmail(req.Token)
+	if err != nil {
+		h.sendError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, gin.H{
+		"message":        "Email verified successfully",
+		"email_verified": user.EmailVerified,
+	})
+}
+
+// ResendVerificationEmail sends the current user a new verification email
+func (h *AuthHandler) ResendVerificationEmail(c *gin.Context) {
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	err := h.authService.ResendVerificationEmail(userID)
+	var rateErr *services.VerificationRateLimitError
+	if errors.As(err, &rateErr) {
+		c.Header("Retry-After", strconv.Itoa(int(rateErr.RetryAfter.Seconds())+1))
+		h.sendError(c, http.StatusTooManyRequests, err.Error())
+		return
+	}
+	if err != nil {
+		h.sendError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, gin.H{"message": "Verification email sent"})
+}
+
+// VerifyMFA completes a login with a TOTP or recovery code
+func (h *AuthHandler) VerifyMFA(c *gin.Context) {
+	var req services.MFAVerifyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.sendError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	response, err := h.authService.VerifyMFA(&req, clientInfo(c))
+	if err != nil {
+		h.sendError(c, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, response)
+}
+
+// GetMFAStatus returns the current user's MFA status
+func (h *AuthHandler) GetMFAStatus(c *gin.Context) {
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	status, err := h.authService.GetMFAStatus(userID)
+	if err != nil {
+		h.sendError(c, http.StatusNotFound, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, status)
+}
+
+// EnrollMFA starts MFA enrollment for the current user
+func (h *AuthHandler) EnrollMFA(c *gin.Context) {
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	enrollment, err := h.authService.EnrollMFA(userID)
+	if err != nil {
+		h.sendError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, enrollment)
+}
+
+// ConfirmMFA enables MFA with a code from the enrolled authenticator
+func (h *AuthHandler) ConfirmMFA(c *gin.Context) {
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.sendError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	codes, err := h.authService.ConfirmMFA(userID, req.Code)
+	if err != nil {
+		h.sendError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, gin.H{
+		"message":        "Multi-factor authentication enabled",
+		"recovery_codes": codes,
+	})
+}
+
+// DisableMFA turns MFA off for the current user
+func (h *AuthHandler) DisableMFA(c *gin.Context) {
+	var req services.DisableMFARequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.sendError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	if err := h.authService.DisableMFA(userID, &req); err != nil {
+		h.sendError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, gin.H{"message": "Multi-factor authentication disabled"})
+}
+
+// RegenerateRecoveryCodes replaces the current user's recovery codes
+func (h *AuthHandler) RegenerateRecoveryCodes(c *gin.Context) {
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.sendError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	codes, err := h.authService.RegenerateRecoveryCodes(userID, req.Code)
+	if err != nil {
+		h.sendError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, gin.H{"recovery_codes": codes})
+}
+
 // ResetPassword handles password reset
 func (h *AuthHandler) ResetPassword(c *gin.Context) {
 	var req struct {
@@ -158,3 +389,11 @@ func (h *AuthHandler) ResetPassword(c *gin.Context) {
 
 	h.sendSuccess(c, gin.H{"message": "Password reset successfully"})
 }
+
+// clientInfo describes the client making the request
+func clientInfo(c *gin.Context) *services.ClientInfo {
+	return &services.ClientInfo{
+		IPAddress: c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+	}
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/mlaitechio/vagais/internal/config"
 	"github.com/mlaitechio/vagais/internal/models"
+	"github.com/mlaitechio/vagais/internal/services"
 )
 
 // BaseHandler provides common functionality for all handlers
@@ -69,3 +70,12 @@ func (h *BaseHandler) getCurrentUser(c *gin.Context) (*models.User, bool) {
 	}
 	return user.(*models.User), true
 }
+
+// sendQuotaError sends an error response describing the plan limit that was hit
+func (h *BaseHandler) sendQuotaError(c *gin.Context, statusCode int, err *services.QuotaError) {
+	c.JSON(statusCode, gin.H{
+		"success": false,
+		"error":   err.Message,
+		"quota":   err,
+	})
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/services"
+)
+
+// BillingHandler handles invoice requests
+type BillingHandler struct {
+	*BaseHandler
+	billingService *services.BillingService
+}
+
+// NewBillingHandler creates a new billing handler
+func NewBillingHandler(db *gorm.DB, cfg *config.Config) *BillingHandler {
+	return &BillingHandler{
+		BaseHandler:    NewBaseHandler(db, cfg),
+		billingService: services.BillingServiceInstance,
+	}
+}
+
+// ListInvoices lists the invoices of the current user and, for admins, their organization
+func (h *BillingHandler) ListInvoices(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	user, exists := h.getCurrentUser(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	invoices, total, err := h.billingService.ListInvoices(user, c.Query("status"), page, limit)
+	if err != nil {
+		h.sendError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, gin.H{
+		"invoices": invoices,
+		"total":    total,
+		"page":     page,
+		"limit":    limit,
+	})
+}
+
+// GetInvoice gets an invoice with its lines
+func (h *BillingHandler) GetInvoice(c *gin.Context) {
+	user, exists := h.getCurrentUser(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	invoice, err := h.billingService.GetInvoice(c.Param("id"), user)
+	if err != nil {
+		h.sendError(c, http.StatusNotFound, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, invoice)
+}
+
+// DownloadInvoice downloads an invoice as JSON, CSV or PDF
+func (h *BillingHandler) DownloadInvoice(c *gin.Context) {
+	user, exists := h.getCurrentUser(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	invoice, err := h.billingService.GetInvoice(c.Param("id"), user)
+	if err != nil {
+		h.sendError(c, http.StatusNotFound, err.Error())
+		return
+	}
+
+	format := strings.ToLower(c.DefaultQuery("format", services.InvoiceFormatPDF))
+	data, contentType, err := h.billingService.RenderInvoice(invoice, format)
+	if err != nil {
+		h.sendError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", invoice.Number+"."+format))
+	c.Data(http.StatusOK, contentType, data)
+}
+
+// GenerateInvoices issues invoices for a past month, given as YYYY-MM
+func (h *BillingHandler) GenerateInvoices(c *gin.Context) {
+	var req struct {
+		Period string `json:"period" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.sendError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	period, err := time.Parse("2006-01", req.Period)
+	if err != nil {
+		h.sendError(c, http.StatusBadRequest, "period must be formatted as YYYY-MM")
+		return
+	}
+
+	invoices, err := h.billingService.GenerateInvoices(period)
+	if err != nil {
+		h.sendError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, gin.H{
+		"invoices": invoices,
+		"total":    len(invoices),
+	})
+}
@@ -1,8 +1,12 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -10,29 +14,137 @@ import (
 	"gorm.io/gorm"
 
 	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/middleware"
+	"github.com/mlaitechio/vagais/internal/models"
 	"github.com/mlaitechio/vagais/internal/services"
 )
 
 // ChatHandler handles real-time chat functionality
 type ChatHandler struct {
 	*BaseHandler
-	agentService *services.AgentService
-	upgrader     websocket.Upgrader
-	clients      map[string]*websocket.Conn
+	agentService        *services.AgentService
+	runtimeService      *services.RuntimeService
+	conversationService *services.ConversationService
+	upgrader            websocket.Upgrader
+	hub                 *ChatHub
+
+	// Chat turns count against the plan's rate limit like HTTP requests do
+	limiter *middleware.PlanLimiter
 }
 
 // NewChatHandler creates a new chat handler
 func NewChatHandler(db *gorm.DB, cfg *config.Config) *ChatHandler {
+	hub := NewChatHub(services.RedisClient)
+	go hub.Run()
+
 	return &ChatHandler{
-		BaseHandler:  NewBaseHandler(db, cfg),
-		agentService: services.AgentServiceInstance,
+		BaseHandler:         NewBaseHandler(db, cfg),
+		agentService:        services.AgentServiceInstance,
+		runtimeService:      services.RuntimeServiceInstance,
+		conversationService: services.ConversationServiceInstance,
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
 				return true // Allow all origins for development
 			},
 		},
-		clients: make(map[string]*websocket.Conn),
+		hub:     hub,
+		limiter: middleware.NewPlanLimiter(),
+	}
+}
+
+// chatSession holds the state of a single chat socket
+type chatSession struct {
+	hub     *ChatHub
+	conn    *websocket.Conn
+	ctx     context.Context
+	user    *models.User
+	userID  string
+	agentID string
+
+	// Outgoing frames are queued here and written by writePump
+	send      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu             sync.Mutex
+	stopActive     context.CancelFunc
+	conversationID string
+}
+
+// getConversationID returns the conversation the session is writing to
+func (s *chatSession) getConversationID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conversationID
+}
+
+// setConversationID binds the session to a conversation
+func (s *chatSession) setConversationID(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conversationID = id
+}
+
+// newChatSession creates the state for a newly upgraded chat socket
+func newChatSession(hub *ChatHub, conn *websocket.Conn, ctx context.Context, userID, agentID string) *chatSession {
+	return &chatSession{
+		hub:     hub,
+		conn:    conn,
+		ctx:     ctx,
+		userID:  userID,
+		agentID: agentID,
+		send:    make(chan []byte, sendBufferSize),
+		done:    make(chan struct{}),
+	}
+}
+
+// writeJSON queues a frame for the connection, disconnecting it if it has fallen behind
+func (s *chatSession) writeJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := s.enqueue(data); err != nil {
+		if errors.Is(err, errSlowClient) {
+			log.Printf("Dropping chat client %s:%s: %v", s.userID, s.agentID, err)
+			s.hub.Unregister(s)
+		}
+		return err
+	}
+	return nil
+}
+
+// startGeneration registers a new in-flight generation, failing if one is already running
+func (s *chatSession) startGeneration() (context.Context, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopActive != nil {
+		return nil, false
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.stopActive = cancel
+	return ctx, true
+}
+
+// finishGeneration clears the in-flight generation
+func (s *chatSession) finishGeneration() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopActive != nil {
+		s.stopActive()
+		s.stopActive = nil
+	}
+}
+
+// stopGeneration cancels the in-flight generation, reporting whether one was running
+func (s *chatSession) stopGeneration() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopActive == nil {
+		return false
 	}
+	s.stopActive()
+	return true
 }
 
 // ChatMessage represents a chat message
@@ -63,11 +175,23 @@ func (h *ChatHandler) HandleChatWebSocket(c *gin.Context) {
 	}
 
 	// Get user from context (assuming auth middleware has set it)
-	userID, exists := h.getCurrentUserID(c)
+	user, exists := h.getCurrentUser(c)
 	if !exists {
 		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
 		return
 	}
+	userID := user.ID
+
+	// Resume an earlier conversation if one was requested
+	var conversation *models.Conversation
+	if conversationID := c.Query("conversation_id"); conversationID != "" {
+		var err error
+		conversation, err = h.conversationService.ResumeConversation(conversationID, userID, agentID)
+		if err != nil {
+			h.sendError(c, http.StatusNotFound, "Conversation not found")
+			return
+		}
+	}
 
 	// Upgrade HTTP connection to WebSocket
 	conn, err := h.upgrader.Upgrade(c.Writer, c.Request, nil)
@@ -77,9 +201,30 @@ func (h *ChatHandler) HandleChatWebSocket(c *gin.Context) {
 	}
 	defer conn.Close()
 
-	// Store client connection
-	clientKey := userID + ":" + agentID
-	h.clients[clientKey] = conn
+	// The session ends with the request, which server shutdown cancels too
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	session := newChatSession(h.hub, conn, ctx, userID, agentID)
+	session.user = user
+	if conversation != nil {
+		session.conversationID = conversation.ID
+	}
+
+	// Register the connection and start writing to it
+	h.hub.Register(session)
+	defer h.hub.Unregister(session)
+	go session.writePump()
+
+	// Drop connections that stop answering pings
+	conn.SetReadLimit(maxChatMessageSize)
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
 
 	// Send welcome message
 	welcomeMsg := ChatResponse{
@@ -88,30 +233,84 @@ func (h *ChatHandler) HandleChatWebSocket(c *gin.Context) {
 		Message:   "Connected to agent chat. You can start chatting now!",
 		Timestamp: time.Now(),
 	}
-	conn.WriteJSON(welcomeMsg)
+	session.writeJSON(welcomeMsg)
+
+	// Replay earlier turns so the client can render the conversation
+	if conversation != nil {
+		history := make([]map[string]interface{}, 0, len(conversation.Messages))
+		for _, m := range conversation.Messages {
+			history = append(history, map[string]interface{}{
+				"id":         m.ID,
+				"role":       m.Role,
+				"content":    m.Content,
+				"created_at": m.CreatedAt,
+			})
+		}
+		session.writeJSON(ChatResponse{
+			Type:      "history",
+			AgentID:   agentID,
+			Message:   conversation.Title,
+			Timestamp: time.Now(),
+			Metadata: map[string]interface{}{
+				"conversation_id": conversation.ID,
+				"messages":        history,
+			},
+		})
+	}
 
 	// Handle incoming messages
 	for {
 		var msg ChatMessage
 		err := conn.ReadJSON(&msg)
 		if err != nil {
-			log.Printf("WebSocket read error: %v", err)
-			delete(h.clients, clientKey)
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("WebSocket read error: %v", err)
+			}
 			break
 		}
 
 		// Process the message
-		h.processChatMessage(conn, agentID, userID, &msg)
+		h.processChatMessage(session, agentID, userID, &msg)
 	}
 }
 
 // processChatMessage processes incoming chat messages
-func (h *ChatHandler) processChatMessage(conn *websocket.Conn, agentID, userID string, msg *ChatMessage) {
+func (h *ChatHandler) processChatMessage(session *chatSession, agentID, userID string, msg *ChatMessage) {
 	// Set message metadata
 	msg.AgentID = agentID
 	msg.UserID = userID
 	msg.Timestamp = time.Now()
 
+	if msg.Type == "stop" {
+		if !session.stopGeneration() {
+			session.writeJSON(ChatResponse{
+				Type:      "error",
+				AgentID:   agentID,
+				Message:   "No response is being generated",
+				Timestamp: time.Now(),
+			})
+		}
+		return
+	}
+
+	if quotaErr, retryAfter := h.limiter.Allow(session.user); quotaErr != nil {
+		session.writeJSON(quotaErrorResponse(agentID, http.StatusTooManyRequests, quotaErr, map[string]interface{}{
+			"retry_after": int(retryAfter.Seconds()) + 1,
+		}))
+		return
+	}
+
+	ctx, ok := session.startGeneration()
+	if !ok {
+		session.writeJSON(ChatResponse{
+			Type:      "error",
+			AgentID:   agentID,
+			Message:   "A response is already being generated. Send a stop message first.",
+			Timestamp: time.Now(),
+		})
+		return
+	}
+
 	// Send acknowledgment
 	ack := ChatResponse{
 		Type:      "ack",
@@ -119,16 +318,50 @@ func (h *ChatHandler) processChatMessage(conn *websocket.Conn, agentID, userID s
 		Message:   "Message received",
 		Timestamp: time.Now(),
 	}
-	conn.WriteJSON(ack)
+	session.writeJSON(ack)
 
 	// Process message with agent
-	go h.processWithAgent(conn, agentID, userID, msg)
+	go h.processWithAgent(ctx, session, agentID, userID, msg)
+}
+
+// quotaErrorResponse builds the error frame sent when a chat turn exceeds a
+// plan limit, carrying the same status and quota details as the HTTP API
+func quotaErrorResponse(agentID string, status int, quotaErr *services.QuotaError, metadata map[string]interface{}) ChatResponse {
+	metadata["status"] = status
+	metadata["quota"] = quotaErr
+	return ChatResponse{
+		Type:      "error",
+		AgentID:   agentID,
+		Message:   quotaErr.Message,
+		Timestamp: time.Now(),
+		Metadata:  metadata,
+	}
+}
+
+// chatErrorResponse builds the error frame for a chat turn that was refused
+// or failed; plan limits carry their quota details like quotaErrorResponse
+func chatErrorResponse(agentID, conversationID string, err error) ChatResponse {
+	metadata := map[string]interface{}{}
+	if conversationID != "" {
+		metadata["conversation_id"] = conversationID
+	}
+	var quotaErr *services.QuotaError
+	if errors.As(err, &quotaErr) {
+		return quotaErrorResponse(agentID, http.StatusPaymentRequired, quotaErr, metadata)
+	}
+	return ChatResponse{
+		Type:      "error",
+		AgentID:   agentID,
+		Message:   err.Error(),
+		Timestamp: time.Now(),
+		Metadata:  metadata,
+	}
 }
 
-// processWithAgent processes the message with the agent
-func (h *ChatHandler) processWithAgent(conn *websocket.Conn, agentID, userID string, msg *ChatMessage) {
-	// Simulate agent processing time
-	time.Sleep(500 * time.Millisecond)
+// processWithAgent streams the agent's reply to the socket as delta frames
+func (h *ChatHandler) processWithAgent(ctx context.Context, session *chatSession, agentID, userID string, msg *ChatMessage) {
+	defer session.finishGeneration()
+	startTime := time.Now()
 
 	// Get agent details
 	agent, err := h.agentService.GetAgent(agentID)
@@ -139,71 +372,140 @@ func (h *ChatHandler) processWithAgent(conn *websocket.Conn, agentID, userID str
 			Message:   "Agent not found or unavailable",
 			Timestamp: time.Now(),
 		}
-		conn.WriteJSON(errorResp)
+		session.writeJSON(errorResp)
 		return
 	}
 
-	// Simulate agent response based on message content
-	response := h.generateAgentResponse(agent.Name, msg.Message)
+	// Load earlier turns as context
+	conversationID := session.getConversationID()
+	var history []models.Message
+	if conversationID != "" {
+		if history, err = h.conversationService.GetHistory(conversationID); err != nil {
+			session.writeJSON(ChatResponse{
+				Type:      "error",
+				AgentID:   agentID,
+				Message:   "Failed to load conversation history",
+				Timestamp: time.Now(),
+			})
+			return
+		}
+	}
+	messages := h.conversationService.BuildContext(agent, history, msg.Message)
 
-	// Send agent response
+	// Refuse the turn before anything is recorded for it
+	if err := h.runtimeService.CheckChat(agent, userID, session.user.OrganizationID, messages); err != nil {
+		session.writeJSON(chatErrorResponse(agentID, conversationID, err))
+		return
+	}
+
+	// Start a new conversation on the first message
+	if conversationID == "" {
+		conversation, err := h.conversationService.StartConversation(userID, agentID, msg.Message)
+		if err != nil {
+			session.writeJSON(ChatResponse{
+				Type:      "error",
+				AgentID:   agentID,
+				Message:   "Failed to start conversation",
+				Timestamp: time.Now(),
+			})
+			return
+		}
+		conversationID = conversation.ID
+		session.setConversationID(conversationID)
+	}
+
+	if err := h.conversationService.AppendMessage(conversationID, &models.Message{
+		Role:    "user",
+		Content: msg.Message,
+	}); err != nil {
+		log.Printf("Failed to save chat message: %v", err)
+	}
+
+	result, err := h.runtimeService.StreamChat(ctx, agent, userID, session.user.OrganizationID, conversationID, messages, func(delta string) error {
+		return session.writeJSON(ChatResponse{
+			Type:      "delta",
+			AgentID:   agentID,
+			Message:   delta,
+			Timestamp: time.Now(),
+		})
+	})
+
+	stopped := errors.Is(ctx.Err(), context.Canceled) && session.ctx.Err() == nil
+	var quotaErr *services.QuotaError
+	if errors.As(err, &quotaErr) || (err != nil && !stopped) {
+		session.writeJSON(chatErrorResponse(agentID, conversationID, err))
+		return
+	}
+	if result == nil {
+		result = &services.ChatCompletionResponse{}
+	}
+
+	finishReason := result.FinishReason
+	if stopped {
+		finishReason = "stopped"
+	}
+
+	// Keep the reply, including partial output of a stopped generation
+	if result.Content != "" {
+		if err := h.conversationService.AppendMessage(conversationID, &models.Message{
+			Role:         "assistant",
+			Content:      result.Content,
+			Model:        result.Model,
+			PromptTokens: result.Usage.PromptTokens,
+			OutputTokens: result.Usage.OutputTokens,
+			Metadata: models.MapToJSON(map[string]interface{}{
+				"finish_reason": finishReason,
+				"stopped":       stopped,
+			}),
+		}); err != nil {
+			log.Printf("Failed to save agent reply: %v", err)
+		}
+	}
+
+	// Send the final agent response
 	agentResp := ChatResponse{
 		Type:      "response",
 		AgentID:   agentID,
-		Message:   response,
+		Message:   result.Content,
 		Timestamp: time.Now(),
 		Metadata: map[string]interface{}{
-			"agent_name":      agent.Name,
-			"processing_time": "500ms",
+			"agent_name":         agent.Name,
+			"conversation_id":    conversationID,
+			"model":              result.Model,
+			"finish_reason":      finishReason,
+			"stopped":            stopped,
+			"processing_time_ms": time.Since(startTime).Milliseconds(),
+			"usage": map[string]interface{}{
+				"prompt_tokens": result.Usage.PromptTokens,
+				"output_tokens": result.Usage.OutputTokens,
+				"total_tokens":  result.Usage.Total(),
+			},
 		},
 	}
 
-	conn.WriteJSON(agentResp)
+	session.writeJSON(agentResp)
 }
 
-// generateAgentResponse generates a simple response based on the agent and message
-func (h *ChatHandler) generateAgentResponse(agentName, message string) string {
-	// This is a simple response generator
-	// In a real implementation, this would call the actual agent service
-	responses := map[string]string{
-		"hello":  "Hello! I'm " + agentName + ". How can I help you today?",
-		"help":   "I'm here to assist you. What would you like to know?",
-		"thanks": "You're welcome! Is there anything else I can help you with?",
-		"bye":    "Goodbye! Have a great day!",
-	}
-
-	// Check for exact matches first
-	if response, exists := responses[message]; exists {
-		return response
+// BroadcastMessage broadcasts a message to all connected clients for an agent
+func (h *ChatHandler) BroadcastMessage(agentID string, message ChatResponse) {
+	if err := h.hub.Broadcast(agentID, message); err != nil {
+		log.Printf("Error broadcasting to agent %s: %v", agentID, err)
 	}
-
-	// Default response
-	return "I understand you said: \"" + message + "\". I'm " + agentName + " and I'm here to help. Could you please provide more details about what you need?"
 }
 
-// BroadcastMessage broadcasts a message to all connected clients for an agent
-func (h *ChatHandler) BroadcastMessage(agentID string, message ChatResponse) {
-	for clientKey, conn := range h.clients {
-		// Check if this client is connected to the specific agent
-		if len(clientKey) > len(agentID) && clientKey[len(clientKey)-len(agentID)-1:] == ":"+agentID {
-			err := conn.WriteJSON(message)
-			if err != nil {
-				log.Printf("Error broadcasting to client %s: %v", clientKey, err)
-				delete(h.clients, clientKey)
-			}
-		}
+// SendToUser sends a message to every connection a user has open for an agent
+func (h *ChatHandler) SendToUser(userID, agentID string, message ChatResponse) {
+	if err := h.hub.SendToUser(userID, agentID, message); err != nil {
+		log.Printf("Error sending to user %s: %v", userID, err)
 	}
 }
 
 // GetConnectedClients returns the number of connected clients
 func (h *ChatHandler) GetConnectedClients() int {
-	return len(h.clients)
+	return h.hub.Count()
 }
 
 // CloseAllConnections closes all WebSocket connections
 func (h *ChatHandler) CloseAllConnections() {
-	for clientKey, conn := range h.clients {
-		conn.Close()
-		delete(h.clients, clientKey)
-	}
+	h.hub.Close()
 }
@@ -0,0 +1,297 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// Time allowed to write a frame to the peer
+	writeWait = 10 * time.Second
+
+	// Time allowed to read the next pong from the peer
+	pongWait = 60 * time.Second
+
+	// Pings are sent at this period, which must be shorter than pongWait
+	pingPeriod = (pongWait * 9) / 10
+
+	// Largest message accepted from the peer
+	maxChatMessageSize = 64 << 10
+
+	// Frames buffered per connection before it is treated as a slow reader
+	sendBufferSize = 256
+
+	// Redis channel carrying broadcasts between server instances
+	chatBroadcastChannel = "vagais:chat:broadcast"
+)
+
+// errSlowClient is returned when a connection's send buffer is full
+var errSlowClient = errors.New("client is not reading messages fast enough")
+
+// errClientClosed is returned when writing to a connection that has been unregistered
+var errClientClosed = errors.New("client connection is closed")
+
+// hubEnvelope is a frame routed through the hub and the Redis backplane
+type hubEnvelope struct {
+	Origin  string          `json:"origin"`
+	AgentID string          `json:"agent_id"`
+	UserID  string          `json:"user_id,omitempty"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// ChatHub tracks chat connections and fans messages out to them. All
+// connection bookkeeping happens on the Run goroutine; other goroutines talk
+// to it through the register, unregister and broadcast channels.
+type ChatHub struct {
+	instanceID string
+	redis      *redis.Client
+
+	// Connections by agent ID; a user may hold several at once
+	clients map[string]map[*chatSession]struct{}
+	count   int64
+
+	register   chan *chatSession
+	unregister chan *chatSession
+	broadcast  chan *hubEnvelope
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+// NewChatHub creates a hub, using Redis to reach other instances when available
+func NewChatHub(redisClient *redis.Client) *ChatHub {
+	return &ChatHub{
+		instanceID: uuid.New().String(),
+		redis:      redisClient,
+		clients:    make(map[string]map[*chatSession]struct{}),
+		register:   make(chan *chatSession),
+		unregister: make(chan *chatSession),
+		broadcast:  make(chan *hubEnvelope, sendBufferSize),
+		done:       make(chan struct{}),
+	}
+}
+
+// Run processes hub events until Close is called
+func (h *ChatHub) Run() {
+	if h.redis != nil {
+		go h.subscribe()
+	}
+
+	for {
+		select {
+		case session := <-h.register:
+			sessions, ok := h.clients[session.agentID]
+			if !ok {
+				sessions = make(map[*chatSession]struct{})
+				h.clients[session.agentID] = sessions
+			}
+			sessions[session] = struct{}{}
+			atomic.AddInt64(&h.count, 1)
+
+		case session := <-h.unregister:
+			h.remove(session)
+
+		case envelope := <-h.broadcast:
+			for session := range h.clients[envelope.AgentID] {
+				if envelope.UserID != "" && session.userID != envelope.UserID {
+					continue
+				}
+				// Drop readers that cannot keep up instead of stalling everyone else
+				if err := session.enqueue(envelope.Payload); err != nil {
+					log.Printf("Dropping chat client %s:%s: %v", session.userID, session.agentID, err)
+					h.remove(session)
+				}
+			}
+
+		case <-h.done:
+			for _, sessions := range h.clients {
+				for session := range sessions {
+					h.remove(session)
+				}
+			}
+			return
+		}
+	}
+}
+
+// remove forgets a connection and stops its write pump
+func (h *ChatHub) remove(session *chatSession) {
+	sessions, ok := h.clients[session.agentID]
+	if !ok {
+		return
+	}
+	if _, ok := sessions[session]; !ok {
+		return
+	}
+	delete(sessions, session)
+	if len(sessions) == 0 {
+		delete(h.clients, session.agentID)
+	}
+	atomic.AddInt64(&h.count, -1)
+	session.close()
+}
+
+// Register adds a connection to the hub
+func (h *ChatHub) Register(session *chatSession) {
+	select {
+	case h.register <- session:
+	case <-h.done:
+		session.close()
+	}
+}
+
+// Unregister removes a connection from the hub; it is safe to call more than once
+func (h *ChatHub) Unregister(session *chatSession) {
+	select {
+	case h.unregister <- session:
+	case <-h.done:
+	}
+}
+
+// Broadcast sends a message to every connection for an agent on every instance
+func (h *ChatHub) Broadcast(agentID string, message interface{}) error {
+	return h.publish(agentID, "", message)
+}
+
+// SendToUser sends a message to all of a user's connections for an agent
+func (h *ChatHub) SendToUser(userID, agentID string, message interface{}) error {
+	return h.publish(agentID, userID, message)
+}
+
+// publish delivers a message locally and forwards it to the other instances
+func (h *ChatHub) publish(agentID, userID string, message interface{}) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	envelope := &hubEnvelope{
+		Origin:  h.instanceID,
+		AgentID: agentID,
+		UserID:  userID,
+		Payload: payload,
+	}
+
+	if h.redis != nil {
+		data, err := json.Marshal(envelope)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), writeWait)
+		defer cancel()
+		if err := h.redis.Publish(ctx, chatBroadcastChannel, data).Err(); err != nil {
+			log.Printf("Failed to publish chat broadcast: %v", err)
+		}
+	}
+
+	select {
+	case h.broadcast <- envelope:
+		return nil
+	case <-h.done:
+		return errClientClosed
+	}
+}
+
+// subscribe relays broadcasts published by other instances to local connections
+func (h *ChatHub) subscribe() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-h.done
+		cancel()
+	}()
+
+	pubsub := h.redis.Subscribe(ctx, chatBroadcastChannel)
+	defer pubsub.Close()
+
+	for msg := range pubsub.Channel() {
+		var envelope hubEnvelope
+		if err := json.Unmarshal([]byte(msg.Payload), &envelope); err != nil {
+			log.Printf("Invalid chat broadcast: %v", err)
+			continue
+		}
+		// Our own broadcasts were already delivered locally
+		if envelope.Origin == h.instanceID {
+			continue
+		}
+		select {
+		case h.broadcast <- &envelope:
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// Count returns the number of registered connections on this instance
+func (h *ChatHub) Count() int {
+	return int(atomic.LoadInt64(&h.count))
+}
+
+// Close disconnects every client and stops the hub
+func (h *ChatHub) Close() {
+	h.closeOnce.Do(func() {
+		close(h.done)
+	})
+}
+
+// writePump sends queued frames and keepalive pings to the connection. It is
+// the only goroutine that writes to the socket.
+func (s *chatSession) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		s.conn.Close()
+	}()
+
+	for {
+		select {
+		case data := <-s.send:
+			s.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := s.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			s.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := s.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-s.done:
+			s.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			s.conn.WriteMessage(websocket.CloseMessage, []byte{})
+			return
+		}
+	}
+}
+
+// enqueue queues a frame for the write pump without blocking
+func (s *chatSession) enqueue(data []byte) error {
+	select {
+	case <-s.done:
+		return errClientClosed
+	default:
+	}
+
+	select {
+	case s.send <- data:
+		return nil
+	case <-s.done:
+		return errClientClosed
+	default:
+		return errSlowClient
+	}
+}
+
+// close stops the write pump; it is safe to call more than once
+func (s *chatSession) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/services"
+)
+
+// ConversationHandler handles chat conversation requests
+type ConversationHandler struct {
+	*BaseHandler
+	conversationService *services.ConversationService
+}
+
+// NewConversationHandler creates a new conversation handler
+func NewConversationHandler(db *gorm.DB, cfg *config.Config) *ConversationHandler {
+	return &ConversationHandler{
+		BaseHandler:         NewBaseHandler(db, cfg),
+		conversationService: services.ConversationServiceInstance,
+	}
+}
+
+// CreateConversation starts a new conversation with an agent
+func (h *ConversationHandler) CreateConversation(c *gin.Context) {
+	var req services.CreateConversationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.sendError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	conversation, err := h.conversationService.CreateConversation(&req, userID)
+	if err != nil {
+		h.sendError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.sendCreated(c, conversation)
+}
+
+// GetConversation gets a conversation with its messages
+func (h *ConversationHandler) GetConversation(c *gin.Context) {
+	conversationID := c.Param("id")
+
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	conversation, err := h.conversationService.GetConversation(conversationID, userID)
+	if err != nil {
+		h.sendError(c, http.StatusNotFound, "Conversation not found")
+		return
+	}
+
+	h.sendSuccess(c, conversation)
+}
+
+// ListConversations lists the current user's conversations
+func (h *ConversationHandler) ListConversations(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	agentID := c.Query("agent_id")
+
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	conversations, total, err := h.conversationService.ListConversations(userID, agentID, page, limit)
+	if err != nil {
+		h.sendError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, gin.H{
+		"conversations": conversations,
+		"total":         total,
+		"page":          page,
+		"limit":         limit,
+	})
+}
+
+// RenameConversation changes a conversation's title
+func (h *ConversationHandler) RenameConversation(c *gin.Context) {
+	conversationID := c.Param("id")
+
+	var req services.RenameConversationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.sendError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	conversation, err := h.conversationService.RenameConversation(conversationID, &req, userID)
+	if err != nil {
+		h.sendError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, conversation)
+}
+
+// DeleteConversation deletes a conversation and its messages
+func (h *ConversationHandler) DeleteConversation(c *gin.Context) {
+	conversationID := c.Param("id")
+
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	if err := h.conversationService.DeleteConversation(conversationID, userID); err != nil {
+		h.sendError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, gin.H{"message": "Conversation deleted successfully"})
+}
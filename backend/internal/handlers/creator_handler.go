@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/services"
+)
+
+// CreatorHandler handles creator earnings and payout requests
+type CreatorHandler struct {
+	*BaseHandler
+	earningsService *services.EarningsService
+}
+
+// NewCreatorHandler creates a new creator handler
+func NewCreatorHandler(db *gorm.DB, cfg *config.Config) *CreatorHandler {
+	return &CreatorHandler{
+		BaseHandler:     NewBaseHandler(db, cfg),
+		earningsService: services.EarningsServiceInstance,
+	}
+}
+
+// GetDashboard reports the current user's earnings as a creator, overall and per agent
+func (h *CreatorHandler) GetDashboard(c *gin.Context) {
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	dashboard, err := h.earningsService.GetDashboard(userID, c.Query("currency"))
+	if err != nil {
+		h.sendError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, dashboard)
+}
+
+// ListEarnings lists the current user's earnings ledger
+func (h *CreatorHandler) ListEarnings(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	earnings, total, err := h.earningsService.ListEarnings(userID, c.Query("type"), page, limit)
+	if err != nil {
+		h.sendError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, gin.H{
+		"earnings": earnings,
+		"total":    total,
+		"page":     page,
+		"limit":    limit,
+	})
+}
+
+// ListPayouts lists the current user's payout requests
+func (h *CreatorHandler) ListPayouts(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	payouts, total, err := h.earningsService.ListPayouts(userID, c.Query("status"), page, limit)
+	if err != nil {
+		h.sendError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, gin.H{
+		"payouts": payouts,
+		"total":   total,
+		"page":    page,
+		"limit":   limit,
+	})
+}
+
+// RequestPayout asks for the current user's available earnings to be paid out
+func (h *CreatorHandler) RequestPayout(c *gin.Context) {
+	var req services.RequestPayoutRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.sendError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	payout, err := h.earningsService.RequestPayout(userID, &req)
+	if err != nil {
+		h.sendError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.sendCreated(c, payout)
+}
+
+// CancelPayout withdraws one of the current user's payout requests
+func (h *CreatorHandler) CancelPayout(c *gin.Context) {
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	payout, err := h.earningsService.CancelPayout(c.Param("id"), userID)
+	if err != nil {
+		h.sendError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, payout)
+}
+
+// ListAllPayouts lists every creator's payouts for review
+func (h *CreatorHandler) ListAllPayouts(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	payouts, total, err := h.earningsService.ListPayouts("", c.Query("status"), page, limit)
+	if err != nil {
+		h.sendError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, gin.H{
+		"payouts": payouts,
+		"total":   total,
+		"page":    page,
+		"limit":   limit,
+	})
+}
+
+// ApprovePayout approves a payout request
+func (h *CreatorHandler) ApprovePayout(c *gin.Context) {
+	adminID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	payout, err := h.earningsService.ApprovePayout(c.Param("id"), adminID)
+	if err != nil {
+		h.sendError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, payout)
+}
+
+// RejectPayout rejects a payout request
+func (h *CreatorHandler) RejectPayout(c *gin.Context) {
+	var req services.ReviewPayoutRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.sendError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	adminID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	payout, err := h.earningsService.RejectPayout(c.Param("id"), adminID, &req)
+	if err != nil {
+		h.sendError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, payout)
+}
+
+// MarkPayoutPaid records that an approved payout has been sent
+func (h *CreatorHandler) MarkPayoutPaid(c *gin.Context) {
+	var req services.ReviewPayoutRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.sendError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	payout, err := h.earningsService.MarkPayoutPaid(c.Param("id"), &req)
+	if err != nil {
+		h.sendError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, payout)
+}
@@ -141,20 +141,32 @@ func (h *IntegrationHandler) GetLLMProviders(c *gin.Context) {
 	h.sendSuccess(c, providers)
 }
 
-// TestLLMConnection tests connection to an LLM provider
+// TestLLMConnection tests connection to a stored LLM provider
 func (h *IntegrationHandler) TestLLMConnection(c *gin.Context) {
-	var req services.LLMProvider
+	var req struct {
+		Name string `json:"name" binding:"required"`
+	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		h.sendError(c, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 
-	if err := h.integrationService.TestLLMConnection(req); err != nil {
-		h.sendError(c, http.StatusInternalServerError, err.Error())
+	result, err := h.integrationService.TestLLMConnection(req.Name)
+	if err != nil {
+		h.sendError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !result.Success {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"success": false,
+			"error":   result.Error,
+			"data":    result,
+		})
 		return
 	}
 
-	h.sendSuccess(c, gin.H{"message": "Connection test successful"})
+	h.sendSuccess(c, result)
 }
 
 // GetIntegrationStats gets integration statistics
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/services"
+)
+
+// LicenseHandler handles on-premises license requests
+type LicenseHandler struct {
+	*BaseHandler
+	licenseService *services.LicenseService
+}
+
+// NewLicenseHandler creates a new license handler
+func NewLicenseHandler(db *gorm.DB, cfg *config.Config) *LicenseHandler {
+	return &LicenseHandler{
+		BaseHandler:    NewBaseHandler(db, cfg),
+		licenseService: services.LicenseServiceInstance,
+	}
+}
+
+// ValidateLicense validates a license key presented by a deployment
+func (h *LicenseHandler) ValidateLicense(c *gin.Context) {
+	var req services.ValidateLicenseRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.sendError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	validation, err := h.licenseService.ValidateLicense(&req)
+	if err != nil {
+		h.sendError(c, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, validation)
+}
+
+// GetPublicKey returns the public key used to verify license keys offline
+func (h *LicenseHandler) GetPublicKey(c *gin.Context) {
+	h.sendSuccess(c, gin.H{
+		"algorithm":  "Ed25519",
+		"public_key": h.licenseService.PublicKey(),
+	})
+}
+
+// GetRevocationList returns the signed list of revoked licenses
+func (h *LicenseHandler) GetRevocationList(c *gin.Context) {
+	list, err := h.licenseService.RevocationList()
+	if err != nil {
+		h.sendError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, gin.H{"revocation_list": list})
+}
+
+// ListLicenses lists the licenses of the current user and, for admins, their organization
+func (h *LicenseHandler) ListLicenses(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	user, exists := h.getCurrentUser(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	licenses, total, err := h.licenseService.ListLicenses(user, c.Query("status"), page, limit)
+	if err != nil {
+		h.sendError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, gin.H{
+		"licenses": licenses,
+		"total":    total,
+		"page":     page,
+		"limit":    limit,
+	})
+}
+
+// GetLicense gets a license and its key
+func (h *LicenseHandler) GetLicense(c *gin.Context) {
+	user, exists := h.getCurrentUser(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	license, err := h.licenseService.GetLicense(c.Param("id"), user)
+	if err != nil {
+		h.sendError(c, http.StatusNotFound, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, license)
+}
+
+// IssueLicense issues a license outside a marketplace purchase
+func (h *LicenseHandler) IssueLicense(c *gin.Context) {
+	var req services.IssueLicenseRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.sendError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	license, err := h.licenseService.IssueLicense(&req)
+	if err != nil {
+		h.sendError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.sendCreated(c, license)
+}
+
+// RevokeLicense revokes a license
+func (h *LicenseHandler) RevokeLicense(c *gin.Context) {
+	var req services.RevokeLicenseRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.sendError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	license, err := h.licenseService.RevokeLicense(c.Param("id"), &req)
+	if err != nil {
+		h.sendError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, license)
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 
@@ -15,6 +16,7 @@ import (
 type MarketplaceHandler struct {
 	*BaseHandler
 	marketplaceService *services.MarketplaceService
+	purchaseService    *services.PurchaseService
 }
 
 // NewMarketplaceHandler creates a new marketplace handler
@@ -22,6 +24,7 @@ func NewMarketplaceHandler(db *gorm.DB, cfg *config.Config) *MarketplaceHandler
 	return &MarketplaceHandler{
 		BaseHandler:        NewBaseHandler(db, cfg),
 		marketplaceService: services.MarketplaceServiceInstance,
+		purchaseService:    services.PurchaseServiceInstance,
 	}
 }
 
@@ -360,11 +363,7 @@ func (h *MarketplaceHandler) TryMarketplaceAgent(c *gin.Context) {
 func (h *MarketplaceHandler) PurchaseMarketplaceAgent(c *gin.Context) {
 	agentID := c.Param("id")
 
-	var req struct {
-		PricingTier    string `json:"pricing_tier" binding:"required"`
-		OrganizationID string `json:"organization_id"`
-	}
-
+	var req services.PurchaseRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		h.sendError(c, http.StatusBadRequest, "Invalid request body")
 		return
@@ -376,15 +375,104 @@ func (h *MarketplaceHandler) PurchaseMarketplaceAgent(c *gin.Context) {
 		return
 	}
 
-	purchase, err := h.marketplaceService.PurchaseMarketplaceAgent(agentID, userID, req.PricingTier, req.OrganizationID)
+	purchase, err := h.marketplaceService.PurchaseMarketplaceAgent(agentID, userID, &req)
+	if errors.Is(err, services.ErrInsufficientCredits) || errors.Is(err, services.ErrPaymentDeclined) {
+		h.sendError(c, http.StatusPaymentRequired, err.Error())
+		return
+	}
+	if err != nil {
+		h.sendError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.sendCreated(c, purchase)
+}
+
+// ListPurchases lists the current user's marketplace purchases
+func (h *MarketplaceHandler) ListPurchases(c *gin.Context) {
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	status := c.Query("status")
+
+	purchases, total, err := h.purchaseService.ListPurchases(userID, status, page, limit)
 	if err != nil {
 		h.sendError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	h.sendSuccess(c, gin.H{
+		"purchases": purchases,
+		"total":     total,
+		"page":      page,
+		"limit":     limit,
+	})
+}
+
+// GetPurchase gets one of the current user's purchases
+func (h *MarketplaceHandler) GetPurchase(c *gin.Context) {
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	purchase, err := h.purchaseService.GetPurchase(c.Param("id"), userID)
+	if err != nil {
+		h.sendError(c, http.StatusNotFound, err.Error())
+		return
+	}
+
 	h.sendSuccess(c, purchase)
 }
 
+// RefundPurchase refunds a purchase and revokes its entitlement
+func (h *MarketplaceHandler) RefundPurchase(c *gin.Context) {
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	var req services.RefundPurchaseRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			h.sendError(c, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+	}
+
+	purchase, err := h.purchaseService.RefundPurchase(c.Param("id"), userID, &req)
+	if err != nil {
+		h.sendError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, purchase)
+}
+
+// ListEntitlements lists the agents the current user, or their organization, may run
+func (h *MarketplaceHandler) ListEntitlements(c *gin.Context) {
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	entitlements, err := h.purchaseService.ListEntitlements(userID)
+	if err != nil {
+		h.sendError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, entitlements)
+}
+
 // GetAgentReviews gets reviews for a marketplace agent
 func (h *MarketplaceHandler) GetAgentReviews(c *gin.Context) {
 	agentID := c.Param("id")
@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/services"
+)
+
+// maxWebhookBodyBytes caps the size of a payment provider webhook
+const maxWebhookBodyBytes = 1 << 20
+
+// PaymentHandler handles payment method, transaction and webhook requests
+type PaymentHandler struct {
+	*BaseHandler
+	paymentService *services.PaymentService
+}
+
+// NewPaymentHandler creates a new payment handler
+func NewPaymentHandler(db *gorm.DB, cfg *config.Config) *PaymentHandler {
+	return &PaymentHandler{
+		BaseHandler:    NewBaseHandler(db, cfg),
+		paymentService: services.PaymentServiceInstance,
+	}
+}
+
+// ListPaymentMethods lists the current user's payment methods
+func (h *PaymentHandler) ListPaymentMethods(c *gin.Context) {
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	methods, err := h.paymentService.ListPaymentMethods(userID)
+	if err != nil {
+		h.sendError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, gin.H{"methods": methods})
+}
+
+// AddPaymentMethod saves a payment method for the current user
+func (h *PaymentHandler) AddPaymentMethod(c *gin.Context) {
+	var req services.AddPaymentMethodRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.sendError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	method, err := h.paymentService.AddPaymentMethod(userID, &req)
+	if err != nil {
+		h.sendError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.sendCreated(c, method)
+}
+
+// ListTransactions lists the current user's payment transactions
+func (h *PaymentHandler) ListTransactions(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	transactions, total, err := h.paymentService.ListTransactions(userID, c.Query("start_date"), c.Query("end_date"), page, limit)
+	if err != nil {
+		h.sendError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, gin.H{
+		"transactions": transactions,
+		"total":        total,
+		"page":         page,
+		"limit":        limit,
+	})
+}
+
+// PurchaseCredits tops up the current user's credits with a payment method
+func (h *PaymentHandler) PurchaseCredits(c *gin.Context) {
+	var req services.PurchaseCreditsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.sendError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	transaction, err := h.paymentService.PurchaseCredits(userID, &req)
+	if errors.Is(err, services.ErrPaymentDeclined) {
+		h.sendError(c, http.StatusPaymentRequired, err.Error())
+		return
+	}
+	if err != nil {
+		h.sendError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.sendCreated(c, transaction)
+}
+
+// HandleWebhook receives signed events from the payment provider
+func (h *PaymentHandler) HandleWebhook(c *gin.Context) {
+	payload, err := io.ReadAll(io.LimitReader(c.Request.Body, maxWebhookBodyBytes))
+	if err != nil {
+		h.sendError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if err := h.paymentService.HandleWebhook(payload, c.Request.Header); err != nil {
+		if errors.Is(err, services.ErrInvalidWebhookSignature) {
+			h.sendError(c, http.StatusUnauthorized, err.Error())
+			return
+		}
+		h.sendError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, gin.H{"received": true})
+}
@@ -1,10 +1,16 @@
 package handlers
 
 import (
+	"context"
+	"errors"
+	"io"
+	"log"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
 	"gorm.io/gorm"
 
 	"github.com/mlaitechio/vagais/internal/config"
@@ -15,6 +21,7 @@ import (
 type RuntimeHandler struct {
 	*BaseHandler
 	runtimeService *services.RuntimeService
+	upgrader       websocket.Upgrader
 }
 
 // NewRuntimeHandler creates a new runtime handler
@@ -22,6 +29,11 @@ func NewRuntimeHandler(db *gorm.DB, cfg *config.Config) *RuntimeHandler {
 	return &RuntimeHandler{
 		BaseHandler:    NewBaseHandler(db, cfg),
 		runtimeService: services.RuntimeServiceInstance,
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				return true // Allow all origins for development
+			},
+		},
 	}
 }
 
@@ -48,6 +60,19 @@ func (h *RuntimeHandler) ExecuteAgent(c *gin.Context) {
 	}
 
 	execution, err := h.runtimeService.ExecuteAgent(&req, userID, orgID)
+	var quotaErr *services.QuotaError
+	if errors.As(err, &quotaErr) {
+		h.sendQuotaError(c, http.StatusPaymentRequired, quotaErr)
+		return
+	}
+	if errors.Is(err, services.ErrInsufficientCredits) || errors.Is(err, services.ErrNotEntitled) {
+		h.sendError(c, http.StatusPaymentRequired, err.Error())
+		return
+	}
+	if errors.Is(err, services.ErrEmailNotVerified) {
+		h.sendError(c, http.StatusForbidden, err.Error())
+		return
+	}
 	if err != nil {
 		h.sendError(c, http.StatusInternalServerError, err.Error())
 		return
@@ -162,3 +187,118 @@ func (h *RuntimeHandler) GetActiveExecutions(c *gin.Context) {
 
 	h.sendSuccess(c, executions)
 }
+
+// authorizeExecutionStream checks that the current user owns the requested execution
+func (h *RuntimeHandler) authorizeExecutionStream(c *gin.Context) (string, bool) {
+	executionID := c.Param("id")
+
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return "", false
+	}
+
+	execution, err := h.runtimeService.GetExecution(executionID)
+	if err != nil || execution.UserID != userID {
+		h.sendError(c, http.StatusNotFound, "Execution not found")
+		return "", false
+	}
+
+	return executionID, true
+}
+
+// StreamExecutionWebSocket streams execution progress over a WebSocket
+func (h *RuntimeHandler) StreamExecutionWebSocket(c *gin.Context) {
+	executionID, ok := h.authorizeExecutionStream(c)
+	if !ok {
+		return
+	}
+
+	conn, err := h.upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade error: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	// Read in the background so pongs are handled and a closed socket ends the stream
+	conn.SetReadLimit(maxChatMessageSize)
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	updates := make(chan services.ExecutionEvent)
+	go h.runtimeService.StreamExecution(ctx, executionID, updates)
+
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-updates:
+			if !ok {
+				conn.SetWriteDeadline(time.Now().Add(writeWait))
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteJSON(event); err != nil {
+				return
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// StreamExecutionEvents streams execution progress as server-sent events
+func (h *RuntimeHandler) StreamExecutionEvents(c *gin.Context) {
+	executionID, ok := h.authorizeExecutionStream(c)
+	if !ok {
+		return
+	}
+
+	// The stream outlives the server's write timeout
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+
+	updates := make(chan services.ExecutionEvent)
+	go h.runtimeService.StreamExecution(c.Request.Context(), executionID, updates)
+
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event, ok := <-updates:
+			if !ok {
+				return false
+			}
+			c.SSEvent(event.Type, event)
+			return true
+		case <-ticker.C:
+			// Comment lines keep proxies from closing an idle stream
+			io.WriteString(w, ": keepalive\n\n")
+			return true
+		}
+	})
+}
@@ -0,0 +1,283 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+	"github.com/mlaitechio/vagais/internal/services"
+)
+
+// SCIMHandler handles SCIM provisioning requests from identity providers,
+// and the management of the tokens they use
+type SCIMHandler struct {
+	*BaseHandler
+	scimService *services.SCIMService
+}
+
+// NewSCIMHandler creates a new SCIM handler
+func NewSCIMHandler(db *gorm.DB, cfg *config.Config) *SCIMHandler {
+	return &SCIMHandler{
+		BaseHandler: NewBaseHandler(db, cfg),
+		scimService: services.SCIMServiceInstance,
+	}
+}
+
+// ListTokens lists the organization's SCIM tokens
+func (h *SCIMHandler) ListTokens(c *gin.Context) {
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	tokens, err := h.scimService.ListTokens(c.Param("id"), userID)
+	if err != nil {
+		h.sendError(c, http.StatusForbidden, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, tokens)
+}
+
+// CreateToken creates a SCIM token; the token is only shown in this response
+func (h *SCIMHandler) CreateToken(c *gin.Context) {
+	var req services.CreateSCIMTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.sendError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	token, err := h.scimService.CreateToken(c.Param("id"), userID, &req)
+	if err != nil {
+		h.sendError(c, http.StatusForbidden, err.Error())
+		return
+	}
+
+	h.sendCreated(c, token)
+}
+
+// RevokeToken revokes a SCIM token
+func (h *SCIMHandler) RevokeToken(c *gin.Context) {
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	token, err := h.scimService.RevokeToken(c.Param("id"), userID, c.Param("tokenId"))
+	if err != nil {
+		h.sendError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, token)
+}
+
+// ServiceProviderConfig describes the SCIM features supported
+func (h *SCIMHandler) ServiceProviderConfig(c *gin.Context) {
+	h.sendSCIM(c, http.StatusOK, h.scimService.ServiceProviderConfig())
+}
+
+// ResourceTypes lists the SCIM resource types served
+func (h *SCIMHandler) ResourceTypes(c *gin.Context) {
+	h.sendSCIM(c, http.StatusOK, h.scimService.ResourceTypes())
+}
+
+// ListUsers lists the organization's users
+func (h *SCIMHandler) ListUsers(c *gin.Context) {
+	response, err := h.scimService.ListUsers(h.scimToken(c), h.listQuery(c))
+	if err != nil {
+		h.sendSCIMError(c, err)
+		return
+	}
+	h.sendSCIM(c, http.StatusOK, response)
+}
+
+// GetUser returns a user
+func (h *SCIMHandler) GetUser(c *gin.Context) {
+	user, err := h.scimService.GetUser(h.scimToken(c), c.Param("id"))
+	if err != nil {
+		h.sendSCIMError(c, err)
+		return
+	}
+	h.sendSCIM(c, http.StatusOK, user)
+}
+
+// CreateUser provisions a user
+func (h *SCIMHandler) CreateUser(c *gin.Context) {
+	var req services.SCIMUser
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.sendSCIMError(c, services.NewSCIMError(http.StatusBadRequest, "invalidSyntax", "Invalid request body"))
+		return
+	}
+
+	user, err := h.scimService.CreateUser(h.scimToken(c), &req)
+	if err != nil {
+		h.sendSCIMError(c, err)
+		return
+	}
+	h.sendSCIM(c, http.StatusCreated, user)
+}
+
+// ReplaceUser replaces a user's attributes
+func (h *SCIMHandler) ReplaceUser(c *gin.Context) {
+	var req services.SCIMUser
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.sendSCIMError(c, services.NewSCIMError(http.StatusBadRequest, "invalidSyntax", "Invalid request body"))
+		return
+	}
+
+	user, err := h.scimService.ReplaceUser(h.scimToken(c), c.Param("id"), &req)
+	if err != nil {
+		h.sendSCIMError(c, err)
+		return
+	}
+	h.sendSCIM(c, http.StatusOK, user)
+}
+
+// PatchUser modifies a user's attributes, including deactivating them
+func (h *SCIMHandler) PatchUser(c *gin.Context) {
+	var req services.SCIMPatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.sendSCIMError(c, services.NewSCIMError(http.StatusBadRequest, "invalidSyntax", "Invalid request body"))
+		return
+	}
+
+	user, err := h.scimService.PatchUser(h.scimToken(c), c.Param("id"), &req)
+	if err != nil {
+		h.sendSCIMError(c, err)
+		return
+	}
+	h.sendSCIM(c, http.StatusOK, user)
+}
+
+// DeleteUser deactivates a user and removes them from the organization
+func (h *SCIMHandler) DeleteUser(c *gin.Context) {
+	if err := h.scimService.DeleteUser(h.scimToken(c), c.Param("id")); err != nil {
+		h.sendSCIMError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// ListGroups lists the organization's groups
+func (h *SCIMHandler) ListGroups(c *gin.Context) {
+	response, err := h.scimService.ListGroups(h.scimToken(c), h.listQuery(c))
+	if err != nil {
+		h.sendSCIMError(c, err)
+		return
+	}
+	h.sendSCIM(c, http.StatusOK, response)
+}
+
+// GetGroup returns a group
+func (h *SCIMHandler) GetGroup(c *gin.Context) {
+	group, err := h.scimService.GetGroup(h.scimToken(c), c.Param("id"))
+	if err != nil {
+		h.sendSCIMError(c, err)
+		return
+	}
+	h.sendSCIM(c, http.StatusOK, group)
+}
+
+// CreateGroup creates a group
+func (h *SCIMHandler) CreateGroup(c *gin.Context) {
+	var req services.SCIMGroupResource
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.sendSCIMError(c, services.NewSCIMError(http.StatusBadRequest, "invalidSyntax", "Invalid request body"))
+		return
+	}
+
+	group, err := h.scimService.CreateGroup(h.scimToken(c), &req)
+	if err != nil {
+		h.sendSCIMError(c, err)
+		return
+	}
+	h.sendSCIM(c, http.StatusCreated, group)
+}
+
+// ReplaceGroup replaces a group's name and members
+func (h *SCIMHandler) ReplaceGroup(c *gin.Context) {
+	var req services.SCIMGroupResource
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.sendSCIMError(c, services.NewSCIMError(http.StatusBadRequest, "invalidSyntax", "Invalid request body"))
+		return
+	}
+
+	group, err := h.scimService.ReplaceGroup(h.scimToken(c), c.Param("id"), &req)
+	if err != nil {
+		h.sendSCIMError(c, err)
+		return
+	}
+	h.sendSCIM(c, http.StatusOK, group)
+}
+
+// PatchGroup modifies a group's name and members
+func (h *SCIMHandler) PatchGroup(c *gin.Context) {
+	var req services.SCIMPatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.sendSCIMError(c, services.NewSCIMError(http.StatusBadRequest, "invalidSyntax", "Invalid request body"))
+		return
+	}
+
+	group, err := h.scimService.PatchGroup(h.scimToken(c), c.Param("id"), &req)
+	if err != nil {
+		h.sendSCIMError(c, err)
+		return
+	}
+	h.sendSCIM(c, http.StatusOK, group)
+}
+
+// DeleteGroup deletes a group
+func (h *SCIMHandler) DeleteGroup(c *gin.Context) {
+	if err := h.scimService.DeleteGroup(h.scimToken(c), c.Param("id")); err != nil {
+		h.sendSCIMError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// scimToken returns the token SCIMAuthMiddleware authenticated
+func (h *SCIMHandler) scimToken(c *gin.Context) *models.SCIMToken {
+	token, _ := c.Get("scim_token")
+	return token.(*models.SCIMToken)
+}
+
+// listQuery reads the filter and page of a list request
+func (h *SCIMHandler) listQuery(c *gin.Context) *services.SCIMListQuery {
+	startIndex, _ := strconv.Atoi(c.DefaultQuery("startIndex", "1"))
+	count, _ := strconv.Atoi(c.DefaultQuery("count", "0"))
+	return &services.SCIMListQuery{
+		Filter:             c.Query("filter"),
+		StartIndex:         startIndex,
+		Count:              count,
+		ExcludedAttributes: c.Query("excludedAttributes"),
+	}
+}
+
+// sendSCIM sends a SCIM response, which is not wrapped like other responses
+func (h *SCIMHandler) sendSCIM(c *gin.Context, status int, data interface{}) {
+	c.Header("Content-Type", "application/scim+json")
+	c.JSON(status, data)
+}
+
+// sendSCIMError sends an error in the SCIM error format
+func (h *SCIMHandler) sendSCIMError(c *gin.Context, err error) {
+	var scimErr *services.SCIMError
+	if !errors.As(err, &scimErr) {
+		scimErr = services.NewSCIMError(http.StatusInternalServerError, "", err.Error())
+	}
+	h.sendSCIM(c, scimErr.Status, scimErr)
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/services"
+)
+
+// SSOHandler handles single sign-on requests
+type SSOHandler struct {
+	*BaseHandler
+	ssoService *services.SSOService
+}
+
+// NewSSOHandler creates a new SSO handler
+func NewSSOHandler(db *gorm.DB, cfg *config.Config) *SSOHandler {
+	return &SSOHandler{
+		BaseHandler: NewBaseHandler(db, cfg),
+		ssoService:  services.SSOServiceInstance,
+	}
+}
+
+// StartLogin returns the identity provider URL to send the user to
+func (h *SSOHandler) StartLogin(c *gin.Context) {
+	var req services.SSOStartRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.sendError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	response, err := h.ssoService.StartLogin(&req)
+	if err != nil {
+		h.sendError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, response)
+}
+
+// Callback completes a login with the code and state the identity provider
+// sent back
+func (h *SSOHandler) Callback(c *gin.Context) {
+	var req services.SSOCallbackRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.sendError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	response, err := h.ssoService.HandleCallback(&req, clientInfo(c))
+	if err != nil {
+		var quotaErr *services.QuotaError
+		if errors.As(err, &quotaErr) {
+			h.sendQuotaError(c, http.StatusPaymentRequired, quotaErr)
+			return
+		}
+		h.sendError(c, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, response)
+}
+
+// GetConnection returns the organization's identity provider
+func (h *SSOHandler) GetConnection(c *gin.Context) {
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	conn, err := h.ssoService.GetConnection(c.Param("id"), userID)
+	if err != nil {
+		h.sendError(c, http.StatusNotFound, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, conn)
+}
+
+// SaveConnection configures the organization's identity provider
+func (h *SSOHandler) SaveConnection(c *gin.Context) {
+	var req services.SSOConnectionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.sendError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	conn, err := h.ssoService.SaveConnection(c.Param("id"), userID, &req)
+	if err != nil {
+		h.sendError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, conn)
+}
+
+// DeleteConnection removes the organization's identity provider
+func (h *SSOHandler) DeleteConnection(c *gin.Context) {
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	if err := h.ssoService.DeleteConnection(c.Param("id"), userID); err != nil {
+		h.sendError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, gin.H{"message": "Single sign-on removed"})
+}
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/services"
+)
+
+// UsageHandler handles usage and credit requests
+type UsageHandler struct {
+	*BaseHandler
+	creditService *services.CreditService
+	planService   *services.PlanService
+}
+
+// NewUsageHandler creates a new usage handler
+func NewUsageHandler(db *gorm.DB, cfg *config.Config) *UsageHandler {
+	return &UsageHandler{
+		BaseHandler:   NewBaseHandler(db, cfg),
+		creditService: services.CreditServiceInstance,
+		planService:   services.PlanServiceInstance,
+	}
+}
+
+// GetCredits gets the current user's credit balance
+func (h *UsageHandler) GetCredits(c *gin.Context) {
+	user, exists := h.getCurrentUser(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	// Grant this month's plan credits before reporting the balance
+	if err := h.planService.AllocateIncludedCredits(user.ID, user.OrganizationID); err != nil {
+		h.sendError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	balance, err := h.creditService.GetBalance(user.ID)
+	if err != nil {
+		h.sendError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if plan := h.planService.PlanFor(user.OrganizationID); plan.IncludedCredits > 0 {
+		balance.MonthlyAllocation = &plan.IncludedCredits
+	}
+
+	h.sendSuccess(c, balance)
+}
+
+// ListCreditTransactions lists the current user's credit ledger
+func (h *UsageHandler) ListCreditTransactions(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	txType := c.Query("type")
+
+	userID, exists := h.getCurrentUserID(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	transactions, total, err := h.creditService.ListTransactions(userID, txType, page, limit)
+	if err != nil {
+		h.sendError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, gin.H{
+		"transactions": transactions,
+		"total":        total,
+		"page":         page,
+		"limit":        limit,
+	})
+}
+
+// GetPlanUsage reports the current user's usage against the limits of their plan
+func (h *UsageHandler) GetPlanUsage(c *gin.Context) {
+	user, exists := h.getCurrentUser(c)
+	if !exists {
+		h.sendError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	usage, err := h.planService.GetUsage(user.ID, user.OrganizationID)
+	if err != nil {
+		h.sendError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, usage)
+}
+
+// ListPlans lists the available subscription plans
+func (h *UsageHandler) ListPlans(c *gin.Context) {
+	h.sendSuccess(c, gin.H{"plans": h.planService.Plans()})
+}
+
+// SetOrganizationPlan moves an organization to another plan
+func (h *UsageHandler) SetOrganizationPlan(c *gin.Context) {
+	var req struct {
+		Plan string `json:"plan" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.sendError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	org, err := h.planService.SetOrganizationPlan(c.Param("id"), req.Plan)
+	if err != nil {
+		h.sendError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.sendSuccess(c, org)
+}
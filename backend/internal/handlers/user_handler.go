@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 
@@ -293,6 +294,11 @@ func (h *UserHandler) InviteUserToOrganization(c *gin.Context) {
 	}
 
 	if err := h.userService.InviteUserToOrganization(&req, orgID, userID); err != nil {
+		var quotaErr *services.QuotaError
+		if errors.As(err, &quotaErr) {
+			h.sendQuotaError(c, http.StatusPaymentRequired, quotaErr)
+			return
+		}
 		h.sendError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
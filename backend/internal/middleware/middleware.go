@@ -2,6 +2,7 @@ package middleware
 
 import (
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -13,7 +14,7 @@ import (
 	"github.com/mlaitechio/vagais/internal/services"
 )
 
-// AuthMiddleware validates JWT tokens
+// AuthMiddleware authenticates requests with a JWT or an API key
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
@@ -30,19 +31,40 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		user, err := services.AuthServiceInstance.GetUserFromToken(tokenString)
+		if strings.HasPrefix(tokenString, services.APIKeyPrefix) {
+			status, message := authenticateAPIKey(c, tokenString)
+			if status != 0 {
+				c.JSON(status, gin.H{"error": message})
+				c.Abort()
+				return
+			}
+			c.Next()
+			return
+		}
+
+		user, claims, err := services.AuthServiceInstance.AuthenticateToken(tokenString)
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
 			c.Abort()
 			return
 		}
 
+		if services.AuthServiceInstance.MFASetupRequired(user) && !allowedWithoutMFA(c.FullPath()) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error":              services.ErrMFASetupRequired.Error(),
+				"mfa_setup_required": true,
+			})
+			c.Abort()
+			return
+		}
+
 		c.Set("user", user)
+		c.Set("token_claims", claims)
 		c.Next()
 	}
 }
 
-// OptionalAuthMiddleware validates JWT tokens if present
+// OptionalAuthMiddleware authenticates requests with a JWT or an API key if present
 func OptionalAuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
@@ -57,8 +79,14 @@ func OptionalAuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		if strings.HasPrefix(tokenString, services.APIKeyPrefix) {
+			authenticateAPIKey(c, tokenString)
+			c.Next()
+			return
+		}
+
 		user, err := services.AuthServiceInstance.GetUserFromToken(tokenString)
-		if err == nil {
+		if err == nil && !services.AuthServiceInstance.MFASetupRequired(user) {
 			c.Set("user", user)
 		}
 
@@ -66,6 +94,109 @@ func OptionalAuthMiddleware() gin.HandlerFunc {
 	}
 }
 
+// SCIMAuthMiddleware authenticates identity providers with an organization's
+// SCIM token. Errors are sent in the SCIM error format.
+func SCIMAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokenString := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		token, err := services.SCIMServiceInstance.Authenticate(tokenString)
+		if err != nil {
+			c.Header("WWW-Authenticate", `Bearer realm="scim"`)
+			c.Header("Content-Type", "application/scim+json")
+			c.JSON(http.StatusUnauthorized, services.NewSCIMError(http.StatusUnauthorized, "", err.Error()))
+			c.Abort()
+			return
+		}
+
+		c.Set("scim_token", token)
+		c.Next()
+	}
+}
+
+// allowedWithoutMFA reports whether a user who must enable MFA may still
+// use the route: enough to enroll, and to sign out
+func allowedWithoutMFA(path string) bool {
+	if strings.HasPrefix(path, "/api/v1/auth/mfa") || strings.HasPrefix(path, "/api/v1/auth/sessions") {
+		return true
+	}
+	switch path {
+	case "/api/v1/auth/logout", "/api/v1/auth/logout-all":
+		return true
+	}
+	return false
+}
+
+// authenticateAPIKey checks an API key and the scope the route requires, and
+// on success sets the user and key on the context. It returns the status and
+// message to respond with on failure, or zero.
+func authenticateAPIKey(c *gin.Context, key string) (int, string) {
+	user, apiKey, err := services.APIKeyServiceInstance.Authenticate(key, c.ClientIP())
+	if err != nil {
+		return http.StatusUnauthorized, err.Error()
+	}
+	if services.AuthServiceInstance.MFASetupRequired(user) {
+		return http.StatusForbidden, services.ErrMFASetupRequired.Error()
+	}
+
+	scope := apiKeyScopeFor(c.Request.Method, c.FullPath())
+	if scope == "" {
+		return http.StatusForbidden, "API keys cannot access this endpoint"
+	}
+	if !services.APIKeyHasScope(apiKey, scope) {
+		return http.StatusForbidden, "API key is missing the " + scope + " scope"
+	}
+
+	c.Set("user", user)
+	c.Set("api_key", apiKey)
+	return 0, ""
+}
+
+// apiKeyRouteScope is the scope an API key needs to read or write under a path
+type apiKeyRouteScope struct {
+	path  string
+	read  string
+	write string
+}
+
+// apiKeyRouteScopes lists the routes API keys may use, most specific first.
+// A path ending in "/" matches every route below it; routes not listed here,
+// such as account, API key and admin management, need a login.
+var apiKeyRouteScopes = []apiKeyRouteScope{
+	{"/api/v1/agents/:id/execute", "", services.ScopeExecutionsWrite},
+	{"/api/v1/agents", services.ScopeAgentsRead, services.ScopeAgentsWrite},
+	{"/api/v1/agents/", services.ScopeAgentsRead, services.ScopeAgentsWrite},
+	{"/api/v1/runtime/", services.ScopeExecutionsRead, services.ScopeExecutionsWrite},
+	{"/ws/executions/", services.ScopeExecutionsRead, ""},
+	{"/api/v1/conversations", services.ScopeConversationsRead, services.ScopeConversationsWrite},
+	{"/api/v1/conversations/", services.ScopeConversationsRead, services.ScopeConversationsWrite},
+	{"/api/v1/integrations/webhooks", services.ScopeWebhooksManage, services.ScopeWebhooksManage},
+	{"/api/v1/integrations/webhooks/", services.ScopeWebhooksManage, services.ScopeWebhooksManage},
+	{"/api/v1/marketplace/agents/:id/purchase", "", services.ScopeMarketplacePurchase},
+	{"/api/v1/marketplace/purchases/:id/refund", "", services.ScopeMarketplacePurchase},
+	{"/api/v1/marketplace/", services.ScopeAgentsRead, ""},
+	{"/api/v1/usage/", services.ScopeUsageRead, ""},
+	{"/api/v1/billing/", services.ScopeBillingRead, ""},
+	{"/api/v1/licenses", services.ScopeLicensesRead, ""},
+	{"/api/v1/licenses/", services.ScopeLicensesRead, ""},
+}
+
+// apiKeyScopeFor returns the scope an API key needs for a request, or "" when
+// API keys may not be used for it
+func apiKeyScopeFor(method, path string) string {
+	for _, route := range apiKeyRouteScopes {
+		matches := path == route.path ||
+			(strings.HasSuffix(route.path, "/") && strings.HasPrefix(path, route.path))
+		if !matches {
+			continue
+		}
+		if method == http.MethodGet || method == http.MethodHead {
+			return route.read
+		}
+		return route.write
+	}
+	return ""
+}
+
 // RoleMiddleware checks if user has required role
 func RoleMiddleware(roles ...string) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -153,6 +284,76 @@ func RateLimiter() gin.HandlerFunc {
 	}
 }
 
+// PlanRateLimit limits authenticated requests to the rate of the caller's plan.
+// Requests are counted per organization, or per user outside one.
+func PlanRateLimit() gin.HandlerFunc {
+	limiter := NewPlanLimiter()
+
+	return func(c *gin.Context) {
+		value, exists := c.Get("user")
+		if !exists {
+			c.Next()
+			return
+		}
+		user, ok := value.(*models.User)
+		if !ok {
+			c.Next()
+			return
+		}
+
+		if quotaErr, retryAfter := limiter.Allow(user); quotaErr != nil {
+			c.Header("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+			c.JSON(http.StatusTooManyRequests, gin.H{
+				"success": false,
+				"error":   quotaErr.Message,
+				"quota":   quotaErr,
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// PlanLimiter counts requests against the rate limit of each caller's plan
+type PlanLimiter struct {
+	mu      sync.Mutex
+	clients map[string]*rateLimiter
+}
+
+// NewPlanLimiter creates a plan rate limiter with no requests counted
+func NewPlanLimiter() *PlanLimiter {
+	return &PlanLimiter{clients: make(map[string]*rateLimiter)}
+}
+
+// Allow counts a request by the user. When it exceeds the plan's rate it
+// returns the error to report and how long until a request is allowed again.
+func (l *PlanLimiter) Allow(user *models.User) (*services.QuotaError, time.Duration) {
+	key, plan := services.PlanServiceInstance.RateLimitFor(user)
+	if plan.RateLimitPerMinute <= 0 {
+		return nil, 0
+	}
+
+	l.mu.Lock()
+	limiter, exists := l.clients[key]
+	if !exists {
+		limiter = &rateLimiter{
+			requests: make([]time.Time, 0),
+			window:   time.Minute,
+		}
+		l.clients[key] = limiter
+	}
+	l.mu.Unlock()
+
+	// The plan may have changed since the limiter was created
+	limiter.SetLimit(plan.RateLimitPerMinute)
+	if !limiter.Allow() {
+		return services.PlanServiceInstance.RateLimitError(plan), limiter.RetryAfter()
+	}
+	return nil, 0
+}
+
 // SecurityHeaders adds security headers
 func SecurityHeaders() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -234,3 +435,24 @@ func (rl *rateLimiter) Allow() bool {
 
 	return false
 }
+
+// SetLimit changes the number of requests allowed per window
+func (rl *rateLimiter) SetLimit(limit int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.limit = limit
+}
+
+// RetryAfter returns how long until the oldest request leaves the window
+func (rl *rateLimiter) RetryAfter() time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if len(rl.requests) == 0 {
+		return 0
+	}
+	if wait := rl.window - time.Since(rl.requests[0]); wait > 0 {
+		return wait
+	}
+	return 0
+}
@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/mlaitechio/vagais/internal/services"
+)
+
+func TestAPIKeyScopeFor(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{method: http.MethodGet, path: "/api/v1/agents", want: services.ScopeAgentsRead},
+		{method: http.MethodHead, path: "/api/v1/agents/:id", want: services.ScopeAgentsRead},
+		{method: http.MethodPost, path: "/api/v1/agents", want: services.ScopeAgentsWrite},
+		{method: http.MethodDelete, path: "/api/v1/agents/:id", want: services.ScopeAgentsWrite},
+		// Running an agent needs the execution scope, not the agent one
+		{method: http.MethodPost, path: "/api/v1/agents/:id/execute", want: services.ScopeExecutionsWrite},
+		{method: http.MethodGet, path: "/api/v1/runtime/executions/:id", want: services.ScopeExecutionsRead},
+		{method: http.MethodGet, path: "/ws/executions/:id", want: services.ScopeExecutionsRead},
+		{method: http.MethodPost, path: "/api/v1/marketplace/agents/:id/purchase", want: services.ScopeMarketplacePurchase},
+		{method: http.MethodGet, path: "/api/v1/marketplace/agents", want: services.ScopeAgentsRead},
+		{method: http.MethodPost, path: "/api/v1/marketplace/agents/:id/reviews", want: ""},
+		{method: http.MethodGet, path: "/api/v1/billing/invoices/:id/download", want: services.ScopeBillingRead},
+		{method: http.MethodPut, path: "/api/v1/integrations/webhooks/:id", want: services.ScopeWebhooksManage},
+		// Account, key and admin management need a login
+		{method: http.MethodPost, path: "/api/v1/api-keys", want: ""},
+		{method: http.MethodGet, path: "/api/v1/users/profile", want: ""},
+		{method: http.MethodGet, path: "/api/v1/admin/users", want: ""},
+		{method: http.MethodGet, path: "/api/v1/agentsx", want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := apiKeyScopeFor(tt.method, tt.path); got != tt.want {
+			t.Errorf("apiKeyScopeFor(%s %s) = %q, want %q", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package models
 import (
 	"database/sql/driver"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
@@ -30,28 +31,40 @@ type Organization struct {
 	Logo        string `json:"logo"`
 	IsActive    bool   `json:"is_active" gorm:"default:true"`
 	Plan        string `json:"plan" gorm:"default:'free'"`
-	Users       []User `json:"users,omitempty" gorm:"foreignKey:OrganizationID"`
+	// RequireVerifiedEmail stops members who have not verified their email
+	// address from running agents or publishing them to the marketplace
+	RequireVerifiedEmail bool `json:"require_verified_email" gorm:"default:false"`
+	// RequireMFA makes members enable multi-factor authentication before
+	// they can use the platform
+	RequireMFA bool   `json:"require_mfa" gorm:"default:false"`
+	Users      []User `json:"users,omitempty" gorm:"foreignKey:OrganizationID"`
 }
 
 // User represents a platform user
 type User struct {
 	BaseModel
-	Email          string        `json:"email" gorm:"uniqueIndex;not null"`
-	Username       string        `json:"username" gorm:"uniqueIndex;not null"`
-	FirstName      string        `json:"first_name"`
-	LastName       string        `json:"last_name"`
-	PasswordHash   string        `json:"-" gorm:"not null"`
-	Role           string        `json:"role" gorm:"default:'user'"`
-	IsActive       bool          `json:"is_active" gorm:"default:true"`
-	EmailVerified  bool          `json:"email_verified" gorm:"default:false"`
-	Avatar         string        `json:"avatar"`
-	OrganizationID *string       `json:"organization_id,omitempty"`
-	Organization   *Organization `json:"organization,omitempty"`
-	Credits        int64         `json:"credits" gorm:"default:0"`
-	LastLoginAt    *time.Time    `json:"last_login_at"`
-	Preferences    JSON          `json:"preferences" gorm:"type:jsonb"`
-	Agents         []Agent       `json:"agents,omitempty" gorm:"foreignKey:CreatorID"`
-	Reviews        []Review      `json:"reviews,omitempty" gorm:"foreignKey:UserID"`
+	Email              string        `json:"email" gorm:"uniqueIndex;not null"`
+	Username           string        `json:"username" gorm:"uniqueIndex;not null"`
+	FirstName          string        `json:"first_name"`
+	LastName           string        `json:"last_name"`
+	PasswordHash       string        `json:"-" gorm:"not null"`
+	Role               string        `json:"role" gorm:"default:'user'"`
+	IsActive           bool          `json:"is_active" gorm:"default:true"`
+	EmailVerified      bool          `json:"email_verified" gorm:"default:false"`
+	VerificationSentAt *time.Time    `json:"-"` // when a verification email was last sent
+	MFAEnabled         bool          `json:"mfa_enabled" gorm:"default:false"`
+	MFASecret          string        `json:"-"` // encrypted TOTP secret
+	MFAPendingSecret   string        `json:"-"` // encrypted secret awaiting confirmation
+	MFALastStep        int64         `json:"-"` // time step of the last accepted code
+	SCIMExternalID     string        `json:"-" gorm:"index"`
+	Avatar             string        `json:"avatar"`
+	OrganizationID     *string       `json:"organization_id,omitempty"`
+	Organization       *Organization `json:"organization,omitempty"`
+	Credits            int64         `json:"credits" gorm:"default:0"`
+	LastLoginAt        *time.Time    `json:"last_login_at"`
+	Preferences        JSON          `json:"preferences" gorm:"type:jsonb"`
+	Agents             []Agent       `json:"agents,omitempty" gorm:"foreignKey:CreatorID"`
+	Reviews            []Review      `json:"reviews,omitempty" gorm:"foreignKey:UserID"`
 }
 
 // Agent represents an AI agent
@@ -113,22 +126,296 @@ type Review struct {
 // Execution represents agent execution logs
 type Execution struct {
 	BaseModel
-	AgentID        string        `json:"agent_id"`
-	Agent          Agent         `json:"agent"`
-	UserID         string        `json:"user_id"`
-	User           User          `json:"user"`
-	OrganizationID *string       `json:"organization_id,omitempty"`
+	AgentID        string          `json:"agent_id"`
+	Agent          Agent           `json:"agent"`
+	UserID         string          `json:"user_id"`
+	User           User            `json:"user"`
+	OrganizationID *string         `json:"organization_id,omitempty"`
+	Organization   *Organization   `json:"organization,omitempty"`
+	Status         string          `json:"status"`
+	Input          JSON            `json:"input" gorm:"type:jsonb"`
+	Output         JSON            `json:"output" gorm:"type:jsonb"`
+	Error          string          `json:"error,omitempty"`
+	Duration       int64           `json:"duration"`
+	Cost           float64         `json:"cost" gorm:"default:0"`
+	CreditsUsed    int64           `json:"credits_used" gorm:"default:0"`
+	Model          string          `json:"model,omitempty"`
+	PromptTokens   int64           `json:"prompt_tokens" gorm:"default:0"`
+	OutputTokens   int64           `json:"output_tokens" gorm:"default:0"`
+	TotalTokens    int64           `json:"total_tokens" gorm:"default:0"`
+	IPAddress      string          `json:"ip_address"`
+	UserAgent      string          `json:"user_agent"`
+	SessionID      string          `json:"session_id"`
+	EntitlementID  *string         `json:"entitlement_id,omitempty"` // usage-based entitlement the run drew on
+	Steps          []ExecutionStep `json:"steps,omitempty" gorm:"foreignKey:ExecutionID"`
+}
+
+// ExecutionStep represents a tool invocation made during an execution
+type ExecutionStep struct {
+	BaseModel
+	ExecutionID string `json:"execution_id" gorm:"index"`
+	Sequence    int    `json:"sequence"`
+	Type        string `json:"type" gorm:"default:'tool_call'"`
+	ToolName    string `json:"tool_name"`
+	ToolCallID  string `json:"tool_call_id"`
+	Input       JSON   `json:"input" gorm:"type:jsonb"`
+	Output      JSON   `json:"output" gorm:"type:jsonb"`
+	Error       string `json:"error,omitempty"`
+	Duration    int64  `json:"duration"`
+}
+
+// ExecutionJob represents a queued run of an execution
+type ExecutionJob struct {
+	BaseModel
+	ExecutionID    string     `json:"execution_id" gorm:"uniqueIndex"`
+	AgentID        string     `json:"agent_id" gorm:"index"`
+	OrganizationID *string    `json:"organization_id,omitempty" gorm:"index"`
+	Status         string     `json:"status" gorm:"index;default:'queued'"` // queued, running, completed, failed, cancelled
+	Attempts       int        `json:"attempts" gorm:"default:0"`
+	MaxAttempts    int        `json:"max_attempts" gorm:"default:3"`
+	AvailableAt    time.Time  `json:"available_at" gorm:"index"`
+	LockedBy       string     `json:"locked_by,omitempty"`
+	LockedUntil    *time.Time `json:"locked_until,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+}
+
+// CreditTransaction represents an entry in a user's credit ledger. Entries are
+// never changed once written; Balance is the user's balance after the entry.
+type CreditTransaction struct {
+	BaseModel
+	UserID      string  `json:"user_id" gorm:"index;not null"`
+	Type        string  `json:"type" gorm:"index;uniqueIndex:idx_credit_execution_entry,priority:2"` // grant, purchase, reserve, settle, refund, adjustment, agent_purchase
+	Amount      int64   `json:"amount"`
+	Balance     int64   `json:"balance"`
+	ExecutionID *string `json:"execution_id,omitempty" gorm:"index;uniqueIndex:idx_credit_execution_entry,priority:1"` // reserved and settled once each
+	Description string  `json:"description"`
+	Metadata    JSON    `json:"metadata" gorm:"type:jsonb"`
+}
+
+// BeforeUpdate keeps the credit ledger append-only
+func (t *CreditTransaction) BeforeUpdate(tx *gorm.DB) error {
+	return errors.New("credit transactions cannot be modified")
+}
+
+// BeforeDelete keeps the credit ledger append-only
+func (t *CreditTransaction) BeforeDelete(tx *gorm.DB) error {
+	return errors.New("credit transactions cannot be deleted")
+}
+
+// Purchase represents a user's purchase of a paid marketplace agent
+type Purchase struct {
+	BaseModel
+	UserID         string     `json:"user_id" gorm:"index;not null;uniqueIndex:idx_purchase_one_time_owner,where:pricing_model = 'one_time' AND status = 'completed'"`
+	AgentID        string     `json:"agent_id" gorm:"index;not null;uniqueIndex:idx_purchase_one_time_owner"` // one completed one-time purchase per buyer
+	Agent          *Agent     `json:"agent,omitempty"`
+	OrganizationID *string    `json:"organization_id,omitempty" gorm:"index"`
+	PricingModel   string     `json:"pricing_model"` // one_time, subscription, usage_based
+	PricingTier    string     `json:"pricing_tier"`
+	Quantity       int        `json:"quantity" gorm:"default:1"`
+	Amount         float64    `json:"amount"`
+	Currency       string     `json:"currency" gorm:"default:'USD'"`
+	Credits        int64      `json:"credits"`
+	PaymentMethod  string     `json:"payment_method" gorm:"default:'credits'"` // credits, payment_method
+	Status         string     `json:"status" gorm:"index;default:'pending'"`   // pending, completed, failed, cancelled, refunded, expired
+	CompletedAt    *time.Time `json:"completed_at,omitempty"`
+	RefundedAt     *time.Time `json:"refunded_at,omitempty"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	FailureReason  string     `json:"failure_reason,omitempty"`
+	Metadata       JSON       `json:"metadata" gorm:"type:jsonb"`
+}
+
+// Entitlement represents the right, granted by a purchase, to run an agent
+type Entitlement struct {
+	BaseModel
+	UserID         string     `json:"user_id" gorm:"index;not null"`
+	AgentID        string     `json:"agent_id" gorm:"index;not null"`
+	OrganizationID *string    `json:"organization_id,omitempty" gorm:"index"`
+	PurchaseID     string     `json:"purchase_id" gorm:"index"`
+	Type           string     `json:"type"`                                 // one_time, subscription, usage_based
+	Status         string     `json:"status" gorm:"index;default:'active'"` // active, expired, exhausted, revoked
+	StartsAt       time.Time  `json:"starts_at"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	UsageLimit     *int64     `json:"usage_limit,omitempty"`
+	UsageCount     int64      `json:"usage_count" gorm:"default:0"`
+}
+
+// PaymentCustomer links a user to their customer record at the payment provider
+type PaymentCustomer struct {
+	BaseModel
+	UserID     string `json:"user_id" gorm:"uniqueIndex:idx_payment_customer_user;not null"`
+	Provider   string `json:"provider" gorm:"uniqueIndex:idx_payment_customer_user;not null"`
+	CustomerID string `json:"customer_id" gorm:"not null"`
+}
+
+// PaymentMethod represents a card or account saved with the payment provider
+type PaymentMethod struct {
+	BaseModel
+	UserID           string `json:"user_id" gorm:"index;not null"`
+	Provider         string `json:"provider"`
+	ProviderMethodID string `json:"-" gorm:"index"`
+	Type             string `json:"type"`                      // card, upi, paypal, bank_transfer
+	Details          JSON   `json:"details" gorm:"type:jsonb"` // last_four, brand, expiry
+	IsDefault        bool   `json:"is_default" gorm:"default:false"`
+}
+
+// PaymentTransaction represents money moved through the payment provider
+type PaymentTransaction struct {
+	BaseModel
+	UserID           string  `json:"user_id" gorm:"index;not null"`
+	PaymentMethodID  *string `json:"payment_method_id,omitempty"`
+	Provider         string  `json:"provider"`
+	ProviderChargeID string  `json:"-" gorm:"index"`
+	Type             string  `json:"type" gorm:"index"` // payment, refund, credit_purchase, usage_charge
+	Amount           float64 `json:"amount"`
+	Currency         string  `json:"currency" gorm:"default:'USD'"`
+	Status           string  `json:"status" gorm:"index;default:'pending'"` // pending, completed, failed, cancelled
+	Description      string  `json:"description"`
+	AgentID          *string `json:"agent_id"`
+	PurchaseID       *string `json:"purchase_id,omitempty" gorm:"index"`
+	RefundOfID       *string `json:"refund_of_id,omitempty" gorm:"index"`
+	Credits          int64   `json:"credits,omitempty"`
+	ActionURL        string  `json:"action_url,omitempty"`
+	FailureReason    string  `json:"failure_reason,omitempty"`
+	Metadata         JSON    `json:"metadata" gorm:"type:jsonb"`
+}
+
+// PaymentEvent records a webhook event received from the payment provider so
+// that redelivered events are processed only once
+type PaymentEvent struct {
+	BaseModel
+	Provider string `json:"provider" gorm:"uniqueIndex:idx_payment_event;not null"`
+	EventID  string `json:"event_id" gorm:"uniqueIndex:idx_payment_event;not null"`
+	Type     string `json:"type"`
+	Payload  JSON   `json:"payload" gorm:"type:jsonb"`
+}
+
+// CreatorEarning is an entry in an agent creator's earnings ledger. Sales and
+// usage add to the balance once AvailableAt has passed; refunds and payouts
+// take it away.
+type CreatorEarning struct {
+	BaseModel
+	CreatorID   string    `json:"creator_id" gorm:"index;not null"`
+	AgentID     *string   `json:"agent_id,omitempty" gorm:"index"`
+	Type        string    `json:"type" gorm:"uniqueIndex:idx_creator_earning_source;not null"`      // sale, usage, refund, payout
+	SourceID    string    `json:"source_id" gorm:"uniqueIndex:idx_creator_earning_source;not null"` // purchase, execution or payout ID
+	GrossAmount float64   `json:"gross_amount"`
+	PlatformFee float64   `json:"platform_fee"`
+	NetAmount   float64   `json:"net_amount"`
+	Currency    string    `json:"currency" gorm:"default:'USD'"`
+	ShareRate   float64   `json:"share_rate"`
+	AvailableAt time.Time `json:"available_at" gorm:"index"`
+	Description string    `json:"description"`
+}
+
+// BeforeDelete keeps the earnings ledger append-only
+func (e *CreatorEarning) BeforeDelete(tx *gorm.DB) error {
+	return errors.New("creator earnings cannot be deleted")
+}
+
+// CreatorPayout represents a creator's request to be paid their earnings
+type CreatorPayout struct {
+	BaseModel
+	CreatorID       string     `json:"creator_id" gorm:"index;not null"`
+	Creator         *User      `json:"creator,omitempty"`
+	Amount          float64    `json:"amount"`
+	Currency        string     `json:"currency" gorm:"default:'USD'"`
+	Status          string     `json:"status" gorm:"index;default:'requested'"` // requested, approved, rejected, paid, cancelled
+	Method          string     `json:"method"`                                  // bank_transfer, paypal, upi
+	Destination     JSON       `json:"destination" gorm:"type:jsonb"`
+	Reference       string     `json:"reference,omitempty"`
+	ReviewedBy      *string    `json:"reviewed_by,omitempty"`
+	ReviewedAt      *time.Time `json:"reviewed_at,omitempty"`
+	PaidAt          *time.Time `json:"paid_at,omitempty"`
+	RejectionReason string     `json:"rejection_reason,omitempty"`
+	Notes           string     `json:"notes,omitempty"`
+}
+
+// License is a signed key that lets an agent run in an on-premises or
+// air-gapped deployment. The key carries the same terms as the row, so it can
+// be checked offline with the issuer's public key.
+type License struct {
+	BaseModel
+	Key              string     `json:"license_key" gorm:"type:text;not null"`
+	Fingerprint      string     `json:"fingerprint" gorm:"uniqueIndex;not null"`
+	UserID           string     `json:"user_id" gorm:"index;not null"`
+	OrganizationID   *string    `json:"organization_id,omitempty" gorm:"index"`
+	PurchaseID       *string    `json:"purchase_id,omitempty" gorm:"index"`
+	AgentIDs         JSON       `json:"agent_ids" gorm:"type:jsonb"`
+	Type             string     `json:"type"` // free, trial, paid, enterprise
+	Seats            int        `json:"seats"`
+	Features         JSON       `json:"features" gorm:"type:jsonb"`
+	DeploymentType   string     `json:"deployment_type"` // on_premise, cloud, hybrid
+	HardwareID       string     `json:"hardware_id,omitempty"`
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"`
+	GraceDays        int        `json:"grace_days"`
+	Status           string     `json:"status" gorm:"index;default:'active'"` // active, revoked
+	RevokedAt        *time.Time `json:"revoked_at,omitempty"`
+	RevocationReason string     `json:"revocation_reason,omitempty"`
+	LastValidatedAt  *time.Time `json:"last_validated_at,omitempty"`
+	ValidationCount  int64      `json:"validation_count" gorm:"default:0"`
+}
+
+// Invoice represents a monthly billing statement for an organization, or for a
+// user outside one. Lines in different currencies are billed on separate invoices.
+type Invoice struct {
+	BaseModel
+	Number         string        `json:"number" gorm:"uniqueIndex;not null"`
+	Sequence       int64         `json:"sequence" gorm:"uniqueIndex;not null"`
+	BillingAccount string        `json:"-" gorm:"uniqueIndex:idx_invoice_period;not null"` // org:<id> or user:<id>
+	OrganizationID *string       `json:"organization_id,omitempty" gorm:"index"`
 	Organization   *Organization `json:"organization,omitempty"`
-	Status         string        `json:"status"`
-	Input          JSON          `json:"input" gorm:"type:jsonb"`
-	Output         JSON          `json:"output" gorm:"type:jsonb"`
-	Error          string        `json:"error,omitempty"`
-	Duration       int64         `json:"duration"`
-	Cost           float64       `json:"cost" gorm:"default:0"`
-	CreditsUsed    int64         `json:"credits_used" gorm:"default:0"`
-	IPAddress      string        `json:"ip_address"`
-	UserAgent      string        `json:"user_agent"`
-	SessionID      string        `json:"session_id"`
+	UserID         *string       `json:"user_id,omitempty" gorm:"index"`
+	User           *User         `json:"user,omitempty"`
+	PeriodStart    time.Time     `json:"period_start" gorm:"uniqueIndex:idx_invoice_period;not null"`
+	PeriodEnd      time.Time     `json:"period_end"`
+	Currency       string        `json:"currency" gorm:"uniqueIndex:idx_invoice_period;default:'USD'"`
+	Status         string        `json:"status" gorm:"index;default:'issued'"` // issued, paid, void
+	Subtotal       float64       `json:"subtotal"`
+	TaxName        string        `json:"tax_name"`
+	TaxRate        float64       `json:"tax_rate"`
+	TaxAmount      float64       `json:"tax_amount"`
+	Total          float64       `json:"total"`
+	CreditsUsed    int64         `json:"credits_used"`
+	IssuedAt       time.Time     `json:"issued_at"`
+	DueAt          *time.Time    `json:"due_at,omitempty"`
+	Lines          []InvoiceLine `json:"lines,omitempty" gorm:"foreignKey:InvoiceID"`
+}
+
+// InvoiceLine represents one charge on an invoice
+type InvoiceLine struct {
+	BaseModel
+	InvoiceID   string  `json:"invoice_id" gorm:"index;not null"`
+	Type        string  `json:"type"` // usage, purchase, refund
+	Description string  `json:"description"`
+	AgentID     *string `json:"agent_id,omitempty"`
+	PurchaseID  *string `json:"purchase_id,omitempty"`
+	Quantity    int64   `json:"quantity"`
+	UnitPrice   float64 `json:"unit_price"`
+	Amount      float64 `json:"amount"`
+	Credits     int64   `json:"credits"`
+}
+
+// Conversation represents a persisted chat thread between a user and an agent
+type Conversation struct {
+	BaseModel
+	UserID        string     `json:"user_id" gorm:"index"`
+	AgentID       string     `json:"agent_id" gorm:"index"`
+	Title         string     `json:"title"`
+	MessageCount  int        `json:"message_count" gorm:"default:0"`
+	LastMessageAt *time.Time `json:"last_message_at,omitempty"`
+	Messages      []Message  `json:"messages,omitempty" gorm:"foreignKey:ConversationID"`
+}
+
+// Message represents a single turn in a conversation
+type Message struct {
+	BaseModel
+	ConversationID string `json:"conversation_id" gorm:"index"`
+	Role           string `json:"role"`
+	Content        string `json:"content"`
+	Model          string `json:"model,omitempty"`
+	PromptTokens   int64  `json:"prompt_tokens" gorm:"default:0"`
+	OutputTokens   int64  `json:"output_tokens" gorm:"default:0"`
+	Metadata       JSON   `json:"metadata" gorm:"type:jsonb"`
 }
 
 // Webhook represents webhook configurations
@@ -165,6 +452,113 @@ type Notification struct {
 	Metadata       JSON          `json:"metadata" gorm:"type:jsonb"`
 }
 
+// MFARecoveryCode is a one-time code that stands in for a TOTP code when the
+// authenticator is lost. Only a hash of the code is stored.
+type MFARecoveryCode struct {
+	BaseModel
+	UserID   string     `json:"user_id" gorm:"index;not null"`
+	CodeHash string     `json:"-" gorm:"uniqueIndex;not null"`
+	UsedAt   *time.Time `json:"used_at,omitempty"`
+}
+
+// MFAChallenge is the second step of a login with MFA enabled. It is
+// redeemed with a TOTP or recovery code for the session tokens.
+type MFAChallenge struct {
+	BaseModel
+	UserID     string     `json:"user_id" gorm:"index;not null"`
+	TokenHash  string     `json:"-" gorm:"uniqueIndex;not null"`
+	IPAddress  string     `json:"ip_address"`
+	UserAgent  string     `json:"user_agent"`
+	Attempts   int        `json:"attempts"`
+	ExpiresAt  time.Time  `json:"expires_at" gorm:"index"`
+	ConsumedAt *time.Time `json:"consumed_at,omitempty"`
+}
+
+// SSOConnection is an organization's OpenID Connect identity provider
+type SSOConnection struct {
+	BaseModel
+	OrganizationID string            `json:"organization_id" gorm:"uniqueIndex;not null"`
+	Issuer         string            `json:"issuer" gorm:"not null"`
+	ClientID       string            `json:"client_id" gorm:"not null"`
+	ClientSecret   string            `json:"-"`
+	Scopes         []string          `json:"scopes" gorm:"type:jsonb;serializer:json"`
+	Domains        []string          `json:"domains" gorm:"type:jsonb;serializer:json"`       // email domains signed in through this provider
+	GroupsClaim    string            `json:"groups_claim"`                                    // ID token claim listing the user's groups
+	RoleMappings   map[string]string `json:"role_mappings" gorm:"type:jsonb;serializer:json"` // group to role
+	DefaultRole    string            `json:"default_role"`
+	AutoProvision  bool              `json:"auto_provision"` // create accounts on first sign-in
+	Enforced       bool              `json:"enforced"`       // members cannot sign in with a password
+	IsEnabled      bool              `json:"is_enabled"`
+}
+
+// SSOIdentity links a user to their subject at an identity provider
+type SSOIdentity struct {
+	BaseModel
+	UserID       string     `json:"user_id" gorm:"index;not null"`
+	ConnectionID string     `json:"connection_id" gorm:"uniqueIndex:idx_sso_identity_subject;not null"`
+	Subject      string     `json:"subject" gorm:"uniqueIndex:idx_sso_identity_subject;not null"`
+	Email        string     `json:"email"`
+	LastLoginAt  *time.Time `json:"last_login_at,omitempty"`
+}
+
+// SSOAuthRequest is an authorization request waiting for the identity
+// provider to send the user back
+type SSOAuthRequest struct {
+	BaseModel
+	ConnectionID string     `json:"connection_id" gorm:"index;not null"`
+	StateHash    string     `json:"-" gorm:"uniqueIndex;not null"`
+	Nonce        string     `json:"-"`
+	CodeVerifier string     `json:"-"`
+	ExpiresAt    time.Time  `json:"expires_at" gorm:"index"`
+	ConsumedAt   *time.Time `json:"consumed_at,omitempty"`
+}
+
+// SCIMToken is the bearer token an organization's identity provider uses to
+// provision users over SCIM. Only a hash of the token is stored.
+type SCIMToken struct {
+	BaseModel
+	OrganizationID string     `json:"organization_id" gorm:"index;not null"`
+	Name           string     `json:"name" gorm:"not null"`
+	Prefix         string     `json:"prefix" gorm:"index;not null"`
+	TokenHash      string     `json:"-" gorm:"uniqueIndex;not null"`
+	CreatedByID    string     `json:"created_by_id" gorm:"index;not null"` // the admin the token acts for
+	LastUsedAt     *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt      *time.Time `json:"revoked_at,omitempty"`
+}
+
+// SCIMGroup is a group pushed by an organization's identity provider. Its
+// members get the role the group maps to.
+type SCIMGroup struct {
+	BaseModel
+	OrganizationID string `json:"organization_id" gorm:"uniqueIndex:idx_scim_group_name;not null"`
+	DisplayName    string `json:"display_name" gorm:"uniqueIndex:idx_scim_group_name;not null"`
+	ExternalID     string `json:"external_id"`
+}
+
+// SCIMGroupMember is a user's membership of a SCIM group
+type SCIMGroupMember struct {
+	BaseModel
+	GroupID string `json:"group_id" gorm:"uniqueIndex:idx_scim_group_member;not null"`
+	UserID  string `json:"user_id" gorm:"uniqueIndex:idx_scim_group_member;index;not null"`
+}
+
+// EmailLog records an outgoing email and the outcome of sending it. Bodies
+// are not stored, since they can contain tokens.
+type EmailLog struct {
+	BaseModel
+	UserID    *string    `json:"user_id,omitempty" gorm:"index"`
+	To        string     `json:"to" gorm:"index"`
+	From      string     `json:"from"`
+	Subject   string     `json:"subject"`
+	Template  string     `json:"template" gorm:"index"`
+	Transport string     `json:"transport"`
+	MessageID string     `json:"message_id"`
+	Status    string     `json:"status" gorm:"index;default:'pending'"` // pending, sent, failed
+	Attempts  int        `json:"attempts"`
+	LastError string     `json:"last_error,omitempty"`
+	SentAt    *time.Time `json:"sent_at,omitempty"`
+}
+
 // LLMProvider represents an LLM provider configuration
 type LLMProvider struct {
 	BaseModel
@@ -176,6 +570,58 @@ type LLMProvider struct {
 	Config    JSON   `json:"config" gorm:"type:jsonb"`
 }
 
+// APIKey is a long-lived credential for programmatic access. Only a hash of
+// the key is stored; Prefix is kept in the clear so users can tell keys apart.
+type APIKey struct {
+	BaseModel
+	Name           string     `json:"name" gorm:"not null"`
+	Prefix         string     `json:"prefix" gorm:"index;not null"`
+	KeyHash        string     `json:"-" gorm:"uniqueIndex;not null"`
+	UserID         string     `json:"user_id" gorm:"index;not null"`
+	OrganizationID *string    `json:"organization_id,omitempty" gorm:"index"` // set for organization keys
+	Scopes         []string   `json:"scopes" gorm:"type:jsonb;serializer:json"`
+	AllowedIPs     []string   `json:"allowed_ips" gorm:"type:jsonb;serializer:json"` // IPs or CIDRs; empty allows any
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt     *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP     string     `json:"last_used_ip,omitempty"`
+	RevokedAt      *time.Time `json:"revoked_at,omitempty"`
+}
+
+// RefreshToken is a server-side refresh token. Each use replaces it with a
+// new token in the same family; presenting a used token again revokes the
+// whole family. Only a hash of the token is stored.
+type RefreshToken struct {
+	BaseModel
+	UserID        string     `json:"user_id" gorm:"index;not null"`
+	FamilyID      string     `json:"family_id" gorm:"index;not null"`
+	TokenHash     string     `json:"-" gorm:"uniqueIndex;not null"`
+	AccessTokenID string     `json:"-" gorm:"index"` // jti of the access token issued with it
+	ExpiresAt     time.Time  `json:"expires_at" gorm:"index"`
+	UsedAt        *time.Time `json:"used_at,omitempty"`
+	RevokedAt     *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Session is one sign-in of a user on a device. It lasts as long as its
+// refresh token family and is revoked along with it.
+type Session struct {
+	BaseModel
+	UserID     string     `json:"user_id" gorm:"index;not null"`
+	FamilyID   string     `json:"family_id" gorm:"uniqueIndex;not null"`
+	IPAddress  string     `json:"ip_address"`
+	UserAgent  string     `json:"user_agent"`
+	Device     string     `json:"device"` // e.g. "Chrome on macOS"
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	ExpiresAt  time.Time  `json:"expires_at" gorm:"index"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// RevokedAccessToken denylists an access token by its jti until it expires
+type RevokedAccessToken struct {
+	BaseModel
+	JTI       string    `json:"jti" gorm:"uniqueIndex;not null"`
+	ExpiresAt time.Time `json:"expires_at" gorm:"index"`
+}
+
 // PasswordResetToken represents a password reset token
 type PasswordResetToken struct {
 	BaseModel
@@ -20,6 +20,15 @@ func SetupRoutes(r *gin.Engine, db *gorm.DB, cfg *config.Config) {
 	integrationHandler := handlers.NewIntegrationHandler(db, cfg)
 	adminHandler := handlers.NewAdminHandler(db, cfg)
 	chatHandler := handlers.NewChatHandler(db, cfg)
+	conversationHandler := handlers.NewConversationHandler(db, cfg)
+	usageHandler := handlers.NewUsageHandler(db, cfg)
+	paymentHandler := handlers.NewPaymentHandler(db, cfg)
+	billingHandler := handlers.NewBillingHandler(db, cfg)
+	creatorHandler := handlers.NewCreatorHandler(db, cfg)
+	licenseHandler := handlers.NewLicenseHandler(db, cfg)
+	apiKeyHandler := handlers.NewAPIKeyHandler(db, cfg)
+	ssoHandler := handlers.NewSSOHandler(db, cfg)
+	scimHandler := handlers.NewSCIMHandler(db, cfg)
 
 	// API v1 routes
 	v1 := r.Group("/api/v1")
@@ -36,9 +45,22 @@ func SetupRoutes(r *gin.Engine, db *gorm.DB, cfg *config.Config) {
 			auth.POST("/register", authHandler.Register)
 			auth.POST("/refresh", authHandler.RefreshToken)
 			auth.POST("/logout", middleware.AuthMiddleware(), authHandler.Logout)
+			auth.POST("/logout-all", middleware.AuthMiddleware(), authHandler.LogoutAll)
+			auth.GET("/sessions", middleware.AuthMiddleware(), authHandler.ListSessions)
+			auth.DELETE("/sessions/:id", middleware.AuthMiddleware(), authHandler.RevokeSession)
 			auth.POST("/validate", authHandler.ValidateToken)
 			auth.POST("/forgot-password", authHandler.ForgotPassword)
 			auth.POST("/reset-password", authHandler.ResetPassword)
+			auth.POST("/verify-email", authHandler.VerifyEmail)
+			auth.POST("/resend-verification", middleware.AuthMiddleware(), authHandler.ResendVerificationEmail)
+			auth.POST("/mfa/verify", authHandler.VerifyMFA)
+			auth.POST("/sso/start", ssoHandler.StartLogin)
+			auth.POST("/sso/callback", ssoHandler.Callback)
+			auth.GET("/mfa", middleware.AuthMiddleware(), authHandler.GetMFAStatus)
+			auth.POST("/mfa/enroll", middleware.AuthMiddleware(), authHandler.EnrollMFA)
+			auth.POST("/mfa/confirm", middleware.AuthMiddleware(), authHandler.ConfirmMFA)
+			auth.POST("/mfa/disable", middleware.AuthMiddleware(), authHandler.DisableMFA)
+			auth.POST("/mfa/recovery-codes", middleware.AuthMiddleware(), authHandler.RegenerateRecoveryCodes)
 		}
 
 		// User routes
@@ -55,6 +77,16 @@ func SetupRoutes(r *gin.Engine, db *gorm.DB, cfg *config.Config) {
 			users.PUT("/:id/role", middleware.RoleMiddleware("admin"), userHandler.UpdateUserRole)
 		}
 
+		// API key routes; keys cannot be used to manage other keys
+		apiKeys := v1.Group("/api-keys")
+		apiKeys.Use(middleware.AuthMiddleware())
+		{
+			apiKeys.GET("", apiKeyHandler.ListAPIKeys)
+			apiKeys.POST("", apiKeyHandler.CreateAPIKey)
+			apiKeys.GET("/scopes", apiKeyHandler.ListScopes)
+			apiKeys.DELETE("/:id", apiKeyHandler.RevokeAPIKey)
+		}
+
 		// Organization routes
 		orgs := v1.Group("/organizations")
 		orgs.Use(middleware.AuthMiddleware())
@@ -65,11 +97,17 @@ func SetupRoutes(r *gin.Engine, db *gorm.DB, cfg *config.Config) {
 			orgs.GET("", userHandler.ListOrganizations)
 			orgs.GET("/:id/users", userHandler.GetOrganizationUsers)
 			orgs.POST("/:id/users", userHandler.InviteUserToOrganization)
+			orgs.GET("/:id/sso", ssoHandler.GetConnection)
+			orgs.PUT("/:id/sso", ssoHandler.SaveConnection)
+			orgs.DELETE("/:id/sso", ssoHandler.DeleteConnection)
+			orgs.GET("/:id/scim-tokens", scimHandler.ListTokens)
+			orgs.POST("/:id/scim-tokens", scimHandler.CreateToken)
+			orgs.DELETE("/:id/scim-tokens/:tokenId", scimHandler.RevokeToken)
 		}
 
 		// Agent routes
 		agents := v1.Group("/agents")
-		agents.Use(middleware.AuthMiddleware())
+		agents.Use(middleware.AuthMiddleware(), middleware.PlanRateLimit())
 		{
 			agents.POST("", middleware.RoleMiddleware("admin"), agentHandler.CreateAgent)
 			agents.GET("/:id", agentHandler.GetAgent)
@@ -104,9 +142,13 @@ func SetupRoutes(r *gin.Engine, db *gorm.DB, cfg *config.Config) {
 			marketplace.GET("/agents", marketplaceHandler.ListMarketplaceAgents)
 			marketplace.GET("/agents/:id", marketplaceHandler.GetMarketplaceAgent)
 			marketplace.POST("/agents/:id/try", marketplaceHandler.TryMarketplaceAgent)
-			marketplace.POST("/agents/:id/purchase", marketplaceHandler.PurchaseMarketplaceAgent)
+			marketplace.POST("/agents/:id/purchase", middleware.AuthMiddleware(), marketplaceHandler.PurchaseMarketplaceAgent)
 			marketplace.GET("/agents/:id/reviews", marketplaceHandler.GetAgentReviews)
 			marketplace.POST("/agents/:id/reviews", marketplaceHandler.CreateAgentReview)
+			marketplace.GET("/purchases", middleware.AuthMiddleware(), marketplaceHandler.ListPurchases)
+			marketplace.GET("/purchases/:id", middleware.AuthMiddleware(), marketplaceHandler.GetPurchase)
+			marketplace.POST("/purchases/:id/refund", middleware.AuthMiddleware(), marketplaceHandler.RefundPurchase)
+			marketplace.GET("/entitlements", middleware.AuthMiddleware(), marketplaceHandler.ListEntitlements)
 		}
 
 		// Review routes
@@ -123,10 +165,11 @@ func SetupRoutes(r *gin.Engine, db *gorm.DB, cfg *config.Config) {
 
 		// Runtime routes
 		runtime := v1.Group("/runtime")
-		runtime.Use(middleware.AuthMiddleware())
+		runtime.Use(middleware.AuthMiddleware(), middleware.PlanRateLimit())
 		{
 			runtime.POST("/execute", runtimeHandler.ExecuteAgent)
 			runtime.GET("/executions/:id", runtimeHandler.GetExecution)
+			runtime.GET("/executions/:id/events", runtimeHandler.StreamExecutionEvents)
 			runtime.GET("/executions", runtimeHandler.ListExecutions)
 			runtime.POST("/executions/:id/cancel", runtimeHandler.CancelExecution)
 			runtime.GET("/executions/stats", runtimeHandler.GetExecutionStats)
@@ -134,6 +177,72 @@ func SetupRoutes(r *gin.Engine, db *gorm.DB, cfg *config.Config) {
 			runtime.GET("/executions/active", runtimeHandler.GetActiveExecutions)
 		}
 
+		// Conversation routes
+		conversations := v1.Group("/conversations")
+		conversations.Use(middleware.AuthMiddleware(), middleware.PlanRateLimit())
+		{
+			conversations.GET("", conversationHandler.ListConversations)
+			conversations.POST("", conversationHandler.CreateConversation)
+			conversations.GET("/:id", conversationHandler.GetConversation)
+			conversations.PUT("/:id", conversationHandler.RenameConversation)
+			conversations.DELETE("/:id", conversationHandler.DeleteConversation)
+		}
+
+		// Usage routes
+		usage := v1.Group("/usage")
+		usage.Use(middleware.AuthMiddleware())
+		{
+			usage.GET("/credits", usageHandler.GetCredits)
+			usage.GET("/credits/transactions", usageHandler.ListCreditTransactions)
+			usage.GET("/plan", usageHandler.GetPlanUsage)
+			usage.GET("/plans", usageHandler.ListPlans)
+		}
+
+		// Payment routes; the webhook is authenticated by the provider's signature
+		payments := v1.Group("/payments")
+		{
+			payments.GET("/methods", middleware.AuthMiddleware(), paymentHandler.ListPaymentMethods)
+			payments.POST("/methods", middleware.AuthMiddleware(), paymentHandler.AddPaymentMethod)
+			payments.GET("/transactions", middleware.AuthMiddleware(), paymentHandler.ListTransactions)
+			payments.POST("/credits", middleware.AuthMiddleware(), paymentHandler.PurchaseCredits)
+			payments.POST("/webhook", paymentHandler.HandleWebhook)
+		}
+
+		// Billing routes
+		billing := v1.Group("/billing")
+		billing.Use(middleware.AuthMiddleware())
+		{
+			billing.GET("/invoices", billingHandler.ListInvoices)
+			billing.GET("/invoices/:id", billingHandler.GetInvoice)
+			billing.GET("/invoices/:id/download", billingHandler.DownloadInvoice)
+		}
+
+		// Creator earnings and payout routes
+		creator := v1.Group("/creator")
+		creator.Use(middleware.AuthMiddleware())
+		{
+			creator.GET("/dashboard", creatorHandler.GetDashboard)
+			creator.GET("/earnings", creatorHandler.ListEarnings)
+			creator.GET("/payouts", creatorHandler.ListPayouts)
+			creator.POST("/payouts", creatorHandler.RequestPayout)
+			creator.POST("/payouts/:id/cancel", creatorHandler.CancelPayout)
+		}
+
+		// License routes; deployments present the license key itself, so validation needs no login
+		license := v1.Group("/license")
+		{
+			license.POST("/validate", licenseHandler.ValidateLicense)
+			license.GET("/public-key", licenseHandler.GetPublicKey)
+			license.GET("/revocations", licenseHandler.GetRevocationList)
+		}
+
+		licenses := v1.Group("/licenses")
+		licenses.Use(middleware.AuthMiddleware())
+		{
+			licenses.GET("", licenseHandler.ListLicenses)
+			licenses.GET("/:id", licenseHandler.GetLicense)
+		}
+
 		// Integration routes
 		integrations := v1.Group("/integrations")
 		integrations.Use(middleware.AuthMiddleware())
@@ -144,7 +253,7 @@ func SetupRoutes(r *gin.Engine, db *gorm.DB, cfg *config.Config) {
 			integrations.PUT("/webhooks/:id", integrationHandler.UpdateWebhook)
 			integrations.DELETE("/webhooks/:id", integrationHandler.DeleteWebhook)
 			integrations.GET("/llm-providers", integrationHandler.GetLLMProviders)
-			integrations.POST("/llm-providers/test", integrationHandler.TestLLMConnection)
+			integrations.POST("/llm-providers/test", middleware.RoleMiddleware("admin"), integrationHandler.TestLLMConnection)
 			integrations.GET("/stats", integrationHandler.GetIntegrationStats)
 		}
 
@@ -167,6 +276,14 @@ func SetupRoutes(r *gin.Engine, db *gorm.DB, cfg *config.Config) {
 			admin.POST("/update", adminHandler.UpdateSystem)
 			admin.GET("/users", adminHandler.GetAllUsers)
 			admin.GET("/organizations", adminHandler.GetAllOrganizations)
+			admin.PUT("/organizations/:id/plan", usageHandler.SetOrganizationPlan)
+			admin.POST("/billing/invoices", billingHandler.GenerateInvoices)
+			admin.GET("/payouts", creatorHandler.ListAllPayouts)
+			admin.POST("/payouts/:id/approve", creatorHandler.ApprovePayout)
+			admin.POST("/payouts/:id/reject", creatorHandler.RejectPayout)
+			admin.POST("/payouts/:id/paid", creatorHandler.MarkPayoutPaid)
+			admin.POST("/licenses", licenseHandler.IssueLicense)
+			admin.POST("/licenses/:id/revoke", licenseHandler.RevokeLicense)
 		}
 	}
 
@@ -175,10 +292,27 @@ func SetupRoutes(r *gin.Engine, db *gorm.DB, cfg *config.Config) {
 	ws.Use(middleware.AuthMiddleware())
 	{
 		ws.GET("/chat/:agentId", chatHandler.HandleChatWebSocket)
-		ws.GET("/executions/:id", func(c *gin.Context) {
-			// WebSocket handler for real-time execution updates
-			c.JSON(200, gin.H{"message": "WebSocket endpoint"})
-		})
+		ws.GET("/executions/:id", runtimeHandler.StreamExecutionWebSocket)
+	}
+
+	// SCIM 2.0 provisioning routes for identity providers
+	scim := r.Group("/scim/v2")
+	scim.Use(middleware.SCIMAuthMiddleware())
+	{
+		scim.GET("/ServiceProviderConfig", scimHandler.ServiceProviderConfig)
+		scim.GET("/ResourceTypes", scimHandler.ResourceTypes)
+		scim.GET("/Users", scimHandler.ListUsers)
+		scim.POST("/Users", scimHandler.CreateUser)
+		scim.GET("/Users/:id", scimHandler.GetUser)
+		scim.PUT("/Users/:id", scimHandler.ReplaceUser)
+		scim.PATCH("/Users/:id", scimHandler.PatchUser)
+		scim.DELETE("/Users/:id", scimHandler.DeleteUser)
+		scim.GET("/Groups", scimHandler.ListGroups)
+		scim.POST("/Groups", scimHandler.CreateGroup)
+		scim.GET("/Groups/:id", scimHandler.GetGroup)
+		scim.PUT("/Groups/:id", scimHandler.ReplaceGroup)
+		scim.PATCH("/Groups/:id", scimHandler.PatchGroup)
+		scim.DELETE("/Groups/:id", scimHandler.DeleteGroup)
 	}
 
 	// Admin panel routes (separate from API)
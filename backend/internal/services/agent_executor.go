@@ -0,0 +1,381 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// AgentExecutor runs a single agent invocation and returns its result. A run
+// that fails after using tokens also returns a result carrying that usage.
+type AgentExecutor interface {
+	Execute(ctx context.Context, agent *models.Agent, input map[string]interface{}) (*ExecutionResult, error)
+}
+
+// ExecutionResult represents the outcome of an agent invocation
+type ExecutionResult struct {
+	Output       map[string]interface{} `json:"output"`
+	Model        string                 `json:"model"`
+	PromptTokens int64                  `json:"prompt_tokens"`
+	OutputTokens int64                  `json:"output_tokens"`
+	TotalTokens  int64                  `json:"total_tokens"`
+}
+
+// AgentRuntimeConfig represents the runtime settings stored in Agent.Config
+type AgentRuntimeConfig struct {
+	SystemPrompt  string   `json:"system_prompt"`
+	Temperature   *float64 `json:"temperature"`
+	MaxTokens     int      `json:"max_tokens"`
+	ContextWindow int      `json:"context_window"`
+
+	// Timeout is the maximum run time in seconds
+	Timeout        int                 `json:"timeout"`
+	ResourceLimits AgentResourceLimits `json:"resource_limits"`
+
+	// Tools the agent may call, and the most calls a single execution may make
+	Tools         []AgentToolConfig   `json:"tools"`
+	MaxToolCalls  int                 `json:"max_tool_calls"`
+	KnowledgeBase []KnowledgeDocument `json:"knowledge_base"`
+
+	// CreditsPerUse is a flat fee charged on top of token usage
+	CreditsPerUse int64 `json:"credits_per_use"`
+
+	// BillingPeriod is the length of a subscription, "monthly" or "yearly"
+	BillingPeriod string `json:"billing_period"`
+}
+
+// AgentResourceLimits represents the resource_limits block of an agent config
+type AgentResourceLimits struct {
+	MaxExecutionTime int     `json:"max_execution_time"` // seconds
+	MaxMemory        int     `json:"max_memory"`         // MB
+	MaxCPU           float64 `json:"max_cpu"`            // cores
+}
+
+// ExecutionTimeout returns how long a run may take, or 0 when the agent sets no limit
+func (c AgentRuntimeConfig) ExecutionTimeout() time.Duration {
+	seconds := c.Timeout
+	if limit := c.ResourceLimits.MaxExecutionTime; limit > 0 && (seconds <= 0 || limit < seconds) {
+		seconds = limit
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// ParseAgentRuntimeConfig decodes the runtime settings of an agent
+func ParseAgentRuntimeConfig(agent *models.Agent) AgentRuntimeConfig {
+	var cfg AgentRuntimeConfig
+	if len(agent.Config) > 0 {
+		if err := json.Unmarshal(agent.Config, &cfg); err != nil {
+			return AgentRuntimeConfig{}
+		}
+	}
+	return cfg
+}
+
+// AgentStreamer is implemented by executors that can stream partial output
+type AgentStreamer interface {
+	Stream(ctx context.Context, agent *models.Agent, messages []ChatMessage, onDelta StreamHandler) (*ChatCompletionResponse, error)
+}
+
+// LLMClientFactory creates the client used to reach a provider
+type LLMClientFactory func(provider *models.LLMProvider) (LLMClient, error)
+
+// LLMExecutor executes agents by calling the LLM provider they are configured with
+type LLMExecutor struct {
+	db        *gorm.DB
+	cfg       *config.Config
+	newClient LLMClientFactory
+	tools     *ToolRegistry
+}
+
+// NewLLMExecutor creates a new LLM-backed executor
+func NewLLMExecutor(db *gorm.DB, cfg *config.Config) *LLMExecutor {
+	return &LLMExecutor{
+		db:    db,
+		cfg:   cfg,
+		tools: NewToolRegistry(cfg),
+		newClient: func(provider *models.LLMProvider) (LLMClient, error) {
+			return NewLLMClientForProvider(provider, cfg)
+		},
+	}
+}
+
+// SetClientFactory replaces the factory used to build provider clients
+func (e *LLMExecutor) SetClientFactory(factory LLMClientFactory) {
+	e.newClient = factory
+}
+
+// Execute runs the agent against its configured LLM provider. When the agent
+// declares tools, the model is called repeatedly until it stops requesting
+// tool calls, with each call recorded as a step of the execution.
+func (e *LLMExecutor) Execute(ctx context.Context, agent *models.Agent, input map[string]interface{}) (*ExecutionResult, error) {
+	messages, err := buildInputMessages(input)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, errors.New("execution input is empty")
+	}
+
+	client, req, err := e.prepare(agent, messages)
+	if err != nil {
+		return nil, err
+	}
+
+	runtimeCfg := ParseAgentRuntimeConfig(agent)
+	tools, err := e.tools.Resolve(agent, runtimeCfg.Tools)
+	if err != nil {
+		return nil, err
+	}
+	for _, tool := range tools {
+		req.Tools = append(req.Tools, tool.Definition())
+	}
+	sort.Slice(req.Tools, func(i, j int) bool { return req.Tools[i].Name < req.Tools[j].Name })
+
+	maxToolCalls := runtimeCfg.MaxToolCalls
+	if maxToolCalls <= 0 {
+		maxToolCalls = e.cfg.Tools.MaxToolCalls
+	}
+
+	reporter := ExecutionReporterFrom(ctx)
+	var usage TokenUsage
+	var completion *ChatCompletionResponse
+	toolCalls := 0
+
+	for {
+		reporter.Log("Sending %d message(s) to %s model %s", len(req.Messages), agent.LLMProvider, req.Model)
+
+		completion, err = client.ChatCompletion(ctx, req)
+		if err != nil {
+			return usageResult(req.Model, usage), err
+		}
+		usage.Add(completion.Usage)
+		reporter.Log("Model returned %d output tokens (finish reason: %s)", completion.Usage.OutputTokens, completion.FinishReason)
+
+		if len(completion.ToolCalls) == 0 {
+			break
+		}
+		if toolCalls+len(completion.ToolCalls) > maxToolCalls {
+			return usageResult(completion.Model, usage), fmt.Errorf("execution exceeded the limit of %d tool calls", maxToolCalls)
+		}
+
+		req.Messages = append(req.Messages, ChatMessage{
+			Role:      "assistant",
+			Content:   completion.Content,
+			ToolCalls: completion.ToolCalls,
+		})
+		for _, call := range completion.ToolCalls {
+			toolCalls++
+			result := e.callTool(ctx, tools, call, toolCalls)
+			req.Messages = append(req.Messages, ChatMessage{
+				Role:       "tool",
+				Content:    result,
+				ToolCallID: call.ID,
+			})
+		}
+	}
+
+	output := map[string]interface{}{
+		"result":        completion.Content,
+		"model":         completion.Model,
+		"finish_reason": completion.FinishReason,
+	}
+	if toolCalls > 0 {
+		output["tool_calls"] = toolCalls
+	}
+
+	return &ExecutionResult{
+		Output:       output,
+		Model:        completion.Model,
+		PromptTokens: usage.PromptTokens,
+		OutputTokens: usage.OutputTokens,
+		TotalTokens:  usage.Total(),
+	}, nil
+}
+
+// usageResult reports the tokens a failed run used, or nil when it used none
+func usageResult(model string, usage TokenUsage) *ExecutionResult {
+	if usage.Total() == 0 {
+		return nil
+	}
+	return &ExecutionResult{
+		Model:        model,
+		PromptTokens: usage.PromptTokens,
+		OutputTokens: usage.OutputTokens,
+		TotalTokens:  usage.Total(),
+	}
+}
+
+// callTool runs one tool call, records it as an execution step and returns
+// the content of the tool message sent back to the model
+func (e *LLMExecutor) callTool(ctx context.Context, tools map[string]Tool, call ToolCall, sequence int) string {
+	reporter := ExecutionReporterFrom(ctx)
+	started := time.Now()
+
+	var output map[string]interface{}
+	tool, ok := tools[call.Name]
+	if !ok {
+		err := fmt.Errorf("unknown tool: %s", call.Name)
+		e.recordStep(reporter, call, sequence, nil, err, started)
+		return toolMessageContent(nil, err)
+	}
+
+	err := ValidateToolArguments(tool.Definition().Parameters, call.Arguments)
+	if err == nil {
+		output, err = tool.Call(ctx, call.Arguments)
+	}
+	e.recordStep(reporter, call, sequence, output, err, started)
+	return toolMessageContent(output, err)
+}
+
+// recordStep stores a tool call as a step of the execution and publishes it
+func (e *LLMExecutor) recordStep(reporter *ExecutionReporter, call ToolCall, sequence int, output map[string]interface{}, callErr error, started time.Time) {
+	reporter.ToolCall(call.Name, call.Arguments, output, callErr)
+
+	executionID := reporter.ExecutionID()
+	if executionID == "" {
+		return
+	}
+
+	step := &models.ExecutionStep{
+		ExecutionID: executionID,
+		Sequence:    sequence,
+		Type:        "tool_call",
+		ToolName:    call.Name,
+		ToolCallID:  call.ID,
+		Input:       models.MapToJSON(call.Arguments),
+		Output:      models.MapToJSON(output),
+		Duration:    time.Since(started).Milliseconds(),
+	}
+	if callErr != nil {
+		step.Error = callErr.Error()
+	}
+	if err := e.db.Create(step).Error; err != nil {
+		fmt.Printf("Failed to record step of execution %s: %v\n", executionID, err)
+	}
+}
+
+// toolMessageContent encodes a tool result, or its error, for the model
+func toolMessageContent(output map[string]interface{}, err error) string {
+	if err != nil {
+		output = map[string]interface{}{"error": err.Error()}
+	}
+	data, marshalErr := json.Marshal(output)
+	if marshalErr != nil {
+		return `{"error":"tool returned an unencodable result"}`
+	}
+	return string(data)
+}
+
+// Tools returns the registry used to resolve agent tools
+func (e *LLMExecutor) Tools() *ToolRegistry {
+	return e.tools
+}
+
+// Stream runs the agent on a conversation and streams partial tokens to onDelta
+func (e *LLMExecutor) Stream(ctx context.Context, agent *models.Agent, messages []ChatMessage, onDelta StreamHandler) (*ChatCompletionResponse, error) {
+	if len(messages) == 0 {
+		return nil, errors.New("no messages to send")
+	}
+
+	client, req, err := e.prepare(agent, messages)
+	if err != nil {
+		return nil, err
+	}
+	return client.StreamChatCompletion(ctx, req, onDelta)
+}
+
+// prepare resolves the agent's provider and builds the completion request
+func (e *LLMExecutor) prepare(agent *models.Agent, messages []ChatMessage) (LLMClient, *ChatCompletionRequest, error) {
+	provider, err := e.resolveProvider(agent.LLMProvider)
+	if err != nil {
+		return nil, nil, err
+	}
+	if agent.LLMModel == "" {
+		return nil, nil, errors.New("agent has no LLM model configured")
+	}
+
+	client, err := e.newClient(provider)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	runtimeCfg := ParseAgentRuntimeConfig(agent)
+	maxTokens := runtimeCfg.MaxTokens
+	if maxTokens <= 0 {
+		maxTokens = e.cfg.LLM.DefaultMaxTokens
+	}
+	if provider.MaxTokens > 0 && maxTokens > provider.MaxTokens {
+		maxTokens = provider.MaxTokens
+	}
+
+	return client, &ChatCompletionRequest{
+		Model:        agent.LLMModel,
+		Messages:     messages,
+		SystemPrompt: runtimeCfg.SystemPrompt,
+		MaxTokens:    maxTokens,
+		Temperature:  runtimeCfg.Temperature,
+	}, nil
+}
+
+// resolveProvider finds the active provider row matching the agent's LLMProvider
+func (e *LLMExecutor) resolveProvider(name string) (*models.LLMProvider, error) {
+	if name == "" {
+		return nil, errors.New("agent has no LLM provider configured")
+	}
+
+	var provider models.LLMProvider
+	key := strings.ToLower(name)
+	if err := e.db.Where("is_active = ? AND (LOWER(type) = ? OR LOWER(name) = ?)", true, key, key).
+		First(&provider).Error; err != nil {
+		return nil, fmt.Errorf("LLM provider %q is not configured or inactive", name)
+	}
+	return &provider, nil
+}
+
+// buildInputMessages converts execution input into chat messages. Callers may
+// only send user and assistant turns; the system prompt is the agent's own.
+func buildInputMessages(input map[string]interface{}) ([]ChatMessage, error) {
+	if raw, ok := input["messages"].([]interface{}); ok {
+		messages := make([]ChatMessage, 0, len(raw))
+		for _, item := range raw {
+			m, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			role, _ := m["role"].(string)
+			content, _ := m["content"].(string)
+			if role != "user" && role != "assistant" {
+				return nil, fmt.Errorf("message role %q is not allowed, use user or assistant", role)
+			}
+			if content == "" {
+				continue
+			}
+			messages = append(messages, ChatMessage{Role: role, Content: content})
+		}
+		return messages, nil
+	}
+
+	for _, key := range []string{"message", "prompt", "input", "query", "text"} {
+		if text, ok := input[key].(string); ok && text != "" {
+			return []ChatMessage{{Role: "user", Content: text}}, nil
+		}
+	}
+
+	if len(input) == 0 {
+		return nil, nil
+	}
+	payload, err := json.Marshal(input)
+	if err != nil {
+		return nil, nil
+	}
+	return []ChatMessage{{Role: "user", Content: string(payload)}}, nil
+}
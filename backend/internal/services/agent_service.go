@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"errors"
 	"strings"
-	"time"
 
 	"gorm.io/gorm"
 
@@ -15,12 +14,14 @@ import (
 // AgentService handles agent operations
 type AgentService struct {
 	BaseService
+	plans *PlanService
 }
 
 // NewAgentService creates a new agent service
 func NewAgentService(db *gorm.DB, cfg *config.Config) *AgentService {
 	return &AgentService{
 		BaseService: NewBaseService(db, cfg, "agent"),
+		plans:       NewPlanService(db, cfg),
 	}
 }
 
@@ -59,6 +60,16 @@ type UpdateAgentRequest struct {
 
 // CreateAgent creates a new agent
 func (s *AgentService) CreateAgent(req *CreateAgentRequest, creatorID string, orgID *string) (*models.Agent, error) {
+	if req.IsPublic {
+		if err := checkEmailVerified(s.db, creatorID); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := s.plans.CheckPrivateAgentQuota(creatorID, orgID); err != nil {
+			return nil, err
+		}
+	}
+
 	tagsJSON, _ := json.Marshal(req.Tags)
 	agent := &models.Agent{
 		Name:              req.Name,
@@ -144,6 +155,18 @@ func (s *AgentService) UpdateAgent(id string, req *UpdateAgentRequest) (*models.
 		updates["embedding_model"] = req.EmbeddingModel
 	}
 	if req.IsPublic != nil {
+		// Making a public agent private takes one of the plan's private agents
+		if agent.IsPublic && !*req.IsPublic {
+			if err := s.plans.CheckPrivateAgentQuota(agent.CreatorID, agent.OrganizationID); err != nil {
+				return nil, err
+			}
+		}
+		// Publishing to the marketplace may require a verified email address
+		if !agent.IsPublic && *req.IsPublic {
+			if err := checkEmailVerified(s.db, agent.CreatorID); err != nil {
+				return nil, err
+			}
+		}
 		updates["is_public"] = *req.IsPublic
 	}
 	if req.IsEnabled != nil {
@@ -240,55 +263,6 @@ func (s *AgentService) DisableAgent(id string, userID string) error {
 	return s.db.Model(&agent).Update("is_enabled", false).Error
 }
 
-// ExecuteAgent executes an agent with given input
-func (s *AgentService) ExecuteAgent(id string, userID string, input map[string]interface{}) (*models.Execution, error) {
-	var agent models.Agent
-	if err := s.db.First(&agent, "id = ?", id).Error; err != nil {
-		return nil, err
-	}
-
-	// Check if agent is enabled
-	if !agent.IsEnabled {
-		return nil, errors.New("agent is not enabled")
-	}
-
-	// Create execution record
-	execution := &models.Execution{
-		AgentID: id,
-		UserID:  userID,
-		Status:  "running",
-		Input:   models.MapToJSON(input),
-		Output:  models.JSON{},
-	}
-
-	if err := s.db.Create(execution).Error; err != nil {
-		return nil, err
-	}
-
-	// TODO: Implement actual agent execution logic
-	// For now, we'll simulate execution
-	time.Sleep(2 * time.Second)
-
-	// Update execution with result
-	output := map[string]interface{}{
-		"result": "Agent execution completed successfully",
-		"data":   input,
-	}
-
-	execution.Status = "completed"
-	execution.Output = models.MapToJSON(output)
-	execution.Duration = 2000 // 2 seconds in milliseconds
-
-	if err := s.db.Save(execution).Error; err != nil {
-		return nil, err
-	}
-
-	// Update agent usage count
-	s.db.Model(&agent).Update("usage_count", agent.UsageCount+1)
-
-	return execution, nil
-}
-
 // GetAgentCategories retrieves all available agent categories
 func (s *AgentService) GetAgentCategories() ([]string, error) {
 	var categories []string
@@ -0,0 +1,261 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// APIKeyPrefix starts every API key, so keys can be told apart from JWTs
+const APIKeyPrefix = "vk_"
+
+// API key scopes
+const (
+	ScopeAgentsRead          = "agents:read"
+	ScopeAgentsWrite         = "agents:write"
+	ScopeExecutionsRead      = "executions:read"
+	ScopeExecutionsWrite     = "executions:write"
+	ScopeConversationsRead   = "conversations:read"
+	ScopeConversationsWrite  = "conversations:write"
+	ScopeWebhooksManage      = "webhooks:manage"
+	ScopeMarketplacePurchase = "marketplace:purchase"
+	ScopeUsageRead           = "usage:read"
+	ScopeBillingRead         = "billing:read"
+	ScopeLicensesRead        = "licenses:read"
+)
+
+// APIKeyScopes describes the scopes an API key may be granted
+var APIKeyScopes = map[string]string{
+	ScopeAgentsRead:          "List and view agents and marketplace listings",
+	ScopeAgentsWrite:         "Create, update and delete agents",
+	ScopeExecutionsRead:      "View executions and stream their events",
+	ScopeExecutionsWrite:     "Run and cancel agents",
+	ScopeConversationsRead:   "View conversations",
+	ScopeConversationsWrite:  "Create, rename and delete conversations",
+	ScopeWebhooksManage:      "Create, update and delete webhooks",
+	ScopeMarketplacePurchase: "Purchase and refund marketplace agents",
+	ScopeUsageRead:           "View credit balance, usage and plan limits",
+	ScopeBillingRead:         "View and download invoices",
+	ScopeLicensesRead:        "View on-premises licenses",
+}
+
+// apiKeyTouchInterval limits how often a key's last-used time is written
+const apiKeyTouchInterval = time.Minute
+
+// ErrInvalidAPIKey is returned for unknown, revoked and expired keys
+var ErrInvalidAPIKey = errors.New("invalid API key")
+
+// APIKeyService manages API keys and authenticates requests made with them
+type APIKeyService struct {
+	BaseService
+}
+
+// NewAPIKeyService creates a new API key service
+func NewAPIKeyService(db *gorm.DB, cfg *config.Config) *APIKeyService {
+	return &APIKeyService{
+		BaseService: NewBaseService(db, cfg, "api_key"),
+	}
+}
+
+// CreateAPIKeyRequest represents API key creation request
+type CreateAPIKeyRequest struct {
+	Name         string     `json:"name" binding:"required"`
+	Scopes       []string   `json:"scopes" binding:"required,min=1"`
+	Organization bool       `json:"organization"`
+	AllowedIPs   []string   `json:"allowed_ips"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+}
+
+// CreatedAPIKey is returned once, when a key is created; the key cannot be
+// retrieved again
+type CreatedAPIKey struct {
+	*models.APIKey
+	Key string `json:"key"`
+}
+
+// CreateAPIKey creates a personal key, or an organization key when requested
+// by an admin of the user's organization
+func (s *APIKeyService) CreateAPIKey(user *models.User, req *CreateAPIKeyRequest) (*CreatedAPIKey, error) {
+	for _, scope := range req.Scopes {
+		if _, ok := APIKeyScopes[scope]; !ok {
+			return nil, fmt.Errorf("unknown scope: %s", scope)
+		}
+	}
+	for _, entry := range req.AllowedIPs {
+		if net.ParseIP(entry) == nil {
+			if _, _, err := net.ParseCIDR(entry); err != nil {
+				return nil, fmt.Errorf("invalid IP address or CIDR: %s", entry)
+			}
+		}
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		return nil, errors.New("expiry must be in the future")
+	}
+
+	var orgID *string
+	if req.Organization {
+		if user.OrganizationID == nil {
+			return nil, errors.New("user does not belong to an organization")
+		}
+		if user.Role != "admin" {
+			return nil, errors.New("only organization admins can create organization keys")
+		}
+		orgID = user.OrganizationID
+	}
+
+	key, prefix, err := generateAPIKey()
+	if err != nil {
+		return nil, err
+	}
+
+	allowedIPs := req.AllowedIPs
+	if allowedIPs == nil {
+		allowedIPs = []string{}
+	}
+	apiKey := &models.APIKey{
+		Name:           req.Name,
+		Prefix:         prefix,
+		KeyHash:        hashToken(key),
+		UserID:         user.ID,
+		OrganizationID: orgID,
+		Scopes:         req.Scopes,
+		AllowedIPs:     allowedIPs,
+		ExpiresAt:      req.ExpiresAt,
+	}
+	if err := s.db.Create(apiKey).Error; err != nil {
+		return nil, err
+	}
+
+	return &CreatedAPIKey{APIKey: apiKey, Key: key}, nil
+}
+
+// apiKeyScope limits a query to the user's personal keys and, for
+// organization admins, their organization's keys
+func apiKeyScope(db *gorm.DB, user *models.User) *gorm.DB {
+	if user.OrganizationID != nil && user.Role == "admin" {
+		return db.Where("(user_id = ? AND organization_id IS NULL) OR organization_id = ?", user.ID, *user.OrganizationID)
+	}
+	return db.Where("user_id = ? AND organization_id IS NULL", user.ID)
+}
+
+// ListAPIKeys lists the keys the user can manage, newest first
+func (s *APIKeyService) ListAPIKeys(user *models.User, includeRevoked bool) ([]models.APIKey, error) {
+	var keys []models.APIKey
+	query := apiKeyScope(s.db, user)
+	if !includeRevoked {
+		query = query.Where("revoked_at IS NULL")
+	}
+	if err := query.Order("created_at DESC").Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey revokes one of the keys the user can manage
+func (s *APIKeyService) RevokeAPIKey(id string, user *models.User) (*models.APIKey, error) {
+	var apiKey models.APIKey
+	if err := apiKeyScope(s.db, user).First(&apiKey, "id = ?", id).Error; err != nil {
+		return nil, errors.New("API key not found")
+	}
+	if apiKey.RevokedAt != nil {
+		return nil, errors.New("API key is already revoked")
+	}
+
+	now := time.Now()
+	if err := s.db.Model(&apiKey).Update("revoked_at", now).Error; err != nil {
+		return nil, err
+	}
+	apiKey.RevokedAt = &now
+	return &apiKey, nil
+}
+
+// Authenticate resolves an API key presented from clientIP to its key record
+// and the user it acts as
+func (s *APIKeyService) Authenticate(key, clientIP string) (*models.User, *models.APIKey, error) {
+	if !strings.HasPrefix(key, APIKeyPrefix) {
+		return nil, nil, ErrInvalidAPIKey
+	}
+
+	var apiKey models.APIKey
+	if err := s.db.First(&apiKey, "key_hash = ?", hashToken(key)).Error; err != nil {
+		return nil, nil, ErrInvalidAPIKey
+	}
+	now := time.Now()
+	if apiKey.RevokedAt != nil || (apiKey.ExpiresAt != nil && now.After(*apiKey.ExpiresAt)) {
+		return nil, nil, ErrInvalidAPIKey
+	}
+	if !ipAllowed(apiKey.AllowedIPs, clientIP) {
+		return nil, nil, fmt.Errorf("API key cannot be used from %s", clientIP)
+	}
+
+	var user models.User
+	if err := s.db.Preload("Organization").First(&user, "id = ?", apiKey.UserID).Error; err != nil || !user.IsActive {
+		return nil, nil, ErrInvalidAPIKey
+	}
+	// Organization keys stop working when their creator leaves the organization
+	if apiKey.OrganizationID != nil && (user.OrganizationID == nil || *user.OrganizationID != *apiKey.OrganizationID) {
+		return nil, nil, ErrInvalidAPIKey
+	}
+
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) > apiKeyTouchInterval {
+		s.db.Model(&apiKey).Updates(map[string]interface{}{"last_used_at": now, "last_used_ip": clientIP})
+	}
+
+	return &user, &apiKey, nil
+}
+
+// APIKeyHasScope reports whether the key was granted the scope
+func APIKeyHasScope(apiKey *models.APIKey, scope string) bool {
+	for _, granted := range apiKey.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ipAllowed reports whether the client IP matches the key's allow-list
+func ipAllowed(allowList []string, clientIP string) bool {
+	if len(allowList) == 0 {
+		return true
+	}
+
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+	for _, entry := range allowList {
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if allowed := net.ParseIP(entry); allowed != nil && allowed.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// generateAPIKey returns a new key and its displayable prefix
+func generateAPIKey() (string, string, error) {
+	id := make([]byte, 4)
+	secret := make([]byte, 24)
+	if _, err := rand.Read(id); err != nil {
+		return "", "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	prefix := APIKeyPrefix + hex.EncodeToString(id)
+	return prefix + "_" + base64.RawURLEncoding.EncodeToString(secret), prefix, nil
+}
@@ -0,0 +1,248 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// apiKeyTest holds an API key service, an organization with an admin and a
+// member, and a user outside any organization
+type apiKeyTest struct {
+	keys   *APIKeyService
+	admin  *models.User
+	member *models.User
+	user   *models.User
+}
+
+func newAPIKeyTest(t *testing.T) *apiKeyTest {
+	t.Helper()
+	db := newTestDB(t, &models.Organization{}, &models.User{}, &models.APIKey{})
+	org := &models.Organization{Name: "Acme", Slug: "acme"}
+	if err := db.Create(org).Error; err != nil {
+		t.Fatal(err)
+	}
+	at := &apiKeyTest{
+		keys:   NewAPIKeyService(db, config.Load()),
+		admin:  &models.User{Email: "bob@example.com", Username: "bob", PasswordHash: "x", IsActive: true, Role: "admin", OrganizationID: &org.ID},
+		member: &models.User{Email: "cat@example.com", Username: "cat", PasswordHash: "x", IsActive: true, Role: "user", OrganizationID: &org.ID},
+		user:   &models.User{Email: "ann@example.com", Username: "ann", PasswordHash: "x", IsActive: true, Role: "user"},
+	}
+	for _, u := range []*models.User{at.admin, at.member, at.user} {
+		if err := db.Create(u).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return at
+}
+
+// create makes a key for the user, failing the test on an error
+func (at *apiKeyTest) create(t *testing.T, user *models.User, req *CreateAPIKeyRequest) *CreatedAPIKey {
+	t.Helper()
+	if req.Name == "" {
+		req.Name = "ci"
+	}
+	if req.Scopes == nil {
+		req.Scopes = []string{ScopeAgentsRead}
+	}
+	created, err := at.keys.CreateAPIKey(user, req)
+	if err != nil {
+		t.Fatalf("CreateAPIKey() error = %v", err)
+	}
+	return created
+}
+
+func TestCreateAPIKey(t *testing.T) {
+	at := newAPIKeyTest(t)
+	past := time.Now().Add(-time.Minute)
+
+	tests := []struct {
+		name string
+		user *models.User
+		req  CreateAPIKeyRequest
+		err  string
+	}{
+		{name: "unknown scope", user: at.user, req: CreateAPIKeyRequest{Scopes: []string{"admin:all"}}, err: "unknown scope"},
+		{name: "invalid IP", user: at.user, req: CreateAPIKeyRequest{Scopes: []string{ScopeAgentsRead}, AllowedIPs: []string{"10.0.0.300"}}, err: "invalid IP address or CIDR"},
+		{name: "expired", user: at.user, req: CreateAPIKeyRequest{Scopes: []string{ScopeAgentsRead}, ExpiresAt: &past}, err: "expiry must be in the future"},
+		{name: "organization key outside one", user: at.user, req: CreateAPIKeyRequest{Scopes: []string{ScopeAgentsRead}, Organization: true}, err: "does not belong to an organization"},
+		{name: "organization key by a member", user: at.member, req: CreateAPIKeyRequest{Scopes: []string{ScopeAgentsRead}, Organization: true}, err: "only organization admins"},
+	}
+	for _, tt := range tests {
+		tt.req.Name = "ci"
+		if _, err := at.keys.CreateAPIKey(tt.user, &tt.req); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("CreateAPIKey(%s) error = %v, want one containing %q", tt.name, err, tt.err)
+		}
+	}
+
+	created := at.create(t, at.admin, &CreateAPIKeyRequest{
+		Scopes:       []string{ScopeAgentsRead, ScopeExecutionsWrite},
+		Organization: true,
+		AllowedIPs:   []string{"203.0.113.7", "10.0.0.0/8"},
+	})
+	if !strings.HasPrefix(created.Key, created.Prefix+"_") || !strings.HasPrefix(created.Prefix, APIKeyPrefix) {
+		t.Errorf("key %q does not start with its prefix %q", created.Key, created.Prefix)
+	}
+	if created.OrganizationID == nil || *created.OrganizationID != *at.admin.OrganizationID {
+		t.Errorf("key organization = %v, want the admin's", created.OrganizationID)
+	}
+
+	// Only a hash of the key is kept
+	var stored models.APIKey
+	at.keys.db.First(&stored, "id = ?", created.ID)
+	if stored.KeyHash != hashToken(created.Key) || strings.Contains(stored.KeyHash, created.Key) {
+		t.Errorf("stored key hash = %q, want the hash of the key", stored.KeyHash)
+	}
+	if !APIKeyHasScope(&stored, ScopeExecutionsWrite) || APIKeyHasScope(&stored, ScopeAgentsWrite) {
+		t.Errorf("stored scopes = %v, want the scopes granted", stored.Scopes)
+	}
+	if len(stored.AllowedIPs) != 2 {
+		t.Errorf("stored allow-list = %v, want both entries", stored.AllowedIPs)
+	}
+}
+
+func TestAuthenticateAPIKey(t *testing.T) {
+	at := newAPIKeyTest(t)
+	future := time.Now().Add(time.Hour)
+	open := at.create(t, at.user, &CreateAPIKeyRequest{})
+	restricted := at.create(t, at.user, &CreateAPIKeyRequest{AllowedIPs: []string{"203.0.113.7", "10.0.0.0/8", "2001:db8::/32"}})
+	expired := at.create(t, at.user, &CreateAPIKeyRequest{ExpiresAt: &future})
+	at.keys.db.Model(&models.APIKey{}).Where("id = ?", expired.ID).Update("expires_at", time.Now().Add(-time.Second))
+	revoked := at.create(t, at.user, &CreateAPIKeyRequest{})
+	if _, err := at.keys.RevokeAPIKey(revoked.ID, at.user); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		key      string
+		clientIP string
+		err      string
+	}{
+		{name: "valid key", key: open.Key, clientIP: "198.51.100.1"},
+		{name: "allowed address", key: restricted.Key, clientIP: "203.0.113.7"},
+		{name: "allowed network", key: restricted.Key, clientIP: "10.20.30.40"},
+		{name: "allowed IPv6 network", key: restricted.Key, clientIP: "2001:db8::1"},
+		{name: "address not allowed", key: restricted.Key, clientIP: "203.0.113.8", err: "cannot be used from 203.0.113.8"},
+		{name: "unparsable address", key: restricted.Key, clientIP: "", err: "cannot be used from"},
+		{name: "not an API key", key: "eyJhbGciOiJIUzI1NiJ9", clientIP: "198.51.100.1", err: ErrInvalidAPIKey.Error()},
+		{name: "unknown key", key: open.Prefix + "_unknown", clientIP: "198.51.100.1", err: ErrInvalidAPIKey.Error()},
+		{name: "expired", key: expired.Key, clientIP: "198.51.100.1", err: ErrInvalidAPIKey.Error()},
+		{name: "revoked", key: revoked.Key, clientIP: "198.51.100.1", err: ErrInvalidAPIKey.Error()},
+	}
+
+	for _, tt := range tests {
+		user, apiKey, err := at.keys.Authenticate(tt.key, tt.clientIP)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Authenticate(%s) error = %v, want one containing %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || user.ID != at.user.ID || !strings.HasPrefix(tt.key, apiKey.Prefix+"_") {
+			t.Errorf("Authenticate(%s) = %v, %v, want the key and its user", tt.name, apiKey, err)
+		}
+	}
+
+	// Use is recorded with the address it came from
+	var stored models.APIKey
+	at.keys.db.First(&stored, "id = ?", restricted.ID)
+	if stored.LastUsedAt == nil || stored.LastUsedIP != "203.0.113.7" {
+		t.Errorf("key last used at %v from %q, want the first use recorded", stored.LastUsedAt, stored.LastUsedIP)
+	}
+}
+
+func TestAuthenticateAPIKeyUser(t *testing.T) {
+	at := newAPIKeyTest(t)
+	orgKey := at.create(t, at.admin, &CreateAPIKeyRequest{Organization: true})
+	personal := at.create(t, at.member, &CreateAPIKeyRequest{})
+
+	if _, _, err := at.keys.Authenticate(orgKey.Key, "198.51.100.1"); err != nil {
+		t.Fatalf("Authenticate() error = %v", err)
+	}
+
+	// Organization keys stop working when their creator leaves the organization
+	at.keys.db.Model(at.admin).Update("organization_id", nil)
+	if _, _, err := at.keys.Authenticate(orgKey.Key, "198.51.100.1"); !errors.Is(err, ErrInvalidAPIKey) {
+		t.Errorf("Authenticate() after leaving the organization error = %v, want ErrInvalidAPIKey", err)
+	}
+
+	// Keys of deactivated users stop working
+	at.keys.db.Model(at.member).Update("is_active", false)
+	if _, _, err := at.keys.Authenticate(personal.Key, "198.51.100.1"); !errors.Is(err, ErrInvalidAPIKey) {
+		t.Errorf("Authenticate() for an inactive user error = %v, want ErrInvalidAPIKey", err)
+	}
+}
+
+func TestManageAPIKeys(t *testing.T) {
+	at := newAPIKeyTest(t)
+	orgKey := at.create(t, at.admin, &CreateAPIKeyRequest{Organization: true})
+	adminKey := at.create(t, at.admin, &CreateAPIKeyRequest{})
+	memberKey := at.create(t, at.member, &CreateAPIKeyRequest{})
+
+	tests := []struct {
+		name string
+		user *models.User
+		want int
+	}{
+		// Admins manage the organization's keys alongside their own
+		{name: "admin", user: at.admin, want: 2},
+		{name: "member", user: at.member, want: 1},
+		{name: "user", user: at.user, want: 0},
+	}
+	for _, tt := range tests {
+		if keys, err := at.keys.ListAPIKeys(tt.user, false); err != nil || len(keys) != tt.want {
+			t.Errorf("ListAPIKeys(%s) = %d keys, %v, want %d", tt.name, len(keys), err, tt.want)
+		}
+	}
+
+	for _, id := range []string{orgKey.ID, adminKey.ID} {
+		if _, err := at.keys.RevokeAPIKey(id, at.member); err == nil {
+			t.Error("RevokeAPIKey() of a key the member cannot manage error = nil, want an error")
+		}
+	}
+	if _, err := at.keys.RevokeAPIKey(memberKey.ID, at.admin); err == nil {
+		t.Error("RevokeAPIKey() of another member's personal key error = nil, want an error")
+	}
+
+	revoked, err := at.keys.RevokeAPIKey(orgKey.ID, at.admin)
+	if err != nil || revoked.RevokedAt == nil {
+		t.Fatalf("RevokeAPIKey() = %v, want the key revoked", err)
+	}
+	if _, err := at.keys.RevokeAPIKey(orgKey.ID, at.admin); err == nil {
+		t.Error("second RevokeAPIKey() error = nil, want an error")
+	}
+	if keys, _ := at.keys.ListAPIKeys(at.admin, false); len(keys) != 1 {
+		t.Errorf("ListAPIKeys() = %d keys, want the revoked key left out", len(keys))
+	}
+	if keys, _ := at.keys.ListAPIKeys(at.admin, true); len(keys) != 2 {
+		t.Errorf("ListAPIKeys(include revoked) = %d keys, want 2", len(keys))
+	}
+}
+
+func TestIPAllowed(t *testing.T) {
+	tests := []struct {
+		allowList []string
+		clientIP  string
+		want      bool
+	}{
+		{allowList: nil, clientIP: "198.51.100.1", want: true},
+		{allowList: []string{"198.51.100.1"}, clientIP: "198.51.100.1", want: true},
+		{allowList: []string{"198.51.100.1"}, clientIP: "198.51.100.2"},
+		{allowList: []string{"198.51.100.0/24"}, clientIP: "198.51.100.200", want: true},
+		{allowList: []string{"198.51.100.0/24"}, clientIP: "198.51.101.1"},
+		{allowList: []string{"::ffff:198.51.100.1"}, clientIP: "198.51.100.1", want: true},
+		{allowList: []string{"2001:db8::/32"}, clientIP: "2001:db9::1"},
+		{allowList: []string{"198.51.100.1"}, clientIP: "not-an-ip"},
+	}
+
+	for _, tt := range tests {
+		if got := ipAllowed(tt.allowList, tt.clientIP); got != tt.want {
+			t.Errorf("ipAllowed(%v, %q) = %v, want %v", tt.allowList, tt.clientIP, got, tt.want)
+		}
+	}
+}
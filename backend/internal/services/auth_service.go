@@ -1,8 +1,14 @@
 package services
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"net/url"
 	"strings"
 	"time"
 
@@ -15,18 +21,40 @@ import (
 	"github.com/mlaitechio/vagais/internal/models"
 )
 
+// tokenTypeAccess marks access tokens, so that no other JWT is accepted in their place
+const tokenTypeAccess = "access"
+
+// Refresh token errors
+var (
+	errInvalidRefreshToken = errors.New("invalid refresh token")
+	errRefreshTokenReused  = errors.New("refresh token has already been used; all sessions from this login have been signed out")
+)
+
 // AuthService handles authentication operations
 type AuthService struct {
 	BaseService
+	credits       *CreditService
+	notifications *NotificationService
+	emails        *EmailService
+	denylist      TokenDenylist
 }
 
 // NewAuthService creates a new auth service
 func NewAuthService(db *gorm.DB, cfg *config.Config) *AuthService {
 	return &AuthService{
-		BaseService: NewBaseService(db, cfg, "auth"),
+		BaseService:   NewBaseService(db, cfg, "auth"),
+		credits:       NewCreditService(db, cfg),
+		notifications: NewNotificationService(db, cfg),
+		emails:        NewEmailService(db, cfg),
+		denylist:      NewDBTokenDenylist(db),
 	}
 }
 
+// SetDenylist replaces the denylist revoked access tokens are recorded in
+func (s *AuthService) SetDenylist(denylist TokenDenylist) {
+	s.denylist = denylist
+}
+
 // LoginRequest represents login request
 type LoginRequest struct {
 	Email    string `json:"email" binding:"required,email"`
@@ -42,24 +70,32 @@ type RegisterRequest struct {
 	OrganizationName string `json:"organization_name"`
 }
 
-// AuthResponse represents authentication response
+// AuthResponse represents authentication response. When the user has MFA
+// enabled, login returns only an MFA token, valid until ExpiresAt, which is
+// exchanged for the session tokens with a code.
 type AuthResponse struct {
-	User         *models.User `json:"user"`
-	AccessToken  string       `json:"access_token"`
-	RefreshToken string       `json:"refresh_token"`
-	ExpiresAt    time.Time    `json:"expires_at"`
+	User             *models.User `json:"user,omitempty"`
+	AccessToken      string       `json:"access_token,omitempty"`
+	RefreshToken     string       `json:"refresh_token,omitempty"`
+	ExpiresAt        time.Time    `json:"expires_at"`
+	MFARequired      bool         `json:"mfa_required,omitempty"`
+	MFAToken         string       `json:"mfa_token,omitempty"`
+	MFASetupRequired bool         `json:"mfa_setup_required,omitempty"`
 }
 
-// JWTClaims represents JWT claims
+// JWTClaims represents JWT claims. The registered ID is the token's jti and
+// SessionID the refresh token family it was issued with.
 type JWTClaims struct {
-	UserID string `json:"user_id"`
-	Email  string `json:"email"`
-	Role   string `json:"role"`
+	UserID    string `json:"user_id"`
+	Email     string `json:"email"`
+	Role      string `json:"role"`
+	Type      string `json:"typ"`
+	SessionID string `json:"sid"`
 	jwt.RegisteredClaims
 }
 
 // Login handles user login
-func (s *AuthService) Login(req *LoginRequest) (*AuthResponse, error) {
+func (s *AuthService) Login(req *LoginRequest, client *ClientInfo) (*AuthResponse, error) {
 	var user models.User
 	if err := s.db.Preload("Organization").Where("email = ?", req.Email).First(&user).Error; err != nil {
 		return nil, errors.New("invalid credentials")
@@ -73,25 +109,52 @@ func (s *AuthService) Login(req *LoginRequest) (*AuthResponse, error) {
 		return nil, errors.New("invalid credentials")
 	}
 
+	if err := checkPasswordLogin(s.db, &user); err != nil {
+		return nil, err
+	}
+
+	// The password is not enough; the login continues with VerifyMFA
+	if user.MFAEnabled {
+		mfaToken, expiresAt, err := s.createMFAChallenge(&user, client)
+		if err != nil {
+			return nil, err
+		}
+		return &AuthResponse{
+			MFARequired: true,
+			MFAToken:    mfaToken,
+			ExpiresAt:   expiresAt,
+		}, nil
+	}
+
+	return s.completeLogin(&user, client)
+}
+
+// completeLogin starts a session for an authenticated user and issues its tokens
+func (s *AuthService) completeLogin(user *models.User, client *ClientInfo) (*AuthResponse, error) {
 	// Update last login
-	s.db.Model(&user).Update("last_login_at", time.Now())
+	s.db.Model(user).Update("last_login_at", time.Now())
 
 	// Generate tokens
-	accessToken, refreshToken, expiresAt, err := s.generateTokens(user.ID, user.Email, user.Role)
+	familyID := uuid.New().String()
+	if err := s.startSession(user, familyID, client); err != nil {
+		return nil, err
+	}
+	accessToken, refreshToken, expiresAt, err := s.generateTokens(user, familyID)
 	if err != nil {
 		return nil, err
 	}
 
 	return &AuthResponse{
-		User:         &user,
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
-		ExpiresAt:    expiresAt,
+		User:             user,
+		AccessToken:      accessToken,
+		RefreshToken:     refreshToken,
+		ExpiresAt:        expiresAt,
+		MFASetupRequired: s.MFASetupRequired(user),
 	}, nil
 }
 
 // Register handles user registration
-func (s *AuthService) Register(req *RegisterRequest) (*AuthResponse, error) {
+func (s *AuthService) Register(req *RegisterRequest, client *ClientInfo) (*AuthResponse, error) {
 	// Check if user already exists
 	var existingUser models.User
 	if err := s.db.Where("email = ?", req.Email).First(&existingUser).Error; err == nil {
@@ -105,14 +168,15 @@ func (s *AuthService) Register(req *RegisterRequest) (*AuthResponse, error) {
 	}
 
 	// Create user
+	sentAt := time.Now()
 	user := &models.User{
-		Email:        req.Email,
-		PasswordHash: string(hashedPassword),
-		FirstName:    req.FirstName,
-		LastName:     req.LastName,
-		Role:         "user",
-		IsActive:     true,
-		Credits:      100, // Default credits
+		Email:              req.Email,
+		PasswordHash:       string(hashedPassword),
+		FirstName:          req.FirstName,
+		LastName:           req.LastName,
+		Role:               "user",
+		IsActive:           true,
+		VerificationSentAt: &sentAt,
 	}
 
 	// If organization name is provided, create organization
@@ -137,11 +201,28 @@ func (s *AuthService) Register(req *RegisterRequest) (*AuthResponse, error) {
 		return nil, err
 	}
 
+	// Starting credits go through the ledger like any other grant
+	if bonus := s.cfg.Credits.SignupBonus; bonus > 0 {
+		if entry, err := s.credits.Credit(user.ID, bonus, CreditTypeGrant, "Sign-up bonus", nil); err != nil {
+			fmt.Printf("Error granting sign-up credits to %s: %v\n", user.ID, err)
+		} else {
+			user.Credits = entry.Balance
+		}
+	}
+
+	if err := s.sendVerificationEmail(user); err != nil {
+		fmt.Printf("Error sending verification email to %s: %v\n", user.Email, err)
+	}
+
 	// Load organization data
 	s.db.Preload("Organization").First(user, user.ID)
 
 	// Generate tokens
-	accessToken, refreshToken, expiresAt, err := s.generateTokens(user.ID, user.Email, user.Role)
+	familyID := uuid.New().String()
+	if err := s.startSession(user, familyID, client); err != nil {
+		return nil, err
+	}
+	accessToken, refreshToken, expiresAt, err := s.generateTokens(user, familyID)
 	if err != nil {
 		return nil, err
 	}
@@ -154,29 +235,51 @@ func (s *AuthService) Register(req *RegisterRequest) (*AuthResponse, error) {
 	}, nil
 }
 
-// RefreshToken refreshes an access token
-func (s *AuthService) RefreshToken(refreshToken string) (*AuthResponse, error) {
-	// Validate refresh token
-	claims, err := s.validateToken(refreshToken)
-	if err != nil {
-		return nil, errors.New("invalid refresh token")
+// RefreshToken exchanges a refresh token for new tokens. The refresh token
+// is rotated: it cannot be used again, and an attempt to do so revokes every
+// token in its family.
+func (s *AuthService) RefreshToken(refreshToken string, client *ClientInfo) (*AuthResponse, error) {
+	var stored models.RefreshToken
+	if err := s.db.First(&stored, "token_hash = ?", hashToken(refreshToken)).Error; err != nil {
+		return nil, errInvalidRefreshToken
+	}
+	if stored.RevokedAt != nil || time.Now().After(stored.ExpiresAt) {
+		return nil, errInvalidRefreshToken
+	}
+	if stored.UsedAt != nil {
+		s.revokeFamily(stored.FamilyID)
+		return nil, errRefreshTokenReused
+	}
+
+	// A concurrent request may have used the token since it was read
+	result := s.db.Model(&models.RefreshToken{}).
+		Where("id = ? AND used_at IS NULL AND revoked_at IS NULL", stored.ID).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		s.revokeFamily(stored.FamilyID)
+		return nil, errRefreshTokenReused
 	}
 
 	// Get user
 	var user models.User
-	if err := s.db.Preload("Organization").First(&user, "id = ?", claims.UserID).Error; err != nil {
+	if err := s.db.Preload("Organization").First(&user, "id = ?", stored.UserID).Error; err != nil {
 		return nil, errors.New("user not found")
 	}
 
 	if !user.IsActive {
+		s.revokeFamily(stored.FamilyID)
 		return nil, errors.New("account is deactivated")
 	}
 
 	// Generate new tokens
-	accessToken, newRefreshToken, expiresAt, err := s.generateTokens(user.ID, user.Email, user.Role)
+	accessToken, newRefreshToken, expiresAt, err := s.generateTokens(&user, stored.FamilyID)
 	if err != nil {
 		return nil, err
 	}
+	s.touchSession(stored.FamilyID, client)
 
 	return &AuthResponse{
 		User:         &user,
@@ -186,16 +289,76 @@ func (s *AuthService) RefreshToken(refreshToken string) (*AuthResponse, error) {
 	}, nil
 }
 
-// Logout handles user logout
-func (s *AuthService) Logout(userID string) error {
-	// In a real implementation, you might want to blacklist the token
-	// For now, we'll just return success
+// Logout revokes the access token and the refresh token family of the session it belongs to
+func (s *AuthService) Logout(claims *JWTClaims) error {
+	if claims.ID != "" && claims.ExpiresAt != nil {
+		if err := s.denylist.Add(context.Background(), claims.ID, claims.ExpiresAt.Time); err != nil {
+			return err
+		}
+	}
+	if claims.SessionID != "" {
+		return s.revokeFamily(claims.SessionID)
+	}
 	return nil
 }
 
-// ValidateToken validates a JWT token
+// LogoutAll revokes every refresh token of the user and the access tokens issued with them
+func (s *AuthService) LogoutAll(userID string) error {
+	return s.revokeTokens(s.db.Where("user_id = ?", userID))
+}
+
+// revokeFamily revokes every token issued from one login
+func (s *AuthService) revokeFamily(familyID string) error {
+	return s.revokeTokens(s.db.Where("family_id = ?", familyID))
+}
+
+// revokeTokens revokes the refresh tokens and sessions matched by scope, and
+// denylists the access tokens issued with them that may not have expired yet
+func (s *AuthService) revokeTokens(scope *gorm.DB) error {
+	now := time.Now()
+	accessTTL := s.accessTokenTTL()
+
+	var live []models.RefreshToken
+	if err := scope.Session(&gorm.Session{}).Select("access_token_id", "created_at").
+		Where("created_at > ? AND access_token_id <> ''", now.Add(-accessTTL)).
+		Find(&live).Error; err != nil {
+		return err
+	}
+	for _, token := range live {
+		if err := s.denylist.Add(context.Background(), token.AccessTokenID, token.CreatedAt.Add(accessTTL)); err != nil {
+			fmt.Printf("Failed to denylist access token: %v\n", err)
+		}
+	}
+
+	if err := scope.Session(&gorm.Session{}).Model(&models.Session{}).
+		Where("revoked_at IS NULL").
+		Update("revoked_at", now).Error; err != nil {
+		return err
+	}
+	return scope.Session(&gorm.Session{}).Model(&models.RefreshToken{}).
+		Where("revoked_at IS NULL").
+		Update("revoked_at", now).Error
+}
+
+// ValidateToken validates an access token and checks it has not been revoked
 func (s *AuthService) ValidateToken(tokenString string) (*JWTClaims, error) {
-	return s.validateToken(tokenString)
+	claims, err := s.validateToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Type != tokenTypeAccess {
+		return nil, errors.New("invalid token")
+	}
+
+	revoked, err := s.denylist.Contains(context.Background(), claims.ID)
+	if err != nil {
+		fmt.Printf("Failed to check token denylist: %v\n", err)
+		return nil, errors.New("unable to verify token")
+	}
+	if revoked {
+		return nil, errors.New("token has been revoked")
+	}
+	return claims, nil
 }
 
 // ForgotPassword handles password reset request
@@ -221,11 +384,16 @@ func (s *AuthService) ForgotPassword(email string) error {
 		return errors.New("failed to create reset token")
 	}
 
-	// In a real implementation, you would send an email with the reset link
-	// For now, we'll just print the token for testing purposes
-	fmt.Printf("Password reset token generated for %s: %s\n", email, token)
-
-	return nil
+	return s.emails.SendAsync(&EmailRequest{
+		To:       user.Email,
+		UserID:   &user.ID,
+		Template: EmailTemplatePasswordReset,
+		Data: map[string]interface{}{
+			"Name":      displayName(&user),
+			"ResetURL":  s.cfg.Email.AppURL + "/reset-password?token=" + url.QueryEscape(token),
+			"ExpiresIn": "1 hour",
+		},
+	})
 }
 
 // ResetPassword handles password reset
@@ -251,21 +419,29 @@ func (s *AuthService) ResetPassword(token, newPassword string) error {
 		fmt.Printf("Failed to mark reset token as used: %v\n", err)
 	}
 
+	// Sign out every session, in case the old password was compromised
+	if err := s.LogoutAll(resetToken.UserID); err != nil {
+		fmt.Printf("Failed to revoke sessions after password reset: %v\n", err)
+	}
+
 	return nil
 }
 
-// generateTokens generates access and refresh tokens
-func (s *AuthService) generateTokens(userID string, email, role string) (string, string, time.Time, error) {
+// generateTokens issues an access token and a refresh token in the given family
+func (s *AuthService) generateTokens(user *models.User, familyID string) (string, string, time.Time, error) {
 	now := time.Now()
-	accessExpiresAt := now.Add(15 * time.Minute)
-	refreshExpiresAt := now.Add(7 * 24 * time.Hour)
+	accessExpiresAt := now.Add(s.accessTokenTTL())
+	refreshExpiresAt := now.Add(s.refreshTokenTTL())
 
 	// Generate access token
 	accessClaims := &JWTClaims{
-		UserID: userID,
-		Email:  email,
-		Role:   role,
+		UserID:    user.ID,
+		Email:     user.Email,
+		Role:      user.Role,
+		Type:      tokenTypeAccess,
+		SessionID: familyID,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
 			ExpiresAt: jwt.NewNumericDate(accessExpiresAt),
 			IssuedAt:  jwt.NewNumericDate(now),
 			NotBefore: jwt.NewNumericDate(now),
@@ -278,32 +454,47 @@ func (s *AuthService) generateTokens(userID string, email, role string) (string,
 		return "", "", time.Time{}, err
 	}
 
-	// Generate refresh token
-	refreshClaims := &JWTClaims{
-		UserID: userID,
-		Email:  email,
-		Role:   role,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(refreshExpiresAt),
-			IssuedAt:  jwt.NewNumericDate(now),
-			NotBefore: jwt.NewNumericDate(now),
-		},
+	// Generate refresh token; it is opaque and only its hash is stored
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", time.Time{}, err
 	}
-
-	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshClaims)
-	refreshTokenString, err := refreshToken.SignedString([]byte(s.cfg.JWT.SecretKey))
-	if err != nil {
+	refreshTokenString := base64.RawURLEncoding.EncodeToString(secret)
+
+	if err := s.db.Create(&models.RefreshToken{
+		UserID:        user.ID,
+		FamilyID:      familyID,
+		TokenHash:     hashToken(refreshTokenString),
+		AccessTokenID: accessClaims.ID,
+		ExpiresAt:     refreshExpiresAt,
+	}).Error; err != nil {
 		return "", "", time.Time{}, err
 	}
 
 	return accessTokenString, refreshTokenString, accessExpiresAt, nil
 }
 
+// accessTokenTTL returns how long access tokens are valid for
+func (s *AuthService) accessTokenTTL() time.Duration {
+	return time.Duration(s.cfg.JWT.AccessTokenMinutes) * time.Minute
+}
+
+// refreshTokenTTL returns how long refresh tokens, and so sessions, are valid for
+func (s *AuthService) refreshTokenTTL() time.Duration {
+	return time.Duration(s.cfg.JWT.RefreshTokenDays) * 24 * time.Hour
+}
+
+// hashToken hashes a random token for storage
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 // validateToken validates a JWT token
 func (s *AuthService) validateToken(tokenString string) (*JWTClaims, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
 		return []byte(s.cfg.JWT.SecretKey), nil
-	})
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
 
 	if err != nil {
 		return nil, err
@@ -327,17 +518,27 @@ func (s *AuthService) generateSlug(name string) string {
 
 // GetUserFromToken gets user from JWT token
 func (s *AuthService) GetUserFromToken(tokenString string) (*models.User, error) {
+	user, _, err := s.AuthenticateToken(tokenString)
+	return user, err
+}
+
+// AuthenticateToken validates an access token and loads the user it was issued to
+func (s *AuthService) AuthenticateToken(tokenString string) (*models.User, *JWTClaims, error) {
 	claims, err := s.ValidateToken(tokenString)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	var user models.User
 	if err := s.db.Preload("Organization").First(&user, "id = ?", claims.UserID).Error; err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	// Deactivation takes effect immediately, not when the token expires
+	if !user.IsActive {
+		return nil, nil, errors.New("account is deactivated")
 	}
 
-	return &user, nil
+	return &user, claims, nil
 }
 
 // IsAvailable checks if the auth service is available
@@ -0,0 +1,269 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// testPassword is the password of the user authTest signs in
+const testPassword = "correct horse battery"
+
+// authTest holds an auth service and an active user who signs in with a password
+type authTest struct {
+	db   *gorm.DB
+	auth *AuthService
+	user *models.User
+}
+
+func newAuthTest(t *testing.T) *authTest {
+	t.Helper()
+	t.Setenv("EMAIL_OUTBOX_DIR", t.TempDir())
+
+	db := newTestDB(t, &models.Organization{}, &models.User{}, &models.CreditTransaction{}, &models.RefreshToken{},
+		&models.RevokedAccessToken{}, &models.Session{}, &models.Notification{}, &models.EmailLog{},
+		&models.PasswordResetToken{}, &models.SSOConnection{})
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &models.User{Email: "ann@example.com", Username: "ann", PasswordHash: string(hash), IsActive: true, EmailVerified: true}
+	if err := db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	waitForEmails(t, db)
+	return &authTest{db: db, auth: NewAuthService(db, config.Load()), user: user}
+}
+
+// login signs the user in from a client with the given user agent
+func (at *authTest) login(t *testing.T, userAgent string) *AuthResponse {
+	t.Helper()
+	resp, err := at.auth.Login(&LoginRequest{Email: at.user.Email, Password: testPassword},
+		&ClientInfo{IPAddress: "198.51.100.1", UserAgent: userAgent})
+	if err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+	return resp
+}
+
+// refresh exchanges a refresh token, failing the test on an error
+func (at *authTest) refresh(t *testing.T, refreshToken string) *AuthResponse {
+	t.Helper()
+	resp, err := at.auth.RefreshToken(refreshToken, &ClientInfo{IPAddress: "198.51.100.2"})
+	if err != nil {
+		t.Fatalf("RefreshToken() error = %v", err)
+	}
+	return resp
+}
+
+// checkRevoked fails the test unless the access token has been revoked
+func (at *authTest) checkRevoked(t *testing.T, accessToken string) {
+	t.Helper()
+	if _, err := at.auth.ValidateToken(accessToken); err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Errorf("ValidateToken() error = %v, want the token revoked", err)
+	}
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	at := newAuthTest(t)
+	login := at.login(t, "curl/8.0")
+
+	// Only a hash of the refresh token is stored
+	var stored models.RefreshToken
+	if err := at.db.First(&stored, "token_hash = ?", hashToken(login.RefreshToken)).Error; err != nil {
+		t.Fatalf("refresh token not stored by its hash: %v", err)
+	}
+
+	// Each use issues a new pair in the same family and uses up the old token
+	refreshed := at.refresh(t, login.RefreshToken)
+	if refreshed.RefreshToken == login.RefreshToken || refreshed.AccessToken == login.AccessToken {
+		t.Error("RefreshToken() returned the tokens it was given")
+	}
+	claims, err := at.auth.ValidateToken(refreshed.AccessToken)
+	if err != nil {
+		t.Fatalf("ValidateToken() error = %v", err)
+	}
+	if claims.SessionID != stored.FamilyID || claims.ID == "" {
+		t.Errorf("new access token in session %q with jti %q, want the login's family", claims.SessionID, claims.ID)
+	}
+	at.db.First(&stored, "id = ?", stored.ID)
+	if stored.UsedAt == nil {
+		t.Error("used refresh token has no used time")
+	}
+	at.refresh(t, refreshed.RefreshToken)
+}
+
+func TestRefreshTokenReuse(t *testing.T) {
+	at := newAuthTest(t)
+	login := at.login(t, "curl/8.0")
+	other := at.login(t, "curl/8.0")
+	refreshed := at.refresh(t, login.RefreshToken)
+
+	// Presenting a used token again signs out every token from that login
+	if _, err := at.auth.RefreshToken(login.RefreshToken, nil); !errors.Is(err, errRefreshTokenReused) {
+		t.Fatalf("RefreshToken() with a used token error = %v, want errRefreshTokenReused", err)
+	}
+	if _, err := at.auth.RefreshToken(refreshed.RefreshToken, nil); !errors.Is(err, errInvalidRefreshToken) {
+		t.Errorf("RefreshToken() with the family's newest token error = %v, want errInvalidRefreshToken", err)
+	}
+	at.checkRevoked(t, refreshed.AccessToken)
+	at.checkRevoked(t, login.AccessToken)
+
+	// Other logins are left alone
+	if _, err := at.auth.ValidateToken(other.AccessToken); err != nil {
+		t.Errorf("ValidateToken() for another login error = %v", err)
+	}
+	at.refresh(t, other.RefreshToken)
+}
+
+func TestRefreshTokenUsedConcurrently(t *testing.T) {
+	at := newAuthTest(t)
+	login := at.login(t, "curl/8.0")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := at.auth.RefreshToken(login.RefreshToken, nil)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	// One request wins; the other is treated as reuse
+	var succeeded, reused int
+	for err := range errs {
+		switch {
+		case err == nil:
+			succeeded++
+		case errors.Is(err, errRefreshTokenReused):
+			reused++
+		}
+	}
+	if succeeded != 1 || reused != 1 {
+		t.Errorf("%d refreshes succeeded and %d were refused as reuse, want 1 and 1", succeeded, reused)
+	}
+}
+
+func TestRefreshTokenRefused(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(at *authTest, login *AuthResponse) string
+		err    string
+	}{
+		{name: "unknown token", modify: func(at *authTest, login *AuthResponse) string {
+			return "not-a-token"
+		}, err: errInvalidRefreshToken.Error()},
+		// Access tokens are not refresh tokens
+		{name: "access token", modify: func(at *authTest, login *AuthResponse) string {
+			return login.AccessToken
+		}, err: errInvalidRefreshToken.Error()},
+		{name: "expired", modify: func(at *authTest, login *AuthResponse) string {
+			at.db.Model(&models.RefreshToken{}).Where("token_hash = ?", hashToken(login.RefreshToken)).
+				Update("expires_at", time.Now().Add(-time.Second))
+			return login.RefreshToken
+		}, err: errInvalidRefreshToken.Error()},
+		{name: "deactivated user", modify: func(at *authTest, login *AuthResponse) string {
+			at.db.Model(at.user).Update("is_active", false)
+			return login.RefreshToken
+		}, err: "account is deactivated"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			at := newAuthTest(t)
+			login := at.login(t, "curl/8.0")
+			token := tt.modify(at, login)
+			if _, err := at.auth.RefreshToken(token, nil); err == nil || err.Error() != tt.err {
+				t.Errorf("RefreshToken() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestValidateTokenType(t *testing.T) {
+	at := newAuthTest(t)
+	claims := &JWTClaims{
+		UserID: at.user.ID,
+		Type:   "refresh",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        "jti-1",
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(at.auth.cfg.JWT.SecretKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only access tokens are accepted, however they are signed
+	if _, err := at.auth.ValidateToken(token); err == nil {
+		t.Error("ValidateToken() of a refresh-type JWT error = nil, want an error")
+	}
+}
+
+func TestLogout(t *testing.T) {
+	at := newAuthTest(t)
+	first := at.login(t, "curl/8.0")
+	second := at.login(t, "curl/8.0")
+
+	// Logging out ends the session the token belongs to
+	claims, err := at.auth.ValidateToken(first.AccessToken)
+	if err != nil {
+		t.Fatalf("ValidateToken() error = %v", err)
+	}
+	if err := at.auth.Logout(claims); err != nil {
+		t.Fatalf("Logout() error = %v", err)
+	}
+	at.checkRevoked(t, first.AccessToken)
+	if _, err := at.auth.RefreshToken(first.RefreshToken, nil); !errors.Is(err, errInvalidRefreshToken) {
+		t.Errorf("RefreshToken() after logout error = %v, want errInvalidRefreshToken", err)
+	}
+	if _, err := at.auth.ValidateToken(second.AccessToken); err != nil {
+		t.Errorf("ValidateToken() for the other session error = %v", err)
+	}
+
+	// Logging out everywhere ends the rest
+	if err := at.auth.LogoutAll(at.user.ID); err != nil {
+		t.Fatalf("LogoutAll() error = %v", err)
+	}
+	at.checkRevoked(t, second.AccessToken)
+	if _, err := at.auth.RefreshToken(second.RefreshToken, nil); !errors.Is(err, errInvalidRefreshToken) {
+		t.Errorf("RefreshToken() after logging out everywhere error = %v, want errInvalidRefreshToken", err)
+	}
+}
+
+func TestDBTokenDenylist(t *testing.T) {
+	denylist := NewDBTokenDenylist(newTestDB(t, &models.RevokedAccessToken{}))
+	ctx := context.Background()
+
+	if err := denylist.Add(ctx, "live", time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	// Adding a token twice is harmless
+	if err := denylist.Add(ctx, "live", time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("second Add() error = %v", err)
+	}
+	if err := denylist.Add(ctx, "expired", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	for jti, want := range map[string]bool{"live": true, "expired": false, "unknown": false} {
+		if got, err := denylist.Contains(ctx, jti); err != nil || got != want {
+			t.Errorf("Contains(%s) = %v, %v, want %v", jti, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,456 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// Invoice statuses
+const (
+	InvoiceIssued = "issued"
+	InvoicePaid   = "paid"
+	InvoiceVoid   = "void"
+)
+
+// Invoice line types
+const (
+	InvoiceLineUsage    = "usage"
+	InvoiceLinePurchase = "purchase"
+	InvoiceLineRefund   = "refund"
+)
+
+// maxInvoiceNumberAttempts bounds retries when two invoices race for the same number
+const maxInvoiceNumberAttempts = 5
+
+// BillingService rolls usage and purchases up into monthly invoices
+type BillingService struct {
+	BaseService
+}
+
+// NewBillingService creates a new billing service
+func NewBillingService(db *gorm.DB, cfg *config.Config) *BillingService {
+	return &BillingService{
+		BaseService: NewBaseService(db, cfg, "billing"),
+	}
+}
+
+// billingAccount collects the lines billed to one organization, or user, in one currency
+type billingAccount struct {
+	key            string
+	organizationID *string
+	userID         *string
+	currency       string
+	lines          []models.InvoiceLine
+}
+
+// accountKey returns the key usage is billed under: the organization, or the user outside one
+func accountKey(userID string, orgID *string) (string, *string, *string) {
+	if orgID != nil && *orgID != "" {
+		return "org:" + *orgID, orgID, nil
+	}
+	return "user:" + userID, nil, &userID
+}
+
+// GenerateInvoices issues invoices for the calendar month containing period.
+// Accounts that already have an invoice for the month are skipped, so the
+// job can safely run more than once.
+func (s *BillingService) GenerateInvoices(period time.Time) ([]models.Invoice, error) {
+	period = period.UTC()
+	start := time.Date(period.Year(), period.Month(), 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 1, 0)
+	if end.After(time.Now()) {
+		return nil, errors.New("invoices can only be generated for a month that has ended")
+	}
+
+	accounts := make(map[string]*billingAccount)
+	account := func(userID string, orgID *string, currency string) *billingAccount {
+		if currency == "" {
+			currency = s.cfg.Payments.Currency
+		}
+		key, org, user := accountKey(userID, orgID)
+		if a, ok := accounts[key+"|"+currency]; ok {
+			return a
+		}
+		a := &billingAccount{key: key, organizationID: org, userID: user, currency: currency}
+		accounts[key+"|"+currency] = a
+		return a
+	}
+
+	if err := s.collectUsage(start, end, account); err != nil {
+		return nil, err
+	}
+	if err := s.collectPurchases(start, end, account); err != nil {
+		return nil, err
+	}
+
+	// Issue in a stable order so invoice numbers do not depend on map iteration
+	keys := make([]string, 0, len(accounts))
+	for key := range accounts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var invoices []models.Invoice
+	for _, key := range keys {
+		invoice, err := s.issueInvoice(accounts[key], start, end)
+		if err != nil {
+			return invoices, err
+		}
+		if invoice != nil {
+			invoices = append(invoices, *invoice)
+		}
+	}
+	return invoices, nil
+}
+
+// collectUsage adds a usage line per agent for the executions run in the period
+func (s *BillingService) collectUsage(start, end time.Time, account func(string, *string, string) *billingAccount) error {
+	var rows []struct {
+		OrganizationID *string
+		UserID         string
+		AgentID        string
+		Runs           int64
+		Cost           float64
+		Credits        int64
+	}
+	// Usage is billed to the organization, so rows without one are grouped by user
+	if err := s.db.Model(&models.Execution{}).
+		Select("organization_id, CASE WHEN organization_id IS NULL THEN user_id ELSE '' END AS user_id, agent_id, COUNT(*) AS runs, COALESCE(SUM(cost), 0) AS cost, COALESCE(SUM(credits_used), 0) AS credits").
+		Where("created_at >= ? AND created_at < ?", start, end).
+		Where("status IN ?", []string{"completed", "failed", "cancelled"}).
+		Group("organization_id, CASE WHEN organization_id IS NULL THEN user_id ELSE '' END, agent_id").
+		Scan(&rows).Error; err != nil {
+		return fmt.Errorf("failed to aggregate usage: %v", err)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	agentIDs := make([]string, 0, len(rows))
+	for _, row := range rows {
+		agentIDs = append(agentIDs, row.AgentID)
+	}
+	agents := make(map[string]models.Agent)
+	var found []models.Agent
+	if err := s.db.Select("id", "name", "currency").Where("id IN ?", agentIDs).Find(&found).Error; err != nil {
+		return err
+	}
+	for _, agent := range found {
+		agents[agent.ID] = agent
+	}
+
+	for _, row := range rows {
+		agent := agents[row.AgentID]
+		name := agent.Name
+		if name == "" {
+			name = row.AgentID
+		}
+		agentID := row.AgentID
+		amount := roundCents(row.Cost)
+		line := models.InvoiceLine{
+			Type:        InvoiceLineUsage,
+			Description: fmt.Sprintf("%s executions", name),
+			AgentID:     &agentID,
+			Quantity:    row.Runs,
+			Amount:      amount,
+			Credits:     row.Credits,
+		}
+		if row.Runs > 0 {
+			line.UnitPrice = roundCents(row.Cost / float64(row.Runs))
+		}
+		a := account(row.UserID, row.OrganizationID, agent.Currency)
+		a.lines = append(a.lines, line)
+	}
+	return nil
+}
+
+// collectPurchases adds a line per purchase completed, and per refund made, in the period
+func (s *BillingService) collectPurchases(start, end time.Time, account func(string, *string, string) *billingAccount) error {
+	var purchases []models.Purchase
+	if err := s.db.Preload("Agent").
+		Where("(completed_at >= ? AND completed_at < ?) OR (refunded_at >= ? AND refunded_at < ?)", start, end, start, end).
+		Order("completed_at").
+		Find(&purchases).Error; err != nil {
+		return fmt.Errorf("failed to load purchases: %v", err)
+	}
+
+	for _, purchase := range purchases {
+		name := purchase.AgentID
+		if purchase.Agent != nil {
+			name = purchase.Agent.Name
+		}
+		agentID := purchase.AgentID
+		purchaseID := purchase.ID
+		a := account(purchase.UserID, purchase.OrganizationID, purchase.Currency)
+
+		if purchase.CompletedAt != nil && !purchase.CompletedAt.Before(start) && purchase.CompletedAt.Before(end) {
+			quantity := int64(purchase.Quantity)
+			if quantity <= 0 {
+				quantity = 1
+			}
+			a.lines = append(a.lines, models.InvoiceLine{
+				Type:        InvoiceLinePurchase,
+				Description: fmt.Sprintf("%s (%s)", name, purchase.PricingModel),
+				AgentID:     &agentID,
+				PurchaseID:  &purchaseID,
+				Quantity:    quantity,
+				UnitPrice:   roundCents(purchase.Amount / float64(quantity)),
+				Amount:      roundCents(purchase.Amount),
+				Credits:     purchase.Credits,
+			})
+		}
+
+		if purchase.RefundedAt != nil && !purchase.RefundedAt.Before(start) && purchase.RefundedAt.Before(end) {
+			amount, credits := purchaseRefund(&purchase)
+			a.lines = append(a.lines, models.InvoiceLine{
+				Type:        InvoiceLineRefund,
+				Description: fmt.Sprintf("Refund: %s", name),
+				AgentID:     &agentID,
+				PurchaseID:  &purchaseID,
+				Quantity:    1,
+				UnitPrice:   -amount,
+				Amount:      -amount,
+				Credits:     -credits,
+			})
+		}
+	}
+	return nil
+}
+
+// purchaseRefund returns how much of a refunded purchase was given back, from its metadata
+func purchaseRefund(purchase *models.Purchase) (float64, int64) {
+	var metadata struct {
+		RefundAmount  *float64 `json:"refund_amount"`
+		RefundCredits *int64   `json:"refund_credits"`
+	}
+	if len(purchase.Metadata) > 0 {
+		json.Unmarshal(purchase.Metadata, &metadata)
+	}
+
+	switch {
+	case metadata.RefundAmount != nil:
+		credits := purchase.Credits
+		if purchase.Amount > 0 {
+			credits = int64(math.Round(float64(purchase.Credits) * *metadata.RefundAmount / purchase.Amount))
+		}
+		return roundCents(*metadata.RefundAmount), credits
+	case metadata.RefundCredits != nil && purchase.Credits > 0:
+		amount := math.Floor(purchase.Amount*float64(*metadata.RefundCredits)/float64(purchase.Credits)*100) / 100
+		return amount, *metadata.RefundCredits
+	default:
+		return roundCents(purchase.Amount), purchase.Credits
+	}
+}
+
+// issueInvoice numbers and stores the invoice for one account, unless it already exists
+func (s *BillingService) issueInvoice(account *billingAccount, start, end time.Time) (*models.Invoice, error) {
+	var existing int64
+	if err := s.db.Model(&models.Invoice{}).
+		Where("billing_account = ? AND period_start = ? AND currency = ?", account.key, start, account.currency).
+		Count(&existing).Error; err != nil {
+		return nil, err
+	}
+	if existing > 0 {
+		return nil, nil
+	}
+
+	now := time.Now()
+	invoice := &models.Invoice{
+		BillingAccount: account.key,
+		OrganizationID: account.organizationID,
+		UserID:         account.userID,
+		PeriodStart:    start,
+		PeriodEnd:      end,
+		Currency:       account.currency,
+		Status:         InvoiceIssued,
+		TaxName:        s.cfg.Billing.TaxName,
+		TaxRate:        s.cfg.Billing.TaxRate,
+		IssuedAt:       now,
+		Lines:          account.lines,
+	}
+	if s.cfg.Billing.DueDays > 0 {
+		dueAt := now.AddDate(0, 0, s.cfg.Billing.DueDays)
+		invoice.DueAt = &dueAt
+	}
+	for _, line := range account.lines {
+		invoice.Subtotal += line.Amount
+		invoice.CreditsUsed += line.Credits
+	}
+	invoice.Subtotal = roundCents(invoice.Subtotal)
+	if invoice.Subtotal > 0 {
+		invoice.TaxAmount = roundCents(invoice.Subtotal * invoice.TaxRate)
+	}
+	invoice.Total = roundCents(invoice.Subtotal + invoice.TaxAmount)
+
+	// Numbers are sequential; a concurrent job taking the same number makes the insert fail and retry
+	var err error
+	for attempt := 0; attempt < maxInvoiceNumberAttempts; attempt++ {
+		err = s.db.Transaction(func(tx *gorm.DB) error {
+			var last int64
+			if err := tx.Model(&models.Invoice{}).Select("COALESCE(MAX(sequence), 0)").Scan(&last).Error; err != nil {
+				return err
+			}
+			invoice.ID = ""
+			invoice.Sequence = last + 1
+			invoice.Number = fmt.Sprintf("%s-%06d", s.cfg.Billing.InvoicePrefix, invoice.Sequence)
+			for i := range invoice.Lines {
+				invoice.Lines[i].ID = ""
+				invoice.Lines[i].InvoiceID = ""
+			}
+			return tx.Create(invoice).Error
+		})
+		if err == nil {
+			return invoice, nil
+		}
+
+		// Another run may have issued this account's invoice in the meantime
+		if s.db.Model(&models.Invoice{}).
+			Where("billing_account = ? AND period_start = ? AND currency = ?", account.key, start, account.currency).
+			Count(&existing); existing > 0 {
+			return nil, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to issue invoice for %s: %v", account.key, err)
+}
+
+// invoiceScope limits a query to the invoices the user may see: their own,
+// and their organization's when they are one of its admins
+func invoiceScope(db *gorm.DB, user *models.User) *gorm.DB {
+	if user.OrganizationID != nil && user.Role == "admin" {
+		return db.Where("user_id = ? OR organization_id = ?", user.ID, *user.OrganizationID)
+	}
+	return db.Where("user_id = ?", user.ID)
+}
+
+// ListInvoices lists the invoices visible to the user, newest first
+func (s *BillingService) ListInvoices(user *models.User, status string, page, limit int) ([]models.Invoice, int64, error) {
+	var invoices []models.Invoice
+	var total int64
+
+	query := invoiceScope(s.db.Model(&models.Invoice{}), user)
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	offset := (page - 1) * limit
+	if err := query.Order("period_start DESC, sequence DESC").Offset(offset).Limit(limit).Find(&invoices).Error; err != nil {
+		return nil, 0, err
+	}
+	return invoices, total, nil
+}
+
+// GetInvoice returns an invoice and its lines if the user may see it
+func (s *BillingService) GetInvoice(id string, user *models.User) (*models.Invoice, error) {
+	var invoice models.Invoice
+	if err := invoiceScope(s.db.Preload("Lines", func(db *gorm.DB) *gorm.DB { return db.Order("created_at") }).
+		Preload("Organization").Preload("User"), user).
+		First(&invoice, "id = ?", id).Error; err != nil {
+		return nil, errors.New("invoice not found")
+	}
+	return &invoice, nil
+}
+
+// Invoice download formats
+const (
+	InvoiceFormatJSON = "json"
+	InvoiceFormatCSV  = "csv"
+	InvoiceFormatPDF  = "pdf"
+)
+
+// RenderInvoice renders an invoice for download, returning the file and its content type
+func (s *BillingService) RenderInvoice(invoice *models.Invoice, format string) ([]byte, string, error) {
+	switch strings.ToLower(format) {
+	case "", InvoiceFormatJSON:
+		data, err := json.MarshalIndent(invoice, "", "  ")
+		return data, "application/json", err
+	case InvoiceFormatCSV:
+		data, err := renderInvoiceCSV(invoice)
+		return data, "text/csv", err
+	case InvoiceFormatPDF:
+		return renderInvoicePDF(invoice, s.cfg.Billing), "application/pdf", nil
+	default:
+		return nil, "", fmt.Errorf("unsupported invoice format: %s", format)
+	}
+}
+
+// roundCents rounds an amount to two decimal places
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// BillingJob issues last month's invoices on a schedule. Every instance may
+// run it: invoices already issued for an account and month are skipped.
+type BillingJob struct {
+	billing  *BillingService
+	interval time.Duration
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewBillingJob creates a job that bills on the configured interval
+func NewBillingJob(billing *BillingService, cfg *config.Config) *BillingJob {
+	interval := time.Duration(cfg.Billing.JobIntervalMinutes) * time.Minute
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	return &BillingJob{billing: billing, interval: interval}
+}
+
+// Start runs the job now and then on every interval
+func (j *BillingJob) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	j.cancel = cancel
+
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+
+		ticker := time.NewTicker(j.interval)
+		defer ticker.Stop()
+		for {
+			j.run()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop waits for a run in progress and stops the job
+func (j *BillingJob) Stop() {
+	if j.cancel == nil {
+		return
+	}
+	j.cancel()
+	j.wg.Wait()
+}
+
+// run invoices the month before the current one
+func (j *BillingJob) run() {
+	lastMonth := currentPeriodStart().AddDate(0, -1, 0)
+	invoices, err := j.billing.GenerateInvoices(lastMonth)
+	if err != nil {
+		fmt.Printf("Failed to generate invoices for %s: %v\n", lastMonth.Format("2006-01"), err)
+	}
+	if len(invoices) > 0 {
+		fmt.Printf("Issued %d invoice(s) for %s\n", len(invoices), lastMonth.Format("2006-01"))
+	}
+}
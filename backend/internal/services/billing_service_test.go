@@ -0,0 +1,317 @@
+package services
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// billingTest holds a billing service taxing at 20%, a user billed on their
+// own and an organization admin whose usage is billed to the organization
+type billingTest struct {
+	billing *BillingService
+	org     *models.Organization
+	user    *models.User
+	admin   *models.User
+	agent   *models.Agent
+	month   time.Time
+}
+
+func newBillingTest(t *testing.T) *billingTest {
+	t.Helper()
+	t.Setenv("BILLING_TAX_NAME", "VAT")
+	t.Setenv("BILLING_TAX_RATE", "0.2")
+	t.Setenv("BILLING_INVOICE_PREFIX", "INV")
+
+	db := newTestDB(t, &models.Organization{}, &models.User{}, &models.Agent{}, &models.Execution{},
+		&models.Purchase{}, &models.Invoice{}, &models.InvoiceLine{})
+	org := &models.Organization{Name: "Acme (EU)", Slug: "acme"}
+	if err := db.Create(org).Error; err != nil {
+		t.Fatal(err)
+	}
+	user := &models.User{Email: "ann@example.com", Username: "ann", PasswordHash: "x", FirstName: "Ann", LastName: "Lee"}
+	admin := &models.User{Email: "bob@example.com", Username: "bob", PasswordHash: "x", Role: "admin", OrganizationID: &org.ID}
+	for _, u := range []*models.User{user, admin} {
+		if err := db.Create(u).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	agent := &models.Agent{Name: "Helper", Slug: "helper", CreatorID: admin.ID, Currency: "USD"}
+	if err := db.Create(agent).Error; err != nil {
+		t.Fatal(err)
+	}
+	return &billingTest{billing: NewBillingService(db, config.Load()), org: org, user: user, admin: admin, agent: agent,
+		month: currentPeriodStart().AddDate(0, -1, 0)}
+}
+
+// run stores an execution of the agent by the user at the given time
+func (bt *billingTest) run(t *testing.T, user *models.User, status string, cost float64, at time.Time) {
+	t.Helper()
+	execution := &models.Execution{AgentID: bt.agent.ID, UserID: user.ID, OrganizationID: user.OrganizationID,
+		Status: status, Cost: cost, CreditsUsed: int64(cost * 100)}
+	execution.CreatedAt = at
+	if err := bt.billing.db.Create(execution).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// invoices issues last month's invoices, failing the test on an error
+func (bt *billingTest) invoices(t *testing.T) []models.Invoice {
+	t.Helper()
+	invoices, err := bt.billing.GenerateInvoices(bt.month)
+	if err != nil {
+		t.Fatalf("GenerateInvoices() error = %v", err)
+	}
+	return invoices
+}
+
+func TestGenerateInvoices(t *testing.T) {
+	bt := newBillingTest(t)
+	day := func(d int) time.Time { return bt.month.AddDate(0, 0, d) }
+
+	// Finished runs in the month are billed; runs in progress or in another month are not
+	for i := 0; i < 3; i++ {
+		bt.run(t, bt.user, "completed", 1.5, day(i))
+	}
+	bt.run(t, bt.user, "running", 1.5, day(3))
+	bt.run(t, bt.user, "completed", 1.5, currentPeriodStart())
+	bt.run(t, bt.admin, "failed", 2, day(4))
+	bt.run(t, bt.admin, "completed", 2, day(5))
+
+	// A purchase made in the month, and another refunded in it after an earlier month
+	completed, earlier, refunded := day(6), bt.month.AddDate(0, -1, 0), day(7)
+	purchases := []*models.Purchase{
+		{UserID: bt.user.ID, AgentID: bt.agent.ID, PricingModel: PricingOneTime, Amount: 10, Credits: 1000,
+			Status: "completed", CompletedAt: &completed},
+		{UserID: bt.user.ID, AgentID: bt.agent.ID, PricingModel: PricingSubscription, Amount: 10, Credits: 1000,
+			Status: "refunded", CompletedAt: &earlier, RefundedAt: &refunded, Metadata: models.JSON(`{"refund_amount": 4}`)},
+	}
+	for _, p := range purchases {
+		if err := bt.billing.db.Create(p).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	invoices := bt.invoices(t)
+	if len(invoices) != 2 {
+		t.Fatalf("GenerateInvoices() issued %d invoices, want 2", len(invoices))
+	}
+	org, own := invoices[0], invoices[1]
+
+	if org.Number != "INV-000001" || org.OrganizationID == nil || *org.OrganizationID != bt.org.ID || org.UserID != nil {
+		t.Errorf("first invoice = %s for %v/%v, want INV-000001 for the organization", org.Number, org.OrganizationID, org.UserID)
+	}
+	if org.Subtotal != 4 || org.TaxAmount != 0.8 || org.Total != 4.8 || org.CreditsUsed != 400 {
+		t.Errorf("organization invoice = %v + %v = %v, %d credits, want 4 + 0.8 = 4.8, 400 credits",
+			org.Subtotal, org.TaxAmount, org.Total, org.CreditsUsed)
+	}
+
+	if own.Number != "INV-000002" || own.UserID == nil || *own.UserID != bt.user.ID {
+		t.Errorf("second invoice = %s for %v, want INV-000002 for the user", own.Number, own.UserID)
+	}
+	want := []struct {
+		kind     string
+		quantity int64
+		unit     float64
+		amount   float64
+		credits  int64
+	}{
+		{kind: InvoiceLineUsage, quantity: 3, unit: 1.5, amount: 4.5, credits: 450},
+		// Purchase lines follow the order the purchases were made in
+		{kind: InvoiceLineRefund, quantity: 1, unit: -4, amount: -4, credits: -400},
+		{kind: InvoiceLinePurchase, quantity: 1, unit: 10, amount: 10, credits: 1000},
+	}
+	if len(own.Lines) != len(want) {
+		t.Fatalf("user invoice has %d lines, want %d", len(own.Lines), len(want))
+	}
+	for i, w := range want {
+		line := own.Lines[i]
+		if line.Type != w.kind || line.Quantity != w.quantity || line.UnitPrice != w.unit || line.Amount != w.amount || line.Credits != w.credits {
+			t.Errorf("line %d = %s %d x %v = %v, %d credits, want %s %d x %v = %v, %d credits", i,
+				line.Type, line.Quantity, line.UnitPrice, line.Amount, line.Credits, w.kind, w.quantity, w.unit, w.amount, w.credits)
+		}
+	}
+	if own.Subtotal != 10.5 || own.TaxAmount != 2.1 || own.Total != 12.6 {
+		t.Errorf("user invoice = %v + %v = %v, want 10.5 + 2.1 = 12.6", own.Subtotal, own.TaxAmount, own.Total)
+	}
+	if own.DueAt == nil || own.DueAt.Sub(own.IssuedAt) != 30*24*time.Hour {
+		t.Errorf("invoice due %v after issue at %v, want 30 days", own.DueAt, own.IssuedAt)
+	}
+
+	// Running the job again issues nothing new
+	if again := bt.invoices(t); len(again) != 0 {
+		t.Errorf("second GenerateInvoices() issued %d invoices, want none", len(again))
+	}
+	if _, err := bt.billing.GenerateInvoices(time.Now()); err == nil {
+		t.Error("GenerateInvoices() for the current month error = nil, want an error")
+	}
+}
+
+func TestGenerateInvoicesRefundOnly(t *testing.T) {
+	bt := newBillingTest(t)
+	earlier, refunded := bt.month.AddDate(0, -1, 0), bt.month.AddDate(0, 0, 1)
+	purchase := &models.Purchase{UserID: bt.user.ID, AgentID: bt.agent.ID, PricingModel: PricingUsageBased, Amount: 10,
+		Credits: 1000, Status: "refunded", CompletedAt: &earlier, RefundedAt: &refunded}
+	if err := bt.billing.db.Create(purchase).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// A credit note carries no tax
+	invoices := bt.invoices(t)
+	if len(invoices) != 1 || invoices[0].Subtotal != -10 || invoices[0].TaxAmount != 0 || invoices[0].Total != -10 {
+		t.Fatalf("GenerateInvoices() = %+v, want one invoice of -10 without tax", invoices)
+	}
+}
+
+func TestPurchaseRefund(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata string
+		amount   float64
+		credits  int64
+	}{
+		{name: "whole purchase", amount: 10, credits: 1000},
+		{name: "refund amount", metadata: `{"refund_amount": 2.5}`, amount: 2.5, credits: 250},
+		// Partial credit refunds round the amount down to the cent
+		{name: "refund credits", metadata: `{"refund_credits": 333}`, amount: 3.33, credits: 333},
+	}
+
+	for _, tt := range tests {
+		amount, credits := purchaseRefund(&models.Purchase{Amount: 10, Credits: 1000, Metadata: models.JSON(tt.metadata)})
+		if amount != tt.amount || credits != tt.credits {
+			t.Errorf("purchaseRefund(%s) = %v, %d, want %v, %d", tt.name, amount, credits, tt.amount, tt.credits)
+		}
+	}
+}
+
+func TestInvoiceVisibility(t *testing.T) {
+	bt := newBillingTest(t)
+	bt.run(t, bt.user, "completed", 1, bt.month)
+	bt.run(t, bt.admin, "completed", 1, bt.month)
+	invoices := bt.invoices(t)
+	orgInvoice, userInvoice := invoices[0], invoices[1]
+	member := &models.User{BaseModel: models.BaseModel{ID: "member-1"}, Role: "user", OrganizationID: &bt.org.ID}
+
+	tests := []struct {
+		name string
+		user *models.User
+		want []string
+	}{
+		{name: "user", user: bt.user, want: []string{userInvoice.ID}},
+		{name: "organization admin", user: bt.admin, want: []string{orgInvoice.ID}},
+		{name: "organization member", user: member},
+	}
+
+	for _, tt := range tests {
+		list, total, err := bt.billing.ListInvoices(tt.user, "", 1, 20)
+		if err != nil {
+			t.Fatalf("ListInvoices(%s) error = %v", tt.name, err)
+		}
+		var got []string
+		for _, invoice := range list {
+			got = append(got, invoice.ID)
+		}
+		if total != int64(len(tt.want)) || strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("ListInvoices(%s) = %v of %d, want %v", tt.name, got, total, tt.want)
+		}
+	}
+
+	if _, err := bt.billing.GetInvoice(orgInvoice.ID, bt.user); err == nil {
+		t.Error("GetInvoice() of another account's invoice error = nil, want an error")
+	}
+	invoice, err := bt.billing.GetInvoice(orgInvoice.ID, bt.admin)
+	if err != nil || len(invoice.Lines) != 1 || invoice.Organization == nil {
+		t.Errorf("GetInvoice() = %v, want the invoice with its lines and organization", err)
+	}
+	if list, _, _ := bt.billing.ListInvoices(bt.user, InvoicePaid, 1, 20); len(list) != 0 {
+		t.Errorf("ListInvoices(paid) = %d invoices, want none", len(list))
+	}
+}
+
+func TestRenderInvoice(t *testing.T) {
+	bt := newBillingTest(t)
+	for i := 0; i < 3; i++ {
+		bt.run(t, bt.user, "completed", 1.5, bt.month)
+	}
+	issued := bt.invoices(t)
+	invoice, err := bt.billing.GetInvoice(issued[0].ID, bt.user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, contentType, err := bt.billing.RenderInvoice(invoice, "JSON")
+	var decoded models.Invoice
+	if err != nil || contentType != "application/json" || json.Unmarshal(data, &decoded) != nil || decoded.Number != invoice.Number {
+		t.Errorf("RenderInvoice(json) = %s, %v, want the invoice as JSON", contentType, err)
+	}
+
+	// One row per line, then the totals
+	data, contentType, err = bt.billing.RenderInvoice(invoice, InvoiceFormatCSV)
+	if err != nil || contentType != "text/csv" {
+		t.Fatalf("RenderInvoice(csv) = %s, %v", contentType, err)
+	}
+	rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil || len(rows) != 5 {
+		t.Fatalf("CSV has %d rows, %v, want a header, one line and three totals", len(rows), err)
+	}
+	if line := rows[1]; line[3] != InvoiceLineUsage || line[7] != "3" || line[8] != "1.50" || line[9] != "4.50" {
+		t.Errorf("CSV line = %v, want 3 runs at 1.50 for 4.50", line)
+	}
+	if tax := rows[3]; tax[4] != "VAT (20%)" || tax[9] != "0.90" {
+		t.Errorf("CSV tax row = %v, want VAT (20%%) of 0.90", tax)
+	}
+
+	data, contentType, err = bt.billing.RenderInvoice(invoice, InvoiceFormatPDF)
+	if err != nil || contentType != "application/pdf" || !bytes.HasPrefix(data, []byte("%PDF-1.4")) || !bytes.HasSuffix(data, []byte("%%EOF\n")) {
+		t.Fatalf("RenderInvoice(pdf) = %s, %v, want a PDF document", contentType, err)
+	}
+	for _, want := range []string{"(INVOICE INV-000001)", "(Ann Lee <ann@example.com>)", "(Total USD)", "(5.40)", "/Count 1"} {
+		if !bytes.Contains(data, []byte(want)) {
+			t.Errorf("PDF lacks %s", want)
+		}
+	}
+
+	if _, _, err := bt.billing.RenderInvoice(invoice, "xlsx"); err == nil {
+		t.Error("RenderInvoice(xlsx) error = nil, want an error")
+	}
+}
+
+func TestRenderInvoicePDFPages(t *testing.T) {
+	invoice := &models.Invoice{Number: "INV-000007", Organization: &models.Organization{Name: "Acme (EU) \\ Ltd"}}
+	for i := 0; i < 80; i++ {
+		invoice.Lines = append(invoice.Lines, models.InvoiceLine{Description: fmt.Sprintf("Agent %d", i)})
+	}
+	data := renderInvoicePDF(invoice, config.BillingConfig{CompanyName: "vagais"})
+
+	// Lines that do not fit on a page continue on the next
+	if !bytes.Contains(data, []byte("/Count 2")) || !bytes.Contains(data, []byte("(Agent 79)")) {
+		t.Error("PDF of 80 lines is not two pages with every line")
+	}
+	if !bytes.Contains(data, []byte(`(Acme \(EU\) \\ Ltd)`)) {
+		t.Error("PDF text is not escaped")
+	}
+}
+
+func TestPDFEscape(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{text: "plain", want: "plain"},
+		{text: `a (b) \c`, want: `a \(b\) \\c`},
+		{text: "café\n", want: "caf??"},
+	}
+
+	for _, tt := range tests {
+		if got := pdfEscape(tt.text); got != tt.want {
+			t.Errorf("pdfEscape(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
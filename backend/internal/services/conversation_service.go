@@ -0,0 +1,277 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// ConversationService handles persisted chat conversations
+type ConversationService struct {
+	BaseService
+}
+
+// NewConversationService creates a new conversation service
+func NewConversationService(db *gorm.DB, cfg *config.Config) *ConversationService {
+	return &ConversationService{
+		BaseService: NewBaseService(db, cfg, "conversation"),
+	}
+}
+
+// CreateConversationRequest represents conversation creation request
+type CreateConversationRequest struct {
+	AgentID string `json:"agent_id" binding:"required"`
+	Title   string `json:"title"`
+}
+
+// RenameConversationRequest represents conversation rename request
+type RenameConversationRequest struct {
+	Title string `json:"title" binding:"required"`
+}
+
+// defaultContextWindows maps model name prefixes to their context window in tokens.
+// Longer prefixes are listed first so that the most specific entry wins.
+var defaultContextWindows = []struct {
+	prefix string
+	tokens int
+}{
+	{"gpt-4o", 128000},
+	{"gpt-4-turbo", 128000},
+	{"gpt-4.1", 1000000},
+	{"gpt-4-32k", 32768},
+	{"gpt-4", 8192},
+	{"gpt-3.5-turbo", 16385},
+	{"claude", 200000},
+}
+
+// fallbackContextWindow is used for models not listed above
+const fallbackContextWindow = 8192
+
+// CreateConversation starts a new conversation with an agent
+func (s *ConversationService) CreateConversation(req *CreateConversationRequest, userID string) (*models.Conversation, error) {
+	var agent models.Agent
+	if err := s.db.First(&agent, "id = ?", req.AgentID).Error; err != nil {
+		return nil, errors.New("agent not found")
+	}
+
+	title := strings.TrimSpace(req.Title)
+	if title == "" {
+		title = "New conversation"
+	}
+
+	conversation := &models.Conversation{
+		UserID:  userID,
+		AgentID: req.AgentID,
+		Title:   title,
+	}
+	if err := s.db.Create(conversation).Error; err != nil {
+		return nil, err
+	}
+	return conversation, nil
+}
+
+// GetConversation retrieves a conversation owned by the user, with its messages
+func (s *ConversationService) GetConversation(id string, userID string) (*models.Conversation, error) {
+	var conversation models.Conversation
+	if err := s.db.Preload("Messages", func(db *gorm.DB) *gorm.DB {
+		return db.Order("created_at ASC")
+	}).First(&conversation, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+
+	if conversation.UserID != userID {
+		return nil, errors.New("unauthorized to access this conversation")
+	}
+	return &conversation, nil
+}
+
+// ListConversations retrieves a user's conversations with pagination
+func (s *ConversationService) ListConversations(userID string, agentID string, page, limit int) ([]models.Conversation, int64, error) {
+	var conversations []models.Conversation
+	var total int64
+
+	query := s.db.Model(&models.Conversation{}).Where("user_id = ?", userID)
+	if agentID != "" {
+		query = query.Where("agent_id = ?", agentID)
+	}
+
+	// Get total count
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	// Apply pagination
+	offset := (page - 1) * limit
+	if err := query.Offset(offset).Limit(limit).Order("updated_at DESC").Find(&conversations).Error; err != nil {
+		return nil, 0, err
+	}
+
+	return conversations, total, nil
+}
+
+// RenameConversation changes the title of a conversation
+func (s *ConversationService) RenameConversation(id string, req *RenameConversationRequest, userID string) (*models.Conversation, error) {
+	var conversation models.Conversation
+	if err := s.db.First(&conversation, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+
+	// Check if user owns this conversation
+	if conversation.UserID != userID {
+		return nil, errors.New("unauthorized to update this conversation")
+	}
+
+	if err := s.db.Model(&conversation).Update("title", strings.TrimSpace(req.Title)).Error; err != nil {
+		return nil, err
+	}
+	return &conversation, nil
+}
+
+// DeleteConversation deletes a conversation and its messages
+func (s *ConversationService) DeleteConversation(id string, userID string) error {
+	var conversation models.Conversation
+	if err := s.db.First(&conversation, "id = ?", id).Error; err != nil {
+		return err
+	}
+
+	// Check if user owns this conversation
+	if conversation.UserID != userID {
+		return errors.New("unauthorized to delete this conversation")
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("conversation_id = ?", id).Delete(&models.Message{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&conversation).Error
+	})
+}
+
+// ResumeConversation loads a conversation for continuing a chat with the given agent
+func (s *ConversationService) ResumeConversation(id string, userID string, agentID string) (*models.Conversation, error) {
+	conversation, err := s.GetConversation(id, userID)
+	if err != nil {
+		return nil, err
+	}
+	if conversation.AgentID != agentID {
+		return nil, errors.New("conversation belongs to a different agent")
+	}
+	return conversation, nil
+}
+
+// StartConversation creates a conversation titled after the first user message
+func (s *ConversationService) StartConversation(userID string, agentID string, firstMessage string) (*models.Conversation, error) {
+	title := strings.Join(strings.Fields(firstMessage), " ")
+	if utf8.RuneCountInString(title) > 60 {
+		title = string([]rune(title)[:60]) + "..."
+	}
+
+	return s.CreateConversation(&CreateConversationRequest{
+		AgentID: agentID,
+		Title:   title,
+	}, userID)
+}
+
+// AppendMessage stores a turn and bumps the conversation counters
+func (s *ConversationService) AppendMessage(conversationID string, message *models.Message) error {
+	message.ConversationID = conversationID
+	if message.Metadata == nil {
+		message.Metadata = models.MapToJSON(nil)
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(message).Error; err != nil {
+			return err
+		}
+		now := time.Now()
+		return tx.Model(&models.Conversation{}).Where("id = ?", conversationID).Updates(map[string]interface{}{
+			"message_count":   gorm.Expr("message_count + ?", 1),
+			"last_message_at": now,
+			"updated_at":      now,
+		}).Error
+	})
+}
+
+// GetHistory retrieves the messages of a conversation in chronological order
+func (s *ConversationService) GetHistory(conversationID string) ([]models.Message, error) {
+	var messages []models.Message
+	if err := s.db.Where("conversation_id = ?", conversationID).
+		Order("created_at ASC").Find(&messages).Error; err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// BuildContext returns the history plus the new user message, dropping the
+// oldest turns so that the prompt fits in the agent model's context window
+func (s *ConversationService) BuildContext(agent *models.Agent, history []models.Message, newMessage string) []ChatMessage {
+	runtimeCfg := ParseAgentRuntimeConfig(agent)
+
+	maxOutput := runtimeCfg.MaxTokens
+	if maxOutput <= 0 {
+		maxOutput = s.cfg.LLM.DefaultMaxTokens
+	}
+	window := runtimeCfg.ContextWindow
+	if window <= 0 {
+		window = ContextWindowFor(agent.LLMModel)
+	}
+
+	budget := window - maxOutput - estimateTokens(runtimeCfg.SystemPrompt)
+	latest := ChatMessage{Role: "user", Content: newMessage}
+	budget -= estimateMessageTokens(latest)
+
+	// Walk backwards from the newest turn and keep whatever still fits
+	kept := make([]ChatMessage, 0, len(history)+1)
+	for i := len(history) - 1; i >= 0; i-- {
+		m := history[i]
+		if m.Role != "user" && m.Role != "assistant" {
+			continue
+		}
+		msg := ChatMessage{Role: m.Role, Content: m.Content}
+		cost := estimateMessageTokens(msg)
+		if cost > budget {
+			break
+		}
+		budget -= cost
+		kept = append(kept, msg)
+	}
+
+	// Reverse back into chronological order
+	for i, j := 0, len(kept)-1; i < j; i, j = i+1, j-1 {
+		kept[i], kept[j] = kept[j], kept[i]
+	}
+
+	// Providers expect the conversation to open with a user turn
+	for len(kept) > 0 && kept[0].Role != "user" {
+		kept = kept[1:]
+	}
+
+	return append(kept, latest)
+}
+
+// ContextWindowFor returns the context window size of a model in tokens
+func ContextWindowFor(model string) int {
+	name := strings.ToLower(model)
+	for _, entry := range defaultContextWindows {
+		if strings.HasPrefix(name, entry.prefix) {
+			return entry.tokens
+		}
+	}
+	return fallbackContextWindow
+}
+
+// estimateTokens approximates the token count of a text at four characters per token
+func estimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+// estimateMessageTokens approximates a message's tokens including role overhead
+func estimateMessageTokens(m ChatMessage) int {
+	return estimateTokens(m.Content) + 4
+}
@@ -0,0 +1,383 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// ErrInsufficientCredits is returned when a user's balance cannot cover a charge
+var ErrInsufficientCredits = errors.New("insufficient credits")
+
+// Credit transaction types
+const (
+	CreditTypeGrant         = "grant"
+	CreditTypePurchase      = "purchase"
+	CreditTypeReserve       = "reserve"
+	CreditTypeSettle        = "settle"
+	CreditTypeRefund        = "refund"
+	CreditTypeAdjustment    = "adjustment"
+	CreditTypeAgentPurchase = "agent_purchase"
+	CreditTypeAllocation    = "allocation"
+)
+
+// ModelPrice represents the price of a model in USD per million tokens
+type ModelPrice struct {
+	PromptPerMillion float64
+	OutputPerMillion float64
+}
+
+// defaultModelPrices maps model name prefixes to their price.
+// Longer prefixes are listed first so that the most specific entry wins.
+var defaultModelPrices = []struct {
+	prefix string
+	price  ModelPrice
+}{
+	{"gpt-4o-mini", ModelPrice{0.15, 0.60}},
+	{"gpt-4o", ModelPrice{2.50, 10.00}},
+	{"gpt-4.1-nano", ModelPrice{0.10, 0.40}},
+	{"gpt-4.1-mini", ModelPrice{0.40, 1.60}},
+	{"gpt-4.1", ModelPrice{2.00, 8.00}},
+	{"gpt-4-turbo", ModelPrice{10.00, 30.00}},
+	{"gpt-4", ModelPrice{30.00, 60.00}},
+	{"gpt-3.5-turbo", ModelPrice{0.50, 1.50}},
+	{"claude-3-haiku", ModelPrice{0.25, 1.25}},
+	{"claude-3-5-haiku", ModelPrice{0.80, 4.00}},
+	{"claude-3-opus", ModelPrice{15.00, 75.00}},
+	{"claude-opus", ModelPrice{15.00, 75.00}},
+	{"claude", ModelPrice{3.00, 15.00}},
+}
+
+// fallbackModelPrice is used for models not listed above
+var fallbackModelPrice = ModelPrice{PromptPerMillion: 1.00, OutputPerMillion: 3.00}
+
+// ModelPriceFor returns the token price of a model
+func ModelPriceFor(model string) ModelPrice {
+	name := strings.ToLower(model)
+	for _, entry := range defaultModelPrices {
+		if strings.HasPrefix(name, entry.prefix) {
+			return entry.price
+		}
+	}
+	return fallbackModelPrice
+}
+
+// Cost returns the USD cost of a request with the given token counts
+func (p ModelPrice) Cost(promptTokens, outputTokens int64) float64 {
+	return (float64(promptTokens)*p.PromptPerMillion + float64(outputTokens)*p.OutputPerMillion) / 1e6
+}
+
+// CreditService keeps the credit ledger and meters executions against it
+type CreditService struct {
+	BaseService
+}
+
+// NewCreditService creates a new credit service
+func NewCreditService(db *gorm.DB, cfg *config.Config) *CreditService {
+	return &CreditService{
+		BaseService: NewBaseService(db, cfg, "credit"),
+	}
+}
+
+// CreditBalance represents a user's credit position
+type CreditBalance struct {
+	TotalCredits      int64   `json:"total_credits"`
+	UsedCredits       int64   `json:"used_credits"`
+	RemainingCredits  int64   `json:"remaining_credits"`
+	ReservedCredits   int64   `json:"reserved_credits"`
+	ExpiresAt         *string `json:"expires_at"`
+	MonthlyAllocation *int64  `json:"monthly_allocation"`
+}
+
+// GetBalance returns the user's credit balance and how much has been used
+func (s *CreditService) GetBalance(userID string) (*CreditBalance, error) {
+	var user models.User
+	if err := s.db.Select("id", "credits").First(&user, "id = ?", userID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+
+	// Reservations not yet settled are held back from the balance but not used
+	var reserved int64
+	if err := s.db.Model(&models.CreditTransaction{}).
+		Where("user_id = ? AND type = ?", userID, CreditTypeReserve).
+		Where("execution_id NOT IN (?)", s.db.Model(&models.CreditTransaction{}).
+			Select("execution_id").Where("type = ? AND execution_id IS NOT NULL", CreditTypeSettle)).
+		Select("COALESCE(SUM(-amount), 0)").Scan(&reserved).Error; err != nil {
+		return nil, err
+	}
+
+	var metered int64
+	if err := s.db.Model(&models.CreditTransaction{}).
+		Where("user_id = ? AND type IN ?", userID, []string{CreditTypeReserve, CreditTypeSettle}).
+		Select("COALESCE(SUM(-amount), 0)").Scan(&metered).Error; err != nil {
+		return nil, err
+	}
+	used := metered - reserved
+
+	return &CreditBalance{
+		TotalCredits:     user.Credits + reserved + used,
+		UsedCredits:      used,
+		RemainingCredits: user.Credits,
+		ReservedCredits:  reserved,
+	}, nil
+}
+
+// ListTransactions returns the user's ledger, newest first
+func (s *CreditService) ListTransactions(userID string, txType string, page, limit int) ([]models.CreditTransaction, int64, error) {
+	var transactions []models.CreditTransaction
+	var total int64
+
+	query := s.db.Model(&models.CreditTransaction{}).Where("user_id = ?", userID)
+	if txType != "" {
+		query = query.Where("type = ?", txType)
+	}
+
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	offset := (page - 1) * limit
+	if err := query.Order("created_at DESC").Offset(offset).Limit(limit).Find(&transactions).Error; err != nil {
+		return nil, 0, err
+	}
+
+	return transactions, total, nil
+}
+
+// Credit adds credits to a user's balance, e.g. a grant or a purchase
+func (s *CreditService) Credit(userID string, amount int64, txType, description string, metadata map[string]interface{}) (*models.CreditTransaction, error) {
+	if amount <= 0 {
+		return nil, errors.New("credit amount must be positive")
+	}
+
+	var entry *models.CreditTransaction
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		entry, err = s.record(tx, userID, txType, amount, nil, description, metadata, false)
+		return err
+	})
+	return entry, err
+}
+
+// Debit removes credits from a user's balance, failing if the balance is too low
+func (s *CreditService) Debit(userID string, amount int64, txType, description string, metadata map[string]interface{}) (*models.CreditTransaction, error) {
+	if amount <= 0 {
+		return nil, errors.New("debit amount must be positive")
+	}
+
+	var entry *models.CreditTransaction
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		entry, err = s.record(tx, userID, txType, -amount, nil, description, metadata, true)
+		return err
+	})
+	return entry, err
+}
+
+// CheckFunds returns ErrInsufficientCredits when the user's balance cannot cover amount
+func (s *CreditService) CheckFunds(userID string, amount int64) error {
+	var user models.User
+	if err := s.db.Select("id", "credits").First(&user, "id = ?", userID).Error; err != nil {
+		return errors.New("user not found")
+	}
+	if user.Credits < amount {
+		return ErrInsufficientCredits
+	}
+	return nil
+}
+
+// Reserve holds credits for an execution before it runs
+func (s *CreditService) Reserve(userID, executionID string, amount int64) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		_, err := s.record(tx, userID, CreditTypeReserve, -amount, &executionID,
+			"Reserved for execution", map[string]interface{}{"reserved": amount}, true)
+		return err
+	})
+}
+
+// Settle replaces an execution's reservation with its actual charge. It is
+// idempotent; an execution is settled at most once, and the ledger entry is
+// only returned by the call that settled it.
+func (s *CreditService) Settle(userID, executionID string, actual int64, metadata map[string]interface{}) (*models.CreditTransaction, error) {
+	var entry *models.CreditTransaction
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// Locking the user row first makes concurrent settles of the execution
+		// wait for each other, so the check below sees the one that went first.
+		// The unique index on the ledger backs this up.
+		if err := tx.Model(&models.User{}).Where("id = ?", userID).
+			UpdateColumn("credits", gorm.Expr("credits")).Error; err != nil {
+			return err
+		}
+
+		var settled int64
+		if err := tx.Model(&models.CreditTransaction{}).
+			Where("execution_id = ? AND type = ?", executionID, CreditTypeSettle).
+			Count(&settled).Error; err != nil {
+			return err
+		}
+		if settled > 0 {
+			return nil
+		}
+
+		var reserved int64
+		if err := tx.Model(&models.CreditTransaction{}).
+			Where("execution_id = ? AND type = ?", executionID, CreditTypeReserve).
+			Select("COALESCE(SUM(-amount), 0)").Scan(&reserved).Error; err != nil {
+			return err
+		}
+
+		if metadata == nil {
+			metadata = map[string]interface{}{}
+		}
+		metadata["reserved"] = reserved
+		metadata["charged"] = actual
+
+		description := fmt.Sprintf("Execution charged %d credits", actual)
+		if actual == 0 {
+			description = "Execution reservation released"
+		}
+
+		// Usage beyond the reservation is charged even if it overdraws the balance
+		var err error
+		entry, err = s.record(tx, userID, CreditTypeSettle, reserved-actual, &executionID, description, metadata, false)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Release returns an execution's reservation without charging it
+func (s *CreditService) Release(userID, executionID string, reason string) error {
+	_, err := s.Settle(userID, executionID, 0, map[string]interface{}{"reason": reason})
+	return err
+}
+
+// PaidCredits returns how many of the credits charged by a settlement were
+// bought rather than granted. Granted credits, such as the sign-up bonus, are
+// spent first, and a charge that took the balance below zero was not paid for.
+func (s *CreditService) PaidCredits(settlement *models.CreditTransaction, charged int64) (int64, error) {
+	var bought int64
+	if err := s.db.Model(&models.CreditTransaction{}).
+		Where("user_id = ? AND type IN ?", settlement.UserID, []string{CreditTypePurchase, CreditTypeAllocation}).
+		Select("COALESCE(SUM(amount), 0)").Scan(&bought).Error; err != nil {
+		return 0, err
+	}
+
+	// The bought credits left are whatever part of the balance they can cover
+	paidPart := func(balance int64) int64 {
+		return max(0, min(balance, bought))
+	}
+	return paidPart(settlement.Balance+charged) - paidPart(settlement.Balance), nil
+}
+
+// record applies amount to the user's balance and appends the ledger entry.
+// When requireFunds is set a debit fails rather than take the balance below zero.
+func (s *CreditService) record(tx *gorm.DB, userID, txType string, amount int64, executionID *string, description string, metadata map[string]interface{}, requireFunds bool) (*models.CreditTransaction, error) {
+	// The conditional update locks the user row until the transaction ends,
+	// so the balance read below is the one this entry produced
+	query := tx.Model(&models.User{}).Where("id = ?", userID)
+	if requireFunds && amount < 0 {
+		query = query.Where("credits >= ?", -amount)
+	}
+	result := query.UpdateColumn("credits", gorm.Expr("credits + ?", amount))
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		var count int64
+		tx.Model(&models.User{}).Where("id = ?", userID).Count(&count)
+		if count == 0 {
+			return nil, errors.New("user not found")
+		}
+		return nil, ErrInsufficientCredits
+	}
+
+	var user models.User
+	if err := tx.Select("id", "credits").First(&user, "id = ?", userID).Error; err != nil {
+		return nil, err
+	}
+
+	entry := &models.CreditTransaction{
+		UserID:      userID,
+		Type:        txType,
+		Amount:      amount,
+		Balance:     user.Credits,
+		ExecutionID: executionID,
+		Description: description,
+		Metadata:    models.MapToJSON(metadata),
+	}
+	if err := tx.Create(entry).Error; err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// EstimateExecutionCredits returns how many credits to reserve for running the agent on input
+func (s *CreditService) EstimateExecutionCredits(agent *models.Agent, input map[string]interface{}) int64 {
+	runtimeCfg := ParseAgentRuntimeConfig(agent)
+	if IsScriptAgent(agent) {
+		return s.applyMinimum(runtimeCfg.CreditsPerUse)
+	}
+
+	payload, _ := json.Marshal(input)
+	promptTokens := int64(estimateTokens(string(payload)) + estimateTokens(runtimeCfg.SystemPrompt))
+	outputTokens := int64(runtimeCfg.MaxTokens)
+	if outputTokens <= 0 {
+		outputTokens = int64(s.cfg.LLM.DefaultMaxTokens)
+	}
+
+	cost := ModelPriceFor(agent.LLMModel).Cost(promptTokens, outputTokens)
+	return s.applyMinimum(s.creditsForCost(cost) + runtimeCfg.CreditsPerUse)
+}
+
+// ExecutionCharge returns the USD cost and the credits charged for a finished execution
+func (s *CreditService) ExecutionCharge(agent *models.Agent, result *ExecutionResult) (float64, int64) {
+	runtimeCfg := ParseAgentRuntimeConfig(agent)
+	var cost float64
+	if result.Model != "" || result.TotalTokens > 0 {
+		model := result.Model
+		if model == "" {
+			model = agent.LLMModel
+		}
+		cost = ModelPriceFor(model).Cost(result.PromptTokens, result.OutputTokens)
+	}
+	return cost, s.applyMinimum(s.creditsForCost(cost) + runtimeCfg.CreditsPerUse)
+}
+
+// UsageCharge returns the USD cost and the credits charged for the tokens a
+// failed execution used; the agent's fee and the minimum charge do not apply
+func (s *CreditService) UsageCharge(agent *models.Agent, result *ExecutionResult) (float64, int64) {
+	if result == nil || result.TotalTokens == 0 {
+		return 0, 0
+	}
+	model := result.Model
+	if model == "" {
+		model = agent.LLMModel
+	}
+	cost := ModelPriceFor(model).Cost(result.PromptTokens, result.OutputTokens)
+	return cost, s.creditsForCost(cost)
+}
+
+// creditsForCost converts a USD cost into credits, rounding up
+func (s *CreditService) creditsForCost(cost float64) int64 {
+	if cost <= 0 {
+		return 0
+	}
+	return int64(math.Ceil(cost * float64(s.cfg.Credits.PerUSD)))
+}
+
+func (s *CreditService) applyMinimum(credits int64) int64 {
+	if credits < s.cfg.Credits.MinimumCharge {
+		return s.cfg.Credits.MinimumCharge
+	}
+	return credits
+}
@@ -0,0 +1,174 @@
+package services
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// newCreditTest returns a credit service and a user holding credits
+func newCreditTest(t *testing.T, credits int64) (*CreditService, *models.User) {
+	t.Helper()
+	db := newTestDB(t, &models.User{}, &models.CreditTransaction{})
+	user := &models.User{Email: "ann@example.com", Username: "ann", PasswordHash: "x", IsActive: true, Credits: credits}
+	if err := db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return NewCreditService(db, config.Load()), user
+}
+
+// checkBalance compares the user's balance with the remaining, reserved and used credits
+func checkBalance(t *testing.T, credits *CreditService, userID string, remaining, reserved, used int64) {
+	t.Helper()
+	balance, err := credits.GetBalance(userID)
+	if err != nil {
+		t.Fatalf("GetBalance() error = %v", err)
+	}
+	if balance.RemainingCredits != remaining || balance.ReservedCredits != reserved || balance.UsedCredits != used {
+		t.Errorf("balance = %d remaining, %d reserved, %d used, want %d, %d, %d",
+			balance.RemainingCredits, balance.ReservedCredits, balance.UsedCredits, remaining, reserved, used)
+	}
+	if balance.TotalCredits != remaining+reserved+used {
+		t.Errorf("total = %d, want %d", balance.TotalCredits, remaining+reserved+used)
+	}
+}
+
+func TestCreditSettle(t *testing.T) {
+	tests := []struct {
+		name     string
+		reserved int64
+		actual   int64
+		balance  int64
+	}{
+		{name: "under the reservation", reserved: 30, actual: 12, balance: 88},
+		{name: "exactly the reservation", reserved: 30, actual: 30, balance: 70},
+		// Usage beyond the reservation is charged, even below zero
+		{name: "over the reservation", reserved: 30, actual: 130, balance: -30},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			credits, user := newCreditTest(t, 100)
+			if err := credits.Reserve(user.ID, "exec-1", tt.reserved); err != nil {
+				t.Fatalf("Reserve() error = %v", err)
+			}
+			checkBalance(t, credits, user.ID, 100-tt.reserved, tt.reserved, 0)
+
+			entry, err := credits.Settle(user.ID, "exec-1", tt.actual, map[string]interface{}{"model": "gpt-4o"})
+			if err != nil || entry == nil {
+				t.Fatalf("Settle() = %v, %v, want the ledger entry", entry, err)
+			}
+			if entry.Amount != tt.reserved-tt.actual || entry.Balance != tt.balance {
+				t.Errorf("settlement amount = %d, balance = %d, want %d, %d", entry.Amount, entry.Balance, tt.reserved-tt.actual, tt.balance)
+			}
+			checkBalance(t, credits, user.ID, tt.balance, 0, tt.actual)
+		})
+	}
+}
+
+func TestCreditRelease(t *testing.T) {
+	credits, user := newCreditTest(t, 100)
+	if err := credits.Reserve(user.ID, "exec-1", 40); err != nil {
+		t.Fatal(err)
+	}
+	if err := credits.Release(user.ID, "exec-1", "cancelled"); err != nil {
+		t.Fatalf("Release() error = %v", err)
+	}
+	checkBalance(t, credits, user.ID, 100, 0, 0)
+
+	// A settle after the release changes nothing
+	if entry, err := credits.Settle(user.ID, "exec-1", 40, nil); entry != nil || err != nil {
+		t.Errorf("Settle() after Release() = %v, %v, want nothing settled", entry, err)
+	}
+	checkBalance(t, credits, user.ID, 100, 0, 0)
+}
+
+func TestCreditInsufficientBalance(t *testing.T) {
+	credits, user := newCreditTest(t, 10)
+
+	if err := credits.Reserve(user.ID, "exec-1", 11); !errors.Is(err, ErrInsufficientCredits) {
+		t.Errorf("Reserve() error = %v, want ErrInsufficientCredits", err)
+	}
+	if _, err := credits.Debit(user.ID, 11, CreditTypeAgentPurchase, "Agent", nil); !errors.Is(err, ErrInsufficientCredits) {
+		t.Errorf("Debit() error = %v, want ErrInsufficientCredits", err)
+	}
+	if err := credits.CheckFunds(user.ID, 11); !errors.Is(err, ErrInsufficientCredits) {
+		t.Errorf("CheckFunds() error = %v, want ErrInsufficientCredits", err)
+	}
+	if err := credits.CheckFunds(user.ID, 10); err != nil {
+		t.Errorf("CheckFunds() of the whole balance error = %v", err)
+	}
+	// Nothing was recorded by the refused debits
+	checkBalance(t, credits, user.ID, 10, 0, 0)
+
+	if err := credits.Reserve("missing", "exec-2", 1); err == nil || errors.Is(err, ErrInsufficientCredits) {
+		t.Errorf("Reserve() for an unknown user error = %v, want user not found", err)
+	}
+}
+
+func TestCreditSettleOnce(t *testing.T) {
+	credits, user := newCreditTest(t, 100)
+	if err := credits.Reserve(user.ID, "exec-1", 30); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only one of several concurrent settles charges the execution
+	var wg sync.WaitGroup
+	entries := make(chan *models.CreditTransaction, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			entry, err := credits.Settle(user.ID, "exec-1", 20, nil)
+			if err != nil {
+				t.Errorf("Settle() error = %v", err)
+			}
+			entries <- entry
+		}()
+	}
+	wg.Wait()
+	close(entries)
+
+	settled := 0
+	for entry := range entries {
+		if entry != nil {
+			settled++
+		}
+	}
+	if settled != 1 {
+		t.Errorf("%d settles returned an entry, want 1", settled)
+	}
+	checkBalance(t, credits, user.ID, 80, 0, 20)
+
+	// The ledger itself refuses a second settlement of the execution
+	executionID := "exec-1"
+	duplicate := &models.CreditTransaction{UserID: user.ID, Type: CreditTypeSettle, Amount: 10, ExecutionID: &executionID}
+	if err := credits.db.Create(duplicate).Error; err == nil {
+		t.Error("a second settlement of the execution was recorded")
+	}
+}
+
+func TestCreditCharges(t *testing.T) {
+	credits, _ := newCreditTest(t, 0)
+	agent := &models.Agent{LLMModel: "gpt-4o", Config: models.MapToJSON(map[string]interface{}{"credits_per_use": 5})}
+	result := &ExecutionResult{Model: "gpt-4o", PromptTokens: 1000000, OutputTokens: 100000, TotalTokens: 1100000}
+
+	// 2.50 + 1.00 USD at 100 credits per USD
+	if cost, charged := credits.ExecutionCharge(agent, result); cost != 3.5 || charged != 355 {
+		t.Errorf("ExecutionCharge() = %v, %d, want 3.5, 355", cost, charged)
+	}
+	// A failed run pays only for its tokens
+	if cost, charged := credits.UsageCharge(agent, result); cost != 3.5 || charged != 350 {
+		t.Errorf("UsageCharge() = %v, %d, want 3.5, 350", cost, charged)
+	}
+	if _, charged := credits.UsageCharge(agent, nil); charged != 0 {
+		t.Errorf("UsageCharge(nil) = %d, want 0", charged)
+	}
+	// A run without tokens still pays the fee, and at least the minimum
+	if _, charged := credits.ExecutionCharge(&models.Agent{}, &ExecutionResult{}); charged != 1 {
+		t.Errorf("ExecutionCharge() of an empty run = %d, want the minimum of 1", charged)
+	}
+}
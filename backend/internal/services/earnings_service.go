@@ -0,0 +1,561 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// Creator earning types
+const (
+	EarningTypeSale   = "sale"
+	EarningTypeUsage  = "usage"
+	EarningTypeRefund = "refund"
+	EarningTypePayout = "payout"
+)
+
+// Payout statuses
+const (
+	PayoutRequested = "requested"
+	PayoutApproved  = "approved"
+	PayoutRejected  = "rejected"
+	PayoutPaid      = "paid"
+	PayoutCancelled = "cancelled"
+)
+
+// payoutTransitions lists the statuses a payout may move to from each status
+var payoutTransitions = map[string][]string{
+	PayoutRequested: {PayoutApproved, PayoutRejected, PayoutCancelled},
+	PayoutApproved:  {PayoutPaid, PayoutRejected},
+}
+
+// payoutMethods are the ways a creator can be paid
+var payoutMethods = map[string]bool{
+	"bank_transfer": true,
+	"paypal":        true,
+	"upi":           true,
+}
+
+// EarningsService keeps the creator earnings ledger and handles payouts
+type EarningsService struct {
+	BaseService
+}
+
+// NewEarningsService creates a new earnings service
+func NewEarningsService(db *gorm.DB, cfg *config.Config) *EarningsService {
+	return &EarningsService{
+		BaseService: NewBaseService(db, cfg, "earnings"),
+	}
+}
+
+// RequestPayoutRequest represents a creator's payout request
+type RequestPayoutRequest struct {
+	Amount      float64                `json:"amount" binding:"required,gt=0"`
+	Currency    string                 `json:"currency"`
+	Method      string                 `json:"method" binding:"required"`
+	Destination map[string]interface{} `json:"destination" binding:"required"`
+	Notes       string                 `json:"notes"`
+}
+
+// ReviewPayoutRequest represents an admin decision on a payout
+type ReviewPayoutRequest struct {
+	Reason    string `json:"reason"`
+	Reference string `json:"reference"`
+}
+
+// CreatorBalance summarises a creator's earnings in one currency
+type CreatorBalance struct {
+	Currency     string  `json:"currency"`
+	GrossSales   float64 `json:"gross_sales"`
+	PlatformFees float64 `json:"platform_fees"`
+	Refunds      float64 `json:"refunds"`
+	NetEarnings  float64 `json:"net_earnings"`
+	Pending      float64 `json:"pending"`
+	Available    float64 `json:"available"`
+	Requested    float64 `json:"requested"`
+	Paid         float64 `json:"paid"`
+}
+
+// AgentEarnings summarises what one agent has earned its creator
+type AgentEarnings struct {
+	AgentID      string  `json:"agent_id"`
+	AgentName    string  `json:"agent_name"`
+	Sales        int64   `json:"sales"`
+	Runs         int64   `json:"runs"`
+	GrossSales   float64 `json:"gross_sales"`
+	PlatformFees float64 `json:"platform_fees"`
+	Refunds      float64 `json:"refunds"`
+	NetEarnings  float64 `json:"net_earnings"`
+	Pending      float64 `json:"pending"`
+	Available    float64 `json:"available"`
+	Paid         float64 `json:"paid"`
+}
+
+// CreatorDashboard reports a creator's earnings overall and per agent
+type CreatorDashboard struct {
+	CreatorBalance
+	ShareRate float64         `json:"share_rate"`
+	HoldDays  int             `json:"hold_days"`
+	Agents    []AgentEarnings `json:"agents"`
+}
+
+// split divides a gross amount between the creator and the platform
+func (s *EarningsService) split(gross float64) (net, fee float64) {
+	net = roundCents(gross * s.cfg.Earnings.CreatorShare)
+	return net, roundCents(gross - net)
+}
+
+// holdUntil returns when earnings made now may be paid out
+func (s *EarningsService) holdUntil(now time.Time) time.Time {
+	return now.AddDate(0, 0, s.cfg.Earnings.HoldDays)
+}
+
+// create appends an entry unless one already exists for the same source
+func (s *EarningsService) create(tx *gorm.DB, entry *models.CreatorEarning) error {
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(entry).Error
+}
+
+// recordSale credits the creator with their share of a completed purchase
+func (s *EarningsService) recordSale(tx *gorm.DB, purchase *models.Purchase, agent *models.Agent) error {
+	if purchase.Amount <= 0 || agent.CreatorID == "" {
+		return nil
+	}
+
+	net, fee := s.split(purchase.Amount)
+	return s.create(tx, &models.CreatorEarning{
+		CreatorID:   agent.CreatorID,
+		AgentID:     &agent.ID,
+		Type:        EarningTypeSale,
+		SourceID:    purchase.ID,
+		GrossAmount: purchase.Amount,
+		PlatformFee: fee,
+		NetAmount:   net,
+		Currency:    purchase.Currency,
+		ShareRate:   s.cfg.Earnings.CreatorShare,
+		AvailableAt: s.holdUntil(time.Now()),
+		Description: "Sale of " + agent.Name,
+	})
+}
+
+// recordRefund takes back the creator's share of a refunded amount at the rate of the original sale
+func (s *EarningsService) recordRefund(tx *gorm.DB, purchase *models.Purchase, agent *models.Agent, amount float64) error {
+	if amount <= 0 || agent.CreatorID == "" {
+		return nil
+	}
+
+	var sale models.CreatorEarning
+	if err := tx.Where("type = ? AND source_id = ?", EarningTypeSale, purchase.ID).First(&sale).Error; err != nil {
+		// Sales made before revenue sharing existed have nothing to take back
+		return nil
+	}
+
+	net := roundCents(amount * sale.ShareRate)
+	// A refund during the hold offsets the sale before it is paid out
+	availableAt := time.Now()
+	if sale.AvailableAt.After(availableAt) {
+		availableAt = sale.AvailableAt
+	}
+	return s.create(tx, &models.CreatorEarning{
+		CreatorID:   sale.CreatorID,
+		AgentID:     sale.AgentID,
+		Type:        EarningTypeRefund,
+		SourceID:    purchase.ID,
+		GrossAmount: -amount,
+		PlatformFee: -roundCents(amount - net),
+		NetAmount:   -net,
+		Currency:    sale.Currency,
+		ShareRate:   sale.ShareRate,
+		AvailableAt: availableAt,
+		Description: "Refund of " + agent.Name,
+	})
+}
+
+// RecordUsage credits the creator with their share of an agent's per-use fee,
+// as far as it was covered by the paid credits the execution was charged.
+// Creators running their own agents earn nothing.
+func (s *EarningsService) RecordUsage(execution *models.Execution, agent *models.Agent, paidCredits int64) error {
+	fee := min(ParseAgentRuntimeConfig(agent).CreditsPerUse, paidCredits)
+	if fee <= 0 || s.cfg.Credits.PerUSD <= 0 || agent.CreatorID == "" || agent.CreatorID == execution.UserID {
+		return nil
+	}
+
+	gross := roundCents(float64(fee) / float64(s.cfg.Credits.PerUSD))
+	if gross <= 0 {
+		return nil
+	}
+	net, platformFee := s.split(gross)
+	return s.create(s.db, &models.CreatorEarning{
+		CreatorID:   agent.CreatorID,
+		AgentID:     &agent.ID,
+		Type:        EarningTypeUsage,
+		SourceID:    execution.ID,
+		GrossAmount: gross,
+		PlatformFee: platformFee,
+		NetAmount:   net,
+		Currency:    s.cfg.Payments.Currency,
+		ShareRate:   s.cfg.Earnings.CreatorShare,
+		AvailableAt: s.holdUntil(time.Now()),
+		Description: "Use of " + agent.Name,
+	})
+}
+
+// currencyOrDefault returns currency, or the platform currency when it is empty
+func (s *EarningsService) currencyOrDefault(currency string) string {
+	if currency == "" {
+		return s.cfg.Payments.Currency
+	}
+	return currency
+}
+
+// balance sums the creator's ledger and open payouts in one currency
+func (s *EarningsService) balance(db *gorm.DB, creatorID, currency string) (*CreatorBalance, error) {
+	now := time.Now()
+	var totals struct {
+		Gross   float64
+		Fees    float64
+		Refunds float64
+		Net     float64
+		Pending float64
+		Cleared float64
+		Paid    float64
+	}
+	if err := db.Model(&models.CreatorEarning{}).
+		Select(`COALESCE(SUM(CASE WHEN type IN ? THEN gross_amount ELSE 0 END), 0) AS gross,
+			COALESCE(SUM(CASE WHEN type <> ? THEN platform_fee ELSE 0 END), 0) AS fees,
+			COALESCE(SUM(CASE WHEN type = ? THEN -gross_amount ELSE 0 END), 0) AS refunds,
+			COALESCE(SUM(CASE WHEN type <> ? THEN net_amount ELSE 0 END), 0) AS net,
+			COALESCE(SUM(CASE WHEN available_at > ? THEN net_amount ELSE 0 END), 0) AS pending,
+			COALESCE(SUM(CASE WHEN available_at <= ? THEN net_amount ELSE 0 END), 0) AS cleared,
+			COALESCE(SUM(CASE WHEN type = ? THEN -net_amount ELSE 0 END), 0) AS paid`,
+			[]string{EarningTypeSale, EarningTypeUsage}, EarningTypePayout, EarningTypeRefund, EarningTypePayout,
+			now, now, EarningTypePayout).
+		Where("creator_id = ? AND currency = ?", creatorID, currency).
+		Scan(&totals).Error; err != nil {
+		return nil, err
+	}
+
+	var requested float64
+	if err := db.Model(&models.CreatorPayout{}).
+		Where("creator_id = ? AND currency = ? AND status IN ?", creatorID, currency, []string{PayoutRequested, PayoutApproved}).
+		Select("COALESCE(SUM(amount), 0)").Scan(&requested).Error; err != nil {
+		return nil, err
+	}
+
+	return &CreatorBalance{
+		Currency:     currency,
+		GrossSales:   roundCents(totals.Gross),
+		PlatformFees: roundCents(totals.Fees),
+		Refunds:      roundCents(totals.Refunds),
+		NetEarnings:  roundCents(totals.Net),
+		Pending:      roundCents(totals.Pending),
+		Available:    roundCents(totals.Cleared - requested),
+		Requested:    roundCents(requested),
+		Paid:         roundCents(totals.Paid),
+	}, nil
+}
+
+// GetDashboard reports the creator's earnings in a currency, overall and per agent.
+// Payouts settle the agents that cleared their hold earliest first.
+func (s *EarningsService) GetDashboard(creatorID, currency string) (*CreatorDashboard, error) {
+	currency = s.currencyOrDefault(currency)
+	balance, err := s.balance(s.db, creatorID, currency)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var rows []struct {
+		AgentID string
+		Sales   int64
+		Runs    int64
+		Gross   float64
+		Fees    float64
+		Refunds float64
+		Net     float64
+		Pending float64
+		Cleared float64
+	}
+	if err := s.db.Model(&models.CreatorEarning{}).
+		Select(`agent_id,
+			COALESCE(SUM(CASE WHEN type = ? THEN 1 ELSE 0 END), 0) AS sales,
+			COALESCE(SUM(CASE WHEN type = ? THEN 1 ELSE 0 END), 0) AS runs,
+			COALESCE(SUM(CASE WHEN type IN ? THEN gross_amount ELSE 0 END), 0) AS gross,
+			COALESCE(SUM(platform_fee), 0) AS fees,
+			COALESCE(SUM(CASE WHEN type = ? THEN -gross_amount ELSE 0 END), 0) AS refunds,
+			COALESCE(SUM(net_amount), 0) AS net,
+			COALESCE(SUM(CASE WHEN available_at > ? THEN net_amount ELSE 0 END), 0) AS pending,
+			COALESCE(SUM(CASE WHEN available_at <= ? THEN net_amount ELSE 0 END), 0) AS cleared`,
+			EarningTypeSale, EarningTypeUsage, []string{EarningTypeSale, EarningTypeUsage}, EarningTypeRefund, now, now).
+		Where("creator_id = ? AND currency = ? AND type <> ? AND agent_id IS NOT NULL", creatorID, currency, EarningTypePayout).
+		Group("agent_id").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	// Agents whose earnings cleared first are paid first
+	var clearedOrder []string
+	if err := s.db.Model(&models.CreatorEarning{}).
+		Select("agent_id").
+		Where("creator_id = ? AND currency = ? AND type <> ? AND agent_id IS NOT NULL AND available_at <= ?", creatorID, currency, EarningTypePayout, now).
+		Group("agent_id").
+		Order("MIN(available_at)").
+		Pluck("agent_id", &clearedOrder).Error; err != nil {
+		return nil, err
+	}
+	rank := make(map[string]int, len(clearedOrder))
+	for i, agentID := range clearedOrder {
+		rank[agentID] = i
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, aCleared := rank[rows[i].AgentID]
+		b, bCleared := rank[rows[j].AgentID]
+		if !aCleared || !bCleared {
+			return aCleared
+		}
+		return a < b
+	})
+
+	agentIDs := make([]string, 0, len(rows))
+	for _, row := range rows {
+		agentIDs = append(agentIDs, row.AgentID)
+	}
+	names := make(map[string]string)
+	var agents []models.Agent
+	if len(agentIDs) > 0 {
+		if err := s.db.Select("id", "name").Where("id IN ?", agentIDs).Find(&agents).Error; err != nil {
+			return nil, err
+		}
+	}
+	for _, agent := range agents {
+		names[agent.ID] = agent.Name
+	}
+
+	unallocated := balance.Paid
+	dashboard := &CreatorDashboard{
+		CreatorBalance: *balance,
+		ShareRate:      s.cfg.Earnings.CreatorShare,
+		HoldDays:       s.cfg.Earnings.HoldDays,
+		Agents:         make([]AgentEarnings, 0, len(rows)),
+	}
+	for _, row := range rows {
+		paid := 0.0
+		if row.Cleared > 0 && unallocated > 0 {
+			paid = row.Cleared
+			if paid > unallocated {
+				paid = unallocated
+			}
+			unallocated -= paid
+		}
+		dashboard.Agents = append(dashboard.Agents, AgentEarnings{
+			AgentID:      row.AgentID,
+			AgentName:    names[row.AgentID],
+			Sales:        row.Sales,
+			Runs:         row.Runs,
+			GrossSales:   roundCents(row.Gross),
+			PlatformFees: roundCents(row.Fees),
+			Refunds:      roundCents(row.Refunds),
+			NetEarnings:  roundCents(row.Net),
+			Pending:      roundCents(row.Pending),
+			Available:    roundCents(row.Cleared - paid),
+			Paid:         roundCents(paid),
+		})
+	}
+	return dashboard, nil
+}
+
+// ListEarnings returns the creator's ledger, newest first
+func (s *EarningsService) ListEarnings(creatorID, earningType string, page, limit int) ([]models.CreatorEarning, int64, error) {
+	var earnings []models.CreatorEarning
+	var total int64
+
+	query := s.db.Model(&models.CreatorEarning{}).Where("creator_id = ?", creatorID)
+	if earningType != "" {
+		query = query.Where("type = ?", earningType)
+	}
+
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	offset := (page - 1) * limit
+	if err := query.Order("created_at DESC").Offset(offset).Limit(limit).Find(&earnings).Error; err != nil {
+		return nil, 0, err
+	}
+
+	return earnings, total, nil
+}
+
+// RequestPayout asks for available earnings to be paid out; an admin must approve it
+func (s *EarningsService) RequestPayout(creatorID string, req *RequestPayoutRequest) (*models.CreatorPayout, error) {
+	if !payoutMethods[req.Method] {
+		return nil, fmt.Errorf("unsupported payout method: %s", req.Method)
+	}
+	amount := roundCents(req.Amount)
+	if amount < s.cfg.Earnings.MinimumPayout {
+		return nil, fmt.Errorf("payouts must be at least %.2f", s.cfg.Earnings.MinimumPayout)
+	}
+
+	payout := &models.CreatorPayout{
+		CreatorID:   creatorID,
+		Amount:      amount,
+		Currency:    s.currencyOrDefault(req.Currency),
+		Status:      PayoutRequested,
+		Method:      req.Method,
+		Destination: models.MapToJSON(req.Destination),
+		Notes:       req.Notes,
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// Touching the creator's row serialises their payout requests
+		// so two requests cannot both spend the same balance
+		if err := tx.Model(&models.User{}).Where("id = ?", creatorID).
+			UpdateColumn("updated_at", time.Now()).Error; err != nil {
+			return err
+		}
+
+		balance, err := s.balance(tx, creatorID, payout.Currency)
+		if err != nil {
+			return err
+		}
+		if amount > balance.Available {
+			return fmt.Errorf("only %.2f %s is available for payout", balance.Available, payout.Currency)
+		}
+		return tx.Create(payout).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return payout, nil
+}
+
+// ListPayouts lists payouts, newest first; an empty creatorID lists every creator's
+func (s *EarningsService) ListPayouts(creatorID, status string, page, limit int) ([]models.CreatorPayout, int64, error) {
+	var payouts []models.CreatorPayout
+	var total int64
+
+	query := s.db.Model(&models.CreatorPayout{})
+	if creatorID != "" {
+		query = query.Where("creator_id = ?", creatorID)
+	} else {
+		query = query.Preload("Creator")
+	}
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	offset := (page - 1) * limit
+	if err := query.Order("created_at DESC").Offset(offset).Limit(limit).Find(&payouts).Error; err != nil {
+		return nil, 0, err
+	}
+
+	return payouts, total, nil
+}
+
+// CancelPayout withdraws a payout request the creator made
+func (s *EarningsService) CancelPayout(payoutID, creatorID string) (*models.CreatorPayout, error) {
+	var payout models.CreatorPayout
+	if err := s.db.First(&payout, "id = ? AND creator_id = ?", payoutID, creatorID).Error; err != nil {
+		return nil, errors.New("payout not found")
+	}
+	if err := transitionPayout(s.db, &payout, PayoutCancelled, nil); err != nil {
+		return nil, err
+	}
+	return &payout, nil
+}
+
+// ApprovePayout approves a requested payout for payment
+func (s *EarningsService) ApprovePayout(payoutID, adminID string) (*models.CreatorPayout, error) {
+	return s.reviewPayout(payoutID, adminID, PayoutApproved, nil)
+}
+
+// RejectPayout rejects a payout, returning its amount to the creator's available balance
+func (s *EarningsService) RejectPayout(payoutID, adminID string, req *ReviewPayoutRequest) (*models.CreatorPayout, error) {
+	if req.Reason == "" {
+		return nil, errors.New("a reason is required to reject a payout")
+	}
+	return s.reviewPayout(payoutID, adminID, PayoutRejected, map[string]interface{}{"rejection_reason": req.Reason})
+}
+
+// MarkPayoutPaid records that an approved payout has been sent and debits the ledger
+func (s *EarningsService) MarkPayoutPaid(payoutID string, req *ReviewPayoutRequest) (*models.CreatorPayout, error) {
+	var payout models.CreatorPayout
+	if err := s.db.First(&payout, "id = ?", payoutID).Error; err != nil {
+		return nil, errors.New("payout not found")
+	}
+
+	now := time.Now()
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := transitionPayout(tx, &payout, PayoutPaid, map[string]interface{}{
+			"paid_at":   now,
+			"reference": req.Reference,
+		}); err != nil {
+			return err
+		}
+		return s.create(tx, &models.CreatorEarning{
+			CreatorID:   payout.CreatorID,
+			Type:        EarningTypePayout,
+			SourceID:    payout.ID,
+			GrossAmount: -payout.Amount,
+			NetAmount:   -payout.Amount,
+			Currency:    payout.Currency,
+			AvailableAt: now,
+			Description: fmt.Sprintf("Payout via %s", payout.Method),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &payout, nil
+}
+
+// reviewPayout moves a payout to an admin decision
+func (s *EarningsService) reviewPayout(payoutID, adminID, to string, updates map[string]interface{}) (*models.CreatorPayout, error) {
+	var payout models.CreatorPayout
+	if err := s.db.First(&payout, "id = ?", payoutID).Error; err != nil {
+		return nil, errors.New("payout not found")
+	}
+	if updates == nil {
+		updates = make(map[string]interface{})
+	}
+	updates["reviewed_by"] = adminID
+	updates["reviewed_at"] = time.Now()
+
+	if err := transitionPayout(s.db, &payout, to, updates); err != nil {
+		return nil, err
+	}
+	return &payout, nil
+}
+
+// transitionPayout moves a payout to a new status, failing if the move is
+// not allowed or another request changed the payout first
+func transitionPayout(tx *gorm.DB, payout *models.CreatorPayout, to string, updates map[string]interface{}) error {
+	if !canTransition(payoutTransitions, payout.Status, to) {
+		return fmt.Errorf("payout cannot move from %s to %s", payout.Status, to)
+	}
+	if updates == nil {
+		updates = make(map[string]interface{})
+	}
+	updates["status"] = to
+
+	result := tx.Model(&models.CreatorPayout{}).
+		Where("id = ? AND status = ?", payout.ID, payout.Status).
+		Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errConcurrentUpdate
+	}
+	return tx.First(payout, "id = ?", payout.ID).Error
+}
@@ -0,0 +1,341 @@
+package services
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// earningsTest holds an earnings service paying creators 70% after a 14 day
+// hold, a creator with two agents and an admin reviewing payouts
+type earningsTest struct {
+	earnings *EarningsService
+	creator  *models.User
+	admin    *models.User
+	agents   []*models.Agent
+}
+
+func newEarningsTest(t *testing.T) *earningsTest {
+	t.Helper()
+	t.Setenv("CREATOR_REVENUE_SHARE", "0.7")
+	t.Setenv("CREATOR_EARNINGS_HOLD_DAYS", "14")
+	t.Setenv("CREATOR_MINIMUM_PAYOUT", "10")
+
+	db := newTestDB(t, &models.User{}, &models.Agent{}, &models.CreatorEarning{}, &models.CreatorPayout{})
+	creator := &models.User{Email: "maker@example.com", Username: "maker", PasswordHash: "x"}
+	admin := &models.User{Email: "admin@example.com", Username: "admin", PasswordHash: "x", Role: "admin"}
+	for _, u := range []*models.User{creator, admin} {
+		if err := db.Create(u).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	et := &earningsTest{earnings: NewEarningsService(db, config.Load()), creator: creator, admin: admin}
+	for _, name := range []string{"Helper", "Writer"} {
+		agent := &models.Agent{Name: name, Slug: strings.ToLower(name), CreatorID: creator.ID,
+			Config: models.JSON(`{"credits_per_use": 50}`)}
+		if err := db.Create(agent).Error; err != nil {
+			t.Fatal(err)
+		}
+		et.agents = append(et.agents, agent)
+	}
+	return et
+}
+
+// sell records the creator's share of a purchase of the agent
+func (et *earningsTest) sell(t *testing.T, agent *models.Agent, purchaseID string, amount float64) *models.Purchase {
+	t.Helper()
+	purchase := &models.Purchase{BaseModel: models.BaseModel{ID: purchaseID}, AgentID: agent.ID, Amount: amount, Currency: "USD"}
+	if err := et.earnings.recordSale(et.earnings.db, purchase, agent); err != nil {
+		t.Fatalf("recordSale() error = %v", err)
+	}
+	return purchase
+}
+
+// clear ends the hold on the earnings from source, as if it had passed
+// the given time ago
+func (et *earningsTest) clear(t *testing.T, sourceID string, ago time.Duration) {
+	t.Helper()
+	if err := et.earnings.db.Model(&models.CreatorEarning{}).Where("source_id = ?", sourceID).
+		Update("available_at", time.Now().Add(-ago)).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dashboard returns the creator's dashboard in the platform currency
+func (et *earningsTest) dashboard(t *testing.T) *CreatorDashboard {
+	t.Helper()
+	dashboard, err := et.earnings.GetDashboard(et.creator.ID, "")
+	if err != nil {
+		t.Fatalf("GetDashboard() error = %v", err)
+	}
+	return dashboard
+}
+
+// requestPayout asks for amount to be paid out by bank transfer
+func (et *earningsTest) requestPayout(amount float64) (*models.CreatorPayout, error) {
+	return et.earnings.RequestPayout(et.creator.ID, &RequestPayoutRequest{
+		Amount:      amount,
+		Method:      "bank_transfer",
+		Destination: map[string]interface{}{"iban": "DE89370400440532013000"},
+	})
+}
+
+func TestRecordSaleAndRefund(t *testing.T) {
+	et := newEarningsTest(t)
+	purchase := et.sell(t, et.agents[0], "purchase-1", 10)
+
+	// A sale is recorded once, however often it is reported
+	et.sell(t, et.agents[0], "purchase-1", 10)
+	var sale models.CreatorEarning
+	if err := et.earnings.db.First(&sale, "type = ? AND source_id = ?", EarningTypeSale, purchase.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if sale.NetAmount != 7 || sale.PlatformFee != 3 || sale.ShareRate != 0.7 {
+		t.Errorf("sale = %v net, %v fee at %v, want 7, 3 at 0.7", sale.NetAmount, sale.PlatformFee, sale.ShareRate)
+	}
+	if hold := time.Until(sale.AvailableAt); hold < 13*24*time.Hour || hold > 14*24*time.Hour {
+		t.Errorf("sale available in %s, want 14 days", hold)
+	}
+
+	// A refund is taken back at the rate of the sale and offsets it during the hold
+	et.earnings.cfg.Earnings.CreatorShare = 0.5
+	if err := et.earnings.recordRefund(et.earnings.db, purchase, et.agents[0], 4); err != nil {
+		t.Fatalf("recordRefund() error = %v", err)
+	}
+	var refund models.CreatorEarning
+	if err := et.earnings.db.First(&refund, "type = ? AND source_id = ?", EarningTypeRefund, purchase.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if refund.NetAmount != -2.8 || refund.PlatformFee != -1.2 || !refund.AvailableAt.Equal(sale.AvailableAt) {
+		t.Errorf("refund = %v net, %v fee available %v, want -2.8, -1.2 with the sale", refund.NetAmount, refund.PlatformFee, refund.AvailableAt)
+	}
+
+	dashboard := et.dashboard(t)
+	if dashboard.GrossSales != 10 || dashboard.PlatformFees != 1.8 || dashboard.Refunds != 4 || dashboard.NetEarnings != 4.2 ||
+		dashboard.Pending != 4.2 || dashboard.Available != 0 {
+		t.Errorf("dashboard = %+v, want 10 gross, 1.8 fees, 4 refunded, 4.2 net and pending", dashboard.CreatorBalance)
+	}
+
+	// Purchases without a recorded sale have nothing to take back
+	if err := et.earnings.recordRefund(et.earnings.db, &models.Purchase{BaseModel: models.BaseModel{ID: "purchase-0"}}, et.agents[0], 4); err != nil {
+		t.Errorf("recordRefund() of an unrecorded sale error = %v", err)
+	}
+	var entries int64
+	et.earnings.db.Model(&models.CreatorEarning{}).Count(&entries)
+	if entries != 2 {
+		t.Errorf("%d ledger entries, want the sale and its refund", entries)
+	}
+}
+
+func TestRecordUsage(t *testing.T) {
+	tests := []struct {
+		name   string
+		userID string
+		paid   int64
+		want   float64
+	}{
+		{name: "fee paid in full", userID: "user-1", paid: 80, want: 0.35},
+		{name: "fee partly paid", userID: "user-1", paid: 30, want: 0.21},
+		{name: "no paid credits", userID: "user-1", paid: 0},
+		{name: "creator's own run", paid: 80},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			et := newEarningsTest(t)
+			userID := tt.userID
+			if userID == "" {
+				userID = et.creator.ID
+			}
+			execution := &models.Execution{BaseModel: models.BaseModel{ID: "exec-1"}, UserID: userID}
+			if err := et.earnings.RecordUsage(execution, et.agents[0], tt.paid); err != nil {
+				t.Fatalf("RecordUsage() error = %v", err)
+			}
+
+			var earned float64
+			et.earnings.db.Model(&models.CreatorEarning{}).Where("type = ?", EarningTypeUsage).
+				Select("COALESCE(SUM(net_amount), 0)").Scan(&earned)
+			if earned != tt.want {
+				t.Errorf("creator earned %v, want %v", earned, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestPayout(t *testing.T) {
+	et := newEarningsTest(t)
+	et.sell(t, et.agents[0], "purchase-1", 10)
+	et.sell(t, et.agents[1], "purchase-2", 20)
+	et.sell(t, et.agents[1], "purchase-3", 100)
+	et.clear(t, "purchase-1", time.Hour)
+	et.clear(t, "purchase-2", time.Hour)
+
+	tests := []struct {
+		amount float64
+		method string
+		err    string
+	}{
+		{amount: 15, method: "cheque", err: "unsupported payout method"},
+		{amount: 5, method: "paypal", err: "at least 10.00"},
+		// Earnings still on hold cannot be paid out
+		{amount: 22, method: "paypal", err: "only 21.00 USD is available"},
+	}
+	for _, tt := range tests {
+		_, err := et.earnings.RequestPayout(et.creator.ID, &RequestPayoutRequest{Amount: tt.amount, Method: tt.method})
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("RequestPayout(%v, %s) error = %v, want one containing %q", tt.amount, tt.method, err, tt.err)
+		}
+	}
+
+	// A request holds its amount until it is cancelled
+	payout, err := et.requestPayout(15)
+	if err != nil {
+		t.Fatalf("RequestPayout() error = %v", err)
+	}
+	if balance := et.dashboard(t); balance.Available != 6 || balance.Requested != 15 || balance.Pending != 70 {
+		t.Errorf("balance = %v available, %v requested, %v pending, want 6, 15, 70", balance.Available, balance.Requested, balance.Pending)
+	}
+	if _, err := et.requestPayout(10); err == nil {
+		t.Error("RequestPayout() beyond the rest error = nil, want an error")
+	}
+	if _, err := et.earnings.CancelPayout(payout.ID, et.admin.ID); err == nil {
+		t.Error("CancelPayout() by another user error = nil, want an error")
+	}
+	if _, err := et.earnings.CancelPayout(payout.ID, et.creator.ID); err != nil {
+		t.Fatalf("CancelPayout() error = %v", err)
+	}
+	if balance := et.dashboard(t); balance.Available != 21 || balance.Requested != 0 {
+		t.Errorf("balance after cancelling = %v available, %v requested, want 21, 0", balance.Available, balance.Requested)
+	}
+}
+
+func TestRequestPayoutConcurrently(t *testing.T) {
+	et := newEarningsTest(t)
+	et.sell(t, et.agents[0], "purchase-1", 30)
+	et.clear(t, "purchase-1", time.Hour)
+
+	// Two requests for most of the balance cannot both be accepted
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := et.requestPayout(15)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	accepted := 0
+	for err := range errs {
+		if err == nil {
+			accepted++
+		}
+	}
+	if accepted != 1 {
+		t.Errorf("%d payout requests accepted, want 1", accepted)
+	}
+}
+
+func TestPayoutReview(t *testing.T) {
+	et := newEarningsTest(t)
+	et.sell(t, et.agents[0], "purchase-1", 50)
+	et.clear(t, "purchase-1", time.Hour)
+
+	// A rejected payout returns its amount to the balance
+	rejected, err := et.requestPayout(20)
+	if err != nil {
+		t.Fatalf("RequestPayout() error = %v", err)
+	}
+	if _, err := et.earnings.RejectPayout(rejected.ID, et.admin.ID, &ReviewPayoutRequest{}); err == nil {
+		t.Error("RejectPayout() without a reason error = nil, want an error")
+	}
+	rejected, err = et.earnings.RejectPayout(rejected.ID, et.admin.ID, &ReviewPayoutRequest{Reason: "unverified account"})
+	if err != nil || rejected.Status != PayoutRejected || rejected.RejectionReason != "unverified account" || rejected.ReviewedBy == nil {
+		t.Fatalf("RejectPayout() = %v, want the payout rejected with its reason", err)
+	}
+	if _, err := et.earnings.ApprovePayout(rejected.ID, et.admin.ID); err == nil {
+		t.Error("ApprovePayout() of a rejected payout error = nil, want an error")
+	}
+
+	// A paid payout is debited from the ledger once
+	payout, err := et.requestPayout(30)
+	if err != nil {
+		t.Fatalf("RequestPayout() error = %v", err)
+	}
+	if _, err := et.earnings.MarkPayoutPaid(payout.ID, &ReviewPayoutRequest{Reference: "TX-1"}); err == nil {
+		t.Error("MarkPayoutPaid() before approval error = nil, want an error")
+	}
+	if _, err := et.earnings.ApprovePayout(payout.ID, et.admin.ID); err != nil {
+		t.Fatalf("ApprovePayout() error = %v", err)
+	}
+	payout, err = et.earnings.MarkPayoutPaid(payout.ID, &ReviewPayoutRequest{Reference: "TX-1"})
+	if err != nil || payout.Status != PayoutPaid || payout.Reference != "TX-1" || payout.PaidAt == nil {
+		t.Fatalf("MarkPayoutPaid() = %v, want the payout paid with its reference", err)
+	}
+	if _, err := et.earnings.MarkPayoutPaid(payout.ID, &ReviewPayoutRequest{}); err == nil {
+		t.Error("second MarkPayoutPaid() error = nil, want an error")
+	}
+	if _, err := et.earnings.CancelPayout(payout.ID, et.creator.ID); err == nil {
+		t.Error("CancelPayout() of a paid payout error = nil, want an error")
+	}
+
+	balance := et.dashboard(t)
+	if balance.NetEarnings != 35 || balance.Paid != 30 || balance.Available != 5 || balance.Requested != 0 {
+		t.Errorf("balance = %v net, %v paid, %v available, %v requested, want 35, 30, 5, 0",
+			balance.NetEarnings, balance.Paid, balance.Available, balance.Requested)
+	}
+	payouts, total, err := et.earnings.ListPayouts("", PayoutPaid, 1, 20)
+	if err != nil || total != 1 || payouts[0].Creator == nil {
+		t.Errorf("ListPayouts(paid) = %d, %v, want the payout with its creator", total, err)
+	}
+}
+
+func TestDashboardAgents(t *testing.T) {
+	et := newEarningsTest(t)
+	helper, writer := et.agents[0], et.agents[1]
+	et.sell(t, writer, "purchase-1", 20)
+	et.sell(t, helper, "purchase-2", 10)
+	et.sell(t, writer, "purchase-3", 10)
+	et.clear(t, "purchase-1", time.Hour)
+	et.clear(t, "purchase-2", 2*time.Hour)
+	if err := et.earnings.RecordUsage(&models.Execution{BaseModel: models.BaseModel{ID: "exec-1"}, UserID: "user-1"}, helper, 100); err != nil {
+		t.Fatal(err)
+	}
+	et.clear(t, "exec-1", time.Hour)
+
+	payout, err := et.requestPayout(10)
+	if err != nil {
+		t.Fatalf("RequestPayout() error = %v", err)
+	}
+	et.earnings.ApprovePayout(payout.ID, et.admin.ID)
+	if _, err := et.earnings.MarkPayoutPaid(payout.ID, &ReviewPayoutRequest{}); err != nil {
+		t.Fatalf("MarkPayoutPaid() error = %v", err)
+	}
+
+	// The payout settles the agent whose earnings cleared first
+	want := []AgentEarnings{
+		{AgentID: helper.ID, AgentName: "Helper", Sales: 1, Runs: 1, GrossSales: 10.5, PlatformFees: 3.15, NetEarnings: 7.35, Paid: 7.35},
+		{AgentID: writer.ID, AgentName: "Writer", Sales: 2, GrossSales: 30, PlatformFees: 9, NetEarnings: 21, Pending: 7, Available: 11.35, Paid: 2.65},
+	}
+	dashboard := et.dashboard(t)
+	if len(dashboard.Agents) != len(want) {
+		t.Fatalf("dashboard has %d agents, want %d", len(dashboard.Agents), len(want))
+	}
+	for i := range want {
+		if dashboard.Agents[i] != want[i] {
+			t.Errorf("agent %d = %+v, want %+v", i, dashboard.Agents[i], want[i])
+		}
+	}
+
+	earnings, total, err := et.earnings.ListEarnings(et.creator.ID, EarningTypeSale, 1, 20)
+	if err != nil || total != 3 || len(earnings) != 3 {
+		t.Errorf("ListEarnings(sale) = %d of %d, %v, want 3", len(earnings), total, err)
+	}
+}
@@ -0,0 +1,182 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// Email log statuses
+const (
+	EmailPending = "pending"
+	EmailSent    = "sent"
+	EmailFailed  = "failed"
+)
+
+// EmailService renders templated email, sends it through the configured
+// mailer and logs every message
+type EmailService struct {
+	BaseService
+	mailer    Mailer
+	mailerErr error
+}
+
+// NewEmailService creates a new email service
+func NewEmailService(db *gorm.DB, cfg *config.Config) *EmailService {
+	mailer, err := NewMailer(cfg)
+	if err != nil {
+		fmt.Printf("Email delivery is disabled: %v\n", err)
+	}
+	return &EmailService{
+		BaseService: NewBaseService(db, cfg, "email"),
+		mailer:      mailer,
+		mailerErr:   err,
+	}
+}
+
+// SetMailer replaces the mailer
+func (s *EmailService) SetMailer(mailer Mailer) {
+	s.mailer = mailer
+	s.mailerErr = nil
+}
+
+// EmailRequest describes an email to send from a template
+type EmailRequest struct {
+	To       string
+	UserID   *string
+	Template string
+	Data     map[string]interface{}
+}
+
+// Send renders and sends an email, retrying failed attempts
+func (s *EmailService) Send(ctx context.Context, req *EmailRequest) error {
+	message, emailLog, err := s.prepare(req)
+	if err != nil {
+		return err
+	}
+	return s.deliver(ctx, emailLog, message)
+}
+
+// SendAsync renders and logs an email, and sends it in the background.
+// The outcome is recorded in the email log.
+func (s *EmailService) SendAsync(req *EmailRequest) error {
+	message, emailLog, err := s.prepare(req)
+	if err != nil {
+		return err
+	}
+	go s.deliver(context.Background(), emailLog, message)
+	return nil
+}
+
+// prepare renders the email and records it in the log
+func (s *EmailService) prepare(req *EmailRequest) (*EmailMessage, *models.EmailLog, error) {
+	subject, text, html, err := renderEmail(req.Template, s.cfg.Email.AppURL, req.Data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	message := &EmailMessage{
+		MessageID: fmt.Sprintf("<%s@%s>", uuid.New().String(), emailDomain(s.cfg.Email.FromEmail)),
+		From:      s.cfg.Email.FromEmail,
+		To:        req.To,
+		Subject:   subject,
+		Text:      text,
+		HTML:      html,
+	}
+	emailLog := &models.EmailLog{
+		UserID:    req.UserID,
+		To:        req.To,
+		From:      message.From,
+		Subject:   subject,
+		Template:  req.Template,
+		MessageID: message.MessageID,
+		Status:    EmailPending,
+	}
+	if s.mailer != nil {
+		emailLog.Transport = s.mailer.Name()
+	}
+	if err := s.db.Create(emailLog).Error; err != nil {
+		return nil, nil, err
+	}
+	return message, emailLog, nil
+}
+
+// deliver sends a logged message. Transient failures are retried with
+// exponential backoff; the final outcome is written to the log.
+func (s *EmailService) deliver(ctx context.Context, emailLog *models.EmailLog, message *EmailMessage) error {
+	if s.mailer == nil {
+		err := errors.New("email delivery is not configured")
+		if s.mailerErr != nil {
+			err = fmt.Errorf("email delivery is not configured: %v", s.mailerErr)
+		}
+		s.finishDelivery(emailLog, 0, err)
+		return err
+	}
+
+	maxAttempts := max(s.cfg.Email.MaxAttempts, 1)
+	delay := time.Duration(s.cfg.Email.RetryBaseDelayMs) * time.Millisecond
+	var err error
+	attempt := 0
+	for attempt < maxAttempts {
+		attempt++
+		if err = s.mailer.Send(ctx, message); err == nil || isPermanentMailError(err) || attempt == maxAttempts {
+			break
+		}
+		fmt.Printf("Email %s to %s failed (attempt %d/%d): %v\n", emailLog.ID, emailLog.To, attempt, maxAttempts, err)
+
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-ctx.Done():
+			err = ctx.Err()
+			attempt = maxAttempts
+		}
+	}
+
+	s.finishDelivery(emailLog, attempt, err)
+	return err
+}
+
+// finishDelivery records the outcome of sending a message
+func (s *EmailService) finishDelivery(emailLog *models.EmailLog, attempts int, err error) {
+	updates := map[string]interface{}{"attempts": attempts}
+	if err == nil {
+		updates["status"] = EmailSent
+		updates["sent_at"] = time.Now()
+	} else {
+		updates["status"] = EmailFailed
+		updates["last_error"] = err.Error()
+		fmt.Printf("Failed to send %s email to %s: %v\n", emailLog.Template, emailLog.To, err)
+	}
+	if dbErr := s.db.Model(emailLog).Updates(updates).Error; dbErr != nil {
+		fmt.Printf("Failed to update email log %s: %v\n", emailLog.ID, dbErr)
+	}
+}
+
+// emailDomain returns the domain of an address, for message IDs
+func emailDomain(address string) string {
+	if parsed, err := mail.ParseAddress(address); err == nil {
+		address = parsed.Address
+	}
+	if at := strings.LastIndex(address, "@"); at >= 0 {
+		return address[at+1:]
+	}
+	return "localhost"
+}
+
+// displayName returns the name to greet a user by in email
+func displayName(user *models.User) string {
+	if name := strings.TrimSpace(user.FirstName); name != "" {
+		return name
+	}
+	return user.Email
+}
@@ -0,0 +1,232 @@
+package services
+
+import (
+	"context"
+	"io"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// fakeMailer fails with each of errs in turn, then accepts every message
+type fakeMailer struct {
+	mu       sync.Mutex
+	errs     []error
+	attempts int
+	sent     []*EmailMessage
+}
+
+func (m *fakeMailer) Name() string {
+	return "fake"
+}
+
+func (m *fakeMailer) Send(ctx context.Context, message *EmailMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.attempts++
+	if len(m.errs) > 0 {
+		err := m.errs[0]
+		m.errs = m.errs[1:]
+		return err
+	}
+	m.sent = append(m.sent, message)
+	return nil
+}
+
+// newEmailTest returns an email service that retries quickly, sending
+// through mailer
+func newEmailTest(t *testing.T, mailer Mailer) (*EmailService, *models.EmailLog) {
+	t.Helper()
+	t.Setenv("EMAIL_OUTBOX_DIR", t.TempDir())
+	t.Setenv("EMAIL_MAX_ATTEMPTS", "3")
+	t.Setenv("EMAIL_RETRY_BASE_DELAY_MS", "1")
+	db := newTestDB(t, &models.EmailLog{})
+	emails := NewEmailService(db, config.Load())
+	if mailer != nil {
+		emails.SetMailer(mailer)
+	}
+	return emails, &models.EmailLog{}
+}
+
+// resetEmail is a password reset email for ann
+func resetEmail() *EmailRequest {
+	userID := "user-1"
+	return &EmailRequest{
+		To:       "ann@example.com",
+		UserID:   &userID,
+		Template: EmailTemplatePasswordReset,
+		Data: map[string]interface{}{
+			"Name":      "Ann",
+			"ResetURL":  "https://app.example.com/reset-password?token=abc",
+			"ExpiresIn": "1 hour",
+		},
+	}
+}
+
+func TestEmailDelivery(t *testing.T) {
+	rejected := &textproto.Error{Code: 550, Msg: "No such user"}
+	busy := &textproto.Error{Code: 451, Msg: "Try again later"}
+	tests := []struct {
+		name     string
+		errs     []error
+		status   string
+		attempts int
+	}{
+		{name: "sent", status: EmailSent, attempts: 1},
+		{name: "sent after retries", errs: []error{busy, io.EOF}, status: EmailSent, attempts: 3},
+		// Retrying cannot help when the recipient is refused
+		{name: "rejected", errs: []error{rejected}, status: EmailFailed, attempts: 1},
+		{name: "out of attempts", errs: []error{busy, busy, busy}, status: EmailFailed, attempts: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mailer := &fakeMailer{errs: tt.errs}
+			emails, entry := newEmailTest(t, mailer)
+
+			err := emails.Send(context.Background(), resetEmail())
+			if (err == nil) != (tt.status == EmailSent) {
+				t.Errorf("Send() error = %v, want status %s", err, tt.status)
+			}
+			if mailer.attempts != tt.attempts {
+				t.Errorf("mailer tried %d times, want %d", mailer.attempts, tt.attempts)
+			}
+
+			if err := emails.db.First(entry).Error; err != nil {
+				t.Fatalf("no email log: %v", err)
+			}
+			if entry.Status != tt.status || entry.Attempts != tt.attempts || (entry.SentAt != nil) != (tt.status == EmailSent) {
+				t.Errorf("log = %s after %d attempts (sent at %v), want %s after %d", entry.Status, entry.Attempts, entry.SentAt, tt.status, tt.attempts)
+			}
+			if tt.status == EmailFailed && entry.LastError != err.Error() {
+				t.Errorf("logged error = %q, want %q", entry.LastError, err)
+			}
+			if entry.To != "ann@example.com" || entry.UserID == nil || *entry.UserID != "user-1" || entry.Template != EmailTemplatePasswordReset ||
+				entry.Subject != "Reset your password" || entry.Transport != "fake" || !strings.HasSuffix(entry.MessageID, "@agais.ai>") {
+				t.Errorf("log = %+v, want the reset email to ann through the fake mailer", entry)
+			}
+		})
+	}
+}
+
+func TestEmailServiceSendAsync(t *testing.T) {
+	mailer := &fakeMailer{}
+	emails, _ := newEmailTest(t, mailer)
+
+	if err := emails.SendAsync(resetEmail()); err != nil {
+		t.Fatalf("SendAsync() error = %v", err)
+	}
+	if entry := waitForEmail(t, emails.db, "ann@example.com", EmailTemplatePasswordReset); entry.Status != EmailSent {
+		t.Errorf("log status = %s, want %s", entry.Status, EmailSent)
+	}
+	mailer.mu.Lock()
+	defer mailer.mu.Unlock()
+	if len(mailer.sent) != 1 || !strings.Contains(mailer.sent[0].Text, "reset-password?token=abc") {
+		t.Errorf("mailer sent %d messages, want the reset email", len(mailer.sent))
+	}
+
+	// A template that cannot be rendered is refused up front and not logged
+	if err := emails.SendAsync(&EmailRequest{To: "ann@example.com", Template: "postcard"}); err == nil {
+		t.Error("SendAsync() with an unknown template error = nil, want an error")
+	}
+	var logged int64
+	emails.db.Model(&models.EmailLog{}).Count(&logged)
+	if logged != 1 {
+		t.Errorf("%d emails logged, want 1", logged)
+	}
+}
+
+func TestEmailServiceWithoutMailer(t *testing.T) {
+	t.Setenv("EMAIL_TRANSPORT", "pigeon")
+	emails, entry := newEmailTest(t, nil)
+
+	// Email is still logged, as failed, when there is no way to send it
+	err := emails.Send(context.Background(), resetEmail())
+	if err == nil || !strings.Contains(err.Error(), "unsupported email transport") {
+		t.Errorf("Send() error = %v, want the transport problem", err)
+	}
+	emails.db.First(entry)
+	if entry.Status != EmailFailed || entry.Attempts != 0 || entry.Transport != "" {
+		t.Errorf("log = %s after %d attempts through %q, want failed without trying", entry.Status, entry.Attempts, entry.Transport)
+	}
+}
+
+func TestRenderEmail(t *testing.T) {
+	tests := []struct {
+		template string
+		data     map[string]interface{}
+		subject  string
+		text     string
+	}{
+		{template: EmailTemplatePasswordReset, data: resetEmail().Data, subject: "Reset your password", text: "reset-password?token=abc"},
+		{template: EmailTemplateEmailVerification, data: map[string]interface{}{
+			"Name": "Ann", "Email": "ann@example.com", "VerifyURL": "https://app.example.com/verify-email?token=abc", "ExpiresIn": "24 hours",
+		}, subject: "Verify your email address", text: "verify-email?token=abc"},
+		{template: EmailTemplateInvitation, data: map[string]interface{}{
+			"Existing": false, "InvitedBy": "Bob", "Organization": "Acme", "Role": "member", "ActionURL": "https://app.example.com/register",
+		}, subject: "You're invited to join Acme", text: "Bob invited you to join Acme on vagais as member."},
+		{template: EmailTemplateInvitation, data: map[string]interface{}{
+			"Existing": true, "InvitedBy": "Bob", "Organization": "Acme", "Role": "member", "ActionURL": "https://app.example.com/login",
+		}, subject: "You have been added to Acme", text: "Bob added you to Acme on vagais as member."},
+		{template: EmailTemplateReceipt, data: map[string]interface{}{
+			"Name": "Ann", "ReceiptNumber": "R-1", "Date": "2 Jan 2026", "AgentName": "Summarizer", "PricingModel": "one_time",
+			"Quantity": 1, "PaidWithCredits": true, "Credits": 50, "Amount": "0.00", "Currency": "USD", "PurchasesURL": "https://app.example.com/purchases",
+		}, subject: "Your receipt for Summarizer", text: "Paid:     50 credits"},
+		{template: EmailTemplateNotification, data: map[string]interface{}{
+			"Name": "Ann", "Title": "Payout approved", "Message": "Your payout was approved.",
+		}, subject: "Payout approved", text: "Your payout was approved."},
+	}
+
+	for _, tt := range tests {
+		subject, text, html, err := renderEmail(tt.template, "https://app.example.com", tt.data)
+		if err != nil {
+			t.Errorf("renderEmail(%s) error = %v", tt.template, err)
+			continue
+		}
+		if subject != tt.subject || !strings.Contains(text, tt.text) {
+			t.Errorf("renderEmail(%s) = %q, %q, want %q containing %q", tt.template, subject, text, tt.subject, tt.text)
+		}
+		// Both bodies end with a link to the app
+		if !strings.Contains(text, "Sent by vagais - https://app.example.com") || !strings.Contains(html, `<a href="https://app.example.com"`) {
+			t.Errorf("renderEmail(%s) is missing the layout", tt.template)
+		}
+	}
+}
+
+func TestRenderEmailData(t *testing.T) {
+	// Values are escaped in HTML only
+	data := resetEmail().Data
+	data["Name"] = "<Ann>"
+	_, text, html, err := renderEmail(EmailTemplatePasswordReset, "https://app.example.com", data)
+	if err != nil {
+		t.Fatalf("renderEmail() error = %v", err)
+	}
+	if !strings.Contains(text, "Hi <Ann>,") || !strings.Contains(html, "Hi &lt;Ann&gt;,") || strings.Contains(html, "<Ann>") {
+		t.Errorf("renderEmail() text %q, HTML %q, want the name escaped in HTML only", text, html)
+	}
+
+	// A missing value is an error rather than a blank in the email
+	delete(data, "ResetURL")
+	if _, _, _, err := renderEmail(EmailTemplatePasswordReset, "https://app.example.com", data); err == nil {
+		t.Error("renderEmail() without ResetURL error = nil, want an error")
+	}
+	if _, _, _, err := renderEmail("postcard", "https://app.example.com", nil); err == nil {
+		t.Error("renderEmail() of an unknown template error = nil, want an error")
+	}
+}
+
+func TestEmailDomain(t *testing.T) {
+	for address, want := range map[string]string{
+		"noreply@agais.ai":             "agais.ai",
+		"vagais <noreply@example.com>": "example.com",
+		"nobody":                       "localhost",
+	} {
+		if got := emailDomain(address); got != want {
+			t.Errorf("emailDomain(%q) = %q, want %q", address, got, want)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Email templates
+const (
+	EmailTemplatePasswordReset     = "password_reset"
+	EmailTemplateEmailVerification = "email_verification"
+	EmailTemplateInvitation        = "organization_invitation"
+	EmailTemplateReceipt           = "receipt"
+	EmailTemplateNotification      = "notification"
+)
+
+// emailTemplateSource holds the subject, text and HTML body of a template.
+// The HTML body is rendered inside emailLayoutHTML.
+type emailTemplateSource struct {
+	subject string
+	text    string
+	html    string
+}
+
+// emailTemplate is a parsed email template
+type emailTemplate struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+const emailLayoutHTML = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Subject}}</title></head>
+<body style="margin:0;padding:24px;background:#f5f5f7;font-family:-apple-system,Segoe UI,Helvetica,Arial,sans-serif;color:#1d1d1f;">
+<div style="max-width:560px;margin:0 auto;background:#ffffff;border-radius:8px;padding:32px;">
+{{template "content" .}}
+</div>
+<p style="max-width:560px;margin:16px auto 0;font-size:12px;color:#86868b;text-align:center;">Sent by <a href="{{.AppURL}}" style="color:#86868b;">vagais</a></p>
+</body>
+</html>`
+
+const emailTextFooter = `
+--
+Sent by vagais - {{.AppURL}}
+`
+
+var emailTemplateSources = map[string]emailTemplateSource{
+	EmailTemplatePasswordReset: {
+		subject: `Reset your password`,
+		text: `Hi {{.Name}},
+
+We received a request to reset the password of your account. Open the link below to choose a new password:
+
+{{.ResetURL}}
+
+The link expires in {{.ExpiresIn}}. If you didn't ask to reset your password, you can ignore this email.
+`,
+		html: `<h2>Reset your password</h2>
+<p>Hi {{.Name}},</p>
+<p>We received a request to reset the password of your account. Click the button below to choose a new password.</p>
+<p><a href="{{.ResetURL}}" style="display:inline-block;padding:10px 20px;background:#0071e3;color:#ffffff;border-radius:6px;text-decoration:none;">Reset password</a></p>
+<p>The link expires in {{.ExpiresIn}}. If you didn't ask to reset your password, you can ignore this email.</p>`,
+	},
+	EmailTemplateEmailVerification: {
+		subject: `Verify your email address`,
+		text: `Hi {{.Name}},
+
+Please confirm that {{.Email}} is your email address by opening the link below:
+
+{{.VerifyURL}}
+
+The link expires in {{.ExpiresIn}}.
+`,
+		html: `<h2>Verify your email address</h2>
+<p>Hi {{.Name}},</p>
+<p>Please confirm that <strong>{{.Email}}</strong> is your email address.</p>
+<p><a href="{{.VerifyURL}}" style="display:inline-block;padding:10px 20px;background:#0071e3;color:#ffffff;border-radius:6px;text-decoration:none;">Verify email</a></p>
+<p>The link expires in {{.ExpiresIn}}.</p>`,
+	},
+	EmailTemplateInvitation: {
+		subject: `{{if .Existing}}You have been added to {{.Organization}}{{else}}You're invited to join {{.Organization}}{{end}}`,
+		text: `Hi,
+
+{{.InvitedBy}} {{if .Existing}}added you to{{else}}invited you to join{{end}} {{.Organization}} on vagais as {{.Role}}.
+
+{{if .Existing}}Sign in to get started:{{else}}Create your account to accept the invitation:{{end}}
+
+{{.ActionURL}}
+`,
+		html: `<h2>{{if .Existing}}You have been added to {{.Organization}}{{else}}You're invited to join {{.Organization}}{{end}}</h2>
+<p>{{.InvitedBy}} {{if .Existing}}added you to{{else}}invited you to join{{end}} <strong>{{.Organization}}</strong> on vagais as {{.Role}}.</p>
+<p><a href="{{.ActionURL}}" style="display:inline-block;padding:10px 20px;background:#0071e3;color:#ffffff;border-radius:6px;text-decoration:none;">{{if .Existing}}Sign in{{else}}Accept invitation{{end}}</a></p>`,
+	},
+	EmailTemplateReceipt: {
+		subject: `Your receipt for {{.AgentName}}`,
+		text: `Hi {{.Name}},
+
+Thanks for your purchase. Here is your receipt.
+
+Receipt:  {{.ReceiptNumber}}
+Date:     {{.Date}}
+Item:     {{.AgentName}} ({{.PricingModel}})
+Quantity: {{.Quantity}}
+{{if .PaidWithCredits}}Paid:     {{.Credits}} credits{{else}}Paid:     {{.Amount}} {{.Currency}}{{end}}
+
+You can view your purchases at {{.PurchasesURL}}
+`,
+		html: `<h2>Thanks for your purchase</h2>
+<p>Hi {{.Name}}, here is your receipt.</p>
+<table style="width:100%;border-collapse:collapse;font-size:14px;">
+<tr><td style="padding:6px 0;color:#86868b;">Receipt</td><td style="padding:6px 0;text-align:right;">{{.ReceiptNumber}}</td></tr>
+<tr><td style="padding:6px 0;color:#86868b;">Date</td><td style="padding:6px 0;text-align:right;">{{.Date}}</td></tr>
+<tr><td style="padding:6px 0;color:#86868b;">Item</td><td style="padding:6px 0;text-align:right;">{{.AgentName}} ({{.PricingModel}})</td></tr>
+<tr><td style="padding:6px 0;color:#86868b;">Quantity</td><td style="padding:6px 0;text-align:right;">{{.Quantity}}</td></tr>
+<tr><td style="padding:6px 0;border-top:1px solid #d2d2d7;font-weight:bold;">Paid</td><td style="padding:6px 0;border-top:1px solid #d2d2d7;text-align:right;font-weight:bold;">{{if .PaidWithCredits}}{{.Credits}} credits{{else}}{{.Amount}} {{.Currency}}{{end}}</td></tr>
+</table>
+<p><a href="{{.PurchasesURL}}">View your purchases</a></p>`,
+	},
+	EmailTemplateNotification: {
+		subject: `{{.Title}}`,
+		text: `Hi {{.Name}},
+
+{{.Message}}
+`,
+		html: `<h2>{{.Title}}</h2>
+<p>Hi {{.Name}},</p>
+<p>{{.Message}}</p>`,
+	},
+}
+
+// emailTemplates holds the parsed templates, so that a broken template fails at startup
+var emailTemplates = mustParseEmailTemplates()
+
+// mustParseEmailTemplates parses every email template
+func mustParseEmailTemplates() map[string]*emailTemplate {
+	templates := make(map[string]*emailTemplate, len(emailTemplateSources))
+	for name, source := range emailTemplateSources {
+		// A missing value is a bug in the caller, not something to send
+		html := htmltemplate.Must(htmltemplate.New(name).Option("missingkey=error").Parse(emailLayoutHTML))
+		htmltemplate.Must(html.New("content").Parse(source.html))
+		templates[name] = &emailTemplate{
+			subject: texttemplate.Must(texttemplate.New(name + "_subject").Option("missingkey=error").Parse(source.subject)),
+			text:    texttemplate.Must(texttemplate.New(name + "_text").Option("missingkey=error").Parse(source.text + emailTextFooter)),
+			html:    html,
+		}
+	}
+	return templates
+}
+
+// renderEmail renders the subject, text and HTML body of a template. The
+// data is made available to the templates along with Subject and AppURL.
+func renderEmail(name string, appURL string, data map[string]interface{}) (string, string, string, error) {
+	tmpl, ok := emailTemplates[name]
+	if !ok {
+		return "", "", "", fmt.Errorf("unknown email template: %s", name)
+	}
+
+	values := make(map[string]interface{}, len(data)+2)
+	for key, value := range data {
+		values[key] = value
+	}
+	values["AppURL"] = appURL
+
+	var subject, text, html bytes.Buffer
+	if err := tmpl.subject.Execute(&subject, values); err != nil {
+		return "", "", "", err
+	}
+	values["Subject"] = strings.TrimSpace(subject.String())
+	if err := tmpl.text.Execute(&text, values); err != nil {
+		return "", "", "", err
+	}
+	if err := tmpl.html.Execute(&html, values); err != nil {
+		return "", "", "", err
+	}
+	return values["Subject"].(string), text.String(), html.String(), nil
+}
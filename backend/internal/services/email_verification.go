@@ -0,0 +1,152 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// tokenTypeEmailVerification marks email verification tokens
+const tokenTypeEmailVerification = "email_verification"
+
+// Email verification errors
+var (
+	// ErrEmailNotVerified is returned when the user's organization requires a
+	// verified email address for the action
+	ErrEmailNotVerified = errors.New("your organization requires a verified email address; please verify your email first")
+
+	errInvalidVerificationToken = errors.New("invalid or expired verification token")
+	errEmailAlreadyVerified     = errors.New("email address is already verified")
+)
+
+// VerificationRateLimitError is returned when a verification email is
+// requested again too soon
+type VerificationRateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *VerificationRateLimitError) Error() string {
+	return fmt.Sprintf("a verification email was sent recently; try again in %d seconds", int(e.RetryAfter.Seconds())+1)
+}
+
+// emailVerificationClaims are the claims of a verification token. The email
+// is included so that the token stops working if the address changes.
+type emailVerificationClaims struct {
+	Email string `json:"email"`
+	Type  string `json:"typ"`
+	jwt.RegisteredClaims
+}
+
+// sendVerificationEmail issues a verification token for the user's current
+// email address and sends it to them
+func (s *AuthService) sendVerificationEmail(user *models.User) error {
+	now := time.Now()
+	claims := &emailVerificationClaims{
+		Email: user.Email,
+		Type:  tokenTypeEmailVerification,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   user.ID,
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Duration(s.cfg.Email.VerificationTokenHours) * time.Hour)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(s.cfg.JWT.SecretKey))
+	if err != nil {
+		return err
+	}
+
+	return s.emails.SendAsync(&EmailRequest{
+		To:       user.Email,
+		UserID:   &user.ID,
+		Template: EmailTemplateEmailVerification,
+		Data: map[string]interface{}{
+			"Name":      displayName(user),
+			"Email":     user.Email,
+			"VerifyURL": s.cfg.Email.AppURL + "/verify-email?token=" + url.QueryEscape(token),
+			"ExpiresIn": fmt.Sprintf("%d hours", s.cfg.Email.VerificationTokenHours),
+		},
+	})
+}
+
+// VerifyEmail marks the email address a verification token was issued for as verified
+func (s *AuthService) VerifyEmail(tokenString string) (*models.User, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &emailVerificationClaims{}, func(token *jwt.Token) (interface{}, error) {
+		return []byte(s.cfg.JWT.SecretKey), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil || !token.Valid {
+		return nil, errInvalidVerificationToken
+	}
+	claims, ok := token.Claims.(*emailVerificationClaims)
+	if !ok || claims.Type != tokenTypeEmailVerification {
+		return nil, errInvalidVerificationToken
+	}
+
+	var user models.User
+	if err := s.db.First(&user, "id = ?", claims.Subject).Error; err != nil {
+		return nil, errInvalidVerificationToken
+	}
+	// The address has changed since the token was issued
+	if user.Email != claims.Email {
+		return nil, errInvalidVerificationToken
+	}
+	if user.EmailVerified {
+		return &user, nil
+	}
+
+	if err := s.db.Model(&user).Update("email_verified", true).Error; err != nil {
+		return nil, err
+	}
+	user.EmailVerified = true
+	return &user, nil
+}
+
+// ResendVerificationEmail sends the user a new verification email, at most
+// once per configured interval
+func (s *AuthService) ResendVerificationEmail(userID string) error {
+	var user models.User
+	if err := s.db.First(&user, "id = ?", userID).Error; err != nil {
+		return errors.New("user not found")
+	}
+	if user.EmailVerified {
+		return errEmailAlreadyVerified
+	}
+
+	// Claim the send with a conditional update, so concurrent requests
+	// cannot both get through
+	now := time.Now()
+	interval := time.Duration(s.cfg.Email.VerificationResendSeconds) * time.Second
+	result := s.db.Model(&models.User{}).
+		Where("id = ? AND (verification_sent_at IS NULL OR verification_sent_at <= ?)", user.ID, now.Add(-interval)).
+		Update("verification_sent_at", now)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		retryAfter := interval
+		if user.VerificationSentAt != nil {
+			retryAfter = max(time.Until(user.VerificationSentAt.Add(interval)), 0)
+		}
+		return &VerificationRateLimitError{RetryAfter: retryAfter}
+	}
+
+	return s.sendVerificationEmail(&user)
+}
+
+// checkEmailVerified returns ErrEmailNotVerified when the user has not
+// verified their email address and their organization requires it
+func checkEmailVerified(db *gorm.DB, userID string) error {
+	var user models.User
+	if err := db.Preload("Organization").First(&user, "id = ?", userID).Error; err != nil {
+		return errors.New("user not found")
+	}
+	if !user.EmailVerified && user.Organization != nil && user.Organization.RequireVerifiedEmail {
+		return ErrEmailNotVerified
+	}
+	return nil
+}
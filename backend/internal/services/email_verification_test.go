@@ -0,0 +1,270 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// verifyLinkPattern finds the token in the link of a verification email
+var verifyLinkPattern = regexp.MustCompile(`/verify-email\?token=(\S+)`)
+
+// verificationTokens waits for count verification emails to be sent and
+// returns the tokens from their links, oldest first
+func (at *authTest) verificationTokens(t *testing.T, count int) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var sent int64
+		at.db.Model(&models.EmailLog{}).Where("template = ? AND status = ?", EmailTemplateEmailVerification, EmailSent).Count(&sent)
+		if sent >= int64(count) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d verification emails sent, want %d", sent, count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Outbox file names start with the time they were written
+	dir := at.auth.cfg.Email.OutboxDir
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("reading the outbox: %v", err)
+	}
+	var tokens []string
+	for _, file := range files {
+		raw, err := os.Open(filepath.Join(dir, file.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		text := emailText(t, raw)
+		raw.Close()
+		if match := verifyLinkPattern.FindStringSubmatch(text); match != nil {
+			token, err := url.QueryUnescape(match[1])
+			if err != nil {
+				t.Fatalf("verification link token %q: %v", match[1], err)
+			}
+			tokens = append(tokens, token)
+		}
+	}
+	if len(tokens) != count {
+		t.Fatalf("%d verification links in the outbox, want %d", len(tokens), count)
+	}
+	return tokens
+}
+
+// emailText returns the decoded text part of a MIME message
+func emailText(t *testing.T, r io.Reader) string {
+	t.Helper()
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		t.Fatalf("parsing email: %v", err)
+	}
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("email content type: %v", err)
+	}
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if err != nil {
+			t.Fatalf("email has no text part: %v", err)
+		}
+		if strings.HasPrefix(part.Header.Get("Content-Type"), "text/plain") {
+			text, err := io.ReadAll(part)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return string(text)
+		}
+	}
+}
+
+// signVerification signs a verification token for the test user, changed by
+// modify, with the secret
+func (at *authTest) signVerification(t *testing.T, secret string, modify func(claims *emailVerificationClaims)) string {
+	t.Helper()
+	claims := &emailVerificationClaims{
+		Email: at.user.Email,
+		Type:  tokenTypeEmailVerification,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   at.user.ID,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}
+	modify(claims)
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestRegisterVerifiesEmail(t *testing.T) {
+	at := newAuthTest(t)
+	resp, err := at.auth.Register(&RegisterRequest{Email: "bob@example.com", Password: testPassword, FirstName: "Bob", LastName: "Smith"},
+		&ClientInfo{IPAddress: "198.51.100.1"})
+	if err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	if resp.User.EmailVerified {
+		t.Error("new user starts with a verified email")
+	}
+
+	// The link in the email verifies the address
+	token := at.verificationTokens(t, 1)[0]
+	user, err := at.auth.VerifyEmail(token)
+	if err != nil {
+		t.Fatalf("VerifyEmail() error = %v", err)
+	}
+	var stored models.User
+	at.db.First(&stored, "id = ?", resp.User.ID)
+	if user.ID != resp.User.ID || !user.EmailVerified || !stored.EmailVerified {
+		t.Errorf("VerifyEmail() = %s (verified %v, stored %v), want the new user verified", user.ID, user.EmailVerified, stored.EmailVerified)
+	}
+
+	// Following the link again is harmless
+	if user, err := at.auth.VerifyEmail(token); err != nil || !user.EmailVerified {
+		t.Errorf("second VerifyEmail() = %v, %v, want the verified user", user, err)
+	}
+}
+
+func TestVerifyEmailRefused(t *testing.T) {
+	tests := []struct {
+		name  string
+		token func(t *testing.T, at *authTest) string
+	}{
+		{name: "malformed", token: func(t *testing.T, at *authTest) string {
+			return "not-a-token"
+		}},
+		{name: "expired", token: func(t *testing.T, at *authTest) string {
+			return at.signVerification(t, at.auth.cfg.JWT.SecretKey, func(claims *emailVerificationClaims) {
+				claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+			})
+		}},
+		{name: "other secret", token: func(t *testing.T, at *authTest) string {
+			return at.signVerification(t, "not-the-secret", func(claims *emailVerificationClaims) {})
+		}},
+		{name: "other token type", token: func(t *testing.T, at *authTest) string {
+			return at.signVerification(t, at.auth.cfg.JWT.SecretKey, func(claims *emailVerificationClaims) {
+				claims.Type = "access"
+			})
+		}},
+		// Access tokens carry the email but are not verification tokens
+		{name: "access token", token: func(t *testing.T, at *authTest) string {
+			return at.login(t, "curl/8.0").AccessToken
+		}},
+		{name: "unknown user", token: func(t *testing.T, at *authTest) string {
+			return at.signVerification(t, at.auth.cfg.JWT.SecretKey, func(claims *emailVerificationClaims) {
+				claims.Subject = "no-such-user"
+			})
+		}},
+		// The user changed their address after the token was sent
+		{name: "old address", token: func(t *testing.T, at *authTest) string {
+			return at.signVerification(t, at.auth.cfg.JWT.SecretKey, func(claims *emailVerificationClaims) {
+				claims.Email = "ann.old@example.com"
+			})
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			at := newAuthTest(t)
+			at.db.Model(at.user).Update("email_verified", false)
+			token := tt.token(t, at)
+
+			if _, err := at.auth.VerifyEmail(token); !errors.Is(err, errInvalidVerificationToken) {
+				t.Errorf("VerifyEmail() error = %v, want errInvalidVerificationToken", err)
+			}
+			var stored models.User
+			at.db.First(&stored, "id = ?", at.user.ID)
+			if stored.EmailVerified {
+				t.Error("refused token verified the email")
+			}
+		})
+	}
+}
+
+func TestResendVerificationEmail(t *testing.T) {
+	at := newAuthTest(t)
+	at.db.Model(at.user).Updates(map[string]interface{}{"email_verified": false, "verification_sent_at": time.Now()})
+
+	// Another email is refused until the interval has passed
+	var limited *VerificationRateLimitError
+	if err := at.auth.ResendVerificationEmail(at.user.ID); !errors.As(err, &limited) {
+		t.Fatalf("ResendVerificationEmail() error = %v, want a VerificationRateLimitError", err)
+	}
+	if limited.RetryAfter <= 0 || limited.RetryAfter > time.Minute {
+		t.Errorf("RetryAfter = %s, want the rest of the minute", limited.RetryAfter)
+	}
+
+	at.db.Model(at.user).Update("verification_sent_at", time.Now().Add(-2*time.Minute))
+	if err := at.auth.ResendVerificationEmail(at.user.ID); err != nil {
+		t.Fatalf("ResendVerificationEmail() error = %v", err)
+	}
+	if err := at.auth.ResendVerificationEmail(at.user.ID); !errors.As(err, &limited) {
+		t.Errorf("ResendVerificationEmail() right after sending error = %v, want a VerificationRateLimitError", err)
+	}
+
+	// Once verified, there is nothing to resend
+	if _, err := at.auth.VerifyEmail(at.verificationTokens(t, 1)[0]); err != nil {
+		t.Fatalf("VerifyEmail() error = %v", err)
+	}
+	if err := at.auth.ResendVerificationEmail(at.user.ID); !errors.Is(err, errEmailAlreadyVerified) {
+		t.Errorf("ResendVerificationEmail() when verified error = %v, want errEmailAlreadyVerified", err)
+	}
+	if err := at.auth.ResendVerificationEmail("no-such-user"); err == nil {
+		t.Error("ResendVerificationEmail() for an unknown user error = nil, want an error")
+	}
+}
+
+func TestCheckEmailVerified(t *testing.T) {
+	db := newTestDB(t, &models.Organization{}, &models.User{})
+	strict := &models.Organization{Name: "Strict", Slug: "strict", RequireVerifiedEmail: true}
+	relaxed := &models.Organization{Name: "Relaxed", Slug: "relaxed"}
+	for _, org := range []*models.Organization{strict, relaxed} {
+		if err := db.Create(org).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		org      *models.Organization
+		verified bool
+		want     error
+	}{
+		{name: "unverified in a strict organization", org: strict, want: ErrEmailNotVerified},
+		{name: "verified in a strict organization", org: strict, verified: true},
+		{name: "unverified in a relaxed organization", org: relaxed},
+		{name: "unverified without an organization"},
+	}
+
+	for i, tt := range tests {
+		user := &models.User{Email: fmt.Sprintf("user%d@example.com", i), Username: fmt.Sprintf("user%d", i), EmailVerified: tt.verified}
+		if tt.org != nil {
+			user.OrganizationID = &tt.org.ID
+		}
+		if err := db.Create(user).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := checkEmailVerified(db, user.ID); err != tt.want {
+			t.Errorf("checkEmailVerified() for a user %s error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// Execution event types
+const (
+	ExecutionEventStatus   = "status"
+	ExecutionEventLog      = "log"
+	ExecutionEventToolCall = "tool_call"
+	ExecutionEventOutput   = "output"
+	ExecutionEventError    = "error"
+)
+
+// executionEventsChannel is the Redis channel carrying events between server instances
+const executionEventsChannel = "vagais:executions:events"
+
+// executionEventBuffer is the number of events buffered per subscriber
+const executionEventBuffer = 64
+
+// ExecutionEvent represents a progress update for an execution
+type ExecutionEvent struct {
+	ExecutionID string                 `json:"execution_id"`
+	Type        string                 `json:"type"`
+	Status      string                 `json:"status,omitempty"`
+	Message     string                 `json:"message,omitempty"`
+	Data        map[string]interface{} `json:"data,omitempty"`
+	Timestamp   time.Time              `json:"timestamp"`
+}
+
+// IsTerminal reports whether the event ends the execution
+func (e *ExecutionEvent) IsTerminal() bool {
+	return e.Type == ExecutionEventStatus && IsTerminalExecutionStatus(e.Status)
+}
+
+// IsTerminalExecutionStatus reports whether an execution in this status will not change again
+func IsTerminalExecutionStatus(status string) bool {
+	return status == "completed" || status == "failed" || status == "cancelled"
+}
+
+// executionEventEnvelope wraps an event published to Redis
+type executionEventEnvelope struct {
+	Origin string         `json:"origin"`
+	Event  ExecutionEvent `json:"event"`
+}
+
+// executionSubscriber receives the events of one execution
+type executionSubscriber struct {
+	events chan ExecutionEvent
+	once   sync.Once
+}
+
+func (s *executionSubscriber) close() {
+	s.once.Do(func() {
+		close(s.events)
+	})
+}
+
+// ExecutionEventBus fans execution events out to subscribers on this and,
+// when Redis is available, every other server instance
+type ExecutionEventBus struct {
+	instanceID string
+	redis      *redis.Client
+
+	mu          sync.Mutex
+	subscribers map[string]map[*executionSubscriber]struct{}
+}
+
+// NewExecutionEventBus creates an event bus, relaying through Redis when a client is given
+func NewExecutionEventBus(redisClient *redis.Client) *ExecutionEventBus {
+	bus := &ExecutionEventBus{
+		instanceID:  uuid.New().String(),
+		redis:       redisClient,
+		subscribers: make(map[string]map[*executionSubscriber]struct{}),
+	}
+	if redisClient != nil {
+		go bus.relay()
+	}
+	return bus
+}
+
+// Subscribe returns a channel of events for an execution and a function that
+// ends the subscription. The channel is closed when the subscription ends or
+// the subscriber falls too far behind.
+func (b *ExecutionEventBus) Subscribe(executionID string) (<-chan ExecutionEvent, func()) {
+	sub := &executionSubscriber{events: make(chan ExecutionEvent, executionEventBuffer)}
+
+	b.mu.Lock()
+	subs, ok := b.subscribers[executionID]
+	if !ok {
+		subs = make(map[*executionSubscriber]struct{})
+		b.subscribers[executionID] = subs
+	}
+	subs[sub] = struct{}{}
+	b.mu.Unlock()
+
+	return sub.events, func() {
+		b.mu.Lock()
+		b.remove(executionID, sub)
+		b.mu.Unlock()
+	}
+}
+
+// remove drops a subscriber; the caller must hold b.mu
+func (b *ExecutionEventBus) remove(executionID string, sub *executionSubscriber) {
+	if subs, ok := b.subscribers[executionID]; ok {
+		delete(subs, sub)
+		if len(subs) == 0 {
+			delete(b.subscribers, executionID)
+		}
+	}
+	sub.close()
+}
+
+// Publish sends an event to every subscriber of its execution
+func (b *ExecutionEventBus) Publish(event ExecutionEvent) {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+
+	if b.redis != nil {
+		data, err := json.Marshal(executionEventEnvelope{Origin: b.instanceID, Event: event})
+		if err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := b.redis.Publish(ctx, executionEventsChannel, data).Err(); err != nil {
+				fmt.Printf("Failed to publish execution event: %v\n", err)
+			}
+			cancel()
+		}
+	}
+
+	b.deliver(event)
+}
+
+// deliver hands an event to the local subscribers
+func (b *ExecutionEventBus) deliver(event ExecutionEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subscribers[event.ExecutionID] {
+		select {
+		case sub.events <- event:
+		default:
+			// Disconnect subscribers that stopped reading rather than block the executor
+			b.remove(event.ExecutionID, sub)
+		}
+	}
+}
+
+// relay delivers events published by other instances
+func (b *ExecutionEventBus) relay() {
+	pubsub := b.redis.Subscribe(context.Background(), executionEventsChannel)
+	defer pubsub.Close()
+
+	for msg := range pubsub.Channel() {
+		var envelope executionEventEnvelope
+		if err := json.Unmarshal([]byte(msg.Payload), &envelope); err != nil {
+			continue
+		}
+		if envelope.Origin == b.instanceID {
+			continue
+		}
+		b.deliver(envelope.Event)
+	}
+}
+
+// ExecutionReporter publishes the progress of a single execution
+type ExecutionReporter struct {
+	bus         *ExecutionEventBus
+	executionID string
+}
+
+// NewExecutionReporter creates a reporter for an execution
+func NewExecutionReporter(bus *ExecutionEventBus, executionID string) *ExecutionReporter {
+	return &ExecutionReporter{bus: bus, executionID: executionID}
+}
+
+// ExecutionID returns the ID of the execution being reported, or "" for a nil reporter
+func (r *ExecutionReporter) ExecutionID() string {
+	if r == nil {
+		return ""
+	}
+	return r.executionID
+}
+
+func (r *ExecutionReporter) publish(event ExecutionEvent) {
+	if r == nil || r.bus == nil {
+		return
+	}
+	event.ExecutionID = r.executionID
+	r.bus.Publish(event)
+}
+
+// Status reports a status change
+func (r *ExecutionReporter) Status(status string, message string) {
+	r.publish(ExecutionEvent{Type: ExecutionEventStatus, Status: status, Message: message})
+}
+
+// Log reports a log line
+func (r *ExecutionReporter) Log(format string, args ...interface{}) {
+	r.publish(ExecutionEvent{Type: ExecutionEventLog, Message: fmt.Sprintf(format, args...)})
+}
+
+// ToolCall reports an intermediate tool invocation and its result
+func (r *ExecutionReporter) ToolCall(name string, input, output map[string]interface{}, err error) {
+	data := map[string]interface{}{
+		"tool":   name,
+		"input":  input,
+		"output": output,
+	}
+	if err != nil {
+		data["error"] = err.Error()
+	}
+	r.publish(ExecutionEvent{Type: ExecutionEventToolCall, Message: name, Data: data})
+}
+
+// Output reports the final output
+func (r *ExecutionReporter) Output(output map[string]interface{}) {
+	r.publish(ExecutionEvent{Type: ExecutionEventOutput, Data: output})
+}
+
+// executionReporterKey is the context key holding the ExecutionReporter
+type executionReporterKey struct{}
+
+// WithExecutionReporter returns a context that carries the reporter to the executor
+func WithExecutionReporter(ctx context.Context, reporter *ExecutionReporter) context.Context {
+	return context.WithValue(ctx, executionReporterKey{}, reporter)
+}
+
+// ExecutionReporterFrom returns the reporter carried by ctx, or nil. The
+// reporter's methods are safe to call on nil.
+func ExecutionReporterFrom(ctx context.Context) *ExecutionReporter {
+	reporter, _ := ctx.Value(executionReporterKey{}).(*ExecutionReporter)
+	return reporter
+}
@@ -0,0 +1,212 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// maxRetryDelay caps the backoff between attempts of a job
+const maxRetryDelay = 5 * time.Minute
+
+// ExecutionWorkerPool runs queued executions on a fixed number of workers
+type ExecutionWorkerPool struct {
+	runtime *RuntimeService
+	queue   JobQueue
+	cfg     config.QueueConfig
+
+	// instance prefixes worker IDs; it is unique to the process so that no two
+	// processes, even on the same host, share a worker ID
+	instance string
+
+	cancel context.CancelCauseFunc
+	wg     sync.WaitGroup
+}
+
+// NewExecutionWorkerPool creates a worker pool for the runtime's queue
+func NewExecutionWorkerPool(runtime *RuntimeService, cfg *config.Config) *ExecutionWorkerPool {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "worker"
+	}
+	instance := fmt.Sprintf("%s-%d-%s", host, os.Getpid(), uuid.New().String()[:8])
+
+	return &ExecutionWorkerPool{
+		runtime:  runtime,
+		queue:    runtime.Queue(),
+		cfg:      cfg.Queue,
+		instance: instance,
+	}
+}
+
+// Start reclaims work orphaned by a previous process and starts the workers
+func (p *ExecutionWorkerPool) Start() {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	p.cancel = cancel
+
+	if n, err := p.queue.Reclaim(ctx); err != nil {
+		fmt.Printf("Failed to reclaim execution jobs: %v\n", err)
+	} else if n > 0 {
+		fmt.Printf("Requeued %d execution job(s) whose lease expired\n", n)
+	}
+	if n, err := p.runtime.ReclaimOrphanedExecutions(); err != nil {
+		fmt.Printf("Failed to reclaim orphaned executions: %v\n", err)
+	} else if n > 0 {
+		fmt.Printf("Marked %d orphaned execution(s) as failed\n", n)
+	}
+
+	workers := p.cfg.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go p.work(ctx, fmt.Sprintf("%s-%d", p.instance, i))
+	}
+
+	// Periodically requeue jobs whose worker on another instance died
+	p.wg.Add(1)
+	go p.reclaimExpired(ctx)
+}
+
+// Stop aborts running executions, returning them to the queue, and waits for the workers to exit
+func (p *ExecutionWorkerPool) Stop() {
+	if p.cancel == nil {
+		return
+	}
+	p.cancel(ErrServerShutdown)
+	p.wg.Wait()
+}
+
+// work claims and runs jobs until the pool is stopped
+func (p *ExecutionWorkerPool) work(ctx context.Context, workerID string) {
+	defer p.wg.Done()
+
+	limits := JobLimits{PerAgent: p.cfg.PerAgentLimit, PerOrg: p.cfg.PerOrgLimit}
+	poll := time.Duration(p.cfg.PollIntervalMs) * time.Millisecond
+	if poll <= 0 {
+		poll = time.Second
+	}
+
+	for ctx.Err() == nil {
+		job, err := p.queue.Dequeue(ctx, workerID, p.lease(), limits)
+		if err != nil && ctx.Err() == nil {
+			fmt.Printf("Worker %s failed to dequeue: %v\n", workerID, err)
+		}
+		if job == nil {
+			p.queue.Wait(ctx, poll)
+			continue
+		}
+		p.run(ctx, job)
+	}
+}
+
+// run executes one job while keeping its lease alive
+func (p *ExecutionWorkerPool) run(ctx context.Context, job *models.ExecutionJob) {
+	ctx, abort := context.WithCancelCause(ctx)
+	defer abort(nil)
+	heartbeatCtx, stopHeartbeat := context.WithCancel(ctx)
+	defer stopHeartbeat()
+	go p.heartbeat(heartbeatCtx, job, abort)
+
+	outcome, err := p.runtime.RunExecutionJob(ctx, job)
+	stopHeartbeat()
+
+	// The job now belongs to another worker, which records its outcome
+	if errors.Is(context.Cause(ctx), ErrJobLeaseLost) {
+		fmt.Printf("Worker abandoned job %s: %v\n", job.ID, ErrJobLeaseLost)
+		return
+	}
+
+	// Record the outcome even when the pool is shutting down
+	bg := context.Background()
+	switch outcome {
+	case JobRetry:
+		err = p.queue.Retry(bg, job, p.backoff(job.Attempts), err.Error())
+	case JobRelease:
+		err = p.queue.Release(bg, job)
+	case JobFailed:
+		err = p.queue.Complete(bg, job, "failed", err.Error())
+	case JobCancelled:
+		err = p.queue.Complete(bg, job, "cancelled", "")
+	default:
+		err = p.queue.Complete(bg, job, "completed", "")
+	}
+	if err != nil {
+		fmt.Printf("Failed to update job %s: %v\n", job.ID, err)
+	}
+}
+
+// heartbeat extends the job lease until ctx is cancelled, aborting the run
+// if the lease was lost to another worker
+func (p *ExecutionWorkerPool) heartbeat(ctx context.Context, job *models.ExecutionJob, abort context.CancelCauseFunc) {
+	ticker := time.NewTicker(p.lease() / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := p.queue.Extend(ctx, job, p.lease())
+			if errors.Is(err, ErrJobLeaseLost) {
+				abort(err)
+				return
+			}
+			if err != nil && ctx.Err() == nil {
+				fmt.Printf("Failed to extend lease on job %s: %v\n", job.ID, err)
+			}
+		}
+	}
+}
+
+// reclaimExpired requeues jobs with expired leases once per lease period
+func (p *ExecutionWorkerPool) reclaimExpired(ctx context.Context) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.lease())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := p.queue.Reclaim(ctx); err != nil && ctx.Err() == nil {
+				fmt.Printf("Failed to reclaim expired jobs: %v\n", err)
+			}
+		}
+	}
+}
+
+// lease returns how long a claimed job stays locked without a heartbeat
+func (p *ExecutionWorkerPool) lease() time.Duration {
+	if p.cfg.LeaseSeconds <= 0 {
+		return time.Minute
+	}
+	return time.Duration(p.cfg.LeaseSeconds) * time.Second
+}
+
+// backoff returns the exponential delay before the next attempt, with jitter
+func (p *ExecutionWorkerPool) backoff(attempts int) time.Duration {
+	delay := time.Duration(p.cfg.RetryBaseDelayMs) * time.Millisecond
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	if delay > 0 {
+		delay += time.Duration(rand.Int63n(int64(delay)/5 + 1))
+	}
+	return delay
+}
@@ -2,6 +2,7 @@ package services
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -230,37 +231,45 @@ func (s *IntegrationService) GetLLMProviders() ([]LLMProvider, error) {
 	return providers, nil
 }
 
-// TestLLMConnection tests connection to an LLM provider
-func (s *IntegrationService) TestLLMConnection(provider LLMProvider) error {
-	// TODO: Implement actual connection testing
-	switch provider.Type {
-	case "openai":
-		return s.testOpenAIConnection(provider)
-	case "anthropic":
-		return s.testAnthropicConnection(provider)
-	case "local":
-		return s.testLocalConnection(provider)
-	default:
-		return errors.New("unsupported provider type")
-	}
+// LLMConnectionTestResult represents the outcome of an LLM provider connection test
+type LLMConnectionTestResult struct {
+	Success   bool     `json:"success"`
+	LatencyMs int64    `json:"latency_ms"`
+	Models    []string `json:"models,omitempty"`
+	AuthError bool     `json:"auth_error"`
+	Error     string   `json:"error,omitempty"`
 }
 
-// testOpenAIConnection tests OpenAI connection
-func (s *IntegrationService) testOpenAIConnection(provider LLMProvider) error {
-	// TODO: Implement OpenAI connection test
-	return nil
-}
+// TestLLMConnection tests the connection to a stored LLM provider by listing
+// its models, using only the provider's stored settings
+func (s *IntegrationService) TestLLMConnection(name string) (*LLMConnectionTestResult, error) {
+	var stored models.LLMProvider
+	if err := s.db.Where("name = ?", name).First(&stored).Error; err != nil {
+		return nil, errors.New("LLM provider not found")
+	}
 
-// testAnthropicConnection tests Anthropic connection
-func (s *IntegrationService) testAnthropicConnection(provider LLMProvider) error {
-	// TODO: Implement Anthropic connection test
-	return nil
-}
+	client, err := NewLLMClientForProvider(&stored, s.cfg)
+	if err != nil {
+		return nil, err
+	}
 
-// testLocalConnection tests local LLM connection
-func (s *IntegrationService) testLocalConnection(provider LLMProvider) error {
-	// TODO: Implement local LLM connection test
-	return nil
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	modelIDs, err := client.ListModels(ctx)
+	result := &LLMConnectionTestResult{
+		LatencyMs: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		result.Error = err.Error()
+		result.AuthError = IsLLMAuthError(err)
+		return result, nil
+	}
+
+	result.Success = true
+	result.Models = modelIDs
+	return result, nil
 }
 
 // GetIntegrationStats retrieves integration statistics
@@ -0,0 +1,45 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+func TestTestLLMConnection(t *testing.T) {
+	db := newTestDB(t, &models.LLMProvider{})
+	stub := newLLMStub(t, respondJSON(http.StatusOK, `{"data":[{"id":"llama3"}]}`))
+	saveProvider := func(name, providerType string, settings map[string]interface{}) {
+		t.Helper()
+		raw, _ := json.Marshal(settings)
+		if err := db.Create(&models.LLMProvider{Name: name, Type: providerType, IsActive: true, Config: raw}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	saveProvider("Local", "local", map[string]interface{}{"endpoint": stub.URL + "/v1"})
+	saveProvider("Proxy", "openai", map[string]interface{}{"base_url": stub.URL + "/v1"})
+
+	service := NewIntegrationService(db, testLLMConfig())
+
+	result, err := service.TestLLMConnection("Local")
+	if err != nil || !result.Success || !reflect.DeepEqual(result.Models, []string{"llama3"}) {
+		t.Fatalf("TestLLMConnection(Local) = %+v, %v, want the stored endpoint's models", result, err)
+	}
+	if _, path, headers, _ := stub.request(); path != "/v1/models" || headers.Get("Authorization") != "" {
+		t.Errorf("request = %s with Authorization %q, want /v1/models without a key", path, headers.Get("Authorization"))
+	}
+
+	// Hosted provider types may not reach internal addresses
+	result, err = service.TestLLMConnection("Proxy")
+	if err != nil || result.Success || !strings.Contains(result.Error, "is not allowed") {
+		t.Errorf("TestLLMConnection(Proxy) = %+v, %v, want the connection refused", result, err)
+	}
+
+	if _, err := service.TestLLMConnection("Unknown"); err == nil {
+		t.Error("TestLLMConnection(Unknown): want an error")
+	}
+}
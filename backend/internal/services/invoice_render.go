@@ -0,0 +1,236 @@
+package services
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// renderInvoiceCSV writes one row per invoice line followed by the totals
+func renderInvoiceCSV(invoice *models.Invoice) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	rows := [][]string{
+		{"invoice_number", "period_start", "period_end", "type", "description", "agent_id", "purchase_id", "quantity", "unit_price", "amount", "credits", "currency"},
+	}
+	for _, line := range invoice.Lines {
+		rows = append(rows, []string{
+			invoice.Number,
+			invoice.PeriodStart.Format("2006-01-02"),
+			invoice.PeriodEnd.Format("2006-01-02"),
+			line.Type,
+			line.Description,
+			stringValue(line.AgentID),
+			stringValue(line.PurchaseID),
+			strconv.FormatInt(line.Quantity, 10),
+			formatAmount(line.UnitPrice),
+			formatAmount(line.Amount),
+			strconv.FormatInt(line.Credits, 10),
+			invoice.Currency,
+		})
+	}
+	totals := [][2]string{
+		{"Subtotal", formatAmount(invoice.Subtotal)},
+		{fmt.Sprintf("%s (%s%%)", invoice.TaxName, formatRate(invoice.TaxRate)), formatAmount(invoice.TaxAmount)},
+		{"Total", formatAmount(invoice.Total)},
+	}
+	for _, total := range totals {
+		rows = append(rows, []string{invoice.Number, "", "", "total", total[0], "", "", "", "", total[1], "", invoice.Currency})
+	}
+
+	if err := w.WriteAll(rows); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// PDF page layout, in points on an A4 page
+const (
+	pdfPageWidth   = 595
+	pdfPageHeight  = 842
+	pdfMargin      = 50
+	pdfLineHeight  = 14
+	pdfFontSize    = 10
+	pdfLinesOnPage = (pdfPageHeight - 2*pdfMargin) / pdfLineHeight
+)
+
+// pdfText is a line of text placed at a column of the page
+type pdfText struct {
+	x    int
+	text string
+	bold bool
+}
+
+// renderInvoicePDF lays the invoice out as text on one or more A4 pages
+func renderInvoicePDF(invoice *models.Invoice, cfg config.BillingConfig) []byte {
+	var lines [][]pdfText
+	add := func(texts ...pdfText) {
+		lines = append(lines, texts)
+	}
+
+	add(pdfText{x: pdfMargin, text: cfg.CompanyName, bold: true})
+	if cfg.CompanyAddress != "" {
+		add(pdfText{x: pdfMargin, text: cfg.CompanyAddress})
+	}
+	add()
+	add(pdfText{x: pdfMargin, text: "INVOICE " + invoice.Number, bold: true})
+	add(pdfText{x: pdfMargin, text: "Issued: " + invoice.IssuedAt.Format("2006-01-02")})
+	if invoice.DueAt != nil {
+		add(pdfText{x: pdfMargin, text: "Due: " + invoice.DueAt.Format("2006-01-02")})
+	}
+	add(pdfText{x: pdfMargin, text: fmt.Sprintf("Period: %s to %s",
+		invoice.PeriodStart.Format("2006-01-02"), invoice.PeriodEnd.AddDate(0, 0, -1).Format("2006-01-02"))})
+	add(pdfText{x: pdfMargin, text: "Status: " + invoice.Status})
+	add()
+	add(pdfText{x: pdfMargin, text: "Bill to", bold: true})
+	add(pdfText{x: pdfMargin, text: invoiceBillTo(invoice)})
+	add()
+
+	columns := []int{pdfMargin, 330, 380, 450, 510}
+	add(
+		pdfText{x: columns[0], text: "Description", bold: true},
+		pdfText{x: columns[1], text: "Qty", bold: true},
+		pdfText{x: columns[2], text: "Unit price", bold: true},
+		pdfText{x: columns[3], text: "Amount", bold: true},
+		pdfText{x: columns[4], text: "Credits", bold: true},
+	)
+	for _, line := range invoice.Lines {
+		add(
+			pdfText{x: columns[0], text: truncate(line.Description, 50)},
+			pdfText{x: columns[1], text: strconv.FormatInt(line.Quantity, 10)},
+			pdfText{x: columns[2], text: formatAmount(line.UnitPrice)},
+			pdfText{x: columns[3], text: formatAmount(line.Amount)},
+			pdfText{x: columns[4], text: strconv.FormatInt(line.Credits, 10)},
+		)
+	}
+	add()
+	add(pdfText{x: columns[2], text: "Subtotal"}, pdfText{x: columns[3], text: formatAmount(invoice.Subtotal)})
+	add(pdfText{x: columns[2], text: fmt.Sprintf("%s %s%%", invoice.TaxName, formatRate(invoice.TaxRate))},
+		pdfText{x: columns[3], text: formatAmount(invoice.TaxAmount)})
+	add(pdfText{x: columns[2], text: "Total " + invoice.Currency, bold: true},
+		pdfText{x: columns[3], text: formatAmount(invoice.Total), bold: true})
+
+	// Split the lines into pages and draw each as a content stream
+	var pages []string
+	for start := 0; start < len(lines); start += pdfLinesOnPage {
+		end := start + pdfLinesOnPage
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		var content strings.Builder
+		for i, texts := range lines[start:end] {
+			y := pdfPageHeight - pdfMargin - i*pdfLineHeight
+			for _, t := range texts {
+				font := "F1"
+				if t.bold {
+					font = "F2"
+				}
+				fmt.Fprintf(&content, "BT /%s %d Tf %d %d Td (%s) Tj ET\n", font, pdfFontSize, t.x, y, pdfEscape(t.text))
+			}
+		}
+		pages = append(pages, content.String())
+	}
+
+	return buildPDF(pages)
+}
+
+// buildPDF assembles a PDF document with one page per content stream
+func buildPDF(pages []string) []byte {
+	var buf bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	buf.WriteString("%PDF-1.4\n")
+
+	// Objects 1-4 are the catalog, page tree and fonts; each page then takes two objects
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, content := range pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, 6+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return buf.Bytes()
+}
+
+// pdfEscape escapes text for a PDF string literal; characters outside ASCII are replaced
+func pdfEscape(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 32 || r > 126:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// invoiceBillTo names the organization or user an invoice is addressed to
+func invoiceBillTo(invoice *models.Invoice) string {
+	switch {
+	case invoice.Organization != nil:
+		return invoice.Organization.Name
+	case invoice.User != nil:
+		name := strings.TrimSpace(invoice.User.FirstName + " " + invoice.User.LastName)
+		if name == "" {
+			return invoice.User.Email
+		}
+		return fmt.Sprintf("%s <%s>", name, invoice.User.Email)
+	case invoice.OrganizationID != nil:
+		return *invoice.OrganizationID
+	default:
+		return stringValue(invoice.UserID)
+	}
+}
+
+// formatAmount formats a currency amount with two decimals
+func formatAmount(amount float64) string {
+	return strconv.FormatFloat(amount, 'f', 2, 64)
+}
+
+// formatRate formats a tax rate fraction as a percentage
+func formatRate(rate float64) string {
+	return strconv.FormatFloat(rate*100, 'f', -1, 64)
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
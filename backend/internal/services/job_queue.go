@@ -0,0 +1,324 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// jobWakeupList is the Redis list used to wake idle workers when a job is enqueued
+const jobWakeupList = "vagais:jobs:wakeup"
+
+// jobWakeupListMax bounds the wake-up list; signals nobody is waiting for
+// would otherwise pile up while all workers are busy
+const jobWakeupListMax = 100
+
+// ErrJobLeaseLost is returned when a job changes hands because its lease expired
+var ErrJobLeaseLost = errors.New("job lease was lost")
+
+// dequeueCandidates is how many due jobs are considered per dequeue attempt
+const dequeueCandidates = 20
+
+// JobLimits caps how many jobs may run at once
+type JobLimits struct {
+	PerAgent int
+	PerOrg   int
+}
+
+// JobQueue stores execution jobs and hands them to workers. Extend, Complete,
+// Retry and Release only change a job still held by the worker that claimed
+// it, and return ErrJobLeaseLost otherwise.
+type JobQueue interface {
+	// Enqueue adds a job that becomes available at job.AvailableAt
+	Enqueue(ctx context.Context, job *models.ExecutionJob) error
+	// Dequeue claims the next due job within the limits, returning nil when none is ready
+	Dequeue(ctx context.Context, workerID string, lease time.Duration, limits JobLimits) (*models.ExecutionJob, error)
+	// Extend renews the lease on a claimed job
+	Extend(ctx context.Context, job *models.ExecutionJob, lease time.Duration) error
+	// Complete marks a job as finished with the given status
+	Complete(ctx context.Context, job *models.ExecutionJob, status string, lastError string) error
+	// Retry releases a job so it runs again after delay
+	Retry(ctx context.Context, job *models.ExecutionJob, delay time.Duration, lastError string) error
+	// Release returns an interrupted job to the queue without counting the attempt
+	Release(ctx context.Context, job *models.ExecutionJob) error
+
+	// Reclaim requeues running jobs whose lease expired
+	Reclaim(ctx context.Context) (int64, error)
+	// Wait blocks until a job may be available or the timeout elapses
+	Wait(ctx context.Context, timeout time.Duration)
+}
+
+// DBJobQueue is a JobQueue kept in the execution_jobs table
+type DBJobQueue struct {
+	db *gorm.DB
+}
+
+// NewDBJobQueue creates a database-backed job queue
+func NewDBJobQueue(db *gorm.DB) *DBJobQueue {
+	return &DBJobQueue{db: db}
+}
+
+// Enqueue adds a job to the queue
+func (q *DBJobQueue) Enqueue(ctx context.Context, job *models.ExecutionJob) error {
+	job.Status = "queued"
+	if job.AvailableAt.IsZero() {
+		job.AvailableAt = time.Now()
+	}
+	return q.db.WithContext(ctx).Create(job).Error
+}
+
+// Dequeue claims the oldest due job whose agent and organization are below their limits
+func (q *DBJobQueue) Dequeue(ctx context.Context, workerID string, lease time.Duration, limits JobLimits) (*models.ExecutionJob, error) {
+	db := q.db.WithContext(ctx)
+	now := time.Now()
+
+	var candidates []models.ExecutionJob
+	if err := db.Where("status = ? AND available_at <= ?", "queued", now).
+		Order("available_at ASC").Limit(dequeueCandidates).Find(&candidates).Error; err != nil {
+		return nil, err
+	}
+
+	for i := range candidates {
+		job := &candidates[i]
+
+		lockedUntil := now.Add(lease)
+		claimed, err := q.claim(db, job, workerID, lockedUntil, limits)
+		if err != nil {
+			return nil, err
+		}
+		if !claimed {
+			continue
+		}
+
+		job.Status = "running"
+		job.LockedBy = workerID
+		job.LockedUntil = &lockedUntil
+		job.Attempts++
+		return job, nil
+	}
+
+	return nil, nil
+}
+
+// claim takes the job for the worker if no other worker got to it first and
+// its agent and organization are below their limits. The agent and
+// organization rows are locked before counting, so claims against the same
+// limit are made one at a time.
+func (q *DBJobQueue) claim(db *gorm.DB, job *models.ExecutionJob, workerID string, lockedUntil time.Time, limits JobLimits) (bool, error) {
+	claimed := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if limits.PerAgent > 0 {
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").
+				Where("id = ?", job.AgentID).Find(&[]models.Agent{}).Error; err != nil {
+				return err
+			}
+			running, err := q.countRunning(tx, "agent_id = ?", job.AgentID)
+			if err != nil {
+				return err
+			}
+			if running >= int64(limits.PerAgent) {
+				return nil
+			}
+		}
+		if limits.PerOrg > 0 && job.OrganizationID != nil {
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").
+				Where("id = ?", *job.OrganizationID).Find(&[]models.Organization{}).Error; err != nil {
+				return err
+			}
+			running, err := q.countRunning(tx, "organization_id = ?", *job.OrganizationID)
+			if err != nil {
+				return err
+			}
+			if running >= int64(limits.PerOrg) {
+				return nil
+			}
+		}
+
+		result := tx.Model(&models.ExecutionJob{}).
+			Where("id = ? AND status = ?", job.ID, "queued").
+			Updates(map[string]interface{}{
+				"status":       "running",
+				"locked_by":    workerID,
+				"locked_until": lockedUntil,
+				"attempts":     gorm.Expr("attempts + ?", 1),
+			})
+		claimed = result.RowsAffected > 0
+		return result.Error
+	})
+	return claimed, err
+}
+
+// countRunning counts jobs holding a live lease that match the condition
+func (q *DBJobQueue) countRunning(db *gorm.DB, condition string, value interface{}) (int64, error) {
+	var count int64
+	err := db.Model(&models.ExecutionJob{}).
+		Where("status = ? AND locked_until > ?", "running", time.Now()).
+		Where(condition, value).
+		Count(&count).Error
+	return count, err
+}
+
+// Extend renews the lease on a job still held by its worker
+func (q *DBJobQueue) Extend(ctx context.Context, job *models.ExecutionJob, lease time.Duration) error {
+	lockedUntil := time.Now().Add(lease)
+	if err := q.updateHeld(ctx, job, map[string]interface{}{"locked_until": lockedUntil}); err != nil {
+		return err
+	}
+	job.LockedUntil = &lockedUntil
+	return nil
+}
+
+// Complete marks a job as finished
+func (q *DBJobQueue) Complete(ctx context.Context, job *models.ExecutionJob, status string, lastError string) error {
+	return q.updateHeld(ctx, job, map[string]interface{}{
+		"status":       status,
+		"locked_by":    "",
+		"locked_until": nil,
+		"last_error":   lastError,
+	})
+}
+
+// Retry puts a job back in the queue after delay
+func (q *DBJobQueue) Retry(ctx context.Context, job *models.ExecutionJob, delay time.Duration, lastError string) error {
+	return q.updateHeld(ctx, job, map[string]interface{}{
+		"status":       "queued",
+		"locked_by":    "",
+		"locked_until": nil,
+		"available_at": time.Now().Add(delay),
+		"last_error":   lastError,
+	})
+}
+
+// Release makes an interrupted job available again immediately
+func (q *DBJobQueue) Release(ctx context.Context, job *models.ExecutionJob) error {
+	return q.updateHeld(ctx, job, map[string]interface{}{
+		"status":       "queued",
+		"locked_by":    "",
+		"locked_until": nil,
+		"available_at": time.Now(),
+		"attempts":     gorm.Expr("attempts - ?", 1),
+	})
+}
+
+// updateHeld updates a job only while the worker that claimed it still holds
+// it; once a lease expires the job may already belong to another worker
+func (q *DBJobQueue) updateHeld(ctx context.Context, job *models.ExecutionJob, updates map[string]interface{}) error {
+	result := q.db.WithContext(ctx).Model(&models.ExecutionJob{}).
+		Where("id = ? AND status = ? AND locked_by = ?", job.ID, "running", job.LockedBy).
+		Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrJobLeaseLost
+	}
+	return nil
+}
+
+// Reclaim requeues running jobs whose worker died, which is known once their
+// lease expires
+func (q *DBJobQueue) Reclaim(ctx context.Context) (int64, error) {
+	result := q.db.WithContext(ctx).Model(&models.ExecutionJob{}).
+		Where("status = ? AND locked_until < ?", "running", time.Now()).
+		Updates(map[string]interface{}{
+			"status":       "queued",
+			"locked_by":    "",
+			"locked_until": nil,
+			"available_at": time.Now(),
+		})
+	return result.RowsAffected, result.Error
+}
+
+// Wait sleeps for the poll interval
+func (q *DBJobQueue) Wait(ctx context.Context, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// RedisJobQueue is the database queue with a Redis wake-up signal. Jobs, their
+// leases and the concurrency limits all live in the database, so they survive
+// restarts and a Redis outage; Redis only carries a bounded list of signals
+// that wakes idle workers on every instance as soon as work arrives, instead
+// of leaving them to the next poll.
+type RedisJobQueue struct {
+	*DBJobQueue
+	redis *redis.Client
+}
+
+// NewRedisJobQueue creates a job queue that signals workers through Redis
+func NewRedisJobQueue(db *gorm.DB, redisClient *redis.Client) *RedisJobQueue {
+	return &RedisJobQueue{
+		DBJobQueue: NewDBJobQueue(db),
+		redis:      redisClient,
+	}
+}
+
+// Enqueue stores the job and wakes a worker
+func (q *RedisJobQueue) Enqueue(ctx context.Context, job *models.ExecutionJob) error {
+	if err := q.DBJobQueue.Enqueue(ctx, job); err != nil {
+		return err
+	}
+	q.wake(ctx)
+	return nil
+}
+
+// Retry requeues the job and wakes a worker
+func (q *RedisJobQueue) Retry(ctx context.Context, job *models.ExecutionJob, delay time.Duration, lastError string) error {
+	if err := q.DBJobQueue.Retry(ctx, job, delay, lastError); err != nil {
+		return err
+	}
+	// Delayed retries are picked up by polling once they fall due
+	if delay <= 0 {
+		q.wake(ctx)
+	}
+	return nil
+}
+
+// Release requeues the interrupted job and wakes a worker, possibly on another instance
+func (q *RedisJobQueue) Release(ctx context.Context, job *models.ExecutionJob) error {
+	if err := q.DBJobQueue.Release(ctx, job); err != nil {
+		return err
+	}
+	q.wake(ctx)
+	return nil
+}
+
+// Complete finishes the job and wakes a worker, since a concurrency slot was freed
+func (q *RedisJobQueue) Complete(ctx context.Context, job *models.ExecutionJob, status string, lastError string) error {
+	if err := q.DBJobQueue.Complete(ctx, job, status, lastError); err != nil {
+		return err
+	}
+	q.wake(ctx)
+	return nil
+}
+
+// wake pushes a signal onto the wake-up list, trimming the signals nobody took
+func (q *RedisJobQueue) wake(ctx context.Context) {
+	_, err := q.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LPush(ctx, jobWakeupList, time.Now().UnixNano())
+		pipe.LTrim(ctx, jobWakeupList, 0, jobWakeupListMax-1)
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("Failed to signal job workers: %v\n", err)
+	}
+}
+
+// Wait blocks until a wake-up signal arrives or the timeout elapses
+func (q *RedisJobQueue) Wait(ctx context.Context, timeout time.Duration) {
+	if err := q.redis.BRPop(ctx, timeout, jobWakeupList).Err(); err != nil && !errors.Is(err, redis.Nil) {
+		// Fall back to sleeping so a Redis outage does not spin the workers
+		q.DBJobQueue.Wait(ctx, timeout)
+	}
+}
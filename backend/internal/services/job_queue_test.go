@@ -0,0 +1,232 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// newJobQueueTest returns an empty database queue
+func newJobQueueTest(t *testing.T) *DBJobQueue {
+	t.Helper()
+	return NewDBJobQueue(newTestDB(t, &models.ExecutionJob{}, &models.Agent{}, &models.Organization{}))
+}
+
+// enqueue adds a job for the agent that falls due after delay
+func enqueue(t *testing.T, q *DBJobQueue, executionID, agentID string, orgID *string, delay time.Duration) *models.ExecutionJob {
+	t.Helper()
+	job := &models.ExecutionJob{ExecutionID: executionID, AgentID: agentID, OrganizationID: orgID,
+		MaxAttempts: 3, AvailableAt: time.Now().Add(delay)}
+	if err := q.Enqueue(context.Background(), job); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	return job
+}
+
+// dequeue claims the next job for the worker, checking which one it gets
+func dequeue(t *testing.T, q *DBJobQueue, workerID string, lease time.Duration, limits JobLimits, want string) *models.ExecutionJob {
+	t.Helper()
+	job, err := q.Dequeue(context.Background(), workerID, lease, limits)
+	if err != nil {
+		t.Fatalf("Dequeue() error = %v", err)
+	}
+	var got string
+	if job != nil {
+		got = job.ExecutionID
+	}
+	if got != want {
+		t.Fatalf("Dequeue() = %q, want %q", got, want)
+	}
+	return job
+}
+
+// storedJob returns the job as stored
+func storedJob(t *testing.T, q *DBJobQueue, id string) *models.ExecutionJob {
+	t.Helper()
+	var job models.ExecutionJob
+	if err := q.db.First(&job, "id = ?", id).Error; err != nil {
+		t.Fatal(err)
+	}
+	return &job
+}
+
+func TestJobQueueDequeue(t *testing.T) {
+	q := newJobQueueTest(t)
+	enqueue(t, q, "later", "agent-1", nil, time.Hour)
+	enqueue(t, q, "second", "agent-1", nil, -time.Minute)
+	enqueue(t, q, "first", "agent-1", nil, -time.Hour)
+
+	// Due jobs come out oldest first; jobs not yet due stay queued
+	job := dequeue(t, q, "worker-a", time.Minute, JobLimits{}, "first")
+	if job.Status != "running" || job.LockedBy != "worker-a" || job.Attempts != 1 || job.LockedUntil == nil {
+		t.Errorf("claimed job = %s by %q, %d attempts, locked until %v", job.Status, job.LockedBy, job.Attempts, job.LockedUntil)
+	}
+	if stored := storedJob(t, q, job.ID); stored.Status != "running" || stored.LockedBy != "worker-a" || stored.Attempts != 1 {
+		t.Errorf("stored job = %s by %q, %d attempts, want running by worker-a, 1", stored.Status, stored.LockedBy, stored.Attempts)
+	}
+	dequeue(t, q, "worker-b", time.Minute, JobLimits{}, "second")
+	dequeue(t, q, "worker-c", time.Minute, JobLimits{}, "")
+}
+
+func TestJobQueueLimits(t *testing.T) {
+	q := newJobQueueTest(t)
+	org := "org-1"
+	enqueue(t, q, "a1", "agent-a", nil, -3*time.Minute)
+	enqueue(t, q, "a2", "agent-a", nil, -2*time.Minute)
+	enqueue(t, q, "b1", "agent-b", &org, -time.Minute)
+	enqueue(t, q, "c1", "agent-c", &org, 0)
+	limits := JobLimits{PerAgent: 1, PerOrg: 1}
+
+	// A second job of a busy agent or organization is skipped for the next one
+	a1 := dequeue(t, q, "worker-1", time.Minute, limits, "a1")
+	dequeue(t, q, "worker-2", time.Minute, limits, "b1")
+	dequeue(t, q, "worker-3", time.Minute, limits, "")
+
+	// Finishing a job frees its slot
+	if err := q.Complete(context.Background(), a1, "completed", ""); err != nil {
+		t.Fatalf("Complete() error = %v", err)
+	}
+	dequeue(t, q, "worker-3", time.Minute, limits, "a2")
+
+	// Jobs whose lease expired do not hold a slot
+	q.db.Model(&models.ExecutionJob{}).Where("execution_id = ?", "b1").Update("locked_until", time.Now().Add(-time.Second))
+	dequeue(t, q, "worker-4", time.Minute, limits, "c1")
+}
+
+func TestJobQueueLeaseLost(t *testing.T) {
+	q := newJobQueueTest(t)
+	ctx := context.Background()
+	enqueue(t, q, "exec-1", "agent-1", nil, 0)
+
+	// The first worker's lease runs out and the job moves to another worker
+	stale := dequeue(t, q, "worker-a", -time.Second, JobLimits{}, "exec-1")
+	if n, err := q.Reclaim(ctx); n != 1 || err != nil {
+		t.Fatalf("Reclaim() = %d, %v, want 1", n, err)
+	}
+	current := dequeue(t, q, "worker-b", time.Minute, JobLimits{}, "exec-1")
+
+	// The first worker can no longer change the job
+	if err := q.Extend(ctx, stale, time.Minute); !errors.Is(err, ErrJobLeaseLost) {
+		t.Errorf("Extend() error = %v, want ErrJobLeaseLost", err)
+	}
+	if err := q.Complete(ctx, stale, "failed", "boom"); !errors.Is(err, ErrJobLeaseLost) {
+		t.Errorf("Complete() error = %v, want ErrJobLeaseLost", err)
+	}
+	if err := q.Retry(ctx, stale, 0, "boom"); !errors.Is(err, ErrJobLeaseLost) {
+		t.Errorf("Retry() error = %v, want ErrJobLeaseLost", err)
+	}
+	if err := q.Release(ctx, stale); !errors.Is(err, ErrJobLeaseLost) {
+		t.Errorf("Release() error = %v, want ErrJobLeaseLost", err)
+	}
+	if stored := storedJob(t, q, current.ID); stored.Status != "running" || stored.LockedBy != "worker-b" || stored.Attempts != 2 {
+		t.Errorf("job = %s by %q, %d attempts, want running by worker-b, 2", stored.Status, stored.LockedBy, stored.Attempts)
+	}
+
+	// The worker holding the job finishes it, once
+	if err := q.Extend(ctx, current, time.Minute); err != nil {
+		t.Errorf("Extend() error = %v", err)
+	}
+	if err := q.Complete(ctx, current, "completed", ""); err != nil {
+		t.Fatalf("Complete() error = %v", err)
+	}
+	if err := q.Complete(ctx, current, "failed", ""); !errors.Is(err, ErrJobLeaseLost) {
+		t.Errorf("second Complete() error = %v, want ErrJobLeaseLost", err)
+	}
+	if stored := storedJob(t, q, current.ID); stored.Status != "completed" || stored.LockedBy != "" || stored.LockedUntil != nil {
+		t.Errorf("job = %s by %q until %v, want completed and unlocked", stored.Status, stored.LockedBy, stored.LockedUntil)
+	}
+}
+
+func TestJobQueueRetryAndRelease(t *testing.T) {
+	q := newJobQueueTest(t)
+	ctx := context.Background()
+	enqueue(t, q, "exec-1", "agent-1", nil, 0)
+
+	// A retry counts the attempt and waits out its delay
+	job := dequeue(t, q, "worker-a", time.Minute, JobLimits{}, "exec-1")
+	if err := q.Retry(ctx, job, time.Hour, "rate limited"); err != nil {
+		t.Fatalf("Retry() error = %v", err)
+	}
+	stored := storedJob(t, q, job.ID)
+	if stored.Status != "queued" || stored.Attempts != 1 || stored.LastError != "rate limited" || stored.LockedBy != "" {
+		t.Errorf("retried job = %s, %d attempts, error %q, locked by %q", stored.Status, stored.Attempts, stored.LastError, stored.LockedBy)
+	}
+	dequeue(t, q, "worker-a", time.Minute, JobLimits{}, "")
+
+	// A released job runs again at once without counting the attempt
+	q.db.Model(&models.ExecutionJob{}).Where("id = ?", job.ID).Update("available_at", time.Now().Add(-time.Second))
+	job = dequeue(t, q, "worker-a", time.Minute, JobLimits{}, "exec-1")
+	if err := q.Release(ctx, job); err != nil {
+		t.Fatalf("Release() error = %v", err)
+	}
+	if stored := storedJob(t, q, job.ID); stored.Status != "queued" || stored.Attempts != 1 {
+		t.Errorf("released job = %s with %d attempts, want queued with 1", stored.Status, stored.Attempts)
+	}
+	dequeue(t, q, "worker-b", time.Minute, JobLimits{}, "exec-1")
+}
+
+func TestJobQueueReclaimOnlyExpired(t *testing.T) {
+	q := newJobQueueTest(t)
+	enqueue(t, q, "live", "agent-1", nil, -time.Minute)
+	enqueue(t, q, "expired", "agent-2", nil, 0)
+	live := dequeue(t, q, "worker-a", time.Minute, JobLimits{}, "live")
+	dequeue(t, q, "worker-b", -time.Second, JobLimits{}, "expired")
+
+	if n, err := q.Reclaim(context.Background()); n != 1 || err != nil {
+		t.Fatalf("Reclaim() = %d, %v, want 1", n, err)
+	}
+	if stored := storedJob(t, q, live.ID); stored.Status != "running" || stored.LockedBy != "worker-a" {
+		t.Errorf("job with a live lease = %s by %q, want still running by worker-a", stored.Status, stored.LockedBy)
+	}
+	dequeue(t, q, "worker-c", time.Minute, JobLimits{}, "expired")
+}
+
+func TestWorkerAbandonsLostJob(t *testing.T) {
+	started := make(chan struct{})
+	causes := make(chan error, 1)
+	rt := newRuntimeTest(t, func(ctx context.Context, agent *models.Agent, input map[string]interface{}) (*ExecutionResult, error) {
+		close(started)
+		<-ctx.Done()
+		causes <- context.Cause(ctx)
+		return usage, ctx.Err()
+	})
+	rt.cfg.Queue.LeaseSeconds = 1
+	pool := NewExecutionWorkerPool(rt.runtime, rt.cfg)
+	execution, _ := rt.execute(t, nil)
+
+	job, err := pool.queue.Dequeue(context.Background(), "worker-a", pool.lease(), JobLimits{})
+	if err != nil || job == nil {
+		t.Fatalf("Dequeue() = %v, %v, want the job", job, err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pool.run(context.Background(), job)
+	}()
+
+	// Another worker takes over the job while the run is going
+	<-started
+	rt.db.Model(&models.ExecutionJob{}).Where("id = ?", job.ID).Update("locked_by", "worker-b")
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the run went on after its lease was lost")
+	}
+	if cause := <-causes; !errors.Is(cause, ErrJobLeaseLost) {
+		t.Errorf("run aborted with %v, want ErrJobLeaseLost", cause)
+	}
+
+	// The new holder's job and execution are left alone
+	var stored models.ExecutionJob
+	rt.db.First(&stored, "id = ?", job.ID)
+	if stored.Status != "running" || stored.LockedBy != "worker-b" {
+		t.Errorf("job = %s by %q, want running by worker-b", stored.Status, stored.LockedBy)
+	}
+	if status := rt.reload(t, execution.ID).Status; status != "running" {
+		t.Errorf("execution = %s, want running", status)
+	}
+}
@@ -0,0 +1,466 @@
+package services
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+	"github.com/mlaitechio/vagais/pkg/license"
+)
+
+// License types
+const (
+	LicenseTypeFree       = "free"
+	LicenseTypeTrial      = "trial"
+	LicenseTypePaid       = "paid"
+	LicenseTypeEnterprise = "enterprise"
+)
+
+// License statuses
+const (
+	LicenseActive  = "active"
+	LicenseRevoked = "revoked"
+)
+
+// Deployment types a license may be restricted to
+const (
+	DeploymentOnPremise = "on_premise"
+	DeploymentCloud     = "cloud"
+	DeploymentHybrid    = "hybrid"
+)
+
+var licenseTypes = map[string]bool{
+	LicenseTypeFree:       true,
+	LicenseTypeTrial:      true,
+	LicenseTypePaid:       true,
+	LicenseTypeEnterprise: true,
+}
+
+var deploymentTypes = map[string]bool{
+	DeploymentOnPremise: true,
+	DeploymentCloud:     true,
+	DeploymentHybrid:    true,
+}
+
+// purchaseLicenseFeatures are the features of licenses issued for purchases
+var purchaseLicenseFeatures = []string{"on_premise", "offline_validation"}
+
+var licenseKeyWarning sync.Once
+
+// LicenseService issues, revokes and validates on-premises license keys
+type LicenseService struct {
+	BaseService
+	signingKey ed25519.PrivateKey
+	plans      *PlanService
+}
+
+// NewLicenseService creates a new license service
+func NewLicenseService(db *gorm.DB, cfg *config.Config) *LicenseService {
+	return &LicenseService{
+		BaseService: NewBaseService(db, cfg, "license"),
+		signingKey:  loadLicenseSigningKey(cfg),
+		plans:       NewPlanService(db, cfg),
+	}
+}
+
+// loadLicenseSigningKey parses LICENSE_SIGNING_KEY. Without one, the key is
+// derived from the JWT secret so that every instance signs with the same key.
+func loadLicenseSigningKey(cfg *config.Config) ed25519.PrivateKey {
+	if cfg.License.SigningKey != "" {
+		key, err := license.ParsePrivateKey(cfg.License.SigningKey)
+		if err == nil {
+			return key
+		}
+		licenseKeyWarning.Do(func() {
+			fmt.Printf("Invalid LICENSE_SIGNING_KEY, deriving the license key from the JWT secret: %v\n", err)
+		})
+	} else {
+		licenseKeyWarning.Do(func() {
+			fmt.Println("LICENSE_SIGNING_KEY not set, deriving the license key from the JWT secret")
+		})
+	}
+	seed := sha256.Sum256([]byte("license:" + cfg.JWT.SecretKey))
+	return ed25519.NewKeyFromSeed(seed[:])
+}
+
+// IssueLicenseRequest represents an admin request to issue a license
+type IssueLicenseRequest struct {
+	UserID         string     `json:"user_id" binding:"required"`
+	OrganizationID *string    `json:"organization_id"`
+	AgentIDs       []string   `json:"agent_ids"`
+	Type           string     `json:"type"`
+	Seats          int        `json:"seats"`
+	Features       []string   `json:"features"`
+	DeploymentType string     `json:"deployment_type"`
+	HardwareID     string     `json:"hardware_id"`
+	ExpiresAt      *time.Time `json:"expires_at"`
+	GraceDays      *int       `json:"grace_days"`
+}
+
+// RevokeLicenseRequest represents an admin request to revoke a license
+type RevokeLicenseRequest struct {
+	Reason string `json:"reason"`
+}
+
+// ValidateLicenseRequest represents a deployment checking its license key
+type ValidateLicenseRequest struct {
+	LicenseKey     string `json:"license_key" binding:"required"`
+	HardwareID     string `json:"hardware_id"`
+	DeploymentType string `json:"deployment_type"`
+	AgentID        string `json:"agent_id"`
+}
+
+// LicenseValidation is the outcome of validating a license key
+type LicenseValidation struct {
+	Valid        bool                   `json:"valid"`
+	LicenseID    string                 `json:"license_id"`
+	LicenseType  string                 `json:"license_type"`
+	ExpiresAt    *time.Time             `json:"expires_at"`
+	InGrace      bool                   `json:"in_grace"`
+	GraceEndsAt  *time.Time             `json:"grace_ends_at,omitempty"`
+	MaxUsers     *int                   `json:"max_users"`
+	MaxAgents    *int                   `json:"max_agents"`
+	Features     []string               `json:"features"`
+	Restrictions map[string]interface{} `json:"restrictions"`
+}
+
+// PublicKey returns the base64 public key installs use to verify license keys offline
+func (s *LicenseService) PublicKey() string {
+	return license.EncodeKey(s.signingKey.Public().(ed25519.PublicKey))
+}
+
+// issueForPurchase issues the license a completed purchase grants, valid for
+// the same period as its entitlement. Usage-based purchases are metered in
+// the cloud and cannot be enforced offline, so they get no license.
+func (s *LicenseService) issueForPurchase(tx *gorm.DB, purchase *models.Purchase, entitlement *models.Entitlement) (*models.License, error) {
+	if purchase.PricingModel == PricingUsageBased {
+		return nil, nil
+	}
+
+	// Organizations get their plan's seats, individual buyers a single seat
+	licenseType, seats := LicenseTypePaid, 1
+	if purchase.OrganizationID != nil {
+		var org models.Organization
+		if err := tx.Select("id", "plan").First(&org, "id = ?", *purchase.OrganizationID).Error; err != nil {
+			return nil, err
+		}
+		plan, err := s.plans.GetPlan(org.Plan)
+		if err != nil {
+			plan = s.plans.PlanFor(nil)
+		}
+		seats = int(plan.Seats)
+		if plan.Name == LicenseTypeEnterprise {
+			licenseType = LicenseTypeEnterprise
+		}
+	}
+
+	claims := &license.Claims{
+		Type:           licenseType,
+		UserID:         purchase.UserID,
+		AgentIDs:       []string{purchase.AgentID},
+		Seats:          seats,
+		Features:       purchaseLicenseFeatures,
+		DeploymentType: DeploymentOnPremise,
+		ExpiresAt:      entitlement.ExpiresAt,
+		GraceDays:      s.cfg.License.GraceDays,
+	}
+	if purchase.OrganizationID != nil {
+		claims.OrganizationID = *purchase.OrganizationID
+	}
+	if entitlement.StartsAt.After(time.Now()) {
+		startsAt := entitlement.StartsAt
+		claims.NotBefore = &startsAt
+	}
+	return s.issue(tx, claims, &purchase.ID)
+}
+
+// revokeForPurchase revokes the licenses issued for a purchase
+func (s *LicenseService) revokeForPurchase(tx *gorm.DB, purchaseID, reason string) error {
+	return tx.Model(&models.License{}).
+		Where("purchase_id = ? AND status = ?", purchaseID, LicenseActive).
+		Updates(map[string]interface{}{
+			"status":            LicenseRevoked,
+			"revoked_at":        time.Now(),
+			"revocation_reason": reason,
+		}).Error
+}
+
+// IssueLicense issues a license on an admin's request, such as an enterprise
+// agreement made outside the marketplace
+func (s *LicenseService) IssueLicense(req *IssueLicenseRequest) (*models.License, error) {
+	if req.Type == "" {
+		req.Type = LicenseTypeEnterprise
+	}
+	if !licenseTypes[req.Type] {
+		return nil, fmt.Errorf("unsupported license type: %s", req.Type)
+	}
+	if req.DeploymentType == "" {
+		req.DeploymentType = DeploymentOnPremise
+	}
+	if !deploymentTypes[req.DeploymentType] {
+		return nil, fmt.Errorf("unsupported deployment type: %s", req.DeploymentType)
+	}
+	if req.Seats < 0 {
+		return nil, errors.New("seats cannot be negative")
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		return nil, errors.New("expiry must be in the future")
+	}
+
+	var user models.User
+	if err := s.db.First(&user, "id = ?", req.UserID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+	if req.OrganizationID != nil {
+		var org models.Organization
+		if err := s.db.First(&org, "id = ?", *req.OrganizationID).Error; err != nil {
+			return nil, errors.New("organization not found")
+		}
+	}
+	if len(req.AgentIDs) > 0 {
+		var count int64
+		if err := s.db.Model(&models.Agent{}).Where("id IN ?", req.AgentIDs).Count(&count).Error; err != nil {
+			return nil, err
+		}
+		if count != int64(len(req.AgentIDs)) {
+			return nil, errors.New("one or more agents not found")
+		}
+	}
+
+	claims := &license.Claims{
+		Type:           req.Type,
+		UserID:         req.UserID,
+		AgentIDs:       req.AgentIDs,
+		Seats:          req.Seats,
+		Features:       req.Features,
+		DeploymentType: req.DeploymentType,
+		HardwareID:     req.HardwareID,
+		ExpiresAt:      req.ExpiresAt,
+		GraceDays:      s.cfg.License.GraceDays,
+	}
+	if req.OrganizationID != nil {
+		claims.OrganizationID = *req.OrganizationID
+	}
+	if req.GraceDays != nil {
+		claims.GraceDays = *req.GraceDays
+	}
+	return s.issue(s.db, claims, nil)
+}
+
+// issue signs the claims and stores the license
+func (s *LicenseService) issue(tx *gorm.DB, claims *license.Claims, purchaseID *string) (*models.License, error) {
+	claims.ID = uuid.New().String()
+	claims.Issuer = s.cfg.License.Issuer
+	claims.IssuedAt = time.Now().UTC().Truncate(time.Second)
+
+	key, err := license.Sign(s.signingKey, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	agentIDs, _ := json.Marshal(claims.AgentIDs)
+	features, _ := json.Marshal(claims.Features)
+	record := &models.License{
+		BaseModel:      models.BaseModel{ID: claims.ID},
+		Key:            key,
+		Fingerprint:    license.Fingerprint(key),
+		UserID:         claims.UserID,
+		PurchaseID:     purchaseID,
+		AgentIDs:       models.JSON(agentIDs),
+		Type:           claims.Type,
+		Seats:          claims.Seats,
+		Features:       models.JSON(features),
+		DeploymentType: claims.DeploymentType,
+		HardwareID:     claims.HardwareID,
+		ExpiresAt:      claims.ExpiresAt,
+		GraceDays:      claims.GraceDays,
+		Status:         LicenseActive,
+	}
+	if claims.OrganizationID != "" {
+		record.OrganizationID = &claims.OrganizationID
+	}
+	if err := tx.Create(record).Error; err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// RevokeLicense revokes a license; installs stop accepting it once they
+// validate online or load a newer revocation list
+func (s *LicenseService) RevokeLicense(id string, req *RevokeLicenseRequest) (*models.License, error) {
+	var record models.License
+	if err := s.db.First(&record, "id = ?", id).Error; err != nil {
+		return nil, errors.New("license not found")
+	}
+	if record.Status == LicenseRevoked {
+		return nil, errors.New("license is already revoked")
+	}
+
+	result := s.db.Model(&record).Where("status = ?", LicenseActive).Updates(map[string]interface{}{
+		"status":            LicenseRevoked,
+		"revoked_at":        time.Now(),
+		"revocation_reason": req.Reason,
+	})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, errConcurrentUpdate
+	}
+
+	if err := s.db.First(&record, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// ValidateLicense verifies a license key's signature and terms and checks it
+// has not been revoked since it was issued
+func (s *LicenseService) ValidateLicense(req *ValidateLicenseRequest) (*LicenseValidation, error) {
+	verifier := license.NewVerifier(s.signingKey.Public().(ed25519.PublicKey))
+	result, err := verifier.Verify(req.LicenseKey, license.Check{
+		AgentID:    req.AgentID,
+		HardwareID: req.HardwareID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	claims := result.Claims
+
+	var record models.License
+	if err := s.db.First(&record, "id = ?", claims.ID).Error; err != nil {
+		return nil, errors.New("license not found")
+	}
+	if record.Status == LicenseRevoked {
+		return nil, license.ErrRevoked
+	}
+	if req.DeploymentType != "" && claims.DeploymentType != "" &&
+		claims.DeploymentType != DeploymentHybrid && req.DeploymentType != claims.DeploymentType {
+		return nil, fmt.Errorf("license is not valid for %s deployments", req.DeploymentType)
+	}
+
+	s.db.Model(&record).Updates(map[string]interface{}{
+		"last_validated_at": time.Now(),
+		"validation_count":  gorm.Expr("validation_count + ?", 1),
+	})
+
+	validation := &LicenseValidation{
+		Valid:       true,
+		LicenseID:   claims.ID,
+		LicenseType: validationLicenseType(claims),
+		ExpiresAt:   claims.ExpiresAt,
+		InGrace:     result.InGrace,
+		GraceEndsAt: result.GraceEndsAt,
+		Features:    claims.Features,
+		Restrictions: map[string]interface{}{
+			"agent_ids":       claims.AgentIDs,
+			"organization_id": claims.OrganizationID,
+			"deployment_type": claims.DeploymentType,
+			"hardware_id":     claims.HardwareID,
+		},
+	}
+	if claims.Seats > 0 {
+		validation.MaxUsers = &claims.Seats
+	}
+	if len(claims.AgentIDs) > 0 {
+		maxAgents := len(claims.AgentIDs)
+		validation.MaxAgents = &maxAgents
+	}
+	if validation.Features == nil {
+		validation.Features = []string{}
+	}
+	return validation, nil
+}
+
+// validationLicenseType maps a license to the type reported to deployments
+func validationLicenseType(claims *license.Claims) string {
+	switch claims.Type {
+	case LicenseTypeTrial, LicenseTypeEnterprise:
+		return claims.Type
+	}
+	if claims.ExpiresAt == nil && len(claims.AgentIDs) == 0 && claims.Seats == 0 {
+		return "unlimited"
+	}
+	return "standard"
+}
+
+// RevocationList returns a signed list of revoked licenses that have not yet
+// expired, for air-gapped installs to load into their verifier
+func (s *LicenseService) RevocationList() (string, error) {
+	var revoked []models.License
+	if err := s.db.Select("id", "expires_at", "grace_days").
+		Where("status = ?", LicenseRevoked).Find(&revoked).Error; err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	list := &license.RevocationList{
+		Issuer:   s.cfg.License.Issuer,
+		IssuedAt: now.UTC().Truncate(time.Second),
+		Revoked:  []string{},
+	}
+	for _, record := range revoked {
+		// Licenses past their grace period are rejected anyway
+		if record.ExpiresAt != nil && record.ExpiresAt.AddDate(0, 0, record.GraceDays).Before(now) {
+			continue
+		}
+		list.Revoked = append(list.Revoked, record.ID)
+	}
+	return license.SignRevocationList(s.signingKey, list)
+}
+
+// licenseScope limits a query to the user's licenses and, for organization
+// admins, their organization's
+func licenseScope(db *gorm.DB, user *models.User) *gorm.DB {
+	if user.OrganizationID != nil && user.Role == "admin" {
+		return db.Where("user_id = ? OR organization_id = ?", user.ID, *user.OrganizationID)
+	}
+	return db.Where("user_id = ?", user.ID)
+}
+
+// ListLicenses lists the licenses visible to the user, newest first
+func (s *LicenseService) ListLicenses(user *models.User, status string, page, limit int) ([]models.License, int64, error) {
+	var licenses []models.License
+	var total int64
+
+	query := licenseScope(s.db.Model(&models.License{}), user)
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	offset := (page - 1) * limit
+	if err := query.Order("created_at DESC").Offset(offset).Limit(limit).Find(&licenses).Error; err != nil {
+		return nil, 0, err
+	}
+	return licenses, total, nil
+}
+
+// GetLicense returns a license if the user may see it
+func (s *LicenseService) GetLicense(id string, user *models.User) (*models.License, error) {
+	var record models.License
+	if err := licenseScope(s.db, user).First(&record, "id = ?", id).Error; err != nil {
+		return nil, errors.New("license not found")
+	}
+	return &record, nil
+}
+
+// licenseForPurchase returns the active license issued for a purchase, if any
+func (s *LicenseService) licenseForPurchase(purchaseID string) *models.License {
+	var record models.License
+	if err := s.db.First(&record, "purchase_id = ? AND status = ?", purchaseID, LicenseActive).Error; err != nil {
+		return nil
+	}
+	return &record
+}
@@ -0,0 +1,274 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// anthropicAPIVersion is the Messages API version sent with every request
+const anthropicAPIVersion = "2023-06-01"
+
+// anthropicClient talks to the Anthropic Messages API
+type anthropicClient struct {
+	llmTransport
+	baseURL string
+}
+
+// newAnthropicClient creates an adapter for the Anthropic API
+func newAnthropicClient(cfg LLMClientConfig) *anthropicClient {
+	return &anthropicClient{
+		llmTransport: llmTransport{
+			provider:   cfg.Type,
+			httpClient: cfg.HTTPClient,
+			headers: map[string]string{
+				"x-api-key":         cfg.APIKey,
+				"anthropic-version": anthropicAPIVersion,
+			},
+		},
+		baseURL: strings.TrimSuffix(cfg.BaseURL, "/v1"),
+	}
+}
+
+// anthropicUsage is the usage block of a Messages API response
+type anthropicUsage struct {
+	InputTokens  int64 `json:"input_tokens"`
+	OutputTokens int64 `json:"output_tokens"`
+}
+
+// anthropicMessage is a message in the Messages API wire format, whose
+// content is either a string or a list of content blocks
+type anthropicMessage struct {
+	Role    string      `json:"role"`
+	Content interface{} `json:"content"`
+
+	toolResults bool
+}
+
+// buildPayload converts a neutral request into the Messages API wire format
+func (c *anthropicClient) buildPayload(req *ChatCompletionRequest, stream bool) map[string]interface{} {
+	// Anthropic takes the system prompt as a top-level field rather than a message
+	system := req.SystemPrompt
+	messages := make([]anthropicMessage, 0, len(req.Messages))
+	for _, m := range req.Messages {
+		switch {
+		case m.Role == "system":
+			if system != "" {
+				system += "\n\n"
+			}
+			system += m.Content
+		case m.Role == "tool":
+			// Tool results travel as user content blocks, merged when they follow each other
+			block := map[string]interface{}{
+				"type":        "tool_result",
+				"tool_use_id": m.ToolCallID,
+				"content":     m.Content,
+			}
+			if n := len(messages); n > 0 && messages[n-1].Role == "user" && messages[n-1].toolResults {
+				messages[n-1].Content = append(messages[n-1].Content.([]map[string]interface{}), block)
+				continue
+			}
+			messages = append(messages, anthropicMessage{
+				Role:        "user",
+				Content:     []map[string]interface{}{block},
+				toolResults: true,
+			})
+		case len(m.ToolCalls) > 0:
+			blocks := make([]map[string]interface{}, 0, len(m.ToolCalls)+1)
+			if m.Content != "" {
+				blocks = append(blocks, map[string]interface{}{"type": "text", "text": m.Content})
+			}
+			for _, call := range m.ToolCalls {
+				input := call.Arguments
+				if input == nil {
+					input = map[string]interface{}{}
+				}
+				blocks = append(blocks, map[string]interface{}{
+					"type":  "tool_use",
+					"id":    call.ID,
+					"name":  call.Name,
+					"input": input,
+				})
+			}
+			messages = append(messages, anthropicMessage{Role: m.Role, Content: blocks})
+		default:
+			messages = append(messages, anthropicMessage{Role: m.Role, Content: m.Content})
+		}
+	}
+
+	maxTokens := req.MaxTokens
+	if maxTokens <= 0 {
+		// max_tokens is mandatory for this API
+		maxTokens = 1024
+	}
+
+	payload := map[string]interface{}{
+		"model":      req.Model,
+		"messages":   messages,
+		"max_tokens": maxTokens,
+	}
+	if system != "" {
+		payload["system"] = system
+	}
+	if len(req.Tools) > 0 {
+		tools := make([]map[string]interface{}, 0, len(req.Tools))
+		for _, tool := range req.Tools {
+			tools = append(tools, map[string]interface{}{
+				"name":         tool.Name,
+				"description":  tool.Description,
+				"input_schema": tool.Parameters,
+			})
+		}
+		payload["tools"] = tools
+	}
+	if req.Temperature != nil {
+		payload["temperature"] = *req.Temperature
+	}
+	if stream {
+		payload["stream"] = true
+	}
+	return payload
+}
+
+// ChatCompletion sends a non-streaming Messages API request
+func (c *anthropicClient) ChatCompletion(ctx context.Context, req *ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	var resp struct {
+		Model   string `json:"model"`
+		Content []struct {
+			Type  string                 `json:"type"`
+			Text  string                 `json:"text"`
+			ID    string                 `json:"id"`
+			Name  string                 `json:"name"`
+			Input map[string]interface{} `json:"input"`
+		} `json:"content"`
+		StopReason string         `json:"stop_reason"`
+		Usage      anthropicUsage `json:"usage"`
+	}
+	if err := c.doJSON(ctx, http.MethodPost, c.baseURL+"/v1/messages", c.buildPayload(req, false), &resp); err != nil {
+		return nil, err
+	}
+
+	var text strings.Builder
+	var toolCalls []ToolCall
+	for _, block := range resp.Content {
+		switch block.Type {
+		case "text":
+			text.WriteString(block.Text)
+		case "tool_use":
+			toolCalls = append(toolCalls, ToolCall{ID: block.ID, Name: block.Name, Arguments: block.Input})
+		}
+	}
+
+	return &ChatCompletionResponse{
+		Content:      text.String(),
+		ToolCalls:    toolCalls,
+		Model:        resp.Model,
+		FinishReason: resp.StopReason,
+		Usage: TokenUsage{
+			PromptTokens: resp.Usage.InputTokens,
+			OutputTokens: resp.Usage.OutputTokens,
+		},
+	}, nil
+}
+
+// StreamChatCompletion sends a streaming Messages API request
+func (c *anthropicClient) StreamChatCompletion(ctx context.Context, req *ChatCompletionRequest, onDelta StreamHandler) (*ChatCompletionResponse, error) {
+	httpReq, err := c.newRequest(ctx, http.MethodPost, c.baseURL+"/v1/messages", c.buildPayload(req, true))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Accept", "text/event-stream")
+
+	resp, err := c.do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := &ChatCompletionResponse{Model: req.Model}
+	var content strings.Builder
+	err = readServerSentEvents(resp.Body, func(data string) (bool, error) {
+		var event struct {
+			Type    string `json:"type"`
+			Message struct {
+				Model string         `json:"model"`
+				Usage anthropicUsage `json:"usage"`
+			} `json:"message"`
+			Delta struct {
+				Type       string `json:"type"`
+				Text       string `json:"text"`
+				StopReason string `json:"stop_reason"`
+			} `json:"delta"`
+			Usage anthropicUsage `json:"usage"`
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return false, fmt.Errorf("failed to decode stream event: %v", err)
+		}
+
+		switch event.Type {
+		case "message_start":
+			if event.Message.Model != "" {
+				result.Model = event.Message.Model
+			}
+			result.Usage.PromptTokens = event.Message.Usage.InputTokens
+		case "content_block_delta":
+			if event.Delta.Type != "text_delta" || event.Delta.Text == "" {
+				return false, nil
+			}
+			content.WriteString(event.Delta.Text)
+			if err := onDelta(event.Delta.Text); err != nil {
+				return false, err
+			}
+		case "message_delta":
+			if event.Delta.StopReason != "" {
+				result.FinishReason = event.Delta.StopReason
+			}
+			result.Usage.OutputTokens = event.Usage.OutputTokens
+		case "message_stop":
+			return true, nil
+		case "error":
+			return false, errors.New(event.Error.Message)
+		}
+		return false, nil
+	})
+	result.Content = content.String()
+	if err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// CreateEmbeddings is not offered by the Anthropic API
+func (c *anthropicClient) CreateEmbeddings(ctx context.Context, model string, inputs []string) (*EmbeddingResponse, error) {
+	return nil, ErrLLMNotSupported
+}
+
+// ListModels returns the identifiers of the models available to the key
+func (c *anthropicClient) ListModels(ctx context.Context) ([]string, error) {
+	var resp struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := c.doJSON(ctx, http.MethodGet, c.baseURL+"/v1/models", nil, &resp); err != nil {
+		return nil, err
+	}
+
+	modelIDs := make([]string, 0, len(resp.Data))
+	for _, m := range resp.Data {
+		modelIDs = append(modelIDs, m.ID)
+	}
+	return modelIDs, nil
+}
+
+// HealthCheck verifies the API is reachable and accepts the credentials
+func (c *anthropicClient) HealthCheck(ctx context.Context) error {
+	_, err := c.ListModels(ctx)
+	return err
+}
@@ -0,0 +1,177 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAnthropicChatCompletion(t *testing.T) {
+	stub := newLLMStub(t, respondJSON(http.StatusOK, `{
+		"id": "msg_01",
+		"type": "message",
+		"role": "assistant",
+		"model": "claude-3-5-sonnet-20241022",
+		"content": [
+			{"type": "text", "text": "Let me calculate. "},
+			{"type": "tool_use", "id": "toolu_1", "name": "calculator", "input": {"expression": "6*7"}},
+			{"type": "text", "text": "One moment."}
+		],
+		"stop_reason": "tool_use",
+		"usage": {"input_tokens": 410, "output_tokens": 58}
+	}`))
+	client := stub.client(t, "anthropic")
+
+	resp, err := client.ChatCompletion(context.Background(), &ChatCompletionRequest{
+		Model:        "claude-3-5-sonnet-20241022",
+		SystemPrompt: "You are terse.",
+		Messages: []ChatMessage{
+			// System messages in the history join the system prompt
+			{Role: "system", Content: "Answer in English."},
+			{Role: "user", Content: "What are 6*7 and 2+2?"},
+			{Role: "assistant", Content: "Calculating.", ToolCalls: []ToolCall{
+				{ID: "toolu_a", Name: "calculator", Arguments: map[string]interface{}{"expression": "6*7"}},
+				{ID: "toolu_b", Name: "clock"},
+			}},
+			{Role: "tool", ToolCallID: "toolu_a", Content: "42"},
+			{Role: "tool", ToolCallID: "toolu_b", Content: "12:00"},
+		},
+		Tools: []ToolDefinition{{
+			Name:        "calculator",
+			Description: "Evaluates arithmetic",
+			Parameters:  map[string]interface{}{"type": "object"},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("ChatCompletion() error = %v", err)
+	}
+
+	method, path, headers, body := stub.request()
+	if method != http.MethodPost || path != "/v1/messages" {
+		t.Errorf("request = %s %s, want POST /v1/messages", method, path)
+	}
+	if headers.Get("x-api-key") != "test-key" || headers.Get("anthropic-version") != anthropicAPIVersion {
+		t.Errorf("headers = %v, want the API key and version", headers)
+	}
+	wantBody := map[string]interface{}{
+		"model":      "claude-3-5-sonnet-20241022",
+		"max_tokens": 1024.0,
+		"system":     "You are terse.\n\nAnswer in English.",
+		"messages": []interface{}{
+			map[string]interface{}{"role": "user", "content": "What are 6*7 and 2+2?"},
+			map[string]interface{}{"role": "assistant", "content": []interface{}{
+				map[string]interface{}{"type": "text", "text": "Calculating."},
+				map[string]interface{}{"type": "tool_use", "id": "toolu_a", "name": "calculator", "input": map[string]interface{}{"expression": "6*7"}},
+				map[string]interface{}{"type": "tool_use", "id": "toolu_b", "name": "clock", "input": map[string]interface{}{}},
+			}},
+			// Consecutive tool results share a single user turn
+			map[string]interface{}{"role": "user", "content": []interface{}{
+				map[string]interface{}{"type": "tool_result", "tool_use_id": "toolu_a", "content": "42"},
+				map[string]interface{}{"type": "tool_result", "tool_use_id": "toolu_b", "content": "12:00"},
+			}},
+		},
+		"tools": []interface{}{
+			map[string]interface{}{"name": "calculator", "description": "Evaluates arithmetic", "input_schema": map[string]interface{}{"type": "object"}},
+		},
+	}
+	if !reflect.DeepEqual(body, wantBody) {
+		got, _ := json.MarshalIndent(body, "", "  ")
+		t.Errorf("request body = %s", got)
+	}
+
+	want := &ChatCompletionResponse{
+		Content:      "Let me calculate. One moment.",
+		Model:        "claude-3-5-sonnet-20241022",
+		FinishReason: "tool_use",
+		ToolCalls:    []ToolCall{{ID: "toolu_1", Name: "calculator", Arguments: map[string]interface{}{"expression": "6*7"}}},
+		Usage:        TokenUsage{PromptTokens: 410, OutputTokens: 58},
+	}
+	if !reflect.DeepEqual(resp, want) {
+		t.Errorf("ChatCompletion() = %+v, want %+v", resp, want)
+	}
+}
+
+func TestAnthropicBaseURL(t *testing.T) {
+	stub := newLLMStub(t, respondJSON(http.StatusOK, `{"data":[{"id":"claude-3-5-haiku-20241022"}]}`))
+
+	// A base URL configured with the version prefix is not doubled
+	client, err := NewLLMClient(LLMClientConfig{Type: "anthropic", BaseURL: stub.URL + "/v1/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	models, err := client.ListModels(context.Background())
+	if err != nil || !reflect.DeepEqual(models, []string{"claude-3-5-haiku-20241022"}) {
+		t.Errorf("ListModels() = %v, %v", models, err)
+	}
+	if method, path, _, _ := stub.request(); method != http.MethodGet || path != "/v1/models" {
+		t.Errorf("ListModels() requested %s %s, want GET /v1/models", method, path)
+	}
+
+	if _, err := client.CreateEmbeddings(context.Background(), "any", []string{"text"}); !errors.Is(err, ErrLLMNotSupported) {
+		t.Errorf("CreateEmbeddings() error = %v, want ErrLLMNotSupported", err)
+	}
+}
+
+func TestAnthropicStreamChatCompletion(t *testing.T) {
+	stub := newLLMStub(t, respondEvents(
+		`{"type":"message_start","message":{"id":"msg_01","model":"claude-3-5-sonnet-20241022","usage":{"input_tokens":25,"output_tokens":1}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"ping"}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Forty"}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"-two"}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"a\":"}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":15}}`,
+		`{"type":"message_stop"}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"after stop"}}`,
+	))
+	client := stub.client(t, "anthropic")
+
+	var deltas []string
+	resp, err := client.StreamChatCompletion(context.Background(), &ChatCompletionRequest{
+		Model:     "claude-3-5-sonnet",
+		MaxTokens: 300,
+		Messages:  []ChatMessage{{Role: "user", Content: "What is 6*7?"}},
+	}, collectDeltas(&deltas))
+	if err != nil {
+		t.Fatalf("StreamChatCompletion() error = %v", err)
+	}
+
+	if _, _, _, body := stub.request(); body["stream"] != true || body["max_tokens"] != 300.0 {
+		t.Errorf("request body = %v, want stream with max_tokens 300", body)
+	}
+	if !reflect.DeepEqual(deltas, []string{"Forty", "-two"}) {
+		t.Errorf("deltas = %q, want [Forty -two]", deltas)
+	}
+	want := &ChatCompletionResponse{
+		Content:      "Forty-two",
+		Model:        "claude-3-5-sonnet-20241022",
+		FinishReason: "end_turn",
+		Usage:        TokenUsage{PromptTokens: 25, OutputTokens: 15},
+	}
+	if !reflect.DeepEqual(resp, want) {
+		t.Errorf("StreamChatCompletion() = %+v, want %+v", resp, want)
+	}
+}
+
+func TestAnthropicStreamError(t *testing.T) {
+	// Errors after the stream started arrive as an event, not a status
+	stub := newLLMStub(t, respondEvents(
+		`{"type":"message_start","message":{"model":"claude-3-5-sonnet-20241022","usage":{"input_tokens":25}}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Partial"}}`,
+		`{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`,
+	))
+
+	resp, err := stub.client(t, "anthropic").StreamChatCompletion(context.Background(), &ChatCompletionRequest{Model: "claude-3-5-sonnet"}, func(string) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "Overloaded") {
+		t.Fatalf("StreamChatCompletion() error = %v, want the provider's message", err)
+	}
+	// The usage known so far is kept so the partial reply can be charged
+	if resp == nil || resp.Content != "Partial" || resp.Usage.PromptTokens != 25 {
+		t.Errorf("StreamChatCompletion() = %+v, want the partial content and prompt tokens", resp)
+	}
+}
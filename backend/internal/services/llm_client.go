@@ -0,0 +1,331 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// ErrLLMNotSupported is returned when a provider does not implement an operation
+var ErrLLMNotSupported = errors.New("operation not supported by this LLM provider")
+
+// LLMClient is implemented by every LLM provider adapter
+type LLMClient interface {
+	ChatCompletion(ctx context.Context, req *ChatCompletionRequest) (*ChatCompletionResponse, error)
+	StreamChatCompletion(ctx context.Context, req *ChatCompletionRequest, onDelta StreamHandler) (*ChatCompletionResponse, error)
+	CreateEmbeddings(ctx context.Context, model string, inputs []string) (*EmbeddingResponse, error)
+	ListModels(ctx context.Context) ([]string, error)
+	HealthCheck(ctx context.Context) error
+}
+
+// StreamHandler receives each partial token produced by a streaming completion
+type StreamHandler func(delta string) error
+
+// ChatMessage represents a single message sent to an LLM. Assistant messages
+// may carry tool calls, and "tool" messages carry the result of one.
+type ChatMessage struct {
+	Role       string     `json:"role"`
+	Content    string     `json:"content"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+}
+
+// ToolDefinition describes a tool the model may call
+type ToolDefinition struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Parameters  map[string]interface{} `json:"parameters"`
+}
+
+// ToolCall represents a model's request to invoke a tool
+type ToolCall struct {
+	ID        string                 `json:"id"`
+	Name      string                 `json:"name"`
+	Arguments map[string]interface{} `json:"arguments"`
+}
+
+// ChatCompletionRequest represents a provider-neutral completion request
+type ChatCompletionRequest struct {
+	Model        string           `json:"model"`
+	Messages     []ChatMessage    `json:"messages"`
+	SystemPrompt string           `json:"system_prompt,omitempty"`
+	MaxTokens    int              `json:"max_tokens,omitempty"`
+	Temperature  *float64         `json:"temperature,omitempty"`
+	Tools        []ToolDefinition `json:"tools,omitempty"`
+}
+
+// ChatCompletionResponse represents a provider-neutral completion result
+type ChatCompletionResponse struct {
+	Content      string     `json:"content"`
+	Model        string     `json:"model"`
+	FinishReason string     `json:"finish_reason"`
+	ToolCalls    []ToolCall `json:"tool_calls,omitempty"`
+	Usage        TokenUsage `json:"usage"`
+}
+
+// TokenUsage represents the tokens consumed by a request
+type TokenUsage struct {
+	PromptTokens int64 `json:"prompt_tokens"`
+	OutputTokens int64 `json:"output_tokens"`
+}
+
+// Total returns the sum of prompt and output tokens
+func (u TokenUsage) Total() int64 {
+	return u.PromptTokens + u.OutputTokens
+}
+
+// Add accumulates the usage of another request
+func (u *TokenUsage) Add(other TokenUsage) {
+	u.PromptTokens += other.PromptTokens
+	u.OutputTokens += other.OutputTokens
+}
+
+// EmbeddingResponse represents the result of an embeddings request
+type EmbeddingResponse struct {
+	Model      string      `json:"model"`
+	Embeddings [][]float64 `json:"embeddings"`
+	Usage      TokenUsage  `json:"usage"`
+}
+
+// LLMError is returned when a provider answers with a non-success status
+type LLMError struct {
+	Provider   string
+	StatusCode int
+	Message    string
+}
+
+func (e *LLMError) Error() string {
+	return fmt.Sprintf("%s provider returned status %d: %s", e.Provider, e.StatusCode, e.Message)
+}
+
+// IsAuthError reports whether the provider rejected the credentials
+func (e *LLMError) IsAuthError() bool {
+	return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+}
+
+// IsLLMAuthError reports whether err is an authentication failure from a provider
+func IsLLMAuthError(err error) bool {
+	var llmErr *LLMError
+	return errors.As(err, &llmErr) && llmErr.IsAuthError()
+}
+
+// IsTransientLLMError reports whether err is a provider failure worth retrying:
+// rate limiting, server errors, timeouts and network failures
+func IsTransientLLMError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var llmErr *LLMError
+	if errors.As(err, &llmErr) {
+		return llmErr.StatusCode == http.StatusTooManyRequests ||
+			llmErr.StatusCode == http.StatusRequestTimeout ||
+			llmErr.StatusCode >= 500
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// LLMClientConfig holds the settings needed to build an LLMClient
+type LLMClientConfig struct {
+	Type       string
+	BaseURL    string
+	APIKey     string
+	HTTPClient *http.Client
+}
+
+// NewLLMClient creates the adapter for the given provider type
+func NewLLMClient(cfg LLMClientConfig) (LLMClient, error) {
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 120 * time.Second}
+	}
+	cfg.BaseURL = strings.TrimRight(cfg.BaseURL, "/")
+
+	switch cfg.Type {
+	case "openai", "local":
+		if cfg.BaseURL == "" {
+			return nil, errors.New("LLM provider has no endpoint configured")
+		}
+		return newOpenAIClient(cfg), nil
+	case "anthropic":
+		return newAnthropicClient(cfg), nil
+	default:
+		return nil, fmt.Errorf("unsupported provider type: %s", cfg.Type)
+	}
+}
+
+// LLMClientConfigFor builds client settings from the base_url, api_key and
+// endpoint keys stored in LLMProvider.Config. The environment keys are only
+// sent to the provider's public API, and only local providers may be served
+// from an internal address.
+func LLMClientConfigFor(providerType string, settings map[string]interface{}, appCfg *config.Config) LLMClientConfig {
+	baseURL, _ := settings["base_url"].(string)
+	if baseURL == "" {
+		baseURL, _ = settings["endpoint"].(string)
+	}
+	apiKey, _ := settings["api_key"].(string)
+
+	var publicHost, envKey string
+	switch providerType {
+	case "openai":
+		if baseURL == "" {
+			baseURL = "https://api.openai.com/v1"
+		}
+		publicHost, envKey = "api.openai.com", appCfg.LLM.OpenAIAPIKey
+	case "anthropic":
+		if baseURL == "" {
+			baseURL = "https://api.anthropic.com"
+		}
+		publicHost, envKey = "api.anthropic.com", appCfg.LLM.AnthropicAPIKey
+	}
+	if apiKey == "" && publicHost != "" {
+		if u, err := url.Parse(baseURL); err == nil && u.Scheme == "https" && strings.EqualFold(u.Host, publicHost) {
+			apiKey = envKey
+		}
+	}
+
+	timeout := time.Duration(appCfg.LLM.RequestTimeoutSeconds) * time.Second
+	httpClient := &http.Client{Timeout: timeout}
+	if providerType != "local" {
+		httpClient.Transport = &http.Transport{
+			Proxy:               nil,
+			DialContext:         newPublicDialer(30 * time.Second).DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		}
+	}
+
+	return LLMClientConfig{
+		Type:       providerType,
+		BaseURL:    baseURL,
+		APIKey:     apiKey,
+		HTTPClient: httpClient,
+	}
+}
+
+// NewLLMClientForProvider creates a client for a stored provider row
+func NewLLMClientForProvider(provider *models.LLMProvider, appCfg *config.Config) (LLMClient, error) {
+	settings := make(map[string]interface{})
+	if len(provider.Config) > 0 {
+		if err := json.Unmarshal(provider.Config, &settings); err != nil {
+			return nil, fmt.Errorf("invalid configuration for provider %s: %v", provider.Name, err)
+		}
+	}
+	return NewLLMClient(LLMClientConfigFor(provider.Type, settings, appCfg))
+}
+
+// llmTransport holds the HTTP plumbing shared by the provider adapters
+type llmTransport struct {
+	provider   string
+	httpClient *http.Client
+	headers    map[string]string
+}
+
+// newRequest builds a request carrying the provider's auth headers
+func (t *llmTransport) newRequest(ctx context.Context, method, url string, payload interface{}) (*http.Request, error) {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	return req, nil
+}
+
+// do sends a request and returns the response, converting error statuses to LLMError
+func (t *llmTransport) do(req *http.Request) (*http.Response, error) {
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s provider request failed: %w", t.provider, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		return nil, &LLMError{
+			Provider:   t.provider,
+			StatusCode: resp.StatusCode,
+			Message:    extractLLMErrorMessage(body),
+		}
+	}
+	return resp, nil
+}
+
+// doJSON sends a JSON request and decodes the JSON response into out
+func (t *llmTransport) doJSON(ctx context.Context, method, url string, payload, out interface{}) error {
+	req, err := t.newRequest(ctx, method, url, payload)
+	if err != nil {
+		return err
+	}
+	resp, err := t.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 10<<20))
+	if err != nil {
+		return fmt.Errorf("failed to read %s provider response: %v", t.provider, err)
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("failed to decode %s provider response: %v", t.provider, err)
+	}
+	return nil
+}
+
+// extractLLMErrorMessage pulls the message out of a provider error body
+func extractLLMErrorMessage(body []byte) string {
+	var parsed struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &parsed); err == nil && parsed.Error.Message != "" {
+		return parsed.Error.Message
+	}
+	return strings.TrimSpace(string(body))
+}
+
+// readServerSentEvents calls fn with the payload of every "data:" line in body
+func readServerSentEvents(body io.Reader, fn func(data string) (bool, error)) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		done, err := fn(strings.TrimSpace(strings.TrimPrefix(line, "data:")))
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,232 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mlaitechio/vagais/internal/config"
+)
+
+// llmStub stands in for a provider's API and records the last request it got
+type llmStub struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	method  string
+	path    string
+	headers http.Header
+	body    map[string]interface{}
+}
+
+// newLLMStub starts a stand-in that answers every request with respond
+func newLLMStub(t *testing.T, respond http.HandlerFunc) *llmStub {
+	t.Helper()
+	stub := &llmStub{}
+	stub.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		var body map[string]interface{}
+		if len(raw) > 0 {
+			if err := json.Unmarshal(raw, &body); err != nil {
+				t.Errorf("request body is not JSON: %v", err)
+			}
+		}
+		stub.mu.Lock()
+		stub.method, stub.path, stub.headers, stub.body = r.Method, r.URL.Path, r.Header.Clone(), body
+		stub.mu.Unlock()
+		respond(w, r)
+	}))
+	t.Cleanup(stub.Close)
+	return stub
+}
+
+// request returns the last request's method, path, headers and decoded body
+func (s *llmStub) request() (string, string, http.Header, map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.method, s.path, s.headers, s.body
+}
+
+// client creates the adapter for providerType against the stand-in
+func (s *llmStub) client(t *testing.T, providerType string) LLMClient {
+	t.Helper()
+	client, err := NewLLMClient(LLMClientConfig{Type: providerType, BaseURL: s.URL, APIKey: "test-key"})
+	if err != nil {
+		t.Fatalf("NewLLMClient(%s) error = %v", providerType, err)
+	}
+	return client
+}
+
+// respondJSON answers with status and a JSON body
+func respondJSON(status int, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}
+}
+
+// respondEvents answers with a server-sent event stream of the given data lines
+func respondEvents(events ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range events {
+			fmt.Fprintf(w, "data: %s\n\n", event)
+			w.(http.Flusher).Flush()
+		}
+	}
+}
+
+// testLLMConfig returns application settings with provider keys from the environment
+func testLLMConfig() *config.Config {
+	return &config.Config{LLM: config.LLMConfig{
+		RequestTimeoutSeconds: 30,
+		OpenAIAPIKey:          "env-openai-key",
+		AnthropicAPIKey:       "env-anthropic-key",
+	}}
+}
+
+// collectDeltas returns a StreamHandler appending to deltas
+func collectDeltas(deltas *[]string) StreamHandler {
+	return func(delta string) error {
+		*deltas = append(*deltas, delta)
+		return nil
+	}
+}
+
+func TestLLMErrorPropagation(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		message   string
+		auth      bool
+		transient bool
+	}{
+		{name: "invalid key", status: http.StatusUnauthorized, body: `{"error":{"message":"Incorrect API key provided"}}`, message: "Incorrect API key provided", auth: true},
+		{name: "forbidden", status: http.StatusForbidden, body: `{"error":{"type":"permission_error","message":"not allowed"}}`, message: "not allowed", auth: true},
+		{name: "bad request", status: http.StatusBadRequest, body: `{"error":{"message":"max_tokens is too large"}}`, message: "max_tokens is too large"},
+		{name: "rate limited", status: http.StatusTooManyRequests, body: `{"error":{"message":"Rate limit reached"}}`, message: "Rate limit reached", transient: true},
+		{name: "overloaded", status: 529, body: `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`, message: "Overloaded", transient: true},
+		{name: "plain text body", status: http.StatusBadGateway, body: "upstream unavailable\n", message: "upstream unavailable", transient: true},
+	}
+
+	for _, providerType := range []string{"openai", "anthropic"} {
+		for _, tt := range tests {
+			t.Run(providerType+"/"+tt.name, func(t *testing.T) {
+				stub := newLLMStub(t, respondJSON(tt.status, tt.body))
+				client := stub.client(t, providerType)
+				req := &ChatCompletionRequest{Model: "m", Messages: []ChatMessage{{Role: "user", Content: "hi"}}}
+
+				for name, call := range map[string]func() error{
+					"ChatCompletion": func() error { _, err := client.ChatCompletion(context.Background(), req); return err },
+					"StreamChatCompletion": func() error {
+						_, err := client.StreamChatCompletion(context.Background(), req, func(string) error { return nil })
+						return err
+					},
+					"HealthCheck": func() error { return client.HealthCheck(context.Background()) },
+				} {
+					err := call()
+					var llmErr *LLMError
+					if !errors.As(err, &llmErr) {
+						t.Fatalf("%s error = %v, want an LLMError", name, err)
+					}
+					if llmErr.StatusCode != tt.status || llmErr.Message != tt.message || llmErr.Provider != providerType {
+						t.Errorf("%s error = %+v, want status %d and message %q", name, llmErr, tt.status, tt.message)
+					}
+					if IsLLMAuthError(err) != tt.auth || IsTransientLLMError(err) != tt.transient {
+						t.Errorf("%s: auth = %v, transient = %v, want %v, %v", name, IsLLMAuthError(err), IsTransientLLMError(err), tt.auth, tt.transient)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestIsTransientLLMError(t *testing.T) {
+	// A provider that does not answer in time fails with a network timeout
+	stub := newLLMStub(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	})
+	client, err := NewLLMClient(LLMClientConfig{Type: "openai", BaseURL: stub.URL, HTTPClient: &http.Client{Timeout: 50 * time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, timeoutErr := client.ChatCompletion(context.Background(), &ChatCompletionRequest{Model: "m"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, cancelledErr := client.ChatCompletion(ctx, &ChatCompletionRequest{Model: "m"})
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "timeout", err: timeoutErr, want: true},
+		{name: "cancelled", err: cancelledErr, want: false},
+		{name: "request timeout status", err: &LLMError{StatusCode: http.StatusRequestTimeout}, want: true},
+		{name: "server error", err: fmt.Errorf("attempt 2: %w", &LLMError{StatusCode: http.StatusInternalServerError}), want: true},
+		{name: "not found", err: &LLMError{StatusCode: http.StatusNotFound}, want: false},
+		{name: "other error", err: errors.New("invalid arguments for tool"), want: false},
+	}
+	for _, tt := range tests {
+		if got := IsTransientLLMError(tt.err); got != tt.want {
+			t.Errorf("IsTransientLLMError(%s: %v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestNewLLMClient(t *testing.T) {
+	if _, err := NewLLMClient(LLMClientConfig{Type: "local"}); err == nil {
+		t.Error("local provider without an endpoint: want an error")
+	}
+	if _, err := NewLLMClient(LLMClientConfig{Type: "cohere", BaseURL: "https://api.example.com"}); err == nil {
+		t.Error("unsupported provider type: want an error")
+	}
+
+	var settings map[string]interface{}
+	json.Unmarshal([]byte(`{"endpoint":"http://llm.internal:8000/v1/","api_key":"stored-key"}`), &settings)
+	cfg := LLMClientConfigFor("local", settings, testLLMConfig())
+	if cfg.BaseURL != "http://llm.internal:8000/v1/" || cfg.APIKey != "stored-key" || cfg.HTTPClient.Timeout != 30*time.Second {
+		t.Errorf("LLMClientConfigFor(local) = %+v, want the stored endpoint and key", cfg)
+	}
+
+	cfg = LLMClientConfigFor("anthropic", map[string]interface{}{}, testLLMConfig())
+	if cfg.BaseURL != "https://api.anthropic.com" || cfg.APIKey != "env-anthropic-key" {
+		t.Errorf("LLMClientConfigFor(anthropic) = %+v, want the public API and the environment key", cfg)
+	}
+
+	// The environment keys are only sent to the public APIs
+	tests := []struct {
+		providerType string
+		baseURL      string
+		want         string
+	}{
+		{providerType: "openai", baseURL: "https://api.openai.com/v1", want: "env-openai-key"},
+		{providerType: "openai", baseURL: "https://API.openai.com/v1/", want: "env-openai-key"},
+		{providerType: "anthropic", baseURL: "https://api.anthropic.com/v1", want: "env-anthropic-key"},
+		{providerType: "openai", baseURL: "https://attacker.example/v1", want: ""},
+		{providerType: "openai", baseURL: "http://api.openai.com/v1", want: ""},
+		{providerType: "openai", baseURL: "https://api.openai.com.attacker.example", want: ""},
+		{providerType: "anthropic", baseURL: "https://api.openai.com", want: ""},
+		{providerType: "local", baseURL: "http://localhost:8000", want: ""},
+	}
+	for _, tt := range tests {
+		cfg := LLMClientConfigFor(tt.providerType, map[string]interface{}{"base_url": tt.baseURL}, testLLMConfig())
+		if cfg.APIKey != tt.want {
+			t.Errorf("LLMClientConfigFor(%s, %s) key = %q, want %q", tt.providerType, tt.baseURL, cfg.APIKey, tt.want)
+		}
+	}
+}
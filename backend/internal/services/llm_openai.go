@@ -0,0 +1,303 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// openAIClient talks to OpenAI and to local servers exposing the same API
+type openAIClient struct {
+	llmTransport
+	baseURL      string
+	includeUsage bool
+}
+
+// newOpenAIClient creates an adapter for an OpenAI-compatible endpoint
+func newOpenAIClient(cfg LLMClientConfig) *openAIClient {
+	baseURL := cfg.BaseURL
+	if !strings.HasSuffix(baseURL, "/v1") {
+		baseURL += "/v1"
+	}
+
+	headers := map[string]string{}
+	if cfg.APIKey != "" {
+		headers["Authorization"] = "Bearer " + cfg.APIKey
+	}
+
+	return &openAIClient{
+		llmTransport: llmTransport{
+			provider:   cfg.Type,
+			httpClient: cfg.HTTPClient,
+			headers:    headers,
+		},
+		baseURL: baseURL,
+		// Local servers do not all understand stream_options
+		includeUsage: cfg.Type == "openai",
+	}
+}
+
+// openAIMessage is a chat message in the OpenAI wire format
+type openAIMessage struct {
+	Role       string           `json:"role"`
+	Content    *string          `json:"content"`
+	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+// openAIToolCall is a function call requested by the model
+type openAIToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+// text returns the message content, treating null as empty
+func (m openAIMessage) text() string {
+	if m.Content == nil {
+		return ""
+	}
+	return *m.Content
+}
+
+// openAIChoice is a single choice in a chat completion response
+type openAIChoice struct {
+	Message      openAIMessage `json:"message"`
+	Delta        openAIMessage `json:"delta"`
+	FinishReason string        `json:"finish_reason"`
+}
+
+// openAIUsage is the usage block of a chat completion response
+type openAIUsage struct {
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+}
+
+// openAIChatResponse is a chat completion response or stream chunk
+type openAIChatResponse struct {
+	Model   string         `json:"model"`
+	Choices []openAIChoice `json:"choices"`
+	Usage   *openAIUsage   `json:"usage"`
+}
+
+// buildPayload converts a neutral request into the OpenAI wire format
+func (c *openAIClient) buildPayload(req *ChatCompletionRequest, stream bool) map[string]interface{} {
+	messages := make([]openAIMessage, 0, len(req.Messages)+1)
+	if req.SystemPrompt != "" {
+		messages = append(messages, toOpenAIMessage(ChatMessage{Role: "system", Content: req.SystemPrompt}))
+	}
+	for _, m := range req.Messages {
+		messages = append(messages, toOpenAIMessage(m))
+	}
+
+	payload := map[string]interface{}{
+		"model":    req.Model,
+		"messages": messages,
+	}
+	if len(req.Tools) > 0 {
+		tools := make([]map[string]interface{}, 0, len(req.Tools))
+		for _, tool := range req.Tools {
+			tools = append(tools, map[string]interface{}{
+				"type": "function",
+				"function": map[string]interface{}{
+					"name":        tool.Name,
+					"description": tool.Description,
+					"parameters":  tool.Parameters,
+				},
+			})
+		}
+		payload["tools"] = tools
+	}
+	if req.MaxTokens > 0 {
+		payload["max_tokens"] = req.MaxTokens
+	}
+	if req.Temperature != nil {
+		payload["temperature"] = *req.Temperature
+	}
+	if stream {
+		payload["stream"] = true
+		if c.includeUsage {
+			payload["stream_options"] = map[string]interface{}{"include_usage": true}
+		}
+	}
+	return payload
+}
+
+// toOpenAIMessage converts a neutral message into the OpenAI wire format
+func toOpenAIMessage(m ChatMessage) openAIMessage {
+	content := m.Content
+	msg := openAIMessage{
+		Role:       m.Role,
+		Content:    &content,
+		ToolCallID: m.ToolCallID,
+	}
+	for _, call := range m.ToolCalls {
+		args, _ := json.Marshal(call.Arguments)
+		wire := openAIToolCall{ID: call.ID, Type: "function"}
+		wire.Function.Name = call.Name
+		wire.Function.Arguments = string(args)
+		msg.ToolCalls = append(msg.ToolCalls, wire)
+	}
+	// Assistant turns that only call tools send null content
+	if content == "" && len(msg.ToolCalls) > 0 {
+		msg.Content = nil
+	}
+	return msg
+}
+
+// ChatCompletion sends a non-streaming chat completion request
+func (c *openAIClient) ChatCompletion(ctx context.Context, req *ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	var resp openAIChatResponse
+	if err := c.doJSON(ctx, http.MethodPost, c.baseURL+"/chat/completions", c.buildPayload(req, false), &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Choices) == 0 {
+		return nil, errors.New("LLM provider returned no choices")
+	}
+
+	message := resp.Choices[0].Message
+	result := &ChatCompletionResponse{
+		Content:      message.text(),
+		Model:        resp.Model,
+		FinishReason: resp.Choices[0].FinishReason,
+	}
+	for _, call := range message.ToolCalls {
+		args := make(map[string]interface{})
+		if call.Function.Arguments != "" {
+			if err := json.Unmarshal([]byte(call.Function.Arguments), &args); err != nil {
+				return nil, fmt.Errorf("invalid arguments for tool %s: %v", call.Function.Name, err)
+			}
+		}
+		result.ToolCalls = append(result.ToolCalls, ToolCall{
+			ID:        call.ID,
+			Name:      call.Function.Name,
+			Arguments: args,
+		})
+	}
+	if resp.Usage != nil {
+		result.Usage = TokenUsage{
+			PromptTokens: resp.Usage.PromptTokens,
+			OutputTokens: resp.Usage.CompletionTokens,
+		}
+	}
+	return result, nil
+}
+
+// StreamChatCompletion sends a streaming chat completion request
+func (c *openAIClient) StreamChatCompletion(ctx context.Context, req *ChatCompletionRequest, onDelta StreamHandler) (*ChatCompletionResponse, error) {
+	httpReq, err := c.newRequest(ctx, http.MethodPost, c.baseURL+"/chat/completions", c.buildPayload(req, true))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Accept", "text/event-stream")
+
+	resp, err := c.do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := &ChatCompletionResponse{Model: req.Model}
+	var content strings.Builder
+	err = readServerSentEvents(resp.Body, func(data string) (bool, error) {
+		if data == "[DONE]" {
+			return true, nil
+		}
+
+		var chunk openAIChatResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return false, fmt.Errorf("failed to decode stream chunk: %v", err)
+		}
+		if chunk.Model != "" {
+			result.Model = chunk.Model
+		}
+		if chunk.Usage != nil {
+			result.Usage = TokenUsage{
+				PromptTokens: chunk.Usage.PromptTokens,
+				OutputTokens: chunk.Usage.CompletionTokens,
+			}
+		}
+		for _, choice := range chunk.Choices {
+			if choice.FinishReason != "" {
+				result.FinishReason = choice.FinishReason
+			}
+			delta := choice.Delta.text()
+			if delta == "" {
+				continue
+			}
+			content.WriteString(delta)
+			if err := onDelta(delta); err != nil {
+				return false, err
+			}
+		}
+		return false, nil
+	})
+	result.Content = content.String()
+	if err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// CreateEmbeddings requests embeddings for the given inputs
+func (c *openAIClient) CreateEmbeddings(ctx context.Context, model string, inputs []string) (*EmbeddingResponse, error) {
+	payload := map[string]interface{}{
+		"model": model,
+		"input": inputs,
+	}
+
+	var resp struct {
+		Model string `json:"model"`
+		Data  []struct {
+			Index     int       `json:"index"`
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+		Usage openAIUsage `json:"usage"`
+	}
+	if err := c.doJSON(ctx, http.MethodPost, c.baseURL+"/embeddings", payload, &resp); err != nil {
+		return nil, err
+	}
+
+	embeddings := make([][]float64, len(inputs))
+	for _, item := range resp.Data {
+		if item.Index >= 0 && item.Index < len(embeddings) {
+			embeddings[item.Index] = item.Embedding
+		}
+	}
+
+	return &EmbeddingResponse{
+		Model:      resp.Model,
+		Embeddings: embeddings,
+		Usage:      TokenUsage{PromptTokens: resp.Usage.PromptTokens},
+	}, nil
+}
+
+// ListModels returns the identifiers of the models the endpoint serves
+func (c *openAIClient) ListModels(ctx context.Context) ([]string, error) {
+	var resp struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := c.doJSON(ctx, http.MethodGet, c.baseURL+"/models", nil, &resp); err != nil {
+		return nil, err
+	}
+
+	modelIDs := make([]string, 0, len(resp.Data))
+	for _, m := range resp.Data {
+		modelIDs = append(modelIDs, m.ID)
+	}
+	return modelIDs, nil
+}
+
+// HealthCheck verifies the endpoint is reachable and accepts the credentials
+func (c *openAIClient) HealthCheck(ctx context.Context) error {
+	_, err := c.ListModels(ctx)
+	return err
+}
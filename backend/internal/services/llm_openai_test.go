@@ -0,0 +1,256 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOpenAIChatCompletion(t *testing.T) {
+	stub := newLLMStub(t, respondJSON(http.StatusOK, `{
+		"model": "gpt-4o-2024-08-06",
+		"choices": [{
+			"message": {
+				"role": "assistant",
+				"content": null,
+				"tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "calculator", "arguments": "{\"expression\":\"6*7\"}"}}]
+			},
+			"finish_reason": "tool_calls"
+		}],
+		"usage": {"prompt_tokens": 82, "completion_tokens": 17, "total_tokens": 99}
+	}`))
+	client := stub.client(t, "openai")
+
+	temperature := 0.2
+	resp, err := client.ChatCompletion(context.Background(), &ChatCompletionRequest{
+		Model:        "gpt-4o",
+		SystemPrompt: "You are terse.",
+		MaxTokens:    256,
+		Temperature:  &temperature,
+		Messages: []ChatMessage{
+			{Role: "user", Content: "What is 6*7?"},
+			{Role: "assistant", ToolCalls: []ToolCall{{ID: "call_0", Name: "calculator", Arguments: map[string]interface{}{"expression": "6"}}}},
+			{Role: "tool", ToolCallID: "call_0", Content: "6"},
+		},
+		Tools: []ToolDefinition{{
+			Name:        "calculator",
+			Description: "Evaluates arithmetic",
+			Parameters:  map[string]interface{}{"type": "object"},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("ChatCompletion() error = %v", err)
+	}
+
+	method, path, headers, body := stub.request()
+	if method != http.MethodPost || path != "/v1/chat/completions" {
+		t.Errorf("request = %s %s, want POST /v1/chat/completions", method, path)
+	}
+	if got := headers.Get("Authorization"); got != "Bearer test-key" {
+		t.Errorf("Authorization = %q, want the API key as a bearer token", got)
+	}
+	wantBody := map[string]interface{}{
+		"model":       "gpt-4o",
+		"max_tokens":  256.0,
+		"temperature": 0.2,
+		"messages": []interface{}{
+			map[string]interface{}{"role": "system", "content": "You are terse."},
+			map[string]interface{}{"role": "user", "content": "What is 6*7?"},
+			// An assistant turn that only calls tools has null content
+			map[string]interface{}{"role": "assistant", "content": nil, "tool_calls": []interface{}{
+				map[string]interface{}{"id": "call_0", "type": "function", "function": map[string]interface{}{
+					"name": "calculator", "arguments": `{"expression":"6"}`,
+				}},
+			}},
+			map[string]interface{}{"role": "tool", "content": "6", "tool_call_id": "call_0"},
+		},
+		"tools": []interface{}{
+			map[string]interface{}{"type": "function", "function": map[string]interface{}{
+				"name": "calculator", "description": "Evaluates arithmetic", "parameters": map[string]interface{}{"type": "object"},
+			}},
+		},
+	}
+	if !reflect.DeepEqual(body, wantBody) {
+		got, _ := json.MarshalIndent(body, "", "  ")
+		t.Errorf("request body = %s", got)
+	}
+
+	want := &ChatCompletionResponse{
+		Model:        "gpt-4o-2024-08-06",
+		FinishReason: "tool_calls",
+		ToolCalls:    []ToolCall{{ID: "call_1", Name: "calculator", Arguments: map[string]interface{}{"expression": "6*7"}}},
+		Usage:        TokenUsage{PromptTokens: 82, OutputTokens: 17},
+	}
+	if !reflect.DeepEqual(resp, want) {
+		t.Errorf("ChatCompletion() = %+v, want %+v", resp, want)
+	}
+}
+
+func TestOpenAIChatCompletionInvalidResponses(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{name: "no choices", body: `{"model":"gpt-4o","choices":[]}`, want: "no choices"},
+		{name: "malformed tool arguments", body: `{"choices":[{"message":{"role":"assistant","tool_calls":[{"id":"1","type":"function","function":{"name":"calculator","arguments":"{oops"}}]}}]}`, want: "invalid arguments for tool calculator"},
+		{name: "not JSON", body: `<html>gateway</html>`, want: "failed to decode openai provider response"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newLLMStub(t, respondJSON(http.StatusOK, tt.body))
+			_, err := stub.client(t, "openai").ChatCompletion(context.Background(), &ChatCompletionRequest{Model: "gpt-4o"})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("ChatCompletion() error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenAIStreamChatCompletion(t *testing.T) {
+	stub := newLLMStub(t, respondEvents(
+		`{"model":"gpt-4o-2024-08-06","choices":[{"delta":{"role":"assistant","content":""}}]}`,
+		`{"model":"gpt-4o-2024-08-06","choices":[{"delta":{"content":"Forty"}}]}`,
+		`{"model":"gpt-4o-2024-08-06","choices":[{"delta":{"content":"-two"}}]}`,
+		`{"model":"gpt-4o-2024-08-06","choices":[{"delta":{},"finish_reason":"stop"}]}`,
+		`{"model":"gpt-4o-2024-08-06","choices":[],"usage":{"prompt_tokens":12,"completion_tokens":3}}`,
+		`[DONE]`,
+		`{"choices":[{"delta":{"content":"after done"}}]}`,
+	))
+	client := stub.client(t, "openai")
+
+	var deltas []string
+	resp, err := client.StreamChatCompletion(context.Background(), &ChatCompletionRequest{
+		Model:    "gpt-4o",
+		Messages: []ChatMessage{{Role: "user", Content: "What is 6*7?"}},
+	}, collectDeltas(&deltas))
+	if err != nil {
+		t.Fatalf("StreamChatCompletion() error = %v", err)
+	}
+
+	_, _, headers, body := stub.request()
+	if body["stream"] != true || !reflect.DeepEqual(body["stream_options"], map[string]interface{}{"include_usage": true}) {
+		t.Errorf("request body = %v, want stream with include_usage", body)
+	}
+	if headers.Get("Accept") != "text/event-stream" {
+		t.Errorf("Accept = %q, want text/event-stream", headers.Get("Accept"))
+	}
+	if !reflect.DeepEqual(deltas, []string{"Forty", "-two"}) {
+		t.Errorf("deltas = %q, want [Forty -two]", deltas)
+	}
+	want := &ChatCompletionResponse{
+		Content:      "Forty-two",
+		Model:        "gpt-4o-2024-08-06",
+		FinishReason: "stop",
+		Usage:        TokenUsage{PromptTokens: 12, OutputTokens: 3},
+	}
+	if !reflect.DeepEqual(resp, want) {
+		t.Errorf("StreamChatCompletion() = %+v, want %+v", resp, want)
+	}
+}
+
+func TestOpenAIStreamStopsWithPartialContent(t *testing.T) {
+	stub := newLLMStub(t, respondEvents(
+		`{"choices":[{"delta":{"content":"one"}}]}`,
+		`{"choices":[{"delta":{"content":" two"}}]}`,
+		`{"choices":[{"delta":{"content":" three"}}]}`,
+		`[DONE]`,
+	))
+	client := stub.client(t, "openai")
+
+	// The handler failing, e.g. because the client went away, ends the stream
+	stop := errors.New("client disconnected")
+	var deltas []string
+	resp, err := client.StreamChatCompletion(context.Background(), &ChatCompletionRequest{Model: "gpt-4o"}, func(delta string) error {
+		deltas = append(deltas, delta)
+		if len(deltas) == 2 {
+			return stop
+		}
+		return nil
+	})
+	if !errors.Is(err, stop) {
+		t.Fatalf("StreamChatCompletion() error = %v, want the handler's error", err)
+	}
+	if resp == nil || resp.Content != "one two" || resp.Model != "gpt-4o" {
+		t.Errorf("StreamChatCompletion() = %+v, want the partial content of the requested model", resp)
+	}
+
+	stub = newLLMStub(t, respondEvents(`{"choices":[{"delta":{"content":"one"}}]}`, `{not json`))
+	resp, err = stub.client(t, "openai").StreamChatCompletion(context.Background(), &ChatCompletionRequest{Model: "gpt-4o"}, func(string) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "failed to decode stream chunk") || resp.Content != "one" {
+		t.Errorf("malformed chunk: response = %+v, error = %v, want the content so far and a decode error", resp, err)
+	}
+}
+
+func TestLocalProviderOmitsStreamOptions(t *testing.T) {
+	stub := newLLMStub(t, respondEvents(`{"choices":[{"delta":{"content":"hi"}}]}`, `[DONE]`))
+	client, err := NewLLMClient(LLMClientConfig{Type: "local", BaseURL: stub.URL + "/v1/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.StreamChatCompletion(context.Background(), &ChatCompletionRequest{Model: "llama3"}, func(string) error { return nil })
+	if err != nil {
+		t.Fatalf("StreamChatCompletion() error = %v", err)
+	}
+	_, path, headers, body := stub.request()
+	if path != "/v1/chat/completions" {
+		t.Errorf("path = %s, want /v1/chat/completions", path)
+	}
+	if _, ok := body["stream_options"]; ok {
+		t.Error("local provider was sent stream_options")
+	}
+	if headers.Get("Authorization") != "" {
+		t.Error("Authorization was sent without an API key")
+	}
+	// Without reported usage the tokens are left for the caller to estimate
+	if resp.Usage != (TokenUsage{}) {
+		t.Errorf("usage = %+v, want none", resp.Usage)
+	}
+}
+
+func TestOpenAIEmbeddingsAndModels(t *testing.T) {
+	stub := newLLMStub(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/embeddings":
+			// Items may come back in any order
+			respondJSON(http.StatusOK, `{"model":"text-embedding-3-small","data":[
+				{"index":1,"embedding":[0.3,0.4]},
+				{"index":0,"embedding":[0.1,0.2]}
+			],"usage":{"prompt_tokens":9,"total_tokens":9}}`)(w, r)
+		case "/v1/models":
+			respondJSON(http.StatusOK, `{"data":[{"id":"gpt-4o"},{"id":"text-embedding-3-small"}]}`)(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	client := stub.client(t, "openai")
+
+	embeddings, err := client.CreateEmbeddings(context.Background(), "text-embedding-3-small", []string{"first", "second"})
+	if err != nil {
+		t.Fatalf("CreateEmbeddings() error = %v", err)
+	}
+	want := &EmbeddingResponse{
+		Model:      "text-embedding-3-small",
+		Embeddings: [][]float64{{0.1, 0.2}, {0.3, 0.4}},
+		Usage:      TokenUsage{PromptTokens: 9},
+	}
+	if !reflect.DeepEqual(embeddings, want) {
+		t.Errorf("CreateEmbeddings() = %+v, want %+v", embeddings, want)
+	}
+	if _, _, _, body := stub.request(); !reflect.DeepEqual(body["input"], []interface{}{"first", "second"}) {
+		t.Errorf("embeddings input = %v, want both texts", body["input"])
+	}
+
+	models, err := client.ListModels(context.Background())
+	if err != nil || !reflect.DeepEqual(models, []string{"gpt-4o", "text-embedding-3-small"}) {
+		t.Errorf("ListModels() = %v, %v, want both models", models, err)
+	}
+	if method, path, _, _ := stub.request(); method != http.MethodGet || path != "/v1/models" {
+		t.Errorf("ListModels() requested %s %s, want GET /v1/models", method, path)
+	}
+}
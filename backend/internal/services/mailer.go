@@ -0,0 +1,271 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mlaitechio/vagais/internal/config"
+)
+
+// errInvalidEmailAddress is returned for messages with a malformed sender or recipient
+var errInvalidEmailAddress = errors.New("invalid email address")
+
+// Mailer is implemented by every email transport
+type Mailer interface {
+	Name() string
+	Send(ctx context.Context, message *EmailMessage) error
+}
+
+// EmailMessage is a rendered email ready to be sent
+type EmailMessage struct {
+	MessageID string
+	From      string
+	To        string
+	Subject   string
+	Text      string
+	HTML      string
+}
+
+// NewMailer creates the mail transport selected in the configuration
+func NewMailer(cfg *config.Config) (Mailer, error) {
+	transport := strings.ToLower(cfg.Email.Transport)
+	if transport == "" {
+		transport = "outbox"
+		if cfg.Email.SMTPHost != "" {
+			transport = "smtp"
+		}
+	}
+
+	switch transport {
+	case "smtp":
+		if cfg.Email.SMTPHost == "" {
+			return nil, errors.New("SMTP_HOST is required for the smtp email transport")
+		}
+		return NewSMTPMailer(cfg.Email), nil
+	case "outbox":
+		return NewOutboxMailer(cfg.Email.OutboxDir), nil
+	default:
+		return nil, fmt.Errorf("unsupported email transport: %s", cfg.Email.Transport)
+	}
+}
+
+// SMTPMailer sends email through an SMTP server. Port 465 uses implicit TLS;
+// other ports upgrade with STARTTLS when the server offers it.
+type SMTPMailer struct {
+	host     string
+	port     int
+	username string
+	password string
+	timeout  time.Duration
+}
+
+// NewSMTPMailer creates an SMTP mailer
+func NewSMTPMailer(cfg config.EmailConfig) *SMTPMailer {
+	return &SMTPMailer{
+		host:     cfg.SMTPHost,
+		port:     cfg.SMTPPort,
+		username: cfg.SMTPUsername,
+		password: cfg.SMTPPassword,
+		timeout:  time.Duration(cfg.SMTPTimeoutSeconds) * time.Second,
+	}
+}
+
+// Name returns the transport name
+func (m *SMTPMailer) Name() string {
+	return "smtp"
+}
+
+// Send delivers the message over a new SMTP connection
+func (m *SMTPMailer) Send(ctx context.Context, message *EmailMessage) error {
+	raw, err := buildMIMEMessage(message)
+	if err != nil {
+		return err
+	}
+	from, to, err := parseMessageAddresses(message)
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(m.host, strconv.Itoa(m.port))
+	dialer := &net.Dialer{Timeout: m.timeout}
+	tlsConfig := &tls.Config{ServerName: m.host}
+	var conn net.Conn
+	if m.port == 465 {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(m.timeout))
+
+	client, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if m.port != 465 {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		}
+	}
+	if m.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.username, m.password, m.host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to.Address); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(raw); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// OutboxMailer writes each message as an .eml file instead of sending it,
+// for development and tests
+type OutboxMailer struct {
+	dir string
+}
+
+// NewOutboxMailer creates a mailer writing to dir
+func NewOutboxMailer(dir string) *OutboxMailer {
+	return &OutboxMailer{dir: dir}
+}
+
+// Name returns the transport name
+func (m *OutboxMailer) Name() string {
+	return "outbox"
+}
+
+// Send writes the message to the outbox directory
+func (m *OutboxMailer) Send(ctx context.Context, message *EmailMessage) error {
+	raw, err := buildMIMEMessage(message)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.dir, 0o755); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), uuid.New().String()[:8])
+	return os.WriteFile(filepath.Join(m.dir, name), raw, 0o644)
+}
+
+// isPermanentMailError reports whether retrying the send cannot help, as
+// when the server rejects the recipient
+func isPermanentMailError(err error) bool {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code >= 500
+	}
+	return errors.Is(err, errInvalidEmailAddress)
+}
+
+// parseMessageAddresses parses the sender and recipient of a message
+func parseMessageAddresses(message *EmailMessage) (*mail.Address, *mail.Address, error) {
+	from, err := mail.ParseAddress(message.From)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: sender %q", errInvalidEmailAddress, message.From)
+	}
+	to, err := mail.ParseAddress(message.To)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: recipient %q", errInvalidEmailAddress, message.To)
+	}
+	return from, to, nil
+}
+
+// buildMIMEMessage encodes the message as multipart/alternative with a text
+// and an HTML part
+func buildMIMEMessage(message *EmailMessage) ([]byte, error) {
+	from, to, err := parseMessageAddresses(message)
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+
+	for _, part := range []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=utf-8", message.Text},
+		{"text/html; charset=utf-8", message.HTML},
+	} {
+		if part.content == "" {
+			continue
+		}
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	headers := [][2]string{
+		{"From", from.String()},
+		{"To", to.String()},
+		{"Subject", mime.QEncoding.Encode("utf-8", message.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", message.MessageID},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + parts.Boundary()},
+	}
+	for _, header := range headers {
+		if header[1] == "" {
+			continue
+		}
+		fmt.Fprintf(&msg, "%s: %s\r\n", header[0], header[1])
+	}
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
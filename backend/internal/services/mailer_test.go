@@ -0,0 +1,268 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mlaitechio/vagais/internal/config"
+)
+
+// testMessage returns a message with a text and an HTML part
+func testMessage(to string) *EmailMessage {
+	return &EmailMessage{
+		MessageID: "<test-1@example.com>",
+		From:      "vagais <noreply@example.com>",
+		To:        to,
+		Subject:   "Grüße from vagais",
+		Text:      "Hello = world, with a line long enough to need wrapping in quoted-printable encoding.",
+		HTML:      "<p>Hello</p>",
+	}
+}
+
+func TestNewMailer(t *testing.T) {
+	tests := []struct {
+		name      string
+		transport string
+		smtpHost  string
+		want      string
+		wantErr   bool
+	}{
+		{name: "default", want: "outbox"},
+		{name: "default with an SMTP host", smtpHost: "smtp.example.com", want: "smtp"},
+		{name: "outbox", transport: "outbox", smtpHost: "smtp.example.com", want: "outbox"},
+		{name: "smtp", transport: "SMTP", smtpHost: "smtp.example.com", want: "smtp"},
+		{name: "smtp without a host", transport: "smtp", wantErr: true},
+		{name: "unknown", transport: "pigeon", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mailer, err := NewMailer(&config.Config{Email: config.EmailConfig{Transport: tt.transport, SMTPHost: tt.smtpHost}})
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("NewMailer() = %s, want an error", mailer.Name())
+				}
+				return
+			}
+			if err != nil || mailer.Name() != tt.want {
+				t.Errorf("NewMailer() = %v, %v, want %s", mailer, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutboxMailer(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "outbox")
+	mailer := NewOutboxMailer(dir)
+	if err := mailer.Send(context.Background(), testMessage("Ann <ann@example.com>")); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil || len(files) != 1 || filepath.Ext(files[0].Name()) != ".eml" {
+		t.Fatalf("outbox = %v, %v, want one .eml file", files, err)
+	}
+	raw, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(string(raw)))
+	if err != nil {
+		t.Fatalf("parsing the message: %v", err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != "Grüße from vagais" {
+		t.Errorf("Subject = %q, %v, want the original subject", subject, err)
+	}
+	for header, want := range map[string]string{
+		"From":       `"vagais" <noreply@example.com>`,
+		"To":         `"Ann" <ann@example.com>`,
+		"Message-Id": "<test-1@example.com>",
+	} {
+		if got := msg.Header.Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+	if text := emailText(t, strings.NewReader(string(raw))); text != testMessage("").Text {
+		t.Errorf("text part = %q, want the message text", text)
+	}
+	if !strings.Contains(string(raw), "text/html") {
+		t.Error("message has no HTML part")
+	}
+
+	// Messages with a malformed address are not written
+	if err := mailer.Send(context.Background(), testMessage("not an address")); !errors.Is(err, errInvalidEmailAddress) {
+		t.Errorf("Send() to a malformed address error = %v, want errInvalidEmailAddress", err)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Errorf("outbox has %d messages, want 1", len(files))
+	}
+}
+
+// smtpServer is a minimal SMTP server that records the messages it accepts
+type smtpServer struct {
+	port   int
+	reject string
+
+	mu   sync.Mutex
+	auth string
+	from string
+	to   string
+	data string
+}
+
+// newSMTPServer starts a server on localhost that refuses the recipient reject
+func newSMTPServer(t *testing.T, reject string) *smtpServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	server := &smtpServer{port: listener.Addr().(*net.TCPAddr).Port, reject: reject}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+// serve handles one SMTP session
+func (s *smtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		s.mu.Lock()
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			text.PrintfLine("250-localhost\r\n250 AUTH PLAIN")
+		case "AUTH":
+			s.auth = arg
+			text.PrintfLine("235 2.7.0 Authentication successful")
+		case "MAIL":
+			s.from = arg
+			text.PrintfLine("250 2.1.0 OK")
+		case "RCPT":
+			if s.reject != "" && strings.Contains(arg, s.reject) {
+				text.PrintfLine("550 5.1.1 No such user")
+				break
+			}
+			s.to = arg
+			text.PrintfLine("250 2.1.5 OK")
+		case "DATA":
+			text.PrintfLine("354 Go ahead")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				s.mu.Unlock()
+				return
+			}
+			s.data = string(data)
+			text.PrintfLine("250 2.0.0 Queued")
+		case "QUIT":
+			text.PrintfLine("221 2.0.0 Bye")
+			s.mu.Unlock()
+			return
+		default:
+			text.PrintfLine("502 5.5.2 Command not recognized")
+		}
+		s.mu.Unlock()
+	}
+}
+
+func TestSMTPMailer(t *testing.T) {
+	server := newSMTPServer(t, "nobody@example.com")
+	mailer := NewSMTPMailer(config.EmailConfig{
+		SMTPHost:           "127.0.0.1",
+		SMTPPort:           server.port,
+		SMTPUsername:       "mailer",
+		SMTPPassword:       "secret",
+		SMTPTimeoutSeconds: 5,
+	})
+
+	if err := mailer.Send(context.Background(), testMessage("Ann <ann@example.com>")); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	server.mu.Lock()
+	auth, from, to, data := server.auth, server.from, server.to, server.data
+	server.mu.Unlock()
+
+	if want := "PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00mailer\x00secret")); auth != want {
+		t.Errorf("AUTH %q, want %q", auth, want)
+	}
+	// The envelope carries the bare addresses
+	if from != "FROM:<noreply@example.com>" || to != "TO:<ann@example.com>" {
+		t.Errorf("envelope MAIL %q, RCPT %q, want the bare addresses", from, to)
+	}
+	if text := emailText(t, strings.NewReader(data)); text != testMessage("").Text {
+		t.Errorf("delivered text = %q, want the message text", text)
+	}
+
+	// A rejected recipient is a permanent failure
+	err := mailer.Send(context.Background(), testMessage("nobody@example.com"))
+	if err == nil || !isPermanentMailError(err) {
+		t.Errorf("Send() to a rejected recipient error = %v, want a permanent error", err)
+	}
+
+	// An unreachable server is worth retrying
+	closed := NewSMTPMailer(config.EmailConfig{SMTPHost: "127.0.0.1", SMTPPort: unusedPort(t), SMTPTimeoutSeconds: 5})
+	if err := closed.Send(context.Background(), testMessage("ann@example.com")); err == nil || isPermanentMailError(err) {
+		t.Errorf("Send() to a closed port error = %v, want a transient error", err)
+	}
+}
+
+// unusedPort returns a localhost port nothing is listening on
+func unusedPort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	listener.Close()
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+func TestIsPermanentMailError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: &textproto.Error{Code: 550, Msg: "No such user"}, want: true},
+		{err: fmt.Errorf("sending: %w", &textproto.Error{Code: 554, Msg: "Rejected"}), want: true},
+		{err: &textproto.Error{Code: 451, Msg: "Try again later"}, want: false},
+		{err: fmt.Errorf("%w: recipient %q", errInvalidEmailAddress, "x"), want: true},
+		{err: io.EOF, want: false},
+	}
+
+	for _, tt := range tests {
+		if got := isPermanentMailError(tt.err); got != tt.want {
+			t.Errorf("isPermanentMailError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
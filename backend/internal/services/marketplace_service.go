@@ -12,12 +12,14 @@ import (
 // MarketplaceService handles marketplace operations
 type MarketplaceService struct {
 	BaseService
+	purchases *PurchaseService
 }
 
 // NewMarketplaceService creates a new marketplace service
 func NewMarketplaceService(db *gorm.DB, cfg *config.Config) *MarketplaceService {
 	return &MarketplaceService{
 		BaseService: NewBaseService(db, cfg, "marketplace"),
+		purchases:   NewPurchaseService(db, cfg),
 	}
 }
 
@@ -387,23 +389,9 @@ func (s *MarketplaceService) TryMarketplaceAgent(agentID string, userID string,
 	}, nil
 }
 
-// PurchaseMarketplaceAgent purchases a marketplace agent
-func (s *MarketplaceService) PurchaseMarketplaceAgent(agentID string, userID string, pricingTier string, organizationID string) (map[string]interface{}, error) {
-	// Check if agent exists and is public
-	var agent models.Agent
-	if err := s.db.Where("id = ? AND is_public = ? AND is_enabled = ?", agentID, true, true).First(&agent).Error; err != nil {
-		return nil, errors.New("agent not found or not available")
-	}
-
-	// Return success - agent access granted
-	return map[string]interface{}{
-		"purchase_id":  "purchase_" + agentID + "_" + userID,
-		"agent_id":     agentID,
-		"user_id":      userID,
-		"pricing_tier": pricingTier,
-		"status":       "completed",
-		"message":      "Agent purchased successfully",
-	}, nil
+// PurchaseMarketplaceAgent purchases a marketplace agent and grants the buyer an entitlement to run it
+func (s *MarketplaceService) PurchaseMarketplaceAgent(agentID string, userID string, req *PurchaseRequest) (*PurchaseResult, error) {
+	return s.purchases.PurchaseAgent(agentID, userID, req)
 }
 
 // GetAgentReviews gets reviews for a marketplace agent
@@ -0,0 +1,422 @@
+package services
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+
+	"github.com/mlaitechio/vagais/internal/models"
+	"github.com/mlaitechio/vagais/pkg/totp"
+)
+
+// recoveryCodeCount is the number of recovery codes issued at a time
+const recoveryCodeCount = 10
+
+// MFA errors
+var (
+	// ErrMFASetupRequired is returned when the user's organization requires
+	// MFA and the user has not enabled it yet
+	ErrMFASetupRequired = errors.New("your organization requires multi-factor authentication; please enable it first")
+
+	errInvalidMFACode        = errors.New("invalid authentication code")
+	errInvalidMFAChallenge   = errors.New("invalid or expired MFA token; please sign in again")
+	errMFAAttemptsExceeded   = errors.New("too many invalid codes; please sign in again")
+	errMFAAlreadyEnabled     = errors.New("multi-factor authentication is already enabled")
+	errMFANotEnabled         = errors.New("multi-factor authentication is not enabled")
+	errMFANotEnrolled        = errors.New("start enrollment before confirming multi-factor authentication")
+	errMFARequiredByOrg      = errors.New("your organization requires multi-factor authentication")
+	errInvalidMFASecretStore = errors.New("stored MFA secret cannot be decrypted")
+)
+
+var mfaKeyWarning sync.Once
+
+// recoveryCodeEncoding encodes recovery codes in lower case without padding
+var recoveryCodeEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// MFAStatus describes the multi-factor authentication of a user
+type MFAStatus struct {
+	Enabled                bool  `json:"enabled"`
+	Required               bool  `json:"required"`
+	RecoveryCodesRemaining int64 `json:"recovery_codes_remaining"`
+}
+
+// MFAEnrollment is returned when enrollment starts. The provisioning URI is
+// shown as a QR code for authenticator apps to scan.
+type MFAEnrollment struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+// MFAVerifyRequest completes a login with MFA enabled
+type MFAVerifyRequest struct {
+	MFAToken string `json:"mfa_token" binding:"required"`
+	Code     string `json:"code" binding:"required"`
+}
+
+// DisableMFARequest represents a request to disable MFA
+type DisableMFARequest struct {
+	Password string `json:"password" binding:"required"`
+	Code     string `json:"code" binding:"required"`
+}
+
+// GetMFAStatus returns the MFA status of a user
+func (s *AuthService) GetMFAStatus(userID string) (*MFAStatus, error) {
+	var user models.User
+	if err := s.db.Preload("Organization").First(&user, "id = ?", userID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+
+	status := &MFAStatus{
+		Enabled:  user.MFAEnabled,
+		Required: user.Organization != nil && user.Organization.RequireMFA,
+	}
+	if user.MFAEnabled {
+		s.db.Model(&models.MFARecoveryCode{}).Where("user_id = ? AND used_at IS NULL", user.ID).Count(&status.RecoveryCodesRemaining)
+	}
+	return status, nil
+}
+
+// EnrollMFA starts enrollment with a new TOTP secret. MFA is enabled once
+// a code from the authenticator is confirmed with ConfirmMFA.
+func (s *AuthService) EnrollMFA(userID string) (*MFAEnrollment, error) {
+	var user models.User
+	if err := s.db.First(&user, "id = ?", userID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+	if user.MFAEnabled {
+		return nil, errMFAAlreadyEnabled
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := s.encryptMFASecret(secret)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(&user).Update("mfa_pending_secret", encrypted).Error; err != nil {
+		return nil, err
+	}
+
+	return &MFAEnrollment{
+		Secret:          secret,
+		ProvisioningURI: totp.ProvisioningURI(s.cfg.MFA.Issuer, user.Email, secret),
+	}, nil
+}
+
+// ConfirmMFA enables MFA once the user proves their authenticator works.
+// It returns the recovery codes, which are not shown again.
+func (s *AuthService) ConfirmMFA(userID, code string) ([]string, error) {
+	var user models.User
+	if err := s.db.First(&user, "id = ?", userID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+	if user.MFAEnabled {
+		return nil, errMFAAlreadyEnabled
+	}
+	if user.MFAPendingSecret == "" {
+		return nil, errMFANotEnrolled
+	}
+
+	secret, err := s.decryptMFASecret(user.MFAPendingSecret)
+	if err != nil {
+		return nil, err
+	}
+	step, ok := totp.Validate(secret, code, time.Now(), 1)
+	if !ok {
+		return nil, errInvalidMFACode
+	}
+
+	var codes []string
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.User{}).
+			Where("id = ? AND mfa_enabled = ? AND mfa_pending_secret = ?", user.ID, false, user.MFAPendingSecret).
+			Updates(map[string]interface{}{
+				"mfa_enabled":        true,
+				"mfa_secret":         user.MFAPendingSecret,
+				"mfa_pending_secret": "",
+				"mfa_last_step":      step,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errMFANotEnrolled
+		}
+
+		var err error
+		codes, err = replaceRecoveryCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableMFA turns MFA off after checking the password and a current code
+func (s *AuthService) DisableMFA(userID string, req *DisableMFARequest) error {
+	var user models.User
+	if err := s.db.Preload("Organization").First(&user, "id = ?", userID).Error; err != nil {
+		return errors.New("user not found")
+	}
+	if !user.MFAEnabled {
+		return errMFANotEnabled
+	}
+	if user.Organization != nil && user.Organization.RequireMFA {
+		return errMFARequiredByOrg
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
+		return errors.New("invalid password")
+	}
+	if err := s.verifyMFACode(&user, req.Code); err != nil {
+		return err
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+			"mfa_enabled":        false,
+			"mfa_secret":         "",
+			"mfa_pending_secret": "",
+			"mfa_last_step":      0,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", user.ID).Delete(&models.MFARecoveryCode{}).Error
+	})
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes after checking
+// a current code
+func (s *AuthService) RegenerateRecoveryCodes(userID, code string) ([]string, error) {
+	var user models.User
+	if err := s.db.First(&user, "id = ?", userID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+	if !user.MFAEnabled {
+		return nil, errMFANotEnabled
+	}
+	if err := s.verifyMFACode(&user, code); err != nil {
+		return nil, err
+	}
+
+	var codes []string
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		codes, err = replaceRecoveryCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// VerifyMFA completes a login by redeeming its MFA challenge with a TOTP or
+// recovery code
+func (s *AuthService) VerifyMFA(req *MFAVerifyRequest, client *ClientInfo) (*AuthResponse, error) {
+	var challenge models.MFAChallenge
+	if err := s.db.Where("token_hash = ?", hashToken(req.MFAToken)).First(&challenge).Error; err != nil {
+		return nil, errInvalidMFAChallenge
+	}
+	if challenge.ConsumedAt != nil || time.Now().After(challenge.ExpiresAt) {
+		return nil, errInvalidMFAChallenge
+	}
+
+	// Count the attempt before checking the code, so that concurrent
+	// guesses cannot get past the limit
+	result := s.db.Model(&models.MFAChallenge{}).
+		Where("id = ? AND consumed_at IS NULL AND attempts < ?", challenge.ID, s.cfg.MFA.MaxAttempts).
+		Update("attempts", gorm.Expr("attempts + 1"))
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, errMFAAttemptsExceeded
+	}
+
+	var user models.User
+	if err := s.db.Preload("Organization").First(&user, "id = ?", challenge.UserID).Error; err != nil {
+		return nil, errInvalidMFAChallenge
+	}
+	if !user.IsActive {
+		return nil, errors.New("account is deactivated")
+	}
+	if !user.MFAEnabled {
+		return nil, errInvalidMFAChallenge
+	}
+	if err := s.verifyMFACode(&user, req.Code); err != nil {
+		return nil, err
+	}
+
+	result = s.db.Model(&models.MFAChallenge{}).
+		Where("id = ? AND consumed_at IS NULL", challenge.ID).
+		Update("consumed_at", time.Now())
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, errInvalidMFAChallenge
+	}
+
+	return s.completeLogin(&user, client)
+}
+
+// MFASetupRequired reports whether the user must enable MFA before using
+// the platform. The user's organization must be loaded.
+func (s *AuthService) MFASetupRequired(user *models.User) bool {
+	return !user.MFAEnabled && user.Organization != nil && user.Organization.RequireMFA
+}
+
+// createMFAChallenge issues the token that the second step of a login is
+// completed with
+func (s *AuthService) createMFAChallenge(user *models.User, client *ClientInfo) (string, time.Time, error) {
+	if client == nil {
+		client = &ClientInfo{}
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", time.Time{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(secret)
+	expiresAt := time.Now().Add(time.Duration(s.cfg.MFA.ChallengeMinutes) * time.Minute)
+
+	if err := s.db.Create(&models.MFAChallenge{
+		UserID:    user.ID,
+		TokenHash: hashToken(token),
+		IPAddress: client.IPAddress,
+		UserAgent: client.UserAgent,
+		ExpiresAt: expiresAt,
+	}).Error; err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiresAt, nil
+}
+
+// verifyMFACode accepts a TOTP code from the user's authenticator or one of
+// their unused recovery codes. Each is accepted only once.
+func (s *AuthService) verifyMFACode(user *models.User, code string) error {
+	code = normalizeMFACode(code)
+	if len(code) == totp.Digits {
+		secret, err := s.decryptMFASecret(user.MFASecret)
+		if err != nil {
+			return err
+		}
+		step, ok := totp.Validate(secret, code, time.Now(), 1)
+		if !ok {
+			return errInvalidMFACode
+		}
+		// Refuse a code, or an earlier one, that has already been used
+		result := s.db.Model(&models.User{}).
+			Where("id = ? AND mfa_last_step < ?", user.ID, step).
+			Update("mfa_last_step", step)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errInvalidMFACode
+		}
+		return nil
+	}
+
+	result := s.db.Model(&models.MFARecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, hashToken(code)).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errInvalidMFACode
+	}
+	return nil
+}
+
+// replaceRecoveryCodes deletes a user's recovery codes and issues new ones
+func replaceRecoveryCodes(tx *gorm.DB, userID string) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&models.MFARecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	records := make([]models.MFARecoveryCode, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 7)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		code := recoveryCodeEncoding.EncodeToString(raw)[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+		records[i] = models.MFARecoveryCode{UserID: userID, CodeHash: hashToken(code)}
+	}
+	if err := tx.Create(&records).Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// normalizeMFACode strips the spaces and dashes users type codes with
+func normalizeMFACode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.NewReplacer(" ", "", "-", "").Replace(code)
+}
+
+// mfaCipher returns the cipher TOTP secrets are encrypted with. Without
+// MFA_ENCRYPTION_KEY, the key is derived from the JWT secret.
+func (s *AuthService) mfaCipher() (cipher.AEAD, error) {
+	key := s.cfg.MFA.EncryptionKey
+	if key == "" {
+		mfaKeyWarning.Do(func() {
+			fmt.Println("MFA_ENCRYPTION_KEY not set, deriving the MFA key from the JWT secret")
+		})
+		key = "mfa:" + s.cfg.JWT.SecretKey
+	}
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptMFASecret encrypts a TOTP secret for storage
+func (s *AuthService) encryptMFASecret(secret string) (string, error) {
+	aead, err := s.mfaCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(secret), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptMFASecret decrypts a stored TOTP secret
+func (s *AuthService) decryptMFASecret(encrypted string) (string, error) {
+	aead, err := s.mfaCipher()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errInvalidMFASecretStore
+	}
+	secret, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", errInvalidMFASecretStore
+	}
+	return string(secret), nil
+}
@@ -1,6 +1,7 @@
 package services
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"time"
@@ -14,12 +15,14 @@ import (
 // NotificationService handles notifications
 type NotificationService struct {
 	BaseService
+	emails *EmailService
 }
 
 // NewNotificationService creates a new notification service
 func NewNotificationService(db *gorm.DB, cfg *config.Config) *NotificationService {
 	return &NotificationService{
 		BaseService: NewBaseService(db, cfg, "notification"),
+		emails:      NewEmailService(db, cfg),
 	}
 }
 
@@ -30,6 +33,7 @@ type CreateNotificationRequest struct {
 	Title    string                 `json:"title" binding:"required"`
 	Message  string                 `json:"message" binding:"required"`
 	Priority string                 `json:"priority"` // low, normal, high, urgent
+	Category string                 `json:"category"`
 	Metadata map[string]interface{} `json:"metadata"`
 	IsRead   bool                   `json:"is_read"`
 }
@@ -42,6 +46,7 @@ func (s *NotificationService) SendNotification(req *CreateNotificationRequest) (
 		Title:    req.Title,
 		Message:  req.Message,
 		Priority: req.Priority,
+		Category: req.Category,
 		Metadata: models.MapToJSON(req.Metadata),
 		Status:   "unread",
 	}
@@ -67,12 +72,27 @@ func (s *NotificationService) SendNotification(req *CreateNotificationRequest) (
 
 // sendEmailNotification sends an email notification
 func (s *NotificationService) sendEmailNotification(notification *models.Notification) {
-	// TODO: Implement actual email sending
-	// For now, we'll just mark it as sent
-	time.Sleep(1 * time.Second) // Simulate email sending
+	var user models.User
+	err := s.db.First(&user, "id = ?", notification.UserID).Error
+	if err == nil {
+		err = s.emails.Send(context.Background(), &EmailRequest{
+			To:       user.Email,
+			UserID:   &user.ID,
+			Template: EmailTemplateNotification,
+			Data: map[string]interface{}{
+				"Name":    displayName(&user),
+				"Title":   notification.Title,
+				"Message": notification.Message,
+			},
+		})
+	}
 
-	notification.Status = "sent"
-	s.db.Save(notification)
+	status := "sent"
+	if err != nil {
+		fmt.Printf("Failed to email notification %s: %v\n", notification.ID, err)
+		status = "failed"
+	}
+	s.db.Model(notification).Update("status", status)
 }
 
 // sendSMSNotification sends an SMS notification
@@ -0,0 +1,141 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Test tokens understood by the fake provider. Any other token attaches a card that always succeeds.
+const (
+	FakeTokenDeclined = "tok_declined"
+	FakeTokenPending  = "tok_pending"
+)
+
+// fakeSignatureHeader carries the hex HMAC-SHA256 of a fake provider webhook body
+const fakeSignatureHeader = "X-Payment-Signature"
+
+// fakePaymentProvider settles payments in-process without moving real money.
+// It is used in tests and on-prem installs that bill outside the platform.
+// It keeps no state: how a charge behaves is encoded in the payment method ID.
+type fakePaymentProvider struct {
+	webhookSecret string
+}
+
+func newFakePaymentProvider(webhookSecret string) *fakePaymentProvider {
+	return &fakePaymentProvider{webhookSecret: webhookSecret}
+}
+
+func (p *fakePaymentProvider) Name() string {
+	return "fake"
+}
+
+func (p *fakePaymentProvider) CreateCustomer(ctx context.Context, params *CustomerParams) (string, error) {
+	return "cus_fake_" + uuid.New().String(), nil
+}
+
+func (p *fakePaymentProvider) AttachPaymentMethod(ctx context.Context, customerID string, params *AttachPaymentMethodParams) (*ProviderPaymentMethod, error) {
+	behaviour := "ok"
+	switch params.Token {
+	case FakeTokenDeclined:
+		behaviour = "declined"
+	case FakeTokenPending:
+		behaviour = "pending"
+	}
+
+	method := &ProviderPaymentMethod{
+		ID:       fmt.Sprintf("pm_fake_%s_%s", behaviour, uuid.New().String()),
+		Type:     params.Type,
+		Brand:    stringSetting(params.Details, "brand"),
+		LastFour: stringSetting(params.Details, "last_four"),
+		Expiry:   stringSetting(params.Details, "expiry"),
+	}
+	if method.Type == "card" {
+		if method.Brand == "" {
+			method.Brand = "visa"
+		}
+		if method.LastFour == "" {
+			method.LastFour = "4242"
+		}
+		if method.Expiry == "" {
+			method.Expiry = "12/30"
+		}
+	}
+	return method, nil
+}
+
+func (p *fakePaymentProvider) Charge(ctx context.Context, params *ChargeParams) (*ProviderCharge, error) {
+	if params.Amount <= 0 {
+		return nil, errors.New("charge amount must be positive")
+	}
+
+	charge := &ProviderCharge{ID: "ch_fake_" + uuid.New().String(), Status: ChargeSucceeded}
+	switch {
+	case strings.HasPrefix(params.PaymentMethodID, "pm_fake_declined_"):
+		charge.Status = ChargeFailed
+		charge.FailureMessage = "Your card was declined."
+	case strings.HasPrefix(params.PaymentMethodID, "pm_fake_pending_"):
+		charge.Status = ChargePending
+		charge.ActionURL = "https://payments.invalid/authorize/" + charge.ID
+	}
+	return charge, nil
+}
+
+func (p *fakePaymentProvider) Refund(ctx context.Context, params *RefundParams) (*ProviderRefund, error) {
+	if !strings.HasPrefix(params.ChargeID, "ch_fake_") {
+		return nil, fmt.Errorf("unknown charge %s", params.ChargeID)
+	}
+	return &ProviderRefund{ID: "re_fake_" + uuid.New().String(), Status: ChargeSucceeded}, nil
+}
+
+// fakeWebhookEvent is the body of a fake provider webhook
+type fakeWebhookEvent struct {
+	ID             string `json:"id"`
+	Type           string `json:"type"`
+	ChargeID       string `json:"charge_id"`
+	RefundID       string `json:"refund_id"`
+	RefundAmount   int64  `json:"refund_amount"`
+	FailureMessage string `json:"failure_message"`
+}
+
+// ParseWebhook verifies the body's HMAC under the configured webhook secret
+func (p *fakePaymentProvider) ParseWebhook(payload []byte, header http.Header) (*ProviderEvent, error) {
+	if p.webhookSecret == "" {
+		return nil, errors.New("PAYMENT_WEBHOOK_SECRET is not configured")
+	}
+	signature, err := hex.DecodeString(header.Get(fakeSignatureHeader))
+	if err != nil || !hmac.Equal(signature, signPayload(p.webhookSecret, payload)) {
+		return nil, ErrInvalidWebhookSignature
+	}
+
+	var event fakeWebhookEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, fmt.Errorf("invalid webhook payload: %v", err)
+	}
+	if event.ID == "" || event.ChargeID == "" {
+		return nil, errors.New("webhook event is missing id or charge_id")
+	}
+	return &ProviderEvent{
+		ID:             event.ID,
+		Type:           event.Type,
+		ChargeID:       event.ChargeID,
+		RefundID:       event.RefundID,
+		RefundAmount:   event.RefundAmount,
+		FailureMessage: event.FailureMessage,
+	}, nil
+}
+
+// signPayload returns the HMAC-SHA256 of payload under secret
+func signPayload(secret string, payload []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,160 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/mlaitechio/vagais/internal/config"
+)
+
+// ErrPaymentDeclined is returned when the provider refuses a charge
+var ErrPaymentDeclined = errors.New("payment was declined")
+
+// ErrInvalidWebhookSignature is returned when a webhook is not signed by the provider
+var ErrInvalidWebhookSignature = errors.New("invalid webhook signature")
+
+// ErrFakeProviderInProduction is returned when the fake provider is selected
+// in production, where it would hand out credits without charging anyone
+var ErrFakeProviderInProduction = errors.New("PAYMENT_PROVIDER=fake approves every charge and cannot be used in production")
+
+// PaymentProvider is implemented by every payment gateway adapter
+type PaymentProvider interface {
+	Name() string
+	CreateCustomer(ctx context.Context, params *CustomerParams) (string, error)
+	AttachPaymentMethod(ctx context.Context, customerID string, params *AttachPaymentMethodParams) (*ProviderPaymentMethod, error)
+	Charge(ctx context.Context, params *ChargeParams) (*ProviderCharge, error)
+	Refund(ctx context.Context, params *RefundParams) (*ProviderRefund, error)
+	ParseWebhook(payload []byte, header http.Header) (*ProviderEvent, error)
+}
+
+// CustomerParams describes the customer created for a user
+type CustomerParams struct {
+	UserID string
+	Email  string
+	Name   string
+}
+
+// AttachPaymentMethodParams describes a payment method to save for a customer
+type AttachPaymentMethodParams struct {
+	Type    string
+	Token   string
+	Details map[string]interface{}
+}
+
+// ProviderPaymentMethod represents a payment method saved at the provider
+type ProviderPaymentMethod struct {
+	ID       string
+	Type     string
+	Brand    string
+	LastFour string
+	Expiry   string
+}
+
+// ChargeParams describes a charge. Amount is in the currency's minor unit.
+type ChargeParams struct {
+	CustomerID      string
+	PaymentMethodID string
+	Amount          int64
+	Currency        string
+	Description     string
+	IdempotencyKey  string
+	Metadata        map[string]string
+}
+
+// Provider charge statuses
+const (
+	ChargeSucceeded = "succeeded"
+	ChargePending   = "pending"
+	ChargeFailed    = "failed"
+)
+
+// ProviderCharge represents the outcome of a charge. A pending charge needs
+// the customer to complete ActionURL, e.g. for 3-D Secure, and is settled by a webhook.
+type ProviderCharge struct {
+	ID             string
+	Status         string
+	FailureMessage string
+	ActionURL      string
+}
+
+// RefundParams describes a refund of part or all of a charge
+type RefundParams struct {
+	ChargeID       string
+	Amount         int64
+	IdempotencyKey string
+}
+
+// ProviderRefund represents a refund issued by the provider
+type ProviderRefund struct {
+	ID     string
+	Status string
+}
+
+// Provider event types, normalised across providers
+const (
+	ProviderEventChargeSucceeded = "charge.succeeded"
+	ProviderEventChargeFailed    = "charge.failed"
+	ProviderEventChargeRefunded  = "charge.refunded"
+)
+
+// ProviderEvent represents a verified webhook event
+type ProviderEvent struct {
+	ID             string
+	Type           string
+	ChargeID       string
+	RefundID       string
+	RefundAmount   int64
+	FailureMessage string
+}
+
+// CheckPaymentProvider reports a payment provider that must not be used in
+// the configured environment
+func CheckPaymentProvider(cfg *config.Config) error {
+	if strings.EqualFold(cfg.Payments.Provider, "fake") && cfg.Environment == "production" {
+		return ErrFakeProviderInProduction
+	}
+	return nil
+}
+
+// fakeProviderWarning logs the fake provider warning once, however many
+// services create a provider
+var fakeProviderWarning sync.Once
+
+// NewPaymentProvider creates the payment provider selected in the configuration.
+// There is no default: payments stay disabled until a provider is chosen.
+func NewPaymentProvider(cfg *config.Config) (PaymentProvider, error) {
+	if err := CheckPaymentProvider(cfg); err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(cfg.Payments.Provider) {
+	case "":
+		return nil, errors.New("PAYMENT_PROVIDER is not set")
+	case "fake":
+		fakeProviderWarning.Do(func() {
+			fmt.Println("WARNING: the fake payment provider is active. Every charge is approved without moving money; never use it where credits or earnings are real.")
+		})
+		return newFakePaymentProvider(cfg.Payments.WebhookSecret), nil
+	case "stripe":
+		if cfg.Payments.StripeSecretKey == "" {
+			return nil, errors.New("STRIPE_SECRET_KEY is required for the stripe payment provider")
+		}
+		return newStripePaymentProvider(cfg.Payments), nil
+	default:
+		return nil, fmt.Errorf("unsupported payment provider: %s", cfg.Payments.Provider)
+	}
+}
+
+// toMinorUnits converts an amount such as 12.34 USD into 1234 cents
+func toMinorUnits(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
+
+// fromMinorUnits converts an amount in cents back into the currency's major unit
+func fromMinorUnits(amount int64) float64 {
+	return float64(amount) / 100
+}
@@ -0,0 +1,518 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// Payment transaction types
+const (
+	PaymentTypePayment        = "payment"
+	PaymentTypeRefund         = "refund"
+	PaymentTypeCreditPurchase = "credit_purchase"
+	PaymentTypeUsageCharge    = "usage_charge"
+)
+
+// Payment transaction statuses
+const (
+	PaymentPending   = "pending"
+	PaymentCompleted = "completed"
+	PaymentFailed    = "failed"
+	PaymentCancelled = "cancelled"
+)
+
+// paymentTransitions lists the statuses each payment status may move to
+var paymentTransitions = map[string][]string{
+	PaymentPending: {PaymentCompleted, PaymentFailed, PaymentCancelled},
+}
+
+// paymentMethodTypes lists the payment method types users may add
+var paymentMethodTypes = []string{"card", "upi", "paypal", "bank_transfer"}
+
+// PaymentListener is called after a payment reaches a final status
+type PaymentListener func(payment *models.PaymentTransaction)
+
+// PaymentService handles payment methods and charges through the configured payment provider
+type PaymentService struct {
+	BaseService
+	provider    PaymentProvider
+	providerErr error
+	credits     *CreditService
+	listeners   []PaymentListener
+}
+
+// NewPaymentService creates a new payment service
+func NewPaymentService(db *gorm.DB, cfg *config.Config) *PaymentService {
+	provider, err := NewPaymentProvider(cfg)
+	if err != nil {
+		fmt.Printf("Payments are disabled: %v\n", err)
+	}
+	return &PaymentService{
+		BaseService: NewBaseService(db, cfg, "payment"),
+		provider:    provider,
+		providerErr: err,
+		credits:     NewCreditService(db, cfg),
+	}
+}
+
+// SetProvider replaces the payment provider
+func (s *PaymentService) SetProvider(provider PaymentProvider) {
+	s.provider = provider
+	s.providerErr = nil
+}
+
+// OnPaymentSettled registers a listener called after a payment completes or fails
+func (s *PaymentService) OnPaymentSettled(listener PaymentListener) {
+	s.listeners = append(s.listeners, listener)
+}
+
+// Provider returns the configured payment provider
+func (s *PaymentService) Provider() (PaymentProvider, error) {
+	if s.provider == nil {
+		if s.providerErr != nil {
+			return nil, fmt.Errorf("payments are not configured: %v", s.providerErr)
+		}
+		return nil, errors.New("payments are not configured")
+	}
+	return s.provider, nil
+}
+
+// AddPaymentMethodRequest represents add payment method request
+type AddPaymentMethodRequest struct {
+	Type    string                 `json:"type" binding:"required"`
+	Token   string                 `json:"token"`
+	Details map[string]interface{} `json:"details"`
+}
+
+// PurchaseCreditsRequest represents credit top-up request
+type PurchaseCreditsRequest struct {
+	Credits         int64  `json:"credits" binding:"required,min=1"`
+	PaymentMethodID string `json:"payment_method_id"`
+}
+
+// ChargeRequest describes a charge against one of a user's payment methods
+type ChargeRequest struct {
+	PaymentMethodID string
+	Amount          float64
+	Type            string
+	Description     string
+	AgentID         *string
+	PurchaseID      *string
+	Credits         int64
+	Metadata        map[string]interface{}
+}
+
+// ListPaymentMethods lists the user's saved payment methods, default first
+func (s *PaymentService) ListPaymentMethods(userID string) ([]models.PaymentMethod, error) {
+	provider, err := s.Provider()
+	if err != nil {
+		return nil, err
+	}
+
+	var methods []models.PaymentMethod
+	err = s.db.Where("user_id = ? AND provider = ?", userID, provider.Name()).
+		Order("is_default DESC, created_at DESC").Find(&methods).Error
+	return methods, err
+}
+
+// AddPaymentMethod saves a payment method with the provider. The first method becomes the default.
+func (s *PaymentService) AddPaymentMethod(userID string, req *AddPaymentMethodRequest) (*models.PaymentMethod, error) {
+	provider, err := s.Provider()
+	if err != nil {
+		return nil, err
+	}
+
+	valid := false
+	for _, t := range paymentMethodTypes {
+		if req.Type == t {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return nil, fmt.Errorf("payment method type must be one of %s", strings.Join(paymentMethodTypes, ", "))
+	}
+
+	ctx := context.Background()
+	customerID, err := s.customerFor(ctx, provider, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	attached, err := provider.AttachPaymentMethod(ctx, customerID, &AttachPaymentMethodParams{
+		Type:    req.Type,
+		Token:   req.Token,
+		Details: req.Details,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to add payment method: %v", err)
+	}
+
+	var existing int64
+	s.db.Model(&models.PaymentMethod{}).Where("user_id = ? AND provider = ?", userID, provider.Name()).Count(&existing)
+
+	details := map[string]interface{}{}
+	if attached.LastFour != "" {
+		details["last_four"] = attached.LastFour
+	}
+	if attached.Brand != "" {
+		details["brand"] = attached.Brand
+	}
+	if attached.Expiry != "" {
+		details["expiry"] = attached.Expiry
+	}
+
+	method := &models.PaymentMethod{
+		UserID:           userID,
+		Provider:         provider.Name(),
+		ProviderMethodID: attached.ID,
+		Type:             attached.Type,
+		Details:          models.MapToJSON(details),
+		IsDefault:        existing == 0,
+	}
+	if err := s.db.Create(method).Error; err != nil {
+		return nil, err
+	}
+	return method, nil
+}
+
+// customerFor returns the user's customer ID at the provider, creating the customer on first use
+func (s *PaymentService) customerFor(ctx context.Context, provider PaymentProvider, userID string) (string, error) {
+	var customer models.PaymentCustomer
+	if err := s.db.Where("user_id = ? AND provider = ?", userID, provider.Name()).First(&customer).Error; err == nil {
+		return customer.CustomerID, nil
+	}
+
+	var user models.User
+	if err := s.db.First(&user, "id = ?", userID).Error; err != nil {
+		return "", errors.New("user not found")
+	}
+
+	customerID, err := provider.CreateCustomer(ctx, &CustomerParams{
+		UserID: user.ID,
+		Email:  user.Email,
+		Name:   strings.TrimSpace(user.FirstName + " " + user.LastName),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create payment customer: %v", err)
+	}
+
+	customer = models.PaymentCustomer{UserID: userID, Provider: provider.Name(), CustomerID: customerID}
+	if err := s.db.Create(&customer).Error; err != nil {
+		// Another request created the customer first
+		if err := s.db.Where("user_id = ? AND provider = ?", userID, provider.Name()).First(&customer).Error; err == nil {
+			return customer.CustomerID, nil
+		}
+		return "", err
+	}
+	return customerID, nil
+}
+
+// ListTransactions lists the user's payment transactions between optional YYYY-MM-DD dates, newest first
+func (s *PaymentService) ListTransactions(userID, startDate, endDate string, page, limit int) ([]models.PaymentTransaction, int64, error) {
+	var transactions []models.PaymentTransaction
+	var total int64
+
+	query := s.db.Model(&models.PaymentTransaction{}).Where("user_id = ?", userID)
+	if startDate != "" {
+		start, err := time.Parse("2006-01-02", startDate)
+		if err != nil {
+			return nil, 0, errors.New("start_date must be formatted as YYYY-MM-DD")
+		}
+		query = query.Where("created_at >= ?", start)
+	}
+	if endDate != "" {
+		end, err := time.Parse("2006-01-02", endDate)
+		if err != nil {
+			return nil, 0, errors.New("end_date must be formatted as YYYY-MM-DD")
+		}
+		query = query.Where("created_at < ?", end.AddDate(0, 0, 1))
+	}
+
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	offset := (page - 1) * limit
+	if err := query.Order("created_at DESC").Offset(offset).Limit(limit).Find(&transactions).Error; err != nil {
+		return nil, 0, err
+	}
+
+	return transactions, total, nil
+}
+
+// PurchaseCredits buys credits with one of the user's payment methods. The
+// credits are added once the payment completes, which may be after a webhook.
+func (s *PaymentService) PurchaseCredits(userID string, req *PurchaseCreditsRequest) (*models.PaymentTransaction, error) {
+	amount := math.Ceil(float64(req.Credits)*100/float64(s.cfg.Credits.PerUSD)) / 100
+	return s.Charge(userID, &ChargeRequest{
+		PaymentMethodID: req.PaymentMethodID,
+		Amount:          amount,
+		Type:            PaymentTypeCreditPurchase,
+		Description:     fmt.Sprintf("Purchase of %d credits", req.Credits),
+		Credits:         req.Credits,
+	})
+}
+
+// Charge takes a payment from one of the user's payment methods, or their
+// default method when none is given. A declined charge returns the failed
+// transaction together with ErrPaymentDeclined.
+func (s *PaymentService) Charge(userID string, req *ChargeRequest) (*models.PaymentTransaction, error) {
+	provider, err := s.Provider()
+	if err != nil {
+		return nil, err
+	}
+	if req.Amount < 0.01 {
+		return nil, errors.New("payment amount is too small")
+	}
+
+	var method models.PaymentMethod
+	query := s.db.Where("user_id = ? AND provider = ?", userID, provider.Name())
+	if req.PaymentMethodID != "" {
+		query = query.Where("id = ?", req.PaymentMethodID)
+	} else {
+		query = query.Where("is_default = ?", true)
+	}
+	if err := query.First(&method).Error; err != nil {
+		return nil, errors.New("payment method not found")
+	}
+
+	ctx := context.Background()
+	customerID, err := s.customerFor(ctx, provider, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	payment := &models.PaymentTransaction{
+		UserID:          userID,
+		PaymentMethodID: &method.ID,
+		Provider:        provider.Name(),
+		Type:            req.Type,
+		Amount:          req.Amount,
+		Currency:        s.cfg.Payments.Currency,
+		Status:          PaymentPending,
+		Description:     req.Description,
+		AgentID:         req.AgentID,
+		PurchaseID:      req.PurchaseID,
+		Credits:         req.Credits,
+		Metadata:        models.MapToJSON(req.Metadata),
+	}
+	if err := s.db.Create(payment).Error; err != nil {
+		return nil, err
+	}
+
+	charge, err := provider.Charge(ctx, &ChargeParams{
+		CustomerID:      customerID,
+		PaymentMethodID: method.ProviderMethodID,
+		Amount:          toMinorUnits(payment.Amount),
+		Currency:        payment.Currency,
+		Description:     payment.Description,
+		IdempotencyKey:  payment.ID,
+		Metadata:        map[string]string{"payment_id": payment.ID, "user_id": userID},
+	})
+	if err != nil {
+		s.settle(payment, PaymentFailed, err.Error())
+		return nil, fmt.Errorf("payment failed: %v", err)
+	}
+
+	payment.ProviderChargeID = charge.ID
+	payment.ActionURL = charge.ActionURL
+	if err := s.db.Model(payment).Updates(map[string]interface{}{
+		"provider_charge_id": charge.ID,
+		"action_url":         charge.ActionURL,
+	}).Error; err != nil {
+		return nil, err
+	}
+
+	switch charge.Status {
+	case ChargeSucceeded:
+		if err := s.settle(payment, PaymentCompleted, ""); err != nil {
+			return nil, err
+		}
+	case ChargeFailed:
+		s.settle(payment, PaymentFailed, charge.FailureMessage)
+		return payment, fmt.Errorf("%w: %s", ErrPaymentDeclined, charge.FailureMessage)
+	}
+	return payment, nil
+}
+
+// Refund returns part or all of a completed payment to the customer
+func (s *PaymentService) Refund(paymentID string, amount float64, reason string) (*models.PaymentTransaction, error) {
+	provider, err := s.Provider()
+	if err != nil {
+		return nil, err
+	}
+
+	var original models.PaymentTransaction
+	if err := s.db.First(&original, "id = ?", paymentID).Error; err != nil {
+		return nil, errors.New("payment not found")
+	}
+	if original.Status != PaymentCompleted || original.Type == PaymentTypeRefund {
+		return nil, errors.New("only completed payments can be refunded")
+	}
+
+	var refunded float64
+	if err := s.db.Model(&models.PaymentTransaction{}).
+		Where("refund_of_id = ? AND status = ?", original.ID, PaymentCompleted).
+		Select("COALESCE(SUM(amount), 0)").Scan(&refunded).Error; err != nil {
+		return nil, err
+	}
+	if toMinorUnits(refunded+amount) > toMinorUnits(original.Amount) {
+		return nil, errors.New("refund exceeds the amount paid")
+	}
+
+	refund := &models.PaymentTransaction{
+		BaseModel:       models.BaseModel{ID: uuid.New().String()},
+		UserID:          original.UserID,
+		PaymentMethodID: original.PaymentMethodID,
+		Provider:        original.Provider,
+		Type:            PaymentTypeRefund,
+		Amount:          amount,
+		Currency:        original.Currency,
+		Status:          PaymentCompleted,
+		Description:     "Refund: " + original.Description,
+		AgentID:         original.AgentID,
+		PurchaseID:      original.PurchaseID,
+		RefundOfID:      &original.ID,
+		Metadata:        models.MapToJSON(map[string]interface{}{"reason": reason}),
+	}
+
+	result, err := provider.Refund(context.Background(), &RefundParams{
+		ChargeID:       original.ProviderChargeID,
+		Amount:         toMinorUnits(amount),
+		IdempotencyKey: refund.ID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("refund failed: %v", err)
+	}
+
+	refund.ProviderChargeID = result.ID
+	if err := s.db.Create(refund).Error; err != nil {
+		return nil, err
+	}
+	return refund, nil
+}
+
+// HandleWebhook verifies and applies a webhook from the payment provider.
+// Events are recorded once applied, so redelivered events are ignored.
+func (s *PaymentService) HandleWebhook(payload []byte, header http.Header) error {
+	provider, err := s.Provider()
+	if err != nil {
+		return err
+	}
+
+	event, err := provider.ParseWebhook(payload, header)
+	if err != nil {
+		return err
+	}
+
+	var seen int64
+	s.db.Model(&models.PaymentEvent{}).Where("provider = ? AND event_id = ?", provider.Name(), event.ID).Count(&seen)
+	if seen > 0 || event.Type == "" {
+		return nil
+	}
+
+	var payment models.PaymentTransaction
+	if err := s.db.Where("provider = ? AND provider_charge_id = ? AND type <> ?", provider.Name(), event.ChargeID, PaymentTypeRefund).
+		First(&payment).Error; err != nil {
+		fmt.Printf("Ignoring %s webhook %s for unknown charge %s\n", provider.Name(), event.ID, event.ChargeID)
+		return nil
+	}
+
+	switch event.Type {
+	case ProviderEventChargeSucceeded:
+		err = s.settle(&payment, PaymentCompleted, "")
+	case ProviderEventChargeFailed:
+		err = s.settle(&payment, PaymentFailed, event.FailureMessage)
+	case ProviderEventChargeRefunded:
+		err = s.recordProviderRefund(&payment, event)
+	}
+	if err != nil && err != errConcurrentUpdate {
+		return err
+	}
+
+	return s.db.Create(&models.PaymentEvent{
+		Provider: provider.Name(),
+		EventID:  event.ID,
+		Type:     event.Type,
+		Payload:  models.JSON(payload),
+	}).Error
+}
+
+// recordProviderRefund records a refund made at the provider, e.g. from its dashboard
+func (s *PaymentService) recordProviderRefund(payment *models.PaymentTransaction, event *ProviderEvent) error {
+	var existing int64
+	s.db.Model(&models.PaymentTransaction{}).
+		Where("provider = ? AND provider_charge_id = ? AND type = ?", payment.Provider, event.RefundID, PaymentTypeRefund).
+		Count(&existing)
+	if existing > 0 {
+		return nil
+	}
+
+	return s.db.Create(&models.PaymentTransaction{
+		UserID:           payment.UserID,
+		PaymentMethodID:  payment.PaymentMethodID,
+		Provider:         payment.Provider,
+		ProviderChargeID: event.RefundID,
+		Type:             PaymentTypeRefund,
+		Amount:           fromMinorUnits(event.RefundAmount),
+		Currency:         payment.Currency,
+		Status:           PaymentCompleted,
+		Description:      "Refund: " + payment.Description,
+		AgentID:          payment.AgentID,
+		PurchaseID:       payment.PurchaseID,
+		RefundOfID:       &payment.ID,
+	}).Error
+}
+
+// settle moves a pending payment to its final status and fulfils it. It
+// returns errConcurrentUpdate when the payment was already settled.
+func (s *PaymentService) settle(payment *models.PaymentTransaction, to string, reason string) error {
+	if !canTransition(paymentTransitions, payment.Status, to) {
+		return errConcurrentUpdate
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.PaymentTransaction{}).
+			Where("id = ? AND status = ?", payment.ID, payment.Status).
+			Updates(map[string]interface{}{"status": to, "failure_reason": reason})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errConcurrentUpdate
+		}
+
+		if to == PaymentCompleted && payment.Type == PaymentTypeCreditPurchase && payment.Credits > 0 {
+			if _, err := s.credits.record(tx, payment.UserID, CreditTypePurchase, payment.Credits, nil,
+				payment.Description, map[string]interface{}{"payment_id": payment.ID}, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if err != errConcurrentUpdate {
+			fmt.Printf("Error settling payment %s: %v\n", payment.ID, err)
+		}
+		return err
+	}
+
+	payment.Status = to
+	payment.FailureReason = reason
+	for _, listener := range s.listeners {
+		listener(payment)
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package services
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// newPaymentTest returns a payment service on the fake provider and a user
+// with no credits
+func newPaymentTest(t *testing.T) (*PaymentService, *models.User) {
+	t.Helper()
+	t.Setenv("PAYMENT_PROVIDER", "fake")
+	t.Setenv("PAYMENT_WEBHOOK_SECRET", "whsec_test")
+
+	db := newTestDB(t, &models.User{}, &models.CreditTransaction{}, &models.PaymentCustomer{},
+		&models.PaymentMethod{}, &models.PaymentTransaction{}, &models.PaymentEvent{})
+	user := &models.User{Email: "ann@example.com", Username: "ann", PasswordHash: "x", IsActive: true}
+	if err := db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return NewPaymentService(db, config.Load()), user
+}
+
+// addMethod saves a payment method for the user from a fake provider token
+func addMethod(t *testing.T, payments *PaymentService, userID, token string) *models.PaymentMethod {
+	t.Helper()
+	method, err := payments.AddPaymentMethod(userID, &AddPaymentMethodRequest{Type: "card", Token: token})
+	if err != nil {
+		t.Fatalf("AddPaymentMethod() error = %v", err)
+	}
+	return method
+}
+
+// fakeWebhook returns a fake provider webhook body and its signature headers
+func fakeWebhook(t *testing.T, secret string, event fakeWebhookEvent) ([]byte, http.Header) {
+	t.Helper()
+	payload, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := http.Header{}
+	header.Set(fakeSignatureHeader, hex.EncodeToString(signPayload(secret, payload)))
+	return payload, header
+}
+
+func TestNewPaymentProvider(t *testing.T) {
+	tests := []struct {
+		provider    string
+		environment string
+		want        string
+		err         string
+	}{
+		{provider: "fake", environment: "development", want: "fake"},
+		{provider: "FAKE", environment: "development", want: "fake"},
+		{provider: "fake", environment: "production", err: ErrFakeProviderInProduction.Error()},
+		{provider: "", environment: "development", err: "PAYMENT_PROVIDER is not set"},
+		{provider: "stripe", environment: "production", err: "STRIPE_SECRET_KEY is required"},
+		{provider: "paypal", environment: "development", err: "unsupported payment provider"},
+	}
+
+	for _, tt := range tests {
+		cfg := &config.Config{Environment: tt.environment, Payments: config.PaymentsConfig{Provider: tt.provider}}
+		provider, err := NewPaymentProvider(cfg)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("NewPaymentProvider(%q, %s) error = %v, want one containing %q", tt.provider, tt.environment, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || provider.Name() != tt.want {
+			t.Errorf("NewPaymentProvider(%q, %s) = %v, %v, want %s", tt.provider, tt.environment, provider, err, tt.want)
+		}
+	}
+}
+
+func TestAddPaymentMethod(t *testing.T) {
+	payments, user := newPaymentTest(t)
+
+	if _, err := payments.AddPaymentMethod(user.ID, &AddPaymentMethodRequest{Type: "cheque"}); err == nil {
+		t.Error("AddPaymentMethod() of an unknown type error = nil, want an error")
+	}
+
+	// The first method becomes the default
+	first := addMethod(t, payments, user.ID, "tok_visa")
+	second := addMethod(t, payments, user.ID, "tok_visa")
+	if !first.IsDefault || second.IsDefault {
+		t.Errorf("defaults = %v, %v, want only the first", first.IsDefault, second.IsDefault)
+	}
+
+	// Both are saved under one customer at the provider
+	var customers int64
+	payments.db.Model(&models.PaymentCustomer{}).Where("user_id = ?", user.ID).Count(&customers)
+	if customers != 1 {
+		t.Errorf("%d customers created, want 1", customers)
+	}
+	methods, err := payments.ListPaymentMethods(user.ID)
+	if err != nil || len(methods) != 2 || methods[0].ID != first.ID {
+		t.Errorf("ListPaymentMethods() = %d methods, %v, want 2 with the default first", len(methods), err)
+	}
+}
+
+func TestPurchaseCredits(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   string
+		status  string
+		credits int64
+		err     error
+	}{
+		{name: "approved", token: "tok_visa", status: PaymentCompleted, credits: 250},
+		{name: "declined", token: FakeTokenDeclined, status: PaymentFailed, err: ErrPaymentDeclined},
+		{name: "awaiting authorization", token: FakeTokenPending, status: PaymentPending},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payments, user := newPaymentTest(t)
+			addMethod(t, payments, user.ID, tt.token)
+
+			payment, err := payments.PurchaseCredits(user.ID, &PurchaseCreditsRequest{Credits: 250})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("PurchaseCredits() error = %v, want %v", err, tt.err)
+			}
+			if payment.Amount != 2.5 || payment.Status != tt.status {
+				t.Errorf("payment = %v %s, want 2.5 %s", payment.Amount, payment.Status, tt.status)
+			}
+			if tt.status == PaymentPending && payment.ActionURL == "" {
+				t.Error("pending payment has no action URL")
+			}
+			checkBalance(t, payments.credits, user.ID, tt.credits, 0, 0)
+		})
+	}
+}
+
+func TestPaymentWebhook(t *testing.T) {
+	payments, user := newPaymentTest(t)
+	addMethod(t, payments, user.ID, FakeTokenPending)
+	payment, err := payments.PurchaseCredits(user.ID, &PurchaseCreditsRequest{Credits: 100})
+	if err != nil {
+		t.Fatalf("PurchaseCredits() error = %v", err)
+	}
+
+	event := fakeWebhookEvent{ID: "evt_1", Type: ProviderEventChargeSucceeded, ChargeID: payment.ProviderChargeID}
+
+	// Events not signed with the webhook secret are refused
+	payload, header := fakeWebhook(t, "wrong", event)
+	if err := payments.HandleWebhook(payload, header); !errors.Is(err, ErrInvalidWebhookSignature) {
+		t.Errorf("HandleWebhook() with a bad signature error = %v, want ErrInvalidWebhookSignature", err)
+	}
+
+	// The charge completes once, however often the event is delivered
+	payload, header = fakeWebhook(t, "whsec_test", event)
+	for i := 0; i < 2; i++ {
+		if err := payments.HandleWebhook(payload, header); err != nil {
+			t.Fatalf("HandleWebhook() error = %v", err)
+		}
+	}
+	var stored models.PaymentTransaction
+	payments.db.First(&stored, "id = ?", payment.ID)
+	if stored.Status != PaymentCompleted {
+		t.Errorf("payment = %s, want completed", stored.Status)
+	}
+	checkBalance(t, payments.credits, user.ID, 100, 0, 0)
+
+	// A later failure event does not undo the completed payment
+	payload, header = fakeWebhook(t, "whsec_test", fakeWebhookEvent{ID: "evt_2", Type: ProviderEventChargeFailed, ChargeID: payment.ProviderChargeID})
+	if err := payments.HandleWebhook(payload, header); err != nil {
+		t.Fatalf("HandleWebhook() error = %v", err)
+	}
+	payments.db.First(&stored, "id = ?", payment.ID)
+	if stored.Status != PaymentCompleted {
+		t.Errorf("payment = %s after a late failure event, want completed", stored.Status)
+	}
+}
+
+func TestPaymentRefund(t *testing.T) {
+	payments, user := newPaymentTest(t)
+	addMethod(t, payments, user.ID, "tok_visa")
+	payment, err := payments.Charge(user.ID, &ChargeRequest{Amount: 10, Type: PaymentTypePayment, Description: "Agent"})
+	if err != nil {
+		t.Fatalf("Charge() error = %v", err)
+	}
+
+	refund, err := payments.Refund(payment.ID, 4, "requested")
+	if err != nil {
+		t.Fatalf("Refund() error = %v", err)
+	}
+	if refund.Type != PaymentTypeRefund || refund.Amount != 4 || refund.RefundOfID == nil || *refund.RefundOfID != payment.ID {
+		t.Errorf("refund = %s of %v for %v, want a refund of 4 for the payment", refund.Type, refund.Amount, refund.RefundOfID)
+	}
+
+	// Refunds together never exceed the payment
+	if _, err := payments.Refund(payment.ID, 6.01, "requested"); err == nil {
+		t.Error("Refund() beyond the amount paid error = nil, want an error")
+	}
+	if _, err := payments.Refund(payment.ID, 6, "requested"); err != nil {
+		t.Errorf("Refund() of the rest error = %v", err)
+	}
+	if _, err := payments.Refund(refund.ID, 1, "requested"); err == nil {
+		t.Error("Refund() of a refund error = nil, want an error")
+	}
+}
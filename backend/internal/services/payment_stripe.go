@@ -0,0 +1,311 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mlaitechio/vagais/internal/config"
+)
+
+// stripeSignatureTolerance is how old a signed webhook may be before it is rejected
+const stripeSignatureTolerance = 5 * time.Minute
+
+// stripePaymentProvider talks to the Stripe API, or any server compatible with it
+type stripePaymentProvider struct {
+	apiBase       string
+	secretKey     string
+	webhookSecret string
+	httpClient    *http.Client
+}
+
+func newStripePaymentProvider(cfg config.PaymentsConfig) *stripePaymentProvider {
+	return &stripePaymentProvider{
+		apiBase:       strings.TrimSuffix(cfg.StripeAPIBase, "/"),
+		secretKey:     cfg.StripeSecretKey,
+		webhookSecret: cfg.StripeWebhookSecret,
+		httpClient: &http.Client{
+			Timeout: time.Duration(cfg.RequestTimeoutSeconds) * time.Second,
+		},
+	}
+}
+
+func (p *stripePaymentProvider) Name() string {
+	return "stripe"
+}
+
+// StripeError is returned when Stripe answers with a non-success status
+type StripeError struct {
+	StatusCode    int    `json:"-"`
+	Type          string `json:"type"`
+	Code          string `json:"code"`
+	Message       string `json:"message"`
+	PaymentIntent *struct {
+		ID string `json:"id"`
+	} `json:"payment_intent"`
+}
+
+func (e *StripeError) Error() string {
+	return fmt.Sprintf("stripe returned status %d: %s", e.StatusCode, e.Message)
+}
+
+// post sends a form-encoded request and decodes the JSON response into out
+func (p *stripePaymentProvider) post(ctx context.Context, path string, form url.Values, idempotencyKey string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.apiBase+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.secretKey)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("stripe request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("failed to read stripe response: %v", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var parsed struct {
+			Error StripeError `json:"error"`
+		}
+		if err := json.Unmarshal(body, &parsed); err != nil || parsed.Error.Message == "" {
+			parsed.Error.Message = strings.TrimSpace(string(body))
+		}
+		parsed.Error.StatusCode = resp.StatusCode
+		return &parsed.Error
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("failed to decode stripe response: %v", err)
+	}
+	return nil
+}
+
+func (p *stripePaymentProvider) CreateCustomer(ctx context.Context, params *CustomerParams) (string, error) {
+	form := url.Values{}
+	form.Set("email", params.Email)
+	form.Set("name", params.Name)
+	form.Set("metadata[user_id]", params.UserID)
+
+	var customer struct {
+		ID string `json:"id"`
+	}
+	if err := p.post(ctx, "/v1/customers", form, "customer-"+params.UserID, &customer); err != nil {
+		return "", err
+	}
+	return customer.ID, nil
+}
+
+// AttachPaymentMethod attaches a payment method created client-side, e.g. by Stripe.js; Token is its pm_ ID
+func (p *stripePaymentProvider) AttachPaymentMethod(ctx context.Context, customerID string, params *AttachPaymentMethodParams) (*ProviderPaymentMethod, error) {
+	if params.Token == "" {
+		return nil, errors.New("a payment method token is required")
+	}
+
+	form := url.Values{}
+	form.Set("customer", customerID)
+
+	var method struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+		Card *struct {
+			Brand    string `json:"brand"`
+			Last4    string `json:"last4"`
+			ExpMonth int    `json:"exp_month"`
+			ExpYear  int    `json:"exp_year"`
+		} `json:"card"`
+	}
+	if err := p.post(ctx, "/v1/payment_methods/"+url.PathEscape(params.Token)+"/attach", form, "", &method); err != nil {
+		return nil, err
+	}
+
+	result := &ProviderPaymentMethod{ID: method.ID, Type: params.Type}
+	if method.Card != nil {
+		result.Type = "card"
+		result.Brand = method.Card.Brand
+		result.LastFour = method.Card.Last4
+		result.Expiry = fmt.Sprintf("%02d/%02d", method.Card.ExpMonth, method.Card.ExpYear%100)
+	}
+	return result, nil
+}
+
+// stripePaymentIntent is the part of a PaymentIntent the adapter reads
+type stripePaymentIntent struct {
+	ID               string `json:"id"`
+	Status           string `json:"status"`
+	LastPaymentError *struct {
+		Message string `json:"message"`
+	} `json:"last_payment_error"`
+	NextAction *struct {
+		RedirectToURL *struct {
+			URL string `json:"url"`
+		} `json:"redirect_to_url"`
+	} `json:"next_action"`
+}
+
+// Charge creates and confirms a PaymentIntent against the customer's saved method
+func (p *stripePaymentProvider) Charge(ctx context.Context, params *ChargeParams) (*ProviderCharge, error) {
+	form := url.Values{}
+	form.Set("amount", strconv.FormatInt(params.Amount, 10))
+	form.Set("currency", strings.ToLower(params.Currency))
+	form.Set("customer", params.CustomerID)
+	form.Set("payment_method", params.PaymentMethodID)
+	form.Set("description", params.Description)
+	form.Set("confirm", "true")
+	form.Set("off_session", "true")
+	for k, v := range params.Metadata {
+		form.Set("metadata["+k+"]", v)
+	}
+
+	var intent stripePaymentIntent
+	err := p.post(ctx, "/v1/payment_intents", form, params.IdempotencyKey, &intent)
+	var stripeErr *StripeError
+	if errors.As(err, &stripeErr) && stripeErr.Type == "card_error" {
+		// Declines are an outcome of the charge, not a failure to reach Stripe
+		charge := &ProviderCharge{Status: ChargeFailed, FailureMessage: stripeErr.Message}
+		if stripeErr.PaymentIntent != nil {
+			charge.ID = stripeErr.PaymentIntent.ID
+		}
+		return charge, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	charge := &ProviderCharge{ID: intent.ID}
+	switch intent.Status {
+	case "succeeded":
+		charge.Status = ChargeSucceeded
+	case "processing", "requires_action", "requires_confirmation":
+		charge.Status = ChargePending
+		if intent.NextAction != nil && intent.NextAction.RedirectToURL != nil {
+			charge.ActionURL = intent.NextAction.RedirectToURL.URL
+		}
+	default:
+		charge.Status = ChargeFailed
+		if intent.LastPaymentError != nil {
+			charge.FailureMessage = intent.LastPaymentError.Message
+		}
+	}
+	return charge, nil
+}
+
+func (p *stripePaymentProvider) Refund(ctx context.Context, params *RefundParams) (*ProviderRefund, error) {
+	form := url.Values{}
+	form.Set("payment_intent", params.ChargeID)
+	if params.Amount > 0 {
+		form.Set("amount", strconv.FormatInt(params.Amount, 10))
+	}
+
+	var refund struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	}
+	if err := p.post(ctx, "/v1/refunds", form, params.IdempotencyKey, &refund); err != nil {
+		return nil, err
+	}
+	return &ProviderRefund{ID: refund.ID, Status: refund.Status}, nil
+}
+
+// ParseWebhook verifies the Stripe-Signature header and normalises the event
+func (p *stripePaymentProvider) ParseWebhook(payload []byte, header http.Header) (*ProviderEvent, error) {
+	if p.webhookSecret == "" {
+		return nil, errors.New("STRIPE_WEBHOOK_SECRET is not configured")
+	}
+	if err := verifyStripeSignature(payload, header.Get("Stripe-Signature"), p.webhookSecret, time.Now()); err != nil {
+		return nil, err
+	}
+
+	var event struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+		Data struct {
+			Object json.RawMessage `json:"object"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, fmt.Errorf("invalid webhook payload: %v", err)
+	}
+
+	result := &ProviderEvent{ID: event.ID}
+	switch event.Type {
+	case "payment_intent.succeeded", "payment_intent.payment_failed":
+		var intent stripePaymentIntent
+		if err := json.Unmarshal(event.Data.Object, &intent); err != nil {
+			return nil, fmt.Errorf("invalid payment intent in webhook: %v", err)
+		}
+		result.ChargeID = intent.ID
+		result.Type = ProviderEventChargeSucceeded
+		if event.Type == "payment_intent.payment_failed" {
+			result.Type = ProviderEventChargeFailed
+			if intent.LastPaymentError != nil {
+				result.FailureMessage = intent.LastPaymentError.Message
+			}
+		}
+	case "refund.created":
+		var refund struct {
+			ID            string `json:"id"`
+			Amount        int64  `json:"amount"`
+			PaymentIntent string `json:"payment_intent"`
+		}
+		if err := json.Unmarshal(event.Data.Object, &refund); err != nil {
+			return nil, fmt.Errorf("invalid refund in webhook: %v", err)
+		}
+		result.Type = ProviderEventChargeRefunded
+		result.ChargeID = refund.PaymentIntent
+		result.RefundID = refund.ID
+		result.RefundAmount = refund.Amount
+	}
+	return result, nil
+}
+
+// verifyStripeSignature checks a "t=timestamp,v1=signature" header against the payload
+func verifyStripeSignature(payload []byte, header, secret string, now time.Time) error {
+	var timestamp string
+	var signatures [][]byte
+	for _, part := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			if sig, err := hex.DecodeString(value); err == nil {
+				signatures = append(signatures, sig)
+			}
+		}
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return ErrInvalidWebhookSignature
+	}
+	if age := now.Sub(time.Unix(seconds, 0)); age > stripeSignatureTolerance || age < -stripeSignatureTolerance {
+		return errors.New("webhook signature has expired")
+	}
+
+	expected := signPayload(secret, []byte(timestamp+"."+string(payload)))
+	for _, sig := range signatures {
+		if hmac.Equal(sig, expected) {
+			return nil
+		}
+	}
+	return ErrInvalidWebhookSignature
+}
@@ -0,0 +1,434 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// Plan describes the limits of a subscription plan. A zero limit means unlimited.
+type Plan struct {
+	Name               string  `json:"name"`
+	DisplayName        string  `json:"display_name"`
+	MonthlyPrice       float64 `json:"monthly_price"`
+	MonthlyExecutions  int64   `json:"monthly_executions"`
+	Seats              int64   `json:"seats"`
+	PrivateAgents      int64   `json:"private_agents"`
+	RateLimitPerMinute int     `json:"rate_limit_per_minute"`
+	IncludedCredits    int64   `json:"included_credits"`
+}
+
+// defaultPlans are used unless PLANS_FILE provides others. They are listed
+// from the lowest tier up, which is the order upgrade hints follow.
+var defaultPlans = []Plan{
+	{
+		Name:               "free",
+		DisplayName:        "Free",
+		MonthlyExecutions:  100,
+		Seats:              3,
+		PrivateAgents:      3,
+		RateLimitPerMinute: 60,
+	},
+	{
+		Name:               "pro",
+		DisplayName:        "Pro",
+		MonthlyPrice:       49,
+		MonthlyExecutions:  5000,
+		Seats:              10,
+		PrivateAgents:      50,
+		RateLimitPerMinute: 600,
+		IncludedCredits:    5000,
+	},
+	{
+		Name:               "enterprise",
+		DisplayName:        "Enterprise",
+		MonthlyPrice:       499,
+		RateLimitPerMinute: 3000,
+		IncludedCredits:    50000,
+	},
+}
+
+// Quota error codes
+const (
+	QuotaExecutions    = "execution_quota_exceeded"
+	QuotaSeats         = "seat_limit_reached"
+	QuotaPrivateAgents = "private_agent_limit_reached"
+	QuotaRateLimit     = "rate_limit_exceeded"
+)
+
+// QuotaError is returned when an action would exceed the limits of the caller's plan
+type QuotaError struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Plan    string       `json:"plan"`
+	Limit   int64        `json:"limit"`
+	Used    int64        `json:"used"`
+	Upgrade *PlanUpgrade `json:"upgrade,omitempty"`
+}
+
+func (e *QuotaError) Error() string {
+	return e.Message
+}
+
+// PlanUpgrade suggests the plan that lifts a limit; Limit is omitted when it is unlimited
+type PlanUpgrade struct {
+	Plan         string  `json:"plan"`
+	DisplayName  string  `json:"display_name"`
+	MonthlyPrice float64 `json:"monthly_price"`
+	Limit        int64   `json:"limit,omitempty"`
+}
+
+// PlanUsage reports usage in the current period against the plan's limits
+type PlanUsage struct {
+	Plan        Plan                 `json:"plan"`
+	PeriodStart time.Time            `json:"period_start"`
+	PeriodEnd   time.Time            `json:"period_end"`
+	Usage       map[string]UsageItem `json:"usage"`
+	Upgrade     *PlanUpgrade         `json:"upgrade,omitempty"`
+}
+
+// UsageItem represents the use of one plan limit; a zero limit means unlimited
+type UsageItem struct {
+	Used  int64 `json:"used"`
+	Limit int64 `json:"limit"`
+}
+
+// PlanService resolves subscription plans and enforces their quotas
+type PlanService struct {
+	BaseService
+	plans   []Plan
+	credits *CreditService
+}
+
+// NewPlanService creates a new plan service
+func NewPlanService(db *gorm.DB, cfg *config.Config) *PlanService {
+	plans := defaultPlans
+	if cfg.Plans.File != "" {
+		loaded, err := loadPlans(cfg.Plans.File)
+		if err != nil {
+			fmt.Printf("Failed to load plans from %s, using defaults: %v\n", cfg.Plans.File, err)
+		} else {
+			plans = loaded
+		}
+	}
+
+	return &PlanService{
+		BaseService: NewBaseService(db, cfg, "plan"),
+		plans:       plans,
+		credits:     NewCreditService(db, cfg),
+	}
+}
+
+// loadPlans reads a JSON array of plans
+func loadPlans(path string) ([]Plan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var plans []Plan
+	if err := json.Unmarshal(data, &plans); err != nil {
+		return nil, err
+	}
+	if len(plans) == 0 {
+		return nil, errors.New("no plans defined")
+	}
+	for _, plan := range plans {
+		if plan.Name == "" {
+			return nil, errors.New("every plan needs a name")
+		}
+	}
+	return plans, nil
+}
+
+// Plans lists the available plans from the lowest tier up
+func (s *PlanService) Plans() []Plan {
+	return s.plans
+}
+
+// GetPlan returns a plan by name
+func (s *PlanService) GetPlan(name string) (*Plan, error) {
+	for i := range s.plans {
+		if s.plans[i].Name == name {
+			return &s.plans[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown plan: %s", name)
+}
+
+// PlanFor returns the plan of an organization, or the default plan for users without one
+func (s *PlanService) PlanFor(orgID *string) *Plan {
+	name := s.cfg.Plans.Default
+	if orgID != nil {
+		var org models.Organization
+		if err := s.db.Select("id", "plan").First(&org, "id = ?", *orgID).Error; err == nil && org.Plan != "" {
+			name = org.Plan
+		}
+	}
+	if plan, err := s.GetPlan(name); err == nil {
+		return plan
+	}
+	return &s.plans[0]
+}
+
+// SetOrganizationPlan moves an organization to another plan
+func (s *PlanService) SetOrganizationPlan(orgID, planName string) (*models.Organization, error) {
+	if _, err := s.GetPlan(planName); err != nil {
+		return nil, err
+	}
+
+	var org models.Organization
+	if err := s.db.First(&org, "id = ?", orgID).Error; err != nil {
+		return nil, errors.New("organization not found")
+	}
+	if err := s.db.Model(&org).Update("plan", planName).Error; err != nil {
+		return nil, err
+	}
+	return &org, nil
+}
+
+// CheckExecutionQuota fails with a QuotaError once the month's executions are used up
+func (s *PlanService) CheckExecutionQuota(userID string, orgID *string) error {
+	plan := s.PlanFor(orgID)
+	if plan.MonthlyExecutions <= 0 {
+		return nil
+	}
+
+	used, err := s.countExecutions(userID, orgID, currentPeriodStart())
+	if err != nil {
+		return err
+	}
+	if used >= plan.MonthlyExecutions {
+		return s.quotaError(plan, QuotaExecutions, used, plan.MonthlyExecutions,
+			fmt.Sprintf("the %s plan allows %d executions per month", plan.DisplayName, plan.MonthlyExecutions),
+			func(p *Plan) int64 { return p.MonthlyExecutions })
+	}
+	return nil
+}
+
+// CheckSeatQuota fails with a QuotaError when the organization has no free seat
+func (s *PlanService) CheckSeatQuota(orgID string) error {
+	plan := s.PlanFor(&orgID)
+	if plan.Seats <= 0 {
+		return nil
+	}
+
+	var used int64
+	if err := s.db.Model(&models.User{}).Where("organization_id = ?", orgID).Count(&used).Error; err != nil {
+		return err
+	}
+	if used >= plan.Seats {
+		return s.quotaError(plan, QuotaSeats, used, plan.Seats,
+			fmt.Sprintf("the %s plan allows %d seats", plan.DisplayName, plan.Seats),
+			func(p *Plan) int64 { return p.Seats })
+	}
+	return nil
+}
+
+// CheckPrivateAgentQuota fails with a QuotaError when no more private agents may be created
+func (s *PlanService) CheckPrivateAgentQuota(userID string, orgID *string) error {
+	plan := s.PlanFor(orgID)
+	if plan.PrivateAgents <= 0 {
+		return nil
+	}
+
+	used, err := s.countPrivateAgents(userID, orgID)
+	if err != nil {
+		return err
+	}
+	if used >= plan.PrivateAgents {
+		return s.quotaError(plan, QuotaPrivateAgents, used, plan.PrivateAgents,
+			fmt.Sprintf("the %s plan allows %d private agents", plan.DisplayName, plan.PrivateAgents),
+			func(p *Plan) int64 { return p.PrivateAgents })
+	}
+	return nil
+}
+
+// RateLimitFor returns the key requests are counted under and the plan's per-minute limit
+func (s *PlanService) RateLimitFor(user *models.User) (string, *Plan) {
+	plan := s.PlanFor(user.OrganizationID)
+	if user.OrganizationID != nil {
+		return "org:" + *user.OrganizationID, plan
+	}
+	return "user:" + user.ID, plan
+}
+
+// RateLimitError builds the error returned when the plan's rate limit is hit
+func (s *PlanService) RateLimitError(plan *Plan) *QuotaError {
+	limit := int64(plan.RateLimitPerMinute)
+	return s.quotaError(plan, QuotaRateLimit, limit, limit,
+		fmt.Sprintf("the %s plan allows %d requests per minute", plan.DisplayName, plan.RateLimitPerMinute),
+		func(p *Plan) int64 { return int64(p.RateLimitPerMinute) })
+}
+
+// AllocateIncludedCredits grants the plan's included credits once per calendar month
+func (s *PlanService) AllocateIncludedCredits(userID string, orgID *string) error {
+	plan := s.PlanFor(orgID)
+	if plan.IncludedCredits <= 0 {
+		return nil
+	}
+
+	periodStart := currentPeriodStart()
+	period := periodStart.Format("2006-01")
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var allocated int64
+		if err := tx.Model(&models.CreditTransaction{}).
+			Where("user_id = ? AND type = ? AND created_at >= ?", userID, CreditTypeAllocation, periodStart).
+			Count(&allocated).Error; err != nil {
+			return err
+		}
+		if allocated > 0 {
+			return errAlreadyAllocated
+		}
+
+		if _, err := s.credits.record(tx, userID, CreditTypeAllocation, plan.IncludedCredits, nil,
+			fmt.Sprintf("%s plan credits for %s", plan.DisplayName, period),
+			map[string]interface{}{"plan": plan.Name, "period": period}, false); err != nil {
+			return err
+		}
+
+		// The ledger update above locks the user row, so a concurrent
+		// allocation is visible here once it commits
+		if err := tx.Model(&models.CreditTransaction{}).
+			Where("user_id = ? AND type = ? AND created_at >= ?", userID, CreditTypeAllocation, periodStart).
+			Count(&allocated).Error; err != nil {
+			return err
+		}
+		if allocated > 1 {
+			return errAlreadyAllocated
+		}
+		return nil
+	})
+	if err == errAlreadyAllocated {
+		return nil
+	}
+	return err
+}
+
+// errAlreadyAllocated rolls back an allocation made twice in the same month
+var errAlreadyAllocated = errors.New("credits already allocated for this period")
+
+// GetUsage reports the caller's usage in the current month against their plan
+func (s *PlanService) GetUsage(userID string, orgID *string) (*PlanUsage, error) {
+	plan := s.PlanFor(orgID)
+	periodStart := currentPeriodStart()
+
+	executions, err := s.countExecutions(userID, orgID, periodStart)
+	if err != nil {
+		return nil, err
+	}
+	privateAgents, err := s.countPrivateAgents(userID, orgID)
+	if err != nil {
+		return nil, err
+	}
+	seats := int64(1)
+	if orgID != nil {
+		if err := s.db.Model(&models.User{}).Where("organization_id = ?", *orgID).Count(&seats).Error; err != nil {
+			return nil, err
+		}
+	}
+	var allocated int64
+	if err := s.db.Model(&models.CreditTransaction{}).
+		Where("user_id = ? AND type = ? AND created_at >= ?", userID, CreditTypeAllocation, periodStart).
+		Select("COALESCE(SUM(amount), 0)").Scan(&allocated).Error; err != nil {
+		return nil, err
+	}
+
+	usage := &PlanUsage{
+		Plan:        *plan,
+		PeriodStart: periodStart,
+		PeriodEnd:   periodStart.AddDate(0, 1, 0),
+		Usage: map[string]UsageItem{
+			"executions":       {Used: executions, Limit: plan.MonthlyExecutions},
+			"seats":            {Used: seats, Limit: plan.Seats},
+			"private_agents":   {Used: privateAgents, Limit: plan.PrivateAgents},
+			"included_credits": {Used: allocated, Limit: plan.IncludedCredits},
+		},
+	}
+	if next := s.nextPlan(plan); next != nil {
+		usage.Upgrade = &PlanUpgrade{Plan: next.Name, DisplayName: next.DisplayName, MonthlyPrice: next.MonthlyPrice}
+	}
+	return usage, nil
+}
+
+// countExecutions counts the executions of the organization, or of the user when they have none, since from
+func (s *PlanService) countExecutions(userID string, orgID *string, from time.Time) (int64, error) {
+	var count int64
+	query := s.db.Model(&models.Execution{}).Where("created_at >= ?", from)
+	if orgID != nil {
+		query = query.Where("organization_id = ?", *orgID)
+	} else {
+		query = query.Where("user_id = ? AND organization_id IS NULL", userID)
+	}
+	err := query.Count(&count).Error
+	return count, err
+}
+
+// countPrivateAgents counts the private agents of the organization, or of the user when they have none
+func (s *PlanService) countPrivateAgents(userID string, orgID *string) (int64, error) {
+	var count int64
+	query := s.db.Model(&models.Agent{}).Where("is_public = ?", false)
+	if orgID != nil {
+		query = query.Where("organization_id = ?", *orgID)
+	} else {
+		query = query.Where("creator_id = ? AND organization_id IS NULL", userID)
+	}
+	err := query.Count(&count).Error
+	return count, err
+}
+
+// quotaError builds a QuotaError with a hint to the first higher plan that lifts the limit
+func (s *PlanService) quotaError(plan *Plan, code string, used, limit int64, message string, limitOf func(*Plan) int64) *QuotaError {
+	err := &QuotaError{
+		Code:    code,
+		Message: message,
+		Plan:    plan.Name,
+		Limit:   limit,
+		Used:    used,
+	}
+
+	higher := false
+	for i := range s.plans {
+		candidate := &s.plans[i]
+		if candidate.Name == plan.Name {
+			higher = true
+			continue
+		}
+		if !higher {
+			continue
+		}
+		if l := limitOf(candidate); l <= 0 || l > limit {
+			err.Upgrade = &PlanUpgrade{
+				Plan:         candidate.Name,
+				DisplayName:  candidate.DisplayName,
+				MonthlyPrice: candidate.MonthlyPrice,
+				Limit:        l,
+			}
+			err.Message += fmt.Sprintf("; upgrade to %s for more", candidate.DisplayName)
+			break
+		}
+	}
+	return err
+}
+
+// nextPlan returns the plan one tier above, if any
+func (s *PlanService) nextPlan(plan *Plan) *Plan {
+	for i := range s.plans {
+		if s.plans[i].Name == plan.Name && i+1 < len(s.plans) {
+			return &s.plans[i+1]
+		}
+	}
+	return nil
+}
+
+// currentPeriodStart returns the start of the current calendar month in UTC
+func currentPeriodStart() time.Time {
+	now := time.Now().UTC()
+	return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
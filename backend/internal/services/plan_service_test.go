@@ -0,0 +1,258 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// planTest holds a plan service, an organization on the given plan and a
+// user outside any organization
+type planTest struct {
+	plans *PlanService
+	org   *models.Organization
+	user  *models.User
+}
+
+func newPlanTest(t *testing.T, plan string) *planTest {
+	t.Helper()
+	db := newTestDB(t, &models.Organization{}, &models.User{}, &models.Agent{}, &models.Execution{}, &models.CreditTransaction{})
+	org := &models.Organization{Name: "Acme", Slug: "acme", Plan: plan}
+	user := &models.User{Email: "ann@example.com", Username: "ann", PasswordHash: "x", IsActive: true}
+	if err := db.Create(org).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return &planTest{plans: NewPlanService(db, config.Load()), org: org, user: user}
+}
+
+// addExecutions stores n executions by the user in the organization, or
+// outside one when orgID is nil, created at the given time
+func (pt *planTest) addExecutions(t *testing.T, orgID *string, n int, createdAt time.Time) {
+	t.Helper()
+	executions := make([]models.Execution, n)
+	for i := range executions {
+		executions[i] = models.Execution{AgentID: "agent-1", UserID: pt.user.ID, OrganizationID: orgID, Status: "completed"}
+		executions[i].CreatedAt = createdAt
+	}
+	if err := pt.plans.db.CreateInBatches(executions, 500).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// quotaErr returns err as a QuotaError, failing the test when it is not one
+func quotaErr(t *testing.T, err error, code string) *QuotaError {
+	t.Helper()
+	var quota *QuotaError
+	if !errors.As(err, &quota) || quota.Code != code {
+		t.Fatalf("error = %v, want a %s QuotaError", err, code)
+	}
+	return quota
+}
+
+func TestNewPlanServiceLoadsPlans(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "plans.json")
+	if err := os.WriteFile(valid, []byte(`[{"name": "team", "monthly_executions": 10}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	unnamed := filepath.Join(dir, "unnamed.json")
+	if err := os.WriteFile(unnamed, []byte(`[{"monthly_executions": 10}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		file string
+		want string
+	}{
+		{file: valid, want: "team"},
+		// Files that cannot be used leave the built-in plans in place
+		{file: unnamed, want: "free"},
+		{file: filepath.Join(dir, "missing.json"), want: "free"},
+	}
+
+	for _, tt := range tests {
+		plans := NewPlanService(nil, &config.Config{Plans: config.PlansConfig{File: tt.file}})
+		if got := plans.Plans()[0].Name; got != tt.want {
+			t.Errorf("NewPlanService(%s) first plan = %s, want %s", filepath.Base(tt.file), got, tt.want)
+		}
+	}
+}
+
+func TestPlanFor(t *testing.T) {
+	pt := newPlanTest(t, "pro")
+	unknown := &models.Organization{Name: "Old", Slug: "old", Plan: "legacy"}
+	pt.plans.db.Create(unknown)
+	missing := "missing"
+
+	tests := []struct {
+		name  string
+		orgID *string
+		want  string
+	}{
+		{name: "no organization", want: "free"},
+		{name: "organization plan", orgID: &pt.org.ID, want: "pro"},
+		{name: "unknown organization", orgID: &missing, want: "free"},
+		{name: "plan no longer offered", orgID: &unknown.ID, want: "free"},
+	}
+
+	for _, tt := range tests {
+		if got := pt.plans.PlanFor(tt.orgID).Name; got != tt.want {
+			t.Errorf("PlanFor(%s) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := pt.plans.SetOrganizationPlan(pt.org.ID, "platinum"); err == nil {
+		t.Error("SetOrganizationPlan() to an unknown plan error = nil, want an error")
+	}
+	if _, err := pt.plans.SetOrganizationPlan(pt.org.ID, "enterprise"); err != nil {
+		t.Fatalf("SetOrganizationPlan() error = %v", err)
+	}
+	if got := pt.plans.PlanFor(&pt.org.ID).Name; got != "enterprise" {
+		t.Errorf("PlanFor() after the change = %s, want enterprise", got)
+	}
+}
+
+func TestCheckExecutionQuota(t *testing.T) {
+	pt := newPlanTest(t, "pro")
+
+	// Only this month's executions outside an organization count for the user
+	pt.addExecutions(t, nil, 99, time.Now())
+	pt.addExecutions(t, nil, 5, currentPeriodStart().Add(-time.Hour))
+	pt.addExecutions(t, &pt.org.ID, 5, time.Now())
+	if err := pt.plans.CheckExecutionQuota(pt.user.ID, nil); err != nil {
+		t.Fatalf("CheckExecutionQuota() with 99 of 100 used error = %v", err)
+	}
+
+	pt.addExecutions(t, nil, 1, time.Now())
+	quota := quotaErr(t, pt.plans.CheckExecutionQuota(pt.user.ID, nil), QuotaExecutions)
+	if quota.Plan != "free" || quota.Used != 100 || quota.Limit != 100 {
+		t.Errorf("quota = %s, %d of %d used, want free, 100 of 100", quota.Plan, quota.Used, quota.Limit)
+	}
+	if quota.Upgrade == nil || quota.Upgrade.Plan != "pro" || quota.Upgrade.Limit != 5000 {
+		t.Errorf("upgrade = %+v, want pro with 5000 executions", quota.Upgrade)
+	}
+
+	// The organization has its own, larger quota
+	if err := pt.plans.CheckExecutionQuota(pt.user.ID, &pt.org.ID); err != nil {
+		t.Errorf("CheckExecutionQuota() in the organization error = %v", err)
+	}
+}
+
+func TestCheckExecutionQuotaUpgradeToUnlimited(t *testing.T) {
+	pt := newPlanTest(t, "pro")
+	pt.addExecutions(t, &pt.org.ID, 5000, time.Now())
+
+	// A plan without the limit is suggested with no limit given
+	quota := quotaErr(t, pt.plans.CheckExecutionQuota(pt.user.ID, &pt.org.ID), QuotaExecutions)
+	if quota.Upgrade == nil || quota.Upgrade.Plan != "enterprise" || quota.Upgrade.Limit != 0 {
+		t.Errorf("upgrade = %+v, want enterprise without a limit", quota.Upgrade)
+	}
+
+	if _, err := pt.plans.SetOrganizationPlan(pt.org.ID, "enterprise"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pt.plans.CheckExecutionQuota(pt.user.ID, &pt.org.ID); err != nil {
+		t.Errorf("CheckExecutionQuota() on enterprise error = %v", err)
+	}
+}
+
+func TestCheckSeatQuota(t *testing.T) {
+	pt := newPlanTest(t, "free")
+	for i, name := range []string{"bob", "cat"} {
+		member := &models.User{Email: name + "@example.com", Username: name, PasswordHash: "x", OrganizationID: &pt.org.ID}
+		if err := pt.plans.db.Create(member).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := pt.plans.CheckSeatQuota(pt.org.ID); err != nil {
+			t.Fatalf("CheckSeatQuota() with %d of 3 seats taken error = %v", i+1, err)
+		}
+	}
+
+	pt.plans.db.Model(pt.user).Update("organization_id", pt.org.ID)
+	quota := quotaErr(t, pt.plans.CheckSeatQuota(pt.org.ID), QuotaSeats)
+	if quota.Used != 3 || quota.Upgrade == nil || quota.Upgrade.Plan != "pro" || quota.Upgrade.Limit != 10 {
+		t.Errorf("quota = %d used, upgrade %+v, want 3 used and pro with 10 seats", quota.Used, quota.Upgrade)
+	}
+}
+
+func TestCheckPrivateAgentQuota(t *testing.T) {
+	pt := newPlanTest(t, "free")
+	for i, public := range []bool{false, false, true, false} {
+		agent := &models.Agent{Name: "Agent", Slug: fmt.Sprintf("agent-%d", i), CreatorID: pt.user.ID, IsPublic: public}
+		if err := pt.plans.db.Create(agent).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Public agents do not count towards the limit
+	quota := quotaErr(t, pt.plans.CheckPrivateAgentQuota(pt.user.ID, nil), QuotaPrivateAgents)
+	if quota.Used != 3 || quota.Limit != 3 {
+		t.Errorf("quota = %d of %d used, want 3 of 3", quota.Used, quota.Limit)
+	}
+	if err := pt.plans.CheckPrivateAgentQuota(pt.user.ID, &pt.org.ID); err != nil {
+		t.Errorf("CheckPrivateAgentQuota() in an empty organization error = %v", err)
+	}
+}
+
+func TestRateLimitFor(t *testing.T) {
+	pt := newPlanTest(t, "pro")
+
+	// Requests are counted per organization, or per user outside one
+	key, plan := pt.plans.RateLimitFor(pt.user)
+	if key != "user:"+pt.user.ID || plan.RateLimitPerMinute != 60 {
+		t.Errorf("RateLimitFor() = %s, %d, want the user's key and 60 per minute", key, plan.RateLimitPerMinute)
+	}
+	member := &models.User{BaseModel: models.BaseModel{ID: "member-1"}, OrganizationID: &pt.org.ID}
+	key, plan = pt.plans.RateLimitFor(member)
+	if key != "org:"+pt.org.ID || plan.RateLimitPerMinute != 600 {
+		t.Errorf("RateLimitFor() = %s, %d, want the organization's key and 600 per minute", key, plan.RateLimitPerMinute)
+	}
+
+	free, _ := pt.plans.GetPlan("free")
+	quota := pt.plans.RateLimitError(free)
+	if quota.Code != QuotaRateLimit || quota.Limit != 60 || quota.Upgrade == nil || quota.Upgrade.Plan != "pro" || quota.Upgrade.Limit != 600 {
+		t.Errorf("RateLimitError() = %+v, want the 60 request limit with an upgrade to pro", quota)
+	}
+}
+
+func TestAllocateIncludedCredits(t *testing.T) {
+	pt := newPlanTest(t, "pro")
+	pt.plans.db.Model(pt.user).Update("organization_id", pt.org.ID)
+
+	// The plan's credits are granted once a month, however often it is called
+	for i := 0; i < 3; i++ {
+		if err := pt.plans.AllocateIncludedCredits(pt.user.ID, &pt.org.ID); err != nil {
+			t.Fatalf("AllocateIncludedCredits() error = %v", err)
+		}
+	}
+	checkBalance(t, pt.plans.credits, pt.user.ID, 5000, 0, 0)
+
+	usage, err := pt.plans.GetUsage(pt.user.ID, &pt.org.ID)
+	if err != nil {
+		t.Fatalf("GetUsage() error = %v", err)
+	}
+	if got := usage.Usage["included_credits"]; got.Used != 5000 || got.Limit != 5000 {
+		t.Errorf("included credits = %d of %d, want 5000 of 5000", got.Used, got.Limit)
+	}
+	if got := usage.Usage["seats"]; got.Used != 1 || got.Limit != 10 {
+		t.Errorf("seats = %d of %d, want 1 of 10", got.Used, got.Limit)
+	}
+	if usage.Upgrade == nil || usage.Upgrade.Plan != "enterprise" {
+		t.Errorf("upgrade = %+v, want enterprise", usage.Upgrade)
+	}
+
+	// The free plan includes none
+	if err := pt.plans.AllocateIncludedCredits(pt.user.ID, nil); err != nil {
+		t.Fatalf("AllocateIncludedCredits() on free error = %v", err)
+	}
+	checkBalance(t, pt.plans.credits, pt.user.ID, 5000, 0, 0)
+}
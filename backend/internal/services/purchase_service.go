@@ -0,0 +1,784 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// Agent pricing models
+const (
+	PricingFree         = "free"
+	PricingOneTime      = "one_time"
+	PricingSubscription = "subscription"
+	PricingUsageBased   = "usage_based"
+	PricingCreditBased  = "credit_based"
+)
+
+// Purchase statuses
+const (
+	PurchasePending   = "pending"
+	PurchaseCompleted = "completed"
+	PurchaseFailed    = "failed"
+	PurchaseCancelled = "cancelled"
+	PurchaseRefunded  = "refunded"
+	PurchaseExpired   = "expired"
+)
+
+// How a purchase is paid for
+const (
+	PaidWithCredits       = "credits"
+	PaidWithPaymentMethod = "payment_method"
+)
+
+// Entitlement statuses
+const (
+	EntitlementActive    = "active"
+	EntitlementExpired   = "expired"
+	EntitlementExhausted = "exhausted"
+	EntitlementRevoked   = "revoked"
+)
+
+// purchaseTransitions lists the statuses each purchase status may move to
+var purchaseTransitions = map[string][]string{
+	PurchasePending:   {PurchaseCompleted, PurchaseFailed, PurchaseCancelled},
+	PurchaseCompleted: {PurchaseRefunded, PurchaseExpired},
+}
+
+// entitlementTransitions lists the statuses each entitlement status may move to
+var entitlementTransitions = map[string][]string{
+	EntitlementActive:    {EntitlementExpired, EntitlementExhausted, EntitlementRevoked},
+	EntitlementExhausted: {EntitlementActive, EntitlementRevoked},
+}
+
+// maxPurchaseQuantity caps how many uses a single usage-based purchase may buy
+const maxPurchaseQuantity = 10000
+
+// ErrNotEntitled is returned when a user runs a paid agent they have not purchased
+var ErrNotEntitled = errors.New("a purchase is required to use this agent")
+
+// ErrAlreadyOwned is returned when a user buys a one-time agent they already own
+var ErrAlreadyOwned = errors.New("you already own this agent")
+
+// errConcurrentUpdate is returned when a row changed status between read and update
+var errConcurrentUpdate = errors.New("record was modified by another request, please retry")
+
+// PurchaseService handles marketplace purchases and the entitlements they grant
+type PurchaseService struct {
+	BaseService
+	credits  *CreditService
+	payments *PaymentService
+	earnings *EarningsService
+	licenses *LicenseService
+	emails   *EmailService
+}
+
+// NewPurchaseService creates a new purchase service
+func NewPurchaseService(db *gorm.DB, cfg *config.Config) *PurchaseService {
+	s := &PurchaseService{
+		BaseService: NewBaseService(db, cfg, "purchase"),
+		credits:     NewCreditService(db, cfg),
+		payments:    NewPaymentService(db, cfg),
+		earnings:    NewEarningsService(db, cfg),
+		licenses:    NewLicenseService(db, cfg),
+		emails:      NewEmailService(db, cfg),
+	}
+	s.payments.OnPaymentSettled(s.HandlePaymentSettled)
+	return s
+}
+
+// PurchaseRequest represents agent purchase request
+type PurchaseRequest struct {
+	PricingTier     string `json:"pricing_tier" binding:"required"`
+	PaymentMethodID string `json:"payment_method_id"`
+	OrganizationID  string `json:"organization_id"`
+	Quantity        int    `json:"quantity"`
+}
+
+// PurchaseResult represents the outcome of a purchase
+type PurchaseResult struct {
+	PurchaseID    string              `json:"purchase_id"`
+	Status        string              `json:"status"`
+	Purchase      *models.Purchase    `json:"purchase"`
+	License       *models.Entitlement `json:"license,omitempty"`
+	OnPremLicense *models.License     `json:"on_prem_license,omitempty"`
+	PaymentURL    *string             `json:"payment_url"`
+}
+
+// RefundPurchaseRequest represents purchase refund request
+type RefundPurchaseRequest struct {
+	Reason string `json:"reason"`
+}
+
+// RequiresPurchase reports whether users other than the creator must buy the agent before running it
+func RequiresPurchase(agent *models.Agent) bool {
+	switch agent.PricingModel {
+	case PricingOneTime, PricingSubscription, PricingUsageBased:
+		return agent.Price > 0
+	}
+	return false
+}
+
+// canTransition reports whether a status may move from one value to another
+func canTransition(transitions map[string][]string, from, to string) bool {
+	for _, allowed := range transitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transitionPurchase moves a purchase to a new status, failing if the move is
+// not allowed or another request changed the purchase first
+func transitionPurchase(tx *gorm.DB, purchase *models.Purchase, to string, updates map[string]interface{}) error {
+	if !canTransition(purchaseTransitions, purchase.Status, to) {
+		return fmt.Errorf("purchase cannot move from %s to %s", purchase.Status, to)
+	}
+	if updates == nil {
+		updates = map[string]interface{}{}
+	}
+	updates["status"] = to
+
+	result := tx.Model(&models.Purchase{}).
+		Where("id = ? AND status = ?", purchase.ID, purchase.Status).
+		Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errConcurrentUpdate
+	}
+	purchase.Status = to
+	return nil
+}
+
+// transitionEntitlement moves an entitlement to a new status under the same rules as purchases
+func transitionEntitlement(tx *gorm.DB, entitlement *models.Entitlement, to string) error {
+	if !canTransition(entitlementTransitions, entitlement.Status, to) {
+		return fmt.Errorf("entitlement cannot move from %s to %s", entitlement.Status, to)
+	}
+
+	result := tx.Model(&models.Entitlement{}).
+		Where("id = ? AND status = ?", entitlement.ID, entitlement.Status).
+		Update("status", to)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errConcurrentUpdate
+	}
+	entitlement.Status = to
+	return nil
+}
+
+// PurchaseAgent buys a paid marketplace agent and grants the entitlement. It is
+// paid with the user's credits unless a payment method is given.
+func (s *PurchaseService) PurchaseAgent(agentID, userID string, req *PurchaseRequest) (*PurchaseResult, error) {
+	var agent models.Agent
+	if err := s.db.Where("id = ? AND is_public = ? AND is_enabled = ?", agentID, true, true).First(&agent).Error; err != nil {
+		return nil, errors.New("agent not found or not available")
+	}
+	if !RequiresPurchase(&agent) {
+		return nil, errors.New("agent is free to use and does not need to be purchased")
+	}
+	if agent.CreatorID == userID {
+		return nil, errors.New("you cannot purchase your own agent")
+	}
+
+	var user models.User
+	if err := s.db.First(&user, "id = ?", userID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+
+	var orgID *string
+	if req.OrganizationID != "" {
+		if user.OrganizationID == nil || *user.OrganizationID != req.OrganizationID {
+			return nil, errors.New("you can only purchase for your own organization")
+		}
+		orgID = &req.OrganizationID
+	}
+
+	quantity := 1
+	if agent.PricingModel == PricingUsageBased && req.Quantity > 0 {
+		quantity = req.Quantity
+	}
+	if quantity > maxPurchaseQuantity {
+		return nil, fmt.Errorf("quantity cannot exceed %d", maxPurchaseQuantity)
+	}
+
+	if agent.PricingModel == PricingOneTime {
+		if _, err := s.findEntitlement(&user, agent.ID); err == nil {
+			return nil, ErrAlreadyOwned
+		}
+	}
+
+	amount := agent.Price * float64(quantity)
+	purchase := &models.Purchase{
+		UserID:         userID,
+		AgentID:        agent.ID,
+		OrganizationID: orgID,
+		PricingModel:   agent.PricingModel,
+		PricingTier:    req.PricingTier,
+		Quantity:       quantity,
+		Amount:         amount,
+		Currency:       agent.Currency,
+		Credits:        int64(math.Ceil(amount * float64(s.cfg.Credits.PerUSD))),
+		PaymentMethod:  PaidWithCredits,
+		Status:         PurchasePending,
+	}
+	if req.PaymentMethodID != "" {
+		purchase.PaymentMethod = PaidWithPaymentMethod
+		purchase.Credits = 0
+	}
+	if err := s.db.Create(purchase).Error; err != nil {
+		return nil, err
+	}
+
+	if req.PaymentMethodID != "" {
+		return s.payWithPaymentMethod(purchase, &agent, req.PaymentMethodID)
+	}
+
+	entitlement, err := s.completePurchase(purchase, &agent)
+	if err != nil {
+		s.failPurchase(purchase, err.Error())
+		return nil, err
+	}
+	return s.purchaseResult(purchase, entitlement, "")
+}
+
+// payWithPaymentMethod charges a purchase to one of the user's payment methods.
+// The purchase completes when the payment does, which may be after a webhook.
+func (s *PurchaseService) payWithPaymentMethod(purchase *models.Purchase, agent *models.Agent, paymentMethodID string) (*PurchaseResult, error) {
+	payment, err := s.payments.Charge(purchase.UserID, &ChargeRequest{
+		PaymentMethodID: paymentMethodID,
+		Amount:          purchase.Amount,
+		Type:            PaymentTypePayment,
+		Description:     "Purchase of " + agent.Name,
+		AgentID:         &agent.ID,
+		PurchaseID:      &purchase.ID,
+	})
+	if err != nil {
+		// A declined payment has already failed the purchase through handlePaymentSettled
+		s.failPurchase(purchase, err.Error())
+		return nil, err
+	}
+
+	if err := s.db.First(purchase, "id = ?", purchase.ID).Error; err != nil {
+		return nil, err
+	}
+	var entitlement *models.Entitlement
+	if purchase.Status == PurchaseCompleted {
+		var granted models.Entitlement
+		if err := s.db.First(&granted, "purchase_id = ?", purchase.ID).Error; err == nil {
+			entitlement = &granted
+		}
+	}
+	return s.purchaseResult(purchase, entitlement, payment.ActionURL)
+}
+
+// completePurchase takes payment for a credit purchase, if needed, grants the
+// entitlement and marks the purchase completed, all in one transaction
+func (s *PurchaseService) completePurchase(purchase *models.Purchase, agent *models.Agent) (*models.Entitlement, error) {
+	var entitlement *models.Entitlement
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// Concurrent purchases of a one-time agent are completed one at a
+		// time under the buyer's row lock, so only the first one succeeds
+		if purchase.PricingModel == PricingOneTime {
+			if err := tx.Model(&models.User{}).Where("id = ?", purchase.UserID).
+				UpdateColumn("credits", gorm.Expr("credits")).Error; err != nil {
+				return err
+			}
+			var owned int64
+			if err := tx.Model(&models.Purchase{}).
+				Where("user_id = ? AND agent_id = ? AND pricing_model = ? AND status = ? AND id <> ?",
+					purchase.UserID, purchase.AgentID, PricingOneTime, PurchaseCompleted, purchase.ID).
+				Count(&owned).Error; err != nil {
+				return err
+			}
+			if owned > 0 {
+				return ErrAlreadyOwned
+			}
+		}
+
+		if purchase.PaymentMethod == PaidWithCredits {
+			if _, err := s.credits.record(tx, purchase.UserID, CreditTypeAgentPurchase, -purchase.Credits, nil,
+				"Purchase of "+agent.Name, map[string]interface{}{"purchase_id": purchase.ID, "agent_id": agent.ID}, true); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		entitlement, err = s.grantEntitlement(tx, purchase, agent)
+		if err != nil {
+			return err
+		}
+		if err := s.earnings.recordSale(tx, purchase, agent); err != nil {
+			return err
+		}
+		if _, err := s.licenses.issueForPurchase(tx, purchase, entitlement); err != nil {
+			return err
+		}
+
+		return transitionPurchase(tx, purchase, PurchaseCompleted, map[string]interface{}{
+			"completed_at": time.Now(),
+			"expires_at":   entitlement.ExpiresAt,
+		})
+	})
+	if err != nil {
+		// The transaction was rolled back, so the purchase is still pending
+		purchase.Status = PurchasePending
+		return nil, err
+	}
+
+	s.db.Model(agent).Update("downloads", gorm.Expr("downloads + ?", 1))
+	s.sendReceipt(purchase, agent)
+	return entitlement, nil
+}
+
+// sendReceipt emails the buyer a receipt for a paid purchase
+func (s *PurchaseService) sendReceipt(purchase *models.Purchase, agent *models.Agent) {
+	if purchase.Amount == 0 && purchase.Credits == 0 {
+		return
+	}
+	var user models.User
+	if err := s.db.First(&user, "id = ?", purchase.UserID).Error; err != nil {
+		fmt.Printf("Error loading buyer of purchase %s: %v\n", purchase.ID, err)
+		return
+	}
+
+	completedAt := time.Now()
+	if purchase.CompletedAt != nil {
+		completedAt = *purchase.CompletedAt
+	}
+	if err := s.emails.SendAsync(&EmailRequest{
+		To:       user.Email,
+		UserID:   &user.ID,
+		Template: EmailTemplateReceipt,
+		Data: map[string]interface{}{
+			"Name":            displayName(&user),
+			"ReceiptNumber":   purchase.ID,
+			"Date":            completedAt.Format("January 2, 2006"),
+			"AgentName":       agent.Name,
+			"PricingModel":    purchase.PricingModel,
+			"Quantity":        purchase.Quantity,
+			"PaidWithCredits": purchase.PaymentMethod == PaidWithCredits,
+			"Credits":         purchase.Credits,
+			"Amount":          formatAmount(purchase.Amount),
+			"Currency":        purchase.Currency,
+			"PurchasesURL":    s.cfg.Email.AppURL + "/marketplace",
+		},
+	}); err != nil {
+		fmt.Printf("Error sending receipt for purchase %s: %v\n", purchase.ID, err)
+	}
+}
+
+// failPurchase marks a pending purchase as failed
+func (s *PurchaseService) failPurchase(purchase *models.Purchase, reason string) {
+	if purchase.Status != PurchasePending {
+		return
+	}
+	err := transitionPurchase(s.db, purchase, PurchaseFailed, map[string]interface{}{"failure_reason": reason})
+	if err != nil && err != errConcurrentUpdate {
+		fmt.Printf("Error marking purchase %s as failed: %v\n", purchase.ID, err)
+	}
+}
+
+// HandlePaymentSettled completes or fails the purchase a payment was made for
+func (s *PurchaseService) HandlePaymentSettled(payment *models.PaymentTransaction) {
+	if payment.PurchaseID == nil || payment.Type != PaymentTypePayment {
+		return
+	}
+
+	var purchase models.Purchase
+	if err := s.db.Preload("Agent").First(&purchase, "id = ?", *payment.PurchaseID).Error; err != nil || purchase.Agent == nil {
+		fmt.Printf("Payment %s settled for unknown purchase %s\n", payment.ID, *payment.PurchaseID)
+		return
+	}
+	if purchase.Status != PurchasePending {
+		return
+	}
+
+	switch payment.Status {
+	case PaymentCompleted:
+		_, err := s.completePurchase(&purchase, purchase.Agent)
+		if errors.Is(err, ErrAlreadyOwned) {
+			// Another purchase of the agent completed while this one was paid for
+			s.failPurchase(&purchase, err.Error())
+			if _, err := s.payments.Refund(payment.ID, payment.Amount, ErrAlreadyOwned.Error()); err != nil {
+				fmt.Printf("Error refunding duplicate purchase %s: %v\n", purchase.ID, err)
+			}
+		} else if err != nil && err != errConcurrentUpdate {
+			fmt.Printf("Error completing purchase %s: %v\n", purchase.ID, err)
+		}
+	case PaymentFailed, PaymentCancelled:
+		s.failPurchase(&purchase, payment.FailureReason)
+	}
+}
+
+// purchaseResult reloads a purchase into the response returned to the buyer
+func (s *PurchaseService) purchaseResult(purchase *models.Purchase, entitlement *models.Entitlement, paymentURL string) (*PurchaseResult, error) {
+	if err := s.db.First(purchase, "id = ?", purchase.ID).Error; err != nil {
+		return nil, err
+	}
+	result := &PurchaseResult{
+		PurchaseID: purchase.ID,
+		Status:     purchase.Status,
+		Purchase:   purchase,
+		License:    entitlement,
+	}
+	if purchase.Status == PurchaseCompleted {
+		result.OnPremLicense = s.licenses.licenseForPurchase(purchase.ID)
+	}
+	if paymentURL != "" && purchase.Status == PurchasePending {
+		result.PaymentURL = &paymentURL
+	}
+	return result, nil
+}
+
+// grantEntitlement creates the entitlement a completed purchase grants
+func (s *PurchaseService) grantEntitlement(tx *gorm.DB, purchase *models.Purchase, agent *models.Agent) (*models.Entitlement, error) {
+	entitlement := &models.Entitlement{
+		UserID:         purchase.UserID,
+		AgentID:        purchase.AgentID,
+		OrganizationID: purchase.OrganizationID,
+		PurchaseID:     purchase.ID,
+		Type:           purchase.PricingModel,
+		Status:         EntitlementActive,
+		StartsAt:       time.Now(),
+	}
+
+	switch purchase.PricingModel {
+	case PricingSubscription:
+		// A renewal starts when the current period ends
+		var current models.Entitlement
+		if err := tx.Where("user_id = ? AND agent_id = ? AND type = ? AND status = ? AND expires_at > ?",
+			purchase.UserID, purchase.AgentID, PricingSubscription, EntitlementActive, entitlement.StartsAt).
+			Order("expires_at DESC").First(&current).Error; err == nil {
+			entitlement.StartsAt = *current.ExpiresAt
+		}
+		expiresAt := subscriptionPeriodEnd(entitlement.StartsAt, agent)
+		entitlement.ExpiresAt = &expiresAt
+	case PricingUsageBased:
+		limit := int64(purchase.Quantity)
+		entitlement.UsageLimit = &limit
+	}
+
+	if err := tx.Create(entitlement).Error; err != nil {
+		return nil, err
+	}
+	return entitlement, nil
+}
+
+// subscriptionPeriodEnd returns when a subscription period starting at start ends
+func subscriptionPeriodEnd(start time.Time, agent *models.Agent) time.Time {
+	if ParseAgentRuntimeConfig(agent).BillingPeriod == "yearly" {
+		return start.AddDate(1, 0, 0)
+	}
+	return start.AddDate(0, 1, 0)
+}
+
+// RefundPurchase refunds a completed purchase and revokes its entitlement.
+// Usage-based purchases are refunded for their unused portion only.
+func (s *PurchaseService) RefundPurchase(purchaseID, userID string, req *RefundPurchaseRequest) (*models.Purchase, error) {
+	purchase, err := s.GetPurchase(purchaseID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if purchase.Status != PurchaseCompleted {
+		return nil, fmt.Errorf("a %s purchase cannot be refunded", purchase.Status)
+	}
+
+	window := time.Duration(s.cfg.Purchases.RefundWindowDays) * 24 * time.Hour
+	if purchase.CompletedAt != nil && time.Since(*purchase.CompletedAt) > window {
+		return nil, fmt.Errorf("purchases can only be refunded within %d days", s.cfg.Purchases.RefundWindowDays)
+	}
+
+	var entitlements []models.Entitlement
+	if err := s.db.Where("purchase_id = ?", purchase.ID).Find(&entitlements).Error; err != nil {
+		return nil, err
+	}
+
+	// Usage-based purchases are refunded for the uses left
+	var used, limit int64
+	for _, entitlement := range entitlements {
+		if entitlement.UsageLimit != nil && *entitlement.UsageLimit > 0 {
+			used, limit = entitlement.UsageCount, *entitlement.UsageLimit
+		}
+	}
+	if limit > 0 && used >= limit {
+		return nil, errors.New("purchase has been fully used and cannot be refunded")
+	}
+	refundCredits := purchase.Credits
+	refundAmount := purchase.Amount
+	if limit > 0 {
+		refundCredits = purchase.Credits * (limit - used) / limit
+		refundAmount = math.Floor(purchase.Amount*float64(limit-used)/float64(limit)*100) / 100
+	}
+
+	// Money is returned through the provider before the purchase is marked refunded
+	var refundPayment *models.PaymentTransaction
+	if purchase.PaymentMethod == PaidWithPaymentMethod {
+		var payment models.PaymentTransaction
+		if err := s.db.Where("purchase_id = ? AND type = ? AND status = ?", purchase.ID, PaymentTypePayment, PaymentCompleted).
+			First(&payment).Error; err != nil {
+			return nil, errors.New("payment for this purchase not found")
+		}
+		if refundAmount > 0 {
+			if refundPayment, err = s.payments.Refund(payment.ID, refundAmount, req.Reason); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	metadata := map[string]interface{}{"refund_reason": req.Reason}
+	if purchase.PaymentMethod == PaidWithCredits {
+		metadata["refund_credits"] = refundCredits
+	} else {
+		metadata["refund_amount"] = refundAmount
+		if refundPayment != nil {
+			metadata["refund_payment_id"] = refundPayment.ID
+		}
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := transitionPurchase(tx, purchase, PurchaseRefunded, map[string]interface{}{
+			"refunded_at": time.Now(),
+			"metadata":    models.MapToJSON(metadata),
+		}); err != nil {
+			return err
+		}
+
+		for i := range entitlements {
+			entitlement := &entitlements[i]
+			if !canTransition(entitlementTransitions, entitlement.Status, EntitlementRevoked) {
+				continue
+			}
+			if err := transitionEntitlement(tx, entitlement, EntitlementRevoked); err != nil {
+				return err
+			}
+		}
+		if err := s.licenses.revokeForPurchase(tx, purchase.ID, "purchase refunded"); err != nil {
+			return err
+		}
+
+		if purchase.Agent != nil {
+			if err := s.earnings.recordRefund(tx, purchase, purchase.Agent, refundAmount); err != nil {
+				return err
+			}
+		}
+
+		if purchase.PaymentMethod != PaidWithCredits || refundCredits <= 0 {
+			return nil
+		}
+		_, err := s.credits.record(tx, purchase.UserID, CreditTypeRefund, refundCredits, nil,
+			"Refund of purchase", map[string]interface{}{"purchase_id": purchase.ID, "reason": req.Reason}, false)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetPurchase(purchase.ID, userID)
+}
+
+// GetPurchase retrieves one of the user's purchases
+func (s *PurchaseService) GetPurchase(purchaseID, userID string) (*models.Purchase, error) {
+	var purchase models.Purchase
+	if err := s.db.Preload("Agent").First(&purchase, "id = ? AND user_id = ?", purchaseID, userID).Error; err != nil {
+		return nil, errors.New("purchase not found")
+	}
+	return &purchase, nil
+}
+
+// ListPurchases lists the user's purchases, newest first
+func (s *PurchaseService) ListPurchases(userID string, status string, page, limit int) ([]models.Purchase, int64, error) {
+	s.ExpireEntitlements()
+
+	var purchases []models.Purchase
+	var total int64
+
+	query := s.db.Model(&models.Purchase{}).Where("user_id = ?", userID)
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	offset := (page - 1) * limit
+	if err := query.Preload("Agent").Order("created_at DESC").Offset(offset).Limit(limit).Find(&purchases).Error; err != nil {
+		return nil, 0, err
+	}
+
+	return purchases, total, nil
+}
+
+// ListEntitlements lists the entitlements that apply to the user, including their organization's
+func (s *PurchaseService) ListEntitlements(userID string) ([]models.Entitlement, error) {
+	s.ExpireEntitlements()
+
+	var user models.User
+	if err := s.db.First(&user, "id = ?", userID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+
+	var entitlements []models.Entitlement
+	err := s.entitlementScope(&user).Order("created_at DESC").Find(&entitlements).Error
+	return entitlements, err
+}
+
+// CheckEntitlement verifies that the user may run the agent without using up an entitlement
+func (s *PurchaseService) CheckEntitlement(agent *models.Agent, userID string) error {
+	if !RequiresPurchase(agent) || agent.CreatorID == userID {
+		return nil
+	}
+
+	var user models.User
+	if err := s.db.First(&user, "id = ?", userID).Error; err != nil {
+		return errors.New("user not found")
+	}
+	_, err := s.findEntitlement(&user, agent.ID)
+	return err
+}
+
+// ConsumeEntitlement records one use of a paid agent, drawing on usage-based
+// entitlements first-to-expire. It returns the usage-based entitlement drawn
+// on, or "" when none was, and fails with ErrNotEntitled when no entitlement
+// covers the run.
+func (s *PurchaseService) ConsumeEntitlement(agent *models.Agent, userID string) (string, error) {
+	if !RequiresPurchase(agent) || agent.CreatorID == userID {
+		return "", nil
+	}
+
+	var user models.User
+	if err := s.db.First(&user, "id = ?", userID).Error; err != nil {
+		return "", errors.New("user not found")
+	}
+
+	s.ExpireEntitlements()
+
+	// Entitlements without an end date are used last on every database
+	var entitlements []models.Entitlement
+	if err := s.activeEntitlements(&user, agent.ID).Order("expires_at IS NULL, expires_at ASC").Find(&entitlements).Error; err != nil {
+		return "", err
+	}
+
+	for i := range entitlements {
+		entitlement := &entitlements[i]
+		if entitlement.UsageLimit == nil {
+			return "", nil
+		}
+
+		used := s.db.Model(&models.Entitlement{}).
+			Where("id = ? AND status = ? AND usage_count < usage_limit", entitlement.ID, EntitlementActive).
+			Update("usage_count", gorm.Expr("usage_count + ?", 1))
+		if used.Error != nil {
+			return "", used.Error
+		}
+		if used.RowsAffected == 0 {
+			continue
+		}
+
+		if entitlement.UsageCount+1 >= *entitlement.UsageLimit {
+			if err := transitionEntitlement(s.db, entitlement, EntitlementExhausted); err != nil && err != errConcurrentUpdate {
+				fmt.Printf("Error closing entitlement %s: %v\n", entitlement.ID, err)
+			}
+		}
+		return entitlement.ID, nil
+	}
+
+	return "", ErrNotEntitled
+}
+
+// RestoreEntitlement gives back a use taken by a run that did not complete,
+// reopening the entitlement if that use had exhausted it
+func (s *PurchaseService) RestoreEntitlement(entitlementID string) error {
+	restored := s.db.Model(&models.Entitlement{}).
+		Where("id = ? AND usage_count > 0", entitlementID).
+		Update("usage_count", gorm.Expr("usage_count - ?", 1))
+	if restored.Error != nil {
+		return restored.Error
+	}
+
+	var entitlement models.Entitlement
+	if err := s.db.First(&entitlement, "id = ?", entitlementID).Error; err != nil {
+		return err
+	}
+	if entitlement.Status != EntitlementExhausted || entitlement.UsageLimit == nil || entitlement.UsageCount >= *entitlement.UsageLimit {
+		return nil
+	}
+	if entitlement.ExpiresAt != nil && !entitlement.ExpiresAt.After(time.Now()) {
+		return nil
+	}
+	if err := transitionEntitlement(s.db, &entitlement, EntitlementActive); err != nil && err != errConcurrentUpdate {
+		return err
+	}
+	return nil
+}
+
+// ExpireEntitlements moves entitlements and subscription purchases past their end date to expired
+func (s *PurchaseService) ExpireEntitlements() {
+	var due []models.Entitlement
+	if err := s.db.Where("status = ? AND expires_at IS NOT NULL AND expires_at <= ?", EntitlementActive, time.Now()).
+		Find(&due).Error; err != nil {
+		fmt.Printf("Error finding expired entitlements: %v\n", err)
+		return
+	}
+
+	for i := range due {
+		entitlement := &due[i]
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			if err := transitionEntitlement(tx, entitlement, EntitlementExpired); err != nil {
+				return err
+			}
+
+			var purchase models.Purchase
+			if err := tx.First(&purchase, "id = ?", entitlement.PurchaseID).Error; err != nil {
+				return nil
+			}
+			if purchase.Status != PurchaseCompleted {
+				return nil
+			}
+			return transitionPurchase(tx, &purchase, PurchaseExpired, nil)
+		})
+		if err != nil && err != errConcurrentUpdate {
+			fmt.Printf("Error expiring entitlement %s: %v\n", entitlement.ID, err)
+		}
+	}
+}
+
+// findEntitlement returns an active entitlement of the user, or their organization, for the agent
+func (s *PurchaseService) findEntitlement(user *models.User, agentID string) (*models.Entitlement, error) {
+	var entitlement models.Entitlement
+	if err := s.activeEntitlements(user, agentID).
+		Where("usage_limit IS NULL OR usage_count < usage_limit").
+		First(&entitlement).Error; err != nil {
+		return nil, ErrNotEntitled
+	}
+	return &entitlement, nil
+}
+
+// activeEntitlements scopes a query to the entitlements currently in force for the user and agent
+func (s *PurchaseService) activeEntitlements(user *models.User, agentID string) *gorm.DB {
+	now := time.Now()
+	return s.entitlementScope(user).
+		Where("agent_id = ? AND status = ? AND starts_at <= ?", agentID, EntitlementActive, now).
+		Where("expires_at IS NULL OR expires_at > ?", now)
+}
+
+// entitlementScope scopes a query to entitlements held by the user or their organization
+func (s *PurchaseService) entitlementScope(user *models.User) *gorm.DB {
+	query := s.db.Model(&models.Entitlement{})
+	if user.OrganizationID != nil {
+		return query.Where("user_id = ? OR organization_id = ?", user.ID, *user.OrganizationID)
+	}
+	return query.Where("user_id = ?", user.ID)
+}
@@ -0,0 +1,291 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// purchaseTest is a buyer with credits and a creator selling an agent
+type purchaseTest struct {
+	purchases *PurchaseService
+	buyer     *models.User
+	agent     *models.Agent
+}
+
+// newPurchaseTest returns a marketplace with one public agent sold at 10 USD
+// under the pricing model, and a buyer holding 5000 credits
+func newPurchaseTest(t *testing.T, pricingModel string) *purchaseTest {
+	t.Helper()
+	t.Setenv("EMAIL_OUTBOX_DIR", t.TempDir())
+	t.Setenv("PAYMENT_PROVIDER", "fake")
+	t.Setenv("PAYMENT_WEBHOOK_SECRET", "whsec_test")
+
+	db := newTestDB(t, &models.User{}, &models.Organization{}, &models.Agent{}, &models.Purchase{},
+		&models.Entitlement{}, &models.CreditTransaction{}, &models.CreatorEarning{}, &models.License{},
+		&models.PaymentCustomer{}, &models.PaymentMethod{}, &models.PaymentTransaction{}, &models.PaymentEvent{},
+		&models.EmailLog{}, &models.Notification{})
+
+	creator := &models.User{Email: "maker@example.com", Username: "maker", PasswordHash: "x", IsActive: true}
+	buyer := &models.User{Email: "ann@example.com", Username: "ann", PasswordHash: "x", IsActive: true, Credits: 5000}
+	for _, u := range []*models.User{creator, buyer} {
+		if err := db.Create(u).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	agent := &models.Agent{Name: "Helper", Slug: "helper", CreatorID: creator.ID, IsPublic: true, IsEnabled: true,
+		PricingModel: pricingModel, Price: 10, Currency: "USD"}
+	if err := db.Create(agent).Error; err != nil {
+		t.Fatal(err)
+	}
+	waitForEmails(t, db)
+	return &purchaseTest{purchases: NewPurchaseService(db, config.Load()), buyer: buyer, agent: agent}
+}
+
+// buy purchases the agent for the buyer with credits, or a payment method when one is given
+func (pt *purchaseTest) buy(paymentMethodID string, quantity int) (*PurchaseResult, error) {
+	return pt.purchases.PurchaseAgent(pt.agent.ID, pt.buyer.ID, &PurchaseRequest{
+		PricingTier:     "standard",
+		PaymentMethodID: paymentMethodID,
+		Quantity:        quantity,
+	})
+}
+
+// count returns how many rows of the model match the condition
+func (pt *purchaseTest) count(t *testing.T, model interface{}, query string, args ...interface{}) int64 {
+	t.Helper()
+	var n int64
+	if err := pt.purchases.db.Model(model).Where(query, args...).Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestPurchaseAgentWithCredits(t *testing.T) {
+	tests := []struct {
+		pricingModel string
+		quantity     int
+		credits      int64
+		usageLimit   int64
+		expires      bool
+	}{
+		{pricingModel: PricingOneTime, credits: 1000},
+		{pricingModel: PricingSubscription, credits: 1000, expires: true},
+		{pricingModel: PricingUsageBased, quantity: 3, credits: 3000, usageLimit: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pricingModel, func(t *testing.T) {
+			pt := newPurchaseTest(t, tt.pricingModel)
+			result, err := pt.buy("", tt.quantity)
+			if err != nil {
+				t.Fatalf("PurchaseAgent() error = %v", err)
+			}
+			if result.Status != PurchaseCompleted || result.Purchase.Credits != tt.credits {
+				t.Errorf("purchase = %s for %d credits, want completed for %d", result.Status, result.Purchase.Credits, tt.credits)
+			}
+
+			entitlement := result.License
+			if entitlement == nil || entitlement.Type != tt.pricingModel || entitlement.Status != EntitlementActive {
+				t.Fatalf("entitlement = %+v, want an active %s one", entitlement, tt.pricingModel)
+			}
+			if (entitlement.ExpiresAt != nil) != tt.expires {
+				t.Errorf("entitlement expires at %v, want an expiry %v", entitlement.ExpiresAt, tt.expires)
+			}
+			if tt.usageLimit > 0 && (entitlement.UsageLimit == nil || *entitlement.UsageLimit != tt.usageLimit) {
+				t.Errorf("usage limit = %v, want %d", entitlement.UsageLimit, tt.usageLimit)
+			}
+			checkBalance(t, pt.purchases.credits, pt.buyer.ID, 5000-tt.credits, 0, 0)
+			if err := pt.purchases.CheckEntitlement(pt.agent, pt.buyer.ID); err != nil {
+				t.Errorf("CheckEntitlement() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestPurchaseAgentRefused(t *testing.T) {
+	pt := newPurchaseTest(t, PricingOneTime)
+	if _, err := pt.purchases.PurchaseAgent(pt.agent.ID, pt.agent.CreatorID, &PurchaseRequest{PricingTier: "standard"}); err == nil {
+		t.Error("PurchaseAgent() of one's own agent error = nil, want an error")
+	}
+
+	// A buyer without enough credits is not charged or entitled
+	pt.purchases.db.Model(pt.buyer).Update("credits", 999)
+	if _, err := pt.buy("", 0); !errors.Is(err, ErrInsufficientCredits) {
+		t.Errorf("PurchaseAgent() error = %v, want ErrInsufficientCredits", err)
+	}
+	checkBalance(t, pt.purchases.credits, pt.buyer.ID, 999, 0, 0)
+	if err := pt.purchases.CheckEntitlement(pt.agent, pt.buyer.ID); !errors.Is(err, ErrNotEntitled) {
+		t.Errorf("CheckEntitlement() error = %v, want ErrNotEntitled", err)
+	}
+	if n := pt.count(t, &models.Purchase{}, "status = ?", PurchaseFailed); n != 1 {
+		t.Errorf("%d failed purchases, want 1", n)
+	}
+}
+
+func TestPurchaseOneTimeOnce(t *testing.T) {
+	pt := newPurchaseTest(t, PricingOneTime)
+	if _, err := pt.buy("", 0); err != nil {
+		t.Fatalf("PurchaseAgent() error = %v", err)
+	}
+	if _, err := pt.buy("", 0); !errors.Is(err, ErrAlreadyOwned) {
+		t.Errorf("second PurchaseAgent() error = %v, want ErrAlreadyOwned", err)
+	}
+	checkBalance(t, pt.purchases.credits, pt.buyer.ID, 4000, 0, 0)
+
+	// Once refunded, the agent may be bought again
+	var purchase models.Purchase
+	pt.purchases.db.First(&purchase, "status = ?", PurchaseCompleted)
+	if _, err := pt.purchases.RefundPurchase(purchase.ID, pt.buyer.ID, &RefundPurchaseRequest{Reason: "test"}); err != nil {
+		t.Fatalf("RefundPurchase() error = %v", err)
+	}
+	if _, err := pt.buy("", 0); err != nil {
+		t.Errorf("PurchaseAgent() after a refund error = %v", err)
+	}
+}
+
+func TestPurchaseOneTimeConcurrently(t *testing.T) {
+	pt := newPurchaseTest(t, PricingOneTime)
+
+	// Purchases that all passed the ownership check complete only once
+	pending := make([]*models.Purchase, 4)
+	for i := range pending {
+		pending[i] = &models.Purchase{UserID: pt.buyer.ID, AgentID: pt.agent.ID, PricingModel: PricingOneTime,
+			Amount: 10, Credits: 1000, PaymentMethod: PaidWithCredits, Status: PurchasePending}
+		if err := pt.purchases.db.Create(pending[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, len(pending))
+	for _, purchase := range pending {
+		wg.Add(1)
+		go func(purchase *models.Purchase) {
+			defer wg.Done()
+			_, err := pt.purchases.completePurchase(purchase, pt.agent)
+			errs <- err
+		}(purchase)
+	}
+	wg.Wait()
+	close(errs)
+
+	completed := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			completed++
+		case !errors.Is(err, ErrAlreadyOwned):
+			t.Errorf("completePurchase() error = %v, want ErrAlreadyOwned", err)
+		}
+	}
+	if completed != 1 {
+		t.Errorf("%d purchases completed, want 1", completed)
+	}
+	checkBalance(t, pt.purchases.credits, pt.buyer.ID, 4000, 0, 0)
+	if n := pt.count(t, &models.Entitlement{}, "user_id = ?", pt.buyer.ID); n != 1 {
+		t.Errorf("%d entitlements granted, want 1", n)
+	}
+
+	// The database refuses a second completed one-time purchase too
+	duplicate := &models.Purchase{UserID: pt.buyer.ID, AgentID: pt.agent.ID, PricingModel: PricingOneTime, Status: PurchaseCompleted}
+	if err := pt.purchases.db.Create(duplicate).Error; err == nil {
+		t.Error("a second completed one-time purchase was recorded")
+	}
+}
+
+func TestPurchaseOneTimePaidTwice(t *testing.T) {
+	pt := newPurchaseTest(t, PricingOneTime)
+	method := addMethod(t, pt.purchases.payments, pt.buyer.ID, FakeTokenPending)
+
+	// Two card purchases await authorization at once
+	var results []*PurchaseResult
+	for i := 0; i < 2; i++ {
+		result, err := pt.buy(method.ID, 0)
+		if err != nil || result.Status != PurchasePending {
+			t.Fatalf("PurchaseAgent() = %v, %v, want a pending purchase", result, err)
+		}
+		results = append(results, result)
+	}
+
+	// The second payment to complete is refunded and its purchase failed
+	for i, result := range results {
+		var payment models.PaymentTransaction
+		pt.purchases.db.First(&payment, "purchase_id = ?", result.PurchaseID)
+		event := fakeWebhookEvent{ID: fmt.Sprintf("evt_%d", i), Type: ProviderEventChargeSucceeded, ChargeID: payment.ProviderChargeID}
+		payload, header := fakeWebhook(t, "whsec_test", event)
+		if err := pt.purchases.payments.HandleWebhook(payload, header); err != nil {
+			t.Fatalf("HandleWebhook() error = %v", err)
+		}
+	}
+
+	var first, second models.Purchase
+	pt.purchases.db.First(&first, "id = ?", results[0].PurchaseID)
+	pt.purchases.db.First(&second, "id = ?", results[1].PurchaseID)
+	if first.Status != PurchaseCompleted || second.Status != PurchaseFailed {
+		t.Errorf("purchases = %s, %s, want completed, failed", first.Status, second.Status)
+	}
+	if n := pt.count(t, &models.PaymentTransaction{}, "type = ? AND refund_of_id IS NOT NULL", PaymentTypeRefund); n != 1 {
+		t.Errorf("%d refunds, want 1 for the second payment", n)
+	}
+}
+
+func TestConsumeEntitlement(t *testing.T) {
+	pt := newPurchaseTest(t, PricingUsageBased)
+	result, err := pt.buy("", 2)
+	if err != nil {
+		t.Fatalf("PurchaseAgent() error = %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if id, err := pt.purchases.ConsumeEntitlement(pt.agent, pt.buyer.ID); err != nil || id != result.License.ID {
+			t.Fatalf("ConsumeEntitlement() = %q, %v, want the purchased entitlement", id, err)
+		}
+	}
+	if _, err := pt.purchases.ConsumeEntitlement(pt.agent, pt.buyer.ID); !errors.Is(err, ErrNotEntitled) {
+		t.Errorf("ConsumeEntitlement() past the limit error = %v, want ErrNotEntitled", err)
+	}
+
+	// A use given back reopens the exhausted entitlement
+	if err := pt.purchases.RestoreEntitlement(result.License.ID); err != nil {
+		t.Fatalf("RestoreEntitlement() error = %v", err)
+	}
+	if _, err := pt.purchases.ConsumeEntitlement(pt.agent, pt.buyer.ID); err != nil {
+		t.Errorf("ConsumeEntitlement() after a restore error = %v", err)
+	}
+
+	// The creator runs their own agent freely
+	if id, err := pt.purchases.ConsumeEntitlement(pt.agent, pt.agent.CreatorID); id != "" || err != nil {
+		t.Errorf("ConsumeEntitlement() by the creator = %q, %v, want no entitlement used", id, err)
+	}
+}
+
+func TestRefundUsageBasedPurchase(t *testing.T) {
+	pt := newPurchaseTest(t, PricingUsageBased)
+	result, err := pt.buy("", 4)
+	if err != nil {
+		t.Fatalf("PurchaseAgent() error = %v", err)
+	}
+	if _, err := pt.purchases.ConsumeEntitlement(pt.agent, pt.buyer.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the three unused uses are refunded
+	refunded, err := pt.purchases.RefundPurchase(result.PurchaseID, pt.buyer.ID, &RefundPurchaseRequest{Reason: "test"})
+	if err != nil {
+		t.Fatalf("RefundPurchase() error = %v", err)
+	}
+	if refunded.Status != PurchaseRefunded {
+		t.Errorf("purchase = %s, want refunded", refunded.Status)
+	}
+	checkBalance(t, pt.purchases.credits, pt.buyer.ID, 5000-1000, 0, 0)
+	if err := pt.purchases.CheckEntitlement(pt.agent, pt.buyer.ID); !errors.Is(err, ErrNotEntitled) {
+		t.Errorf("CheckEntitlement() after the refund error = %v, want ErrNotEntitled", err)
+	}
+	if _, err := pt.purchases.RefundPurchase(result.PurchaseID, pt.buyer.ID, &RefundPurchaseRequest{}); err == nil {
+		t.Error("second RefundPurchase() error = nil, want an error")
+	}
+}
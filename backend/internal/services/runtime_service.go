@@ -2,10 +2,12 @@ package services
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"time"
 
+	"github.com/google/uuid"
 	"gorm.io/gorm"
 
 	"github.com/mlaitechio/vagais/internal/config"
@@ -15,15 +17,66 @@ import (
 // RuntimeService handles agent execution and runtime management
 type RuntimeService struct {
 	BaseService
+	executor      AgentExecutor
+	scripts       AgentExecutor
+	conversations *ConversationService
+	credits       *CreditService
+	purchases     *PurchaseService
+	plans         *PlanService
+	earnings      *EarningsService
+	events        *ExecutionEventBus
+	queue         JobQueue
 }
 
 // NewRuntimeService creates a new runtime service
 func NewRuntimeService(db *gorm.DB, cfg *config.Config) *RuntimeService {
 	return &RuntimeService{
-		BaseService: NewBaseService(db, cfg, "runtime"),
+		BaseService:   NewBaseService(db, cfg, "runtime"),
+		executor:      NewLLMExecutor(db, cfg),
+		scripts:       NewScriptExecutor(cfg),
+		conversations: NewConversationService(db, cfg),
+		credits:       NewCreditService(db, cfg),
+		purchases:     NewPurchaseService(db, cfg),
+		plans:         NewPlanService(db, cfg),
+		earnings:      NewEarningsService(db, cfg),
+		events:        NewExecutionEventBus(nil),
+		queue:         NewDBJobQueue(db),
 	}
 }
 
+// SetExecutor replaces the executor used to run agents
+func (s *RuntimeService) SetExecutor(executor AgentExecutor) {
+	s.executor = executor
+}
+
+// SetScriptExecutor replaces the executor used to run script-based agents
+func (s *RuntimeService) SetScriptExecutor(executor AgentExecutor) {
+	s.scripts = executor
+}
+
+// executorFor returns the executor that runs the agent
+func (s *RuntimeService) executorFor(agent *models.Agent) AgentExecutor {
+	if IsScriptAgent(agent) {
+		return s.scripts
+	}
+	return s.executor
+}
+
+// SetEventBus replaces the bus execution progress is published on
+func (s *RuntimeService) SetEventBus(events *ExecutionEventBus) {
+	s.events = events
+}
+
+// SetQueue replaces the queue executions are scheduled on
+func (s *RuntimeService) SetQueue(queue JobQueue) {
+	s.queue = queue
+}
+
+// Queue returns the queue executions are scheduled on
+func (s *RuntimeService) Queue() JobQueue {
+	return s.queue
+}
+
 // ExecuteAgentRequest represents agent execution request
 type ExecuteAgentRequest struct {
 	AgentID   string                 `json:"agent_id" binding:"required"`
@@ -37,60 +90,664 @@ func (s *RuntimeService) ExecuteAgent(req *ExecuteAgentRequest, userID string, o
 	if err := s.db.First(&agent, "id = ?", req.AgentID).Error; err != nil {
 		return nil, errors.New("agent not found")
 	}
-	if !agent.IsEnabled {
-		return nil, errors.New("agent is not enabled")
+	if err := s.checkAgentAccess(&agent, userID); err != nil {
+		return nil, err
 	}
-	if !agent.IsPublic && agent.CreatorID != userID {
-		return nil, errors.New("unauthorized to execute this agent")
+	if err := s.purchases.CheckEntitlement(&agent, userID); err != nil {
+		return nil, err
+	}
+	if err := s.plans.CheckExecutionQuota(userID, orgID); err != nil {
+		return nil, err
+	}
+	if _, err := buildInputMessages(req.Input); err != nil {
+		return nil, err
 	}
+
+	// A session ID continues an existing conversation with the agent
+	if req.SessionID != "" {
+		if _, err := s.conversations.ResumeConversation(req.SessionID, userID, req.AgentID); err != nil {
+			return nil, errors.New("session not found")
+		}
+	}
+
 	execution := &models.Execution{
+		BaseModel:      models.BaseModel{ID: uuid.New().String()},
 		AgentID:        req.AgentID,
 		UserID:         userID,
 		OrganizationID: orgID,
-		Status:         "running",
+		Status:         "queued",
 		Input:          models.MapToJSON(req.Input),
 		Output:         models.MapToJSON(map[string]interface{}{}),
 		SessionID:      req.SessionID,
 	}
-	if err := s.db.Create(execution).Error; err != nil {
+
+	// The plan's included credits are granted on the first run of each month
+	if err := s.plans.AllocateIncludedCredits(userID, orgID); err != nil {
+		fmt.Printf("Failed to allocate plan credits for user %s: %v\n", userID, err)
+	}
+
+	// Hold enough credits for the run; the reservation is settled when it ends
+	if err := s.startExecution(execution, &agent, s.credits.EstimateExecutionCredits(&agent, req.Input)); err != nil {
 		return nil, err
 	}
-	go s.executeAgentAsync(execution, &agent)
+
+	job := &models.ExecutionJob{
+		ExecutionID:    execution.ID,
+		AgentID:        execution.AgentID,
+		OrganizationID: orgID,
+		MaxAttempts:    s.cfg.Queue.MaxAttempts,
+	}
+	if err := s.queue.Enqueue(context.Background(), job); err != nil {
+		s.db.Model(execution).Updates(map[string]interface{}{"status": "failed", "error": "failed to queue execution"})
+		s.releaseCredits(execution, "failed to queue execution")
+		return nil, fmt.Errorf("failed to queue execution: %v", err)
+	}
+
+	NewExecutionReporter(s.events, execution.ID).Status(execution.Status, "Execution queued")
 	return execution, nil
 }
 
-// executeAgentAsync executes the agent asynchronously
-func (s *RuntimeService) executeAgentAsync(execution *models.Execution, agent *models.Agent) {
+// StreamChat runs a chat turn against the agent, streaming partial tokens to
+// onDelta. The turn is recorded as an execution of the conversation and
+// charged like one, including the usage of a reply that fails or is stopped.
+func (s *RuntimeService) StreamChat(ctx context.Context, agent *models.Agent, userID string, orgID *string, conversationID string, messages []ChatMessage, onDelta StreamHandler) (*ChatCompletionResponse, error) {
+	streamer, estimate, err := s.admitChat(agent, userID, orgID, messages)
+	if err != nil {
+		return nil, err
+	}
+
+	var prompt string
+	if len(messages) > 0 {
+		prompt = messages[len(messages)-1].Content
+	}
+	execution := &models.Execution{
+		BaseModel:      models.BaseModel{ID: uuid.New().String()},
+		AgentID:        agent.ID,
+		UserID:         userID,
+		OrganizationID: orgID,
+		Status:         "running",
+		Input:          models.MapToJSON(map[string]interface{}{"message": prompt}),
+		Output:         models.MapToJSON(map[string]interface{}{}),
+		SessionID:      conversationID,
+	}
+
+	if err := s.startExecution(execution, agent, estimate); err != nil {
+		return nil, err
+	}
+
+	timeout := s.executionTimeout(agent)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	reporter := NewExecutionReporter(s.events, execution.ID)
 	startTime := time.Now()
+	response, err := streamer.Stream(ctx, agent, messages, onDelta)
+	execution.Duration = int64(time.Since(startTime).Milliseconds())
+	if err != nil {
+		switch {
+		case errors.Is(ctx.Err(), context.Canceled):
+			err = ErrExecutionCancelled
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			err = fmt.Errorf("%w after %s", ErrExecutionTimedOut, timeout)
+		}
+	}
+
+	// The conversation records the turn itself, so no prompt is passed on
+	result := chatResult(agent, messages, response)
+	if !s.finishExecution(execution, agent, reporter, result, "", err) {
+		s.settleCancelled(execution, agent, result)
+	}
+	return response, err
+}
+
+// CheckChat returns the error StreamChat would refuse a turn with before it
+// starts: no access to the agent, no entitlement, a plan quota reached or too
+// few credits. Callers use it to refuse a turn before recording anything.
+func (s *RuntimeService) CheckChat(agent *models.Agent, userID string, orgID *string, messages []ChatMessage) error {
+	_, _, err := s.admitChat(agent, userID, orgID, messages)
+	return err
+}
+
+// admitChat checks that the user may start a chat turn and returns the
+// agent's streamer and the credits to reserve for the turn
+func (s *RuntimeService) admitChat(agent *models.Agent, userID string, orgID *string, messages []ChatMessage) (AgentStreamer, int64, error) {
+	if err := s.checkAgentAccess(agent, userID); err != nil {
+		return nil, 0, err
+	}
 
-	// TODO: Implement actual agent execution logic
-	// This is a placeholder for the actual execution
-	time.Sleep(2 * time.Second) // Simulate processing time
+	streamer, ok := s.executorFor(agent).(AgentStreamer)
+	if !ok {
+		return nil, 0, errors.New("agent runtime does not support streaming")
+	}
+	if err := s.purchases.CheckEntitlement(agent, userID); err != nil {
+		return nil, 0, err
+	}
+	if err := s.plans.CheckExecutionQuota(userID, orgID); err != nil {
+		return nil, 0, err
+	}
+
+	if err := s.plans.AllocateIncludedCredits(userID, orgID); err != nil {
+		fmt.Printf("Failed to allocate plan credits for user %s: %v\n", userID, err)
+	}
+	estimate := s.credits.EstimateExecutionCredits(agent, map[string]interface{}{"messages": chatMessagesToInput(messages)})
+	if err := s.credits.CheckFunds(userID, estimate); err != nil {
+		return nil, 0, err
+	}
+	return streamer, estimate, nil
+}
 
-	// Update execution with result
-	output := map[string]interface{}{
-		"result":    fmt.Sprintf("Agent '%s' executed successfully", agent.Name),
-		"data":      execution.Input,
-		"timestamp": time.Now().Unix(),
+// startExecution reserves the estimated credits for an execution, takes the
+// entitlement use a paid agent needs, and saves the execution. Nothing is held
+// when a step fails.
+func (s *RuntimeService) startExecution(execution *models.Execution, agent *models.Agent, estimate int64) error {
+	if err := s.credits.Reserve(execution.UserID, execution.ID, estimate); err != nil {
+		return err
+	}
+	// Paid agents use up an entitlement only once the run is funded
+	entitlementID, err := s.purchases.ConsumeEntitlement(agent, execution.UserID)
+	if err != nil {
+		s.releaseCredits(execution, "agent has not been purchased")
+		return err
+	}
+	if entitlementID != "" {
+		execution.EntitlementID = &entitlementID
 	}
+	if err := s.db.Create(execution).Error; err != nil {
+		s.releaseCredits(execution, "execution could not be created")
+		if entitlementID != "" {
+			if err := s.purchases.RestoreEntitlement(entitlementID); err != nil {
+				fmt.Printf("Error restoring entitlement %s: %v\n", entitlementID, err)
+			}
+		}
+		return err
+	}
+	return nil
+}
 
-	execution.Status = "completed"
-	execution.Output = models.MapToJSON(output)
+// chatResult converts a streamed reply into an execution result. Providers
+// that do not report usage on a stream have it estimated from the text.
+func chatResult(agent *models.Agent, messages []ChatMessage, response *ChatCompletionResponse) *ExecutionResult {
+	if response == nil {
+		return nil
+	}
+
+	usage := response.Usage
+	if usage.Total() == 0 && response.Content != "" {
+		usage.PromptTokens = int64(estimateTokens(ParseAgentRuntimeConfig(agent).SystemPrompt))
+		for _, m := range messages {
+			usage.PromptTokens += int64(estimateTokens(m.Content))
+		}
+		usage.OutputTokens = int64(estimateTokens(response.Content))
+	}
+
+	model := response.Model
+	if model == "" {
+		model = agent.LLMModel
+	}
+	return &ExecutionResult{
+		Output: map[string]interface{}{
+			"result":        response.Content,
+			"model":         model,
+			"finish_reason": response.FinishReason,
+		},
+		Model:        model,
+		PromptTokens: usage.PromptTokens,
+		OutputTokens: usage.OutputTokens,
+		TotalTokens:  usage.Total(),
+	}
+}
+
+// executionTimeout returns how long a run of the agent may take, or 0 for no limit
+func (s *RuntimeService) executionTimeout(agent *models.Agent) time.Duration {
+	if timeout := ParseAgentRuntimeConfig(agent).ExecutionTimeout(); timeout > 0 {
+		return timeout
+	}
+	return time.Duration(s.cfg.Queue.ExecutionTimeoutSeconds) * time.Second
+}
+
+// checkAgentAccess verifies that the user may run the agent
+func (s *RuntimeService) checkAgentAccess(agent *models.Agent, userID string) error {
+	if !agent.IsEnabled {
+		return errors.New("agent is not enabled")
+	}
+	if !agent.IsPublic && agent.CreatorID != userID {
+		return errors.New("unauthorized to execute this agent")
+	}
+	return checkEmailVerified(s.db, userID)
+}
+
+// Errors recorded as the cause when an execution's context is cancelled
+var (
+	ErrExecutionCancelled = errors.New("execution cancelled by user")
+	ErrExecutionTimedOut  = errors.New("execution timed out")
+	ErrServerShutdown     = errors.New("server is shutting down")
+)
+
+// JobResult tells the worker what to do with a job after an attempt
+type JobResult int
+
+const (
+	// JobCompleted means the execution finished successfully
+	JobCompleted JobResult = iota
+	// JobFailed means the execution failed for good
+	JobFailed
+	// JobCancelled means the execution was cancelled before or while running
+	JobCancelled
+	// JobRetry means the attempt hit a transient error and should be retried later
+	JobRetry
+	// JobRelease means the attempt was interrupted and should run again without counting
+	JobRelease
+)
+
+// RunExecutionJob runs the execution behind a claimed job. The run is aborted
+// when ctx is cancelled, when the user cancels the execution, or when the
+// agent's timeout elapses.
+func (s *RuntimeService) RunExecutionJob(ctx context.Context, job *models.ExecutionJob) (JobResult, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	// Watch for cancellation before looking at the row so none is missed;
+	// cancellations from other instances arrive through the event bus
+	events, unsubscribe := s.events.Subscribe(job.ExecutionID)
+	defer unsubscribe()
+	go func() {
+		for event := range events {
+			if event.Type == ExecutionEventStatus && event.Status == "cancelled" {
+				cancel(ErrExecutionCancelled)
+				return
+			}
+		}
+	}()
+
+	var execution models.Execution
+	if err := s.db.First(&execution, "id = ?", job.ExecutionID).Error; err != nil {
+		return JobFailed, fmt.Errorf("execution not found: %v", err)
+	}
+
+	reporter := NewExecutionReporter(s.events, execution.ID)
+
+	var agent models.Agent
+	if err := s.db.First(&agent, "id = ?", execution.AgentID).Error; err != nil {
+		s.finishExecution(&execution, &agent, reporter, nil, "", errors.New("agent not found"))
+		return JobFailed, err
+	}
+
+	// Executions cancelled while queued are not run
+	claimed := s.db.Model(&models.Execution{}).
+		Where("id = ? AND status IN ?", execution.ID, []string{"queued", "running"}).
+		Update("status", "running")
+	if claimed.Error != nil {
+		return JobRelease, claimed.Error
+	}
+	if claimed.RowsAffected == 0 {
+		// A run cancelled while a worker held it is settled here if that worker died
+		if execution.Status == "cancelled" {
+			s.settleCancelled(&execution, &agent, earlierUsage(nil, &execution))
+		}
+		return JobCancelled, nil
+	}
+	execution.Status = "running"
+
+	// Steps of an earlier attempt are replaced by the ones this run records
+	if err := s.db.Where("execution_id = ?", execution.ID).Delete(&models.ExecutionStep{}).Error; err != nil {
+		fmt.Printf("Error clearing steps of execution %s: %v\n", execution.ID, err)
+	}
+	reporter.Status("running", fmt.Sprintf("Attempt %d of %d", job.Attempts, job.MaxAttempts))
+
+	timeout := s.executionTimeout(&agent)
+	if timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeoutCause(ctx, timeout, ErrExecutionTimedOut)
+		defer cancelTimeout()
+	}
+
+	startTime := time.Now()
+
+	var input map[string]interface{}
+	if err := json.Unmarshal(execution.Input, &input); err != nil {
+		input = make(map[string]interface{})
+	}
+
+	// Send earlier turns of the session along as context
+	var prompt string
+	if execution.SessionID != "" {
+		if messages, _ := buildInputMessages(input); len(messages) > 0 {
+			prompt = messages[len(messages)-1].Content
+			history, err := s.conversations.GetHistory(execution.SessionID)
+			if err != nil {
+				fmt.Printf("Error loading session history: %v\n", err)
+			}
+			input["messages"] = chatMessagesToInput(s.conversations.BuildContext(&agent, history, prompt))
+		}
+	}
+
+	result, err := s.executorFor(&agent).Execute(WithExecutionReporter(ctx, reporter), &agent, input)
 	execution.Duration = int64(time.Since(startTime).Milliseconds())
+	result = earlierUsage(result, &execution)
+
+	// An aborted run reports why its context ended rather than the transport error
+	if ctx.Err() != nil {
+		switch cause := context.Cause(ctx); {
+		case errors.Is(cause, ErrExecutionCancelled):
+			s.settleCancelled(&execution, &agent, result)
+			return JobCancelled, nil
+		case errors.Is(cause, ErrServerShutdown):
+			s.requeueExecution(&execution, reporter, "Interrupted by server shutdown, will resume", result)
+			return JobRelease, cause
+		case errors.Is(cause, ErrJobLeaseLost):
+			// The worker now holding the job runs the execution and records it
+			return JobRelease, cause
+		case errors.Is(cause, ErrExecutionTimedOut):
+			err = fmt.Errorf("%w after %s", ErrExecutionTimedOut, timeout)
+		}
+	}
+
+	if err != nil && IsTransientLLMError(err) && job.Attempts < job.MaxAttempts {
+		reporter.Log("Attempt %d failed: %v", job.Attempts, err)
+		s.requeueExecution(&execution, reporter, "Retrying after a transient provider error", result)
+		return JobRetry, err
+	}
 
-	if err := s.db.Save(execution).Error; err != nil {
+	// A cancel that lands after the run returned still settles its usage
+	if !s.finishExecution(&execution, &agent, reporter, result, prompt, err) {
+		s.settleCancelled(&execution, &agent, result)
+		return JobCancelled, nil
+	}
+	if err != nil {
+		return JobFailed, err
+	}
+	return JobCompleted, nil
+}
+
+// earlierUsage adds the tokens used by earlier attempts of the execution to
+// the result of this one, so that they are charged when it ends
+func earlierUsage(result *ExecutionResult, execution *models.Execution) *ExecutionResult {
+	if execution.PromptTokens == 0 && execution.OutputTokens == 0 {
+		return result
+	}
+	if result == nil {
+		result = &ExecutionResult{Model: execution.Model}
+	}
+	result.PromptTokens += execution.PromptTokens
+	result.OutputTokens += execution.OutputTokens
+	result.TotalTokens = result.PromptTokens + result.OutputTokens
+	return result
+}
+
+// requeueExecution puts a running execution back in the queued state, keeping
+// the usage of the interrupted attempt to be charged with the next one
+func (s *RuntimeService) requeueExecution(execution *models.Execution, reporter *ExecutionReporter, message string, usage *ExecutionResult) {
+	updates := map[string]interface{}{"status": "queued"}
+	if usage != nil {
+		updates["model"] = usage.Model
+		updates["prompt_tokens"] = usage.PromptTokens
+		updates["output_tokens"] = usage.OutputTokens
+		updates["total_tokens"] = usage.TotalTokens
+	}
+	result := s.db.Model(&models.Execution{}).
+		Where("id = ? AND status = ?", execution.ID, "running").
+		Updates(updates)
+	if result.Error == nil && result.RowsAffected > 0 {
+		execution.Status = "queued"
+		reporter.Status("queued", message)
+	}
+}
+
+// finishExecution records the final outcome of an execution. It returns false
+// without changing anything if the execution was cancelled in the meantime.
+func (s *RuntimeService) finishExecution(execution *models.Execution, agent *models.Agent, reporter *ExecutionReporter, result *ExecutionResult, prompt string, err error) bool {
+	updates := map[string]interface{}{
+		"duration": execution.Duration,
+	}
+	if err != nil {
+		execution.Status = "failed"
+		if errors.Is(err, ErrExecutionCancelled) {
+			execution.Status = "cancelled"
+		}
+		execution.Error = err.Error()
+
+		// Tokens used before the failure are still charged
+		if result != nil {
+			execution.Model = result.Model
+			execution.PromptTokens = result.PromptTokens
+			execution.OutputTokens = result.OutputTokens
+			execution.TotalTokens = result.TotalTokens
+			execution.Cost, execution.CreditsUsed = s.credits.UsageCharge(agent, result)
+
+			updates["model"] = execution.Model
+			updates["prompt_tokens"] = execution.PromptTokens
+			updates["output_tokens"] = execution.OutputTokens
+			updates["total_tokens"] = execution.TotalTokens
+			updates["cost"] = execution.Cost
+			updates["credits_used"] = execution.CreditsUsed
+		}
+	} else {
+		execution.Status = "completed"
+		execution.Error = ""
+		execution.Output = models.MapToJSON(result.Output)
+		execution.Model = result.Model
+		execution.PromptTokens = result.PromptTokens
+		execution.OutputTokens = result.OutputTokens
+		execution.TotalTokens = result.TotalTokens
+		execution.Cost, execution.CreditsUsed = s.credits.ExecutionCharge(agent, result)
+
+		updates["output"] = execution.Output
+		updates["model"] = execution.Model
+		updates["prompt_tokens"] = execution.PromptTokens
+		updates["output_tokens"] = execution.OutputTokens
+		updates["total_tokens"] = execution.TotalTokens
+		updates["cost"] = execution.Cost
+		updates["credits_used"] = execution.CreditsUsed
+	}
+	updates["status"] = execution.Status
+	updates["error"] = execution.Error
+
+	// Only a queued or running execution may be finished, so a cancel always wins
+	saved := s.db.Model(&models.Execution{}).
+		Where("id = ? AND status IN ?", execution.ID, []string{"queued", "running"}).
+		Updates(updates)
+	if saved.Error != nil {
 		// Log error but don't fail the execution
-		fmt.Printf("Error saving execution: %v\n", err)
+		fmt.Printf("Error saving execution: %v\n", saved.Error)
+	} else if saved.RowsAffected == 0 {
+		return false
 	}
 
+	switch {
+	case execution.Status == "completed":
+		// The creator earns only from credits the run was actually charged
+		if settlement := s.settleCredits(execution); settlement != nil {
+			paid, err := s.credits.PaidCredits(settlement, execution.CreditsUsed)
+			if err == nil {
+				err = s.earnings.RecordUsage(execution, agent, paid)
+			}
+			if err != nil {
+				fmt.Printf("Error recording creator earnings for execution %s: %v\n", execution.ID, err)
+			}
+		}
+	case execution.CreditsUsed > 0:
+		s.settleCredits(execution)
+		s.restoreEntitlement(execution)
+	default:
+		s.releaseCredits(execution, execution.Error)
+	}
+
+	if execution.Status == "completed" {
+		reporter.Output(result.Output)
+	}
+	reporter.Status(execution.Status, execution.Error)
+
 	// Update agent usage count
-	s.db.Model(agent).Update("usage_count", agent.UsageCount+1)
+	if execution.Status == "completed" {
+		s.db.Model(agent).Update("usage_count", gorm.Expr("usage_count + ?", 1))
+	}
+
+	// Record the turn in the session conversation
+	if execution.Status == "completed" && prompt != "" {
+		reply, _ := result.Output["result"].(string)
+		if err := s.conversations.AppendMessage(execution.SessionID, &models.Message{
+			Role:    "user",
+			Content: prompt,
+		}); err != nil {
+			fmt.Printf("Error saving session message: %v\n", err)
+			return true
+		}
+		if err := s.conversations.AppendMessage(execution.SessionID, &models.Message{
+			Role:         "assistant",
+			Content:      reply,
+			Model:        result.Model,
+			PromptTokens: result.PromptTokens,
+			OutputTokens: result.OutputTokens,
+			Metadata: models.MapToJSON(map[string]interface{}{
+				"execution_id": execution.ID,
+			}),
+		}); err != nil {
+			fmt.Printf("Error saving session message: %v\n", err)
+		}
+	}
+	return true
+}
+
+// ReclaimOrphanedExecutions fails executions left running by an earlier
+// process that have no job to resume them. Chat turns never have a job, so
+// only executions older than the execution timeout are considered, which
+// leaves those still streaming on other instances alone.
+func (s *RuntimeService) ReclaimOrphanedExecutions() (int64, error) {
+	age := time.Duration(s.cfg.Queue.ExecutionTimeoutSeconds) * time.Second
+	if age <= 0 {
+		age = time.Hour
+	}
+
+	var orphaned []models.Execution
+	if err := s.db.Select("id", "user_id", "entitlement_id").
+		Where("status IN ?", []string{"queued", "running"}).
+		Where("created_at < ?", time.Now().Add(-age)).
+		Where("id NOT IN (?)", s.db.Model(&models.ExecutionJob{}).Select("execution_id")).
+		Find(&orphaned).Error; err != nil {
+		return 0, err
+	}
+
+	var failed int64
+	for i := range orphaned {
+		execution := &orphaned[i]
+		execution.Error = "execution was interrupted by a server restart"
+		result := s.db.Model(&models.Execution{}).
+			Where("id = ? AND status IN ?", execution.ID, []string{"queued", "running"}).
+			Updates(map[string]interface{}{
+				"status": "failed",
+				"error":  execution.Error,
+			})
+		if result.Error != nil {
+			return failed, result.Error
+		}
+		if result.RowsAffected > 0 {
+			failed++
+			s.releaseCredits(execution, execution.Error)
+		}
+	}
+	return failed, nil
+}
+
+// settleCredits charges an execution the credits recorded on it, returning the
+// ledger entry, or nil when the execution was not settled by this call
+func (s *RuntimeService) settleCredits(execution *models.Execution) *models.CreditTransaction {
+	metadata := map[string]interface{}{
+		"model":         execution.Model,
+		"prompt_tokens": execution.PromptTokens,
+		"output_tokens": execution.OutputTokens,
+		"cost":          execution.Cost,
+	}
+	if execution.Error != "" {
+		metadata["reason"] = execution.Error
+	}
+	settlement, err := s.credits.Settle(execution.UserID, execution.ID, execution.CreditsUsed, metadata)
+	if err != nil {
+		fmt.Printf("Error settling credits for execution %s: %v\n", execution.ID, err)
+	}
+	return settlement
+}
+
+// settleCancelled charges a cancelled execution for the tokens it used
+// before it was stopped and returns the rest of its reservation
+func (s *RuntimeService) settleCancelled(execution *models.Execution, agent *models.Agent, usage *ExecutionResult) {
+	execution.Error = ErrExecutionCancelled.Error()
+	execution.Cost, execution.CreditsUsed = s.credits.UsageCharge(agent, usage)
+	if execution.CreditsUsed == 0 {
+		s.releaseCredits(execution, execution.Error)
+		return
+	}
+
+	execution.Model = usage.Model
+	execution.PromptTokens = usage.PromptTokens
+	execution.OutputTokens = usage.OutputTokens
+	execution.TotalTokens = usage.TotalTokens
+	if err := s.db.Model(&models.Execution{}).Where("id = ?", execution.ID).Updates(map[string]interface{}{
+		"model":         execution.Model,
+		"prompt_tokens": execution.PromptTokens,
+		"output_tokens": execution.OutputTokens,
+		"total_tokens":  execution.TotalTokens,
+		"cost":          execution.Cost,
+		"credits_used":  execution.CreditsUsed,
+	}).Error; err != nil {
+		fmt.Printf("Error saving usage of cancelled execution %s: %v\n", execution.ID, err)
+	}
+	s.settleCredits(execution)
+	s.restoreEntitlement(execution)
+}
+
+// releaseCredits returns the credits reserved for an execution that will not
+// be charged, along with the entitlement use it took
+func (s *RuntimeService) releaseCredits(execution *models.Execution, reason string) {
+	if err := s.credits.Release(execution.UserID, execution.ID, reason); err != nil {
+		fmt.Printf("Error releasing credits for execution %s: %v\n", execution.ID, err)
+	}
+	s.restoreEntitlement(execution)
+}
+
+// restoreEntitlement gives back the entitlement use taken by an execution
+// that did not complete. Clearing it from the row first makes this happen once.
+func (s *RuntimeService) restoreEntitlement(execution *models.Execution) {
+	if execution.EntitlementID == nil {
+		return
+	}
+	entitlementID := *execution.EntitlementID
+	cleared := s.db.Model(&models.Execution{}).
+		Where("id = ? AND entitlement_id = ?", execution.ID, entitlementID).
+		Update("entitlement_id", nil)
+	if cleared.Error != nil {
+		fmt.Printf("Error restoring entitlement of execution %s: %v\n", execution.ID, cleared.Error)
+		return
+	}
+	execution.EntitlementID = nil
+	if cleared.RowsAffected == 0 {
+		return
+	}
+	if err := s.purchases.RestoreEntitlement(entitlementID); err != nil {
+		fmt.Printf("Error restoring entitlement %s: %v\n", entitlementID, err)
+	}
+}
+
+// chatMessagesToInput converts chat messages into the execution input messages format
+func chatMessagesToInput(messages []ChatMessage) []interface{} {
+	items := make([]interface{}, 0, len(messages))
+	for _, m := range messages {
+		items = append(items, map[string]interface{}{
+			"role":    m.Role,
+			"content": m.Content,
+		})
+	}
+	return items
 }
 
 // GetExecution retrieves an execution by ID
 func (s *RuntimeService) GetExecution(id string) (*models.Execution, error) {
 	var execution models.Execution
-	if err := s.db.Preload("Agent").Preload("User").Preload("Organization").First(&execution, "id = ?", id).Error; err != nil {
+	if err := s.db.Preload("Agent").Preload("User").Preload("Organization").
+		Preload("Steps", func(db *gorm.DB) *gorm.DB { return db.Order("sequence ASC") }).
+		First(&execution, "id = ?", id).Error; err != nil {
 		return nil, err
 	}
 	return &execution, nil
@@ -138,12 +795,37 @@ func (s *RuntimeService) CancelExecution(id string, userID string) error {
 		return errors.New("unauthorized to cancel this execution")
 	}
 
-	// Only allow cancellation of running executions
-	if execution.Status != "running" {
-		return errors.New("can only cancel running executions")
+	// Only allow cancellation of queued or running executions
+	if execution.Status != "queued" && execution.Status != "running" {
+		return errors.New("can only cancel queued or running executions")
+	}
+
+	// A queued execution has used nothing, so its reservation is returned now
+	queued := s.db.Model(&models.Execution{}).
+		Where("id = ? AND status = ?", execution.ID, "queued").
+		Update("status", "cancelled")
+	if queued.Error != nil {
+		return queued.Error
+	}
+	if queued.RowsAffected > 0 {
+		s.releaseCredits(&execution, ErrExecutionCancelled.Error())
+	} else {
+		// The worker running the execution charges what it used once it stops;
+		// the status guard keeps a run that just finished from being marked cancelled
+		running := s.db.Model(&models.Execution{}).
+			Where("id = ? AND status = ?", execution.ID, "running").
+			Update("status", "cancelled")
+		if running.Error != nil {
+			return running.Error
+		}
+		if running.RowsAffected == 0 {
+			return errors.New("can only cancel queued or running executions")
+		}
 	}
 
-	return s.db.Model(&execution).Update("status", "cancelled").Error
+	// The worker running the execution aborts when it sees this event
+	NewExecutionReporter(s.events, execution.ID).Status("cancelled", ErrExecutionCancelled.Error())
+	return nil
 }
 
 // GetExecutionStats retrieves execution statistics
@@ -212,38 +894,80 @@ func (s *RuntimeService) GetAgentExecutionStats(agentID string) (map[string]inte
 	return stats, nil
 }
 
-// StreamExecution streams execution updates via WebSocket
-func (s *RuntimeService) StreamExecution(ctx context.Context, executionID string, updates chan<- map[string]interface{}) {
+// StreamExecution sends the current state of an execution followed by every
+// event published for it, closing updates once the execution ends
+func (s *RuntimeService) StreamExecution(ctx context.Context, executionID string, updates chan<- ExecutionEvent) {
 	defer close(updates)
 
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
+	// Subscribe before reading the current state so no event falls in between
+	events, unsubscribe := s.events.Subscribe(executionID)
+	defer unsubscribe()
 
-	for {
+	send := func(event ExecutionEvent) bool {
 		select {
+		case updates <- event:
+			return true
 		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			var execution models.Execution
-			if err := s.db.First(&execution, "id = ?", executionID).Error; err != nil {
-				updates <- map[string]interface{}{
-					"error": "Execution not found",
-				}
+			return false
+		}
+	}
+
+	var execution models.Execution
+	if err := s.db.First(&execution, "id = ?", executionID).Error; err != nil {
+		send(ExecutionEvent{
+			ExecutionID: executionID,
+			Type:        ExecutionEventError,
+			Message:     "Execution not found",
+			Timestamp:   time.Now(),
+		})
+		return
+	}
+
+	snapshot := ExecutionEvent{
+		ExecutionID: execution.ID,
+		Type:        ExecutionEventStatus,
+		Status:      execution.Status,
+		Message:     execution.Error,
+		Timestamp:   time.Now(),
+	}
+	if IsTerminalExecutionStatus(execution.Status) {
+		if execution.Status == "completed" {
+			var output map[string]interface{}
+			json.Unmarshal(execution.Output, &output)
+			if !send(ExecutionEvent{
+				ExecutionID: execution.ID,
+				Type:        ExecutionEventOutput,
+				Data:        output,
+				Timestamp:   time.Now(),
+			}) {
 				return
 			}
+		}
+		send(snapshot)
+		return
+	}
+	if !send(snapshot) {
+		return
+	}
 
-			update := map[string]interface{}{
-				"id":     execution.ID,
-				"status": execution.Status,
-				"output": execution.Output,
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				// The subscriber fell behind and was dropped
+				send(ExecutionEvent{
+					ExecutionID: executionID,
+					Type:        ExecutionEventError,
+					Message:     "Event stream interrupted, reconnect to resume",
+					Timestamp:   time.Now(),
+				})
+				return
 			}
-
-			if execution.Status == "completed" || execution.Status == "failed" {
-				updates <- update
+			if !send(event) || event.IsTerminal() {
 				return
 			}
-
-			updates <- update
 		}
 	}
 }
@@ -251,7 +975,7 @@ func (s *RuntimeService) StreamExecution(ctx context.Context, executionID string
 // GetActiveExecutions retrieves currently running executions
 func (s *RuntimeService) GetActiveExecutions(userID string) ([]models.Execution, error) {
 	var executions []models.Execution
-	if err := s.db.Where("user_id = ? AND status = ?", userID, "running").
+	if err := s.db.Where("user_id = ? AND status IN ?", userID, []string{"queued", "running"}).
 		Preload("Agent").Order("created_at DESC").Find(&executions).Error; err != nil {
 		return nil, err
 	}
@@ -261,5 +985,12 @@ func (s *RuntimeService) GetActiveExecutions(userID string) ([]models.Execution,
 // CleanupOldExecutions removes old execution records
 func (s *RuntimeService) CleanupOldExecutions(daysOld int) error {
 	cutoff := time.Now().AddDate(0, 0, -daysOld)
-	return s.db.Where("created_at < ? AND status IN (?)", cutoff, []string{"completed", "failed", "cancelled"}).Delete(&models.Execution{}).Error
+	statuses := []string{"completed", "failed", "cancelled"}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		old := tx.Model(&models.Execution{}).Select("id").Where("created_at < ? AND status IN (?)", cutoff, statuses)
+		if err := tx.Where("execution_id IN (?)", old).Delete(&models.ExecutionStep{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("created_at < ? AND status IN (?)", cutoff, statuses).Delete(&models.Execution{}).Error
+	})
 }
@@ -0,0 +1,277 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"gorm.io/gorm"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// executorFunc adapts a function to the AgentExecutor interface
+type executorFunc func(ctx context.Context, agent *models.Agent, input map[string]interface{}) (*ExecutionResult, error)
+
+func (f executorFunc) Execute(ctx context.Context, agent *models.Agent, input map[string]interface{}) (*ExecutionResult, error) {
+	return f(ctx, agent, input)
+}
+
+// runtimeTest is a user with credits and an enabled public agent, run by a
+// stand-in executor when one is given
+type runtimeTest struct {
+	db      *gorm.DB
+	cfg     *config.Config
+	runtime *RuntimeService
+	user    *models.User
+	creator *models.User
+	agent   *models.Agent
+}
+
+func newRuntimeTest(t *testing.T, executor executorFunc) *runtimeTest {
+	t.Helper()
+	t.Setenv("EMAIL_OUTBOX_DIR", t.TempDir())
+
+	db := newTestDB(t, &models.Organization{}, &models.User{}, &models.Agent{}, &models.Execution{},
+		&models.ExecutionJob{}, &models.ExecutionStep{}, &models.CreditTransaction{}, &models.Purchase{},
+		&models.Entitlement{}, &models.CreatorEarning{}, &models.Conversation{}, &models.Message{},
+		&models.Notification{}, &models.EmailLog{}, &models.LLMProvider{})
+
+	creator := &models.User{Email: "maker@example.com", Username: "maker", PasswordHash: "x", IsActive: true, EmailVerified: true}
+	user := &models.User{Email: "ann@example.com", Username: "ann", PasswordHash: "x", IsActive: true, EmailVerified: true, Credits: 1000}
+	for _, u := range []*models.User{creator, user} {
+		if err := db.Create(u).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	agent := &models.Agent{Name: "Helper", Slug: "helper", CreatorID: creator.ID, IsPublic: true, IsEnabled: true,
+		LLMProvider: "OpenAI", LLMModel: "gpt-4o", PricingModel: PricingFree}
+	if err := db.Create(agent).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Load()
+	runtime := NewRuntimeService(db, cfg)
+	if executor != nil {
+		runtime.SetExecutor(executor)
+	}
+	return &runtimeTest{db: db, cfg: cfg, runtime: runtime, user: user, creator: creator, agent: agent}
+}
+
+// execute queues a run of the agent on input, "hello" when nil, and returns
+// the execution and its job
+func (rt *runtimeTest) execute(t *testing.T, input map[string]interface{}) (*models.Execution, *models.ExecutionJob) {
+	t.Helper()
+	if input == nil {
+		input = map[string]interface{}{"message": "hello"}
+	}
+	execution, err := rt.runtime.ExecuteAgent(&ExecuteAgentRequest{
+		AgentID: rt.agent.ID,
+		Input:   input,
+	}, rt.user.ID, nil)
+	if err != nil {
+		t.Fatalf("ExecuteAgent() error = %v", err)
+	}
+	var job models.ExecutionJob
+	if err := rt.db.First(&job, "execution_id = ?", execution.ID).Error; err != nil {
+		t.Fatalf("no job queued: %v", err)
+	}
+	job.Attempts = 1
+	return execution, &job
+}
+
+// reload returns the execution as stored
+func (rt *runtimeTest) reload(t *testing.T, id string) *models.Execution {
+	t.Helper()
+	var execution models.Execution
+	if err := rt.db.First(&execution, "id = ?", id).Error; err != nil {
+		t.Fatal(err)
+	}
+	return &execution
+}
+
+// balance returns the user's credit balance
+func (rt *runtimeTest) balance(t *testing.T) *CreditBalance {
+	t.Helper()
+	balance, err := rt.runtime.credits.GetBalance(rt.user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return balance
+}
+
+// settlements returns the settle entries recorded for an execution
+func (rt *runtimeTest) settlements(t *testing.T, executionID string) []models.CreditTransaction {
+	t.Helper()
+	var entries []models.CreditTransaction
+	if err := rt.db.Where("execution_id = ? AND type = ?", executionID, CreditTypeSettle).Find(&entries).Error; err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+// usage is the result of a run that used some tokens
+var usage = &ExecutionResult{
+	Output:       map[string]interface{}{"result": "hi"},
+	Model:        "gpt-4o",
+	PromptTokens: 20000,
+	OutputTokens: 5000,
+	TotalTokens:  25000,
+}
+
+func TestRunExecutionJobCompletes(t *testing.T) {
+	rt := newRuntimeTest(t, func(ctx context.Context, agent *models.Agent, input map[string]interface{}) (*ExecutionResult, error) {
+		return usage, nil
+	})
+	execution, job := rt.execute(t, nil)
+	if rt.balance(t).ReservedCredits == 0 {
+		t.Fatal("no credits reserved for the queued execution")
+	}
+
+	if result, err := rt.runtime.RunExecutionJob(context.Background(), job); result != JobCompleted || err != nil {
+		t.Fatalf("RunExecutionJob() = %v, %v, want JobCompleted", result, err)
+	}
+
+	stored := rt.reload(t, execution.ID)
+	_, charge := rt.runtime.credits.ExecutionCharge(rt.agent, usage)
+	if stored.Status != "completed" || stored.CreditsUsed != charge || stored.TotalTokens != usage.TotalTokens {
+		t.Errorf("execution = %s, %d credits, %d tokens, want completed, %d, %d",
+			stored.Status, stored.CreditsUsed, stored.TotalTokens, charge, usage.TotalTokens)
+	}
+	if balance := rt.balance(t); balance.ReservedCredits != 0 || balance.UsedCredits != charge {
+		t.Errorf("balance = %+v, want nothing reserved and %d used", balance, charge)
+	}
+}
+
+func TestRunExecutionJobCancelledAfterExecutorReturned(t *testing.T) {
+	// The cancel lands between the executor returning and the outcome being
+	// saved, too late to abort the run through its context
+	var rt *runtimeTest
+	rt = newRuntimeTest(t, func(ctx context.Context, agent *models.Agent, input map[string]interface{}) (*ExecutionResult, error) {
+		rt.db.Model(&models.Execution{}).Where("status = ?", "running").Update("status", "cancelled")
+		return usage, nil
+	})
+
+	uses := int64(2)
+	entitlement := &models.Entitlement{UserID: rt.user.ID, AgentID: rt.agent.ID, Type: PricingUsageBased,
+		Status: EntitlementActive, UsageLimit: &uses}
+	if err := rt.db.Create(entitlement).Error; err != nil {
+		t.Fatal(err)
+	}
+	rt.db.Model(rt.agent).Updates(map[string]interface{}{"pricing_model": PricingUsageBased, "price": 1.0})
+	rt.agent.PricingModel, rt.agent.Price = PricingUsageBased, 1.0
+
+	execution, job := rt.execute(t, nil)
+	if result, err := rt.runtime.RunExecutionJob(context.Background(), job); result != JobCancelled || err != nil {
+		t.Fatalf("RunExecutionJob() = %v, %v, want JobCancelled", result, err)
+	}
+
+	// The tokens used are charged and the rest of the reservation returned
+	stored := rt.reload(t, execution.ID)
+	_, charge := rt.runtime.credits.UsageCharge(rt.agent, usage)
+	if stored.Status != "cancelled" || stored.CreditsUsed != charge {
+		t.Errorf("execution = %s with %d credits, want cancelled with %d", stored.Status, stored.CreditsUsed, charge)
+	}
+	if entries := rt.settlements(t, execution.ID); len(entries) != 1 {
+		t.Errorf("%d settlements, want 1", len(entries))
+	}
+	if balance := rt.balance(t); balance.ReservedCredits != 0 || balance.UsedCredits != charge {
+		t.Errorf("balance = %+v, want nothing reserved and %d used", balance, charge)
+	}
+
+	// The entitlement use is given back
+	var restored models.Entitlement
+	rt.db.First(&restored, "id = ?", entitlement.ID)
+	if restored.UsageCount != 0 || stored.EntitlementID != nil {
+		t.Errorf("entitlement used %d times, execution holds %v, want the use given back", restored.UsageCount, stored.EntitlementID)
+	}
+}
+
+// blockUntilDone is an executor that signals started and runs until its
+// context ends, having used some tokens by then
+func blockUntilDone(started chan<- struct{}) executorFunc {
+	return func(ctx context.Context, agent *models.Agent, input map[string]interface{}) (*ExecutionResult, error) {
+		close(started)
+		<-ctx.Done()
+		return usage, ctx.Err()
+	}
+}
+
+func TestRunExecutionJobCancelledWhileRunning(t *testing.T) {
+	started := make(chan struct{})
+	rt := newRuntimeTest(t, blockUntilDone(started))
+	execution, job := rt.execute(t, nil)
+
+	go func() {
+		<-started
+		if err := rt.runtime.CancelExecution(execution.ID, rt.user.ID); err != nil {
+			t.Errorf("CancelExecution() error = %v", err)
+		}
+	}()
+	if result, err := rt.runtime.RunExecutionJob(context.Background(), job); result != JobCancelled || err != nil {
+		t.Fatalf("RunExecutionJob() = %v, %v, want JobCancelled", result, err)
+	}
+
+	// The tokens used before the cancel are charged
+	stored := rt.reload(t, execution.ID)
+	_, charge := rt.runtime.credits.UsageCharge(rt.agent, usage)
+	if stored.Status != "cancelled" || stored.CreditsUsed != charge {
+		t.Errorf("execution = %s with %d credits, want cancelled with %d", stored.Status, stored.CreditsUsed, charge)
+	}
+	if balance := rt.balance(t); balance.ReservedCredits != 0 || balance.UsedCredits != charge {
+		t.Errorf("balance = %+v, want nothing reserved and %d used", balance, charge)
+	}
+}
+
+func TestRunExecutionJobInterruptedByShutdown(t *testing.T) {
+	started := make(chan struct{})
+	rt := newRuntimeTest(t, blockUntilDone(started))
+	execution, job := rt.execute(t, nil)
+	reserved := rt.balance(t).ReservedCredits
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	go func() {
+		<-started
+		cancel(ErrServerShutdown)
+	}()
+	if result, err := rt.runtime.RunExecutionJob(ctx, job); result != JobRelease || !errors.Is(err, ErrServerShutdown) {
+		t.Fatalf("RunExecutionJob() = %v, %v, want JobRelease", result, err)
+	}
+
+	// The run goes back to the queue holding its reservation and the tokens
+	// it used, which are charged when it finishes
+	stored := rt.reload(t, execution.ID)
+	if stored.Status != "queued" || stored.TotalTokens != usage.TotalTokens {
+		t.Errorf("execution = %s with %d tokens, want queued with %d", stored.Status, stored.TotalTokens, usage.TotalTokens)
+	}
+	if balance := rt.balance(t); balance.ReservedCredits != reserved || balance.UsedCredits != 0 {
+		t.Errorf("balance = %+v, want %d still reserved and nothing used", balance, reserved)
+	}
+}
+
+func TestCancelQueuedExecution(t *testing.T) {
+	rt := newRuntimeTest(t, func(ctx context.Context, agent *models.Agent, input map[string]interface{}) (*ExecutionResult, error) {
+		t.Error("a cancelled execution was run")
+		return usage, nil
+	})
+	execution, job := rt.execute(t, nil)
+
+	if err := rt.runtime.CancelExecution(execution.ID, rt.creator.ID); err == nil {
+		t.Error("CancelExecution() by another user error = nil, want unauthorized")
+	}
+	if err := rt.runtime.CancelExecution(execution.ID, rt.user.ID); err != nil {
+		t.Fatalf("CancelExecution() error = %v", err)
+	}
+	if err := rt.runtime.CancelExecution(execution.ID, rt.user.ID); err == nil {
+		t.Error("second CancelExecution() error = nil, want an error")
+	}
+
+	// The reservation is returned at once and the job finds nothing to run
+	if balance := rt.balance(t); balance.ReservedCredits != 0 || balance.UsedCredits != 0 {
+		t.Errorf("balance = %+v, want nothing reserved or used", balance)
+	}
+	if result, err := rt.runtime.RunExecutionJob(context.Background(), job); result != JobCancelled || err != nil {
+		t.Errorf("RunExecutionJob() = %v, %v, want JobCancelled", result, err)
+	}
+}
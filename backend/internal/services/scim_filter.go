@@ -0,0 +1,573 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// scimFilter is a parsed SCIM filter expression (RFC 7644, section 3.4.2.2),
+// evaluated against resources in their JSON form
+type scimFilter interface {
+	matches(resource map[string]interface{}) bool
+}
+
+// scimLogical joins two filters with "and" or "or"
+type scimLogical struct {
+	and         bool
+	left, right scimFilter
+}
+
+func (f *scimLogical) matches(resource map[string]interface{}) bool {
+	if f.and {
+		return f.left.matches(resource) && f.right.matches(resource)
+	}
+	return f.left.matches(resource) || f.right.matches(resource)
+}
+
+// scimNot negates a filter
+type scimNot struct {
+	filter scimFilter
+}
+
+func (f *scimNot) matches(resource map[string]interface{}) bool {
+	return !f.filter.matches(resource)
+}
+
+// scimComparison compares an attribute with a value, or checks that it is
+// present. Multi-valued attributes match when any value does.
+type scimComparison struct {
+	path  []string
+	op    string
+	value interface{}
+}
+
+func (f *scimComparison) matches(resource map[string]interface{}) bool {
+	for _, actual := range scimValues(resource, f.path) {
+		if f.op == "pr" {
+			if actual != nil && actual != "" {
+				return true
+			}
+			continue
+		}
+		if compareSCIMValue(actual, f.op, f.value) {
+			return true
+		}
+	}
+	return false
+}
+
+// scimValues returns the values at an attribute path, descending into
+// multi-valued attributes
+func scimValues(value interface{}, path []string) []interface{} {
+	if len(path) == 0 {
+		if values, ok := value.([]interface{}); ok {
+			return values
+		}
+		return []interface{}{value}
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		child, ok := scimLookup(v, path[0])
+		if !ok {
+			return nil
+		}
+		return scimValues(child, path[1:])
+	case []interface{}:
+		var values []interface{}
+		for _, item := range v {
+			values = append(values, scimValues(item, path)...)
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+// scimLookup finds an attribute by name, ignoring case as SCIM requires
+func scimLookup(resource map[string]interface{}, name string) (interface{}, bool) {
+	if value, ok := resource[name]; ok {
+		return value, true
+	}
+	for key, value := range resource {
+		if strings.EqualFold(key, name) {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// scimKey returns the key an attribute is stored under, or name when absent
+func scimKey(resource map[string]interface{}, name string) string {
+	for key := range resource {
+		if strings.EqualFold(key, name) {
+			return key
+		}
+	}
+	return name
+}
+
+// compareSCIMValue applies a comparison operator. Strings compare without
+// regard to case.
+func compareSCIMValue(actual interface{}, op string, expected interface{}) bool {
+	switch want := expected.(type) {
+	case string:
+		got, ok := actual.(string)
+		if !ok {
+			return op == "ne"
+		}
+		got, want = strings.ToLower(got), strings.ToLower(want)
+		switch op {
+		case "eq":
+			return got == want
+		case "ne":
+			return got != want
+		case "co":
+			return strings.Contains(got, want)
+		case "sw":
+			return strings.HasPrefix(got, want)
+		case "ew":
+			return strings.HasSuffix(got, want)
+		case "gt":
+			return got > want
+		case "ge":
+			return got >= want
+		case "lt":
+			return got < want
+		case "le":
+			return got <= want
+		}
+	case bool:
+		got, ok := scimBool(actual)
+		switch op {
+		case "eq":
+			return ok && got == want
+		case "ne":
+			return !ok || got != want
+		}
+	case float64:
+		got, ok := actual.(float64)
+		if !ok {
+			return op == "ne"
+		}
+		switch op {
+		case "eq":
+			return got == want
+		case "ne":
+			return got != want
+		case "gt":
+			return got > want
+		case "ge":
+			return got >= want
+		case "lt":
+			return got < want
+		case "le":
+			return got <= want
+		}
+	case nil:
+		switch op {
+		case "eq":
+			return actual == nil
+		case "ne":
+			return actual != nil
+		}
+	}
+	return false
+}
+
+// scimBool reads a boolean that some clients send as a string
+func scimBool(value interface{}) (bool, bool) {
+	switch v := value.(type) {
+	case bool:
+		return v, true
+	case string:
+		b, err := strconv.ParseBool(strings.ToLower(v))
+		return b, err == nil
+	}
+	return false, false
+}
+
+// parseSCIMFilter parses a filter expression
+func parseSCIMFilter(filter string) (scimFilter, error) {
+	p := &scimFilterParser{input: filter}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return nil, fmt.Errorf("unexpected %q in filter", p.input[p.pos:])
+	}
+	return expr, nil
+}
+
+// scimFilterParser is a recursive descent parser for filter expressions
+type scimFilterParser struct {
+	input string
+	pos   int
+}
+
+func (p *scimFilterParser) parseOr() (scimFilter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &scimLogical{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *scimFilterParser) parseAnd() (scimFilter, error) {
+	left, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("and") {
+		right, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		left = &scimLogical{and: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *scimFilterParser) parseFactor() (scimFilter, error) {
+	p.skipSpace()
+	if p.acceptKeyword("not") {
+		p.skipSpace()
+		if !p.accept('(') {
+			return nil, fmt.Errorf("expected ( after not")
+		}
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(')') {
+			return nil, fmt.Errorf("missing ) in filter")
+		}
+		return &scimNot{filter: expr}, nil
+	}
+	if p.accept('(') {
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(')') {
+			return nil, fmt.Errorf("missing ) in filter")
+		}
+		return expr, nil
+	}
+
+	path := p.word()
+	if path == "" {
+		return nil, fmt.Errorf("expected attribute at position %d", p.pos)
+	}
+	if strings.Contains(path, "[") {
+		return nil, fmt.Errorf("complex attribute filters are not supported")
+	}
+	op := strings.ToLower(p.word())
+	switch op {
+	case "pr":
+		return &scimComparison{path: scimAttrPath(path), op: op}, nil
+	case "eq", "ne", "co", "sw", "ew", "gt", "ge", "lt", "le":
+	default:
+		return nil, fmt.Errorf("unsupported operator %q", op)
+	}
+	value, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	return &scimComparison{path: scimAttrPath(path), op: op, value: value}, nil
+}
+
+// value parses a JSON string, boolean, null or number
+func (p *scimFilterParser) value() (interface{}, error) {
+	p.skipSpace()
+	if p.pos < len(p.input) && p.input[p.pos] == '"' {
+		end := p.pos + 1
+		for end < len(p.input) && p.input[end] != '"' {
+			if p.input[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(p.input) {
+			return nil, fmt.Errorf("unterminated string in filter")
+		}
+		var s string
+		if err := json.Unmarshal([]byte(p.input[p.pos:end+1]), &s); err != nil {
+			return nil, fmt.Errorf("invalid string in filter")
+		}
+		p.pos = end + 1
+		return s, nil
+	}
+
+	word := p.word()
+	switch strings.ToLower(word) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	number, err := strconv.ParseFloat(word, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q in filter", word)
+	}
+	return number, nil
+}
+
+// word reads up to the next space or parenthesis
+func (p *scimFilterParser) word() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.input) {
+		c := rune(p.input[p.pos])
+		if unicode.IsSpace(c) || c == '(' || c == ')' {
+			break
+		}
+		p.pos++
+	}
+	return p.input[start:p.pos]
+}
+
+// acceptKeyword consumes a keyword followed by a space or parenthesis
+func (p *scimFilterParser) acceptKeyword(keyword string) bool {
+	p.skipSpace()
+	end := p.pos + len(keyword)
+	if end > len(p.input) || !strings.EqualFold(p.input[p.pos:end], keyword) {
+		return false
+	}
+	if end < len(p.input) && !unicode.IsSpace(rune(p.input[end])) && p.input[end] != '(' {
+		return false
+	}
+	p.pos = end
+	return true
+}
+
+func (p *scimFilterParser) accept(c byte) bool {
+	p.skipSpace()
+	if p.pos < len(p.input) && p.input[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *scimFilterParser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+// scimAttrPath splits an attribute path into its names, dropping the URN of
+// a core schema
+func scimAttrPath(path string) []string {
+	for _, schema := range []string{scimSchemaUser, scimSchemaGroup} {
+		if len(path) > len(schema) && strings.EqualFold(path[:len(schema)+1], schema+":") {
+			path = path[len(schema)+1:]
+		}
+	}
+	return strings.Split(path, ".")
+}
+
+// applySCIMPatch applies a PATCH operation (RFC 7644, section 3.5.2) to a
+// resource in its JSON form
+func applySCIMPatch(resource map[string]interface{}, op *SCIMPatchOperation) error {
+	operation := strings.ToLower(op.Op)
+	if operation != "add" && operation != "replace" && operation != "remove" {
+		return scimBadRequest("invalidSyntax", fmt.Sprintf("unsupported patch operation %q", op.Op))
+	}
+
+	var value interface{}
+	if len(op.Value) > 0 {
+		if err := json.Unmarshal(op.Value, &value); err != nil {
+			return scimBadRequest("invalidValue", "invalid patch value")
+		}
+	}
+
+	// Without a path, the value holds the attributes to add or replace
+	if op.Path == "" {
+		if operation == "remove" {
+			return scimBadRequest("noTarget", "remove requires a path")
+		}
+		attributes, ok := value.(map[string]interface{})
+		if !ok {
+			return scimBadRequest("invalidValue", "patch value must be an object when no path is given")
+		}
+		for path, attrValue := range attributes {
+			if err := patchSCIMPath(resource, path, operation, attrValue); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return patchSCIMPath(resource, op.Path, operation, value)
+}
+
+// patchSCIMPath applies an operation at a path, which may select values of a
+// multi-valued attribute with a filter, as in members[value eq "id"]
+func patchSCIMPath(resource map[string]interface{}, path, operation string, value interface{}) error {
+	var valueFilter scimFilter
+	var subAttr string
+	if start := strings.Index(path, "["); start >= 0 {
+		end := strings.LastIndex(path, "]")
+		if end < start {
+			return scimBadRequest("invalidPath", "invalid path "+path)
+		}
+		filter, err := parseSCIMFilter(path[start+1 : end])
+		if err != nil {
+			return scimBadRequest("invalidPath", err.Error())
+		}
+		valueFilter = filter
+		subAttr = strings.TrimPrefix(path[end+1:], ".")
+		path = path[:start]
+	}
+
+	names := scimAttrPath(path)
+	// Extension schemas are not stored
+	if strings.HasPrefix(strings.ToLower(names[0]), "urn:") {
+		return nil
+	}
+
+	// Walk to the parent of the attribute, creating complex attributes
+	parent := resource
+	for _, name := range names[:len(names)-1] {
+		key := scimKey(parent, name)
+		child, ok := parent[key].(map[string]interface{})
+		if !ok {
+			if operation == "remove" {
+				return nil
+			}
+			child = map[string]interface{}{}
+			parent[key] = child
+		}
+		parent = child
+	}
+	key := scimKey(parent, names[len(names)-1])
+
+	if valueFilter == nil {
+		switch {
+		case operation == "remove":
+			// Remove listed values from a multi-valued attribute, or the
+			// whole attribute
+			if items, ok := parent[key].([]interface{}); ok && value != nil {
+				parent[key] = removeSCIMValues(items, value)
+			} else {
+				delete(parent, key)
+			}
+		case operation == "add":
+			if items, ok := parent[key].([]interface{}); ok {
+				parent[key] = appendSCIMValues(items, value)
+			} else {
+				parent[key] = value
+			}
+		default:
+			parent[key] = value
+		}
+		return nil
+	}
+
+	items, _ := parent[key].([]interface{})
+	kept := make([]interface{}, 0, len(items))
+	matched := false
+	for _, item := range items {
+		element, ok := item.(map[string]interface{})
+		if !ok || !valueFilter.matches(element) {
+			kept = append(kept, item)
+			continue
+		}
+		matched = true
+		switch {
+		case operation == "remove" && subAttr == "":
+			continue
+		case operation == "remove":
+			delete(element, scimKey(element, subAttr))
+		case subAttr == "":
+			if replacement, ok := value.(map[string]interface{}); ok {
+				element = replacement
+			}
+		default:
+			element[scimKey(element, subAttr)] = value
+		}
+		kept = append(kept, element)
+	}
+	if !matched && operation != "remove" {
+		// Nothing matched; add a value built from the filter, as for
+		// emails[type eq "work"].value
+		element := map[string]interface{}{}
+		if comparison, ok := valueFilter.(*scimComparison); ok && comparison.op == "eq" && len(comparison.path) == 1 {
+			element[comparison.path[0]] = comparison.value
+		}
+		if subAttr != "" {
+			element[subAttr] = value
+		} else if replacement, ok := value.(map[string]interface{}); ok {
+			for k, v := range replacement {
+				element[k] = v
+			}
+		}
+		kept = append(kept, element)
+	}
+	parent[key] = kept
+	return nil
+}
+
+// appendSCIMValues adds values to a multi-valued attribute, skipping
+// values already present
+func appendSCIMValues(items []interface{}, value interface{}) []interface{} {
+	added, ok := value.([]interface{})
+	if !ok {
+		added = []interface{}{value}
+	}
+	for _, add := range added {
+		if !containsSCIMValue(items, add) {
+			items = append(items, add)
+		}
+	}
+	return items
+}
+
+// removeSCIMValues removes values from a multi-valued attribute
+func removeSCIMValues(items []interface{}, value interface{}) []interface{} {
+	removed, ok := value.([]interface{})
+	if !ok {
+		removed = []interface{}{value}
+	}
+	kept := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		if !containsSCIMValue(removed, item) {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+// containsSCIMValue reports whether items holds value; complex values are
+// compared by their "value" sub-attribute
+func containsSCIMValue(items []interface{}, value interface{}) bool {
+	for _, item := range items {
+		if scimValueKey(item) == scimValueKey(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// scimValueKey identifies a value of a multi-valued attribute
+func scimValueKey(value interface{}) string {
+	if complexValue, ok := value.(map[string]interface{}); ok {
+		if v, ok := scimLookup(complexValue, "value"); ok {
+			return fmt.Sprint(v)
+		}
+	}
+	return fmt.Sprint(value)
+}
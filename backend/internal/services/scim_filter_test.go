@@ -0,0 +1,229 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// scimResource decodes a resource the way the service holds it, in JSON form
+func scimResource(t *testing.T, raw string) map[string]interface{} {
+	t.Helper()
+	var resource map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &resource); err != nil {
+		t.Fatalf("invalid resource: %v", err)
+	}
+	return resource
+}
+
+func TestSCIMFilterMatches(t *testing.T) {
+	user := scimResource(t, `{
+		"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"],
+		"userName": "Ann.Lee@example.com",
+		"displayName": "Ann \"AL\" Lee",
+		"externalId": "",
+		"title": null,
+		"active": true,
+		"loginCount": 3,
+		"name": {"givenName": "Ann", "familyName": "Lee"},
+		"emails": [
+			{"value": "ann@example.com", "type": "work", "primary": true},
+			{"value": "ann@home.example", "type": "home"}
+		],
+		"meta": {"created": "2024-03-01T10:00:00Z"}
+	}`)
+
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		// Attribute names, operators and string values ignore case
+		{filter: `userName eq "ann.lee@example.com"`, want: true},
+		{filter: `USERNAME Eq "Ann.Lee@Example.com"`, want: true},
+		{filter: `userName eq "bob@example.com"`, want: false},
+		{filter: `userName ne "bob@example.com"`, want: true},
+		{filter: `userName co "LEE@"`, want: true},
+		{filter: `userName sw "ann."`, want: true},
+		{filter: `userName ew ".org"`, want: false},
+		{filter: `meta.created gt "2024-01-01T00:00:00Z"`, want: true},
+		{filter: `meta.created lt "2024-01-01T00:00:00Z"`, want: false},
+
+		// Sub-attributes, with or without the schema URN
+		{filter: `name.familyName eq "Lee"`, want: true},
+		{filter: `urn:ietf:params:scim:schemas:core:2.0:User:name.givenName eq "Ann"`, want: true},
+		{filter: `name.middleName eq "Ann"`, want: false},
+
+		// Multi-valued attributes match when any value does
+		{filter: `emails.type eq "home"`, want: true},
+		{filter: `emails.value sw "bob"`, want: false},
+		{filter: `emails.primary eq true`, want: true},
+
+		// Presence treats empty strings and null as absent
+		{filter: `emails pr`, want: true},
+		{filter: `externalId pr`, want: false},
+		{filter: `title pr`, want: false},
+		{filter: `nickName pr`, want: false},
+		{filter: `title eq null`, want: true},
+
+		// Booleans and numbers
+		{filter: `active eq true`, want: true},
+		{filter: `active eq FALSE`, want: false},
+		{filter: `active ne false`, want: true},
+		{filter: `loginCount gt 2`, want: true},
+		{filter: `loginCount le 2.5`, want: false},
+		{filter: `loginCount eq 3`, want: true},
+
+		// Quoted strings may hold escapes, parentheses and keywords
+		{filter: `displayName eq "Ann \"AL\" Lee"`, want: true},
+		{filter: `userName ne "a) or (b"`, want: true},
+
+		// Logical operators, grouping and negation
+		{filter: `userName sw "ann" and active eq true`, want: true},
+		{filter: `userName sw "ann" and active eq false`, want: false},
+		{filter: `userName eq "bob" or active eq true`, want: true},
+		{filter: `not (active eq false)`, want: true},
+		{filter: `not(emails.type eq "home")`, want: false},
+		{filter: `(userName sw "bob" or name.givenName eq "ann") and loginCount ge 3`, want: true},
+		{filter: `  userName   eq   "ann.lee@example.com"  `, want: true},
+
+		// "and" binds tighter than "or"
+		{filter: `userName sw "ann" or userName eq "bob" and active eq false`, want: true},
+		{filter: `(userName sw "ann" or userName eq "bob") and active eq false`, want: false},
+
+		// Attributes starting with a keyword are not taken for one
+		{filter: `notes pr or ordinal pr or andrew pr`, want: false},
+	}
+
+	for _, tt := range tests {
+		filter, err := parseSCIMFilter(tt.filter)
+		if err != nil {
+			t.Errorf("parseSCIMFilter(%s) error = %v", tt.filter, err)
+			continue
+		}
+		if got := filter.matches(user); got != tt.want {
+			t.Errorf("parseSCIMFilter(%s) matches = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestParseSCIMFilterErrors(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   string
+	}{
+		{filter: ``, want: "expected attribute"},
+		{filter: `userName`, want: "unsupported operator"},
+		{filter: `userName is "ann"`, want: `unsupported operator "is"`},
+		{filter: `userName eq`, want: "invalid value"},
+		{filter: `userName eq ann`, want: `invalid value "ann"`},
+		{filter: `userName eq "ann`, want: "unterminated string"},
+		{filter: `userName eq "ann\"`, want: "unterminated string"},
+		{filter: `userName eq "\q"`, want: "invalid string"},
+		{filter: `(userName eq "ann"`, want: "missing )"},
+		{filter: `userName eq "ann")`, want: `unexpected ")"`},
+		{filter: `userName eq "ann" active eq true`, want: "unexpected"},
+		{filter: `userName eq "ann" and`, want: "expected attribute"},
+		{filter: `not userName eq "ann"`, want: "expected ( after not"},
+		{filter: `not (userName eq "ann"`, want: "missing )"},
+		{filter: `emails[type eq "work"].value pr`, want: "complex attribute filters are not supported"},
+	}
+
+	for _, tt := range tests {
+		if _, err := parseSCIMFilter(tt.filter); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseSCIMFilter(%s) error = %v, want one containing %q", tt.filter, err, tt.want)
+		}
+	}
+}
+
+func TestApplySCIMPatch(t *testing.T) {
+	tests := []struct {
+		name string
+		op   string
+		want string
+	}{
+		{
+			name: "replace without a path",
+			op:   `{"op":"Replace","value":{"active":false,"name.givenName":"Anna"}}`,
+			want: `{"active":false,"name":{"givenName":"Anna","familyName":"Lee"},"emails":[{"value":"ann@example.com","type":"work"}],"members":[{"value":"u1"},{"value":"u2"}]}`,
+		},
+		{
+			name: "add to a multi-valued attribute skips values present",
+			op:   `{"op":"add","path":"members","value":[{"value":"u2"},{"value":"u3"}]}`,
+			want: `{"active":true,"name":{"givenName":"Ann","familyName":"Lee"},"emails":[{"value":"ann@example.com","type":"work"}],"members":[{"value":"u1"},{"value":"u2"},{"value":"u3"}]}`,
+		},
+		{
+			name: "remove values selected by a filter",
+			op:   `{"op":"remove","path":"members[value eq \"u1\"]"}`,
+			want: `{"active":true,"name":{"givenName":"Ann","familyName":"Lee"},"emails":[{"value":"ann@example.com","type":"work"}],"members":[{"value":"u2"}]}`,
+		},
+		{
+			name: "remove listed values",
+			op:   `{"op":"remove","path":"members","value":[{"value":"u2"}]}`,
+			want: `{"active":true,"name":{"givenName":"Ann","familyName":"Lee"},"emails":[{"value":"ann@example.com","type":"work"}],"members":[{"value":"u1"}]}`,
+		},
+		{
+			name: "replace a sub-attribute of filtered values",
+			op:   `{"op":"replace","path":"emails[type eq \"work\"].value","value":"ann@example.org"}`,
+			want: `{"active":true,"name":{"givenName":"Ann","familyName":"Lee"},"emails":[{"value":"ann@example.org","type":"work"}],"members":[{"value":"u1"},{"value":"u2"}]}`,
+		},
+		{
+			name: "replace a sub-attribute of unmatched values adds one",
+			op:   `{"op":"replace","path":"emails[type eq \"home\"].value","value":"ann@home.example"}`,
+			want: `{"active":true,"name":{"givenName":"Ann","familyName":"Lee"},"emails":[{"value":"ann@example.com","type":"work"},{"value":"ann@home.example","type":"home"}],"members":[{"value":"u1"},{"value":"u2"}]}`,
+		},
+		{
+			name: "remove a sub-attribute with the schema URN",
+			op:   `{"op":"remove","path":"urn:ietf:params:scim:schemas:core:2.0:User:name.familyName"}`,
+			want: `{"active":true,"name":{"givenName":"Ann"},"emails":[{"value":"ann@example.com","type":"work"}],"members":[{"value":"u1"},{"value":"u2"}]}`,
+		},
+		{
+			name: "extension attributes are ignored",
+			op:   `{"op":"add","path":"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:department","value":"Sales"}`,
+			want: `{"active":true,"name":{"givenName":"Ann","familyName":"Lee"},"emails":[{"value":"ann@example.com","type":"work"}],"members":[{"value":"u1"},{"value":"u2"}]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resource := scimResource(t, `{"active":true,"name":{"givenName":"Ann","familyName":"Lee"},"emails":[{"value":"ann@example.com","type":"work"}],"members":[{"value":"u1"},{"value":"u2"}]}`)
+			var op SCIMPatchOperation
+			if err := json.Unmarshal([]byte(tt.op), &op); err != nil {
+				t.Fatal(err)
+			}
+			if err := applySCIMPatch(resource, &op); err != nil {
+				t.Fatalf("applySCIMPatch() error = %v", err)
+			}
+			if want := scimResource(t, tt.want); !reflect.DeepEqual(resource, want) {
+				got, _ := json.Marshal(resource)
+				t.Errorf("applySCIMPatch() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplySCIMPatchErrors(t *testing.T) {
+	tests := []struct {
+		op       string
+		scimType string
+	}{
+		{op: `{"op":"move","path":"active","value":false}`, scimType: "invalidSyntax"},
+		{op: `{"op":"remove"}`, scimType: "noTarget"},
+		{op: `{"op":"replace","value":"active"}`, scimType: "invalidValue"},
+		{op: `{"op":"remove","path":"members[value eq]"}`, scimType: "invalidPath"},
+		{op: `{"op":"remove","path":"members]value eq \"u1\"["}`, scimType: "invalidPath"},
+	}
+
+	for _, tt := range tests {
+		var op SCIMPatchOperation
+		if err := json.Unmarshal([]byte(tt.op), &op); err != nil {
+			t.Fatal(err)
+		}
+		err := applySCIMPatch(map[string]interface{}{"members": []interface{}{}}, &op)
+		var scimErr *SCIMError
+		if !errors.As(err, &scimErr) || scimErr.Status != 400 || scimErr.ScimType != tt.scimType {
+			t.Errorf("applySCIMPatch(%s) error = %v, want a 400 %s error", tt.op, err, tt.scimType)
+		}
+	}
+}
@@ -0,0 +1,960 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// SCIMTokenPrefix starts every SCIM token, so they can be told apart from
+// API keys and JWTs
+const SCIMTokenPrefix = "scim_"
+
+// SCIM schema URNs (RFC 7643, RFC 7644)
+const (
+	scimSchemaUser         = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimSchemaGroup        = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimSchemaListResponse = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimSchemaError        = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimSchemaConfig       = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	scimSchemaResourceType = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+)
+
+// scimMaxResults caps the page size of list requests
+const scimMaxResults = 200
+
+// ErrInvalidSCIMToken is returned for unknown and revoked SCIM tokens
+var ErrInvalidSCIMToken = errors.New("invalid SCIM token")
+
+// SCIMError is an error in the SCIM error format (RFC 7644, section 3.12)
+type SCIMError struct {
+	Schemas  []string `json:"schemas"`
+	Status   int      `json:"status,string"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail"`
+}
+
+func (e *SCIMError) Error() string {
+	return e.Detail
+}
+
+// NewSCIMError creates a SCIM error
+func NewSCIMError(status int, scimType, detail string) *SCIMError {
+	return &SCIMError{Schemas: []string{scimSchemaError}, Status: status, ScimType: scimType, Detail: detail}
+}
+
+func scimBadRequest(scimType, detail string) error {
+	return NewSCIMError(http.StatusBadRequest, scimType, detail)
+}
+
+func scimNotFound(resource string) error {
+	return NewSCIMError(http.StatusNotFound, "", resource+" not found")
+}
+
+func scimConflict(detail string) error {
+	return NewSCIMError(http.StatusConflict, "uniqueness", detail)
+}
+
+// SCIMMeta is a resource's metadata
+type SCIMMeta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+// SCIMName is a user's name
+type SCIMName struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+// SCIMEmail is one of a user's email addresses
+type SCIMEmail struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// SCIMMemberRef refers to a group member, or to a group a user belongs to
+type SCIMMemberRef struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+}
+
+// SCIMUser is the SCIM form of a user
+type SCIMUser struct {
+	Schemas     []string        `json:"schemas"`
+	ID          string          `json:"id,omitempty"`
+	ExternalID  string          `json:"externalId,omitempty"`
+	UserName    string          `json:"userName"`
+	Name        *SCIMName       `json:"name,omitempty"`
+	DisplayName string          `json:"displayName,omitempty"`
+	Emails      []SCIMEmail     `json:"emails,omitempty"`
+	Active      *bool           `json:"active,omitempty"`
+	Password    string          `json:"password,omitempty"`
+	Groups      []SCIMMemberRef `json:"groups,omitempty"`
+	Meta        *SCIMMeta       `json:"meta,omitempty"`
+}
+
+// SCIMGroupResource is the SCIM form of a group
+type SCIMGroupResource struct {
+	Schemas     []string        `json:"schemas"`
+	ID          string          `json:"id,omitempty"`
+	ExternalID  string          `json:"externalId,omitempty"`
+	DisplayName string          `json:"displayName"`
+	Members     []SCIMMemberRef `json:"members"`
+	Meta        *SCIMMeta       `json:"meta,omitempty"`
+}
+
+// SCIMListResponse is a page of resources
+type SCIMListResponse struct {
+	Schemas      []string      `json:"schemas"`
+	TotalResults int           `json:"totalResults"`
+	StartIndex   int           `json:"startIndex"`
+	ItemsPerPage int           `json:"itemsPerPage"`
+	Resources    []interface{} `json:"Resources"`
+}
+
+// SCIMListQuery holds the filter and page of a list request
+type SCIMListQuery struct {
+	Filter             string
+	StartIndex         int
+	Count              int
+	ExcludedAttributes string
+}
+
+// SCIMPatchRequest is a PATCH request body
+type SCIMPatchRequest struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []SCIMPatchOperation `json:"Operations"`
+}
+
+// SCIMPatchOperation is one operation of a PATCH request
+type SCIMPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// CreateSCIMTokenRequest represents SCIM token creation request
+type CreateSCIMTokenRequest struct {
+	Name string `json:"name" binding:"required"`
+}
+
+// CreatedSCIMToken is returned once, when a token is created; the token
+// cannot be retrieved again
+type CreatedSCIMToken struct {
+	*models.SCIMToken
+	Token string `json:"token"`
+}
+
+// SCIMService provisions an organization's users and groups for its
+// identity provider over SCIM 2.0
+type SCIMService struct {
+	BaseService
+	users *UserService
+	plans *PlanService
+	auth  *AuthService
+}
+
+// NewSCIMService creates a new SCIM service
+func NewSCIMService(db *gorm.DB, cfg *config.Config) *SCIMService {
+	return &SCIMService{
+		BaseService: NewBaseService(db, cfg, "scim"),
+		users:       NewUserService(db, cfg),
+		plans:       NewPlanService(db, cfg),
+		auth:        NewAuthService(db, cfg),
+	}
+}
+
+// SetAuthService replaces the auth service used to sign out deprovisioned
+// users, so that their revoked tokens land in the server's denylist
+func (s *SCIMService) SetAuthService(auth *AuthService) {
+	s.auth = auth
+}
+
+// ListTokens returns an organization's SCIM tokens
+func (s *SCIMService) ListTokens(orgID, userID string) ([]models.SCIMToken, error) {
+	if err := s.requireOrgAdmin(orgID, userID); err != nil {
+		return nil, err
+	}
+	var tokens []models.SCIMToken
+	err := s.db.Where("organization_id = ?", orgID).Order("created_at DESC").Find(&tokens).Error
+	return tokens, err
+}
+
+// CreateToken creates a SCIM token for an organization. The token acts for
+// the admin who created it, and stops working if they lose the role.
+func (s *SCIMService) CreateToken(orgID, userID string, req *CreateSCIMTokenRequest) (*CreatedSCIMToken, error) {
+	if err := s.requireOrgAdmin(orgID, userID); err != nil {
+		return nil, err
+	}
+
+	key, prefix, err := generateSCIMToken()
+	if err != nil {
+		return nil, err
+	}
+	token := &models.SCIMToken{
+		OrganizationID: orgID,
+		Name:           req.Name,
+		Prefix:         prefix,
+		TokenHash:      hashToken(key),
+		CreatedByID:    userID,
+	}
+	if err := s.db.Create(token).Error; err != nil {
+		return nil, err
+	}
+	return &CreatedSCIMToken{SCIMToken: token, Token: key}, nil
+}
+
+// RevokeToken revokes an organization's SCIM token
+func (s *SCIMService) RevokeToken(orgID, userID, tokenID string) (*models.SCIMToken, error) {
+	if err := s.requireOrgAdmin(orgID, userID); err != nil {
+		return nil, err
+	}
+	var token models.SCIMToken
+	if err := s.db.Where("id = ? AND organization_id = ?", tokenID, orgID).First(&token).Error; err != nil {
+		return nil, errors.New("SCIM token not found")
+	}
+	if token.RevokedAt == nil {
+		now := time.Now()
+		if err := s.db.Model(&token).Update("revoked_at", now).Error; err != nil {
+			return nil, err
+		}
+		token.RevokedAt = &now
+	}
+	return &token, nil
+}
+
+// Authenticate resolves a SCIM token
+func (s *SCIMService) Authenticate(key string) (*models.SCIMToken, error) {
+	if !strings.HasPrefix(key, SCIMTokenPrefix) {
+		return nil, ErrInvalidSCIMToken
+	}
+
+	var token models.SCIMToken
+	if err := s.db.First(&token, "token_hash = ?", hashToken(key)).Error; err != nil {
+		return nil, ErrInvalidSCIMToken
+	}
+	if token.RevokedAt != nil {
+		return nil, ErrInvalidSCIMToken
+	}
+	// Tokens stop working when their creator is no longer an active admin
+	// of the organization
+	if err := s.requireOrgAdmin(token.OrganizationID, token.CreatedByID); err != nil {
+		return nil, ErrInvalidSCIMToken
+	}
+
+	now := time.Now()
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) > apiKeyTouchInterval {
+		s.db.Model(&token).Update("last_used_at", now)
+	}
+	return &token, nil
+}
+
+// ServiceProviderConfig describes the SCIM features supported
+func (s *SCIMService) ServiceProviderConfig() map[string]interface{} {
+	unsupported := map[string]bool{"supported": false}
+	return map[string]interface{}{
+		"schemas":        []string{scimSchemaConfig},
+		"patch":          map[string]bool{"supported": true},
+		"bulk":           map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]interface{}{"supported": true, "maxResults": scimMaxResults},
+		"changePassword": unsupported,
+		"sort":           unsupported,
+		"etag":           unsupported,
+		"authenticationSchemes": []map[string]interface{}{{
+			"type":        "oauthbearertoken",
+			"name":        "OAuth Bearer Token",
+			"description": "Authentication with an organization's SCIM token",
+			"primary":     true,
+		}},
+	}
+}
+
+// ResourceTypes lists the SCIM resource types served
+func (s *SCIMService) ResourceTypes() *SCIMListResponse {
+	types := []interface{}{
+		map[string]interface{}{"schemas": []string{scimSchemaResourceType}, "id": "User", "name": "User", "endpoint": "/Users", "schema": scimSchemaUser},
+		map[string]interface{}{"schemas": []string{scimSchemaResourceType}, "id": "Group", "name": "Group", "endpoint": "/Groups", "schema": scimSchemaGroup},
+	}
+	return scimPage(types, &SCIMListQuery{})
+}
+
+// ListUsers returns the organization's users that match the query's filter
+func (s *SCIMService) ListUsers(token *models.SCIMToken, query *SCIMListQuery) (*SCIMListResponse, error) {
+	filter, err := s.parseFilter(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []models.User
+	if err := s.db.Where("organization_id = ?", token.OrganizationID).Order("created_at").Find(&users).Error; err != nil {
+		return nil, err
+	}
+	groups, err := s.userGroups(token.OrganizationID)
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []interface{}
+	for i := range users {
+		resource := s.toSCIMUser(&users[i], groups[users[i].ID])
+		if filter != nil && !filter.matches(toSCIMMap(resource)) {
+			continue
+		}
+		matched = append(matched, resource)
+	}
+	return scimPage(matched, query), nil
+}
+
+// GetUser returns one of the organization's users
+func (s *SCIMService) GetUser(token *models.SCIMToken, id string) (*SCIMUser, error) {
+	user, err := s.findUser(token.OrganizationID, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.userResource(user)
+}
+
+// CreateUser provisions a user into the organization
+func (s *SCIMService) CreateUser(token *models.SCIMToken, resource *SCIMUser) (*SCIMUser, error) {
+	if err := s.plans.CheckSeatQuota(token.OrganizationID); err != nil {
+		var quotaErr *QuotaError
+		if errors.As(err, &quotaErr) {
+			return nil, NewSCIMError(http.StatusForbidden, "", quotaErr.Message)
+		}
+		return nil, err
+	}
+
+	orgID := token.OrganizationID
+	user := &models.User{
+		Role:           s.defaultRole(orgID),
+		IsActive:       true,
+		EmailVerified:  true,
+		OrganizationID: &orgID,
+	}
+	if err := s.applyUser(user, resource); err != nil {
+		return nil, err
+	}
+	if err := s.db.Create(user).Error; err != nil {
+		return nil, err
+	}
+
+	// Accounts provisioned as inactive are deactivated like any other
+	if resource.Active != nil && !*resource.Active {
+		if err := s.setActive(token, user, false); err != nil {
+			return nil, err
+		}
+	}
+	return s.userResource(user)
+}
+
+// ReplaceUser replaces a user's attributes
+func (s *SCIMService) ReplaceUser(token *models.SCIMToken, id string, resource *SCIMUser) (*SCIMUser, error) {
+	user, err := s.findUser(token.OrganizationID, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.updateUser(token, user, resource)
+}
+
+// PatchUser modifies a user's attributes with PATCH operations
+func (s *SCIMService) PatchUser(token *models.SCIMToken, id string, req *SCIMPatchRequest) (*SCIMUser, error) {
+	user, err := s.findUser(token.OrganizationID, id)
+	if err != nil {
+		return nil, err
+	}
+	current, err := s.userResource(user)
+	if err != nil {
+		return nil, err
+	}
+
+	resource := toSCIMMap(current)
+	for i := range req.Operations {
+		if err := applySCIMPatch(resource, &req.Operations[i]); err != nil {
+			return nil, err
+		}
+	}
+	// Some identity providers send active as a string
+	if key := scimKey(resource, "active"); resource[key] != nil {
+		active, ok := scimBool(resource[key])
+		if !ok {
+			return nil, scimBadRequest("invalidValue", "active must be a boolean")
+		}
+		resource[key] = active
+	}
+
+	var patched SCIMUser
+	if err := fromSCIMMap(resource, &patched); err != nil {
+		return nil, err
+	}
+	return s.updateUser(token, user, &patched)
+}
+
+// DeleteUser removes a user from the organization. The account is
+// deactivated rather than deleted, keeping the agents and history it owns.
+func (s *SCIMService) DeleteUser(token *models.SCIMToken, id string) error {
+	user, err := s.findUser(token.OrganizationID, id)
+	if err != nil {
+		return err
+	}
+	if user.IsActive {
+		if err := s.setActive(token, user, false); err != nil {
+			return err
+		}
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", user.ID).Delete(&models.SCIMGroupMember{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(user).Updates(map[string]interface{}{"organization_id": nil, "role": "user"}).Error
+	})
+}
+
+// updateUser applies a full resource to an existing user
+func (s *SCIMService) updateUser(token *models.SCIMToken, user *models.User, resource *SCIMUser) (*SCIMUser, error) {
+	if err := s.applyUser(user, resource); err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(user).Updates(map[string]interface{}{
+		"username":         user.Username,
+		"email":            user.Email,
+		"first_name":       user.FirstName,
+		"last_name":        user.LastName,
+		"scim_external_id": user.SCIMExternalID,
+		"password_hash":    user.PasswordHash,
+	}).Error; err != nil {
+		return nil, err
+	}
+
+	if resource.Active != nil && *resource.Active != user.IsActive {
+		if err := s.setActive(token, user, *resource.Active); err != nil {
+			return nil, err
+		}
+	}
+	return s.userResource(user)
+}
+
+// applyUser copies a resource's attributes onto a user, checking that the
+// username and email are not taken by another account
+func (s *SCIMService) applyUser(user *models.User, resource *SCIMUser) error {
+	userName := strings.TrimSpace(resource.UserName)
+	if userName == "" {
+		return scimBadRequest("invalidValue", "userName is required")
+	}
+
+	email := ""
+	for _, e := range resource.Emails {
+		if e.Primary || email == "" {
+			email = e.Value
+		}
+	}
+	if email == "" && strings.Contains(userName, "@") {
+		email = userName
+	}
+	email = strings.ToLower(strings.TrimSpace(email))
+	if _, err := mail.ParseAddress(email); err != nil {
+		return scimBadRequest("invalidValue", "a valid email address is required")
+	}
+
+	var count int64
+	s.db.Model(&models.User{}).Where("username = ? AND id <> ?", userName, user.ID).Count(&count)
+	if count > 0 {
+		return scimConflict("userName is already taken")
+	}
+	s.db.Model(&models.User{}).Where("email = ? AND id <> ?", email, user.ID).Count(&count)
+	if count > 0 {
+		return scimConflict("an account with this email already exists")
+	}
+
+	user.Username = userName
+	user.Email = email
+	user.SCIMExternalID = resource.ExternalID
+	if resource.Name != nil && (resource.Name.GivenName != "" || resource.Name.FamilyName != "") {
+		user.FirstName, user.LastName = resource.Name.GivenName, resource.Name.FamilyName
+	} else if resource.DisplayName != "" {
+		user.FirstName, user.LastName, _ = strings.Cut(resource.DisplayName, " ")
+	}
+	if resource.Password != "" {
+		hashed, err := bcrypt.GenerateFromPassword([]byte(resource.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		user.PasswordHash = string(hashed)
+	}
+	return nil
+}
+
+// setActive activates or deactivates a user on behalf of the token's admin.
+// Deactivation also ends the user's sessions.
+func (s *SCIMService) setActive(token *models.SCIMToken, user *models.User, active bool) error {
+	if active {
+		if err := s.users.ActivateUser(user.ID, token.CreatedByID); err != nil {
+			return err
+		}
+	} else {
+		if err := s.users.DeactivateUser(user.ID, token.CreatedByID); err != nil {
+			return err
+		}
+		if err := s.auth.LogoutAll(user.ID); err != nil {
+			fmt.Printf("Failed to end sessions of deactivated user %s: %v\n", user.ID, err)
+		}
+	}
+	user.IsActive = active
+	return nil
+}
+
+// findUser loads a user of the organization
+func (s *SCIMService) findUser(orgID, id string) (*models.User, error) {
+	var user models.User
+	if err := s.db.Where("id = ? AND organization_id = ?", id, orgID).First(&user).Error; err != nil {
+		return nil, scimNotFound("User " + id)
+	}
+	return &user, nil
+}
+
+// userResource returns the SCIM form of a user, with their groups
+func (s *SCIMService) userResource(user *models.User) (*SCIMUser, error) {
+	var groups []models.SCIMGroup
+	err := s.db.Joins("JOIN scim_group_members ON scim_group_members.group_id = scim_groups.id").
+		Where("scim_group_members.user_id = ?", user.ID).
+		Find(&groups).Error
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]SCIMMemberRef, 0, len(groups))
+	for _, group := range groups {
+		refs = append(refs, SCIMMemberRef{Value: group.ID, Display: group.DisplayName})
+	}
+	return s.toSCIMUser(user, refs), nil
+}
+
+// userGroups returns the groups of each user of the organization
+func (s *SCIMService) userGroups(orgID string) (map[string][]SCIMMemberRef, error) {
+	var rows []struct {
+		UserID      string
+		GroupID     string
+		DisplayName string
+	}
+	err := s.db.Model(&models.SCIMGroupMember{}).
+		Select("scim_group_members.user_id, scim_groups.id AS group_id, scim_groups.display_name").
+		Joins("JOIN scim_groups ON scim_groups.id = scim_group_members.group_id").
+		Where("scim_groups.organization_id = ?", orgID).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	groups := make(map[string][]SCIMMemberRef)
+	for _, row := range rows {
+		groups[row.UserID] = append(groups[row.UserID], SCIMMemberRef{Value: row.GroupID, Display: row.DisplayName})
+	}
+	return groups, nil
+}
+
+func (s *SCIMService) toSCIMUser(user *models.User, groups []SCIMMemberRef) *SCIMUser {
+	active := user.IsActive
+	displayName := strings.TrimSpace(user.FirstName + " " + user.LastName)
+	return &SCIMUser{
+		Schemas:    []string{scimSchemaUser},
+		ID:         user.ID,
+		ExternalID: user.SCIMExternalID,
+		UserName:   user.Username,
+		Name: &SCIMName{
+			Formatted:  displayName,
+			GivenName:  user.FirstName,
+			FamilyName: user.LastName,
+		},
+		DisplayName: displayName,
+		Emails:      []SCIMEmail{{Value: user.Email, Type: "work", Primary: true}},
+		Active:      &active,
+		Groups:      groups,
+		Meta:        &SCIMMeta{ResourceType: "User", Created: user.CreatedAt, LastModified: user.UpdatedAt},
+	}
+}
+
+// ListGroups returns the organization's groups that match the query's filter
+func (s *SCIMService) ListGroups(token *models.SCIMToken, query *SCIMListQuery) (*SCIMListResponse, error) {
+	filter, err := s.parseFilter(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []models.SCIMGroup
+	if err := s.db.Where("organization_id = ?", token.OrganizationID).Order("display_name").Find(&groups).Error; err != nil {
+		return nil, err
+	}
+	withMembers := !strings.Contains(strings.ToLower(query.ExcludedAttributes), "members")
+
+	var matched []interface{}
+	for i := range groups {
+		resource, err := s.groupResource(&groups[i])
+		if err != nil {
+			return nil, err
+		}
+		if filter != nil && !filter.matches(toSCIMMap(resource)) {
+			continue
+		}
+		if !withMembers {
+			resource.Members = nil
+		}
+		matched = append(matched, resource)
+	}
+	return scimPage(matched, query), nil
+}
+
+// GetGroup returns one of the organization's groups
+func (s *SCIMService) GetGroup(token *models.SCIMToken, id string) (*SCIMGroupResource, error) {
+	group, err := s.findGroup(token.OrganizationID, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.groupResource(group)
+}
+
+// CreateGroup creates a group and adds its members
+func (s *SCIMService) CreateGroup(token *models.SCIMToken, resource *SCIMGroupResource) (*SCIMGroupResource, error) {
+	group := &models.SCIMGroup{OrganizationID: token.OrganizationID}
+	if err := s.saveGroup(group, resource); err != nil {
+		return nil, err
+	}
+	return s.groupResource(group)
+}
+
+// ReplaceGroup replaces a group's name and members
+func (s *SCIMService) ReplaceGroup(token *models.SCIMToken, id string, resource *SCIMGroupResource) (*SCIMGroupResource, error) {
+	group, err := s.findGroup(token.OrganizationID, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.saveGroup(group, resource); err != nil {
+		return nil, err
+	}
+	return s.groupResource(group)
+}
+
+// PatchGroup modifies a group's name and members with PATCH operations
+func (s *SCIMService) PatchGroup(token *models.SCIMToken, id string, req *SCIMPatchRequest) (*SCIMGroupResource, error) {
+	group, err := s.findGroup(token.OrganizationID, id)
+	if err != nil {
+		return nil, err
+	}
+	current, err := s.groupResource(group)
+	if err != nil {
+		return nil, err
+	}
+
+	resource := toSCIMMap(current)
+	for i := range req.Operations {
+		if err := applySCIMPatch(resource, &req.Operations[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	var patched SCIMGroupResource
+	if err := fromSCIMMap(resource, &patched); err != nil {
+		return nil, err
+	}
+	if err := s.saveGroup(group, &patched); err != nil {
+		return nil, err
+	}
+	return s.groupResource(group)
+}
+
+// DeleteGroup deletes a group, updating the roles of its former members
+func (s *SCIMService) DeleteGroup(token *models.SCIMToken, id string) error {
+	group, err := s.findGroup(token.OrganizationID, id)
+	if err != nil {
+		return err
+	}
+
+	var memberIDs []string
+	if err := s.db.Model(&models.SCIMGroupMember{}).Where("group_id = ?", group.ID).Pluck("user_id", &memberIDs).Error; err != nil {
+		return err
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("group_id = ?", group.ID).Delete(&models.SCIMGroupMember{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(group).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	if s.groupRole(group.OrganizationID, group.DisplayName) != "" {
+		return s.syncRoles(group.OrganizationID, memberIDs)
+	}
+	return nil
+}
+
+// saveGroup applies a resource's name and members to a group, then updates
+// the roles of the members whose role may have changed
+func (s *SCIMService) saveGroup(group *models.SCIMGroup, resource *SCIMGroupResource) error {
+	displayName := strings.TrimSpace(resource.DisplayName)
+	if displayName == "" {
+		return scimBadRequest("invalidValue", "displayName is required")
+	}
+	var count int64
+	s.db.Model(&models.SCIMGroup{}).
+		Where("organization_id = ? AND LOWER(display_name) = LOWER(?) AND id <> ?", group.OrganizationID, displayName, group.ID).
+		Count(&count)
+	if count > 0 {
+		return scimConflict("a group with this displayName already exists")
+	}
+
+	// Members must be users of the organization
+	wanted := make(map[string]bool, len(resource.Members))
+	for _, member := range resource.Members {
+		wanted[member.Value] = true
+	}
+	if len(wanted) > 0 {
+		ids := make([]string, 0, len(wanted))
+		for id := range wanted {
+			ids = append(ids, id)
+		}
+		var found int64
+		s.db.Model(&models.User{}).Where("id IN ? AND organization_id = ?", ids, group.OrganizationID).Count(&found)
+		if int(found) != len(ids) {
+			return scimBadRequest("invalidValue", "members must be users of the organization")
+		}
+	}
+
+	var current []string
+	if group.ID != "" {
+		if err := s.db.Model(&models.SCIMGroupMember{}).Where("group_id = ?", group.ID).Pluck("user_id", &current).Error; err != nil {
+			return err
+		}
+	}
+	var added, removed []string
+	for id := range wanted {
+		if !containsString(current, id) {
+			added = append(added, id)
+		}
+	}
+	for _, id := range current {
+		if !wanted[id] {
+			removed = append(removed, id)
+		}
+	}
+
+	oldName := group.DisplayName
+	group.DisplayName = displayName
+	group.ExternalID = resource.ExternalID
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(group).Error; err != nil {
+			return err
+		}
+		if len(removed) > 0 {
+			if err := tx.Where("group_id = ? AND user_id IN ?", group.ID, removed).Delete(&models.SCIMGroupMember{}).Error; err != nil {
+				return err
+			}
+		}
+		for _, userID := range added {
+			if err := tx.Create(&models.SCIMGroupMember{GroupID: group.ID, UserID: userID}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Only groups that map to a role affect roles, so that membership of
+	// other groups leaves roles alone
+	affected := append(added, removed...)
+	if oldName != displayName {
+		affected = append(current, added...)
+	}
+	if s.groupRole(group.OrganizationID, oldName) != "" || s.groupRole(group.OrganizationID, displayName) != "" {
+		return s.syncRoles(group.OrganizationID, affected)
+	}
+	return nil
+}
+
+// syncRoles sets each user's role to the highest role their groups map to,
+// or to the organization's default role
+func (s *SCIMService) syncRoles(orgID string, userIDs []string) error {
+	for _, userID := range userIDs {
+		var names []string
+		err := s.db.Model(&models.SCIMGroup{}).
+			Joins("JOIN scim_group_members ON scim_group_members.group_id = scim_groups.id").
+			Where("scim_group_members.user_id = ? AND scim_groups.organization_id = ?", userID, orgID).
+			Pluck("scim_groups.display_name", &names).Error
+		if err != nil {
+			return err
+		}
+
+		role := s.defaultRole(orgID)
+		for _, name := range names {
+			if mapped := s.groupRole(orgID, name); roleRank[mapped] > roleRank[role] {
+				role = mapped
+			}
+		}
+		if err := s.db.Model(&models.User{}).
+			Where("id = ? AND organization_id = ?", userID, orgID).
+			Update("role", role).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// groupRole returns the role a group maps to: through the role mappings of
+// the organization's single sign-on connection, or by being named after a
+// role. It returns "" for groups that map to no role.
+func (s *SCIMService) groupRole(orgID, name string) string {
+	if conn := s.ssoConnection(orgID); conn != nil {
+		if role, ok := conn.RoleMappings[name]; ok {
+			return role
+		}
+	}
+	if _, ok := roleRank[strings.ToLower(name)]; ok {
+		return strings.ToLower(name)
+	}
+	return ""
+}
+
+// defaultRole returns the role of users in no role-mapped group
+func (s *SCIMService) defaultRole(orgID string) string {
+	if conn := s.ssoConnection(orgID); conn != nil && conn.DefaultRole != "" {
+		return conn.DefaultRole
+	}
+	return "user"
+}
+
+// ssoConnection returns the organization's single sign-on connection, or nil
+func (s *SCIMService) ssoConnection(orgID string) *models.SSOConnection {
+	var conn models.SSOConnection
+	if err := s.db.Where("organization_id = ?", orgID).First(&conn).Error; err != nil {
+		return nil
+	}
+	return &conn
+}
+
+// findGroup loads a group of the organization
+func (s *SCIMService) findGroup(orgID, id string) (*models.SCIMGroup, error) {
+	var group models.SCIMGroup
+	if err := s.db.Where("id = ? AND organization_id = ?", id, orgID).First(&group).Error; err != nil {
+		return nil, scimNotFound("Group " + id)
+	}
+	return &group, nil
+}
+
+// groupResource returns the SCIM form of a group, with its members
+func (s *SCIMService) groupResource(group *models.SCIMGroup) (*SCIMGroupResource, error) {
+	var members []models.User
+	err := s.db.Joins("JOIN scim_group_members ON scim_group_members.user_id = users.id").
+		Where("scim_group_members.group_id = ?", group.ID).
+		Order("users.username").
+		Find(&members).Error
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]SCIMMemberRef, 0, len(members))
+	for _, member := range members {
+		refs = append(refs, SCIMMemberRef{Value: member.ID, Display: member.Username})
+	}
+	return &SCIMGroupResource{
+		Schemas:     []string{scimSchemaGroup},
+		ID:          group.ID,
+		ExternalID:  group.ExternalID,
+		DisplayName: group.DisplayName,
+		Members:     refs,
+		Meta:        &SCIMMeta{ResourceType: "Group", Created: group.CreatedAt, LastModified: group.UpdatedAt},
+	}, nil
+}
+
+// parseFilter parses a list query's filter, if any
+func (s *SCIMService) parseFilter(query *SCIMListQuery) (scimFilter, error) {
+	if strings.TrimSpace(query.Filter) == "" {
+		return nil, nil
+	}
+	filter, err := parseSCIMFilter(query.Filter)
+	if err != nil {
+		return nil, scimBadRequest("invalidFilter", err.Error())
+	}
+	return filter, nil
+}
+
+// requireOrgAdmin checks that the user is an active admin of the organization
+func (s *SCIMService) requireOrgAdmin(orgID, userID string) error {
+	var user models.User
+	if err := s.db.First(&user, "id = ?", userID).Error; err != nil {
+		return errors.New("user not found")
+	}
+	if !user.IsActive || user.OrganizationID == nil || *user.OrganizationID != orgID || user.Role != "admin" {
+		return errors.New("unauthorized to manage provisioning for this organization")
+	}
+	return nil
+}
+
+// scimPage returns a page of resources; startIndex is 1-based
+func scimPage(resources []interface{}, query *SCIMListQuery) *SCIMListResponse {
+	start := query.StartIndex
+	if start < 1 {
+		start = 1
+	}
+	count := query.Count
+	if count <= 0 || count > scimMaxResults {
+		count = scimMaxResults
+	}
+
+	page := []interface{}{}
+	if start <= len(resources) {
+		end := start - 1 + count
+		if end > len(resources) {
+			end = len(resources)
+		}
+		page = resources[start-1 : end]
+	}
+	return &SCIMListResponse{
+		Schemas:      []string{scimSchemaListResponse},
+		TotalResults: len(resources),
+		StartIndex:   start,
+		ItemsPerPage: len(page),
+		Resources:    page,
+	}
+}
+
+// toSCIMMap returns the JSON form of a resource, for filtering and patching
+func toSCIMMap(resource interface{}) map[string]interface{} {
+	data, _ := json.Marshal(resource)
+	var m map[string]interface{}
+	json.Unmarshal(data, &m)
+	return m
+}
+
+// fromSCIMMap decodes a resource from its JSON form
+func fromSCIMMap(m map[string]interface{}, resource interface{}) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, resource); err != nil {
+		return scimBadRequest("invalidValue", "invalid attribute value: "+err.Error())
+	}
+	return nil
+}
+
+// generateSCIMToken returns a new token and its displayable prefix
+func generateSCIMToken() (string, string, error) {
+	key, prefix, err := generateAPIKey()
+	if err != nil {
+		return "", "", err
+	}
+	return SCIMTokenPrefix + strings.TrimPrefix(key, APIKeyPrefix), SCIMTokenPrefix + strings.TrimPrefix(prefix, APIKeyPrefix), nil
+}
@@ -0,0 +1,321 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// maxScriptStderrBytes is how much of a script's stderr is kept for the error message
+const maxScriptStderrBytes = 16 << 10
+
+// scriptWaitDelay is how long to wait for a killed script's output pipes to close
+const scriptWaitDelay = 5 * time.Second
+
+// scriptInterpreters maps script extensions to the interpreter that runs them
+var scriptInterpreters = map[string]string{
+	".py": "python3",
+	".js": "node",
+	".sh": "sh",
+}
+
+// errScriptOutputTooLarge is the cause recorded when a script writes too much output
+var errScriptOutputTooLarge = errors.New("script output limit exceeded")
+
+// ScriptLimits represents the resource limits applied to a script process
+type ScriptLimits struct {
+	MemoryBytes uint64
+	CPUSeconds  uint64
+	Processes   uint64
+}
+
+// ScriptExecutor runs agents whose ExecutablePath points at a script or binary.
+// The agent receives its input as JSON on stdin and must write a JSON result
+// to stdout.
+type ScriptExecutor struct {
+	cfg config.ScriptsConfig
+}
+
+// NewScriptExecutor creates a new subprocess executor
+func NewScriptExecutor(cfg *config.Config) *ScriptExecutor {
+	return &ScriptExecutor{cfg: cfg.Scripts}
+}
+
+// IsScriptAgent reports whether the agent runs as a subprocess rather than through an LLM
+func IsScriptAgent(agent *models.Agent) bool {
+	return agent.ExecutablePath != ""
+}
+
+// Execute runs the agent's script with the input on stdin
+func (e *ScriptExecutor) Execute(ctx context.Context, agent *models.Agent, input map[string]interface{}) (*ExecutionResult, error) {
+	name, args, err := e.command(agent)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := json.Marshal(input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode input: %v", err)
+	}
+
+	workDir, err := os.MkdirTemp("", "vagais-agent-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create working directory: %v", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	reporter := ExecutionReporterFrom(ctx)
+	limits := e.limits(ctx, agent)
+
+	// Stop the script as soon as it writes more than we are willing to keep
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	stdout := &cappedBuffer{max: e.maxOutput(), onExceed: func() { cancel(errScriptOutputTooLarge) }}
+	stderr := &cappedBuffer{max: maxScriptStderrBytes}
+
+	cmd, err := sandboxCommand(ctx, e.cfg, workDir, name, args, limits)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Env = scriptEnvironment(workDir, agent, reporter.ExecutionID())
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.WaitDelay = scriptWaitDelay
+
+	reporter.Log("Starting %s", filepath.Base(name))
+	startTime := time.Now()
+
+	if err := cmd.Start(); err != nil {
+		return nil, sandboxStartError(e.cfg, err)
+	}
+	err = cmd.Wait()
+
+	reporter.Log("Script exited after %s", time.Since(startTime).Round(time.Millisecond))
+	if stderr.buf.Len() > 0 {
+		reporter.Log("Script stderr: %s", stderr.String())
+	}
+
+	if errors.Is(context.Cause(ctx), errScriptOutputTooLarge) {
+		return nil, fmt.Errorf("agent script wrote more than %d bytes of output", stdout.max)
+	}
+	if err != nil {
+		// Context errors are reported by the caller, which knows why the run was aborted
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, scriptExitError(err, stderr.String())
+	}
+
+	output, err := decodeScriptOutput(stdout.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return &ExecutionResult{Output: output}, nil
+}
+
+// command resolves the program and arguments used to run the agent
+func (e *ScriptExecutor) command(agent *models.Agent) (string, []string, error) {
+	// An interpreter name runs the agent's file, e.g. executable_path "python3" with file_path "main.py"
+	if e.isInterpreter(agent.ExecutablePath) {
+		if agent.FilePath == "" {
+			return "", nil, errors.New("agent has no script file configured")
+		}
+		program, err := exec.LookPath(agent.ExecutablePath)
+		if err != nil {
+			return "", nil, fmt.Errorf("interpreter %s is not installed", agent.ExecutablePath)
+		}
+		script, err := e.resolve(agent.FilePath)
+		if err != nil {
+			return "", nil, err
+		}
+		return program, []string{script}, nil
+	}
+
+	path, err := e.resolve(agent.ExecutablePath)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Scripts are run through their interpreter so they need not be executable
+	if interpreter, ok := scriptInterpreters[strings.ToLower(filepath.Ext(path))]; ok && e.isInterpreter(interpreter) {
+		program, err := exec.LookPath(interpreter)
+		if err != nil {
+			return "", nil, fmt.Errorf("interpreter %s is not installed", interpreter)
+		}
+		return program, []string{path}, nil
+	}
+	return path, nil, nil
+}
+
+// isInterpreter reports whether name is one of the configured interpreters
+func (e *ScriptExecutor) isInterpreter(name string) bool {
+	for _, interpreter := range e.cfg.Interpreters {
+		if name == interpreter {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the absolute path of an agent file, which must lie inside the scripts directory
+func (e *ScriptExecutor) resolve(path string) (string, error) {
+	root, err := filepath.Abs(e.cfg.Dir)
+	if err != nil {
+		return "", err
+	}
+
+	full := filepath.Clean(filepath.Join(root, path))
+	if filepath.IsAbs(path) {
+		full = filepath.Clean(path)
+	}
+	rel, err := filepath.Rel(root, full)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("agent file %s is outside the scripts directory", path)
+	}
+
+	info, err := os.Stat(full)
+	if err != nil {
+		return "", fmt.Errorf("agent file %s not found", path)
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("agent file %s is a directory", path)
+	}
+	return full, nil
+}
+
+// limits combines the server's maxima with the agent's own, stricter, resource limits
+func (e *ScriptExecutor) limits(ctx context.Context, agent *models.Agent) ScriptLimits {
+	agentLimits := ParseAgentRuntimeConfig(agent).ResourceLimits
+
+	memoryMB := e.cfg.MaxMemoryMB
+	if agentLimits.MaxMemory > 0 && (memoryMB <= 0 || agentLimits.MaxMemory < memoryMB) {
+		memoryMB = agentLimits.MaxMemory
+	}
+
+	cpuSeconds := e.cfg.MaxCPUSeconds
+	// A limit in cores allows that many CPU seconds per second of wall-clock time
+	if deadline, ok := ctx.Deadline(); ok && agentLimits.MaxCPU > 0 {
+		budget := int(math.Ceil(agentLimits.MaxCPU * time.Until(deadline).Seconds()))
+		if budget < 1 {
+			budget = 1
+		}
+		if cpuSeconds <= 0 || budget < cpuSeconds {
+			cpuSeconds = budget
+		}
+	}
+
+	var limits ScriptLimits
+	if e.cfg.MaxProcesses > 0 {
+		limits.Processes = uint64(e.cfg.MaxProcesses)
+	}
+	if memoryMB > 0 {
+		limits.MemoryBytes = uint64(memoryMB) << 20
+	}
+	if cpuSeconds > 0 {
+		limits.CPUSeconds = uint64(cpuSeconds)
+	}
+	return limits
+}
+
+func (e *ScriptExecutor) maxOutput() int {
+	if e.cfg.MaxOutputBytes <= 0 {
+		return 1 << 20
+	}
+	return int(e.cfg.MaxOutputBytes)
+}
+
+// scriptEnvironment builds the environment of a script; nothing is inherited from the server
+func scriptEnvironment(workDir string, agent *models.Agent, executionID string) []string {
+	return []string{
+		"PATH=/usr/local/bin:/usr/bin:/bin",
+		"HOME=" + workDir,
+		"TMPDIR=" + workDir,
+		"LANG=C.UTF-8",
+		"VAGAIS_AGENT_ID=" + agent.ID,
+		"VAGAIS_AGENT_VERSION=" + agent.Version,
+		"VAGAIS_EXECUTION_ID=" + executionID,
+	}
+}
+
+// scriptExitError describes a failed script run, including what it wrote to stderr
+func scriptExitError(err error, stderr string) error {
+	var exitErr *exec.ExitError
+	message := err.Error()
+	if errors.As(err, &exitErr) {
+		message = fmt.Sprintf("agent script exited with status %d", exitErr.ExitCode())
+		if exitErr.ExitCode() < 0 {
+			message = fmt.Sprintf("agent script was terminated (%s)", exitErr.String())
+		}
+	}
+	if stderr = strings.TrimSpace(stderr); stderr != "" {
+		message += ": " + stderr
+	}
+	return errors.New(message)
+}
+
+// decodeScriptOutput parses a script's stdout; non-object results are wrapped as {"result": value}
+func decodeScriptOutput(data []byte) (map[string]interface{}, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, errors.New("agent script produced no output")
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, fmt.Errorf("agent script output is not valid JSON: %v", err)
+	}
+	if output, ok := value.(map[string]interface{}); ok {
+		return output, nil
+	}
+	return map[string]interface{}{"result": value}, nil
+}
+
+// cappedBuffer keeps at most max bytes and calls onExceed once when more are
+// written. It deliberately does not embed bytes.Buffer, whose ReadFrom would
+// let io.Copy bypass the cap.
+type cappedBuffer struct {
+	buf      bytes.Buffer
+	max      int
+	exceeded bool
+	onExceed func()
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.buf.Len(); room < len(p) {
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		if !b.exceeded {
+			b.exceeded = true
+			if b.onExceed != nil {
+				b.onExceed()
+			}
+		}
+		// Discard the rest so the process is not blocked on a full pipe
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+// Bytes returns the data kept so far
+func (b *cappedBuffer) Bytes() []byte {
+	return b.buf.Bytes()
+}
+
+// String returns the data kept so far as a string
+func (b *cappedBuffer) String() string {
+	return b.buf.String()
+}
@@ -0,0 +1,178 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// newScriptTest returns an executor whose scripts directory holds the given
+// files, readable by the unprivileged user scripts run as
+func newScriptTest(t *testing.T, files map[string]string) *ScriptExecutor {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "vagais-scripts-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := os.Chmod(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &ScriptExecutor{cfg: config.ScriptsConfig{
+		Dir:            dir,
+		Interpreters:   []string{"sh"},
+		MaxMemoryMB:    512,
+		MaxCPUSeconds:  10,
+		MaxOutputBytes: 1024,
+		MaxProcesses:   64,
+		UID:            65534,
+		GID:            65534,
+	}}
+}
+
+func TestScriptCommand(t *testing.T) {
+	e := newScriptTest(t, map[string]string{"echo.sh": "cat", "lib/tool.py": "print(1)"})
+	sh := e.cfg.Dir + "/echo.sh"
+
+	tests := []struct {
+		name       string
+		executable string
+		file       string
+		wantArgs   []string
+		err        string
+	}{
+		{name: "script by extension", executable: "echo.sh", wantArgs: []string{sh}},
+		{name: "interpreter and file", executable: "sh", file: "echo.sh", wantArgs: []string{sh}},
+		{name: "absolute path inside the directory", executable: sh, wantArgs: []string{sh}},
+		{name: "interpreter without a file", executable: "sh", err: "no script file"},
+		{name: "parent directory", executable: "../echo.sh", err: "outside the scripts directory"},
+		{name: "absolute path outside", executable: "/bin/sh", err: "outside the scripts directory"},
+		{name: "missing file", executable: "missing.sh", err: "not found"},
+		{name: "directory", executable: "lib", err: "is a directory"},
+		// Only the configured interpreters are looked up on the PATH
+		{name: "interpreter not allowed", executable: "python3", file: "lib/tool.py", err: "agent file python3 not found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, args, err := e.command(&models.Agent{ExecutablePath: tt.executable, FilePath: tt.file})
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("command() error = %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("command() error = %v", err)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("command() args = %v, want %v", args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestScriptLimits(t *testing.T) {
+	e := newScriptTest(t, nil)
+	agent := func(limits string) *models.Agent {
+		return &models.Agent{Config: models.JSON(`{"resource_limits":` + limits + `}`)}
+	}
+
+	// The server's maxima apply unless the agent asks for less
+	if got := e.limits(context.Background(), agent(`{}`)); got.MemoryBytes != 512<<20 || got.CPUSeconds != 10 || got.Processes != 64 {
+		t.Errorf("limits() = %+v, want the server maxima", got)
+	}
+	if got := e.limits(context.Background(), agent(`{"max_memory":2048}`)); got.MemoryBytes != 512<<20 {
+		t.Errorf("limits() memory = %d, want the server maximum", got.MemoryBytes)
+	}
+	if got := e.limits(context.Background(), agent(`{"max_memory":64}`)); got.MemoryBytes != 64<<20 {
+		t.Errorf("limits() memory = %d, want the agent's 64 MB", got.MemoryBytes)
+	}
+
+	// A core limit is a CPU time budget over the time left to run
+	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
+	defer cancel()
+	if got := e.limits(ctx, agent(`{"max_cpu":0.5}`)); got.CPUSeconds != 2 {
+		t.Errorf("limits() CPU = %d seconds, want 2", got.CPUSeconds)
+	}
+	if got := e.limits(ctx, agent(`{"max_cpu":8}`)); got.CPUSeconds != 10 {
+		t.Errorf("limits() CPU = %d seconds, want the server maximum of 10", got.CPUSeconds)
+	}
+}
+
+func TestDecodeScriptOutput(t *testing.T) {
+	tests := []struct {
+		output string
+		want   map[string]interface{}
+		err    string
+	}{
+		{output: `{"answer": 42}`, want: map[string]interface{}{"answer": float64(42)}},
+		{output: "  \"hi\"\n", want: map[string]interface{}{"result": "hi"}},
+		{output: `[1, 2]`, want: map[string]interface{}{"result": []interface{}{float64(1), float64(2)}}},
+		{output: "", err: "produced no output"},
+		{output: "hello", err: "not valid JSON"},
+	}
+
+	for _, tt := range tests {
+		got, err := decodeScriptOutput([]byte(tt.output))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("decodeScriptOutput(%q) error = %v, want one containing %q", tt.output, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("decodeScriptOutput(%q) = %v, %v, want %v", tt.output, got, err, tt.want)
+		}
+	}
+}
+
+func TestCappedBuffer(t *testing.T) {
+	exceeded := 0
+	b := &cappedBuffer{max: 5, onExceed: func() { exceeded++ }}
+	for _, chunk := range []string{"abc", "defg", "hij"} {
+		if n, err := b.Write([]byte(chunk)); n != len(chunk) || err != nil {
+			t.Errorf("Write(%q) = %d, %v, want everything taken", chunk, n, err)
+		}
+	}
+	if b.String() != "abcde" || exceeded != 1 {
+		t.Errorf("buffer = %q after %d exceeds, want \"abcde\" after 1", b.String(), exceeded)
+	}
+}
+
+func TestScriptEnvironment(t *testing.T) {
+	t.Setenv("JWT_SECRET", "server-secret")
+	env := scriptEnvironment("/tmp/work", &models.Agent{BaseModel: models.BaseModel{ID: "agent-1"}, Version: "1.2.0"}, "exec-1")
+
+	// Nothing is inherited from the server's environment
+	for _, v := range env {
+		if strings.Contains(v, "server-secret") {
+			t.Errorf("script environment holds %s", v)
+		}
+	}
+	for _, want := range []string{"HOME=/tmp/work", "VAGAIS_AGENT_ID=agent-1", "VAGAIS_AGENT_VERSION=1.2.0", "VAGAIS_EXECUTION_ID=exec-1"} {
+		found := false
+		for _, v := range env {
+			found = found || v == want
+		}
+		if !found {
+			t.Errorf("script environment %v lacks %s", env, want)
+		}
+	}
+}
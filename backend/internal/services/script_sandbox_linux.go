@@ -0,0 +1,140 @@
+//go:build linux
+
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/mlaitechio/vagais/internal/config"
+)
+
+// scriptSandboxArg marks the server re-executing itself to start a script.
+// The child lowers its rlimits and then execs the script, so the limits are
+// in force before the script runs its first instruction.
+const scriptSandboxArg = "__vagais_script_sandbox"
+
+// scriptSandboxExitCode is the status the sandbox exits with when it cannot
+// apply the limits or start the script
+const scriptSandboxExitCode = 126
+
+func init() {
+	if len(os.Args) > 1 && os.Args[1] == scriptSandboxArg {
+		runScriptSandbox(os.Args[2:])
+	}
+}
+
+// sandboxCommand builds the command that runs a script in the sandbox: as the
+// configured unprivileged user, in its own process group, with its rlimits
+// applied before exec. The working directory is handed over to that user.
+func sandboxCommand(ctx context.Context, cfg config.ScriptsConfig, workDir, name string, args []string, limits ScriptLimits) (*exec.Cmd, error) {
+	if cfg.UID <= 0 || cfg.GID <= 0 {
+		return nil, errors.New("agent scripts must run as an unprivileged user; set AGENT_SCRIPT_UID and AGENT_SCRIPT_GID")
+	}
+	if cfg.UID == os.Getuid() {
+		return nil, errors.New("agent scripts must not run as the server's own user")
+	}
+	if err := os.Chown(workDir, cfg.UID, cfg.GID); err != nil {
+		return nil, fmt.Errorf("failed to prepare the script working directory: %v", err)
+	}
+
+	sandboxArgs := []string{
+		scriptSandboxArg,
+		strconv.FormatUint(limits.MemoryBytes, 10),
+		strconv.FormatUint(limits.CPUSeconds, 10),
+		strconv.FormatUint(limits.Processes, 10),
+		name,
+	}
+	cmd := exec.CommandContext(ctx, "/proc/self/exe", append(sandboxArgs, args...)...)
+	cmd.Dir = workDir
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid:   true,
+		Pdeathsig: syscall.SIGKILL,
+		Credential: &syscall.Credential{
+			Uid:    uint32(cfg.UID),
+			Gid:    uint32(cfg.GID),
+			Groups: []uint32{},
+		},
+	}
+	// Cancelling the run kills everything the script started
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	return cmd, nil
+}
+
+// sandboxStartError explains why the sandbox could not be started
+func sandboxStartError(cfg config.ScriptsConfig, err error) error {
+	if errors.Is(err, syscall.EPERM) {
+		return fmt.Errorf("failed to start agent script: the server may not switch to uid %d (needs CAP_SETUID and CAP_SETGID): %v", cfg.UID, err)
+	}
+	return fmt.Errorf("failed to start agent script: %v", err)
+}
+
+// runScriptSandbox runs in the re-executed child: it applies the limits
+// passed on the command line and replaces itself with the script. It never
+// returns.
+func runScriptSandbox(args []string) {
+	fail := func(format string, a ...interface{}) {
+		fmt.Fprintf(os.Stderr, "sandbox: "+format+"\n", a...)
+		os.Exit(scriptSandboxExitCode)
+	}
+	if len(args) < 4 {
+		fail("missing arguments")
+	}
+
+	var limits ScriptLimits
+	for i, limit := range []*uint64{&limits.MemoryBytes, &limits.CPUSeconds, &limits.Processes} {
+		value, err := strconv.ParseUint(args[i], 10, 64)
+		if err != nil {
+			fail("invalid limit %q", args[i])
+		}
+		*limit = value
+	}
+	if err := applyScriptLimits(limits); err != nil {
+		fail("failed to apply resource limits: %v", err)
+	}
+
+	program := args[3]
+	if err := unix.Exec(program, args[3:], os.Environ()); err != nil {
+		fail("failed to run %s: %v", program, err)
+	}
+}
+
+// applyScriptLimits sets the rlimits of the current process, which the script
+// inherits; an unprivileged process cannot raise them again
+func applyScriptLimits(limits ScriptLimits) error {
+	set := func(resource int, name string, value uint64) error {
+		if err := unix.Setrlimit(resource, &unix.Rlimit{Cur: value, Max: value}); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		return nil
+	}
+
+	if err := set(unix.RLIMIT_CORE, "RLIMIT_CORE", 0); err != nil {
+		return err
+	}
+	if limits.MemoryBytes > 0 {
+		if err := set(unix.RLIMIT_AS, "RLIMIT_AS", limits.MemoryBytes); err != nil {
+			return err
+		}
+	}
+	if limits.CPUSeconds > 0 {
+		if err := set(unix.RLIMIT_CPU, "RLIMIT_CPU", limits.CPUSeconds); err != nil {
+			return err
+		}
+	}
+	if limits.Processes > 0 {
+		if err := set(unix.RLIMIT_NPROC, "RLIMIT_NPROC", limits.Processes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
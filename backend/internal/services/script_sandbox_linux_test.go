@@ -0,0 +1,119 @@
+//go:build linux
+
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// runScript runs the agent script at path in the sandbox with input
+func runScript(t *testing.T, e *ScriptExecutor, ctx context.Context, path string, input map[string]interface{}) (*ExecutionResult, error) {
+	t.Helper()
+	if os.Getuid() != 0 {
+		t.Skip("running scripts as another user needs root")
+	}
+	return e.Execute(ctx, &models.Agent{BaseModel: models.BaseModel{ID: "agent-1"}, ExecutablePath: path}, input)
+}
+
+func TestSandboxCommandRefusesPrivilegedUsers(t *testing.T) {
+	e := newScriptTest(t, nil)
+	for _, uid := range []int{0, os.Getuid()} {
+		cfg := e.cfg
+		cfg.UID = uid
+		if _, err := sandboxCommand(context.Background(), cfg, t.TempDir(), "/bin/sh", nil, ScriptLimits{}); err == nil {
+			t.Errorf("sandboxCommand() as uid %d error = nil, want an error", uid)
+		}
+	}
+}
+
+func TestScriptSandbox(t *testing.T) {
+	// A file only the server's user may read
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secret, []byte("key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	e := newScriptTest(t, map[string]string{
+		"echo.sh":   `read line; printf '{"input": %s, "uid": "%s", "home": "%s"}' "$line" "$(id -u)" "$HOME"`,
+		"limits.sh": `printf '{"limits": "%s"}' "$(tr -s ' ' </proc/self/limits | tr '\n' ';')"`,
+		"fail.sh":   `echo "bad input" >&2; exit 3`,
+		"flood.sh":  `while true; do echo xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx; done`,
+		"sleep.sh":  `sleep 30 & sleep 30; echo '{}'`,
+		"escape.sh": `cat ` + secret + ` >/dev/null 2>&1 && echo '{"read": true}' || echo '{"read": false}'`,
+	})
+
+	t.Run("input and output", func(t *testing.T) {
+		result, err := runScript(t, e, context.Background(), "echo.sh", map[string]interface{}{"message": "hi"})
+		if err != nil {
+			t.Fatalf("Execute() error = %v", err)
+		}
+		input, _ := result.Output["input"].(map[string]interface{})
+		if input["message"] != "hi" {
+			t.Errorf("script read %v, want the input", result.Output["input"])
+		}
+		// The script runs as the configured user in its own working directory
+		if result.Output["uid"] != "65534" {
+			t.Errorf("script ran as uid %v, want 65534", result.Output["uid"])
+		}
+		if home, _ := result.Output["home"].(string); !strings.Contains(home, "vagais-agent-") {
+			t.Errorf("script home = %q, want its working directory", home)
+		}
+	})
+
+	t.Run("limits applied before the script starts", func(t *testing.T) {
+		result, err := runScript(t, e, context.Background(), "limits.sh", nil)
+		if err != nil {
+			t.Fatalf("Execute() error = %v", err)
+		}
+		limits, _ := result.Output["limits"].(string)
+		for _, want := range []string{"Max cpu time 10 10 seconds", "Max processes 64 64 processes", "Max address space 536870912 536870912 bytes", "Max core file size 0 0 bytes"} {
+			if !strings.Contains(limits, want) {
+				t.Errorf("script limits %q lack %q", limits, want)
+			}
+		}
+	})
+
+	t.Run("exit status and stderr", func(t *testing.T) {
+		_, err := runScript(t, e, context.Background(), "fail.sh", nil)
+		if err == nil || !strings.Contains(err.Error(), "exited with status 3: bad input") {
+			t.Errorf("Execute() error = %v, want the exit status and stderr", err)
+		}
+	})
+
+	t.Run("output limit", func(t *testing.T) {
+		_, err := runScript(t, e, context.Background(), "flood.sh", nil)
+		if err == nil || !strings.Contains(err.Error(), "more than 1024 bytes") {
+			t.Errorf("Execute() error = %v, want the output limit", err)
+		}
+	})
+
+	t.Run("cancel kills the process group", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		if _, err := runScript(t, e, ctx, "sleep.sh", nil); err != context.DeadlineExceeded {
+			t.Errorf("Execute() error = %v, want context.DeadlineExceeded", err)
+		}
+		// A child left running would hold the output open until scriptWaitDelay
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("Execute() returned after %s, want it to stop at the deadline", elapsed)
+		}
+	})
+
+	t.Run("server files are out of reach", func(t *testing.T) {
+		result, err := runScript(t, e, context.Background(), "escape.sh", nil)
+		if err != nil {
+			t.Fatalf("Execute() error = %v", err)
+		}
+		if result.Output["read"] != false {
+			t.Error("script read a file private to the server's user")
+		}
+	})
+}
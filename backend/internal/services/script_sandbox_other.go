@@ -0,0 +1,23 @@
+//go:build !linux
+
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+
+	"github.com/mlaitechio/vagais/internal/config"
+)
+
+// sandboxCommand refuses to run scripts outside Linux, where their resource
+// limits and user could not be enforced
+func sandboxCommand(ctx context.Context, cfg config.ScriptsConfig, workDir, name string, args []string, limits ScriptLimits) (*exec.Cmd, error) {
+	return nil, errors.New("script agents are only supported on Linux, where their resource limits can be enforced")
+}
+
+// sandboxStartError explains why the sandbox could not be started
+func sandboxStartError(cfg config.ScriptsConfig, err error) error {
+	return fmt.Errorf("failed to start agent script: %v", err)
+}
@@ -15,19 +15,64 @@ var (
 	RuntimeServiceInstance      *RuntimeService
 	IntegrationServiceInstance  *IntegrationService
 	NotificationServiceInstance *NotificationService
+	ConversationServiceInstance *ConversationService
+	CreditServiceInstance       *CreditService
+	PurchaseServiceInstance     *PurchaseService
+	PaymentServiceInstance      *PaymentService
+	PlanServiceInstance         *PlanService
+	BillingServiceInstance      *BillingService
+	BillingJobInstance          *BillingJob
+	EarningsServiceInstance     *EarningsService
+	LicenseServiceInstance      *LicenseService
+	APIKeyServiceInstance       *APIKeyService
+	EmailServiceInstance        *EmailService
+	SSOServiceInstance          *SSOService
+	SCIMServiceInstance         *SCIMService
+	ExecutionEventBusInstance   *ExecutionEventBus
+	ExecutionWorkerPoolInstance *ExecutionWorkerPool
+
+	// RedisClient is the shared Redis connection, nil when Redis is unavailable
+	RedisClient *redis.Client
 )
 
 // InitializeServices initializes all services with graceful fallbacks
 func InitializeServices(db *gorm.DB, redisClient *redis.Client, cfg *config.Config) {
+	RedisClient = redisClient
+
 	// Initialize core services
 	AuthServiceInstance = NewAuthService(db, cfg)
+	if redisClient != nil {
+		AuthServiceInstance.SetDenylist(NewRedisTokenDenylist(redisClient))
+	}
 	UserServiceInstance = NewUserService(db, cfg)
 	AgentServiceInstance = NewAgentService(db, cfg)
 	MarketplaceServiceInstance = NewMarketplaceService(db, cfg)
+	ExecutionEventBusInstance = NewExecutionEventBus(redisClient)
 	RuntimeServiceInstance = NewRuntimeService(db, cfg)
+	RuntimeServiceInstance.SetEventBus(ExecutionEventBusInstance)
+	if cfg.Queue.Backend == "redis" && redisClient != nil {
+		RuntimeServiceInstance.SetQueue(NewRedisJobQueue(db, redisClient))
+	}
+	ExecutionWorkerPoolInstance = NewExecutionWorkerPool(RuntimeServiceInstance, cfg)
 	IntegrationServiceInstance = NewIntegrationService(db, cfg)
+	ConversationServiceInstance = NewConversationService(db, cfg)
+	CreditServiceInstance = NewCreditService(db, cfg)
+	PurchaseServiceInstance = NewPurchaseService(db, cfg)
+	PaymentServiceInstance = NewPaymentService(db, cfg)
+	PaymentServiceInstance.OnPaymentSettled(PurchaseServiceInstance.HandlePaymentSettled)
+	PlanServiceInstance = NewPlanService(db, cfg)
+	BillingServiceInstance = NewBillingService(db, cfg)
+	BillingJobInstance = NewBillingJob(BillingServiceInstance, cfg)
+	EarningsServiceInstance = NewEarningsService(db, cfg)
+	LicenseServiceInstance = NewLicenseService(db, cfg)
+	APIKeyServiceInstance = NewAPIKeyService(db, cfg)
+	SSOServiceInstance = NewSSOService(db, cfg)
+	SSOServiceInstance.SetAuthService(AuthServiceInstance)
+	SCIMServiceInstance = NewSCIMService(db, cfg)
+	SCIMServiceInstance.SetAuthService(AuthServiceInstance)
 
 	// Initialize optional services with fallbacks
+	EmailServiceInstance = NewEmailService(db, cfg)
 	NotificationServiceInstance = NewNotificationService(db, cfg)
 }
 
@@ -0,0 +1,68 @@
+package services
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// newTestDB opens an in-memory database private to the test with the given
+// models migrated
+func newTestDB(t *testing.T, models ...interface{}) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open("file:"+url.PathEscape(t.Name())+"?mode=memory&cache=shared"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+	if err := db.AutoMigrate(models...); err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+	return db
+}
+
+// waitForEmails waits, when the test ends, for email sent in the background
+// to be delivered, so it does not outlive the test's database
+func waitForEmails(t *testing.T, db *gorm.DB) {
+	t.Cleanup(func() {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			var pending int64
+			if err := db.Model(&models.EmailLog{}).Where("status = ?", EmailPending).Count(&pending).Error; err != nil || pending == 0 {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Error("email was still being sent when the test ended")
+	})
+}
+
+// waitForEmail waits for email from the template to be sent to the address
+// in the background and returns its log entry
+func waitForEmail(t *testing.T, db *gorm.DB, to, template string) *models.EmailLog {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var entry models.EmailLog
+		if err := db.Where("\"to\" = ? AND template = ? AND status <> ?", to, template, EmailPending).
+			First(&entry).Error; err == nil {
+			return &entry
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no %s email sent to %s", template, to)
+	return nil
+}
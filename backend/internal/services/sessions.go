@@ -0,0 +1,163 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// ClientInfo describes where an authentication request came from
+type ClientInfo struct {
+	IPAddress string
+	UserAgent string
+}
+
+// SessionInfo is a session as listed to its user
+type SessionInfo struct {
+	models.Session
+	Current bool `json:"current"`
+}
+
+// startSession records a new sign-in and notifies the user when it comes
+// from a device they have not signed in from before
+func (s *AuthService) startSession(user *models.User, familyID string, client *ClientInfo) error {
+	if client == nil {
+		client = &ClientInfo{}
+	}
+	now := time.Now()
+	session := &models.Session{
+		UserID:     user.ID,
+		FamilyID:   familyID,
+		IPAddress:  client.IPAddress,
+		UserAgent:  client.UserAgent,
+		Device:     describeDevice(client.UserAgent),
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(s.refreshTokenTTL()),
+	}
+
+	// The first sign-in of an account is not worth an alert
+	var known, sameDevice int64
+	s.db.Model(&models.Session{}).Where("user_id = ?", user.ID).Count(&known)
+	if known > 0 {
+		s.db.Model(&models.Session{}).Where("user_id = ? AND device = ?", user.ID, session.Device).Count(&sameDevice)
+	}
+
+	if err := s.db.Create(session).Error; err != nil {
+		return err
+	}
+
+	if known > 0 && sameDevice == 0 {
+		s.notifyNewDevice(user, session)
+	}
+	return nil
+}
+
+// touchSession marks the session of a token family as seen from client
+func (s *AuthService) touchSession(familyID string, client *ClientInfo) {
+	now := time.Now()
+	updates := map[string]interface{}{
+		"last_seen_at": now,
+		"expires_at":   now.Add(s.refreshTokenTTL()),
+	}
+	if client != nil && client.IPAddress != "" {
+		updates["ip_address"] = client.IPAddress
+	}
+	if err := s.db.Model(&models.Session{}).Where("family_id = ?", familyID).Updates(updates).Error; err != nil {
+		fmt.Printf("Failed to update session: %v\n", err)
+	}
+}
+
+// notifyNewDevice tells the user about a sign-in from a new device
+func (s *AuthService) notifyNewDevice(user *models.User, session *models.Session) {
+	_, err := s.notifications.SendNotification(&CreateNotificationRequest{
+		UserID:   user.ID,
+		Type:     "email",
+		Title:    "New sign-in to your account",
+		Message:  fmt.Sprintf("Your account was signed in to from %s (IP address %s). If this wasn't you, revoke the session and change your password.", session.Device, session.IPAddress),
+		Priority: "high",
+		Category: "security",
+		Metadata: map[string]interface{}{
+			"session_id": session.ID,
+			"device":     session.Device,
+			"ip_address": session.IPAddress,
+			"user_agent": session.UserAgent,
+		},
+	})
+	if err != nil {
+		fmt.Printf("Failed to send new device notification to %s: %v\n", user.ID, err)
+	}
+}
+
+// ListSessions lists the user's active sessions, most recently used first.
+// currentSessionID marks the session the request was made from.
+func (s *AuthService) ListSessions(userID, currentSessionID string) ([]SessionInfo, error) {
+	var sessions []models.Session
+	if err := s.db.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("last_seen_at DESC").Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+
+	infos := make([]SessionInfo, len(sessions))
+	for i, session := range sessions {
+		infos[i] = SessionInfo{Session: session, Current: session.FamilyID == currentSessionID}
+	}
+	return infos, nil
+}
+
+// RevokeSession signs out one of the user's sessions
+func (s *AuthService) RevokeSession(userID, sessionID string) error {
+	var session models.Session
+	if err := s.db.First(&session, "id = ? AND user_id = ?", sessionID, userID).Error; err != nil {
+		return errors.New("session not found")
+	}
+	if session.RevokedAt != nil {
+		return errors.New("session is already revoked")
+	}
+	return s.revokeFamily(session.FamilyID)
+}
+
+// describeDevice summarizes a user agent as browser and operating system
+func describeDevice(userAgent string) string {
+	if strings.TrimSpace(userAgent) == "" {
+		return "Unknown device"
+	}
+
+	var browser string
+	switch {
+	case strings.Contains(userAgent, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(userAgent, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(userAgent, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(userAgent, "Chrome/"):
+		browser = "Chrome"
+	case strings.Contains(userAgent, "Safari/"):
+		browser = "Safari"
+	default:
+		// Clients such as curl/8.0 or python-requests/2.31
+		browser = strings.SplitN(strings.Fields(userAgent)[0], "/", 2)[0]
+	}
+
+	var os string
+	switch {
+	case strings.Contains(userAgent, "Windows"):
+		os = "Windows"
+	case strings.Contains(userAgent, "iPhone"), strings.Contains(userAgent, "iPad"):
+		os = "iOS"
+	case strings.Contains(userAgent, "Android"):
+		os = "Android"
+	case strings.Contains(userAgent, "Mac OS X"):
+		os = "macOS"
+	case strings.Contains(userAgent, "Linux"):
+		os = "Linux"
+	}
+
+	if os == "" {
+		return browser
+	}
+	return browser + " on " + os
+}
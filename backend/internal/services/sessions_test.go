@@ -0,0 +1,146 @@
+package services
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+const (
+	chromeOnMac    = "Mozilla/5.0 (Macintosh; Intel Mac OS X 14_4) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36"
+	firefoxOnLinux = "Mozilla/5.0 (X11; Linux x86_64; rv:125.0) Gecko/20100101 Firefox/125.0"
+)
+
+// sessionFor returns the session started by a login
+func (at *authTest) sessionFor(t *testing.T, resp *AuthResponse) *models.Session {
+	t.Helper()
+	claims, err := at.auth.ValidateToken(resp.AccessToken)
+	if err != nil {
+		t.Fatalf("ValidateToken() error = %v", err)
+	}
+	var session models.Session
+	if err := at.db.First(&session, "family_id = ?", claims.SessionID).Error; err != nil {
+		t.Fatalf("no session for the login: %v", err)
+	}
+	return &session
+}
+
+// deviceAlerts counts the new device notifications the user has had
+func (at *authTest) deviceAlerts(t *testing.T) int64 {
+	t.Helper()
+	var count int64
+	at.db.Model(&models.Notification{}).Where("user_id = ? AND category = ?", at.user.ID, "security").Count(&count)
+	return count
+}
+
+func TestLoginStartsSession(t *testing.T) {
+	at := newAuthTest(t)
+	login := at.login(t, chromeOnMac)
+
+	session := at.sessionFor(t, login)
+	if session.UserID != at.user.ID || session.IPAddress != "198.51.100.1" || session.UserAgent != chromeOnMac || session.Device != "Chrome on macOS" {
+		t.Errorf("session = %s from %s on %q, want the user's from 198.51.100.1 on Chrome on macOS", session.UserID, session.IPAddress, session.Device)
+	}
+	if lifetime := session.ExpiresAt.Sub(session.LastSeenAt); lifetime != 7*24*time.Hour {
+		t.Errorf("session lasts %s, want the refresh token lifetime", lifetime)
+	}
+
+	// Refreshing keeps the session alive and records where it was used from
+	at.db.Model(session).Update("last_seen_at", time.Now().Add(-time.Hour))
+	at.refresh(t, login.RefreshToken)
+	refreshed := at.sessionFor(t, login)
+	if refreshed.IPAddress != "198.51.100.2" || time.Since(refreshed.LastSeenAt) > time.Minute {
+		t.Errorf("refreshed session last seen %v from %s, want now from 198.51.100.2", refreshed.LastSeenAt, refreshed.IPAddress)
+	}
+}
+
+func TestNewDeviceNotification(t *testing.T) {
+	at := newAuthTest(t)
+
+	// The first sign-in and sign-ins from a known device raise no alert
+	at.login(t, chromeOnMac)
+	at.login(t, chromeOnMac)
+	if alerts := at.deviceAlerts(t); alerts != 0 {
+		t.Errorf("%d alerts for known devices, want none", alerts)
+	}
+
+	at.login(t, firefoxOnLinux)
+	if alerts := at.deviceAlerts(t); alerts != 1 {
+		t.Fatalf("%d alerts after a sign-in from a new device, want 1", alerts)
+	}
+	email := waitForEmail(t, at.db, at.user.Email, EmailTemplateNotification)
+	if email.Subject == "" || email.Status != EmailSent {
+		t.Errorf("alert email = %q, %s, want it sent", email.Subject, email.Status)
+	}
+	var alert models.Notification
+	at.db.First(&alert, "user_id = ? AND category = ?", at.user.ID, "security")
+	if !strings.Contains(alert.Message, "Firefox on Linux") || !strings.Contains(alert.Message, "198.51.100.1") {
+		t.Errorf("alert = %q, want the device and address", alert.Message)
+	}
+}
+
+func TestListAndRevokeSessions(t *testing.T) {
+	at := newAuthTest(t)
+	mac := at.login(t, chromeOnMac)
+	linux := at.login(t, firefoxOnLinux)
+	waitForEmail(t, at.db, at.user.Email, EmailTemplateNotification)
+	macSession, linuxSession := at.sessionFor(t, mac), at.sessionFor(t, linux)
+	at.db.Model(macSession).Update("last_seen_at", time.Now().Add(-time.Hour))
+
+	// Sessions are listed most recently used first, marking the current one
+	sessions, err := at.auth.ListSessions(at.user.ID, macSession.FamilyID)
+	if err != nil || len(sessions) != 2 {
+		t.Fatalf("ListSessions() = %d sessions, %v, want 2", len(sessions), err)
+	}
+	if sessions[0].ID != linuxSession.ID || sessions[0].Current || !sessions[1].Current {
+		t.Errorf("ListSessions() = %s (current %v), %s (current %v), want the Linux session first and the Mac one current",
+			sessions[0].Device, sessions[0].Current, sessions[1].Device, sessions[1].Current)
+	}
+
+	// Revoking a session signs it out and hides it
+	if err := at.auth.RevokeSession("someone-else", linuxSession.ID); err == nil {
+		t.Error("RevokeSession() of another user's session error = nil, want an error")
+	}
+	if err := at.auth.RevokeSession(at.user.ID, linuxSession.ID); err != nil {
+		t.Fatalf("RevokeSession() error = %v", err)
+	}
+	if err := at.auth.RevokeSession(at.user.ID, linuxSession.ID); err == nil {
+		t.Error("second RevokeSession() error = nil, want an error")
+	}
+	at.checkRevoked(t, linux.AccessToken)
+	if _, err := at.auth.RefreshToken(linux.RefreshToken, nil); err == nil {
+		t.Error("RefreshToken() of a revoked session error = nil, want an error")
+	}
+	if sessions, _ := at.auth.ListSessions(at.user.ID, ""); len(sessions) != 1 || sessions[0].ID != macSession.ID {
+		t.Errorf("ListSessions() after revoking = %d sessions, want the Mac one", len(sessions))
+	}
+
+	// Expired sessions are not listed
+	at.db.Model(macSession).Update("expires_at", time.Now().Add(-time.Second))
+	if sessions, _ := at.auth.ListSessions(at.user.ID, ""); len(sessions) != 0 {
+		t.Errorf("ListSessions() = %d sessions, want the expired one left out", len(sessions))
+	}
+}
+
+func TestDescribeDevice(t *testing.T) {
+	tests := []struct {
+		userAgent string
+		want      string
+	}{
+		{userAgent: chromeOnMac, want: "Chrome on macOS"},
+		{userAgent: firefoxOnLinux, want: "Firefox on Linux"},
+		{userAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36 Edg/124.0.0.0", want: "Edge on Windows"},
+		{userAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1", want: "Safari on iOS"},
+		{userAgent: "Mozilla/5.0 (Linux; Android 14) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Mobile Safari/537.36", want: "Chrome on Android"},
+		{userAgent: "curl/8.0.1", want: "curl"},
+		{userAgent: "  ", want: "Unknown device"},
+	}
+
+	for _, tt := range tests {
+		if got := describeDevice(tt.userAgent); got != tt.want {
+			t.Errorf("describeDevice(%q) = %q, want %q", tt.userAgent, got, tt.want)
+		}
+	}
+}
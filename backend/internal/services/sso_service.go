@@ -0,0 +1,556 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+	"github.com/mlaitechio/vagais/pkg/oidc"
+)
+
+// SSO errors
+var (
+	// ErrSSORequired is returned for password logins of members whose
+	// organization signs in through its identity provider
+	ErrSSORequired = errors.New("your organization signs in with single sign-on")
+
+	errSSONotConfigured   = errors.New("single sign-on is not configured for this organization")
+	errSSOInvalidState    = errors.New("invalid or expired sign-in request; please start again")
+	errSSOEmailUnverified = errors.New("the identity provider did not return a verified email address")
+	errSSODomainNotListed = errors.New("your email domain is not allowed for this organization")
+	errSSOAccountExists   = errors.New("an account with this email already exists outside the organization; ask an administrator to add it")
+	errSSONoAccount       = errors.New("no account exists for this user; ask an administrator to invite you")
+)
+
+// roleRank orders roles by privilege, for picking the highest role a user's
+// groups map to
+var roleRank = map[string]int{"user": 1, "staff": 2, "maintainer": 3, "admin": 4}
+
+// SSOService handles OpenID Connect single sign-on
+type SSOService struct {
+	BaseService
+	auth       *AuthService
+	plans      *PlanService
+	httpClient *http.Client
+
+	mu        sync.Mutex
+	providers map[string]*ssoProvider
+}
+
+// ssoProvider is the cached metadata and keys of an issuer
+type ssoProvider struct {
+	metadata  *oidc.Provider
+	keys      *oidc.KeySet
+	fetchedAt time.Time
+}
+
+// NewSSOService creates a new SSO service
+func NewSSOService(db *gorm.DB, cfg *config.Config) *SSOService {
+	return &SSOService{
+		BaseService: NewBaseService(db, cfg, "sso"),
+		auth:        NewAuthService(db, cfg),
+		plans:       NewPlanService(db, cfg),
+		httpClient:  &http.Client{Timeout: time.Duration(cfg.SSO.HTTPTimeoutSeconds) * time.Second},
+		providers:   make(map[string]*ssoProvider),
+	}
+}
+
+// SetAuthService replaces the auth service sessions are issued through, so
+// that SSO logins share the server's token denylist
+func (s *SSOService) SetAuthService(auth *AuthService) {
+	s.auth = auth
+}
+
+// SSOConnectionRequest configures an organization's identity provider
+type SSOConnectionRequest struct {
+	Issuer        string            `json:"issuer" binding:"required"`
+	ClientID      string            `json:"client_id" binding:"required"`
+	ClientSecret  string            `json:"client_secret"`
+	Scopes        []string          `json:"scopes"`
+	Domains       []string          `json:"domains"`
+	GroupsClaim   string            `json:"groups_claim"`
+	RoleMappings  map[string]string `json:"role_mappings"`
+	DefaultRole   string            `json:"default_role"`
+	AutoProvision *bool             `json:"auto_provision"`
+	Enforced      bool              `json:"enforced"`
+	IsEnabled     *bool             `json:"is_enabled"`
+}
+
+// SSOStartRequest starts a login, routed by email domain or organization slug
+type SSOStartRequest struct {
+	Email        string `json:"email"`
+	Organization string `json:"organization"`
+}
+
+// SSOStartResponse is where to send the user to sign in
+type SSOStartResponse struct {
+	AuthorizationURL string    `json:"authorization_url"`
+	ExpiresAt        time.Time `json:"expires_at"`
+}
+
+// SSOCallbackRequest carries what the identity provider sent back
+type SSOCallbackRequest struct {
+	Code  string `json:"code" binding:"required"`
+	State string `json:"state" binding:"required"`
+}
+
+// GetConnection returns an organization's identity provider
+func (s *SSOService) GetConnection(orgID, userID string) (*models.SSOConnection, error) {
+	if err := s.requireOrgAdmin(orgID, userID); err != nil {
+		return nil, err
+	}
+	var conn models.SSOConnection
+	if err := s.db.Where("organization_id = ?", orgID).First(&conn).Error; err != nil {
+		return nil, errSSONotConfigured
+	}
+	return &conn, nil
+}
+
+// SaveConnection creates or updates an organization's identity provider.
+// The issuer is checked by fetching its discovery document.
+func (s *SSOService) SaveConnection(orgID, userID string, req *SSOConnectionRequest) (*models.SSOConnection, error) {
+	if err := s.requireOrgAdmin(orgID, userID); err != nil {
+		return nil, err
+	}
+
+	var conn models.SSOConnection
+	exists := s.db.Where("organization_id = ?", orgID).First(&conn).Error == nil
+	if !exists {
+		conn = models.SSOConnection{OrganizationID: orgID, AutoProvision: true, IsEnabled: true}
+	}
+
+	conn.Issuer = strings.TrimSpace(req.Issuer)
+	conn.ClientID = strings.TrimSpace(req.ClientID)
+	// An empty secret keeps the current one, so it need not be sent back
+	if req.ClientSecret != "" {
+		conn.ClientSecret = req.ClientSecret
+	}
+	conn.Scopes = req.Scopes
+	conn.GroupsClaim = strings.TrimSpace(req.GroupsClaim)
+	if conn.GroupsClaim == "" {
+		conn.GroupsClaim = "groups"
+	}
+	conn.DefaultRole = req.DefaultRole
+	if conn.DefaultRole == "" {
+		conn.DefaultRole = "user"
+	}
+	if _, ok := roleRank[conn.DefaultRole]; !ok {
+		return nil, fmt.Errorf("invalid default role: %s", conn.DefaultRole)
+	}
+	conn.RoleMappings = req.RoleMappings
+	for group, role := range conn.RoleMappings {
+		if _, ok := roleRank[role]; !ok {
+			return nil, fmt.Errorf("invalid role %q for group %q", role, group)
+		}
+	}
+	if req.AutoProvision != nil {
+		conn.AutoProvision = *req.AutoProvision
+	}
+	if req.IsEnabled != nil {
+		conn.IsEnabled = *req.IsEnabled
+	}
+	conn.Enforced = req.Enforced
+
+	domains, err := s.checkDomains(orgID, req.Domains)
+	if err != nil {
+		return nil, err
+	}
+	conn.Domains = domains
+
+	if _, err := s.provider(context.Background(), conn.Issuer, true); err != nil {
+		return nil, err
+	}
+
+	if exists {
+		err = s.db.Save(&conn).Error
+	} else {
+		err = s.db.Create(&conn).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &conn, nil
+}
+
+// DeleteConnection removes an organization's identity provider
+func (s *SSOService) DeleteConnection(orgID, userID string) error {
+	if err := s.requireOrgAdmin(orgID, userID); err != nil {
+		return err
+	}
+	var conn models.SSOConnection
+	if err := s.db.Where("organization_id = ?", orgID).First(&conn).Error; err != nil {
+		return errSSONotConfigured
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("connection_id = ?", conn.ID).Delete(&models.SSOIdentity{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("connection_id = ?", conn.ID).Delete(&models.SSOAuthRequest{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&conn).Error
+	})
+}
+
+// StartLogin creates an authorization request with PKCE for the identity
+// provider of the user's email domain, or of the named organization
+func (s *SSOService) StartLogin(req *SSOStartRequest) (*SSOStartResponse, error) {
+	conn, err := s.findConnection(req)
+	if err != nil {
+		return nil, err
+	}
+	provider, err := s.provider(context.Background(), conn.Issuer, false)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := oidc.RandomToken()
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := oidc.RandomToken()
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := oidc.NewCodeVerifier()
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt := time.Now().Add(time.Duration(s.cfg.SSO.StateMinutes) * time.Minute)
+	if err := s.db.Create(&models.SSOAuthRequest{
+		ConnectionID: conn.ID,
+		StateHash:    hashToken(state),
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		ExpiresAt:    expiresAt,
+	}).Error; err != nil {
+		return nil, err
+	}
+
+	return &SSOStartResponse{
+		AuthorizationURL: provider.metadata.AuthCodeURL(oidc.AuthRequest{
+			ClientID:      conn.ClientID,
+			RedirectURI:   s.cfg.SSO.RedirectURL,
+			Scopes:        conn.Scopes,
+			State:         state,
+			Nonce:         nonce,
+			CodeChallenge: oidc.CodeChallenge(verifier),
+			LoginHint:     strings.TrimSpace(req.Email),
+		}),
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+// HandleCallback redeems the authorization code, validates the ID token and
+// signs the user in, creating their account on first sign-in
+func (s *SSOService) HandleCallback(req *SSOCallbackRequest, client *ClientInfo) (*AuthResponse, error) {
+	var authReq models.SSOAuthRequest
+	if err := s.db.Where("state_hash = ?", hashToken(req.State)).First(&authReq).Error; err != nil {
+		return nil, errSSOInvalidState
+	}
+	if time.Now().After(authReq.ExpiresAt) {
+		return nil, errSSOInvalidState
+	}
+	// A state is redeemed once
+	result := s.db.Model(&models.SSOAuthRequest{}).
+		Where("id = ? AND consumed_at IS NULL", authReq.ID).
+		Update("consumed_at", time.Now())
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, errSSOInvalidState
+	}
+
+	var conn models.SSOConnection
+	if err := s.db.First(&conn, "id = ?", authReq.ConnectionID).Error; err != nil || !conn.IsEnabled {
+		return nil, errSSONotConfigured
+	}
+
+	ctx := context.Background()
+	provider, err := s.provider(ctx, conn.Issuer, false)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := provider.metadata.Exchange(ctx, s.httpClient, oidc.ExchangeRequest{
+		ClientID:     conn.ClientID,
+		ClientSecret: conn.ClientSecret,
+		Code:         req.Code,
+		CodeVerifier: authReq.CodeVerifier,
+		RedirectURI:  s.cfg.SSO.RedirectURL,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	expected := oidc.Expected{Issuer: provider.metadata.Issuer, ClientID: conn.ClientID, Nonce: authReq.Nonce}
+	idToken, err := oidc.VerifyIDToken(tokens.IDToken, provider.keys, expected)
+	if errors.Is(err, oidc.ErrKeyNotFound) {
+		// The provider may have rotated its keys since they were cached
+		if provider, err = s.provider(ctx, conn.Issuer, true); err != nil {
+			return nil, err
+		}
+		idToken, err = oidc.VerifyIDToken(tokens.IDToken, provider.keys, expected)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.resolveUser(&conn, idToken)
+	if err != nil {
+		return nil, err
+	}
+	return s.auth.completeLogin(user, client)
+}
+
+// resolveUser finds the user an ID token is for, linking or creating their
+// account as needed, and applies the role their groups map to
+func (s *SSOService) resolveUser(conn *models.SSOConnection, idToken *oidc.IDToken) (*models.User, error) {
+	email := strings.ToLower(strings.TrimSpace(idToken.Email))
+	role := mapSSORole(conn, idToken.Strings(conn.GroupsClaim))
+	now := time.Now()
+
+	var user models.User
+	var identity models.SSOIdentity
+	err := s.db.Where("connection_id = ? AND subject = ?", conn.ID, idToken.Subject).First(&identity).Error
+	switch {
+	case err == nil:
+		if err := s.db.First(&user, "id = ?", identity.UserID).Error; err != nil {
+			return nil, errors.New("user not found")
+		}
+		if user.OrganizationID == nil || *user.OrganizationID != conn.OrganizationID {
+			return nil, errSSOAccountExists
+		}
+
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		// Accounts are matched by email only when the provider vouches for
+		// the address and the domain belongs to the organization
+		if email == "" || !idToken.EmailVerified {
+			return nil, errSSOEmailUnverified
+		}
+		if len(conn.Domains) > 0 && !containsString(conn.Domains, emailDomain(email)) {
+			return nil, errSSODomainNotListed
+		}
+
+		if err := s.db.Where("email = ?", email).First(&user).Error; err == nil {
+			// An existing account is only linked within the organization, so
+			// that a provider cannot take over outside accounts
+			if user.OrganizationID == nil || *user.OrganizationID != conn.OrganizationID {
+				return nil, errSSOAccountExists
+			}
+		} else if !conn.AutoProvision {
+			return nil, errSSONoAccount
+		} else if err := s.provisionUser(conn, idToken, email, role, &user); err != nil {
+			return nil, err
+		}
+
+		identity = models.SSOIdentity{UserID: user.ID, ConnectionID: conn.ID, Subject: idToken.Subject, Email: email}
+		if err := s.db.Create(&identity).Error; err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, err
+	}
+
+	if !user.IsActive {
+		return nil, errors.New("account is deactivated")
+	}
+
+	updates := map[string]interface{}{"last_login_at": now}
+	if email != "" {
+		updates["email"] = email
+	}
+	if err := s.db.Model(&identity).Updates(updates).Error; err != nil {
+		fmt.Printf("Failed to update SSO identity %s: %v\n", identity.ID, err)
+	}
+
+	// Groups decide the role once mappings are configured. A token without
+	// the groups claim leaves the role alone, so that an admin does not lose
+	// their role when the provider is not set up to send groups.
+	_, hasGroups := idToken.Claims[conn.GroupsClaim]
+	if len(conn.RoleMappings) > 0 && hasGroups && user.Role != role {
+		if err := s.db.Model(&user).Update("role", role).Error; err != nil {
+			return nil, err
+		}
+		user.Role = role
+	}
+
+	if err := s.db.Preload("Organization").First(&user, "id = ?", user.ID).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// provisionUser creates the account of a user signing in for the first time
+func (s *SSOService) provisionUser(conn *models.SSOConnection, idToken *oidc.IDToken, email, role string, user *models.User) error {
+	if err := s.plans.CheckSeatQuota(conn.OrganizationID); err != nil {
+		return err
+	}
+
+	firstName, lastName := idToken.GivenName, idToken.FamilyName
+	if firstName == "" && lastName == "" {
+		firstName, lastName, _ = strings.Cut(idToken.Name, " ")
+	}
+	orgID := conn.OrganizationID
+	*user = models.User{
+		Email:          email,
+		Username:       email,
+		FirstName:      firstName,
+		LastName:       lastName,
+		Role:           role,
+		IsActive:       true,
+		EmailVerified:  true,
+		OrganizationID: &orgID,
+	}
+	// No password is set; the account signs in through the provider
+	return s.db.Create(user).Error
+}
+
+// mapSSORole returns the highest role the groups map to, or the default role
+func mapSSORole(conn *models.SSOConnection, groups []string) string {
+	role := conn.DefaultRole
+	if role == "" {
+		role = "user"
+	}
+	for _, group := range groups {
+		if mapped, ok := conn.RoleMappings[group]; ok && roleRank[mapped] > roleRank[role] {
+			role = mapped
+		}
+	}
+	return role
+}
+
+// findConnection routes a login to an enabled identity provider
+func (s *SSOService) findConnection(req *SSOStartRequest) (*models.SSOConnection, error) {
+	var conn models.SSOConnection
+	if slug := strings.TrimSpace(req.Organization); slug != "" {
+		var org models.Organization
+		if err := s.db.Where("slug = ?", slug).First(&org).Error; err != nil {
+			return nil, errSSONotConfigured
+		}
+		if err := s.db.Where("organization_id = ? AND is_enabled = ?", org.ID, true).First(&conn).Error; err != nil {
+			return nil, errSSONotConfigured
+		}
+		return &conn, nil
+	}
+
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	if !strings.Contains(email, "@") {
+		return nil, errors.New("email or organization is required")
+	}
+	domain := emailDomain(email)
+	var conns []models.SSOConnection
+	if err := s.db.Where("is_enabled = ?", true).Find(&conns).Error; err != nil {
+		return nil, err
+	}
+	for i := range conns {
+		if containsString(conns[i].Domains, domain) {
+			return &conns[i], nil
+		}
+	}
+	return nil, errors.New("single sign-on is not configured for this email domain")
+}
+
+// checkDomains normalizes an organization's email domains and makes sure no
+// other organization has claimed them
+func (s *SSOService) checkDomains(orgID string, domains []string) ([]string, error) {
+	normalized := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(domain, "@")))
+		if domain == "" || strings.ContainsAny(domain, "@/ ") || !strings.Contains(domain, ".") {
+			return nil, fmt.Errorf("invalid domain: %q", domain)
+		}
+		if !containsString(normalized, domain) {
+			normalized = append(normalized, domain)
+		}
+	}
+
+	var others []models.SSOConnection
+	if err := s.db.Where("organization_id <> ?", orgID).Find(&others).Error; err != nil {
+		return nil, err
+	}
+	for _, other := range others {
+		for _, domain := range normalized {
+			if containsString(other.Domains, domain) {
+				return nil, fmt.Errorf("domain %s is already used by another organization", domain)
+			}
+		}
+	}
+	return normalized, nil
+}
+
+// provider returns the cached metadata and keys of an issuer, fetching them
+// when missing, stale or refresh is set
+func (s *SSOService) provider(ctx context.Context, issuer string, refresh bool) (*ssoProvider, error) {
+	s.mu.Lock()
+	cached := s.providers[issuer]
+	s.mu.Unlock()
+	maxAge := time.Duration(s.cfg.SSO.MetadataCacheMinutes) * time.Minute
+	if cached != nil && !refresh && time.Since(cached.fetchedAt) < maxAge {
+		return cached, nil
+	}
+
+	metadata, err := oidc.Discover(ctx, s.httpClient, issuer)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := oidc.FetchKeySet(ctx, s.httpClient, metadata.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+
+	fetched := &ssoProvider{metadata: metadata, keys: keys, fetchedAt: time.Now()}
+	s.mu.Lock()
+	s.providers[issuer] = fetched
+	s.mu.Unlock()
+	return fetched, nil
+}
+
+// requireOrgAdmin checks that the user is an admin of the organization
+func (s *SSOService) requireOrgAdmin(orgID, userID string) error {
+	var user models.User
+	if err := s.db.First(&user, "id = ?", userID).Error; err != nil {
+		return errors.New("user not found")
+	}
+	if user.OrganizationID == nil || *user.OrganizationID != orgID || user.Role != "admin" {
+		return errors.New("unauthorized to manage single sign-on for this organization")
+	}
+	return nil
+}
+
+// checkPasswordLogin returns ErrSSORequired when the user's organization
+// requires its members to sign in through its identity provider
+func checkPasswordLogin(db *gorm.DB, user *models.User) error {
+	if user.OrganizationID == nil {
+		return nil
+	}
+	var count int64
+	db.Model(&models.SSOConnection{}).
+		Where("organization_id = ? AND is_enabled = ? AND enforced = ?", *user.OrganizationID, true, true).
+		Count(&count)
+	if count > 0 {
+		return ErrSSORequired
+	}
+	return nil
+}
+
+// containsString reports whether values contains value
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,265 @@
+package services
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+	"github.com/mlaitechio/vagais/pkg/oidc"
+	"github.com/mlaitechio/vagais/pkg/oidc/oidctest"
+)
+
+// ssoTest is an organization with single sign-on through a local provider
+type ssoTest struct {
+	db    *gorm.DB
+	sso   *SSOService
+	idp   *oidctest.Server
+	org   *models.Organization
+	admin *models.User
+}
+
+func newSSOTest(t *testing.T) *ssoTest {
+	t.Helper()
+	t.Setenv("EMAIL_OUTBOX_DIR", t.TempDir())
+
+	db := newTestDB(t, &models.Organization{}, &models.User{}, &models.CreditTransaction{},
+		&models.RefreshToken{}, &models.RevokedAccessToken{}, &models.Session{}, &models.Notification{},
+		&models.EmailLog{}, &models.SSOConnection{}, &models.SSOIdentity{}, &models.SSOAuthRequest{})
+
+	org := &models.Organization{Name: "Acme", Slug: "acme", Plan: "enterprise", IsActive: true}
+	if err := db.Create(org).Error; err != nil {
+		t.Fatal(err)
+	}
+	admin := &models.User{Email: "boss@acme.com", Username: "boss", PasswordHash: "x", Role: "admin",
+		IsActive: true, EmailVerified: true, OrganizationID: &org.ID}
+	if err := db.Create(admin).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	idp := oidctest.NewServer("vagais", "s3cret")
+	t.Cleanup(idp.Close)
+
+	cfg := config.Load()
+	test := &ssoTest{db: db, sso: NewSSOService(db, cfg), idp: idp, org: org, admin: admin}
+	test.saveConnection(t, nil)
+	return test
+}
+
+// saveConnection configures the organization's provider, applying modify
+// to the default request
+func (s *ssoTest) saveConnection(t *testing.T, modify func(*SSOConnectionRequest)) {
+	t.Helper()
+	req := &SSOConnectionRequest{
+		Issuer:       s.idp.Issuer(),
+		ClientID:     s.idp.ClientID,
+		ClientSecret: s.idp.ClientSecret,
+		Domains:      []string{"Acme.com"},
+		RoleMappings: map[string]string{"eng-leads": "maintainer", "it": "admin"},
+	}
+	if modify != nil {
+		modify(req)
+	}
+	if _, err := s.sso.SaveConnection(s.org.ID, s.admin.ID, req); err != nil {
+		t.Fatalf("SaveConnection() error = %v", err)
+	}
+}
+
+// authorize starts a login and signs user in at the provider, returning the
+// code and state the callback receives
+func (s *ssoTest) authorize(t *testing.T, user oidctest.User) (string, string) {
+	t.Helper()
+	s.idp.SetUser(user)
+	start, err := s.sso.StartLogin(&SSOStartRequest{Organization: "acme"})
+	if err != nil {
+		t.Fatalf("StartLogin() error = %v", err)
+	}
+	code, state, err := s.idp.Authorize(start.AuthorizationURL)
+	if err != nil {
+		t.Fatalf("Authorize() error = %v", err)
+	}
+	return code, state
+}
+
+// login runs a full sign-in of user
+func (s *ssoTest) login(t *testing.T, user oidctest.User) (*AuthResponse, error) {
+	t.Helper()
+	code, state := s.authorize(t, user)
+	return s.sso.HandleCallback(&SSOCallbackRequest{Code: code, State: state}, &ClientInfo{})
+}
+
+func TestSSOLoginProvisionsAndUpdatesUser(t *testing.T) {
+	test := newSSOTest(t)
+	ann := oidctest.User{Subject: "ann-1", Email: "Ann@Acme.com", EmailVerified: true, GivenName: "Ann", FamilyName: "Lee",
+		Groups: []string{"eng-leads", "everyone"}}
+
+	resp, err := test.login(t, ann)
+	if err != nil {
+		t.Fatalf("first login: error = %v", err)
+	}
+	if resp.AccessToken == "" || resp.RefreshToken == "" {
+		t.Error("first login issued no session tokens")
+	}
+	user := resp.User
+	if user.Email != "ann@acme.com" || user.Role != "maintainer" || !user.EmailVerified || user.FirstName != "Ann" ||
+		user.OrganizationID == nil || *user.OrganizationID != test.org.ID {
+		t.Errorf("provisioned user = %+v, want a verified maintainer of the organization", user)
+	}
+
+	// The provider's subject finds the account again and groups update the role
+	ann.Groups = []string{"it"}
+	resp, err = test.login(t, ann)
+	if err != nil {
+		t.Fatalf("second login: error = %v", err)
+	}
+	if resp.User.ID != user.ID || resp.User.Role != "admin" {
+		t.Errorf("second login: user %s with role %s, want %s with role admin", resp.User.ID, resp.User.Role, user.ID)
+	}
+
+	// Without a groups claim the role is left alone
+	ann.Groups = nil
+	resp, err = test.login(t, ann)
+	if err != nil {
+		t.Fatalf("login without groups: error = %v", err)
+	}
+	if resp.User.Role != "admin" {
+		t.Errorf("login without groups: role = %s, want admin", resp.User.Role)
+	}
+
+	var count int64
+	test.db.Model(&models.User{}).Where("email = ?", "ann@acme.com").Count(&count)
+	if count != 1 {
+		t.Errorf("%d accounts for ann@acme.com, want 1", count)
+	}
+}
+
+func TestSSOLoginLinksOrganizationMembersOnly(t *testing.T) {
+	test := newSSOTest(t)
+
+	resp, err := test.login(t, oidctest.User{Subject: "boss-1", Email: "boss@acme.com", EmailVerified: true})
+	if err != nil {
+		t.Fatalf("member login: error = %v", err)
+	}
+	if resp.User.ID != test.admin.ID {
+		t.Errorf("member login signed in %s, want the existing account %s", resp.User.ID, test.admin.ID)
+	}
+
+	// An account outside the organization is not taken over
+	outsider := &models.User{Email: "eve@acme.com", Username: "eve", PasswordHash: "x", IsActive: true}
+	if err := test.db.Create(outsider).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := test.login(t, oidctest.User{Subject: "eve-1", Email: "eve@acme.com", EmailVerified: true}); !errors.Is(err, errSSOAccountExists) {
+		t.Errorf("outsider login: error = %v, want errSSOAccountExists", err)
+	}
+}
+
+func TestSSOLoginRefusesUntrustedIdentities(t *testing.T) {
+	test := newSSOTest(t)
+
+	tests := []struct {
+		name string
+		user oidctest.User
+		want error
+	}{
+		{name: "unverified email", user: oidctest.User{Subject: "bob-1", Email: "bob@acme.com"}, want: errSSOEmailUnverified},
+		{name: "no email", user: oidctest.User{Subject: "bob-2", EmailVerified: true}, want: errSSOEmailUnverified},
+		{name: "domain not listed", user: oidctest.User{Subject: "mal-1", Email: "mal@evil.com", EmailVerified: true}, want: errSSODomainNotListed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := test.login(t, tt.user); !errors.Is(err, tt.want) {
+				t.Errorf("login error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	test.saveConnection(t, func(req *SSOConnectionRequest) {
+		autoProvision := false
+		req.AutoProvision = &autoProvision
+	})
+	if _, err := test.login(t, oidctest.User{Subject: "carl-1", Email: "carl@acme.com", EmailVerified: true}); !errors.Is(err, errSSONoAccount) {
+		t.Errorf("login without auto-provisioning: error = %v, want errSSONoAccount", err)
+	}
+}
+
+func TestSSOCallbackState(t *testing.T) {
+	test := newSSOTest(t)
+	ann := oidctest.User{Subject: "ann-1", Email: "ann@acme.com", EmailVerified: true}
+
+	t.Run("replayed", func(t *testing.T) {
+		code, state := test.authorize(t, ann)
+		if _, err := test.sso.HandleCallback(&SSOCallbackRequest{Code: code, State: state}, &ClientInfo{}); err != nil {
+			t.Fatalf("first callback: error = %v", err)
+		}
+		if _, err := test.sso.HandleCallback(&SSOCallbackRequest{Code: code, State: state}, &ClientInfo{}); !errors.Is(err, errSSOInvalidState) {
+			t.Errorf("replayed callback: error = %v, want errSSOInvalidState", err)
+		}
+	})
+
+	t.Run("forged", func(t *testing.T) {
+		code, _ := test.authorize(t, ann)
+		if _, err := test.sso.HandleCallback(&SSOCallbackRequest{Code: code, State: "forged"}, &ClientInfo{}); !errors.Is(err, errSSOInvalidState) {
+			t.Errorf("forged state: error = %v, want errSSOInvalidState", err)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		code, state := test.authorize(t, ann)
+		test.db.Model(&models.SSOAuthRequest{}).Where("state_hash = ?", hashToken(state)).
+			Update("expires_at", time.Now().Add(-time.Second))
+		if _, err := test.sso.HandleCallback(&SSOCallbackRequest{Code: code, State: state}, &ClientInfo{}); !errors.Is(err, errSSOInvalidState) {
+			t.Errorf("expired state: error = %v, want errSSOInvalidState", err)
+		}
+	})
+
+	// A code is only redeemed with the PKCE verifier of the login it was
+	// issued to, so a code injected into another login's callback fails
+	t.Run("code of another login", func(t *testing.T) {
+		code, _ := test.authorize(t, ann)
+		_, state := test.authorize(t, ann)
+		_, err := test.sso.HandleCallback(&SSOCallbackRequest{Code: code, State: state}, &ClientInfo{})
+		var tokenErr *oidc.TokenError
+		if !errors.As(err, &tokenErr) || tokenErr.Code != "invalid_grant" {
+			t.Errorf("swapped code: error = %v, want invalid_grant", err)
+		}
+	})
+}
+
+func TestSSOStartLogin(t *testing.T) {
+	test := newSSOTest(t)
+
+	start, err := test.sso.StartLogin(&SSOStartRequest{Email: "ann@ACME.com"})
+	if err != nil {
+		t.Fatalf("StartLogin() by email domain: error = %v", err)
+	}
+	authURL, err := url.Parse(start.AuthorizationURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := authURL.Query()
+	if query.Get("client_id") != "vagais" || query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" ||
+		query.Get("state") == "" || query.Get("nonce") == "" || query.Get("login_hint") != "ann@ACME.com" {
+		t.Errorf("authorization URL %s is missing PKCE, state, nonce or hint", start.AuthorizationURL)
+	}
+
+	// The state is stored hashed, with the verifier whose challenge was sent
+	var authReq models.SSOAuthRequest
+	if err := test.db.Where("state_hash = ?", hashToken(query.Get("state"))).First(&authReq).Error; err != nil {
+		t.Fatalf("no stored request for the state: %v", err)
+	}
+	if oidc.CodeChallenge(authReq.CodeVerifier) != query.Get("code_challenge") || authReq.Nonce != query.Get("nonce") {
+		t.Error("stored verifier or nonce does not match the authorization URL")
+	}
+
+	if _, err := test.sso.StartLogin(&SSOStartRequest{Email: "ann@other.com"}); err == nil {
+		t.Error("StartLogin() for an unknown domain: want an error")
+	}
+	if _, err := test.sso.StartLogin(&SSOStartRequest{Organization: "unknown"}); !errors.Is(err, errSSONotConfigured) {
+		t.Errorf("StartLogin() for an unknown organization: error = %v, want errSSONotConfigured", err)
+	}
+}
@@ -0,0 +1,76 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// tokenDenylistPrefix prefixes the Redis keys of denylisted access tokens
+const tokenDenylistPrefix = "vagais:auth:denylist:"
+
+// TokenDenylist records revoked access tokens by jti until they expire
+type TokenDenylist interface {
+	// Add denylists a token until its expiry
+	Add(ctx context.Context, jti string, expiresAt time.Time) error
+	// Contains reports whether a token has been denylisted
+	Contains(ctx context.Context, jti string) (bool, error)
+}
+
+// DBTokenDenylist keeps the denylist in the database
+type DBTokenDenylist struct {
+	db *gorm.DB
+}
+
+// NewDBTokenDenylist creates a database-backed denylist
+func NewDBTokenDenylist(db *gorm.DB) *DBTokenDenylist {
+	return &DBTokenDenylist{db: db}
+}
+
+// Add denylists a token and clears out entries that have expired
+func (d *DBTokenDenylist) Add(ctx context.Context, jti string, expiresAt time.Time) error {
+	db := d.db.WithContext(ctx)
+	if err := db.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&models.RevokedAccessToken{JTI: jti, ExpiresAt: expiresAt}).Error; err != nil {
+		return err
+	}
+	return db.Where("expires_at < ?", time.Now()).Delete(&models.RevokedAccessToken{}).Error
+}
+
+// Contains reports whether an unexpired entry exists for the token
+func (d *DBTokenDenylist) Contains(ctx context.Context, jti string) (bool, error) {
+	var count int64
+	err := d.db.WithContext(ctx).Model(&models.RevokedAccessToken{}).
+		Where("jti = ? AND expires_at >= ?", jti, time.Now()).Count(&count).Error
+	return count > 0, err
+}
+
+// RedisTokenDenylist keeps the denylist in Redis, where entries expire with the token
+type RedisTokenDenylist struct {
+	redis *redis.Client
+}
+
+// NewRedisTokenDenylist creates a Redis-backed denylist
+func NewRedisTokenDenylist(redisClient *redis.Client) *RedisTokenDenylist {
+	return &RedisTokenDenylist{redis: redisClient}
+}
+
+// Add denylists a token for the rest of its lifetime
+func (d *RedisTokenDenylist) Add(ctx context.Context, jti string, expiresAt time.Time) error {
+	ttl := time.Until(expiresAt)
+	if ttl <= 0 {
+		return nil
+	}
+	return d.redis.Set(ctx, tokenDenylistPrefix+jti, 1, ttl).Err()
+}
+
+// Contains reports whether the token's key exists
+func (d *RedisTokenDenylist) Contains(ctx context.Context, jti string) (bool, error) {
+	n, err := d.redis.Exists(ctx, tokenDenylistPrefix+jti).Result()
+	return n > 0, err
+}
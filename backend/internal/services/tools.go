@@ -0,0 +1,225 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// Tool is a capability an agent can invoke during an execution
+type Tool interface {
+	// Definition describes the tool and the JSON schema of its input
+	Definition() ToolDefinition
+	// Call runs the tool; it must stop when ctx is cancelled
+	Call(ctx context.Context, args map[string]interface{}) (map[string]interface{}, error)
+}
+
+// AgentToolConfig represents an entry of the tools list in Agent.Config
+type AgentToolConfig struct {
+	Name        string                 `json:"name"`
+	Type        string                 `json:"type"`
+	Description string                 `json:"description"`
+	Config      map[string]interface{} `json:"config"`
+}
+
+// KnowledgeDocument represents a document in the knowledge_base list of Agent.Config
+type KnowledgeDocument struct {
+	Title   string `json:"title"`
+	Content string `json:"content"`
+	Source  string `json:"source"`
+}
+
+// ToolFactory builds a tool for an agent from its tool config
+type ToolFactory func(spec AgentToolConfig, agent *models.Agent) (Tool, error)
+
+// ToolRegistry maps tool types to the factories that build them
+type ToolRegistry struct {
+	mu        sync.RWMutex
+	factories map[string]ToolFactory
+}
+
+// NewToolRegistry creates a registry holding the built-in tools
+func NewToolRegistry(cfg *config.Config) *ToolRegistry {
+	r := &ToolRegistry{factories: make(map[string]ToolFactory)}
+	registerBuiltinTools(r, cfg)
+	return r
+}
+
+// Register adds or replaces the factory for a tool type
+func (r *ToolRegistry) Register(toolType string, factory ToolFactory) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.factories[toolType] = factory
+}
+
+// Types returns the registered tool types
+func (r *ToolRegistry) Types() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	types := make([]string, 0, len(r.factories))
+	for t := range r.factories {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Resolve builds the tools declared in the agent's config, keyed by the name the model sees
+func (r *ToolRegistry) Resolve(agent *models.Agent, specs []AgentToolConfig) (map[string]Tool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	tools := make(map[string]Tool, len(specs))
+	for _, spec := range specs {
+		if spec.Type == "" {
+			spec.Type = spec.Name
+		}
+		factory, ok := r.factories[spec.Type]
+		if !ok {
+			return nil, fmt.Errorf("unknown tool type: %s", spec.Type)
+		}
+		tool, err := factory(spec, agent)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure tool %s: %v", spec.Type, err)
+		}
+		name := tool.Definition().Name
+		if _, exists := tools[name]; exists {
+			return nil, fmt.Errorf("tool %s is declared more than once", name)
+		}
+		tools[name] = tool
+	}
+	return tools, nil
+}
+
+// namedTool overrides the name and description a tool is presented with
+type namedTool struct {
+	Tool
+	name        string
+	description string
+}
+
+func (t namedTool) Definition() ToolDefinition {
+	def := t.Tool.Definition()
+	if t.name != "" {
+		def.Name = t.name
+	}
+	if t.description != "" {
+		def.Description = t.description
+	}
+	return def
+}
+
+// withSpec applies the name and description from the agent's tool config
+func withSpec(tool Tool, spec AgentToolConfig) Tool {
+	if spec.Name == "" && spec.Description == "" {
+		return tool
+	}
+	return namedTool{Tool: tool, name: spec.Name, description: spec.Description}
+}
+
+// ValidateToolArguments checks tool arguments against the tool's JSON schema.
+// It supports the subset of JSON schema used by tool definitions: object
+// properties, required, type and enum.
+func ValidateToolArguments(schema map[string]interface{}, args map[string]interface{}) error {
+	return validateSchemaValue(schema, args, "arguments")
+}
+
+func validateSchemaValue(schema map[string]interface{}, value interface{}, path string) error {
+	if schema == nil {
+		return nil
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if fmt.Sprint(allowed) == fmt.Sprint(value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s must be one of %v", path, enum)
+		}
+	}
+
+	schemaType, _ := schema["type"].(string)
+	switch schemaType {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an object", path)
+		}
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, field := range required {
+				name, _ := field.(string)
+				if _, present := obj[name]; !present {
+					return fmt.Errorf("%s.%s is required", path, name)
+				}
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		for name, propSchema := range properties {
+			propValue, present := obj[name]
+			if !present {
+				continue
+			}
+			ps, _ := propSchema.(map[string]interface{})
+			if err := validateSchemaValue(ps, propValue, path+"."+name); err != nil {
+				return err
+			}
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an array", path)
+		}
+		itemSchema, _ := schema["items"].(map[string]interface{})
+		for i, item := range items {
+			if err := validateSchemaValue(itemSchema, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("%s must be a string", path)
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return fmt.Errorf("%s must be a number", path)
+		}
+	case "integer":
+		n, ok := value.(float64)
+		if !ok || n != math.Trunc(n) {
+			return fmt.Errorf("%s must be an integer", path)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s must be a boolean", path)
+		}
+	}
+	return nil
+}
+
+// stringSetting reads a string from a tool config
+func stringSetting(settings map[string]interface{}, key string) string {
+	value, _ := settings[key].(string)
+	return strings.TrimSpace(value)
+}
+
+// stringListSetting reads a list of strings from a tool config
+func stringListSetting(settings map[string]interface{}, key string) []string {
+	raw, _ := settings[key].([]interface{})
+	values := make([]string, 0, len(raw))
+	for _, item := range raw {
+		if s, ok := item.(string); ok && strings.TrimSpace(s) != "" {
+			values = append(values, strings.TrimSpace(s))
+		}
+	}
+	return values
+}
@@ -0,0 +1,752 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// Built-in tool types
+const (
+	ToolHTTPFetch        = "http_fetch"
+	ToolCalculator       = "calculator"
+	ToolCurrentTime      = "current_time"
+	ToolKnowledgeSearch  = "knowledge_search"
+	defaultKnowledgeTopK = 3
+)
+
+// registerBuiltinTools adds the tools shipped with the platform
+func registerBuiltinTools(r *ToolRegistry, cfg *config.Config) {
+	r.Register(ToolHTTPFetch, func(spec AgentToolConfig, agent *models.Agent) (Tool, error) {
+		// The operator's allow-list is required; an agent may narrow it but never widen it
+		if len(cfg.Tools.HTTPAllowedDomains) == 0 {
+			return nil, errors.New("http_fetch is disabled until TOOLS_HTTP_ALLOWED_DOMAINS is set")
+		}
+		domains := cfg.Tools.HTTPAllowedDomains
+		if requested := stringListSetting(spec.Config, "allowed_domains"); len(requested) > 0 {
+			domains = intersectDomains(requested, cfg.Tools.HTTPAllowedDomains)
+			if len(domains) == 0 {
+				return nil, errors.New("none of the allowed domains is permitted by TOOLS_HTTP_ALLOWED_DOMAINS")
+			}
+		}
+		return withSpec(newHTTPFetchTool(domains, cfg.Tools), spec), nil
+	})
+	r.Register(ToolCalculator, func(spec AgentToolConfig, agent *models.Agent) (Tool, error) {
+		return withSpec(calculatorTool{}, spec), nil
+	})
+	r.Register(ToolCurrentTime, func(spec AgentToolConfig, agent *models.Agent) (Tool, error) {
+		return withSpec(currentTimeTool{defaultZone: stringSetting(spec.Config, "timezone")}, spec), nil
+	})
+	r.Register(ToolKnowledgeSearch, func(spec AgentToolConfig, agent *models.Agent) (Tool, error) {
+		docs := ParseAgentRuntimeConfig(agent).KnowledgeBase
+		if len(docs) == 0 {
+			return nil, errors.New("agent has no knowledge base")
+		}
+		return withSpec(newKnowledgeSearchTool(docs), spec), nil
+	})
+}
+
+// httpFetchTool retrieves web pages from an allow-list of domains
+type httpFetchTool struct {
+	allowed  []string
+	maxBytes int64
+	client   *http.Client
+}
+
+func newHTTPFetchTool(allowed []string, cfg config.ToolsConfig) *httpFetchTool {
+	timeout := time.Duration(cfg.HTTPTimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = 15 * time.Second
+	}
+	maxBytes := cfg.HTTPMaxBodyBytes
+	if maxBytes <= 0 {
+		maxBytes = 64 << 10
+	}
+
+	t := &httpFetchTool{allowed: allowed, maxBytes: maxBytes}
+
+	// Refuse to connect to internal addresses even when an allowed name resolves to one
+	t.client = &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:               nil,
+			DialContext:         newPublicDialer(timeout).DialContext,
+			TLSHandshakeTimeout: timeout,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			return t.checkURL(req.URL)
+		},
+	}
+	return t
+}
+
+func (t *httpFetchTool) Definition() ToolDefinition {
+	return ToolDefinition{
+		Name:        ToolHTTPFetch,
+		Description: "Fetch the contents of a web page. Only these domains may be fetched: " + strings.Join(t.allowed, ", "),
+		Parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"url": map[string]interface{}{
+					"type":        "string",
+					"description": "Absolute http or https URL to fetch",
+				},
+				"method": map[string]interface{}{
+					"type": "string",
+					"enum": []interface{}{"GET", "HEAD"},
+				},
+			},
+			"required": []interface{}{"url"},
+		},
+	}
+}
+
+func (t *httpFetchTool) Call(ctx context.Context, args map[string]interface{}) (map[string]interface{}, error) {
+	rawURL, _ := args["url"].(string)
+	method, _ := args["method"].(string)
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %v", err)
+	}
+	if err := t.checkURL(target); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "vagais-agent/1.0")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, t.maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	truncated := int64(len(body)) > t.maxBytes
+	if truncated {
+		body = body[:t.maxBytes]
+	}
+
+	return map[string]interface{}{
+		"url":          resp.Request.URL.String(),
+		"status":       resp.StatusCode,
+		"content_type": resp.Header.Get("Content-Type"),
+		"body":         string(body),
+		"truncated":    truncated,
+	}, nil
+}
+
+// checkURL verifies the scheme and that the host is on the allow-list
+func (t *httpFetchTool) checkURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported url scheme: %s", u.Scheme)
+	}
+	host := strings.ToLower(u.Hostname())
+	if !inDomains(host, t.allowed) {
+		return fmt.Errorf("domain %s is not in the allow-list", host)
+	}
+	return nil
+}
+
+// inDomains reports whether host is one of domains or a subdomain of one
+func inDomains(host string, domains []string) bool {
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.TrimPrefix(domain, "*."))
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// newPublicDialer returns a dialer that refuses connections to internal
+// addresses. The check runs on the resolved address, so names that resolve
+// to an internal host are refused too.
+func newPublicDialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || isInternalIP(ip) {
+				return fmt.Errorf("connection to %s is not allowed", host)
+			}
+			return nil
+		},
+	}
+}
+
+// intersectDomains returns the domains covered by both lists. A domain in one
+// list that is a subdomain of one in the other is kept as the narrower name.
+func intersectDomains(a, b []string) []string {
+	var domains []string
+	seen := make(map[string]bool)
+	for _, x := range a {
+		x = strings.ToLower(strings.TrimPrefix(x, "*."))
+		for _, y := range b {
+			y = strings.ToLower(strings.TrimPrefix(y, "*."))
+			var domain string
+			switch {
+			case inDomains(x, []string{y}):
+				domain = x
+			case inDomains(y, []string{x}):
+				domain = y
+			default:
+				continue
+			}
+			if domain != "" && !seen[domain] {
+				seen[domain] = true
+				domains = append(domains, domain)
+			}
+		}
+	}
+	return domains
+}
+
+// internalNetworks are the non-public ranges not covered by the net.IP predicates
+var internalNetworks = parseCIDRs(
+	"0.0.0.0/8",      // "this" network
+	"100.64.0.0/10",  // carrier-grade NAT
+	"192.0.0.0/24",   // IETF protocol assignments
+	"198.18.0.0/15",  // benchmarking
+	"240.0.0.0/4",    // reserved
+	"64:ff9b:1::/48", // local-use NAT64
+)
+
+// nat64Prefix is the well-known NAT64 prefix, which embeds an IPv4 address
+var nat64Prefix = parseCIDRs("64:ff9b::/96")[0]
+
+// isInternalIP reports whether ip belongs to a loopback, private or otherwise
+// non-public range, including IPv4 addresses embedded in IPv6 ones
+func isInternalIP(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	} else if nat64Prefix.Contains(ip) {
+		return isInternalIP(net.IP(ip[12:16]))
+	}
+
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	for _, network := range internalNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRs parses a fixed list of networks
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// calculatorTool evaluates arithmetic expressions
+type calculatorTool struct{}
+
+func (calculatorTool) Definition() ToolDefinition {
+	return ToolDefinition{
+		Name:        ToolCalculator,
+		Description: "Evaluate an arithmetic expression. Supports + - * / % ^, parentheses, the constants pi and e, and the functions sqrt, abs, ln, log, sin, cos, tan, min, max, pow, round, floor and ceil.",
+		Parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"expression": map[string]interface{}{
+					"type":        "string",
+					"description": "Expression to evaluate, e.g. (2 + 3) * sqrt(16)",
+				},
+			},
+			"required": []interface{}{"expression"},
+		},
+	}
+}
+
+func (calculatorTool) Call(ctx context.Context, args map[string]interface{}) (map[string]interface{}, error) {
+	expression, _ := args["expression"].(string)
+	result, err := evaluateExpression(expression)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"expression": expression,
+		"result":     result,
+	}, nil
+}
+
+// maxExpressionLength bounds the input accepted by the calculator
+const maxExpressionLength = 1024
+
+// evaluateExpression parses and evaluates an arithmetic expression
+func evaluateExpression(expression string) (float64, error) {
+	if len(expression) > maxExpressionLength {
+		return 0, errors.New("expression is too long")
+	}
+	p := &exprParser{input: expression}
+	value, err := p.parseExpression()
+	if err != nil {
+		return 0, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return 0, fmt.Errorf("unexpected %q at position %d", p.input[p.pos], p.pos)
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, errors.New("expression has no finite result")
+	}
+	return value, nil
+}
+
+// exprParser is a recursive-descent parser for arithmetic expressions
+type exprParser struct {
+	input string
+	pos   int
+	depth int
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *exprParser) peek() byte {
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return p.input[p.pos]
+	}
+	return 0
+}
+
+// expression := term (('+' | '-') term)*
+func (p *exprParser) parseExpression() (float64, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > 64 {
+		return 0, errors.New("expression is nested too deeply")
+	}
+
+	left, err := p.parseTerm()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		switch p.peek() {
+		case '+':
+			p.pos++
+			right, err := p.parseTerm()
+			if err != nil {
+				return 0, err
+			}
+			left += right
+		case '-':
+			p.pos++
+			right, err := p.parseTerm()
+			if err != nil {
+				return 0, err
+			}
+			left -= right
+		default:
+			return left, nil
+		}
+	}
+}
+
+// term := unary (('*' | '/' | '%') unary)*
+func (p *exprParser) parseTerm() (float64, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' && op != '%' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case '*':
+			left *= right
+		case '/':
+			if right == 0 {
+				return 0, errors.New("division by zero")
+			}
+			left /= right
+		case '%':
+			if right == 0 {
+				return 0, errors.New("division by zero")
+			}
+			left = math.Mod(left, right)
+		}
+	}
+}
+
+// unary := ('-' | '+') unary | power
+func (p *exprParser) parseUnary() (float64, error) {
+	switch p.peek() {
+	case '-':
+		p.pos++
+		value, err := p.parseUnary()
+		return -value, err
+	case '+':
+		p.pos++
+		return p.parseUnary()
+	}
+	return p.parsePower()
+}
+
+// power := primary ('^' unary)?
+func (p *exprParser) parsePower() (float64, error) {
+	base, err := p.parsePrimary()
+	if err != nil {
+		return 0, err
+	}
+	if p.peek() == '^' {
+		p.pos++
+		exponent, err := p.parseUnary()
+		if err != nil {
+			return 0, err
+		}
+		return math.Pow(base, exponent), nil
+	}
+	return base, nil
+}
+
+// primary := number | constant | function '(' args ')' | '(' expression ')'
+func (p *exprParser) parsePrimary() (float64, error) {
+	c := p.peek()
+	switch {
+	case c == '(':
+		p.pos++
+		value, err := p.parseExpression()
+		if err != nil {
+			return 0, err
+		}
+		if p.peek() != ')' {
+			return 0, errors.New("missing closing parenthesis")
+		}
+		p.pos++
+		return value, nil
+	case c == '.' || (c >= '0' && c <= '9'):
+		return p.parseNumber()
+	case unicode.IsLetter(rune(c)):
+		return p.parseIdentifier()
+	case c == 0:
+		return 0, errors.New("unexpected end of expression")
+	}
+	return 0, fmt.Errorf("unexpected %q at position %d", c, p.pos)
+}
+
+func (p *exprParser) parseNumber() (float64, error) {
+	start := p.pos
+	for p.pos < len(p.input) && (p.input[p.pos] == '.' || (p.input[p.pos] >= '0' && p.input[p.pos] <= '9')) {
+		p.pos++
+	}
+	// Exponent notation such as 1e6
+	if p.pos < len(p.input) && (p.input[p.pos] == 'e' || p.input[p.pos] == 'E') {
+		next := p.pos + 1
+		if next < len(p.input) && (p.input[next] == '+' || p.input[next] == '-') {
+			next++
+		}
+		if next < len(p.input) && p.input[next] >= '0' && p.input[next] <= '9' {
+			p.pos = next
+			for p.pos < len(p.input) && p.input[p.pos] >= '0' && p.input[p.pos] <= '9' {
+				p.pos++
+			}
+		}
+	}
+	value, err := strconv.ParseFloat(p.input[start:p.pos], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", p.input[start:p.pos])
+	}
+	return value, nil
+}
+
+func (p *exprParser) parseIdentifier() (float64, error) {
+	start := p.pos
+	for p.pos < len(p.input) && (unicode.IsLetter(rune(p.input[p.pos])) || unicode.IsDigit(rune(p.input[p.pos]))) {
+		p.pos++
+	}
+	name := strings.ToLower(p.input[start:p.pos])
+
+	switch name {
+	case "pi":
+		return math.Pi, nil
+	case "e":
+		return math.E, nil
+	}
+
+	if p.peek() != '(' {
+		return 0, fmt.Errorf("unknown identifier %q", name)
+	}
+	p.pos++
+
+	var args []float64
+	if p.peek() != ')' {
+		for {
+			value, err := p.parseExpression()
+			if err != nil {
+				return 0, err
+			}
+			args = append(args, value)
+			if p.peek() != ',' {
+				break
+			}
+			p.pos++
+		}
+	}
+	if p.peek() != ')' {
+		return 0, errors.New("missing closing parenthesis")
+	}
+	p.pos++
+
+	return applyFunction(name, args)
+}
+
+// applyFunction evaluates a calculator function
+func applyFunction(name string, args []float64) (float64, error) {
+	unary := map[string]func(float64) float64{
+		"sqrt":  math.Sqrt,
+		"abs":   math.Abs,
+		"ln":    math.Log,
+		"log":   math.Log10,
+		"sin":   math.Sin,
+		"cos":   math.Cos,
+		"tan":   math.Tan,
+		"round": math.Round,
+		"floor": math.Floor,
+		"ceil":  math.Ceil,
+	}
+	if fn, ok := unary[name]; ok {
+		if len(args) != 1 {
+			return 0, fmt.Errorf("%s takes 1 argument", name)
+		}
+		return fn(args[0]), nil
+	}
+
+	switch name {
+	case "pow":
+		if len(args) != 2 {
+			return 0, errors.New("pow takes 2 arguments")
+		}
+		return math.Pow(args[0], args[1]), nil
+	case "min", "max":
+		if len(args) == 0 {
+			return 0, fmt.Errorf("%s takes at least 1 argument", name)
+		}
+		result := args[0]
+		for _, v := range args[1:] {
+			if name == "min" {
+				result = math.Min(result, v)
+			} else {
+				result = math.Max(result, v)
+			}
+		}
+		return result, nil
+	}
+	return 0, fmt.Errorf("unknown function %q", name)
+}
+
+// currentTimeTool reports the current date and time
+type currentTimeTool struct {
+	defaultZone string
+}
+
+func (currentTimeTool) Definition() ToolDefinition {
+	return ToolDefinition{
+		Name:        ToolCurrentTime,
+		Description: "Get the current date and time.",
+		Parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"timezone": map[string]interface{}{
+					"type":        "string",
+					"description": "IANA time zone name such as Europe/London; defaults to UTC",
+				},
+			},
+		},
+	}
+}
+
+func (t currentTimeTool) Call(ctx context.Context, args map[string]interface{}) (map[string]interface{}, error) {
+	zone, _ := args["timezone"].(string)
+	if zone == "" {
+		zone = t.defaultZone
+	}
+	if zone == "" {
+		zone = "UTC"
+	}
+	location, err := time.LoadLocation(zone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q", zone)
+	}
+
+	now := time.Now().In(location)
+	return map[string]interface{}{
+		"timezone":  location.String(),
+		"datetime":  now.Format(time.RFC3339),
+		"date":      now.Format("2006-01-02"),
+		"time":      now.Format("15:04:05"),
+		"weekday":   now.Weekday().String(),
+		"unix_time": now.Unix(),
+	}, nil
+}
+
+// knowledgeChunk is a searchable passage of a knowledge base document
+type knowledgeChunk struct {
+	title  string
+	source string
+	text   string
+	terms  map[string]int
+}
+
+// knowledgeSearchTool searches the agent's knowledge base by keyword
+type knowledgeSearchTool struct {
+	chunks []knowledgeChunk
+}
+
+func newKnowledgeSearchTool(docs []KnowledgeDocument) *knowledgeSearchTool {
+	t := &knowledgeSearchTool{}
+	for _, doc := range docs {
+		for _, paragraph := range strings.Split(doc.Content, "\n\n") {
+			paragraph = strings.TrimSpace(paragraph)
+			if paragraph == "" {
+				continue
+			}
+			terms := make(map[string]int)
+			for _, term := range tokenize(paragraph) {
+				terms[term]++
+			}
+			t.chunks = append(t.chunks, knowledgeChunk{
+				title:  doc.Title,
+				source: doc.Source,
+				text:   paragraph,
+				terms:  terms,
+			})
+		}
+	}
+	return t
+}
+
+func (t *knowledgeSearchTool) Definition() ToolDefinition {
+	return ToolDefinition{
+		Name:        ToolKnowledgeSearch,
+		Description: "Search the agent's knowledge base and return the most relevant passages.",
+		Parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"query": map[string]interface{}{
+					"type":        "string",
+					"description": "What to search for",
+				},
+				"top_k": map[string]interface{}{
+					"type":        "integer",
+					"description": "Maximum number of passages to return",
+				},
+			},
+			"required": []interface{}{"query"},
+		},
+	}
+}
+
+func (t *knowledgeSearchTool) Call(ctx context.Context, args map[string]interface{}) (map[string]interface{}, error) {
+	query, _ := args["query"].(string)
+	topK := defaultKnowledgeTopK
+	if k, ok := args["top_k"].(float64); ok && k > 0 {
+		topK = int(k)
+	}
+
+	queryTerms := tokenize(query)
+	if len(queryTerms) == 0 {
+		return nil, errors.New("query is empty")
+	}
+
+	type scored struct {
+		chunk *knowledgeChunk
+		score float64
+	}
+	var matches []scored
+	for i := range t.chunks {
+		chunk := &t.chunks[i]
+		score := 0.0
+		for _, term := range queryTerms {
+			if n := chunk.terms[term]; n > 0 {
+				// Dampen repeated terms so one word cannot dominate a passage's score
+				score += 1 + math.Log(float64(n))
+			}
+		}
+		if score > 0 {
+			matches = append(matches, scored{chunk: chunk, score: score})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].score > matches[j].score
+	})
+	if len(matches) > topK {
+		matches = matches[:topK]
+	}
+
+	results := make([]interface{}, 0, len(matches))
+	for _, m := range matches {
+		results = append(results, map[string]interface{}{
+			"title":   m.chunk.title,
+			"source":  m.chunk.source,
+			"content": m.chunk.text,
+			"score":   m.score,
+		})
+	}
+	return map[string]interface{}{
+		"query":   query,
+		"results": results,
+	}, nil
+}
+
+// tokenize splits text into lowercase words
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
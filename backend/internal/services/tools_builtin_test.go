@@ -0,0 +1,166 @@
+package services
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mlaitechio/vagais/internal/config"
+	"github.com/mlaitechio/vagais/internal/models"
+)
+
+// resolveHTTPFetch builds the http_fetch tool an agent asks for under the operator's allow-list
+func resolveHTTPFetch(operator []string, requested ...interface{}) (*httpFetchTool, error) {
+	cfg := &config.Config{Tools: config.ToolsConfig{HTTPAllowedDomains: operator}}
+	spec := AgentToolConfig{Type: ToolHTTPFetch}
+	if requested != nil {
+		spec.Config = map[string]interface{}{"allowed_domains": requested}
+	}
+	tools, err := NewToolRegistry(cfg).Resolve(&models.Agent{}, []AgentToolConfig{spec})
+	if err != nil {
+		return nil, err
+	}
+	return tools[ToolHTTPFetch].(*httpFetchTool), nil
+}
+
+func TestHTTPFetchAllowedDomains(t *testing.T) {
+	tests := []struct {
+		name      string
+		operator  []string
+		requested []interface{}
+		want      []string
+		err       string
+	}{
+		{name: "operator list", operator: []string{"example.com", "docs.io"}, want: []string{"example.com", "docs.io"}},
+		{name: "narrowed to a subdomain", operator: []string{"example.com"}, requested: []interface{}{"api.example.com"}, want: []string{"api.example.com"}},
+		{name: "wildcards", operator: []string{"*.example.com"}, requested: []interface{}{"*.EXAMPLE.com"}, want: []string{"example.com"}},
+		// A broad agent entry only reaches what the operator allows
+		{name: "top-level domain", operator: []string{"example.com", "docs.io"}, requested: []interface{}{"com"}, want: []string{"example.com"}},
+		{name: "partly allowed", operator: []string{"example.com"}, requested: []interface{}{"evil.org", "example.com"}, want: []string{"example.com"}},
+		{name: "nothing allowed", operator: []string{"example.com"}, requested: []interface{}{"evil.org"}, err: "none of the allowed domains"},
+		{name: "no operator list", requested: []interface{}{"example.com"}, err: "TOOLS_HTTP_ALLOWED_DOMAINS is set"},
+		{name: "no lists at all", err: "TOOLS_HTTP_ALLOWED_DOMAINS is set"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tool, err := resolveHTTPFetch(tt.operator, tt.requested...)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Resolve() error = %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resolve() error = %v", err)
+			}
+			if !reflect.DeepEqual(tool.allowed, tt.want) {
+				t.Errorf("allowed domains = %v, want %v", tool.allowed, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTTPFetchCheckURL(t *testing.T) {
+	tool := newHTTPFetchTool([]string{"example.com"}, config.ToolsConfig{})
+
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{url: "https://example.com/page", ok: true},
+		{url: "http://docs.EXAMPLE.com:8080/", ok: true},
+		{url: "https://badexample.com/", ok: false},
+		{url: "https://example.com.evil.org/", ok: false},
+		{url: "ftp://example.com/file", ok: false},
+		{url: "file:///etc/passwd", ok: false},
+	}
+
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tool.checkURL(u); (err == nil) != tt.ok {
+			t.Errorf("checkURL(%s) error = %v, want allowed %v", tt.url, err, tt.ok)
+		}
+	}
+}
+
+func TestIsInternalIP(t *testing.T) {
+	tests := []struct {
+		ip       string
+		internal bool
+	}{
+		{ip: "127.0.0.1", internal: true},
+		{ip: "10.1.2.3", internal: true},
+		{ip: "172.16.0.1", internal: true},
+		{ip: "192.168.1.1", internal: true},
+		{ip: "169.254.169.254", internal: true},
+		{ip: "100.64.0.1", internal: true},
+		{ip: "0.0.0.0", internal: true},
+		{ip: "198.18.0.1", internal: true},
+		{ip: "224.0.0.1", internal: true},
+		{ip: "::1", internal: true},
+		{ip: "fd00::1", internal: true},
+		{ip: "fe80::1", internal: true},
+		// IPv4 addresses embedded in IPv6 are checked as IPv4
+		{ip: "::ffff:127.0.0.1", internal: true},
+		{ip: "64:ff9b::a9fe:a9fe", internal: true},
+		{ip: "64:ff9b::808:808", internal: false},
+		{ip: "8.8.8.8", internal: false},
+		{ip: "93.184.216.34", internal: false},
+		{ip: "2606:4700::1111", internal: false},
+	}
+
+	for _, tt := range tests {
+		if got := isInternalIP(net.ParseIP(tt.ip)); got != tt.internal {
+			t.Errorf("isInternalIP(%s) = %v, want %v", tt.ip, got, tt.internal)
+		}
+	}
+}
+
+func TestHTTPFetchRefusesInternalAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("internal"))
+	}))
+	defer server.Close()
+
+	// The name is allowed, but the address it reaches is not
+	tool := newHTTPFetchTool([]string{"127.0.0.1"}, config.ToolsConfig{})
+	_, err := tool.Call(context.Background(), map[string]interface{}{"url": server.URL})
+	if err == nil || !strings.Contains(err.Error(), "is not allowed") {
+		t.Errorf("Call() error = %v, want the connection refused", err)
+	}
+}
+
+func TestEvaluateExpression(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       float64
+	}{
+		{expression: "1 + 2 * 3", want: 7},
+		{expression: "(1 + 2) * 3", want: 9},
+		{expression: "2 ^ 3 ^ 2", want: 512},
+		{expression: "-4 + 10 / 4", want: -1.5},
+		{expression: "sqrt(16) + abs(-2)", want: 6},
+	}
+
+	for _, tt := range tests {
+		got, err := evaluateExpression(tt.expression)
+		if err != nil || got != tt.want {
+			t.Errorf("evaluateExpression(%s) = %v, %v, want %v", tt.expression, got, err, tt.want)
+		}
+	}
+
+	for _, expression := range []string{"", "1 +", "1 / 0", "(2", "unknown(1)"} {
+		if _, err := evaluateExpression(expression); err == nil {
+			t.Errorf("evaluateExpression(%s) error = nil, want an error", expression)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package services
 
 import (
 	"errors"
+	"fmt"
+	"net/url"
 	"strings"
 
 	"gorm.io/gorm"
@@ -13,12 +15,16 @@ import (
 // UserService handles user operations
 type UserService struct {
 	BaseService
+	plans  *PlanService
+	emails *EmailService
 }
 
 // NewUserService creates a new user service
 func NewUserService(db *gorm.DB, cfg *config.Config) *UserService {
 	return &UserService{
 		BaseService: NewBaseService(db, cfg, "user"),
+		plans:       NewPlanService(db, cfg),
+		emails:      NewEmailService(db, cfg),
 	}
 }
 
@@ -45,6 +51,9 @@ type UpdateOrganizationRequest struct {
 	Website     string `json:"website"`
 	Logo        string `json:"logo"`
 	IsActive    *bool  `json:"is_active"`
+
+	RequireVerifiedEmail *bool `json:"require_verified_email"`
+	RequireMFA           *bool `json:"require_mfa"`
 }
 
 // GetUser retrieves a user by ID
@@ -121,13 +130,13 @@ func (s *UserService) ListUsers(page, limit int, orgID *string) ([]models.User,
 // DeactivateUser deactivates a user
 func (s *UserService) DeactivateUser(id string, adminID string) error {
 	var user models.User
-	if err := s.db.First(&user, id).Error; err != nil {
+	if err := s.db.First(&user, "id = ?", id).Error; err != nil {
 		return err
 	}
 
 	// Check if admin has permission
 	var admin models.User
-	if err := s.db.First(&admin, adminID).Error; err != nil {
+	if err := s.db.First(&admin, "id = ?", adminID).Error; err != nil {
 		return err
 	}
 
@@ -141,13 +150,13 @@ func (s *UserService) DeactivateUser(id string, adminID string) error {
 // ActivateUser activates a user
 func (s *UserService) ActivateUser(id string, adminID string) error {
 	var user models.User
-	if err := s.db.First(&user, id).Error; err != nil {
+	if err := s.db.First(&user, "id = ?", id).Error; err != nil {
 		return err
 	}
 
 	// Check if admin has permission
 	var admin models.User
-	if err := s.db.First(&admin, adminID).Error; err != nil {
+	if err := s.db.First(&admin, "id = ?", adminID).Error; err != nil {
 		return err
 	}
 
@@ -167,7 +176,7 @@ func (s *UserService) UpdateUserRole(id string, role string, adminID string) err
 
 	// Check if admin has permission
 	var admin models.User
-	if err := s.db.First(&admin, adminID).Error; err != nil {
+	if err := s.db.First(&admin, "id = ?", adminID).Error; err != nil {
 		return err
 	}
 
@@ -227,13 +236,13 @@ func (s *UserService) CreateOrganization(req *CreateOrganizationRequest, creator
 // UpdateOrganization updates an organization
 func (s *UserService) UpdateOrganization(id string, req *UpdateOrganizationRequest, userID string) (*models.Organization, error) {
 	var org models.Organization
-	if err := s.db.First(&org, id).Error; err != nil {
+	if err := s.db.First(&org, "id = ?", id).Error; err != nil {
 		return nil, err
 	}
 
 	// Check if user is admin of this organization
 	var user models.User
-	if err := s.db.First(&user, userID).Error; err != nil {
+	if err := s.db.First(&user, "id = ?", userID).Error; err != nil {
 		return nil, err
 	}
 
@@ -258,6 +267,17 @@ func (s *UserService) UpdateOrganization(id string, req *UpdateOrganizationReque
 	if req.IsActive != nil {
 		updates["is_active"] = *req.IsActive
 	}
+	if req.RequireVerifiedEmail != nil {
+		updates["require_verified_email"] = *req.RequireVerifiedEmail
+	}
+	if req.RequireMFA != nil {
+		// Members without MFA are locked out until they enable it, so the
+		// admin turning it on must not be one of them
+		if *req.RequireMFA && !user.MFAEnabled {
+			return nil, errors.New("enable multi-factor authentication on your own account before requiring it")
+		}
+		updates["require_mfa"] = *req.RequireMFA
+	}
 
 	if err := s.db.Model(&org).Updates(updates).Error; err != nil {
 		return nil, err
@@ -291,7 +311,7 @@ func (s *UserService) ListOrganizations(page, limit int) ([]models.Organization,
 func (s *UserService) AddUserToOrganization(userID, orgID string, role string, adminID string) error {
 	// Check if admin has permission
 	var admin models.User
-	if err := s.db.First(&admin, adminID).Error; err != nil {
+	if err := s.db.First(&admin, "id = ?", adminID).Error; err != nil {
 		return err
 	}
 
@@ -309,7 +329,7 @@ func (s *UserService) AddUserToOrganization(userID, orgID string, role string, a
 func (s *UserService) RemoveUserFromOrganization(userID string, adminID string) error {
 	// Check if admin has permission
 	var admin models.User
-	if err := s.db.First(&admin, adminID).Error; err != nil {
+	if err := s.db.First(&admin, "id = ?", adminID).Error; err != nil {
 		return err
 	}
 
@@ -389,7 +409,7 @@ type InviteUserRequest struct {
 func (s *UserService) InviteUserToOrganization(req *InviteUserRequest, orgID string, adminID string) error {
 	// Check if admin has permission
 	var admin models.User
-	if err := s.db.First(&admin, adminID).Error; err != nil {
+	if err := s.db.First(&admin, "id = ?", adminID).Error; err != nil {
 		return err
 	}
 
@@ -400,14 +420,59 @@ func (s *UserService) InviteUserToOrganization(req *InviteUserRequest, orgID str
 	// Check if user already exists
 	var existingUser models.User
 	if err := s.db.Where("email = ?", req.Email).First(&existingUser).Error; err == nil {
-		// User exists, add to organization
-		return s.db.Model(&existingUser).Updates(map[string]interface{}{
+		// User exists, add to organization if the plan has a free seat
+		if existingUser.OrganizationID == nil || *existingUser.OrganizationID != orgID {
+			if err := s.plans.CheckSeatQuota(orgID); err != nil {
+				return err
+			}
+		}
+		if err := s.db.Model(&existingUser).Updates(map[string]interface{}{
 			"organization_id": orgID,
 			"role":            req.Role,
-		}).Error
+		}).Error; err != nil {
+			return err
+		}
+		s.sendInvitation(req, orgID, &admin, &existingUser)
+		return nil
 	}
 
-	// User doesn't exist, create invitation (in a real app, you'd send an email)
-	// For now, we'll just return success
+	// User doesn't exist, invite them to sign up
+	s.sendInvitation(req, orgID, &admin, nil)
 	return nil
 }
+
+// sendInvitation emails an invited user. existing is nil when the user has
+// yet to create an account.
+func (s *UserService) sendInvitation(req *InviteUserRequest, orgID string, admin *models.User, existing *models.User) {
+	var org models.Organization
+	if err := s.db.First(&org, "id = ?", orgID).Error; err != nil {
+		fmt.Printf("Error loading organization %s for invitation: %v\n", orgID, err)
+		return
+	}
+
+	actionURL := s.cfg.Email.AppURL + "/register?email=" + url.QueryEscape(req.Email)
+	var userID *string
+	if existing != nil {
+		actionURL = s.cfg.Email.AppURL + "/login"
+		userID = &existing.ID
+	}
+	invitedBy := strings.TrimSpace(admin.FirstName + " " + admin.LastName)
+	if invitedBy == "" {
+		invitedBy = admin.Email
+	}
+
+	if err := s.emails.SendAsync(&EmailRequest{
+		To:       req.Email,
+		UserID:   userID,
+		Template: EmailTemplateInvitation,
+		Data: map[string]interface{}{
+			"Existing":     existing != nil,
+			"Organization": org.Name,
+			"InvitedBy":    invitedBy,
+			"Role":         req.Role,
+			"ActionURL":    actionURL,
+		},
+	}); err != nil {
+		fmt.Printf("Error sending invitation to %s: %v\n", req.Email, err)
+	}
+}
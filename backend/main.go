@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -49,6 +50,9 @@ func main() {
 
 	// Initialize configuration
 	cfg := config.Load()
+	if err := services.CheckPaymentProvider(cfg); err != nil {
+		log.Fatalf("Invalid payment configuration: %v", err)
+	}
 
 	// Initialize database
 	db, err := database.Initialize(cfg)
@@ -65,6 +69,12 @@ func main() {
 	// Initialize services
 	services.InitializeServices(db, redisClient, cfg)
 
+	// Start the execution workers
+	services.ExecutionWorkerPoolInstance.Start()
+
+	// Start issuing monthly invoices
+	services.BillingJobInstance.Start()
+
 	// Set Gin mode
 	if cfg.Environment == "production" {
 		gin.SetMode(gin.ReleaseMode)
@@ -73,6 +83,12 @@ func main() {
 	// Initialize router
 	router := gin.New()
 
+	// Client addresses feed rate limits and API key IP allow-lists, so
+	// forwarding headers are only believed from the configured proxies
+	if err := router.SetTrustedProxies(cfg.Security.TrustedProxies); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+
 	// Add middleware
 	router.Use(gin.Logger())
 	router.Use(gin.Recovery())
@@ -118,6 +134,11 @@ func main() {
 		c.File("./dist/index.html")
 	})
 
+	// Requests run under a context cancelled when shutdown begins, so event
+	// streams and chat turns end instead of holding the server open
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	defer cancelBase()
+
 	// Start server
 	srv := &http.Server{
 		Addr:         ":" + cfg.Port,
@@ -125,7 +146,11 @@ func main() {
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
+		BaseContext: func(net.Listener) context.Context {
+			return baseCtx
+		},
 	}
+	srv.RegisterOnShutdown(cancelBase)
 
 	// Start server in a goroutine
 	go func() {
@@ -141,12 +166,18 @@ func main() {
 	<-quit
 	log.Println("Shutting down server...")
 
+	// Abort running executions first; they go back to the queue and are
+	// resumed by the next worker to start
+	services.ExecutionWorkerPoolInstance.Stop()
+	services.BillingJobInstance.Stop()
+
 	// Give outstanding requests a deadline for completion
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatal("Server forced to shutdown:", err)
+		log.Printf("Server forced to shutdown: %v", err)
+		srv.Close()
 	}
 
 	log.Println("Server exiting")
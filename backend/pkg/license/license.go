@@ -0,0 +1,265 @@
+// Package license issues and verifies signed license keys for on-premises
+// agent deployments.
+//
+// A license key is a JSON claims document signed with Ed25519. Verification
+// needs only the issuer's public key, so air-gapped installations can embed
+// this package and check keys without contacting the marketplace:
+//
+//	verifier := license.NewVerifier(publicKey)
+//	result, err := verifier.Verify(key, license.Check{AgentID: agentID})
+//
+// Revoked licenses are distributed as a signed revocation list that can be
+// copied onto the installation and loaded with Verifier.SetRevocations.
+package license
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Token prefixes; the prefix is signed, so a revocation list can never be
+// presented as a license key or the other way round
+const (
+	KeyPrefix            = "vgl1"
+	RevocationListPrefix = "vgr1"
+)
+
+// Verification errors
+var (
+	ErrMalformed        = errors.New("license key is malformed")
+	ErrInvalidSignature = errors.New("license key signature is invalid")
+	ErrNotYetValid      = errors.New("license is not valid yet")
+	ErrExpired          = errors.New("license has expired")
+	ErrRevoked          = errors.New("license has been revoked")
+	ErrHardwareMismatch = errors.New("license is bound to a different machine")
+	ErrAgentNotLicensed = errors.New("license does not cover this agent")
+	ErrSeatsExceeded    = errors.New("license seat count exceeded")
+)
+
+// Claims are the terms a license key grants
+type Claims struct {
+	ID             string     `json:"jti"`
+	Issuer         string     `json:"iss,omitempty"`
+	Type           string     `json:"type"`
+	UserID         string     `json:"sub,omitempty"`
+	OrganizationID string     `json:"org,omitempty"`
+	AgentIDs       []string   `json:"agents,omitempty"` // empty covers every agent
+	Seats          int        `json:"seats,omitempty"`  // 0 means unlimited
+	Features       []string   `json:"features,omitempty"`
+	DeploymentType string     `json:"deployment,omitempty"` // on_premise, cloud, hybrid
+	HardwareID     string     `json:"hwid,omitempty"`
+	IssuedAt       time.Time  `json:"iat"`
+	NotBefore      *time.Time `json:"nbf,omitempty"`
+	ExpiresAt      *time.Time `json:"exp,omitempty"` // nil never expires
+	GraceDays      int        `json:"grace_days,omitempty"`
+}
+
+// GraceEndsAt returns when the license stops working, its expiry plus the
+// grace period, or nil for a perpetual license
+func (c *Claims) GraceEndsAt() *time.Time {
+	if c.ExpiresAt == nil {
+		return nil
+	}
+	end := c.ExpiresAt.AddDate(0, 0, c.GraceDays)
+	return &end
+}
+
+// CoversAgent reports whether the license allows running the agent
+func (c *Claims) CoversAgent(agentID string) bool {
+	if len(c.AgentIDs) == 0 {
+		return true
+	}
+	for _, id := range c.AgentIDs {
+		if id == agentID {
+			return true
+		}
+	}
+	return false
+}
+
+// HasFeature reports whether the license enables a feature
+func (c *Claims) HasFeature(feature string) bool {
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Sign encodes the claims and signs them with the issuer's private key
+func Sign(key ed25519.PrivateKey, claims *Claims) (string, error) {
+	if claims.ID == "" {
+		return "", errors.New("license ID is required")
+	}
+	return signToken(key, KeyPrefix, claims)
+}
+
+// Decode reads the claims from a license key without verifying its signature.
+// Use it only to look a key up; never trust the result.
+func Decode(key string) (*Claims, error) {
+	payload, _, err := splitToken(KeyPrefix, key)
+	if err != nil {
+		return nil, err
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.ID == "" {
+		return nil, ErrMalformed
+	}
+	return &claims, nil
+}
+
+// Fingerprint returns a short, stable identifier for a license key, suitable
+// for logs where the key itself should not appear
+func Fingerprint(key string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(key)))
+	return fmt.Sprintf("%x", sum[:8])
+}
+
+// Check lists the conditions a license must satisfy besides a valid signature.
+// Empty fields are not checked.
+type Check struct {
+	AgentID    string
+	HardwareID string
+	Users      int
+}
+
+// Result describes a license that passed verification
+type Result struct {
+	Claims      *Claims    `json:"claims"`
+	InGrace     bool       `json:"in_grace"`
+	GraceEndsAt *time.Time `json:"grace_ends_at,omitempty"`
+}
+
+// Verifier checks license keys against the issuer's public key and, when
+// loaded, a revocation list
+type Verifier struct {
+	publicKey   ed25519.PublicKey
+	revocations *RevocationList
+
+	// Now returns the current time; tests and installs with an untrusted
+	// clock may replace it
+	Now func() time.Time
+}
+
+// NewVerifier creates a verifier for keys signed by the given public key
+func NewVerifier(publicKey ed25519.PublicKey) *Verifier {
+	return &Verifier{
+		publicKey: publicKey,
+		Now:       time.Now,
+	}
+}
+
+// SetRevocations verifies a signed revocation list and uses it for later
+// checks. A list older than the one already loaded is ignored, so an old
+// copy cannot un-revoke a license.
+func (v *Verifier) SetRevocations(token string) error {
+	list, err := ParseRevocationList(v.publicKey, token)
+	if err != nil {
+		return err
+	}
+	if v.revocations != nil && list.IssuedAt.Before(v.revocations.IssuedAt) {
+		return nil
+	}
+	v.revocations = list
+	return nil
+}
+
+// Revocations returns the revocation list in use, or nil
+func (v *Verifier) Revocations() *RevocationList {
+	return v.revocations
+}
+
+// Verify checks a license key's signature, validity period, revocation and
+// the given conditions. A license past its expiry but inside its grace
+// period is accepted with InGrace set.
+func (v *Verifier) Verify(key string, check Check) (*Result, error) {
+	payload, err := verifyToken(v.publicKey, KeyPrefix, key)
+	if err != nil {
+		return nil, err
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.ID == "" {
+		return nil, ErrMalformed
+	}
+
+	result := &Result{Claims: &claims, GraceEndsAt: claims.GraceEndsAt()}
+	now := v.Now()
+	if claims.NotBefore != nil && now.Before(*claims.NotBefore) {
+		return result, ErrNotYetValid
+	}
+	if claims.ExpiresAt != nil && now.After(*claims.ExpiresAt) {
+		if now.After(*result.GraceEndsAt) {
+			return result, ErrExpired
+		}
+		result.InGrace = true
+	}
+	if v.revocations != nil && v.revocations.IsRevoked(claims.ID) {
+		return result, ErrRevoked
+	}
+
+	if check.HardwareID != "" && claims.HardwareID != "" && check.HardwareID != claims.HardwareID {
+		return result, ErrHardwareMismatch
+	}
+	if check.AgentID != "" && !claims.CoversAgent(check.AgentID) {
+		return result, ErrAgentNotLicensed
+	}
+	if check.Users > 0 && claims.Seats > 0 && check.Users > claims.Seats {
+		return result, ErrSeatsExceeded
+	}
+	return result, nil
+}
+
+// signToken encodes v as JSON and signs it as <prefix>.<payload>.<signature>
+func signToken(key ed25519.PrivateKey, prefix string, v interface{}) (string, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return "", errors.New("invalid Ed25519 private key")
+	}
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	signed := prefix + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature := ed25519.Sign(key, []byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// verifyToken checks a token's signature and returns its payload
+func verifyToken(publicKey ed25519.PublicKey, prefix, token string) ([]byte, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid Ed25519 public key")
+	}
+	payload, signature, err := splitToken(prefix, token)
+	if err != nil {
+		return nil, err
+	}
+	token = strings.TrimSpace(token)
+	signed := token[:strings.LastIndexByte(token, '.')]
+	if !ed25519.Verify(publicKey, []byte(signed), signature) {
+		return nil, ErrInvalidSignature
+	}
+	return payload, nil
+}
+
+// splitToken decodes the payload and signature of a token
+func splitToken(prefix, token string) ([]byte, []byte, error) {
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 || parts[0] != prefix {
+		return nil, nil, ErrMalformed
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, ErrMalformed
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return nil, nil, ErrMalformed
+	}
+	return payload, signature, nil
+}
@@ -0,0 +1,326 @@
+package license
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testNow is the time licenses are verified at in these tests
+var testNow = time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func newTestKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+	public, private, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	return public, private
+}
+
+func newTestVerifier(public ed25519.PublicKey) *Verifier {
+	verifier := NewVerifier(public)
+	verifier.Now = func() time.Time { return testNow }
+	return verifier
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+func testClaims() *Claims {
+	return &Claims{
+		ID:             "lic-1",
+		Issuer:         "vagais",
+		Type:           "enterprise",
+		UserID:         "user-1",
+		OrganizationID: "org-1",
+		AgentIDs:       []string{"agent-1", "agent-2"},
+		Seats:          10,
+		Features:       []string{"sso", "audit"},
+		DeploymentType: "on_premise",
+		HardwareID:     "hw-1",
+		IssuedAt:       testNow.AddDate(0, -1, 0),
+		NotBefore:      timePtr(testNow.AddDate(0, -1, 0)),
+		ExpiresAt:      timePtr(testNow.AddDate(1, 0, 0)),
+		GraceDays:      14,
+	}
+}
+
+func sign(t *testing.T, key ed25519.PrivateKey, claims *Claims) string {
+	t.Helper()
+	token, err := Sign(key, claims)
+	if err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+	return token
+}
+
+func TestSignVerifyRoundTrip(t *testing.T) {
+	public, private := newTestKey(t)
+	claims := testClaims()
+	key := sign(t, private, claims)
+
+	if !strings.HasPrefix(key, KeyPrefix+".") || strings.Count(key, ".") != 2 {
+		t.Errorf("Sign() = %q, want <prefix>.<payload>.<signature>", key)
+	}
+
+	result, err := newTestVerifier(public).Verify(key, Check{AgentID: "agent-2", HardwareID: "hw-1", Users: 10})
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if !reflect.DeepEqual(result.Claims, claims) {
+		t.Errorf("Verify() claims = %+v, want %+v", result.Claims, claims)
+	}
+	if result.InGrace || !result.GraceEndsAt.Equal(claims.ExpiresAt.AddDate(0, 0, 14)) {
+		t.Errorf("Verify() = in grace %v until %v, want not in grace until 14 days after expiry", result.InGrace, result.GraceEndsAt)
+	}
+
+	// Surrounding whitespace from copying the key is ignored
+	if _, err := newTestVerifier(public).Verify("  "+key+"\n", Check{}); err != nil {
+		t.Errorf("Verify() with whitespace: error = %v", err)
+	}
+
+	decoded, err := Decode(key)
+	if err != nil || !reflect.DeepEqual(decoded, claims) {
+		t.Errorf("Decode() = %+v, %v, want the signed claims", decoded, err)
+	}
+}
+
+func TestVerifyRejectsTampering(t *testing.T) {
+	public, private := newTestKey(t)
+	key := sign(t, private, testClaims())
+	parts := strings.Split(key, ".")
+
+	// Raise the seat count in the payload and keep the original signature
+	var claims map[string]interface{}
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	json.Unmarshal(payload, &claims)
+	claims["seats"] = 1000
+	forged, _ := json.Marshal(claims)
+	forgedPayload := parts[0] + "." + base64.RawURLEncoding.EncodeToString(forged) + "." + parts[2]
+
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	signature[0] ^= 0x01
+	flippedSignature := parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(signature)
+
+	_, otherKey := newTestKey(t)
+	otherIssuer := sign(t, otherKey, testClaims())
+
+	list, err := SignRevocationList(private, &RevocationList{IssuedAt: testNow})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		key  string
+		want error
+	}{
+		{name: "modified payload", key: forgedPayload, want: ErrInvalidSignature},
+		{name: "modified signature", key: flippedSignature, want: ErrInvalidSignature},
+		{name: "signed by another issuer", key: otherIssuer, want: ErrInvalidSignature},
+		{name: "relabelled as a revocation list", key: RevocationListPrefix + "." + parts[1] + "." + parts[2], want: ErrMalformed},
+		{name: "revocation list presented as a key", key: list, want: ErrMalformed},
+		// The prefix is signed, so relabelling a token breaks its signature
+		{name: "revocation list relabelled as a key", key: KeyPrefix + strings.TrimPrefix(list, RevocationListPrefix), want: ErrInvalidSignature},
+		{name: "truncated signature", key: key[:len(key)-4], want: ErrMalformed},
+		{name: "missing signature", key: parts[0] + "." + parts[1], want: ErrMalformed},
+		{name: "extra segment", key: key + ".x", want: ErrMalformed},
+		{name: "payload not base64", key: parts[0] + ".!!!." + parts[2], want: ErrMalformed},
+		{name: "empty", key: "", want: ErrMalformed},
+	}
+
+	verifier := newTestVerifier(public)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := verifier.Verify(tt.key, Check{}); !errors.Is(err, tt.want) {
+				t.Errorf("Verify() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyValidityPeriod(t *testing.T) {
+	public, private := newTestKey(t)
+	verifier := newTestVerifier(public)
+
+	tests := []struct {
+		name    string
+		modify  func(*Claims)
+		want    error
+		inGrace bool
+	}{
+		{name: "valid", modify: func(*Claims) {}},
+		{name: "perpetual", modify: func(c *Claims) { c.ExpiresAt = nil }},
+		{name: "not yet valid", modify: func(c *Claims) { c.NotBefore = timePtr(testNow.Add(time.Hour)) }, want: ErrNotYetValid},
+		{name: "in grace period", modify: func(c *Claims) { c.ExpiresAt = timePtr(testNow.AddDate(0, 0, -13)) }, inGrace: true},
+		{name: "grace period over", modify: func(c *Claims) { c.ExpiresAt = timePtr(testNow.AddDate(0, 0, -15)) }, want: ErrExpired},
+		{name: "expired without grace", modify: func(c *Claims) {
+			c.ExpiresAt = timePtr(testNow.Add(-time.Second))
+			c.GraceDays = 0
+		}, want: ErrExpired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := testClaims()
+			tt.modify(claims)
+			result, err := verifier.Verify(sign(t, private, claims), Check{})
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.want)
+			}
+			if result.InGrace != tt.inGrace {
+				t.Errorf("Verify() in grace = %v, want %v", result.InGrace, tt.inGrace)
+			}
+		})
+	}
+}
+
+func TestVerifyConditions(t *testing.T) {
+	public, private := newTestKey(t)
+	verifier := newTestVerifier(public)
+	key := sign(t, private, testClaims())
+
+	tests := []struct {
+		name  string
+		check Check
+		want  error
+	}{
+		{name: "other machine", check: Check{HardwareID: "hw-2"}, want: ErrHardwareMismatch},
+		{name: "agent not covered", check: Check{AgentID: "agent-3"}, want: ErrAgentNotLicensed},
+		{name: "too many users", check: Check{Users: 11}, want: ErrSeatsExceeded},
+		{name: "within limits", check: Check{AgentID: "agent-1", HardwareID: "hw-1", Users: 10}},
+	}
+	for _, tt := range tests {
+		if _, err := verifier.Verify(key, tt.check); !errors.Is(err, tt.want) {
+			t.Errorf("%s: Verify() error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	// Unbound licenses cover every agent, machine and number of users
+	claims := testClaims()
+	claims.AgentIDs, claims.HardwareID, claims.Seats = nil, "", 0
+	if _, err := verifier.Verify(sign(t, private, claims), Check{AgentID: "agent-9", HardwareID: "hw-9", Users: 500}); err != nil {
+		t.Errorf("unbound license: Verify() error = %v", err)
+	}
+}
+
+func TestRevocations(t *testing.T) {
+	public, private := newTestKey(t)
+	verifier := newTestVerifier(public)
+	key := sign(t, private, testClaims())
+
+	signList := func(issuedAt time.Time, revoked ...string) string {
+		t.Helper()
+		list, err := SignRevocationList(private, &RevocationList{IssuedAt: issuedAt, Revoked: revoked})
+		if err != nil {
+			t.Fatalf("SignRevocationList() error = %v", err)
+		}
+		return list
+	}
+
+	if err := verifier.SetRevocations(signList(testNow, "lic-0", "lic-1")); err != nil {
+		t.Fatalf("SetRevocations() error = %v", err)
+	}
+	if _, err := verifier.Verify(key, Check{}); !errors.Is(err, ErrRevoked) {
+		t.Errorf("revoked license: Verify() error = %v, want ErrRevoked", err)
+	}
+
+	// An older list cannot take a revocation back
+	if err := verifier.SetRevocations(signList(testNow.Add(-time.Hour))); err != nil {
+		t.Fatalf("SetRevocations() with an older list: error = %v", err)
+	}
+	if _, err := verifier.Verify(key, Check{}); !errors.Is(err, ErrRevoked) {
+		t.Errorf("after an older list: Verify() error = %v, want ErrRevoked", err)
+	}
+
+	// A list signed by someone else, or a license key, is refused
+	_, otherKey := newTestKey(t)
+	forged, err := SignRevocationList(otherKey, &RevocationList{IssuedAt: testNow.Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifier.SetRevocations(forged); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("SetRevocations() with a forged list: error = %v, want ErrInvalidSignature", err)
+	}
+	if err := verifier.SetRevocations(key); !errors.Is(err, ErrMalformed) {
+		t.Errorf("SetRevocations() with a license key: error = %v, want ErrMalformed", err)
+	}
+	if list := verifier.Revocations(); list == nil || !list.IsRevoked("lic-1") || list.IsRevoked("lic-2") {
+		t.Errorf("Revocations() = %+v, want the first list", list)
+	}
+
+	// A newer list replaces it
+	if err := verifier.SetRevocations(signList(testNow.Add(time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.Verify(key, Check{}); err != nil {
+		t.Errorf("after a newer list: Verify() error = %v", err)
+	}
+}
+
+func TestSignRequiresID(t *testing.T) {
+	_, private := newTestKey(t)
+	claims := testClaims()
+	claims.ID = ""
+	if _, err := Sign(private, claims); err == nil {
+		t.Error("Sign() without an ID: want an error")
+	}
+	if _, err := Sign(private[:10], testClaims()); err == nil {
+		t.Error("Sign() with a short key: want an error")
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	public, private := newTestKey(t)
+	seed := private.Seed()
+
+	for name, encoded := range map[string]string{
+		"expanded":          EncodeKey(private),
+		"seed":              EncodeKey(seed),
+		"URL-safe seed":     base64.RawURLEncoding.EncodeToString(seed),
+		"seed with padding": base64.URLEncoding.EncodeToString(seed) + "\n",
+	} {
+		parsed, err := ParsePrivateKey(encoded)
+		if err != nil || !parsed.Equal(private) {
+			t.Errorf("ParsePrivateKey(%s) = %v, want the original key", name, err)
+		}
+	}
+	if parsed, err := ParsePublicKey(EncodeKey(public)); err != nil || !parsed.Equal(public) {
+		t.Errorf("ParsePublicKey() = %v, want the original key", err)
+	}
+
+	if _, err := ParsePrivateKey(EncodeKey(seed[:16])); err == nil {
+		t.Error("ParsePrivateKey() with 16 bytes: want an error")
+	}
+	if _, err := ParsePublicKey(EncodeKey(private)); err == nil {
+		t.Error("ParsePublicKey() with a private key: want an error")
+	}
+	if _, err := ParsePublicKey("not base64!"); err == nil {
+		t.Error("ParsePublicKey() with invalid base64: want an error")
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	_, private := newTestKey(t)
+	key := sign(t, private, testClaims())
+
+	fingerprint := Fingerprint(key)
+	if len(fingerprint) != 16 || strings.Contains(key, fingerprint) {
+		t.Errorf("Fingerprint() = %q, want 16 hex characters not taken from the key", fingerprint)
+	}
+	if Fingerprint(" "+key+"\n") != fingerprint {
+		t.Error("Fingerprint() depends on surrounding whitespace")
+	}
+	other := testClaims()
+	other.ID = "lic-2"
+	if Fingerprint(sign(t, private, other)) == fingerprint {
+		t.Error("different keys share a fingerprint")
+	}
+}
@@ -0,0 +1,49 @@
+package license
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"time"
+)
+
+// RevocationList is the set of license IDs the issuer has revoked, as of
+// IssuedAt
+type RevocationList struct {
+	Issuer   string    `json:"iss,omitempty"`
+	IssuedAt time.Time `json:"iat"`
+	Revoked  []string  `json:"revoked"`
+
+	index map[string]bool
+}
+
+// IsRevoked reports whether the license ID is on the list
+func (l *RevocationList) IsRevoked(id string) bool {
+	if l.index == nil {
+		l.index = make(map[string]bool, len(l.Revoked))
+		for _, revoked := range l.Revoked {
+			l.index[revoked] = true
+		}
+	}
+	return l.index[id]
+}
+
+// SignRevocationList signs a revocation list for distribution to installs
+func SignRevocationList(key ed25519.PrivateKey, list *RevocationList) (string, error) {
+	if list.Revoked == nil {
+		list.Revoked = []string{}
+	}
+	return signToken(key, RevocationListPrefix, list)
+}
+
+// ParseRevocationList verifies a signed revocation list and decodes it
+func ParseRevocationList(publicKey ed25519.PublicKey, token string) (*RevocationList, error) {
+	payload, err := verifyToken(publicKey, RevocationListPrefix, token)
+	if err != nil {
+		return nil, err
+	}
+	var list RevocationList
+	if err := json.Unmarshal(payload, &list); err != nil {
+		return nil, ErrMalformed
+	}
+	return &list, nil
+}
@@ -0,0 +1,240 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ID token errors
+var (
+	// ErrKeyNotFound is returned when the token is signed with a key that is
+	// not in the key set; the provider may have rotated its keys
+	ErrKeyNotFound = errors.New("ID token signing key not found")
+
+	ErrInvalidIDToken = errors.New("invalid ID token")
+)
+
+// signingMethods are the algorithms accepted for ID tokens. HMAC is not
+// accepted, since the client secret would then be the key.
+var signingMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// clockSkew is the leeway allowed for the provider's clock
+const clockSkew = time.Minute
+
+// KeySet holds a provider's public signing keys by key ID
+type KeySet struct {
+	keys map[string]crypto.PublicKey
+}
+
+// jsonWebKey is a key of a JWK set (RFC 7517)
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// FetchKeySet fetches a provider's JWK set. RSA and EC signing keys are
+// kept; other keys are ignored.
+func FetchKeySet(ctx context.Context, client *http.Client, jwksURI string) (*KeySet, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, jwksURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := doJSON(client, req, &set); err != nil {
+		return nil, fmt.Errorf("fetching signing keys failed: %w", err)
+	}
+
+	keySet := &KeySet{keys: make(map[string]crypto.PublicKey)}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		keySet.keys[jwk.Kid] = key
+	}
+	if len(keySet.keys) == 0 {
+		return nil, errors.New("provider publishes no usable signing keys")
+	}
+	return keySet, nil
+}
+
+// publicKey decodes the key
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+}
+
+// decodeBigInt decodes a base64url big-endian integer
+func decodeBigInt(encoded string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil || len(raw) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
+
+// lookup returns the key for a key ID. Tokens without a key ID are accepted
+// when the set holds a single key.
+func (s *KeySet) lookup(kid string) (crypto.PublicKey, error) {
+	if key, ok := s.keys[kid]; ok {
+		return key, nil
+	}
+	if kid == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, nil
+		}
+	}
+	return nil, ErrKeyNotFound
+}
+
+// Expected holds the values an ID token must carry
+type Expected struct {
+	Issuer   string
+	ClientID string
+	Nonce    string
+}
+
+// IDToken is a validated ID token
+type IDToken struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	GivenName     string
+	FamilyName    string
+	Claims        jwt.MapClaims
+}
+
+// VerifyIDToken checks an ID token's signature, issuer, audience, expiry
+// and nonce (OpenID Connect Core, section 3.1.3.7)
+func VerifyIDToken(raw string, keys *KeySet, expected Expected) (*IDToken, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return keys.lookup(kid)
+	},
+		jwt.WithValidMethods(signingMethods),
+		jwt.WithIssuer(expected.Issuer),
+		jwt.WithAudience(expected.ClientID),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(clockSkew),
+	)
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+
+	if exp, _ := claims.GetExpirationTime(); exp == nil {
+		return nil, fmt.Errorf("%w: missing expiry", ErrInvalidIDToken)
+	}
+	// With several audiences, the token must have been issued to this client
+	if aud, _ := claims.GetAudience(); len(aud) > 1 {
+		if azp, _ := claims["azp"].(string); azp != expected.ClientID {
+			return nil, fmt.Errorf("%w: authorized party is not this client", ErrInvalidIDToken)
+		}
+	}
+	if nonce, _ := claims["nonce"].(string); expected.Nonce == "" || nonce != expected.Nonce {
+		return nil, fmt.Errorf("%w: nonce does not match", ErrInvalidIDToken)
+	}
+
+	token := &IDToken{Claims: claims}
+	token.Subject, _ = claims.GetSubject()
+	if token.Subject == "" {
+		return nil, fmt.Errorf("%w: missing subject", ErrInvalidIDToken)
+	}
+	token.Email, _ = claims["email"].(string)
+	token.Name, _ = claims["name"].(string)
+	token.GivenName, _ = claims["given_name"].(string)
+	token.FamilyName, _ = claims["family_name"].(string)
+	// Some providers send the flag as a string
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		token.EmailVerified = verified
+	case string:
+		token.EmailVerified = verified == "true"
+	}
+	return token, nil
+}
+
+// Strings returns a claim holding a string or a list of strings, such as
+// a groups claim
+func (t *IDToken) Strings(claim string) []string {
+	switch value := t.Claims[claim].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
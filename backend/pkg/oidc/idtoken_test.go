@@ -0,0 +1,251 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testIssuer   = "https://idp.example.com"
+	testClientID = "vagais"
+	testNonce    = "n-0S6_WzA2Mj"
+)
+
+// testKeys is a key set holding a single RSA key, and its private half
+type testKeys struct {
+	private *rsa.PrivateKey
+	set     *KeySet
+}
+
+func newTestKeys(t *testing.T) *testKeys {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	return &testKeys{
+		private: key,
+		set:     &KeySet{keys: map[string]crypto.PublicKey{"k1": &key.PublicKey}},
+	}
+}
+
+// validClaims returns the claims of an ID token that passes validation
+func validClaims() jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":   testIssuer,
+		"sub":   "248289761001",
+		"aud":   testClientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(5 * time.Minute).Unix(),
+		"nonce": testNonce,
+		"email": "ann@example.com",
+	}
+}
+
+// sign signs claims with the method and key, under key ID kid
+func sign(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	raw, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("signing token: %v", err)
+	}
+	return raw
+}
+
+func expected() Expected {
+	return Expected{Issuer: testIssuer, ClientID: testClientID, Nonce: testNonce}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	keys := newTestKeys(t)
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		modify func(jwt.MapClaims)
+		want   Expected
+		valid  bool
+	}{
+		{name: "valid", modify: func(jwt.MapClaims) {}, valid: true},
+		{name: "wrong issuer", modify: func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }},
+		{name: "missing issuer", modify: func(c jwt.MapClaims) { delete(c, "iss") }},
+		{name: "wrong audience", modify: func(c jwt.MapClaims) { c["aud"] = "other-client" }},
+		{name: "audience list", modify: func(c jwt.MapClaims) {
+			c["aud"] = []string{"other-client", testClientID}
+			c["azp"] = testClientID
+		}, valid: true},
+		{name: "audience list without authorized party", modify: func(c jwt.MapClaims) {
+			c["aud"] = []string{"other-client", testClientID}
+		}},
+		{name: "audience list authorized to another client", modify: func(c jwt.MapClaims) {
+			c["aud"] = []string{"other-client", testClientID}
+			c["azp"] = "other-client"
+		}},
+		{name: "expired", modify: func(c jwt.MapClaims) { c["exp"] = now.Add(-2 * clockSkew).Unix() }},
+		{name: "expired within clock skew", modify: func(c jwt.MapClaims) { c["exp"] = now.Add(-clockSkew / 2).Unix() }, valid: true},
+		{name: "missing expiry", modify: func(c jwt.MapClaims) { delete(c, "exp") }},
+		{name: "issued in the future", modify: func(c jwt.MapClaims) { c["iat"] = now.Add(2 * clockSkew).Unix() }},
+		{name: "not yet valid", modify: func(c jwt.MapClaims) { c["nbf"] = now.Add(2 * clockSkew).Unix() }},
+		{name: "wrong nonce", modify: func(c jwt.MapClaims) { c["nonce"] = "replayed" }},
+		{name: "missing nonce", modify: func(c jwt.MapClaims) { delete(c, "nonce") }},
+		{name: "no nonce expected", modify: func(c jwt.MapClaims) { c["nonce"] = "" }, want: Expected{Issuer: testIssuer, ClientID: testClientID}},
+		{name: "missing subject", modify: func(c jwt.MapClaims) { delete(c, "sub") }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := validClaims()
+			tt.modify(claims)
+			want := tt.want
+			if want == (Expected{}) {
+				want = expected()
+			}
+
+			token, err := VerifyIDToken(sign(t, jwt.SigningMethodRS256, keys.private, "k1", claims), keys.set, want)
+			if tt.valid {
+				if err != nil {
+					t.Fatalf("VerifyIDToken() error = %v, want nil", err)
+				}
+				if token.Subject != "248289761001" || token.Email != "ann@example.com" {
+					t.Errorf("VerifyIDToken() = %+v, want the token's subject and email", token)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidIDToken) {
+				t.Fatalf("VerifyIDToken() error = %v, want ErrInvalidIDToken", err)
+			}
+		})
+	}
+}
+
+func TestVerifyIDTokenAlgorithmConfusion(t *testing.T) {
+	keys := newTestKeys(t)
+	publicDER, err := x509.MarshalPKIXPublicKey(&keys.private.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		// The public key is known to anyone; a verifier that let the token
+		// choose HMAC would accept it as the shared secret
+		{name: "HS256 keyed with the public key PEM", token: sign(t, jwt.SigningMethodHS256, publicPEM, "k1", validClaims())},
+		{name: "HS256 keyed with the public key DER", token: sign(t, jwt.SigningMethodHS256, publicDER, "k1", validClaims())},
+		{name: "unsigned", token: sign(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "k1", validClaims())},
+		{name: "ES256 under the RSA key ID", token: sign(t, jwt.SigningMethodES256, ecKey, "k1", validClaims())},
+		{name: "RS256 signed by another key", token: sign(t, jwt.SigningMethodRS256, otherKey, "k1", validClaims())},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := VerifyIDToken(tt.token, keys.set, expected()); !errors.Is(err, ErrInvalidIDToken) {
+				t.Fatalf("VerifyIDToken() error = %v, want ErrInvalidIDToken", err)
+			}
+		})
+	}
+}
+
+func TestVerifyIDTokenKeyLookup(t *testing.T) {
+	keys := newTestKeys(t)
+
+	if _, err := VerifyIDToken(sign(t, jwt.SigningMethodRS256, keys.private, "rotated", validClaims()), keys.set, expected()); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("unknown key ID: error = %v, want ErrKeyNotFound", err)
+	}
+
+	// A token without a key ID is checked against the only key there is
+	if _, err := VerifyIDToken(sign(t, jwt.SigningMethodRS256, keys.private, "", validClaims()), keys.set, expected()); err != nil {
+		t.Errorf("no key ID with a single key: error = %v, want nil", err)
+	}
+
+	other := newTestKeys(t)
+	keys.set.keys["k2"] = other.set.keys["k1"]
+	if _, err := VerifyIDToken(sign(t, jwt.SigningMethodRS256, keys.private, "", validClaims()), keys.set, expected()); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("no key ID with several keys: error = %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestFetchKeySet(t *testing.T) {
+	rsaKey := newTestKeys(t).private
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{
+				{"kty": "RSA", "kid": "rsa", "use": "sig", "n": encode(rsaKey.N.Bytes()), "e": "AQAB"},
+				{"kty": "EC", "kid": "ec", "crv": "P-256", "x": encode(ecKey.X.Bytes()), "y": encode(ecKey.Y.Bytes())},
+				{"kty": "RSA", "kid": "enc", "use": "enc", "n": encode(rsaKey.N.Bytes()), "e": "AQAB"},
+				{"kty": "EC", "kid": "off-curve", "crv": "P-256", "x": encode([]byte{1}), "y": encode([]byte{2})},
+				{"kty": "oct", "kid": "hmac", "k": encode([]byte("secret"))},
+			},
+		})
+	}))
+	defer server.Close()
+
+	keys, err := FetchKeySet(context.Background(), server.Client(), server.URL)
+	if err != nil {
+		t.Fatalf("FetchKeySet() error = %v", err)
+	}
+	if len(keys.keys) != 2 || keys.keys["rsa"] == nil || keys.keys["ec"] == nil {
+		t.Fatalf("FetchKeySet() kept keys %v, want only the rsa and ec signing keys", keys.keys)
+	}
+
+	claims := validClaims()
+	if _, err := VerifyIDToken(sign(t, jwt.SigningMethodES256, ecKey, "ec", claims), keys, expected()); err != nil {
+		t.Errorf("ES256 token: error = %v, want nil", err)
+	}
+	if _, err := VerifyIDToken(sign(t, jwt.SigningMethodRS256, rsaKey, "rsa", claims), keys, expected()); err != nil {
+		t.Errorf("RS256 token: error = %v, want nil", err)
+	}
+}
+
+func TestIDTokenStrings(t *testing.T) {
+	token := &IDToken{Claims: jwt.MapClaims{
+		"groups": []interface{}{"engineering", 7, "admins"},
+		"role":   "owner",
+	}}
+
+	if got := token.Strings("groups"); len(got) != 2 || got[0] != "engineering" || got[1] != "admins" {
+		t.Errorf("Strings(groups) = %v, want [engineering admins]", got)
+	}
+	if got := token.Strings("role"); len(got) != 1 || got[0] != "owner" {
+		t.Errorf("Strings(role) = %v, want [owner]", got)
+	}
+	if got := token.Strings("missing"); got != nil {
+		t.Errorf("Strings(missing) = %v, want nil", got)
+	}
+}
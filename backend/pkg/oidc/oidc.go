@@ -0,0 +1,276 @@
+// Package oidc implements the relying-party side of OpenID Connect: provider
+// discovery, the authorization code flow with PKCE and ID token validation.
+//
+//	provider, _ := oidc.Discover(ctx, client, issuer)
+//	verifier, _ := oidc.NewCodeVerifier()
+//	redirect := provider.AuthCodeURL(oidc.AuthRequest{
+//		ClientID:      clientID,
+//		RedirectURI:   redirectURI,
+//		State:         state,
+//		Nonce:         nonce,
+//		CodeChallenge: oidc.CodeChallenge(verifier),
+//	})
+//	// ... the provider redirects back with a code
+//	tokens, _ := provider.Exchange(ctx, client, oidc.ExchangeRequest{...})
+//	keys, _ := oidc.FetchKeySet(ctx, client, provider.JWKSURI)
+//	idToken, err := oidc.VerifyIDToken(tokens.IDToken, keys, oidc.Expected{...})
+//
+// Only what a login needs is covered; access tokens are not used.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DefaultScopes are requested when none are configured
+var DefaultScopes = []string{"openid", "email", "profile"}
+
+// maxResponseSize bounds the provider responses that are read
+const maxResponseSize = 1 << 20
+
+// Provider is the metadata published by an OpenID provider
+type Provider struct {
+	Issuer                        string   `json:"issuer"`
+	AuthorizationEndpoint         string   `json:"authorization_endpoint"`
+	TokenEndpoint                 string   `json:"token_endpoint"`
+	JWKSURI                       string   `json:"jwks_uri"`
+	UserInfoEndpoint              string   `json:"userinfo_endpoint,omitempty"`
+	CodeChallengeMethodsSupported []string `json:"code_challenge_methods_supported,omitempty"`
+}
+
+// Discover fetches the provider metadata of an issuer
+func Discover(ctx context.Context, client *http.Client, issuer string) (*Provider, error) {
+	if err := CheckURL(issuer); err != nil {
+		return nil, fmt.Errorf("invalid issuer: %w", err)
+	}
+
+	discoveryURL := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discoveryURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	var provider Provider
+	if err := doJSON(client, req, &provider); err != nil {
+		return nil, fmt.Errorf("discovery failed: %w", err)
+	}
+
+	// The metadata must be about the issuer it was fetched for
+	if strings.TrimSuffix(provider.Issuer, "/") != strings.TrimSuffix(issuer, "/") {
+		return nil, fmt.Errorf("discovery returned issuer %q, expected %q", provider.Issuer, issuer)
+	}
+	for name, endpoint := range map[string]string{
+		"authorization_endpoint": provider.AuthorizationEndpoint,
+		"token_endpoint":         provider.TokenEndpoint,
+		"jwks_uri":               provider.JWKSURI,
+	} {
+		if err := CheckURL(endpoint); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+	if len(provider.CodeChallengeMethodsSupported) > 0 && !contains(provider.CodeChallengeMethodsSupported, "S256") {
+		return nil, errors.New("provider does not support PKCE with S256")
+	}
+	return &provider, nil
+}
+
+// CheckURL requires an absolute https URL. Plain http is allowed for
+// loopback hosts, so that a provider running locally can be used in tests.
+func CheckURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return errors.New("must be an absolute URL")
+	}
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+		host := u.Hostname()
+		if host == "localhost" {
+			return nil
+		}
+		if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+			return nil
+		}
+		return errors.New("must use https")
+	default:
+		return errors.New("must use https")
+	}
+}
+
+// AuthRequest holds the parameters of an authorization request
+type AuthRequest struct {
+	ClientID      string
+	RedirectURI   string
+	Scopes        []string
+	State         string
+	Nonce         string
+	CodeChallenge string
+	LoginHint     string
+}
+
+// AuthCodeURL returns the URL to send the user to for authorization
+func (p *Provider) AuthCodeURL(req AuthRequest) string {
+	scopes := req.Scopes
+	if len(scopes) == 0 {
+		scopes = DefaultScopes
+	}
+	if !contains(scopes, "openid") {
+		scopes = append([]string{"openid"}, scopes...)
+	}
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", req.ClientID)
+	query.Set("redirect_uri", req.RedirectURI)
+	query.Set("scope", strings.Join(scopes, " "))
+	query.Set("state", req.State)
+	query.Set("nonce", req.Nonce)
+	query.Set("code_challenge", req.CodeChallenge)
+	query.Set("code_challenge_method", "S256")
+	if req.LoginHint != "" {
+		query.Set("login_hint", req.LoginHint)
+	}
+
+	separator := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return p.AuthorizationEndpoint + separator + query.Encode()
+}
+
+// ExchangeRequest holds the parameters of a token request
+type ExchangeRequest struct {
+	ClientID     string
+	ClientSecret string
+	Code         string
+	CodeVerifier string
+	RedirectURI  string
+}
+
+// TokenResponse is a successful token response
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	IDToken     string `json:"id_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// TokenError is an error returned by the token endpoint
+type TokenError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *TokenError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("token request failed: %s: %s", e.Code, e.Description)
+	}
+	return "token request failed: " + e.Code
+}
+
+// Exchange redeems an authorization code at the token endpoint. Confidential
+// clients authenticate with client_secret_basic.
+func (p *Provider) Exchange(ctx context.Context, client *http.Client, req ExchangeRequest) (*TokenResponse, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", req.Code)
+	form.Set("redirect_uri", req.RedirectURI)
+	form.Set("code_verifier", req.CodeVerifier)
+	if req.ClientSecret == "" {
+		form.Set("client_id", req.ClientID)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	httpReq.Header.Set("Accept", "application/json")
+	if req.ClientSecret != "" {
+		httpReq.SetBasicAuth(url.QueryEscape(req.ClientID), url.QueryEscape(req.ClientSecret))
+	}
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		tokenErr := &TokenError{}
+		if json.Unmarshal(body, tokenErr) != nil || tokenErr.Code == "" {
+			return nil, fmt.Errorf("token request failed with status %d", resp.StatusCode)
+		}
+		return nil, tokenErr
+	}
+
+	var tokens TokenResponse
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return nil, fmt.Errorf("invalid token response: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("token response has no ID token")
+	}
+	return &tokens, nil
+}
+
+// NewCodeVerifier returns a random PKCE code verifier
+func NewCodeVerifier() (string, error) {
+	return RandomToken()
+}
+
+// CodeChallenge returns the S256 challenge for a code verifier
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// RandomToken returns 32 random bytes encoded for use in URLs, as a state,
+// nonce or code verifier
+func RandomToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// doJSON performs a request and decodes a successful JSON response
+func doJSON(client *http.Client, req *http.Request, v interface{}) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", req.URL.Redacted(), resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(v)
+}
+
+// contains reports whether values contains value
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
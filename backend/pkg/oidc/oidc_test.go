@@ -0,0 +1,270 @@
+package oidc_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/mlaitechio/vagais/pkg/oidc"
+	"github.com/mlaitechio/vagais/pkg/oidc/oidctest"
+)
+
+const redirectURI = "http://localhost:8080/api/v1/auth/sso/callback"
+
+// login starts a login against the provider and returns the callback's code
+// and state, with the values the client kept for the callback
+func login(t *testing.T, server *oidctest.Server, provider *oidc.Provider) (code, state, verifier, nonce string) {
+	t.Helper()
+	var err error
+	if verifier, err = oidc.NewCodeVerifier(); err != nil {
+		t.Fatal(err)
+	}
+	if nonce, err = oidc.RandomToken(); err != nil {
+		t.Fatal(err)
+	}
+	sentState, err := oidc.RandomToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, state, err = server.Authorize(provider.AuthCodeURL(oidc.AuthRequest{
+		ClientID:      server.ClientID,
+		RedirectURI:   redirectURI,
+		State:         sentState,
+		Nonce:         nonce,
+		CodeChallenge: oidc.CodeChallenge(verifier),
+	}))
+	if err != nil {
+		t.Fatalf("Authorize() error = %v", err)
+	}
+	if state != sentState {
+		t.Fatalf("callback state = %q, want %q", state, sentState)
+	}
+	return code, state, verifier, nonce
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	server := oidctest.NewServer("vagais", "s3cret")
+	defer server.Close()
+	server.SetUser(oidctest.User{
+		Subject:       "u-123",
+		Email:         "ann@example.com",
+		EmailVerified: true,
+		GivenName:     "Ann",
+		Groups:        []string{"engineering", "admins"},
+	})
+	ctx := context.Background()
+	client := server.Client()
+
+	provider, err := oidc.Discover(ctx, client, server.Issuer())
+	if err != nil {
+		t.Fatalf("Discover() error = %v", err)
+	}
+	code, _, verifier, nonce := login(t, server, provider)
+
+	tokens, err := provider.Exchange(ctx, client, oidc.ExchangeRequest{
+		ClientID:     server.ClientID,
+		ClientSecret: server.ClientSecret,
+		Code:         code,
+		CodeVerifier: verifier,
+		RedirectURI:  redirectURI,
+	})
+	if err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+
+	keys, err := oidc.FetchKeySet(ctx, client, provider.JWKSURI)
+	if err != nil {
+		t.Fatalf("FetchKeySet() error = %v", err)
+	}
+	expected := oidc.Expected{Issuer: provider.Issuer, ClientID: server.ClientID, Nonce: nonce}
+	idToken, err := oidc.VerifyIDToken(tokens.IDToken, keys, expected)
+	if err != nil {
+		t.Fatalf("VerifyIDToken() error = %v", err)
+	}
+	if idToken.Subject != "u-123" || idToken.Email != "ann@example.com" || !idToken.EmailVerified || idToken.GivenName != "Ann" {
+		t.Errorf("VerifyIDToken() = %+v, want the signed-in user", idToken)
+	}
+	if groups := idToken.Strings("groups"); len(groups) != 2 || groups[1] != "admins" {
+		t.Errorf("groups = %v, want [engineering admins]", groups)
+	}
+
+	// The token is bound to the nonce of the login it was issued for
+	expected.Nonce = "nonce-of-another-login"
+	if _, err := oidc.VerifyIDToken(tokens.IDToken, keys, expected); !errors.Is(err, oidc.ErrInvalidIDToken) {
+		t.Errorf("VerifyIDToken() with another nonce: error = %v, want ErrInvalidIDToken", err)
+	}
+}
+
+func TestExchangeRejected(t *testing.T) {
+	server := oidctest.NewServer("vagais", "s3cret")
+	defer server.Close()
+	ctx := context.Background()
+	client := server.Client()
+
+	provider, err := oidc.Discover(ctx, client, server.Issuer())
+	if err != nil {
+		t.Fatalf("Discover() error = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*oidc.ExchangeRequest)
+		want   string
+	}{
+		{name: "wrong code verifier", modify: func(r *oidc.ExchangeRequest) { r.CodeVerifier = "guessed" }, want: "invalid_grant"},
+		{name: "missing code verifier", modify: func(r *oidc.ExchangeRequest) { r.CodeVerifier = "" }, want: "invalid_grant"},
+		{name: "other redirect URI", modify: func(r *oidc.ExchangeRequest) { r.RedirectURI = "http://localhost:9999/callback" }, want: "invalid_grant"},
+		{name: "unknown code", modify: func(r *oidc.ExchangeRequest) { r.Code = "forged" }, want: "invalid_grant"},
+		{name: "wrong client secret", modify: func(r *oidc.ExchangeRequest) { r.ClientSecret = "wrong" }, want: "invalid_client"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, verifier, _ := login(t, server, provider)
+			req := oidc.ExchangeRequest{
+				ClientID:     server.ClientID,
+				ClientSecret: server.ClientSecret,
+				Code:         code,
+				CodeVerifier: verifier,
+				RedirectURI:  redirectURI,
+			}
+			tt.modify(&req)
+
+			_, err := provider.Exchange(ctx, client, req)
+			var tokenErr *oidc.TokenError
+			if !errors.As(err, &tokenErr) || tokenErr.Code != tt.want {
+				t.Fatalf("Exchange() error = %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestExchangeCodeIsSingleUse(t *testing.T) {
+	server := oidctest.NewServer("vagais", "s3cret")
+	defer server.Close()
+	ctx := context.Background()
+	client := server.Client()
+
+	provider, err := oidc.Discover(ctx, client, server.Issuer())
+	if err != nil {
+		t.Fatalf("Discover() error = %v", err)
+	}
+	code, _, verifier, _ := login(t, server, provider)
+	req := oidc.ExchangeRequest{
+		ClientID:     server.ClientID,
+		ClientSecret: server.ClientSecret,
+		Code:         code,
+		CodeVerifier: verifier,
+		RedirectURI:  redirectURI,
+	}
+
+	if _, err := provider.Exchange(ctx, client, req); err != nil {
+		t.Fatalf("first Exchange() error = %v", err)
+	}
+	var tokenErr *oidc.TokenError
+	if _, err := provider.Exchange(ctx, client, req); !errors.As(err, &tokenErr) || tokenErr.Code != "invalid_grant" {
+		t.Fatalf("second Exchange() error = %v, want invalid_grant", err)
+	}
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	provider := &oidc.Provider{AuthorizationEndpoint: "https://idp.example.com/authorize?tenant=acme"}
+	raw := provider.AuthCodeURL(oidc.AuthRequest{
+		ClientID:      "vagais",
+		RedirectURI:   redirectURI,
+		Scopes:        []string{"email", "groups"},
+		State:         "state-1",
+		Nonce:         "nonce-1",
+		CodeChallenge: "challenge-1",
+		LoginHint:     "ann@example.com",
+	})
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatalf("AuthCodeURL() = %q is not a URL: %v", raw, err)
+	}
+	want := map[string]string{
+		"tenant":                "acme",
+		"response_type":         "code",
+		"client_id":             "vagais",
+		"redirect_uri":          redirectURI,
+		"scope":                 "openid email groups",
+		"state":                 "state-1",
+		"nonce":                 "nonce-1",
+		"code_challenge":        "challenge-1",
+		"code_challenge_method": "S256",
+		"login_hint":            "ann@example.com",
+	}
+	query := u.Query()
+	for name, value := range want {
+		if got := query.Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestCodeChallenge(t *testing.T) {
+	// RFC 7636, appendix B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	if got, want := oidc.CodeChallenge(verifier), "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"; got != want {
+		t.Errorf("CodeChallenge() = %q, want %q", got, want)
+	}
+
+	first, err := oidc.NewCodeVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := oidc.NewCodeVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// RFC 7636 requires 43 to 128 characters
+	if len(first) < 43 || len(first) > 128 || first == second {
+		t.Errorf("NewCodeVerifier() = %q, %q, want distinct verifiers of 43 to 128 characters", first, second)
+	}
+}
+
+func TestDiscoverRejectsMismatchedIssuer(t *testing.T) {
+	var issuer string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"issuer":"` + issuer + `","authorization_endpoint":"https://idp.example.com/authorize","token_endpoint":"https://idp.example.com/token","jwks_uri":"https://idp.example.com/jwks"}`))
+	}))
+	defer server.Close()
+
+	issuer = "https://idp.example.com"
+	if _, err := oidc.Discover(context.Background(), server.Client(), server.URL); err == nil {
+		t.Error("Discover() accepted metadata for another issuer")
+	}
+
+	issuer = server.URL + "/"
+	if _, err := oidc.Discover(context.Background(), server.Client(), server.URL); err != nil {
+		t.Errorf("Discover() error = %v, want nil for the issuer with a trailing slash", err)
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{"https://idp.example.com", true},
+		{"http://localhost:8080", true},
+		{"http://127.0.0.1:5556/dex", true},
+		{"http://[::1]:5556", true},
+		{"http://idp.example.com", false},
+		{"ftp://idp.example.com", false},
+		{"/relative/path", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if err := oidc.CheckURL(tt.url); (err == nil) != tt.valid {
+			t.Errorf("CheckURL(%q) error = %v, want valid = %v", tt.url, err, tt.valid)
+		}
+	}
+}
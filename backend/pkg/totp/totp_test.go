@@ -0,0 +1,187 @@
+package totp
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key of the RFC 4226 and RFC 6238 test vectors,
+// "12345678901234567890", base32 encoded
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCodeRFC6238(t *testing.T) {
+	// RFC 6238, appendix B, SHA-1. The RFC lists eight digits; the six
+	// digit codes are their last six.
+	tests := []struct {
+		unix int64
+		step int64
+		want string
+	}{
+		{unix: 59, step: 0x1, want: "287082"},
+		{unix: 1111111109, step: 0x23523EC, want: "081804"},
+		{unix: 1111111111, step: 0x23523ED, want: "050471"},
+		{unix: 1234567890, step: 0x273EF07, want: "005924"},
+		{unix: 2000000000, step: 0x3F940AA, want: "279037"},
+		{unix: 20000000000, step: 0x27BC86AA, want: "353130"},
+	}
+
+	for _, tt := range tests {
+		at := time.Unix(tt.unix, 0).UTC()
+		if got := Step(at); got != tt.step {
+			t.Errorf("Step(%d) = %#x, want %#x", tt.unix, got, tt.step)
+		}
+		got, err := Code(rfcSecret, at)
+		if err != nil {
+			t.Fatalf("Code(%d) error = %v", tt.unix, err)
+		}
+		if got != tt.want {
+			t.Errorf("Code(%d) = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestHOTPRFC4226(t *testing.T) {
+	// RFC 4226, appendix D
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	key := []byte("12345678901234567890")
+	for counter, expected := range want {
+		if got := code(key, int64(counter)); got != expected {
+			t.Errorf("HOTP(%d) = %s, want %s", counter, got, expected)
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	// 1111111111 is step 0x23523ED, one second into it
+	now := time.Unix(1111111111, 0)
+	current := Step(now)
+	codeAt := func(step int64) string {
+		code, err := Code(rfcSecret, time.Unix(step*int64(Period.Seconds()), 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	tests := []struct {
+		name   string
+		offset int64
+		skew   int
+		valid  bool
+	}{
+		{name: "current step", offset: 0, skew: 0, valid: true},
+		{name: "previous step without skew", offset: -1, skew: 0, valid: false},
+		{name: "previous step", offset: -1, skew: 1, valid: true},
+		{name: "next step", offset: 1, skew: 1, valid: true},
+		{name: "two steps back", offset: -2, skew: 1, valid: false},
+		{name: "two steps ahead", offset: 2, skew: 1, valid: false},
+		{name: "two steps back with skew 2", offset: -2, skew: 2, valid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := Validate(rfcSecret, codeAt(current+tt.offset), now, tt.skew)
+			if ok != tt.valid {
+				t.Fatalf("Validate() ok = %v, want %v", ok, tt.valid)
+			}
+			// The matched step is reported so that a used code can be refused
+			if ok && step != current+tt.offset {
+				t.Errorf("Validate() step = %#x, want %#x", step, current+tt.offset)
+			}
+		})
+	}
+}
+
+func TestValidateStepBoundary(t *testing.T) {
+	// 59 is the last second of step 1 and 60 the first of step 2
+	last, first := time.Unix(59, 0), time.Unix(60, 0)
+	if Step(last) != 1 || Step(first) != 2 {
+		t.Fatalf("Step(59), Step(60) = %d, %d, want 1, 2", Step(last), Step(first))
+	}
+
+	if step, ok := Validate(rfcSecret, "287082", last, 0); !ok || step != 1 {
+		t.Errorf("step 1 code in its last second: step = %d, ok = %v, want 1, true", step, ok)
+	}
+	if _, ok := Validate(rfcSecret, "287082", first, 0); ok {
+		t.Error("step 1 code accepted in step 2 without skew")
+	}
+	if step, ok := Validate(rfcSecret, "287082", first, 1); !ok || step != 1 {
+		t.Errorf("step 1 code in step 2 with skew 1: step = %d, ok = %v, want 1, true", step, ok)
+	}
+	if _, ok := Validate(rfcSecret, "287082", time.Unix(90, 0), 1); ok {
+		t.Error("step 1 code accepted in step 3 with skew 1")
+	}
+}
+
+func TestValidateInput(t *testing.T) {
+	at := time.Unix(59, 0)
+
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+		valid  bool
+	}{
+		{name: "spaced code", secret: rfcSecret, code: " 287 082 ", valid: true},
+		{name: "lower case spaced secret", secret: strings.ToLower("GEZD GNBV GY3T QOJQ GEZD GNBV GY3T QOJQ"), code: "287082", valid: true},
+		{name: "padded secret", secret: "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ======", code: "287082", valid: true},
+		{name: "wrong code", secret: rfcSecret, code: "287083", valid: false},
+		{name: "short code", secret: rfcSecret, code: "28708", valid: false},
+		{name: "eight digit code", secret: rfcSecret, code: "94287082", valid: false},
+		{name: "empty code", secret: rfcSecret, code: "", valid: false},
+		{name: "invalid secret", secret: "not base32!", code: "287082", valid: false},
+		{name: "empty secret", secret: "", code: "287082", valid: false},
+	}
+
+	for _, tt := range tests {
+		if _, ok := Validate(tt.secret, tt.code, at, 1); ok != tt.valid {
+			t.Errorf("%s: Validate() ok = %v, want %v", tt.name, ok, tt.valid)
+		}
+	}
+
+	if _, err := Code("not base32!", at); err != ErrInvalidSecret {
+		t.Errorf("Code() with an invalid secret: error = %v, want ErrInvalidSecret", err)
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("GenerateSecret() error = %v", err)
+	}
+	key, err := decodeSecret(secret)
+	if err != nil || len(key) != SecretSize {
+		t.Fatalf("GenerateSecret() = %q decodes to %d bytes, %v, want %d", secret, len(key), err, SecretSize)
+	}
+	if other, _ := GenerateSecret(); other == secret {
+		t.Error("GenerateSecret() returned the same secret twice")
+	}
+
+	now := time.Now()
+	code, err := Code(secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Validate(secret, code, now, 0); !ok {
+		t.Error("a generated secret's code does not validate")
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	raw := ProvisioningURI("vagais", "ann@example.com", rfcSecret)
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatalf("ProvisioningURI() = %q is not a URL: %v", raw, err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/vagais:ann@example.com" {
+		t.Errorf("ProvisioningURI() = %q, want otpauth://totp/vagais:ann@example.com", raw)
+	}
+	query := u.Query()
+	for name, want := range map[string]string{"secret": rfcSecret, "issuer": "vagais", "algorithm": "SHA1", "digits": "6", "period": "30"} {
+		if got := query.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}